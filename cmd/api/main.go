@@ -2,10 +2,18 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
@@ -15,12 +23,19 @@ import (
 	"github.com/apt-router/api/internal/utils"
 	"github.com/gin-gonic/gin"
 	"github.com/patrickmn/go-cache"
+	"google.golang.org/grpc"
 )
 
 // main is the entry point for the AptRouter API server
 func main() {
+	validateOnly := flag.Bool("validate-config", false, "validate the configuration, print it with secrets redacted, and exit")
+	flag.Parse()
+
 	// Load configuration with timeout
 	cfg, err := utils.LoadConfig()
+	if *validateOnly {
+		os.Exit(printConfigDiagnostics(cfg, err))
+	}
 	if err != nil {
 		slog.Error("Failed to load configuration", "error", err)
 		os.Exit(1)
@@ -30,11 +45,31 @@ func main() {
 	logger := initLogger(cfg)
 	slog.SetDefault(logger)
 	slog.Info("Starting AptRouter API", "version", "1.0.0", "env", cfg.Server.Env)
+	slog.Debug("Effective configuration", "config", cfg.Redacted())
+	for _, warning := range cfg.Warnings() {
+		slog.Warn("Configuration warning", "warning", warning)
+	}
 
 	// Create root context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Reload provider API keys loaded from Secret Manager or files, to pick up rotations
+	go cfg.WatchSecrets(ctx)
+
+	// Initialize tracing before anything that makes outbound calls
+	shutdownTracing, err := utils.InitTracing(ctx, cfg.Tracing)
+	if err != nil {
+		slog.Error("Failed to initialize tracing", "error", err)
+		os.Exit(1)
+	}
+
+	// Route provider calls through their configured proxies and base URLs, and check they're reachable
+	if err := initProviderNetworks(ctx, cfg); err != nil {
+		slog.Error("Provider connectivity check failed", "error", err)
+		os.Exit(1)
+	}
+
 	// Initialize Firebase service with timeout
 	firebaseService, err := initFirebaseService(cfg)
 	if err != nil {
@@ -42,11 +77,29 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Check the composite indexes queries need exist, rather than failing on first use
+	if err := checkFirestoreIndexes(ctx, cfg, firebaseService); err != nil {
+		slog.Error("Firestore index check failed", "error", err)
+		os.Exit(1)
+	}
+
+	// Convert legacy float64 money fields to micro-USD before serving traffic
+	if cfg.Cost.MigrateMoneyFields {
+		if _, err := firebaseService.MigrateMoneyFields(ctx); err != nil {
+			slog.Error("Failed to migrate money fields", "error", err)
+			os.Exit(1)
+		}
+	}
+
 	// Initialize memory cache with optimized settings
 	memoryCache := cache.New(cfg.Cache.DefaultExpiration, cfg.Cache.CleanupInterval)
 
+	// Layer the shared Firestore cache behind the in-memory cache and listen for remote invalidations
+	sharedCache := services.NewSharedCache(memoryCache, firebaseService, cfg.Cache.Shared)
+	go sharedCache.ListenForInvalidations(ctx)
+
 	// Initialize pricing service and pre-cache data with timeout
-	pricingService := services.NewPricingService(firebaseService)
+	pricingService := services.NewPricingService(firebaseService, sharedCache, services.NewAuditService(firebaseService))
 	pricingCtx, pricingCancel := context.WithTimeout(ctx, 60*time.Second)
 	defer pricingCancel()
 
@@ -55,6 +108,10 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Push model configuration and pricing tier changes into memory as they are written
+	go pricingService.ListenForModelConfigs(ctx)
+	go pricingService.ListenForPricingTiers(ctx)
+
 	// Set Gin mode based on environment
 	if cfg.IsProduction() {
 		gin.SetMode(gin.ReleaseMode)
@@ -64,21 +121,39 @@ func main() {
 	router := gin.New()
 	router.Use(gin.Recovery())
 
+	// Only trust forwarded client IPs from known proxies, since API key IP allowlists rely on them
+	router.RemoteIPHeaders = cfg.Server.RemoteIPHeaders
+	if err := router.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		slog.Error("Invalid trusted proxies configuration", "error", err)
+		os.Exit(1)
+	}
+
 	// Initialize API handlers
-	apiHandler := handlers.NewHandler(cfg, firebaseService, memoryCache, pricingService)
+	apiHandler := handlers.NewHandler(cfg, firebaseService, sharedCache, pricingService)
 
-	// Add request logging middleware
+	// Add tracing, request logging, body size and compression middleware
+	router.Use(apiHandler.TracingMiddleware())
 	router.Use(apiHandler.RequestLogger())
+	router.Use(apiHandler.BodyLimitMiddleware())
+	if cfg.Server.CompressResponses {
+		router.Use(apiHandler.CompressionMiddleware())
+	}
 
 	// Register routes
 	registerRoutes(router, apiHandler)
 
+	// Push users' usage to their metering systems
+	go apiHandler.RunUsageExport(ctx)
+
+	// Run the API key expiry, privacy and request log retention sweeps on one elected replica
+	go apiHandler.RunJobs(ctx)
+
 	// Create HTTP server with optimized settings
 	server := &http.Server{
 		Addr:         ":" + cfg.GetPort(),
 		Handler:      router,
 		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
+		WriteTimeout: cfg.Timeouts.MaxRequest + 30*time.Second, // Outlast the longest provider timeout
 		IdleTimeout:  120 * time.Second,
 		// Performance optimizations
 		MaxHeaderBytes: 128 * 1024, // 128KB
@@ -93,6 +168,24 @@ func main() {
 		}
 	}()
 
+	// Serve the gRPC API for internal consumers, when enabled
+	var grpcServer *grpc.Server
+	if cfg.Server.GRPCPort > 0 {
+		listener, err := net.Listen("tcp", ":"+strconv.Itoa(cfg.Server.GRPCPort))
+		if err != nil {
+			slog.Error("Failed to listen for gRPC", "port", cfg.Server.GRPCPort, "error", err)
+			os.Exit(1)
+		}
+		grpcServer = handlers.NewGRPCServer(apiHandler)
+		go func() {
+			slog.Info("Starting gRPC server", "port", cfg.Server.GRPCPort)
+			if err := grpcServer.Serve(listener); err != nil {
+				slog.Error("Failed to start gRPC server", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
 	// Wait for interrupt signal to gracefully shutdown the server
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -108,10 +201,49 @@ func main() {
 	if err := server.Shutdown(shutdownCtx); err != nil {
 		slog.Error("Server forced to shutdown", "error", err)
 	}
+	if grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-shutdownCtx.Done():
+			slog.Error("gRPC server forced to shutdown")
+			grpcServer.Stop()
+		}
+	}
+
+	// Flush any buffered spans
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Failed to shut down tracing", "error", err)
+	}
 
 	slog.Info("Server exited")
 }
 
+// printConfigDiagnostics reports the result of --validate-config and returns the exit code
+func printConfigDiagnostics(cfg *utils.Config, err error) int {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Configuration is invalid:\n%v\n", err)
+		return 1
+	}
+
+	effective, err := json.MarshalIndent(cfg.Redacted(), "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to print configuration: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Effective configuration (secrets redacted):\n%s\n", effective)
+
+	for _, warning := range cfg.Warnings() {
+		fmt.Printf("warning: %s\n", warning)
+	}
+	fmt.Println("Configuration is valid")
+	return 0
+}
+
 // initLogger initializes the structured logger based on configuration
 func initLogger(cfg *utils.Config) *slog.Logger {
 	var level slog.Level
@@ -143,12 +275,112 @@ func initLogger(cfg *utils.Config) *slog.Logger {
 }
 
 // initFirebaseService initializes the Firebase service with timeout
+// initProviderNetworks applies each provider's proxy and base URL to its clients, then checks that
+// every provider with a platform key can be reached. Failed checks are logged, and stop startup
+// when PROVIDER_CONNECTIVITY_CHECK is require.
+func initProviderNetworks(ctx context.Context, cfg *utils.Config) error {
+	providers := []string{"openai", "anthropic", "google"}
+	for _, provider := range providers {
+		baseURL, proxy := cfg.LLM.ProviderNetwork(provider)
+		network := data.ProviderNetwork{BaseURL: baseURL}
+		if proxy != "" {
+			proxyURL, err := url.Parse(proxy)
+			if err != nil {
+				return fmt.Errorf("invalid %s proxy: %w", provider, err)
+			}
+			network.Proxy = proxyURL
+		}
+		data.SetProviderNetwork(provider, network)
+	}
+
+	if cfg.LLM.ConnectivityCheck == "off" || cfg.Dev.Enabled {
+		return nil
+	}
+
+	checkCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	errs := make([]error, len(providers))
+	var wg sync.WaitGroup
+	for i, provider := range providers {
+		if cfg.ProviderKey(provider) == "" {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = data.CheckProviderConnectivity(checkCtx, provider)
+		}()
+	}
+	wg.Wait()
+
+	var failed []error
+	for i, err := range errs {
+		if err != nil {
+			slog.Warn("Provider is unreachable", "provider", providers[i], "error", err)
+			failed = append(failed, err)
+		} else if cfg.ProviderKey(providers[i]) != "" {
+			slog.Info("Provider is reachable", "provider", providers[i])
+		}
+	}
+	if len(failed) > 0 && cfg.LLM.ConnectivityCheck == "require" {
+		return errors.Join(failed...)
+	}
+	return nil
+}
+
+// checkFirestoreIndexes logs each composite index the API needs that is missing or still building,
+// with the command that creates it, and fails when FIRESTORE_INDEX_CHECK is require. Development
+// mode's in-memory datastore needs no indexes.
+func checkFirestoreIndexes(ctx context.Context, cfg *utils.Config, firebaseService *data.Service) error {
+	if cfg.Firebase.IndexCheck == "off" || cfg.Dev.Enabled {
+		return nil
+	}
+
+	checkCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	statuses, err := firebaseService.CheckIndexes(checkCtx, data.RequiredIndexes)
+	if err != nil {
+		// The check needs permission to list indexes, which the service account may lack
+		if cfg.Firebase.IndexCheck == "require" {
+			return err
+		}
+		slog.Warn("Failed to check Firestore indexes", "error", err)
+		return nil
+	}
+
+	missing := 0
+	for _, status := range statuses {
+		if status.Ready {
+			continue
+		}
+		missing++
+		slog.Warn("Firestore index is not ready",
+			"collection", status.Index.CollectionGroup,
+			"building", status.Exists,
+			"create_with", data.IndexCreateCommand(cfg.Firebase.ProjectID, status.Index))
+	}
+	if missing == 0 {
+		slog.Info("Firestore indexes are ready", "indexes", len(statuses))
+		return nil
+	}
+	if cfg.Firebase.IndexCheck == "require" {
+		return fmt.Errorf("%d of %d Firestore indexes are not ready: deploy firestore.indexes.json with firebase deploy --only firestore:indexes, or run aptrouter-admin check-indexes for the commands that create them", missing, len(statuses))
+	}
+	return nil
+}
+
 func initFirebaseService(cfg *utils.Config) (*data.Service, error) {
 	// Create Firebase config
 	firebaseConfig := &data.FirebaseConfig{
 		ProjectID:          cfg.Firebase.ProjectID,
 		ServiceAccountPath: cfg.Firebase.ServiceAccountPath,
 		UseCLIAuth:         cfg.Firebase.UseCLIAuth,
+		InMemory:           cfg.Dev.Enabled,
+	}
+	if firebaseConfig.InMemory && firebaseConfig.ProjectID == "" {
+		firebaseConfig.ProjectID = "aptrouter-dev"
 	}
 
 	// Initialize Firebase service
@@ -157,6 +389,14 @@ func initFirebaseService(cfg *utils.Config) (*data.Service, error) {
 		return nil, err
 	}
 
+	// The in-memory datastore starts empty, so load the development seed into it
+	if cfg.Dev.Enabled {
+		if err := seedDevDatastore(context.Background(), cfg, service); err != nil {
+			service.Close()
+			return nil, err
+		}
+	}
+
 	// Test connection
 	if err := testFirebaseConnection(context.Background(), service); err != nil {
 		return nil, err
@@ -165,6 +405,40 @@ func initFirebaseService(cfg *utils.Config) (*data.Service, error) {
 	return service, nil
 }
 
+// seedDevDatastore applies the configured seed paths that exist to the in-memory datastore
+func seedDevDatastore(ctx context.Context, cfg *utils.Config, service *data.Service) error {
+	var paths []string
+	for _, path := range cfg.Dev.SeedPaths {
+		if _, err := os.Stat(path); err != nil {
+			slog.Warn("Skipping development seed path", "path", path, "error", err)
+			continue
+		}
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	seed, err := services.LoadSeed(paths...)
+	if err != nil {
+		return fmt.Errorf("failed to load development seed: %w", err)
+	}
+	if err := seed.AddModelPrices(data.ModelPrices()); err != nil {
+		return fmt.Errorf("failed to load development seed: %w", err)
+	}
+	seeder := services.NewSeedService(service, cfg.Security.APIKeySalt)
+	changes, err := seeder.Plan(ctx, seed, false)
+	if err != nil {
+		return fmt.Errorf("failed to plan development seed: %w", err)
+	}
+	if err := seeder.Apply(ctx, changes); err != nil {
+		return fmt.Errorf("failed to apply development seed: %w", err)
+	}
+
+	slog.Info("Seeded in-memory datastore", "paths", paths, "documents", len(changes))
+	return nil
+}
+
 // testFirebaseConnection tests the Firebase connection
 func testFirebaseConnection(ctx context.Context, service *data.Service) error {
 	// Simple health check - try to get default pricing tier
@@ -178,36 +452,186 @@ func testFirebaseConnection(ctx context.Context, service *data.Service) error {
 
 // registerRoutes registers all API routes with proper grouping
 func registerRoutes(router *gin.Engine, handler *handlers.Handler) {
-	// Health check endpoint
+	// Liveness and readiness probes
 	router.GET("/healthz", handler.HealthCheck)
+	router.GET("/readyz", handler.ReadinessCheck)
+
+	// API version metadata and field deprecations
+	router.GET("/versions", handler.ListAPIVersions)
 
 	// API v1 routes
 	v1 := router.Group("/v1")
+	v1.Use(handler.APIVersionMiddleware(handlers.APIVersionV1))
 	{
 		// Public endpoints (require API key authentication)
 		generate := v1.Group("/generate")
-		generate.Use(handler.AuthMiddleware())
+		generate.Use(handler.AuthMiddleware(data.ScopeGenerate), handler.RepeatedFailureMiddleware(), handler.ConcurrencyLimitMiddleware())
 		{
 			generate.POST("", handler.Generate)
 			generate.POST("/stream", handler.GenerateStream)
+			generate.GET("/ws", handler.GenerateWebSocket)
+		}
+
+		// Anthropic Messages-compatible endpoint, routed to any model in the catalog
+		v1.POST("/messages", handler.AuthMiddleware(data.ScopeGenerate), handler.RepeatedFailureMiddleware(), handler.ConcurrencyLimitMiddleware(), handler.Messages)
+
+		// Sessions keep conversation history on the server for stateless clients
+		sessions := v1.Group("/sessions")
+		sessions.Use(handler.AuthMiddleware(data.ScopeGenerate))
+		{
+			sessions.POST("", handler.CreateSession)
+			sessions.GET("/:session_id", handler.GetSession)
+			sessions.DELETE("/:session_id", handler.DeleteSession)
+			sessions.POST("/:session_id/messages", handler.RepeatedFailureMiddleware(), handler.ConcurrencyLimitMiddleware(), handler.SendSessionMessage)
 		}
 
-		// User management endpoints (require JWT authentication)
+		// Cost estimation runs no provider call, but uses the same keys and scope as generation
+		v1.POST("/estimate", handler.AuthMiddleware(data.ScopeGenerate), handler.Estimate)
+		v1.POST("/optimize", handler.AuthMiddleware(data.ScopeGenerate), handler.Optimize)
+
+		// Model catalog, priced for the key's account
+		v1.GET("/models", handler.AuthMiddleware(), handler.ListModels)
+
+		// User management endpoints (require JWT authentication; admins may read them while impersonating)
 		user := v1.Group("/user")
-		user.Use(handler.JWTAuthMiddleware())
+		user.Use(handler.UserViewAuthMiddleware())
 		{
 			user.GET("/profile", handler.GetProfile)
 			user.GET("/balance", handler.GetBalance)
 			user.GET("/usage", handler.GetUsage)
+			user.GET("/usage/logs", handler.GetUsageLogs)
+			user.GET("/savings", handler.GetSavings)
+			user.GET("/ledger", handler.GetLedger)
+			user.GET("/invoices", handler.GetInvoice)
+			user.GET("/credits", handler.GetCredits)
+			user.GET("/referral-code", handler.GetReferralCode)
+			user.POST("/referral-code/redeem", handler.RedeemReferralCode)
+			user.GET("/provider-keys", handler.ListProviderKeys)
+			user.PUT("/provider-keys/:provider", handler.StoreProviderKey)
+			user.DELETE("/provider-keys/:provider", handler.DeleteProviderKey)
+			user.POST("/data-export", handler.RequestDataExport)
+			user.GET("/data-export/:export_id", handler.GetDataExport)
+			user.GET("/data-export/:export_id/download", handler.DownloadDataExport)
+			user.POST("/delete", handler.DeleteAccount)
+		}
+
+		// Billing endpoints (JWT authentication, except the Stripe webhook)
+		billing := v1.Group("/billing")
+		{
+			// Stripe authenticates webhooks with a signature header rather than a user token
+			billing.POST("/webhook", handler.StripeWebhook)
+
+			authed := billing.Group("")
+			authed.Use(handler.JWTAuthMiddleware())
+			{
+				authed.POST("/checkout", handler.CreateCheckoutSession)
+				authed.PUT("/auto-top-up", handler.UpdateAutoTopUp)
+				authed.GET("/spend-alerts", handler.GetSpendAlerts)
+				authed.PUT("/spend-alerts", handler.UpdateSpendAlerts)
+				authed.GET("/usage-export", handler.GetUsageExport)
+				authed.PUT("/usage-export", handler.UpdateUsageExport)
+				authed.GET("/line-items", handler.GetInvoiceLineItems)
+				authed.GET("/currency", handler.GetCurrency)
+				authed.PUT("/currency", handler.UpdateCurrency)
+			}
+		}
+
+		// Organization endpoints (require JWT authentication)
+		org := v1.Group("/org")
+		org.Use(handler.JWTAuthMiddleware())
+		{
+			org.POST("", handler.CreateOrganization)
+			org.GET("/:org_id", handler.GetOrganization)
+			org.GET("/:org_id/members", handler.ListOrgMembers)
+			org.POST("/:org_id/members", handler.SetOrgMember)
+			org.PUT("/:org_id/members/:user_id", handler.SetOrgMember)
+			org.DELETE("/:org_id/members/:user_id", handler.RemoveOrgMember)
+			org.POST("/:org_id/keys", handler.CreateOrgAPIKey)
+			org.GET("/:org_id/usage", handler.GetOrgUsage)
+			org.GET("/:org_id/aliases", handler.ListOrgModelAliases)
+			org.PUT("/:org_id/aliases/:alias", handler.SetOrgModelAlias)
+			org.DELETE("/:org_id/aliases/:alias", handler.DeleteOrgModelAlias)
+			org.GET("/:org_id/system-prompt", handler.GetOrgSystemPrompt)
+			org.PUT("/:org_id/system-prompt", handler.SetOrgSystemPrompt)
+			org.DELETE("/:org_id/system-prompt", handler.DeleteOrgSystemPrompt)
+			org.GET("/:org_id/system-prompt/versions", handler.ListOrgSystemPromptVersions)
+		}
+
+		// Prompt template endpoints (require JWT authentication)
+		templates := v1.Group("/templates")
+		templates.Use(handler.JWTAuthMiddleware())
+		{
+			templates.POST("", handler.CreateTemplate)
+			templates.GET("", handler.ListTemplates)
+			templates.GET("/:template_id", handler.GetTemplate)
+			templates.PUT("/:template_id", handler.UpdateTemplate)
+			templates.DELETE("/:template_id", handler.DeleteTemplate)
+			templates.GET("/:template_id/versions", handler.ListTemplateVersions)
+		}
+
+		// Platform admin endpoints (require JWT authentication as a configured admin user)
+		admin := v1.Group("/admin")
+		admin.Use(handler.JWTAuthMiddleware(), handler.AdminMiddleware())
+		{
+			admin.GET("/audit-events", handler.ListAuditEvents)
+			admin.GET("/experiments", handler.ListExperiments)
+			admin.POST("/experiments", handler.CreateExperiment)
+			admin.PUT("/experiments/:experiment_id", handler.UpdateExperiment)
+			admin.GET("/experiments/:experiment_id/results", handler.GetExperimentResults)
+			admin.GET("/experiments/:experiment_id/shadow-results", handler.GetShadowResults)
+			admin.GET("/routing-rules", handler.ListRoutingRules)
+			admin.POST("/routing-rules", handler.CreateRoutingRule)
+			admin.PUT("/routing-rules/:rule_id", handler.UpdateRoutingRule)
+			admin.DELETE("/routing-rules/:rule_id", handler.DeleteRoutingRule)
+			admin.GET("/quality-evaluations", handler.ListQualityEvaluations)
+			admin.GET("/provider-endpoints", handler.ListProviderEndpoints)
+			admin.GET("/provider-keys", handler.ListProviderKeyPool)
+			admin.GET("/jobs", handler.ListJobs)
+			admin.GET("/pricing-tiers", handler.ListPricingTiers)
+			admin.PUT("/pricing-tiers/:tier_id/models/:model_id", handler.SetTierModelPricing)
+			admin.DELETE("/pricing-tiers/:tier_id/models/:model_id", handler.DeleteTierModelPricing)
+			admin.PUT("/pricing-tiers/:tier_id/optimization", handler.SetTierOptimization)
+			admin.GET("/tenants", handler.ListTenants)
+			admin.POST("/tenants", handler.CreateTenant)
+			admin.PUT("/tenants/:tenant_id", handler.UpdateTenant)
+			admin.GET("/tenants/:tenant_id/usage", handler.GetTenantUsage)
+			admin.PUT("/keys/:key_id/tenant", handler.SetAPIKeyTenant)
+			admin.POST("/request-logs/:request_id/replay", handler.ReplayRequestLog)
+			admin.POST("/usage-rollups/rebuild", handler.RebuildUsageRollups)
+			admin.GET("/reconciliation", handler.ListCostReconciliations)
+			admin.POST("/reconciliation/run", handler.RunCostReconciliation)
+			admin.POST("/reconciliation/billing/:provider", handler.ImportBillingExport)
+			admin.POST("/users/:user_id/credits", handler.GrantCredits)
+			admin.POST("/users/:user_id/impersonate", handler.ImpersonateUser)
+			admin.GET("/service-accounts", handler.ListServiceAccounts)
+			admin.POST("/service-accounts", handler.CreateServiceAccount)
+			admin.POST("/service-accounts/:user_id/keys", handler.CreateServiceAccountAPIKey)
 		}
 
 		// API key management endpoints (require JWT authentication)
 		keys := v1.Group("/keys")
-		keys.Use(handler.JWTAuthMiddleware())
+		keys.Use(handler.UserViewAuthMiddleware())
 		{
 			keys.POST("", handler.CreateAPIKey)
 			keys.GET("", handler.ListAPIKeys)
 			keys.DELETE(":key_id", handler.RevokeAPIKey)
+			keys.POST(":key_id/rotate", handler.RotateAPIKey)
+			keys.GET(":key_id/system-prompt", handler.GetKeySystemPrompt)
+			keys.PUT(":key_id/system-prompt", handler.SetKeySystemPrompt)
+			keys.DELETE(":key_id/system-prompt", handler.DeleteKeySystemPrompt)
+			keys.GET(":key_id/system-prompt/versions", handler.ListKeySystemPromptVersions)
+		}
+	}
+
+	// API v2 routes take the conversation as chat messages and are shimmed onto the v1 pipeline
+	v2 := router.Group("/v2")
+	v2.Use(handler.APIVersionMiddleware(handlers.APIVersionV2))
+	{
+		generate := v2.Group("/generate")
+		generate.Use(handler.AuthMiddleware(data.ScopeGenerate), handler.RepeatedFailureMiddleware(), handler.ConcurrencyLimitMiddleware())
+		{
+			generate.POST("", handler.Generate)
+			generate.POST("/stream", handler.GenerateStream)
 		}
 	}
 }
@@ -0,0 +1,697 @@
+// Command aptrouter-admin administers an AptRouter deployment directly against its configured
+// Firestore project: creating users and API keys, crediting balances, importing and exporting
+// model configurations, checking them against the model price list, tailing request logs,
+// managing Firestore indexes and rewrapping stored secrets after a vault key rotation.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	"github.com/apt-router/api/internal/utils"
+	"github.com/google/uuid"
+)
+
+// adminActorID identifies the tool in audit events
+const adminActorID = "aptrouter-admin"
+
+// command is one aptrouter-admin subcommand
+type command struct {
+	name    string
+	summary string
+	run     func(ctx context.Context, admin *admin, args []string) error
+}
+
+var commands = []command{
+	{"create-user", "create a user", createUser},
+	{"create-key", "issue an API key for a user", createKey},
+	{"credit", "credit or debit a user's balance", creditBalance},
+	{"export-models", "write model configurations as JSON", exportModels},
+	{"import-models", "create or replace model configurations from JSON", importModels},
+	{"check-prices", "report model prices that have drifted from the price list", checkPrices},
+	{"tail-logs", "print recent request logs, optionally following new ones", tailLogs},
+	{"indexes", "write the composite indexes the API needs as firestore.indexes.json", writeIndexes},
+	{"check-indexes", "check the project has every composite index the API needs", checkIndexes},
+	{"rewrap-secrets", "move stored provider keys and usage export tokens to the current vault key", rewrapSecrets},
+}
+
+// admin holds what subcommands need
+type admin struct {
+	config          *utils.Config
+	firebaseService *data.Service
+	out             io.Writer
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	idx := slices.IndexFunc(commands, func(c command) bool { return c.name == flag.Arg(0) })
+	if idx < 0 {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	a := &admin{out: os.Stdout}
+	err := commands[idx].run(ctx, a, flag.Args()[1:])
+	if a.firebaseService != nil {
+		a.firebaseService.Close()
+	}
+	if err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", commands[idx].name, err)
+		}
+		os.Exit(1)
+	}
+}
+
+// connect loads the configuration and connects to Firestore; commands call it once their flags
+// are valid
+func (a *admin) connect() error {
+	cfg, err := utils.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	firebaseService, err := data.NewService(&data.FirebaseConfig{
+		ProjectID:          cfg.Firebase.ProjectID,
+		ServiceAccountPath: cfg.Firebase.ServiceAccountPath,
+		UseCLIAuth:         cfg.Firebase.UseCLIAuth,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to connect to Firestore: %w", err)
+	}
+	a.config, a.firebaseService = cfg, firebaseService
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: aptrouter-admin <command> [flags]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun 'aptrouter-admin <command> -h' for a command's flags. Configuration is read from the\nenvironment and .env, as for the API server.\n")
+}
+
+// newFlagSet creates a subcommand's flag set
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("aptrouter-admin "+name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	return fs
+}
+
+// printJSON writes v as indented JSON
+func (a *admin) printJSON(v interface{}) error {
+	encoder := json.NewEncoder(a.out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// audit records an action taken with the tool
+func (a *admin) audit(ctx context.Context, event *data.AuditEvent) {
+	event.ActorType = data.AuditActorSystem
+	event.ActorID = adminActorID
+	if err := a.firebaseService.RecordAuditEvent(ctx, event); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to record audit event: %v\n", err)
+	}
+}
+
+func createUser(ctx context.Context, a *admin, args []string) error {
+	fs := newFlagSet("create-user")
+	email := fs.String("email", "", "email address (required)")
+	id := fs.String("id", "", "user ID, usually the Firebase Auth UID (default: a random UUID)")
+	tier := fs.String("tier", "", "pricing tier ID (default: the default tier)")
+	balance := fs.Float64("balance", 0, "starting balance in USD")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *email == "" {
+		return fmt.Errorf("-email is required")
+	}
+	if *balance < 0 {
+		return fmt.Errorf("-balance must not be negative")
+	}
+	if *id == "" {
+		*id = uuid.NewString()
+	}
+	if err := a.connect(); err != nil {
+		return err
+	}
+
+	user := &data.User{ID: *id, Email: *email, TierID: *tier, IsActive: true}
+	if err := a.firebaseService.CreateUser(ctx, user); err != nil {
+		return err
+	}
+	if *balance > 0 {
+		if _, err := a.firebaseService.UpdateUserBalance(ctx, user.ID, data.USDToMicros(*balance), data.LedgerEntryAdjustment, ""); err != nil {
+			return fmt.Errorf("user created but the starting balance failed: %w", err)
+		}
+	}
+
+	return a.printJSON(map[string]interface{}{
+		"id":      user.ID,
+		"email":   user.Email,
+		"tier_id": user.TierID,
+		"balance": data.USDToMicros(*balance),
+	})
+}
+
+func createKey(ctx context.Context, a *admin, args []string) error {
+	fs := newFlagSet("create-key")
+	userID := fs.String("user", "", "user ID (required)")
+	name := fs.String("name", "", "key name (required)")
+	scopes := fs.String("scopes", data.ScopeGenerate, "comma-separated scopes: generate, embeddings, admin")
+	orgID := fs.String("org", "", "organization ID to bill instead of the user")
+	testMode := fs.Bool("test", false, "create a test key, answered by a fake provider and never charged")
+	expires := fs.Duration("expires", 0, "expire the key after this long, e.g. 2160h (default never)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *userID == "" || *name == "" {
+		return fmt.Errorf("-user and -name are required")
+	}
+	if *expires < 0 {
+		return fmt.Errorf("-expires must not be negative")
+	}
+	var expiresAt time.Time
+	if *expires > 0 {
+		expiresAt = time.Now().Add(*expires)
+	}
+
+	var keyScopes []string
+	for _, scope := range strings.Split(*scopes, ",") {
+		scope = strings.TrimSpace(scope)
+		if !data.ValidScope(scope) {
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+		keyScopes = append(keyScopes, scope)
+	}
+	if err := a.connect(); err != nil {
+		return err
+	}
+	if _, err := a.firebaseService.GetUserByID(ctx, *userID); err != nil {
+		return err
+	}
+
+	rawKey, err := data.GenerateAPIKey(*testMode)
+	if err != nil {
+		return err
+	}
+	apiKey, err := a.firebaseService.CreateAPIKey(ctx, &data.APIKey{
+		UserID:    *userID,
+		OrgID:     *orgID,
+		KeyHash:   data.HashAPIKey(rawKey, a.config.Security.APIKeySalt),
+		Name:      *name,
+		Scopes:    keyScopes,
+		TestMode:  *testMode,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	after := map[string]interface{}{
+		"user_id":   apiKey.UserID,
+		"name":      apiKey.Name,
+		"scopes":    apiKey.Scopes,
+		"test_mode": apiKey.TestMode,
+	}
+	// The raw key is only ever shown once
+	output := map[string]interface{}{
+		"id":        apiKey.ID,
+		"user_id":   apiKey.UserID,
+		"org_id":    apiKey.OrgID,
+		"name":      apiKey.Name,
+		"scopes":    apiKey.Scopes,
+		"test_mode": apiKey.TestMode,
+		"key":       rawKey,
+	}
+	if !apiKey.ExpiresAt.IsZero() {
+		after["expires_at"] = apiKey.ExpiresAt
+		output["expires_at"] = apiKey.ExpiresAt
+	}
+
+	a.audit(ctx, &data.AuditEvent{
+		Type:     data.AuditAPIKeyCreated,
+		OrgID:    apiKey.OrgID,
+		TargetID: apiKey.ID,
+		After:    after,
+	})
+
+	return a.printJSON(output)
+}
+
+func creditBalance(ctx context.Context, a *admin, args []string) error {
+	fs := newFlagSet("credit")
+	userID := fs.String("user", "", "user ID (required)")
+	amount := fs.Float64("amount", 0, "amount in USD; negative debits the balance (required)")
+	entryType := fs.String("type", string(data.LedgerEntryAdjustment), "ledger entry type: adjustment, topup or refund")
+	reference := fs.String("reference", "", "reference recorded on the ledger entry, such as a ticket or payment ID")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *userID == "" || *amount == 0 {
+		return fmt.Errorf("-user and a non-zero -amount are required")
+	}
+
+	ledgerType := data.LedgerEntryType(*entryType)
+	switch ledgerType {
+	case data.LedgerEntryAdjustment, data.LedgerEntryTopUp, data.LedgerEntryRefund:
+	default:
+		return fmt.Errorf("unsupported ledger entry type %q", *entryType)
+	}
+	if err := a.connect(); err != nil {
+		return err
+	}
+
+	micros := data.USDToMicros(*amount)
+	if _, err := a.firebaseService.UpdateUserBalance(ctx, *userID, micros, ledgerType, *reference); err != nil {
+		return err
+	}
+	balance, err := a.firebaseService.GetUserBalance(ctx, *userID)
+	if err != nil {
+		return err
+	}
+
+	a.audit(ctx, &data.AuditEvent{
+		Type:     data.AuditBalanceCredited,
+		TargetID: *userID,
+		Details: map[string]interface{}{
+			"amount":    micros,
+			"type":      ledgerType,
+			"reference": *reference,
+		},
+	})
+
+	return a.printJSON(map[string]interface{}{
+		"user_id": *userID,
+		"amount":  micros,
+		"balance": balance,
+	})
+}
+
+func exportModels(ctx context.Context, a *admin, args []string) error {
+	fs := newFlagSet("export-models")
+	output := fs.String("o", "", "file to write (default: stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := a.connect(); err != nil {
+		return err
+	}
+
+	configs, err := a.firebaseService.ExportModelConfigs(ctx)
+	if err != nil {
+		return err
+	}
+	if configs == nil {
+		configs = []map[string]interface{}{}
+	}
+
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		a.out = file
+	}
+	if err := a.printJSON(configs); err != nil {
+		return err
+	}
+	if *output != "" {
+		fmt.Fprintf(os.Stderr, "exported %d model configurations to %s\n", len(configs), *output)
+	}
+	return nil
+}
+
+func importModels(ctx context.Context, a *admin, args []string) error {
+	fs := newFlagSet("import-models")
+	input := fs.String("f", "", "JSON file written by export-models, or - for stdin (required)")
+	dryRun := fs.Bool("dry-run", false, "validate the file without writing")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *input == "" {
+		return fmt.Errorf("-f is required")
+	}
+
+	var r io.Reader = os.Stdin
+	if *input != "-" {
+		file, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	// Numbers are kept as integers where they are whole, so they load into integer fields
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	var configs []map[string]interface{}
+	if err := decoder.Decode(&configs); err != nil {
+		return fmt.Errorf("failed to parse model configurations: %w", err)
+	}
+	for i, config := range configs {
+		convertNumbers(config)
+		if err := validateModelConfig(config); err != nil {
+			return fmt.Errorf("model configuration %d: %w", i, err)
+		}
+	}
+	if *dryRun {
+		fmt.Fprintf(a.out, "%d model configurations are valid\n", len(configs))
+		return nil
+	}
+	if err := a.connect(); err != nil {
+		return err
+	}
+
+	if err := a.firebaseService.ImportModelConfigs(ctx, configs); err != nil {
+		return err
+	}
+
+	ids := make([]string, len(configs))
+	for i, config := range configs {
+		ids[i] = config["id"].(string)
+	}
+	a.audit(ctx, &data.AuditEvent{
+		Type:    data.AuditModelConfigUpdated,
+		Details: map[string]interface{}{"imported": ids},
+	})
+
+	fmt.Fprintf(a.out, "imported %d model configurations\n", len(configs))
+	return nil
+}
+
+// validateModelConfig checks the fields the router needs to price and route a model
+func validateModelConfig(config map[string]interface{}) error {
+	id, _ := config["id"].(string)
+	if id == "" {
+		return fmt.Errorf("id is required")
+	}
+	if modelID, _ := config["model_id"].(string); modelID == "" {
+		return fmt.Errorf("%s: model_id is required", id)
+	}
+	if provider, _ := config["provider"].(string); provider == "" {
+		return fmt.Errorf("%s: provider is required", id)
+	}
+	for _, field := range []string{"input_price_per_million", "output_price_per_million"} {
+		var price float64
+		switch v := config[field].(type) {
+		case int64:
+			price = float64(v)
+		case float64:
+			price = v
+		default:
+			return fmt.Errorf("%s: %s must be a number", id, field)
+		}
+		if price < 0 {
+			return fmt.Errorf("%s: %s must not be negative", id, field)
+		}
+	}
+	return nil
+}
+
+// convertNumbers replaces the json.Number values in m, recursively, with int64 or float64
+func convertNumbers(m map[string]interface{}) {
+	for k, v := range m {
+		m[k] = convertNumber(v)
+	}
+}
+
+func convertNumber(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		convertNumbers(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = convertNumber(v[i])
+		}
+	}
+	return v
+}
+
+func checkPrices(ctx context.Context, a *admin, args []string) error {
+	fs := newFlagSet("check-prices")
+	published := fs.String("published", "", "also compare with published prices in LiteLLM's model_prices_and_context_window.json format, from a file or URL")
+	offline := fs.Bool("offline", false, "skip Firestore and only compare with -published")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *offline && *published == "" {
+		return fmt.Errorf("-offline needs -published")
+	}
+
+	list := data.ModelPrices()
+	drifted := 0
+	if !*offline {
+		if err := a.connect(); err != nil {
+			return err
+		}
+		configs, err := a.firebaseService.ExportModelConfigs(ctx)
+		if err != nil {
+			return err
+		}
+		stored := make(map[string]data.ModelPrice, len(configs))
+		for _, config := range configs {
+			// Model configuration documents use the price list's field names
+			raw, err := json.Marshal(config)
+			if err != nil {
+				return err
+			}
+			var price data.ModelPrice
+			if err := json.Unmarshal(raw, &price); err != nil {
+				return fmt.Errorf("failed to parse model configuration %v: %w", config["id"], err)
+			}
+			stored[price.ModelID] = price
+		}
+
+		for _, listed := range list.Models {
+			actual, ok := stored[listed.ModelID]
+			if !ok {
+				fmt.Fprintf(a.out, "missing    %s\n", listed.ModelID)
+				drifted++
+				continue
+			}
+			for _, drift := range listed.Drift(actual) {
+				fmt.Fprintf(a.out, "firestore  %s %s: listed %g, configured %g\n", drift.ModelID, drift.Field, drift.Listed, drift.Actual)
+				drifted++
+			}
+		}
+	}
+
+	if *published != "" {
+		raw, err := readFileOrURL(ctx, *published)
+		if err != nil {
+			return err
+		}
+		drift, unpublished, err := list.PublishedDrift(raw)
+		if err != nil {
+			return err
+		}
+		for _, d := range drift {
+			fmt.Fprintf(a.out, "published  %s %s: listed %g, published %g\n", d.ModelID, d.Field, d.Listed, d.Actual)
+		}
+		drifted += len(drift)
+		if len(unpublished) > 0 {
+			fmt.Fprintf(os.Stderr, "no published price for %s\n", strings.Join(unpublished, ", "))
+		}
+	}
+
+	if drifted > 0 {
+		return fmt.Errorf("%d prices differ from price list %s; correct internal/data/model_prices.json or reseed with aptrouter-seed apply", drifted, list.Version)
+	}
+	fmt.Fprintf(a.out, "all %d models match price list %s\n", len(list.Models), list.Version)
+	return nil
+}
+
+// readFileOrURL reads a local file, or fetches an http or https URL
+func readFileOrURL(ctx context.Context, location string) ([]byte, error) {
+	if !strings.HasPrefix(location, "https://") && !strings.HasPrefix(location, "http://") {
+		return os.ReadFile(location)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %d", location, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func tailLogs(ctx context.Context, a *admin, args []string) error {
+	fs := newFlagSet("tail-logs")
+	userID := fs.String("user", "", "only show this user's requests")
+	limit := fs.Int("n", 20, "number of recent requests to show")
+	follow := fs.Bool("f", false, "keep printing new requests until interrupted")
+	interval := fs.Duration("interval", 2*time.Second, "how often to poll for new requests with -f")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *limit < 1 {
+		return fmt.Errorf("-n must be positive")
+	}
+	if err := a.connect(); err != nil {
+		return err
+	}
+
+	since := time.Time{}
+	for {
+		logs, err := a.firebaseService.ListRecentRequestLogs(ctx, *userID, since, *limit)
+		if err != nil {
+			return err
+		}
+		// Logs come newest first; print them in order
+		for i := len(logs) - 1; i >= 0; i-- {
+			a.printLog(logs[i])
+		}
+		if len(logs) > 0 {
+			since = logs[0].RequestTimestamp
+		}
+
+		if !*follow {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(*interval):
+		}
+	}
+}
+
+// printLog writes one request log as a line
+func (a *admin) printLog(log *data.RequestLog) {
+	line := fmt.Sprintf("%s  %-36s  %-20s  %-24s  %-7s  %6d in  %6d out  %12s  %6dms",
+		log.RequestTimestamp.UTC().Format(time.RFC3339),
+		log.RequestID,
+		log.UserID,
+		log.ModelID,
+		log.Status,
+		log.InputTokens,
+		log.OutputTokens,
+		log.TotalCost,
+		log.DurationMs,
+	)
+	if log.Error != "" {
+		line += "  error=" + log.Error
+	}
+	fmt.Fprintln(a.out, line)
+}
+
+func writeIndexes(ctx context.Context, a *admin, args []string) error {
+	fs := newFlagSet("indexes")
+	output := fs.String("o", "", "file to write, usually firestore.indexes.json (default: stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	file, err := data.IndexesFile(data.RequiredIndexes, data.TTLFields)
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		_, err = a.out.Write(file)
+		return err
+	}
+	if err := os.WriteFile(*output, file, 0o644); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "wrote %d indexes and %d TTL policies to %s; deploy them with firebase deploy --only firestore:indexes\n", len(data.RequiredIndexes), len(data.TTLFields), *output)
+	return nil
+}
+
+func checkIndexes(ctx context.Context, a *admin, args []string) error {
+	fs := newFlagSet("check-indexes")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := a.connect(); err != nil {
+		return err
+	}
+
+	statuses, err := a.firebaseService.CheckIndexes(ctx, data.RequiredIndexes)
+	if err != nil {
+		return err
+	}
+	missing := 0
+	for _, status := range statuses {
+		switch {
+		case status.Ready:
+			continue
+		case status.Exists:
+			fmt.Fprintf(a.out, "building  %s\n", data.IndexCreateCommand(a.config.Firebase.ProjectID, status.Index))
+		default:
+			fmt.Fprintf(a.out, "missing   %s\n", data.IndexCreateCommand(a.config.Firebase.ProjectID, status.Index))
+		}
+		missing++
+	}
+	if missing > 0 {
+		return fmt.Errorf("%d of %d indexes are not ready; deploy firestore.indexes.json with firebase deploy --only firestore:indexes or run the commands above", missing, len(statuses))
+	}
+	fmt.Fprintf(a.out, "all %d indexes are ready\n", len(statuses))
+	return nil
+}
+
+func rewrapSecrets(ctx context.Context, a *admin, args []string) error {
+	fs := newFlagSet("rewrap-secrets")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := a.connect(); err != nil {
+		return err
+	}
+
+	keys, keysErr := services.NewProviderKeyService(a.config, a.firebaseService).RewrapKeys(ctx)
+	fmt.Fprintf(a.out, "examined %d provider keys\n", keys)
+	tokens, tokensErr := services.NewUsageExportService(a.config, a.firebaseService, nil).RewrapTokens(ctx)
+	fmt.Fprintf(a.out, "examined %d usage export tokens\n", tokens)
+	if err := errors.Join(keysErr, tokensErr); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(a.out, "every secret is sealed with %s; the previous vault key can be retired\n", vaultKeyName(a.config))
+	return nil
+}
+
+// vaultKeyName names the current vault key
+func vaultKeyName(cfg *utils.Config) string {
+	if cfg.Vault.KMSKey != "" {
+		return cfg.Vault.KMSKey
+	}
+	return cfg.Vault.MasterKeyID
+}
@@ -0,0 +1,285 @@
+// Command aptrouter-seed brings Firestore in line with declarative seed files and runs data
+// migrations. Seed files declare pricing tiers, users, API keys and models outside the model price
+// list in YAML or JSON, and the price list's models are always seeded; plan shows the difference
+// and apply writes it, so the same files seed a development project and run as a migration step
+// in deployments.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	"github.com/apt-router/api/internal/utils"
+)
+
+// seedActorID identifies the tool in audit events
+const seedActorID = "aptrouter-seed"
+
+// exitDrift is plan's exit status when -detailed-exitcode is set and changes are pending
+const exitDrift = 2
+
+// errDrift reports pending changes to main
+var errDrift = errors.New("changes pending")
+
+// command is one aptrouter-seed subcommand
+type command struct {
+	name    string
+	summary string
+	run     func(ctx context.Context, s *seeder, args []string) error
+}
+
+var commands = []command{
+	{"plan", "show the changes apply would make", plan},
+	{"apply", "run pending migrations, then write the seed's changes", apply},
+	{"migrate", "run pending data migrations only", migrate},
+}
+
+// seeder holds what subcommands need
+type seeder struct {
+	config          *utils.Config
+	firebaseService *data.Service
+	seedService     *services.SeedService
+	out             io.Writer
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	idx := slices.IndexFunc(commands, func(c command) bool { return c.name == flag.Arg(0) })
+	if idx < 0 {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	s := &seeder{out: os.Stdout}
+	err := commands[idx].run(ctx, s, flag.Args()[1:])
+	if s.firebaseService != nil {
+		s.firebaseService.Close()
+	}
+	if errors.Is(err, errDrift) {
+		os.Exit(exitDrift)
+	}
+	if err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", commands[idx].name, err)
+		}
+		os.Exit(1)
+	}
+}
+
+// connect loads the configuration and connects to Firestore; commands call it once their flags
+// and seed files are valid
+func (s *seeder) connect() error {
+	cfg, err := utils.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	firebaseService, err := data.NewService(&data.FirebaseConfig{
+		ProjectID:          cfg.Firebase.ProjectID,
+		ServiceAccountPath: cfg.Firebase.ServiceAccountPath,
+		UseCLIAuth:         cfg.Firebase.UseCLIAuth,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to connect to Firestore: %w", err)
+	}
+	s.config, s.firebaseService = cfg, firebaseService
+	s.seedService = services.NewSeedService(firebaseService, cfg.Security.APIKeySalt)
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: aptrouter-seed <command> [flags]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun 'aptrouter-seed <command> -h' for a command's flags. Configuration is read from the\nenvironment and .env, as for the API server.\n")
+}
+
+// pathList collects repeated -f flags
+type pathList []string
+
+func (p *pathList) String() string { return strings.Join(*p, ",") }
+
+func (p *pathList) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+// seedFlags are the flags plan and apply share
+type seedFlags struct {
+	paths pathList
+	prune bool
+}
+
+// newFlagSet creates a subcommand's flag set
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("aptrouter-seed "+name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	return fs
+}
+
+// register adds the shared seed flags to fs
+func (f *seedFlags) register(fs *flag.FlagSet) {
+	fs.Var(&f.paths, "f", "seed file or directory; repeatable (default: seeds)")
+	fs.BoolVar(&f.prune, "prune", false, "deactivate seeded documents that are no longer in the seed")
+}
+
+// load reads the seed files named by the flags, adding the models of the price list
+func (f *seedFlags) load() (services.Seed, error) {
+	if len(f.paths) == 0 {
+		f.paths = pathList{"seeds"}
+	}
+	seed, err := services.LoadSeed(f.paths...)
+	if err != nil {
+		return nil, err
+	}
+	if err := seed.AddModelPrices(data.ModelPrices()); err != nil {
+		return nil, err
+	}
+	return seed, nil
+}
+
+func plan(ctx context.Context, s *seeder, args []string) error {
+	fs := newFlagSet("plan")
+	var flags seedFlags
+	flags.register(fs)
+	detailed := fs.Bool("detailed-exitcode", false, fmt.Sprintf("exit %d when changes are pending", exitDrift))
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	seed, err := flags.load()
+	if err != nil {
+		return err
+	}
+	if err := s.connect(); err != nil {
+		return err
+	}
+
+	changes, err := s.seedService.Plan(ctx, seed, flags.prune)
+	if err != nil {
+		return err
+	}
+	s.printChanges(changes)
+	if *detailed && len(changes) > 0 {
+		return errDrift
+	}
+	return nil
+}
+
+func apply(ctx context.Context, s *seeder, args []string) error {
+	fs := newFlagSet("apply")
+	var flags seedFlags
+	flags.register(fs)
+	skipMigrations := fs.Bool("skip-migrations", false, "apply the seed without running pending migrations")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	seed, err := flags.load()
+	if err != nil {
+		return err
+	}
+	if err := s.connect(); err != nil {
+		return err
+	}
+
+	if !*skipMigrations {
+		if err := s.runMigrations(ctx); err != nil {
+			return err
+		}
+	}
+
+	changes, err := s.seedService.Plan(ctx, seed, flags.prune)
+	if err != nil {
+		return err
+	}
+	s.printChanges(changes)
+	if err := s.seedService.Apply(ctx, changes); err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	counts := make(map[string]interface{})
+	for _, change := range changes {
+		key := change.Collection + "." + change.Action
+		count, _ := counts[key].(int)
+		counts[key] = count + 1
+	}
+	event := &data.AuditEvent{
+		Type:      data.AuditSeedApplied,
+		ActorType: data.AuditActorSystem,
+		ActorID:   seedActorID,
+		Details:   counts,
+	}
+	if err := s.firebaseService.RecordAuditEvent(ctx, event); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to record audit event: %v\n", err)
+	}
+
+	fmt.Fprintf(s.out, "applied %d changes\n", len(changes))
+	return nil
+}
+
+func migrate(ctx context.Context, s *seeder, args []string) error {
+	fs := newFlagSet("migrate")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := s.connect(); err != nil {
+		return err
+	}
+	return s.runMigrations(ctx)
+}
+
+// runMigrations runs the pending data migrations and reports them
+func (s *seeder) runMigrations(ctx context.Context) error {
+	ran, err := s.firebaseService.RunMigrations(ctx)
+	for _, name := range ran {
+		fmt.Fprintf(s.out, "migrated %s\n", name)
+	}
+	return err
+}
+
+// printChanges writes one line per change, with the fields it sets
+func (s *seeder) printChanges(changes []data.SeedChange) {
+	if len(changes) == 0 {
+		fmt.Fprintln(s.out, "no changes")
+		return
+	}
+
+	symbols := map[string]string{data.SeedCreate: "+", data.SeedUpdate: "~", data.SeedDeactivate: "-"}
+	for _, change := range changes {
+		fields := make([]string, 0, len(change.Fields))
+		for field := range change.Fields {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		fmt.Fprintf(s.out, "%s %s %s/%s", symbols[change.Action], change.Action, change.Collection, change.ID)
+		if change.Action != data.SeedCreate {
+			for _, field := range fields {
+				fmt.Fprintf(s.out, " %s=%v", field, change.Fields[field])
+			}
+		}
+		fmt.Fprintln(s.out)
+	}
+}
@@ -0,0 +1,336 @@
+// Command loadtest drives /v1/generate or /v1/generate/stream with concurrent requests and reports
+// latency percentiles, throughput and status counts. It targets a server in development mode, whose
+// fake providers answer instantly, so the numbers measure AptRouter's own routing, billing and
+// logging. With -inprocess it starts that server itself and also reports allocations per request.
+//
+// Usage:
+//
+//	DEV_MODE=true go run ./cmd/api &
+//	go run ./cmd/loadtest -concurrency 20 -requests 5000
+//	go run ./cmd/loadtest -inprocess -stream -duration 30s
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/handlers"
+	"github.com/apt-router/api/internal/services"
+	"github.com/apt-router/api/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/patrickmn/go-cache"
+)
+
+// options are the command's flags
+type options struct {
+	url         string
+	key         string
+	model       string
+	prompt      string
+	stream      bool
+	concurrency int
+	requests    int
+	duration    time.Duration
+	timeout     time.Duration
+	inProcess   bool
+}
+
+// result is the outcome of one request
+type result struct {
+	status  int
+	latency time.Duration
+	// firstEvent is the time to the first streamed data event; zero for unstreamed requests
+	firstEvent time.Duration
+	err        error
+}
+
+func main() {
+	var opts options
+	flag.StringVar(&opts.url, "url", "http://localhost:8080", "base URL of the API server")
+	flag.StringVar(&opts.key, "key", "apt-dev-test-key", "API key to authenticate with")
+	flag.StringVar(&opts.model, "model", "gpt-4o", "model to request")
+	flag.StringVar(&opts.prompt, "prompt", "Summarize the plot of Hamlet in three sentences.", "prompt to send")
+	flag.BoolVar(&opts.stream, "stream", false, "drive /v1/generate/stream instead of /v1/generate")
+	flag.IntVar(&opts.concurrency, "concurrency", 10, "number of concurrent clients")
+	flag.IntVar(&opts.requests, "requests", 1000, "total requests to send; ignored when -duration is set")
+	flag.DurationVar(&opts.duration, "duration", 0, "send requests for this long instead of a fixed number")
+	flag.DurationVar(&opts.timeout, "timeout", 30*time.Second, "timeout of each request")
+	flag.BoolVar(&opts.inProcess, "inprocess", false, "start a development mode server in this process and report its allocations")
+	flag.Parse()
+
+	if opts.concurrency < 1 || (opts.duration <= 0 && opts.requests < 1) {
+		fmt.Fprintln(os.Stderr, "loadtest: -concurrency and -requests must be positive")
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, opts, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "loadtest: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run sends the load and writes the report to out
+func run(ctx context.Context, opts options, out io.Writer) error {
+	if opts.inProcess {
+		server, closeServer, err := startServer()
+		if err != nil {
+			return err
+		}
+		defer closeServer()
+		opts.url = server.URL
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"model": opts.model, "prompt": opts.prompt})
+	if err != nil {
+		return err
+	}
+	endpoint := strings.TrimSuffix(opts.url, "/") + "/v1/generate"
+	if opts.stream {
+		endpoint += "/stream"
+	}
+	client := &http.Client{
+		Timeout:   opts.timeout,
+		Transport: &http.Transport{MaxIdleConnsPerHost: opts.concurrency},
+	}
+
+	// Warm up connections and caches so the first requests don't skew the percentiles
+	if res := send(ctx, client, endpoint, opts.key, body, opts.stream); res.err != nil || res.status != http.StatusOK {
+		return fmt.Errorf("warm-up request failed: %s", describe(res))
+	}
+
+	if opts.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.duration)
+		defer cancel()
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	var sent atomic.Int64
+	results := make([][]result, opts.concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if opts.duration <= 0 && sent.Add(1) > int64(opts.requests) {
+					return
+				}
+				res := send(ctx, client, endpoint, opts.key, body, opts.stream)
+				if errors.Is(res.err, context.Canceled) || errors.Is(res.err, context.DeadlineExceeded) {
+					return
+				}
+				results[i] = append(results[i], res)
+			}
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	var all []result
+	for _, worker := range results {
+		all = append(all, worker...)
+	}
+	if len(all) == 0 {
+		return errors.New("no requests completed")
+	}
+
+	report(out, opts, all, elapsed)
+	if opts.inProcess {
+		n := uint64(len(all))
+		fmt.Fprintf(out, "allocations  %d per request, %d B per request (server and load generator)\n",
+			(after.Mallocs-before.Mallocs)/n, (after.TotalAlloc-before.TotalAlloc)/n)
+	}
+	return nil
+}
+
+// send makes one generate request, reading a stream to its end
+func send(ctx context.Context, client *http.Client, endpoint, key string, body []byte, stream bool) result {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return result{err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+key)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return result{err: err}
+	}
+	defer resp.Body.Close()
+
+	res := result{status: resp.StatusCode}
+	if stream && resp.StatusCode == http.StatusOK {
+		reader := bufio.NewReader(resp.Body)
+		for {
+			line, err := reader.ReadString('\n')
+			if res.firstEvent == 0 && strings.HasPrefix(line, "data:") {
+				res.firstEvent = time.Since(start)
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				res.err = err
+				break
+			}
+		}
+	} else if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		res.err = err
+	}
+	res.latency = time.Since(start)
+	return res
+}
+
+// describe summarizes a failed request
+func describe(res result) string {
+	if res.err != nil {
+		return res.err.Error()
+	}
+	return fmt.Sprintf("status %d", res.status)
+}
+
+// report writes the results' status counts, throughput and latency percentiles
+func report(out io.Writer, opts options, results []result, elapsed time.Duration) {
+	statuses := make(map[int]int)
+	var failed int
+	var latencies, firstEvents []time.Duration
+	for _, res := range results {
+		if res.err != nil {
+			failed++
+			continue
+		}
+		statuses[res.status]++
+		if res.status != http.StatusOK {
+			continue
+		}
+		latencies = append(latencies, res.latency)
+		if res.firstEvent > 0 {
+			firstEvents = append(firstEvents, res.firstEvent)
+		}
+	}
+
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	counts := make([]string, 0, len(codes))
+	for _, code := range codes {
+		counts = append(counts, fmt.Sprintf("%d=%d", code, statuses[code]))
+	}
+
+	fmt.Fprintf(out, "target       %s (%s, concurrency %d)\n", opts.url, opts.model, opts.concurrency)
+	fmt.Fprintf(out, "requests     %d in %s, %d failed without a response\n", len(results), elapsed.Round(time.Millisecond), failed)
+	fmt.Fprintf(out, "statuses     %s\n", strings.Join(counts, " "))
+	fmt.Fprintf(out, "throughput   %.1f req/s\n", float64(len(results))/elapsed.Seconds())
+	if len(latencies) > 0 {
+		fmt.Fprintf(out, "latency      %s (successful requests)\n", percentiles(latencies))
+	}
+	if len(firstEvents) > 0 {
+		fmt.Fprintf(out, "first event  %s\n", percentiles(firstEvents))
+	}
+}
+
+// percentiles formats the p50, p95, p99 and maximum of durations, which it sorts
+func percentiles(durations []time.Duration) string {
+	slices.Sort(durations)
+	at := func(p float64) time.Duration {
+		return durations[int(p*float64(len(durations)-1))]
+	}
+	return fmt.Sprintf("p50=%s p95=%s p99=%s max=%s",
+		at(0.50).Round(time.Microsecond), at(0.95).Round(time.Microsecond), at(0.99).Round(time.Microsecond), durations[len(durations)-1].Round(time.Microsecond))
+}
+
+// startServer starts the generate routes in development mode, with an in-memory datastore loaded
+// from the development seed, the way DEV_MODE=true go run ./cmd/api serves them
+func startServer() (*httptest.Server, func(), error) {
+	os.Setenv("DEV_MODE", "true")
+	cfg, err := utils.LoadConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	// Request logging would dominate the allocations being measured
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError})))
+
+	projectID := cfg.Firebase.ProjectID
+	if projectID == "" {
+		projectID = "aptrouter-dev"
+	}
+	firebaseService, err := data.NewService(&data.FirebaseConfig{ProjectID: projectID, InMemory: true})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to start in-memory datastore: %w", err)
+	}
+
+	ctx := context.Background()
+	seed, err := services.LoadSeed(cfg.Dev.SeedPaths...)
+	if err != nil {
+		firebaseService.Close()
+		return nil, nil, fmt.Errorf("failed to load development seed (run from the repository root or set DEV_SEED_PATHS): %w", err)
+	}
+	if err := seed.AddModelPrices(data.ModelPrices()); err != nil {
+		firebaseService.Close()
+		return nil, nil, fmt.Errorf("failed to load development seed: %w", err)
+	}
+	seeder := services.NewSeedService(firebaseService, cfg.Security.APIKeySalt)
+	changes, err := seeder.Plan(ctx, seed, false)
+	if err == nil {
+		err = seeder.Apply(ctx, changes)
+	}
+	if err != nil {
+		firebaseService.Close()
+		return nil, nil, fmt.Errorf("failed to apply development seed: %w", err)
+	}
+
+	sharedCache := services.NewSharedCache(cache.New(cfg.Cache.DefaultExpiration, cfg.Cache.CleanupInterval), firebaseService, false)
+	pricingService := services.NewPricingService(firebaseService, sharedCache, services.NewAuditService(firebaseService))
+	if err := pricingService.PreCacheData(ctx); err != nil {
+		firebaseService.Close()
+		return nil, nil, fmt.Errorf("failed to pre-cache pricing data: %w", err)
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	handler := handlers.NewHandler(cfg, firebaseService, sharedCache, pricingService)
+	router := gin.New()
+	router.Use(gin.Recovery(), handler.TracingMiddleware(), handler.RequestLogger(), handler.BodyLimitMiddleware())
+	generate := router.Group("/v1/generate")
+	generate.Use(handler.APIVersionMiddleware(handlers.APIVersionV1), handler.AuthMiddleware(data.ScopeGenerate), handler.RepeatedFailureMiddleware(), handler.ConcurrencyLimitMiddleware())
+	generate.POST("", handler.Generate)
+	generate.POST("/stream", handler.GenerateStream)
+
+	server := httptest.NewServer(router)
+	return server, func() {
+		server.Close()
+		firebaseService.Close()
+	}, nil
+}
@@ -0,0 +1,79 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"google.golang.org/api/iterator"
+)
+
+// modelAliasesCollection holds model aliases; global aliases have an empty org_id
+const modelAliasesCollection = "model_aliases"
+
+// ModelAlias maps a stable model name to a concrete model version, globally or for one organization
+type ModelAlias struct {
+	Alias     string    `firestore:"alias" json:"alias"`
+	ModelID   string    `firestore:"model_id" json:"model_id"`
+	OrgID     string    `firestore:"org_id" json:"org_id,omitempty"`
+	UpdatedBy string    `firestore:"updated_by,omitempty" json:"updated_by,omitempty"`
+	UpdatedAt time.Time `firestore:"updated_at" json:"updated_at"`
+}
+
+// modelAliasDocID returns the document ID for an alias, unique per organization
+func modelAliasDocID(orgID, alias string) string {
+	if orgID == "" {
+		return "global_" + alias
+	}
+	return orgID + "_" + alias
+}
+
+// ListModelAliases lists the aliases for an organization, or the global aliases when orgID is empty
+func (s *Service) ListModelAliases(ctx context.Context, orgID string) ([]*ModelAlias, error) {
+	iter := s.dbClient.Collection(modelAliasesCollection).Where("org_id", "==", orgID).Documents(ctx)
+	defer iter.Stop()
+
+	var aliases []*ModelAlias
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list model aliases: %w", err)
+		}
+
+		var alias ModelAlias
+		if err := doc.DataTo(&alias); err != nil {
+			slog.Warn("Failed to parse model alias", "doc_id", doc.Ref.ID, "error", err)
+			continue
+		}
+
+		aliases = append(aliases, &alias)
+	}
+
+	return aliases, nil
+}
+
+// SetModelAlias creates or repoints a model alias
+func (s *Service) SetModelAlias(ctx context.Context, alias *ModelAlias) error {
+	alias.UpdatedAt = time.Now()
+
+	if _, err := s.dbClient.Collection(modelAliasesCollection).Doc(modelAliasDocID(alias.OrgID, alias.Alias)).Set(ctx, alias); err != nil {
+		return fmt.Errorf("failed to set model alias: %w", err)
+	}
+
+	slog.Info("Model alias set", "org_id", alias.OrgID, "alias", alias.Alias, "model_id", alias.ModelID, "updated_by", alias.UpdatedBy)
+	return nil
+}
+
+// DeleteModelAlias removes a model alias
+func (s *Service) DeleteModelAlias(ctx context.Context, orgID, alias string) error {
+	if _, err := s.dbClient.Collection(modelAliasesCollection).Doc(modelAliasDocID(orgID, alias)).Delete(ctx); err != nil {
+		return fmt.Errorf("failed to delete model alias: %w", err)
+	}
+
+	slog.Info("Model alias deleted", "org_id", orgID, "alias", alias)
+	return nil
+}
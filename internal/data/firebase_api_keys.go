@@ -0,0 +1,209 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GetAPIKey gets an active API key by its ID
+func (s *Service) GetAPIKey(ctx context.Context, keyID string) (*APIKey, error) {
+	ctx, span := startSpan(ctx, "GetAPIKey", "api_keys")
+	defer span.End()
+
+	doc, err := s.dbClient.Collection("api_keys").Doc(keyID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API key: %w", err)
+	}
+
+	var apiKey APIKey
+	if err := doc.DataTo(&apiKey); err != nil {
+		return nil, fmt.Errorf("failed to parse API key: %w", err)
+	}
+	if apiKey.Status != "active" {
+		return nil, ErrAPIKeyNotFound
+	}
+	return &apiKey, nil
+}
+
+// RotateAPIKey replaces an active API key's secret with the one hashing to newHash, keeping its ID,
+// name, scopes and restrictions. The old secret keeps working for grace; a second rotation within
+// the grace period ends it, since only the latest previous secret is kept.
+func (s *Service) RotateAPIKey(ctx context.Context, keyID, newHash string, grace time.Duration) (*APIKey, error) {
+	ctx, span := startSpan(ctx, "RotateAPIKey", "api_keys")
+	defer span.End()
+
+	ref := s.dbClient.Collection("api_keys").Doc(keyID)
+	var apiKey APIKey
+	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return ErrAPIKeyNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := doc.DataTo(&apiKey); err != nil {
+			return fmt.Errorf("failed to parse API key: %w", err)
+		}
+		if apiKey.Status != "active" {
+			return ErrAPIKeyNotFound
+		}
+
+		now := time.Now()
+		apiKey.PreviousKeyHash = apiKey.KeyHash
+		apiKey.PreviousKeyExpiresAt = now.Add(grace)
+		apiKey.KeyHash = newHash
+		apiKey.RotatedAt = now
+		return tx.Update(ref, []firestore.Update{
+			{Path: "key_hash", Value: apiKey.KeyHash},
+			{Path: "previous_key_hash", Value: apiKey.PreviousKeyHash},
+			{Path: "previous_key_expires_at", Value: apiKey.PreviousKeyExpiresAt},
+			{Path: "rotated_at", Value: apiKey.RotatedAt},
+		})
+	})
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate API key: %w", err)
+	}
+
+	slog.Info("API key rotated", "api_key_id", keyID, "user_id", apiKey.UserID, "previous_key_expires_at", apiKey.PreviousKeyExpiresAt)
+	return &apiKey, nil
+}
+
+// ListUserAPIKeys lists every API key a user owns, whatever its status, newest first
+func (s *Service) ListUserAPIKeys(ctx context.Context, userID string) ([]*APIKey, error) {
+	ctx, span := startSpan(ctx, "ListUserAPIKeys", "api_keys")
+	defer span.End()
+
+	iter := s.dbClient.Collection("api_keys").Where("user_id", "==", userID).Documents(ctx)
+	defer iter.Stop()
+
+	var apiKeys []*APIKey
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list API keys: %w", err)
+		}
+
+		var apiKey APIKey
+		if err := doc.DataTo(&apiKey); err != nil {
+			return nil, fmt.Errorf("failed to parse API key: %w", err)
+		}
+		apiKeys = append(apiKeys, &apiKey)
+	}
+	// Sorted here rather than in the query, which would need a composite index
+	sort.Slice(apiKeys, func(i, j int) bool { return apiKeys[i].CreatedAt.After(apiKeys[j].CreatedAt) })
+	return apiKeys, nil
+}
+
+// ListExpiringAPIKeys lists the active API keys expiring at or before before, soonest first
+func (s *Service) ListExpiringAPIKeys(ctx context.Context, before time.Time) ([]*APIKey, error) {
+	ctx, span := startSpan(ctx, "ListExpiringAPIKeys", "api_keys")
+	defer span.End()
+
+	iter := s.dbClient.Collection("api_keys").
+		Where("status", "==", "active").
+		Where("expires_at", "<=", before).
+		OrderBy("expires_at", firestore.Asc).
+		Documents(ctx)
+	defer iter.Stop()
+
+	var apiKeys []*APIKey
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list expiring API keys: %w", err)
+		}
+
+		var apiKey APIKey
+		if err := doc.DataTo(&apiKey); err != nil {
+			return nil, fmt.Errorf("failed to parse API key: %w", err)
+		}
+		apiKeys = append(apiKeys, &apiKey)
+	}
+	return apiKeys, nil
+}
+
+// ExpireAPIKey sets an active API key past its expiry to the expired status, reporting whether it
+// did. It is a no-op for keys already expired, revoked or extended by another replica.
+func (s *Service) ExpireAPIKey(ctx context.Context, keyID string, now time.Time) (bool, error) {
+	ctx, span := startSpan(ctx, "ExpireAPIKey", "api_keys")
+	defer span.End()
+
+	ref := s.dbClient.Collection("api_keys").Doc(keyID)
+	var expired bool
+	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		expired = false
+
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var apiKey APIKey
+		if err := doc.DataTo(&apiKey); err != nil {
+			return fmt.Errorf("failed to parse API key: %w", err)
+		}
+		if apiKey.Status != "active" || !apiKey.Expired(now) {
+			return nil
+		}
+
+		expired = true
+		return tx.Update(ref, []firestore.Update{{Path: "status", Value: "expired"}})
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to expire API key: %w", err)
+	}
+	return expired, nil
+}
+
+// ClaimAPIKeyExpiryWarning records that an active API key's owner is being warned of its expiry,
+// reporting false when they already were, so only one replica sends each warning
+func (s *Service) ClaimAPIKeyExpiryWarning(ctx context.Context, keyID string) (bool, error) {
+	ctx, span := startSpan(ctx, "ClaimAPIKeyExpiryWarning", "api_keys")
+	defer span.End()
+
+	ref := s.dbClient.Collection("api_keys").Doc(keyID)
+	var claimed bool
+	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		claimed = false
+
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var apiKey APIKey
+		if err := doc.DataTo(&apiKey); err != nil {
+			return fmt.Errorf("failed to parse API key: %w", err)
+		}
+		if apiKey.Status != "active" || !apiKey.ExpiryWarnedAt.IsZero() {
+			return nil
+		}
+
+		claimed = true
+		return tx.Update(ref, []firestore.Update{{Path: "expiry_warned_at", Value: time.Now()}})
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to claim API key expiry warning: %w", err)
+	}
+	return claimed, nil
+}
@@ -0,0 +1,165 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// auditEventsCollection holds administrative and security events
+const auditEventsCollection = "audit_events"
+
+// AuditEventType identifies the kind of audited action
+type AuditEventType string
+
+const (
+	AuditAPIKeyCreated         AuditEventType = "api_key.created"
+	AuditAPIKeyRevoked         AuditEventType = "api_key.revoked"
+	AuditAPIKeyRotated         AuditEventType = "api_key.rotated"
+	AuditAPIKeyExpired         AuditEventType = "api_key.expired"
+	AuditServiceAccountCreated AuditEventType = "service_account.created"
+	AuditOrgMemberUpdated      AuditEventType = "org_member.updated"
+	AuditOrgMemberRemoved      AuditEventType = "org_member.removed"
+	AuditModelAliasUpdated     AuditEventType = "model_alias.updated"
+	AuditModelAliasDeleted     AuditEventType = "model_alias.deleted"
+	AuditModelConfigUpdated    AuditEventType = "model_config.updated"
+	AuditModelConfigDeleted    AuditEventType = "model_config.deleted"
+	AuditPricingTierUpdated    AuditEventType = "pricing_tier.updated"
+	AuditPricingTierDeleted    AuditEventType = "pricing_tier.deleted"
+	AuditBalanceCredited       AuditEventType = "balance.credited"
+	AuditAutoTopUpUpdated      AuditEventType = "billing.auto_top_up_updated"
+	AuditSpendAlertsUpdated    AuditEventType = "billing.spend_alerts_updated"
+	AuditSpendAlertFired       AuditEventType = "billing.spend_alert_fired"
+	AuditUsageExportUpdated    AuditEventType = "billing.usage_export_updated"
+	AuditCurrencyUpdated       AuditEventType = "billing.currency_updated"
+	AuditCreditGranted         AuditEventType = "credit.granted"
+	AuditReferralRedeemed      AuditEventType = "referral.redeemed"
+	AuditProviderKeyStored     AuditEventType = "provider_key.stored"
+	AuditProviderKeyDeleted    AuditEventType = "provider_key.deleted"
+	AuditSystemPromptUpdated   AuditEventType = "system_prompt.updated"
+	AuditSystemPromptDeleted   AuditEventType = "system_prompt.deleted"
+	AuditTemplateUpdated       AuditEventType = "prompt_template.updated"
+	AuditTemplateDeleted       AuditEventType = "prompt_template.deleted"
+	AuditExperimentUpdated     AuditEventType = "experiment.updated"
+	AuditRoutingRuleUpdated    AuditEventType = "routing_rule.updated"
+	AuditRoutingRuleDeleted    AuditEventType = "routing_rule.deleted"
+	AuditTenantUpdated         AuditEventType = "tenant.updated"
+	AuditAPIKeyTenantUpdated   AuditEventType = "api_key.tenant_updated"
+	AuditAuthFailed            AuditEventType = "auth.failed"
+	AuditAdminAccessDenied     AuditEventType = "auth.admin_denied"
+	AuditSeedApplied           AuditEventType = "seed.applied"
+	AuditRequestReplayed       AuditEventType = "request_log.replayed"
+	AuditImpersonationStarted  AuditEventType = "impersonation.started"
+	AuditImpersonatedRequest   AuditEventType = "impersonation.request"
+	AuditDataExportRequested   AuditEventType = "user.data_export_requested"
+	AuditUserDeleted           AuditEventType = "user.deleted"
+	AuditUserPurged            AuditEventType = "user.purged"
+	AuditBillingExportImported AuditEventType = "provider_billing.imported"
+)
+
+// Actor types recorded on audit events
+const (
+	AuditActorUser      = "user"
+	AuditActorAPIKey    = "api_key"
+	AuditActorSystem    = "system"
+	AuditActorAnonymous = "anonymous"
+)
+
+// AuditEvent records who did what to which resource, with the resource's state before and after
+type AuditEvent struct {
+	ID        string         `firestore:"id" json:"id"`
+	Type      AuditEventType `firestore:"type" json:"type"`
+	ActorType string         `firestore:"actor_type" json:"actor_type"`
+	ActorID   string         `firestore:"actor_id,omitempty" json:"actor_id,omitempty"`
+	OrgID     string         `firestore:"org_id,omitempty" json:"org_id,omitempty"`
+	// TargetID identifies the affected resource, e.g. a key, member or model ID
+	TargetID  string                 `firestore:"target_id,omitempty" json:"target_id,omitempty"`
+	IPAddress string                 `firestore:"ip_address,omitempty" json:"ip_address,omitempty"`
+	UserAgent string                 `firestore:"user_agent,omitempty" json:"user_agent,omitempty"`
+	RequestID string                 `firestore:"request_id,omitempty" json:"request_id,omitempty"`
+	Before    interface{}            `firestore:"before,omitempty" json:"before,omitempty"`
+	After     interface{}            `firestore:"after,omitempty" json:"after,omitempty"`
+	Details   map[string]interface{} `firestore:"details,omitempty" json:"details,omitempty"`
+	CreatedAt time.Time              `firestore:"created_at" json:"created_at"`
+}
+
+// AuditEventFilter narrows an audit event query; empty fields match everything
+type AuditEventFilter struct {
+	Type       AuditEventType
+	ActorID    string
+	OrgID      string
+	Since      time.Time
+	Until      time.Time
+	Limit      int
+	StartAfter string
+}
+
+// RecordAuditEvent stores an audit event
+func (s *Service) RecordAuditEvent(ctx context.Context, event *AuditEvent) error {
+	ref := s.dbClient.Collection(auditEventsCollection).NewDoc()
+	event.ID = ref.ID
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+
+	if _, err := ref.Set(ctx, event); err != nil {
+		return fmt.Errorf("failed to record audit event: %w", err)
+	}
+	return nil
+}
+
+// ListAuditEvents lists audit events matching filter, newest first.
+// When filter.StartAfter is non-empty, listing resumes after that event ID.
+func (s *Service) ListAuditEvents(ctx context.Context, filter AuditEventFilter) ([]*AuditEvent, error) {
+	query := s.dbClient.Collection(auditEventsCollection).Query
+	if filter.Type != "" {
+		query = query.Where("type", "==", string(filter.Type))
+	}
+	if filter.ActorID != "" {
+		query = query.Where("actor_id", "==", filter.ActorID)
+	}
+	if filter.OrgID != "" {
+		query = query.Where("org_id", "==", filter.OrgID)
+	}
+	if !filter.Since.IsZero() {
+		query = query.Where("created_at", ">=", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		query = query.Where("created_at", "<", filter.Until)
+	}
+	query = query.OrderBy("created_at", firestore.Desc).Limit(filter.Limit)
+
+	if filter.StartAfter != "" {
+		cursor, err := s.dbClient.Collection(auditEventsCollection).Doc(filter.StartAfter).Get(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("invalid audit event cursor: %w", err)
+		}
+		query = query.StartAfter(cursor)
+	}
+
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+
+	var events []*AuditEvent
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list audit events: %w", err)
+		}
+
+		var event AuditEvent
+		if err := doc.DataTo(&event); err != nil {
+			continue // Skip malformed events
+		}
+
+		events = append(events, &event)
+	}
+
+	return events, nil
+}
@@ -0,0 +1,228 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrPaymentAlreadyProcessed is returned when a payment has already been credited
+var ErrPaymentAlreadyProcessed = errors.New("payment already processed")
+
+// paymentsCollection is the Firestore collection holding credited payments, keyed by provider payment ID
+const paymentsCollection = "payments"
+
+// AutoTopUpSettings configures automatic balance top-ups for a user
+type AutoTopUpSettings struct {
+	Enabled         bool      `firestore:"enabled" json:"enabled"`
+	Threshold       MicroUSD  `firestore:"threshold_micros" json:"threshold"`
+	Amount          MicroUSD  `firestore:"amount_micros" json:"amount"`
+	PaymentMethodID string    `firestore:"payment_method_id,omitempty" json:"-"`
+	LastTriggeredAt time.Time `firestore:"last_triggered_at,omitempty" json:"last_triggered_at,omitempty"`
+}
+
+// Payment records a payment credited to a user's balance
+type Payment struct {
+	ID        string    `firestore:"id"`
+	UserID    string    `firestore:"user_id"`
+	Amount    MicroUSD  `firestore:"amount_micros"`
+	Source    string    `firestore:"source"`
+	CreatedAt time.Time `firestore:"created_at"`
+}
+
+// InvoiceLineItem summarizes a user's usage of a single model over a billing period
+type InvoiceLineItem struct {
+	ModelID      string   `json:"model_id"`
+	Provider     string   `json:"provider"`
+	Requests     int      `json:"requests"`
+	InputTokens  int      `json:"input_tokens"`
+	OutputTokens int      `json:"output_tokens"`
+	BYOKRequests int      `json:"byok_requests"`
+	PlatformFees MicroUSD `json:"platform_fees"`
+	// OptimizerCosts is the part of Amount spent on prompt optimization
+	OptimizerCosts MicroUSD `json:"optimizer_costs"`
+	Amount         MicroUSD `json:"amount"`
+}
+
+// CreditPayment credits a payment to the user's balance exactly once.
+// The payment document and the balance change are written in the same transaction.
+func (s *Service) CreditPayment(ctx context.Context, payment *Payment) error {
+	ctx, span := startSpan(ctx, "CreditPayment", paymentsCollection)
+	defer span.End()
+
+	paymentRef := s.dbClient.Collection(paymentsCollection).Doc(payment.ID)
+
+	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		if _, err := tx.Get(paymentRef); err == nil {
+			return ErrPaymentAlreadyProcessed
+		} else if status.Code(err) != codes.NotFound {
+			return fmt.Errorf("failed to check payment: %w", err)
+		}
+
+		// applyBalanceChange reads the user, so it must run before any writes
+		if _, err := s.applyBalanceChange(tx, payment.UserID, payment.Amount, LedgerEntryTopUp, payment.ID); err != nil {
+			return err
+		}
+
+		return tx.Create(paymentRef, payment)
+	})
+	if err != nil {
+		if errors.Is(err, ErrPaymentAlreadyProcessed) {
+			return err
+		}
+		return fmt.Errorf("failed to credit payment: %w", err)
+	}
+
+	slog.Info("Payment credited",
+		"user_id", payment.UserID,
+		"payment_id", payment.ID,
+		"amount", payment.Amount.String(),
+		"source", payment.Source,
+	)
+
+	return nil
+}
+
+// SetStripeCustomerID stores the Stripe customer ID for a user
+func (s *Service) SetStripeCustomerID(ctx context.Context, userID, customerID string) error {
+	_, err := s.dbClient.Collection("users").Doc(userID).Update(ctx, []firestore.Update{
+		{Path: "stripe_customer_id", Value: customerID},
+		{Path: "updated_at", Value: time.Now()},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set stripe customer: %w", err)
+	}
+	return nil
+}
+
+// SetAutoTopUpPaymentMethod stores the saved payment method used for automatic top-ups
+func (s *Service) SetAutoTopUpPaymentMethod(ctx context.Context, userID, paymentMethodID string) error {
+	_, err := s.dbClient.Collection("users").Doc(userID).Update(ctx, []firestore.Update{
+		{Path: "auto_top_up.payment_method_id", Value: paymentMethodID},
+		{Path: "updated_at", Value: time.Now()},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set auto top-up payment method: %w", err)
+	}
+	return nil
+}
+
+// UpdateAutoTopUpSettings updates a user's auto top-up threshold and amount
+func (s *Service) UpdateAutoTopUpSettings(ctx context.Context, userID string, enabled bool, threshold, amount MicroUSD) error {
+	_, err := s.dbClient.Collection("users").Doc(userID).Update(ctx, []firestore.Update{
+		{Path: "auto_top_up.enabled", Value: enabled},
+		{Path: "auto_top_up.threshold_micros", Value: threshold},
+		{Path: "auto_top_up.amount_micros", Value: amount},
+		{Path: "updated_at", Value: time.Now()},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update auto top-up settings: %w", err)
+	}
+	return nil
+}
+
+// ClaimAutoTopUp atomically checks whether a user is due an automatic top-up and, if so,
+// marks it as triggered so that concurrent charges on other replicas do not trigger it again.
+func (s *Service) ClaimAutoTopUp(ctx context.Context, userID string, cooldown time.Duration) (*User, bool, error) {
+	userRef := s.dbClient.Collection("users").Doc(userID)
+
+	var claimed *User
+	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		claimed = nil
+
+		doc, err := tx.Get(userRef)
+		if err != nil {
+			return fmt.Errorf("failed to get user: %w", err)
+		}
+
+		var user User
+		if err := doc.DataTo(&user); err != nil {
+			return fmt.Errorf("failed to parse user: %w", err)
+		}
+		user.migrateLegacyBalance()
+
+		settings := user.AutoTopUp
+		if !settings.Enabled || settings.PaymentMethodID == "" || user.StripeCustomerID == "" {
+			return nil
+		}
+		if user.Balance >= settings.Threshold || time.Since(settings.LastTriggeredAt) < cooldown {
+			return nil
+		}
+
+		now := time.Now()
+		if err := tx.Update(userRef, []firestore.Update{{Path: "auto_top_up.last_triggered_at", Value: now}}); err != nil {
+			return err
+		}
+
+		user.AutoTopUp.LastTriggeredAt = now
+		claimed = &user
+		return nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to claim auto top-up: %w", err)
+	}
+
+	return claimed, claimed != nil, nil
+}
+
+// GetInvoiceLineItems aggregates a user's request logs into per-model line items for a billing period
+func (s *Service) GetInvoiceLineItems(ctx context.Context, userID string, startDate, endDate time.Time) ([]InvoiceLineItem, error) {
+	iter := s.dbClient.Collection("request_logs").
+		Where("user_id", "==", userID).
+		Where("request_timestamp", ">=", startDate).
+		Where("request_timestamp", "<", endDate).
+		Documents(ctx)
+	defer iter.Stop()
+
+	items := make(map[string]*InvoiceLineItem)
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to query request logs: %w", err)
+		}
+
+		var log RequestLog
+		if err := doc.DataTo(&log); err != nil {
+			continue // Skip malformed logs
+		}
+		if log.TestMode {
+			continue // Test mode requests are free
+		}
+
+		item, ok := items[log.ModelID]
+		if !ok {
+			item = &InvoiceLineItem{ModelID: log.ModelID, Provider: log.Provider}
+			items[log.ModelID] = item
+		}
+		item.Requests++
+		item.InputTokens += log.InputTokens
+		item.OutputTokens += log.OutputTokens
+		if log.BYOK {
+			item.BYOKRequests++
+		}
+		item.PlatformFees += log.PlatformFee
+		item.OptimizerCosts += log.OptimizerCost
+		item.Amount += log.TotalCost
+	}
+
+	lineItems := make([]InvoiceLineItem, 0, len(items))
+	for _, item := range items {
+		lineItems = append(lineItems, *item)
+	}
+	sort.Slice(lineItems, func(i, j int) bool {
+		return lineItems[i].ModelID < lineItems[j].ModelID
+	})
+
+	return lineItems, nil
+}
@@ -0,0 +1,140 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	cacheEntriesCollection       = "cache_entries"
+	cacheInvalidationsCollection = "cache_invalidations"
+)
+
+// cacheInvalidationTTL is how long invalidations are kept before their TTL policy deletes them.
+// Listeners only follow invalidations made after they start, and a restarted one flushes its
+// cache instead of replaying what it missed, so they are only needed briefly.
+const cacheInvalidationTTL = time.Hour
+
+// CacheEntry represents a shared cache entry stored in Firestore. Expired entries are ignored
+// until the TTL policy on ExpiresAt deletes them.
+type CacheEntry struct {
+	Key       string    `firestore:"key"`
+	Value     []byte    `firestore:"value"`
+	ExpiresAt time.Time `firestore:"expires_at"`
+	UpdatedAt time.Time `firestore:"updated_at"`
+}
+
+// CacheInvalidation represents an invalidation event broadcast to all replicas
+type CacheInvalidation struct {
+	Key       string    `firestore:"key"`
+	SourceID  string    `firestore:"source_id"`
+	CreatedAt time.Time `firestore:"created_at"`
+	// ExpiresAt is the TTL field Firestore deletes the invalidation by
+	ExpiresAt time.Time `firestore:"expires_at"`
+}
+
+// cacheDocID converts a cache key into a valid Firestore document ID
+func cacheDocID(key string) string {
+	return strings.ReplaceAll(key, "/", "_")
+}
+
+// GetCacheEntry gets a shared cache entry by key, returning nil if missing or expired
+func (s *Service) GetCacheEntry(ctx context.Context, key string) (*CacheEntry, error) {
+	doc, err := s.dbClient.Collection(cacheEntriesCollection).Doc(cacheDocID(key)).Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get cache entry: %w", err)
+	}
+
+	var entry CacheEntry
+	if err := doc.DataTo(&entry); err != nil {
+		return nil, fmt.Errorf("failed to parse cache entry: %w", err)
+	}
+
+	if time.Now().After(entry.ExpiresAt) {
+		return nil, nil
+	}
+
+	return &entry, nil
+}
+
+// SetCacheEntry stores a shared cache entry with the given TTL
+func (s *Service) SetCacheEntry(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	now := time.Now()
+	entry := &CacheEntry{
+		Key:       key,
+		Value:     value,
+		ExpiresAt: now.Add(ttl),
+		UpdatedAt: now,
+	}
+
+	if _, err := s.dbClient.Collection(cacheEntriesCollection).Doc(cacheDocID(key)).Set(ctx, entry); err != nil {
+		return fmt.Errorf("failed to set cache entry: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteCacheEntry removes a shared cache entry
+func (s *Service) DeleteCacheEntry(ctx context.Context, key string) error {
+	if _, err := s.dbClient.Collection(cacheEntriesCollection).Doc(cacheDocID(key)).Delete(ctx); err != nil {
+		return fmt.Errorf("failed to delete cache entry: %w", err)
+	}
+	return nil
+}
+
+// PublishCacheInvalidation broadcasts an invalidation event for a cache key
+func (s *Service) PublishCacheInvalidation(ctx context.Context, key, sourceID string) error {
+	now := time.Now()
+	_, _, err := s.dbClient.Collection(cacheInvalidationsCollection).Add(ctx, &CacheInvalidation{
+		Key:       key,
+		SourceID:  sourceID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(cacheInvalidationTTL),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish cache invalidation: %w", err)
+	}
+	return nil
+}
+
+// ListenCacheInvalidations listens for invalidation events created after since and calls fn for each.
+// It blocks until the context is cancelled or the listener fails.
+func (s *Service) ListenCacheInvalidations(ctx context.Context, since time.Time, fn func(*CacheInvalidation)) error {
+	snapshots := s.dbClient.Collection(cacheInvalidationsCollection).
+		Where("created_at", ">", since).
+		Snapshots(ctx)
+	defer snapshots.Stop()
+
+	for {
+		snap, err := snapshots.Next()
+		if err != nil {
+			if status.Code(err) == codes.Canceled || ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("cache invalidation listener failed: %w", err)
+		}
+
+		for _, change := range snap.Changes {
+			if change.Kind != firestore.DocumentAdded {
+				continue
+			}
+
+			var event CacheInvalidation
+			if err := change.Doc.DataTo(&event); err != nil {
+				slog.Warn("Failed to parse cache invalidation", "doc_id", change.Doc.Ref.ID, "error", err)
+				continue
+			}
+			fn(&event)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrRequestAlreadyCharged is returned when a request has already been charged
+var ErrRequestAlreadyCharged = errors.New("request already charged")
+
+// chargesCollection is the Firestore collection holding request charges, keyed by request ID
+const chargesCollection = "charges"
+
+// Charge records the charge for a request, so that each request is charged exactly once
+type Charge struct {
+	RequestID string `firestore:"request_id" json:"request_id"`
+	UserID    string `firestore:"user_id" json:"user_id"`
+	// OrgID is set when the request was charged to the organization's shared balance
+	OrgID  string   `firestore:"org_id,omitempty" json:"org_id,omitempty"`
+	Amount MicroUSD `firestore:"amount_micros" json:"amount"`
+	// CreditsUsed is the user's promotional credit the charge consumed
+	CreditsUsed MicroUSD `firestore:"credits_used_micros,omitempty" json:"credits_used,omitempty"`
+	// Debt is the part of the charge the balance could not cover
+	Debt      MicroUSD  `firestore:"debt_micros,omitempty" json:"debt,omitempty"`
+	CreatedAt time.Time `firestore:"created_at" json:"created_at"`
+}
+
+// ChargeRequest charges a request to the user, or to the organization's shared balance when
+// OrgID is set, exactly once. The charge record and the balance change are written in the same
+// transaction. When the request has already been charged it returns ErrRequestAlreadyCharged
+// and fills charge in from the existing record.
+func (s *Service) ChargeRequest(ctx context.Context, charge *Charge) error {
+	ctx, span := startSpan(ctx, "ChargeRequest", chargesCollection)
+	defer span.End()
+
+	chargeRef := s.dbClient.Collection(chargesCollection).Doc(charge.RequestID)
+	charge.CreatedAt = time.Now()
+
+	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		if doc, err := tx.Get(chargeRef); err == nil {
+			if err := doc.DataTo(charge); err != nil {
+				return fmt.Errorf("failed to parse charge: %w", err)
+			}
+			return ErrRequestAlreadyCharged
+		} else if status.Code(err) != codes.NotFound {
+			return fmt.Errorf("failed to check charge: %w", err)
+		}
+
+		// The balance changes read the account, so they must run before any writes
+		var entry *LedgerEntry
+		var err error
+		if charge.OrgID != "" {
+			entry, err = s.applyOrgBalanceChange(tx, charge.OrgID, charge.UserID, -charge.Amount, LedgerEntryCharge, charge.RequestID)
+		} else {
+			entry, err = s.applyBalanceChange(tx, charge.UserID, -charge.Amount, LedgerEntryCharge, charge.RequestID)
+		}
+		if err != nil {
+			return err
+		}
+		charge.CreditsUsed, charge.Debt = -entry.CreditAmount, entry.Debt
+
+		return tx.Create(chargeRef, charge)
+	})
+	if err != nil {
+		if errors.Is(err, ErrRequestAlreadyCharged) {
+			return err
+		}
+		return fmt.Errorf("failed to charge request: %w", err)
+	}
+
+	slog.Info("Request charged",
+		"request_id", charge.RequestID,
+		"user_id", charge.UserID,
+		"org_id", charge.OrgID,
+		"amount", charge.Amount.String(),
+		"credits_used", charge.CreditsUsed.String(),
+		"debt", charge.Debt.String(),
+	)
+
+	return nil
+}
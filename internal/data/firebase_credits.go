@@ -0,0 +1,332 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// referralCodesCollection maps referral codes to the users who share them
+const referralCodesCollection = "referral_codes"
+
+// Credit grant sources
+const (
+	CreditSourceAdmin = "admin"
+	// CreditSourceReferral is granted to a user who redeems a referral code
+	CreditSourceReferral = "referral"
+	// CreditSourceReferrer is granted to the user whose referral code was redeemed
+	CreditSourceReferrer = "referrer"
+)
+
+// referralCodeAlphabet leaves out characters that are easily confused when codes are shared by hand
+const referralCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// referralCodeLength is the length of generated referral codes
+const referralCodeLength = 8
+
+var (
+	// ErrReferralCodeNotFound is returned when redeeming a referral code that does not exist
+	ErrReferralCodeNotFound = errors.New("referral code not found")
+	// ErrAlreadyReferred is returned when a user who has already redeemed a referral code redeems another
+	ErrAlreadyReferred = errors.New("a referral code has already been redeemed")
+	// ErrOwnReferralCode is returned when a user redeems their own referral code
+	ErrOwnReferralCode = errors.New("cannot redeem your own referral code")
+	// ErrReferralCodeExhausted is returned when a referral code has reached its redemption limit
+	ErrReferralCodeExhausted = errors.New("referral code has no redemptions left")
+)
+
+// CreditGrant is a promotional credit held separately from the paid balance. Charges consume
+// credits, soonest expiring first, before the paid balance; unused credit lapses at ExpiresAt.
+type CreditGrant struct {
+	ID        string    `firestore:"id" json:"id"`
+	Amount    MicroUSD  `firestore:"amount_micros" json:"amount"`
+	Remaining MicroUSD  `firestore:"remaining_micros" json:"remaining"`
+	Source    string    `firestore:"source" json:"source"`
+	Reason    string    `firestore:"reason,omitempty" json:"reason,omitempty"`
+	ExpiresAt time.Time `firestore:"expires_at" json:"expires_at"`
+	CreatedAt time.Time `firestore:"created_at" json:"created_at"`
+}
+
+// ReferralCode is a code a user shares to grant credits to the users who redeem it
+type ReferralCode struct {
+	Code        string    `firestore:"code" json:"code"`
+	UserID      string    `firestore:"user_id" json:"-"`
+	Redemptions int       `firestore:"redemptions" json:"redemptions"`
+	CreatedAt   time.Time `firestore:"created_at" json:"created_at"`
+}
+
+// AvailableCredits returns the unexpired promotional credit the user can spend
+func (u *User) AvailableCredits(now time.Time) MicroUSD {
+	var total MicroUSD
+	for _, grant := range u.Credits {
+		if now.Before(grant.ExpiresAt) {
+			total += grant.Remaining
+		}
+	}
+	return total
+}
+
+// pruneCredits drops used up and expired grants, returning the expired credit written off
+func (u *User) pruneCredits(now time.Time) MicroUSD {
+	var expired MicroUSD
+	active := u.Credits[:0]
+	for _, grant := range u.Credits {
+		switch {
+		case grant.Remaining <= 0:
+		case !now.Before(grant.ExpiresAt):
+			expired += grant.Remaining
+		default:
+			active = append(active, grant)
+		}
+	}
+	u.Credits = active
+	return expired
+}
+
+// consumeCredits spends up to amount from the user's credits, soonest expiring first, returning the credit used
+func (u *User) consumeCredits(amount MicroUSD, now time.Time) MicroUSD {
+	sort.SliceStable(u.Credits, func(i, j int) bool {
+		return u.Credits[i].ExpiresAt.Before(u.Credits[j].ExpiresAt)
+	})
+
+	var used MicroUSD
+	for i := range u.Credits {
+		grant := &u.Credits[i]
+		if used == amount {
+			break
+		}
+		if !now.Before(grant.ExpiresAt) {
+			continue
+		}
+		spend := min(grant.Remaining, amount-used)
+		grant.Remaining -= spend
+		used += spend
+	}
+	return used
+}
+
+// writeCreditExpiry records credit that lapsed unused, if any, in the ledger
+func (s *Service) writeCreditExpiry(tx *firestore.Transaction, user *User, expired MicroUSD, now time.Time) error {
+	if expired <= 0 {
+		return nil
+	}
+	return s.writeLedgerEntry(tx, &LedgerEntry{
+		UserID:           user.ID,
+		Type:             LedgerEntryCreditExpiry,
+		CreditAmount:     -expired,
+		ResultingBalance: user.Balance,
+		ResultingCredits: user.AvailableCredits(now),
+		CreatedAt:        now,
+	})
+}
+
+// addCreditGrant adds a grant to a user read in the transaction and records it in the ledger.
+// The caller writes the user's credits.
+func (s *Service) addCreditGrant(tx *firestore.Transaction, user *User, grant *CreditGrant, now time.Time) error {
+	expired := user.pruneCredits(now)
+
+	grant.ID = uuid.NewString()
+	grant.Remaining = grant.Amount
+	grant.CreatedAt = now
+	user.Credits = append(user.Credits, *grant)
+
+	if err := s.writeCreditExpiry(tx, user, expired, now); err != nil {
+		return err
+	}
+	return s.writeLedgerEntry(tx, &LedgerEntry{
+		UserID:           user.ID,
+		Type:             LedgerEntryCreditGrant,
+		RequestID:        grant.ID,
+		CreditAmount:     grant.Amount,
+		ResultingBalance: user.Balance,
+		ResultingCredits: user.AvailableCredits(now),
+		CreatedAt:        now,
+	})
+}
+
+// getUserInTransaction reads a user within a transaction
+func (s *Service) getUserInTransaction(tx *firestore.Transaction, userID string) (*User, error) {
+	doc, err := tx.Get(s.dbClient.Collection("users").Doc(userID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	var user User
+	if err := doc.DataTo(&user); err != nil {
+		return nil, fmt.Errorf("failed to parse user: %w", err)
+	}
+	user.ID = doc.Ref.ID
+	user.migrateLegacyBalance()
+	return &user, nil
+}
+
+// GrantCredits adds a promotional credit grant to a user
+func (s *Service) GrantCredits(ctx context.Context, userID string, grant *CreditGrant) error {
+	userRef := s.dbClient.Collection("users").Doc(userID)
+
+	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		user, err := s.getUserInTransaction(tx, userID)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if err := s.addCreditGrant(tx, user, grant, now); err != nil {
+			return err
+		}
+		return tx.Update(userRef, []firestore.Update{
+			{Path: "credits", Value: user.Credits},
+			{Path: "updated_at", Value: now},
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to grant credits: %w", err)
+	}
+
+	slog.Info("Credits granted", "user_id", userID, "amount", grant.Amount.String(), "source", grant.Source, "expires_at", grant.ExpiresAt)
+	return nil
+}
+
+// GetOrCreateReferralCode returns the user's referral code, creating one on first use
+func (s *Service) GetOrCreateReferralCode(ctx context.Context, userID string) (*ReferralCode, error) {
+	userRef := s.dbClient.Collection("users").Doc(userID)
+
+	var code *ReferralCode
+	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		user, err := s.getUserInTransaction(tx, userID)
+		if err != nil {
+			return err
+		}
+
+		if user.ReferralCode != "" {
+			doc, err := tx.Get(s.dbClient.Collection(referralCodesCollection).Doc(user.ReferralCode))
+			if err != nil {
+				return fmt.Errorf("failed to get referral code: %w", err)
+			}
+			code = &ReferralCode{}
+			return doc.DataTo(code)
+		}
+
+		value, err := newReferralCode()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		code = &ReferralCode{Code: value, UserID: userID, CreatedAt: now}
+
+		// Create fails the transaction in the unlikely event the code is already taken; callers can retry
+		if err := tx.Create(s.dbClient.Collection(referralCodesCollection).Doc(value), code); err != nil {
+			return err
+		}
+		return tx.Update(userRef, []firestore.Update{
+			{Path: "referral_code", Value: value},
+			{Path: "updated_at", Value: now},
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get referral code: %w", err)
+	}
+
+	return code, nil
+}
+
+// RedeemReferralCode grants referral credits to a user redeeming a code and to the code's owner.
+// A user can redeem one code, once; maxRedemptions bounds how often a code can be redeemed (0 is unlimited).
+// It returns the ID of the code's owner.
+func (s *Service) RedeemReferralCode(ctx context.Context, userID, code string, referee, referrer *CreditGrant, maxRedemptions int) (string, error) {
+	codeRef := s.dbClient.Collection(referralCodesCollection).Doc(code)
+
+	var referrerID string
+	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(codeRef)
+		if status.Code(err) == codes.NotFound {
+			return ErrReferralCodeNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get referral code: %w", err)
+		}
+
+		var referral ReferralCode
+		if err := doc.DataTo(&referral); err != nil {
+			return fmt.Errorf("failed to parse referral code: %w", err)
+		}
+		referrerID = referral.UserID
+		if referrerID == userID {
+			return ErrOwnReferralCode
+		}
+		if maxRedemptions > 0 && referral.Redemptions >= maxRedemptions {
+			return ErrReferralCodeExhausted
+		}
+
+		user, err := s.getUserInTransaction(tx, userID)
+		if err != nil {
+			return err
+		}
+		if user.ReferredBy != "" {
+			return ErrAlreadyReferred
+		}
+		owner, err := s.getUserInTransaction(tx, referrerID)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		userUpdates := []firestore.Update{{Path: "referred_by", Value: referrerID}, {Path: "updated_at", Value: now}}
+		if referee.Amount > 0 {
+			if err := s.addCreditGrant(tx, user, referee, now); err != nil {
+				return err
+			}
+			userUpdates = append(userUpdates, firestore.Update{Path: "credits", Value: user.Credits})
+		}
+		if err := tx.Update(s.dbClient.Collection("users").Doc(userID), userUpdates); err != nil {
+			return err
+		}
+
+		if referrer.Amount > 0 {
+			if err := s.addCreditGrant(tx, owner, referrer, now); err != nil {
+				return err
+			}
+			if err := tx.Update(s.dbClient.Collection("users").Doc(referrerID), []firestore.Update{
+				{Path: "credits", Value: owner.Credits},
+				{Path: "updated_at", Value: now},
+			}); err != nil {
+				return err
+			}
+		}
+
+		return tx.Update(codeRef, []firestore.Update{
+			{Path: "redemptions", Value: firestore.Increment(1)},
+		})
+	})
+	if errors.Is(err, ErrReferralCodeNotFound) || errors.Is(err, ErrOwnReferralCode) ||
+		errors.Is(err, ErrReferralCodeExhausted) || errors.Is(err, ErrAlreadyReferred) {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to redeem referral code: %w", err)
+	}
+
+	slog.Info("Referral code redeemed", "user_id", userID, "referrer_id", referrerID, "code", code)
+	return referrerID, nil
+}
+
+// newReferralCode generates a random referral code
+func newReferralCode() (string, error) {
+	b := make([]byte, referralCodeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate referral code: %w", err)
+	}
+	for i := range b {
+		b[i] = referralCodeAlphabet[int(b[i])%len(referralCodeAlphabet)]
+	}
+	return string(b), nil
+}
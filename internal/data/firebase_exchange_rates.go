@@ -0,0 +1,74 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// exchangeRatesCollection holds one day's exchange rates per document
+const exchangeRatesCollection = "exchange_rates"
+
+// ErrExchangeRatesNotFound is returned when no exchange rates were fetched on or before a day
+var ErrExchangeRatesNotFound = errors.New("exchange rates not found")
+
+// ExchangeRates are a day's rates of other currencies against USD. They are only used to display
+// amounts; balances, charges and statements are accounted in USD.
+type ExchangeRates struct {
+	// Day is the UTC day the rates were published for
+	Day time.Time `firestore:"day" json:"day"`
+	// Rates are how many units of each currency, by ISO 4217 code, one USD buys
+	Rates     map[string]float64 `firestore:"rates" json:"rates"`
+	Source    string             `firestore:"source" json:"source"`
+	FetchedAt time.Time          `firestore:"fetched_at" json:"fetched_at"`
+}
+
+// SetExchangeRates stores a day's exchange rates, replacing any already held for the day
+func (s *Service) SetExchangeRates(ctx context.Context, rates *ExchangeRates) error {
+	_, err := s.dbClient.Collection(exchangeRatesCollection).Doc(rates.Day.Format("20060102")).Set(ctx, rates)
+	if err != nil {
+		return fmt.Errorf("failed to set exchange rates: %w", err)
+	}
+	return nil
+}
+
+// GetExchangeRates gets the latest exchange rates published on or before at's UTC day
+func (s *Service) GetExchangeRates(ctx context.Context, at time.Time) (*ExchangeRates, error) {
+	iter := s.dbClient.Collection(exchangeRatesCollection).
+		Where("day", "<=", RollupBucket(RollupDaily, at)).
+		OrderBy("day", firestore.Desc).
+		Limit(1).
+		Documents(ctx)
+	defer iter.Stop()
+
+	doc, err := iter.Next()
+	if err == iterator.Done {
+		return nil, ErrExchangeRatesNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get exchange rates: %w", err)
+	}
+
+	var rates ExchangeRates
+	if err := doc.DataTo(&rates); err != nil {
+		return nil, fmt.Errorf("failed to parse exchange rates: %w", err)
+	}
+	return &rates, nil
+}
+
+// UpdateUserCurrency sets the currency a user's balances, costs and statements are displayed in;
+// an empty currency displays them in USD
+func (s *Service) UpdateUserCurrency(ctx context.Context, userID, currency string) error {
+	_, err := s.dbClient.Collection("users").Doc(userID).Update(ctx, []firestore.Update{
+		{Path: "currency", Value: currency},
+		{Path: "updated_at", Value: time.Now()},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update currency: %w", err)
+	}
+	return nil
+}
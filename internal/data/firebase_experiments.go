@@ -0,0 +1,218 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// experimentsCollection holds A/B experiments on optimization and routing
+const experimentsCollection = "experiments"
+
+// Experiment statuses; only active experiments assign traffic
+const (
+	ExperimentStatusActive    = "active"
+	ExperimentStatusPaused    = "paused"
+	ExperimentStatusCompleted = "completed"
+)
+
+// Experiment variants recorded on request logs
+const (
+	ExperimentVariantControl   = "control"
+	ExperimentVariantTreatment = "treatment"
+)
+
+// Experiment sends a percentage of matching users to an alternate optimization or routing strategy
+type Experiment struct {
+	ID          string `firestore:"id" json:"id"`
+	Name        string `firestore:"name" json:"name"`
+	Description string `firestore:"description,omitempty" json:"description,omitempty"`
+	Status      string `firestore:"status" json:"status"`
+	// TierIDs and UserIDs limit the experiment to those pricing tiers or users; empty matches everyone
+	TierIDs []string `firestore:"tier_ids,omitempty" json:"tier_ids,omitempty"`
+	UserIDs []string `firestore:"user_ids,omitempty" json:"user_ids,omitempty"`
+	// TreatmentPercent of matching users get Treatment; the rest form the control group
+	TreatmentPercent float64           `firestore:"treatment_percent" json:"treatment_percent"`
+	Treatment        ExperimentVariant `firestore:"treatment" json:"treatment"`
+	CreatedBy        string            `firestore:"created_by,omitempty" json:"created_by,omitempty"`
+	CreatedAt        time.Time         `firestore:"created_at" json:"created_at"`
+	UpdatedAt        time.Time         `firestore:"updated_at" json:"updated_at"`
+	// Shadow mirrors a sample of the experiment's requests to a secondary model. ShadowSpend is what
+	// the mirrored requests have cost so far; it is maintained by the server.
+	Shadow      *ShadowTraffic `firestore:"shadow,omitempty" json:"shadow,omitempty"`
+	ShadowSpend MicroUSD       `firestore:"shadow_spend_micros" json:"shadow_spend"`
+}
+
+// ShadowTraffic mirrors Percent of an experiment's requests, in either variant, to Model. Mirrored
+// requests are never returned to the caller and are paid for from Budget rather than by the account.
+type ShadowTraffic struct {
+	Model   string  `firestore:"model" json:"model"`
+	Percent float64 `firestore:"percent" json:"percent"`
+	// Budget caps the provider cost of mirrored requests; mirroring stops once it is spent
+	Budget MicroUSD `firestore:"budget_micros" json:"budget"`
+	// StoreResults keeps both completions on each shadow result for comparison; otherwise they are
+	// discarded and only usage, cost and latency are kept
+	StoreResults bool `firestore:"store_results,omitempty" json:"store_results,omitempty"`
+}
+
+// ExperimentVariant overrides how a request is optimized or routed; empty fields keep the default
+type ExperimentVariant struct {
+	OptimizationMode    string `firestore:"optimization_mode,omitempty" json:"optimization_mode,omitempty"`
+	OptimizerModel      string `firestore:"optimizer_model,omitempty" json:"optimizer_model,omitempty"`
+	DisableOptimization bool   `firestore:"disable_optimization,omitempty" json:"disable_optimization,omitempty"`
+	// Model routes requests to another model
+	Model string `firestore:"model,omitempty" json:"model,omitempty"`
+}
+
+// ExperimentVariantResult aggregates the request logs of one experiment variant
+type ExperimentVariantResult struct {
+	Variant      string   `json:"variant"`
+	Requests     int      `json:"requests"`
+	InputTokens  int      `json:"input_tokens"`
+	OutputTokens int      `json:"output_tokens"`
+	TokensSaved  int      `json:"tokens_saved"`
+	TotalCost    MicroUSD `json:"total_cost"`
+	AvgCost      MicroUSD `json:"avg_cost"`
+	AvgLatencyMs float64  `json:"avg_latency_ms"`
+}
+
+// CreateExperiment stores a new experiment
+func (s *Service) CreateExperiment(ctx context.Context, experiment *Experiment) error {
+	ref := s.dbClient.Collection(experimentsCollection).NewDoc()
+	now := time.Now()
+	experiment.ID = ref.ID
+	experiment.CreatedAt = now
+	experiment.UpdatedAt = now
+
+	if _, err := ref.Create(ctx, experiment); err != nil {
+		return fmt.Errorf("failed to create experiment: %w", err)
+	}
+
+	slog.Info("Experiment created", "experiment_id", experiment.ID, "name", experiment.Name)
+	return nil
+}
+
+// GetExperiment gets an experiment, returning nil if it does not exist
+func (s *Service) GetExperiment(ctx context.Context, experimentID string) (*Experiment, error) {
+	doc, err := s.dbClient.Collection(experimentsCollection).Doc(experimentID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get experiment: %w", err)
+	}
+
+	var experiment Experiment
+	if err := doc.DataTo(&experiment); err != nil {
+		return nil, fmt.Errorf("failed to parse experiment: %w", err)
+	}
+
+	return &experiment, nil
+}
+
+// UpdateExperiment replaces an experiment
+func (s *Service) UpdateExperiment(ctx context.Context, experiment *Experiment) error {
+	experiment.UpdatedAt = time.Now()
+
+	if _, err := s.dbClient.Collection(experimentsCollection).Doc(experiment.ID).Set(ctx, experiment); err != nil {
+		return fmt.Errorf("failed to update experiment: %w", err)
+	}
+
+	slog.Info("Experiment updated", "experiment_id", experiment.ID, "status", experiment.Status)
+	return nil
+}
+
+// ListExperiments lists experiments, oldest first, optionally only those with the given status
+func (s *Service) ListExperiments(ctx context.Context, status string) ([]*Experiment, error) {
+	query := s.dbClient.Collection(experimentsCollection).Query
+	if status != "" {
+		query = query.Where("status", "==", status)
+	}
+
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+
+	var experiments []*Experiment
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list experiments: %w", err)
+		}
+
+		var experiment Experiment
+		if err := doc.DataTo(&experiment); err != nil {
+			slog.Warn("Failed to parse experiment", "doc_id", doc.Ref.ID, "error", err)
+			continue
+		}
+
+		experiments = append(experiments, &experiment)
+	}
+
+	sort.Slice(experiments, func(i, j int) bool {
+		return experiments[i].CreatedAt.Before(experiments[j].CreatedAt)
+	})
+
+	return experiments, nil
+}
+
+// GetExperimentResults aggregates an experiment's request logs per variant for a date range
+func (s *Service) GetExperimentResults(ctx context.Context, experimentID string, startDate, endDate time.Time) ([]ExperimentVariantResult, error) {
+	iter := s.dbClient.Collection("request_logs").
+		Where("experiment_id", "==", experimentID).
+		Where("request_timestamp", ">=", startDate).
+		Where("request_timestamp", "<=", endDate).
+		Documents(ctx)
+	defer iter.Stop()
+
+	results := map[string]*ExperimentVariantResult{
+		ExperimentVariantControl:   {Variant: ExperimentVariantControl},
+		ExperimentVariantTreatment: {Variant: ExperimentVariantTreatment},
+	}
+	totalLatency := make(map[string]int64)
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to query request logs: %w", err)
+		}
+
+		var log RequestLog
+		if err := doc.DataTo(&log); err != nil {
+			continue // Skip malformed logs
+		}
+
+		result, ok := results[log.ExperimentVariant]
+		if !ok {
+			continue
+		}
+		result.Requests++
+		result.InputTokens += log.InputTokens
+		result.OutputTokens += log.OutputTokens
+		result.TokensSaved += log.TokensSaved
+		result.TotalCost += log.TotalCost
+		totalLatency[log.ExperimentVariant] += log.DurationMs
+	}
+
+	variants := []ExperimentVariantResult{}
+	for _, variant := range []string{ExperimentVariantControl, ExperimentVariantTreatment} {
+		result := results[variant]
+		if result.Requests > 0 {
+			result.AvgCost = result.TotalCost / MicroUSD(result.Requests)
+			result.AvgLatencyMs = float64(totalLatency[variant]) / float64(result.Requests)
+		}
+		variants = append(variants, *result)
+	}
+
+	return variants, nil
+}
@@ -0,0 +1,209 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// scheduledJobsCollection holds each scheduled job's last run
+	scheduledJobsCollection = "scheduled_jobs"
+	// jobLeaderCollection holds the lease of the replica elected to run scheduled jobs
+	jobLeaderCollection = "job_leader"
+	jobLeaderDoc        = "leader"
+)
+
+// Scheduled job run statuses
+const (
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// JobLeader is the replica elected to run scheduled jobs. It leads until its lease runs out
+// without being renewed.
+type JobLeader struct {
+	InstanceID string    `firestore:"instance_id" json:"instance_id"`
+	ElectedAt  time.Time `firestore:"elected_at" json:"elected_at"`
+	LeaseUntil time.Time `firestore:"lease_until" json:"lease_until"`
+}
+
+// JobRun is a scheduled job's last run
+type JobRun struct {
+	Name   string `firestore:"name" json:"name"`
+	Status string `firestore:"status,omitempty" json:"status,omitempty"`
+	// InstanceID is the replica that ran it
+	InstanceID     string    `firestore:"instance_id,omitempty" json:"instance_id,omitempty"`
+	LastStartedAt  time.Time `firestore:"last_started_at,omitempty" json:"last_started_at,omitempty"`
+	LastFinishedAt time.Time `firestore:"last_finished_at,omitempty" json:"last_finished_at,omitempty"`
+	LastDurationMS int64     `firestore:"last_duration_ms,omitempty" json:"last_duration_ms,omitempty"`
+	LastError      string    `firestore:"last_error,omitempty" json:"last_error,omitempty"`
+	Runs           int64     `firestore:"runs" json:"runs"`
+	Failures       int64     `firestore:"failures" json:"failures"`
+}
+
+// ClaimJobLeadership elects instanceID to run scheduled jobs, or renews its lease, unless another
+// replica's lease has yet to run out. It returns whether instanceID leads.
+func (s *Service) ClaimJobLeadership(ctx context.Context, instanceID string, lease time.Duration) (bool, error) {
+	leaderRef := s.dbClient.Collection(jobLeaderCollection).Doc(jobLeaderDoc)
+
+	var elected bool
+	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		elected = false
+		now := time.Now()
+
+		var leader JobLeader
+		doc, err := tx.Get(leaderRef)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return fmt.Errorf("failed to get job leader: %w", err)
+		}
+		if err == nil {
+			if err := doc.DataTo(&leader); err != nil {
+				return fmt.Errorf("failed to parse job leader: %w", err)
+			}
+		}
+		if leader.InstanceID != instanceID && now.Before(leader.LeaseUntil) {
+			return nil
+		}
+
+		if leader.InstanceID != instanceID {
+			leader = JobLeader{InstanceID: instanceID, ElectedAt: now}
+		}
+		leader.LeaseUntil = now.Add(lease)
+		if err := tx.Set(leaderRef, leader); err != nil {
+			return err
+		}
+		elected = true
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to claim job leadership: %w", err)
+	}
+
+	return elected, nil
+}
+
+// ReleaseJobLeadership ends instanceID's lease early, so another replica is elected without waiting
+// for it to run out
+func (s *Service) ReleaseJobLeadership(ctx context.Context, instanceID string) error {
+	leaderRef := s.dbClient.Collection(jobLeaderCollection).Doc(jobLeaderDoc)
+	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(leaderRef)
+		if status.Code(err) == codes.NotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if holder, _ := doc.Data()["instance_id"].(string); holder != instanceID {
+			return nil
+		}
+		return tx.Update(leaderRef, []firestore.Update{{Path: "lease_until", Value: time.Time{}}})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to release job leadership: %w", err)
+	}
+	return nil
+}
+
+// GetJobLeader gets the replica elected to run scheduled jobs; nil before the first election
+func (s *Service) GetJobLeader(ctx context.Context) (*JobLeader, error) {
+	doc, err := s.dbClient.Collection(jobLeaderCollection).Doc(jobLeaderDoc).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get job leader: %w", err)
+	}
+
+	var leader JobLeader
+	if err := doc.DataTo(&leader); err != nil {
+		return nil, fmt.Errorf("failed to parse job leader: %w", err)
+	}
+	return &leader, nil
+}
+
+// ClaimJobRun starts a run of a scheduled job on instanceID if the job last started at least
+// interval ago, so each job runs at most once per interval whichever replica leads. It returns
+// when the run started and whether it was claimed.
+func (s *Service) ClaimJobRun(ctx context.Context, name, instanceID string, interval time.Duration) (time.Time, bool, error) {
+	jobRef := s.dbClient.Collection(scheduledJobsCollection).Doc(name)
+
+	var startedAt time.Time
+	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		startedAt = time.Time{}
+		now := time.Now()
+
+		doc, err := tx.Get(jobRef)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return fmt.Errorf("failed to get scheduled job: %w", err)
+		}
+		if err == nil {
+			lastStartedAt, _ := doc.Data()["last_started_at"].(time.Time)
+			if now.Before(lastStartedAt.Add(interval)) {
+				return nil
+			}
+		}
+
+		if err := tx.Set(jobRef, map[string]interface{}{
+			"name":            name,
+			"status":          JobRunning,
+			"instance_id":     instanceID,
+			"last_started_at": now,
+		}, firestore.MergeAll); err != nil {
+			return err
+		}
+		startedAt = now
+		return nil
+	})
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to claim scheduled job: %w", err)
+	}
+
+	return startedAt, !startedAt.IsZero(), nil
+}
+
+// FinishJobRun records the outcome of a scheduled job's run that started at startedAt
+func (s *Service) FinishJobRun(ctx context.Context, name string, startedAt time.Time, runErr error) error {
+	now := time.Now()
+	updates := []firestore.Update{
+		{Path: "status", Value: JobSucceeded},
+		{Path: "last_finished_at", Value: now},
+		{Path: "last_duration_ms", Value: now.Sub(startedAt).Milliseconds()},
+		{Path: "last_error", Value: firestore.Delete},
+		{Path: "runs", Value: firestore.Increment(1)},
+	}
+	if runErr != nil {
+		updates[0].Value = JobFailed
+		updates[3].Value = runErr.Error()
+		updates = append(updates, firestore.Update{Path: "failures", Value: firestore.Increment(1)})
+	}
+
+	if _, err := s.dbClient.Collection(scheduledJobsCollection).Doc(name).Update(ctx, updates); err != nil {
+		return fmt.Errorf("failed to finish scheduled job: %w", err)
+	}
+	return nil
+}
+
+// ListJobRuns lists every scheduled job's last run, by job name
+func (s *Service) ListJobRuns(ctx context.Context) (map[string]*JobRun, error) {
+	docs, err := s.dbClient.Collection(scheduledJobsCollection).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list scheduled jobs: %w", err)
+	}
+
+	runs := make(map[string]*JobRun, len(docs))
+	for _, doc := range docs {
+		var run JobRun
+		if err := doc.DataTo(&run); err != nil {
+			return nil, fmt.Errorf("failed to parse scheduled job: %w", err)
+		}
+		runs[doc.Ref.ID] = &run
+	}
+	return runs, nil
+}
@@ -0,0 +1,143 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// LedgerEntryType identifies the kind of balance change recorded in the ledger
+type LedgerEntryType string
+
+const (
+	LedgerEntryCharge     LedgerEntryType = "charge"
+	LedgerEntryRefund     LedgerEntryType = "refund"
+	LedgerEntryTopUp      LedgerEntryType = "topup"
+	LedgerEntryAdjustment LedgerEntryType = "adjustment"
+	// LedgerEntryCreditGrant adds promotional credit; LedgerEntryCreditExpiry writes off credit that lapsed unused
+	LedgerEntryCreditGrant  LedgerEntryType = "credit_grant"
+	LedgerEntryCreditExpiry LedgerEntryType = "credit_expiry"
+)
+
+// ledgerCollection is the Firestore collection holding balance ledger entries
+const ledgerCollection = "balance_ledger"
+
+// LedgerEntry records a single balance change and the balance it produced
+type LedgerEntry struct {
+	ID               string          `firestore:"id" json:"id"`
+	UserID           string          `firestore:"user_id" json:"user_id"`
+	OrgID            string          `firestore:"org_id,omitempty" json:"org_id,omitempty"`
+	Type             LedgerEntryType `firestore:"type" json:"type"`
+	RequestID        string          `firestore:"request_id,omitempty" json:"request_id,omitempty"`
+	Amount           MicroUSD        `firestore:"amount_micros" json:"amount"`
+	ResultingBalance MicroUSD        `firestore:"resulting_balance_micros" json:"resulting_balance"`
+	// CreditAmount is the change in promotional credit, kept apart from Amount, the paid balance change
+	CreditAmount     MicroUSD `firestore:"credit_amount_micros,omitempty" json:"credit_amount,omitempty"`
+	ResultingCredits MicroUSD `firestore:"resulting_credits_micros,omitempty" json:"resulting_credits,omitempty"`
+	// Debt is the part of a charge the balance could not cover, leaving it negative until a top-up
+	// repays it
+	Debt      MicroUSD  `firestore:"debt_micros,omitempty" json:"debt,omitempty"`
+	CreatedAt time.Time `firestore:"created_at" json:"created_at"`
+}
+
+// settleDebt checks whether a balance change that left an account at balance may stand. Charges
+// are for usage already delivered, so they always settle and any shortfall becomes debt; other
+// deductions may not take the balance below zero, while top-ups may leave some debt unpaid. It
+// returns the debt the change added.
+func settleDebt(entryType LedgerEntryType, balance, change MicroUSD) (MicroUSD, error) {
+	if balance >= 0 || change >= 0 {
+		return 0, nil
+	}
+	if entryType != LedgerEntryCharge {
+		return 0, fmt.Errorf("insufficient balance: current balance %s, attempted charge %s", balance-change, -change)
+	}
+	if before := balance - change; before < 0 {
+		return -change, nil
+	}
+	return -balance, nil
+}
+
+// writeLedgerEntry adds a ledger entry to the given transaction
+func (s *Service) writeLedgerEntry(tx *firestore.Transaction, entry *LedgerEntry) error {
+	ref := s.dbClient.Collection(ledgerCollection).NewDoc()
+	entry.ID = ref.ID
+
+	if err := tx.Create(ref, entry); err != nil {
+		return fmt.Errorf("failed to write ledger entry: %w", err)
+	}
+	return nil
+}
+
+// ListLedgerEntries lists a user's ledger entries, newest first.
+// When startAfter is non-empty, listing resumes after that entry ID.
+func (s *Service) ListLedgerEntries(ctx context.Context, userID string, limit int, startAfter string) ([]*LedgerEntry, error) {
+	query := s.dbClient.Collection(ledgerCollection).
+		Where("user_id", "==", userID).
+		OrderBy("created_at", firestore.Desc).
+		Limit(limit)
+
+	if startAfter != "" {
+		cursor, err := s.dbClient.Collection(ledgerCollection).Doc(startAfter).Get(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ledger cursor: %w", err)
+		}
+		query = query.StartAfter(cursor)
+	}
+
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+
+	var entries []*LedgerEntry
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list ledger entries: %w", err)
+		}
+
+		var entry LedgerEntry
+		if err := doc.DataTo(&entry); err != nil {
+			continue // Skip malformed entries
+		}
+
+		entries = append(entries, &entry)
+	}
+
+	return entries, nil
+}
+
+// ListLedgerEntriesBetween lists a user's ledger entries created in [startDate, endDate), oldest first
+func (s *Service) ListLedgerEntriesBetween(ctx context.Context, userID string, startDate, endDate time.Time) ([]*LedgerEntry, error) {
+	iter := s.dbClient.Collection(ledgerCollection).
+		Where("user_id", "==", userID).
+		Where("created_at", ">=", startDate).
+		Where("created_at", "<", endDate).
+		OrderBy("created_at", firestore.Asc).
+		Documents(ctx)
+	defer iter.Stop()
+
+	var entries []*LedgerEntry
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list ledger entries: %w", err)
+		}
+
+		var entry LedgerEntry
+		if err := doc.DataTo(&entry); err != nil {
+			continue // Skip malformed entries
+		}
+
+		entries = append(entries, &entry)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,982 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	pb "cloud.google.com/go/firestore/apiv1/firestorepb"
+	"google.golang.org/api/option"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// memoryFirestore is an in-process Firestore backend for development mode and tests. It serves
+// the Firestore gRPC API from memory, so the real client, and every query, transaction, bulk
+// write and snapshot listener built on it, runs unchanged without credentials or an emulator.
+//
+// It covers what this codebase uses: documents, field and composite filters, ordering, cursors,
+// limits, projections, field transforms, optimistic transactions, BulkWriter and listeners.
+// Indexes are not enforced and data is lost when the process exits.
+type memoryFirestore struct {
+	pb.UnimplementedFirestoreServer
+
+	mu   sync.Mutex
+	docs map[string]*pb.Document
+	// txs holds each open transaction's reads, by document name, with the update time seen
+	// (nil when the document was missing); commit aborts if any has since changed
+	txs    map[string]map[string]*timestamppb.Timestamp
+	nextTx uint64
+	// lastWrite keeps commit times strictly increasing, which listeners rely on
+	lastWrite time.Time
+	// changed is closed and replaced on every write to wake listeners
+	changed chan struct{}
+}
+
+// newMemoryFirestoreClient starts an in-memory Firestore backend and returns a client connected
+// to it, with a function that stops the backend once the client is closed
+func newMemoryFirestoreClient(ctx context.Context, projectID string) (*firestore.Client, func(), error) {
+	backend := &memoryFirestore{
+		docs:      make(map[string]*pb.Document),
+		txs:       make(map[string]map[string]*timestamppb.Timestamp),
+		changed:   make(chan struct{}),
+		lastWrite: time.Now(),
+	}
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	pb.RegisterFirestoreServer(server, backend)
+	go server.Serve(listener)
+
+	conn, err := grpc.NewClient("passthrough:///memory",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		server.Stop()
+		return nil, nil, fmt.Errorf("failed to connect to in-memory firestore: %w", err)
+	}
+
+	client, err := firestore.NewClient(ctx, projectID, option.WithGRPCConn(conn))
+	if err != nil {
+		conn.Close()
+		server.Stop()
+		return nil, nil, fmt.Errorf("failed to create in-memory firestore client: %w", err)
+	}
+	return client, server.Stop, nil
+}
+
+// commitTime returns a write time later than every earlier one. Callers hold mu.
+func (m *memoryFirestore) commitTime() *timestamppb.Timestamp {
+	now := time.Now()
+	if !now.After(m.lastWrite) {
+		now = m.lastWrite.Add(time.Microsecond)
+	}
+	m.lastWrite = now
+	return timestamppb.New(now)
+}
+
+// notify wakes listeners after a write. Callers hold mu.
+func (m *memoryFirestore) notify() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// recordRead adds a document version to a transaction's read set. Callers hold mu.
+func (m *memoryFirestore) recordRead(txID []byte, name string) error {
+	if txID == nil {
+		return nil
+	}
+	reads, ok := m.txs[string(txID)]
+	if !ok {
+		return status.Error(codes.InvalidArgument, "transaction is not open")
+	}
+	if _, seen := reads[name]; seen {
+		return nil
+	}
+	if doc, ok := m.docs[name]; ok {
+		reads[name] = doc.UpdateTime
+	} else {
+		reads[name] = nil
+	}
+	return nil
+}
+
+func (m *memoryFirestore) BeginTransaction(ctx context.Context, req *pb.BeginTransactionRequest) (*pb.BeginTransactionResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if retry := req.GetOptions().GetReadWrite().GetRetryTransaction(); retry != nil {
+		delete(m.txs, string(retry))
+	}
+	m.nextTx++
+	txID := binary.BigEndian.AppendUint64(nil, m.nextTx)
+	m.txs[string(txID)] = make(map[string]*timestamppb.Timestamp)
+	return &pb.BeginTransactionResponse{Transaction: txID}, nil
+}
+
+func (m *memoryFirestore) Rollback(ctx context.Context, req *pb.RollbackRequest) (*emptypb.Empty, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.txs, string(req.Transaction))
+	return &emptypb.Empty{}, nil
+}
+
+func (m *memoryFirestore) BatchGetDocuments(req *pb.BatchGetDocumentsRequest, stream pb.Firestore_BatchGetDocumentsServer) error {
+	m.mu.Lock()
+	var responses []*pb.BatchGetDocumentsResponse
+	readTime := timestamppb.New(m.lastWrite)
+	for _, name := range req.Documents {
+		if err := m.recordRead(req.GetTransaction(), name); err != nil {
+			m.mu.Unlock()
+			return err
+		}
+		res := &pb.BatchGetDocumentsResponse{ReadTime: readTime}
+		if doc, ok := m.docs[name]; ok {
+			res.Result = &pb.BatchGetDocumentsResponse_Found{Found: projectDocument(doc, req.Mask.GetFieldPaths())}
+		} else {
+			res.Result = &pb.BatchGetDocumentsResponse_Missing{Missing: name}
+		}
+		responses = append(responses, res)
+	}
+	m.mu.Unlock()
+
+	for _, res := range responses {
+		if err := stream.Send(res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryFirestore) RunQuery(req *pb.RunQueryRequest, stream pb.Firestore_RunQueryServer) error {
+	m.mu.Lock()
+	docs, err := m.runQuery(req.Parent, req.GetStructuredQuery())
+	if err == nil {
+		for _, doc := range docs {
+			if err = m.recordRead(req.GetTransaction(), doc.Name); err != nil {
+				break
+			}
+		}
+	}
+	readTime := timestamppb.New(m.lastWrite)
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if len(docs) == 0 {
+		return stream.Send(&pb.RunQueryResponse{ReadTime: readTime})
+	}
+	for _, doc := range docs {
+		if err := stream.Send(&pb.RunQueryResponse{Document: doc, ReadTime: readTime}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryFirestore) Commit(ctx context.Context, req *pb.CommitRequest) (*pb.CommitResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if req.Transaction != nil {
+		reads, ok := m.txs[string(req.Transaction)]
+		if !ok {
+			return nil, status.Error(codes.InvalidArgument, "transaction is not open")
+		}
+		delete(m.txs, string(req.Transaction))
+		for name, seen := range reads {
+			current, exists := m.docs[name]
+			if exists != (seen != nil) || (exists && !proto.Equal(seen, current.UpdateTime)) {
+				return nil, status.Error(codes.Aborted, "transaction conflicted with a concurrent write")
+			}
+		}
+	}
+
+	// Writes apply together or not at all, so stage them on a copy of the touched documents
+	commitTime := m.commitTime()
+	staged := make(map[string]*pb.Document)
+	results := make([]*pb.WriteResult, len(req.Writes))
+	for i, write := range req.Writes {
+		result, err := m.applyWrite(staged, write, commitTime)
+		if err != nil {
+			return nil, err
+		}
+		results[i] = result
+	}
+
+	for name, doc := range staged {
+		if doc == nil {
+			delete(m.docs, name)
+		} else {
+			m.docs[name] = doc
+		}
+	}
+	if len(staged) > 0 {
+		m.notify()
+	}
+	return &pb.CommitResponse{WriteResults: results, CommitTime: commitTime}, nil
+}
+
+func (m *memoryFirestore) BatchWrite(ctx context.Context, req *pb.BatchWriteRequest) (*pb.BatchWriteResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := &pb.BatchWriteResponse{
+		WriteResults: make([]*pb.WriteResult, len(req.Writes)),
+		Status:       make([]*rpcstatus.Status, len(req.Writes)),
+	}
+	commitTime := m.commitTime()
+	for i, write := range req.Writes {
+		staged := make(map[string]*pb.Document)
+		result, err := m.applyWrite(staged, write, commitTime)
+		if err != nil {
+			res.WriteResults[i] = &pb.WriteResult{}
+			res.Status[i] = status.Convert(err).Proto()
+			continue
+		}
+		for name, doc := range staged {
+			if doc == nil {
+				delete(m.docs, name)
+			} else {
+				m.docs[name] = doc
+			}
+		}
+		res.WriteResults[i] = result
+		res.Status[i] = &rpcstatus.Status{}
+	}
+	m.notify()
+	return res, nil
+}
+
+// applyWrite applies one write to staged, which shadows the stored documents; a nil staged
+// document is a deletion. Callers hold mu.
+func (m *memoryFirestore) applyWrite(staged map[string]*pb.Document, write *pb.Write, commitTime *timestamppb.Timestamp) (*pb.WriteResult, error) {
+	var name string
+	switch op := write.Operation.(type) {
+	case *pb.Write_Update:
+		name = op.Update.Name
+	case *pb.Write_Delete:
+		name = op.Delete
+	default:
+		return nil, status.Errorf(codes.Unimplemented, "unsupported write %T", op)
+	}
+
+	current, ok := staged[name]
+	if !ok {
+		current = m.docs[name]
+	}
+	exists := current != nil
+
+	if pre := write.CurrentDocument; pre != nil {
+		switch cond := pre.ConditionType.(type) {
+		case *pb.Precondition_Exists:
+			if cond.Exists && !exists {
+				return nil, status.Errorf(codes.NotFound, "no document to update: %s", name)
+			}
+			if !cond.Exists && exists {
+				return nil, status.Errorf(codes.AlreadyExists, "document already exists: %s", name)
+			}
+		case *pb.Precondition_UpdateTime:
+			if !exists || !proto.Equal(cond.UpdateTime, current.UpdateTime) {
+				return nil, status.Errorf(codes.FailedPrecondition, "document %s was updated since it was read", name)
+			}
+		}
+	}
+
+	if _, ok := write.Operation.(*pb.Write_Delete); ok {
+		staged[name] = nil
+		return &pb.WriteResult{UpdateTime: commitTime}, nil
+	}
+
+	update := write.GetUpdate()
+	doc := &pb.Document{Name: name, Fields: map[string]*pb.Value{}, CreateTime: commitTime}
+	if exists {
+		doc.CreateTime = current.CreateTime
+	}
+	if mask := write.UpdateMask; mask != nil {
+		if exists {
+			doc.Fields = proto.Clone(&pb.MapValue{Fields: current.Fields}).(*pb.MapValue).Fields
+		}
+		for _, path := range mask.FieldPaths {
+			parts, err := parseFieldPath(path)
+			if err != nil {
+				return nil, err
+			}
+			if value, ok := lookupField(update.Fields, parts); ok {
+				setField(doc.Fields, parts, proto.Clone(value).(*pb.Value))
+			} else {
+				deleteField(doc.Fields, parts)
+			}
+		}
+	} else {
+		doc.Fields = proto.Clone(&pb.MapValue{Fields: update.Fields}).(*pb.MapValue).Fields
+	}
+
+	var transformResults []*pb.Value
+	for _, transform := range write.UpdateTransforms {
+		parts, err := parseFieldPath(transform.FieldPath)
+		if err != nil {
+			return nil, err
+		}
+		current, _ := lookupField(doc.Fields, parts)
+		value, err := applyTransform(transform, current, commitTime)
+		if err != nil {
+			return nil, err
+		}
+		setField(doc.Fields, parts, value)
+		transformResults = append(transformResults, value)
+	}
+
+	doc.UpdateTime = commitTime
+	staged[name] = doc
+	return &pb.WriteResult{UpdateTime: commitTime, TransformResults: transformResults}, nil
+}
+
+// applyTransform computes a field transform's result from the field's current value
+func applyTransform(transform *pb.DocumentTransform_FieldTransform, current *pb.Value, commitTime *timestamppb.Timestamp) (*pb.Value, error) {
+	switch t := transform.TransformType.(type) {
+	case *pb.DocumentTransform_FieldTransform_SetToServerValue:
+		return &pb.Value{ValueType: &pb.Value_TimestampValue{TimestampValue: commitTime}}, nil
+	case *pb.DocumentTransform_FieldTransform_Increment:
+		if !isNumber(current) {
+			return t.Increment, nil
+		}
+		a, aInt := current.ValueType.(*pb.Value_IntegerValue)
+		b, bInt := t.Increment.ValueType.(*pb.Value_IntegerValue)
+		if aInt && bInt {
+			return &pb.Value{ValueType: &pb.Value_IntegerValue{IntegerValue: a.IntegerValue + b.IntegerValue}}, nil
+		}
+		return &pb.Value{ValueType: &pb.Value_DoubleValue{DoubleValue: numberOf(current) + numberOf(t.Increment)}}, nil
+	case *pb.DocumentTransform_FieldTransform_Maximum:
+		if !isNumber(current) || compareValues(t.Maximum, current) > 0 {
+			return t.Maximum, nil
+		}
+		return current, nil
+	case *pb.DocumentTransform_FieldTransform_Minimum:
+		if !isNumber(current) || compareValues(t.Minimum, current) < 0 {
+			return t.Minimum, nil
+		}
+		return current, nil
+	case *pb.DocumentTransform_FieldTransform_AppendMissingElements:
+		values := current.GetArrayValue().GetValues()
+		for _, add := range t.AppendMissingElements.Values {
+			if !containsValue(values, add) {
+				values = append(values, add)
+			}
+		}
+		return &pb.Value{ValueType: &pb.Value_ArrayValue{ArrayValue: &pb.ArrayValue{Values: values}}}, nil
+	case *pb.DocumentTransform_FieldTransform_RemoveAllFromArray:
+		var values []*pb.Value
+		for _, value := range current.GetArrayValue().GetValues() {
+			if !containsValue(t.RemoveAllFromArray.Values, value) {
+				values = append(values, value)
+			}
+		}
+		return &pb.Value{ValueType: &pb.Value_ArrayValue{ArrayValue: &pb.ArrayValue{Values: values}}}, nil
+	default:
+		return nil, status.Errorf(codes.Unimplemented, "unsupported transform %T", t)
+	}
+}
+
+func (m *memoryFirestore) Listen(stream pb.Firestore_ListenServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	target := req.GetAddTarget()
+	if target == nil {
+		return status.Error(codes.InvalidArgument, "the first listen request must add a target")
+	}
+
+	// The client only sends more requests to remove the target, so any request or error ends the stream
+	closed := make(chan struct{})
+	go func() {
+		stream.Recv()
+		close(closed)
+	}()
+
+	send := func(res *pb.ListenResponse) error { return stream.Send(res) }
+	targetChange := func(changeType pb.TargetChange_TargetChangeType, ids []int32, readTime *timestamppb.Timestamp) error {
+		change := &pb.TargetChange{TargetChangeType: changeType, TargetIds: ids, ReadTime: readTime}
+		if readTime != nil {
+			change.ResumeToken, _ = proto.Marshal(readTime)
+		}
+		return send(&pb.ListenResponse{ResponseType: &pb.ListenResponse_TargetChange{TargetChange: change}})
+	}
+
+	ids := []int32{target.TargetId}
+	if err := targetChange(pb.TargetChange_ADD, ids, nil); err != nil {
+		return err
+	}
+	if target.GetResumeToken() != nil {
+		// The client still holds the documents it saw before reconnecting; start it afresh
+		if err := targetChange(pb.TargetChange_RESET, ids, nil); err != nil {
+			return err
+		}
+	}
+
+	known := make(map[string]*timestamppb.Timestamp)
+	for first := true; ; first = false {
+		m.mu.Lock()
+		docs, err := m.evaluateTarget(target)
+		readTime := timestamppb.New(m.lastWrite)
+		changed := m.changed
+		m.mu.Unlock()
+		if err != nil {
+			return err
+		}
+
+		matched := make(map[string]bool, len(docs))
+		for _, doc := range docs {
+			matched[doc.Name] = true
+			if seen, ok := known[doc.Name]; ok && proto.Equal(seen, doc.UpdateTime) {
+				continue
+			}
+			known[doc.Name] = doc.UpdateTime
+			if err := send(&pb.ListenResponse{ResponseType: &pb.ListenResponse_DocumentChange{
+				DocumentChange: &pb.DocumentChange{Document: doc, TargetIds: ids},
+			}}); err != nil {
+				return err
+			}
+		}
+		for name := range known {
+			if matched[name] {
+				continue
+			}
+			delete(known, name)
+			if err := send(&pb.ListenResponse{ResponseType: &pb.ListenResponse_DocumentRemove{
+				DocumentRemove: &pb.DocumentRemove{Document: name, RemovedTargetIds: ids},
+			}}); err != nil {
+				return err
+			}
+		}
+
+		if first {
+			if err := targetChange(pb.TargetChange_CURRENT, ids, readTime); err != nil {
+				return err
+			}
+		}
+		if err := targetChange(pb.TargetChange_NO_CHANGE, nil, readTime); err != nil {
+			return err
+		}
+
+		select {
+		case <-changed:
+		case <-closed:
+			return nil
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// evaluateTarget returns the documents a listen target currently matches. Callers hold mu.
+func (m *memoryFirestore) evaluateTarget(target *pb.Target) ([]*pb.Document, error) {
+	switch t := target.TargetType.(type) {
+	case *pb.Target_Query:
+		return m.runQuery(t.Query.Parent, t.Query.GetStructuredQuery())
+	case *pb.Target_Documents:
+		var docs []*pb.Document
+		for _, name := range t.Documents.Documents {
+			if doc, ok := m.docs[name]; ok {
+				docs = append(docs, proto.Clone(doc).(*pb.Document))
+			}
+		}
+		return docs, nil
+	default:
+		return nil, status.Errorf(codes.Unimplemented, "unsupported target %T", t)
+	}
+}
+
+// runQuery evaluates a structured query against the stored documents. Callers hold mu.
+func (m *memoryFirestore) runQuery(parent string, query *pb.StructuredQuery) ([]*pb.Document, error) {
+	if query == nil || len(query.From) != 1 {
+		return nil, status.Error(codes.InvalidArgument, "queries must select exactly one collection")
+	}
+	from := query.From[0]
+
+	orders := query.OrderBy
+	if len(orders) == 0 || orders[len(orders)-1].Field.FieldPath != firestore.DocumentID {
+		direction := pb.StructuredQuery_ASCENDING
+		if len(orders) > 0 {
+			direction = orders[len(orders)-1].Direction
+		}
+		orders = append(orders[:len(orders):len(orders)], &pb.StructuredQuery_Order{
+			Field:     &pb.StructuredQuery_FieldReference{FieldPath: firestore.DocumentID},
+			Direction: direction,
+		})
+	}
+	orderPaths := make([][]string, len(orders))
+	for i, order := range orders {
+		parts, err := parseFieldPath(order.Field.FieldPath)
+		if err != nil {
+			return nil, err
+		}
+		orderPaths[i] = parts
+	}
+
+	var docs []*pb.Document
+	for name, doc := range m.docs {
+		if !inCollection(name, parent, from.CollectionId, from.AllDescendants) {
+			continue
+		}
+		if query.Where != nil {
+			ok, err := matchesFilter(doc, query.Where)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		// Documents without an ordered field are not in the ordering's index
+		missing := false
+		for _, parts := range orderPaths {
+			if _, ok := documentValue(doc, parts); !ok {
+				missing = true
+				break
+			}
+		}
+		if !missing {
+			docs = append(docs, doc)
+		}
+	}
+
+	compareDocs := func(a, b *pb.Document) int {
+		for i, parts := range orderPaths {
+			av, _ := documentValue(a, parts)
+			bv, _ := documentValue(b, parts)
+			if c := compareValues(av, bv); c != 0 {
+				if orders[i].Direction == pb.StructuredQuery_DESCENDING {
+					return -c
+				}
+				return c
+			}
+		}
+		return 0
+	}
+	sort.Slice(docs, func(i, j int) bool { return compareDocs(docs[i], docs[j]) < 0 })
+
+	// compareCursor orders a document against a cursor's values, which prefix the ordering
+	compareCursor := func(doc *pb.Document, cursor *pb.Cursor) int {
+		for i, value := range cursor.Values {
+			if i >= len(orderPaths) {
+				break
+			}
+			dv, _ := documentValue(doc, orderPaths[i])
+			if c := compareValues(dv, value); c != 0 {
+				if orders[i].Direction == pb.StructuredQuery_DESCENDING {
+					return -c
+				}
+				return c
+			}
+		}
+		return 0
+	}
+
+	var results []*pb.Document
+	offset := query.Offset
+	for _, doc := range docs {
+		if start := query.StartAt; start != nil {
+			c := compareCursor(doc, start)
+			if c < 0 || (c == 0 && !start.Before) {
+				continue
+			}
+		}
+		if end := query.EndAt; end != nil {
+			c := compareCursor(doc, end)
+			if c > 0 || (c == 0 && end.Before) {
+				continue
+			}
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if limit := query.Limit; limit != nil && len(results) >= int(limit.Value) {
+			break
+		}
+
+		var fields []string
+		if query.Select != nil {
+			fields = []string{}
+			for _, field := range query.Select.Fields {
+				if field.FieldPath != firestore.DocumentID {
+					fields = append(fields, field.FieldPath)
+				}
+			}
+		}
+		results = append(results, projectDocument(doc, fields))
+	}
+	return results, nil
+}
+
+// inCollection reports whether a document belongs to collection under parent, or with
+// allDescendants to any collection of that ID beneath parent
+func inCollection(name, parent, collection string, allDescendants bool) bool {
+	if !strings.HasPrefix(name, parent+"/") {
+		return false
+	}
+	segments := strings.Split(strings.TrimPrefix(name, parent+"/"), "/")
+	if allDescendants {
+		return len(segments) >= 2 && len(segments)%2 == 0 && segments[len(segments)-2] == collection
+	}
+	return len(segments) == 2 && segments[0] == collection
+}
+
+// projectDocument returns a copy of doc with only the given fields; nil fields copies them all
+func projectDocument(doc *pb.Document, fields []string) *pb.Document {
+	if fields == nil {
+		return proto.Clone(doc).(*pb.Document)
+	}
+	projected := &pb.Document{Name: doc.Name, Fields: map[string]*pb.Value{}, CreateTime: doc.CreateTime, UpdateTime: doc.UpdateTime}
+	for _, field := range fields {
+		parts, err := parseFieldPath(field)
+		if err != nil {
+			continue
+		}
+		if value, ok := lookupField(doc.Fields, parts); ok {
+			setField(projected.Fields, parts, proto.Clone(value).(*pb.Value))
+		}
+	}
+	return projected
+}
+
+// matchesFilter evaluates a query filter against a document
+func matchesFilter(doc *pb.Document, filter *pb.StructuredQuery_Filter) (bool, error) {
+	switch f := filter.FilterType.(type) {
+	case *pb.StructuredQuery_Filter_CompositeFilter:
+		or := f.CompositeFilter.Op == pb.StructuredQuery_CompositeFilter_OR
+		for _, sub := range f.CompositeFilter.Filters {
+			ok, err := matchesFilter(doc, sub)
+			if err != nil {
+				return false, err
+			}
+			if ok == or {
+				return or, nil
+			}
+		}
+		return !or, nil
+
+	case *pb.StructuredQuery_Filter_FieldFilter:
+		parts, err := parseFieldPath(f.FieldFilter.Field.FieldPath)
+		if err != nil {
+			return false, err
+		}
+		value, exists := documentValue(doc, parts)
+		operand := f.FieldFilter.Value
+		switch f.FieldFilter.Op {
+		case pb.StructuredQuery_FieldFilter_EQUAL:
+			return exists && compareValues(value, operand) == 0, nil
+		case pb.StructuredQuery_FieldFilter_NOT_EQUAL:
+			return exists && !isNull(value) && compareValues(value, operand) != 0, nil
+		case pb.StructuredQuery_FieldFilter_LESS_THAN:
+			return exists && sameTypeOrder(value, operand) && compareValues(value, operand) < 0, nil
+		case pb.StructuredQuery_FieldFilter_LESS_THAN_OR_EQUAL:
+			return exists && sameTypeOrder(value, operand) && compareValues(value, operand) <= 0, nil
+		case pb.StructuredQuery_FieldFilter_GREATER_THAN:
+			return exists && sameTypeOrder(value, operand) && compareValues(value, operand) > 0, nil
+		case pb.StructuredQuery_FieldFilter_GREATER_THAN_OR_EQUAL:
+			return exists && sameTypeOrder(value, operand) && compareValues(value, operand) >= 0, nil
+		case pb.StructuredQuery_FieldFilter_ARRAY_CONTAINS:
+			return exists && containsValue(value.GetArrayValue().GetValues(), operand), nil
+		case pb.StructuredQuery_FieldFilter_ARRAY_CONTAINS_ANY:
+			for _, candidate := range operand.GetArrayValue().GetValues() {
+				if exists && containsValue(value.GetArrayValue().GetValues(), candidate) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case pb.StructuredQuery_FieldFilter_IN:
+			return exists && containsValue(operand.GetArrayValue().GetValues(), value), nil
+		case pb.StructuredQuery_FieldFilter_NOT_IN:
+			return exists && !isNull(value) && !containsValue(operand.GetArrayValue().GetValues(), value), nil
+		}
+		return false, status.Errorf(codes.Unimplemented, "unsupported filter operator %s", f.FieldFilter.Op)
+
+	case *pb.StructuredQuery_Filter_UnaryFilter:
+		parts, err := parseFieldPath(f.UnaryFilter.GetField().FieldPath)
+		if err != nil {
+			return false, err
+		}
+		value, exists := documentValue(doc, parts)
+		nan := exists && math.IsNaN(value.GetDoubleValue())
+		switch f.UnaryFilter.Op {
+		case pb.StructuredQuery_UnaryFilter_IS_NULL:
+			return exists && isNull(value), nil
+		case pb.StructuredQuery_UnaryFilter_IS_NOT_NULL:
+			return exists && !isNull(value), nil
+		case pb.StructuredQuery_UnaryFilter_IS_NAN:
+			return nan, nil
+		case pb.StructuredQuery_UnaryFilter_IS_NOT_NAN:
+			return exists && !nan && !isNull(value), nil
+		}
+		return false, status.Errorf(codes.Unimplemented, "unsupported filter operator %s", f.UnaryFilter.Op)
+	}
+	return false, status.Errorf(codes.Unimplemented, "unsupported filter %T", filter.FilterType)
+}
+
+// documentValue returns a document's value at a field path; __name__ is the document reference
+func documentValue(doc *pb.Document, parts []string) (*pb.Value, bool) {
+	if len(parts) == 1 && parts[0] == firestore.DocumentID {
+		return &pb.Value{ValueType: &pb.Value_ReferenceValue{ReferenceValue: doc.Name}}, true
+	}
+	return lookupField(doc.Fields, parts)
+}
+
+// lookupField returns the value at a field path within fields
+func lookupField(fields map[string]*pb.Value, parts []string) (*pb.Value, bool) {
+	value, ok := fields[parts[0]]
+	if !ok {
+		return nil, false
+	}
+	if len(parts) == 1 {
+		return value, true
+	}
+	nested := value.GetMapValue()
+	if nested == nil {
+		return nil, false
+	}
+	return lookupField(nested.Fields, parts[1:])
+}
+
+// setField sets the value at a field path, replacing any non-map value on the way
+func setField(fields map[string]*pb.Value, parts []string, value *pb.Value) {
+	if len(parts) == 1 {
+		fields[parts[0]] = value
+		return
+	}
+	nested := fields[parts[0]].GetMapValue()
+	if nested == nil {
+		nested = &pb.MapValue{}
+		fields[parts[0]] = &pb.Value{ValueType: &pb.Value_MapValue{MapValue: nested}}
+	}
+	if nested.Fields == nil {
+		nested.Fields = map[string]*pb.Value{}
+	}
+	setField(nested.Fields, parts[1:], value)
+}
+
+// deleteField removes the value at a field path, if present
+func deleteField(fields map[string]*pb.Value, parts []string) {
+	if len(parts) == 1 {
+		delete(fields, parts[0])
+		return
+	}
+	if nested := fields[parts[0]].GetMapValue(); nested != nil {
+		deleteField(nested.Fields, parts[1:])
+	}
+}
+
+// parseFieldPath splits a dotted field path, in which components may be quoted with backticks
+func parseFieldPath(path string) ([]string, error) {
+	var parts []string
+	var part strings.Builder
+	quoted := false
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(path):
+			i++
+			part.WriteByte(path[i])
+		case c == '`':
+			quoted = !quoted
+		case c == '.' && !quoted:
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(c)
+		}
+	}
+	parts = append(parts, part.String())
+	if quoted || slices.Contains(parts, "") {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid field path %q", path)
+	}
+	return parts, nil
+}
+
+// typeOrder ranks values by type in Firestore's cross-type ordering
+func typeOrder(v *pb.Value) int {
+	switch v.GetValueType().(type) {
+	case nil, *pb.Value_NullValue:
+		return 0
+	case *pb.Value_BooleanValue:
+		return 1
+	case *pb.Value_IntegerValue, *pb.Value_DoubleValue:
+		return 2
+	case *pb.Value_TimestampValue:
+		return 3
+	case *pb.Value_StringValue:
+		return 4
+	case *pb.Value_BytesValue:
+		return 5
+	case *pb.Value_ReferenceValue:
+		return 6
+	case *pb.Value_GeoPointValue:
+		return 7
+	case *pb.Value_ArrayValue:
+		return 8
+	default:
+		return 9
+	}
+}
+
+// sameTypeOrder reports whether range comparison between two values is meaningful
+func sameTypeOrder(a, b *pb.Value) bool {
+	return typeOrder(a) == typeOrder(b)
+}
+
+// compareValues orders two values as Firestore does, with NaN before every other number
+func compareValues(a, b *pb.Value) int {
+	if ta, tb := typeOrder(a), typeOrder(b); ta != tb {
+		return ta - tb
+	}
+
+	switch av := a.GetValueType().(type) {
+	case *pb.Value_BooleanValue:
+		bv := b.GetBooleanValue()
+		switch {
+		case av.BooleanValue == bv:
+			return 0
+		case !av.BooleanValue:
+			return -1
+		default:
+			return 1
+		}
+	case *pb.Value_IntegerValue, *pb.Value_DoubleValue:
+		ai, aInt := av.(*pb.Value_IntegerValue)
+		bi, bInt := b.ValueType.(*pb.Value_IntegerValue)
+		if aInt && bInt {
+			return compareOrdered(ai.IntegerValue, bi.IntegerValue)
+		}
+		x, y := numberOf(a), numberOf(b)
+		switch {
+		case math.IsNaN(x) && math.IsNaN(y):
+			return 0
+		case math.IsNaN(x):
+			return -1
+		case math.IsNaN(y):
+			return 1
+		}
+		return compareOrdered(x, y)
+	case *pb.Value_TimestampValue:
+		return av.TimestampValue.AsTime().Compare(b.GetTimestampValue().AsTime())
+	case *pb.Value_StringValue:
+		return strings.Compare(av.StringValue, b.GetStringValue())
+	case *pb.Value_BytesValue:
+		return bytes.Compare(av.BytesValue, b.GetBytesValue())
+	case *pb.Value_ReferenceValue:
+		return compareReferences(av.ReferenceValue, b.GetReferenceValue())
+	case *pb.Value_GeoPointValue:
+		if c := compareOrdered(av.GeoPointValue.Latitude, b.GetGeoPointValue().Latitude); c != 0 {
+			return c
+		}
+		return compareOrdered(av.GeoPointValue.Longitude, b.GetGeoPointValue().Longitude)
+	case *pb.Value_ArrayValue:
+		x, y := av.ArrayValue.Values, b.GetArrayValue().GetValues()
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := compareValues(x[i], y[i]); c != 0 {
+				return c
+			}
+		}
+		return compareOrdered(len(x), len(y))
+	case *pb.Value_MapValue:
+		x, y := av.MapValue.Fields, b.GetMapValue().GetFields()
+		xKeys, yKeys := sortedFieldNames(x), sortedFieldNames(y)
+		for i := 0; i < len(xKeys) && i < len(yKeys); i++ {
+			if c := strings.Compare(xKeys[i], yKeys[i]); c != 0 {
+				return c
+			}
+			if c := compareValues(x[xKeys[i]], y[yKeys[i]]); c != 0 {
+				return c
+			}
+		}
+		return compareOrdered(len(xKeys), len(yKeys))
+	}
+	return 0
+}
+
+// compareReferences orders document names segment by segment
+func compareReferences(a, b string) int {
+	x, y := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(x) && i < len(y); i++ {
+		if c := strings.Compare(x[i], y[i]); c != 0 {
+			return c
+		}
+	}
+	return compareOrdered(len(x), len(y))
+}
+
+// compareOrdered compares two ordered values
+func compareOrdered[T int | int64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// sortedFieldNames returns a map value's keys in order
+func sortedFieldNames(fields map[string]*pb.Value) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// containsValue reports whether values holds a value equal to v
+func containsValue(values []*pb.Value, v *pb.Value) bool {
+	for _, candidate := range values {
+		if compareValues(candidate, v) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// isNumber reports whether v is an integer or double
+func isNumber(v *pb.Value) bool {
+	switch v.GetValueType().(type) {
+	case *pb.Value_IntegerValue, *pb.Value_DoubleValue:
+		return true
+	}
+	return false
+}
+
+// numberOf returns a numeric value as a float64
+func numberOf(v *pb.Value) float64 {
+	if i, ok := v.GetValueType().(*pb.Value_IntegerValue); ok {
+		return float64(i.IntegerValue)
+	}
+	return v.GetDoubleValue()
+}
+
+// isNull reports whether v is null
+func isNull(v *pb.Value) bool {
+	_, ok := v.GetValueType().(*pb.Value_NullValue)
+	return ok
+}
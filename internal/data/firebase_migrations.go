@@ -0,0 +1,99 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// legacyMoneyFields maps pre-migration float64 USD fields to their micro-USD replacements per collection
+var legacyMoneyFields = map[string]map[string]string{
+	"users": {
+		"balance": "balance_micros",
+	},
+	"request_logs": {
+		"base_cost":      "base_cost_micros",
+		"markup_amount":  "markup_amount_micros",
+		"total_cost":     "total_cost_micros",
+		"savings_amount": "savings_amount_micros",
+	},
+}
+
+// MigrateMoneyFields rewrites legacy float64 USD fields as integer micro-USD fields.
+// It is idempotent: documents that already carry the micro-USD field are left untouched.
+func (s *Service) MigrateMoneyFields(ctx context.Context) (int, error) {
+	migrated := 0
+
+	for collection, fields := range legacyMoneyFields {
+		count, err := s.migrateCollectionMoneyFields(ctx, collection, fields)
+		migrated += count
+		if err != nil {
+			return migrated, err
+		}
+	}
+
+	slog.Info("Money field migration completed", "documents_migrated", migrated)
+	return migrated, nil
+}
+
+// migrateCollectionMoneyFields migrates the legacy money fields of a single collection
+func (s *Service) migrateCollectionMoneyFields(ctx context.Context, collection string, fields map[string]string) (int, error) {
+	writer := s.dbClient.BulkWriter(ctx)
+	defer writer.End()
+
+	iter := s.dbClient.Collection(collection).Documents(ctx)
+	defer iter.Stop()
+
+	count := 0
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return count, fmt.Errorf("failed to iterate %s: %w", collection, err)
+		}
+
+		raw := doc.Data()
+		var updates []firestore.Update
+		for legacyField, microsField := range fields {
+			legacy, hasLegacy := raw[legacyField]
+			if !hasLegacy {
+				continue
+			}
+			if _, hasMicros := raw[microsField]; !hasMicros {
+				updates = append(updates, firestore.Update{Path: microsField, Value: int64(USDToMicros(toFloat64(legacy)))})
+			}
+			updates = append(updates, firestore.Update{Path: legacyField, Value: firestore.Delete})
+		}
+
+		if len(updates) == 0 {
+			continue
+		}
+
+		if _, err := writer.Update(doc.Ref, updates); err != nil {
+			return count, fmt.Errorf("failed to migrate %s/%s: %w", collection, doc.Ref.ID, err)
+		}
+		count++
+	}
+
+	writer.Flush()
+	return count, nil
+}
+
+// toFloat64 converts a numeric Firestore value to float64
+func toFloat64(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case int64:
+		return float64(n)
+	case int:
+		return float64(n)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,66 @@
+package data
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// modelConfigsCollection holds model prices and capabilities, keyed by model ID
+const modelConfigsCollection = "model_configurations"
+
+// ExportModelConfigs returns every model configuration document as stored, with its document ID
+// under "id"
+func (s *Service) ExportModelConfigs(ctx context.Context) ([]map[string]interface{}, error) {
+	iter := s.dbClient.Collection(modelConfigsCollection).OrderBy(firestore.DocumentID, firestore.Asc).Documents(ctx)
+	defer iter.Stop()
+
+	var configs []map[string]interface{}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list model configurations: %w", err)
+		}
+
+		config := doc.Data()
+		config["id"] = doc.Ref.ID
+		configs = append(configs, config)
+	}
+
+	return configs, nil
+}
+
+// ImportModelConfigs writes model configuration documents, replacing any with the same "id".
+// Running replicas pick the changes up through their snapshot listeners.
+func (s *Service) ImportModelConfigs(ctx context.Context, configs []map[string]interface{}) error {
+	for i, config := range configs {
+		if id, _ := config["id"].(string); id == "" {
+			return fmt.Errorf("model configuration %d has no id", i)
+		}
+	}
+
+	writer := s.dbClient.BulkWriter(ctx)
+	defer writer.End()
+
+	jobs := make([]*firestore.BulkWriterJob, len(configs))
+	for i, config := range configs {
+		job, err := writer.Set(s.dbClient.Collection(modelConfigsCollection).Doc(config["id"].(string)), config)
+		if err != nil {
+			return fmt.Errorf("failed to import model configuration %v: %w", config["id"], err)
+		}
+		jobs[i] = job
+	}
+	writer.Flush()
+
+	for i, job := range jobs {
+		if _, err := job.Results(); err != nil {
+			return fmt.Errorf("failed to import model configuration %v: %w", configs[i]["id"], err)
+		}
+	}
+	return nil
+}
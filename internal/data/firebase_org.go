@@ -0,0 +1,343 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/google/uuid"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrNotOrgMember is returned when a user is not a member of an organization
+var ErrNotOrgMember = errors.New("user is not a member of the organization")
+
+// Firestore collections for organizations and their memberships
+const (
+	organizationsCollection = "organizations"
+	orgMembersCollection    = "organization_members"
+)
+
+// OrgRole is a member's role within an organization
+type OrgRole string
+
+const (
+	OrgRoleOwner  OrgRole = "owner"
+	OrgRoleAdmin  OrgRole = "admin"
+	OrgRoleMember OrgRole = "member"
+)
+
+// Valid reports whether the role is one of the known roles
+func (r OrgRole) Valid() bool {
+	return r == OrgRoleOwner || r == OrgRoleAdmin || r == OrgRoleMember
+}
+
+// CanManageMembers reports whether the role may add and remove members
+func (r OrgRole) CanManageMembers() bool {
+	return r == OrgRoleOwner || r == OrgRoleAdmin
+}
+
+// Organization represents a team account whose members share a balance and pricing tier
+type Organization struct {
+	ID        string    `firestore:"id" json:"id"`
+	Name      string    `firestore:"name" json:"name"`
+	OwnerID   string    `firestore:"owner_id" json:"owner_id"`
+	Balance   MicroUSD  `firestore:"balance_micros" json:"balance"`
+	TierID    string    `firestore:"tier_id" json:"tier_id"`
+	IsActive  bool      `firestore:"is_active" json:"is_active"`
+	CreatedAt time.Time `firestore:"created_at" json:"created_at"`
+	UpdatedAt time.Time `firestore:"updated_at" json:"updated_at"`
+}
+
+// OrgMember represents a user's membership in an organization
+type OrgMember struct {
+	OrgID    string    `firestore:"org_id" json:"org_id"`
+	UserID   string    `firestore:"user_id" json:"user_id"`
+	Role     OrgRole   `firestore:"role" json:"role"`
+	JoinedAt time.Time `firestore:"joined_at" json:"joined_at"`
+}
+
+// MemberUsage attributes an organization's usage to a single member
+type MemberUsage struct {
+	UserID       string   `json:"user_id"`
+	Requests     int      `json:"requests"`
+	InputTokens  int      `json:"input_tokens"`
+	OutputTokens int      `json:"output_tokens"`
+	BYOKRequests int      `json:"byok_requests"`
+	TotalCost    MicroUSD `json:"total_cost"`
+}
+
+// orgMemberRef returns the membership document for a user in an organization
+func (s *Service) orgMemberRef(orgID, userID string) *firestore.DocumentRef {
+	return s.dbClient.Collection(orgMembersCollection).Doc(orgID + "_" + userID)
+}
+
+// CreateOrganization creates an organization with the given user as its owner
+func (s *Service) CreateOrganization(ctx context.Context, name, ownerID, tierID string) (*Organization, error) {
+	now := time.Now()
+	org := &Organization{
+		ID:        uuid.New().String(),
+		Name:      name,
+		OwnerID:   ownerID,
+		TierID:    tierID,
+		IsActive:  true,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		if err := tx.Create(s.dbClient.Collection(organizationsCollection).Doc(org.ID), org); err != nil {
+			return err
+		}
+		return tx.Create(s.orgMemberRef(org.ID, ownerID), &OrgMember{
+			OrgID:    org.ID,
+			UserID:   ownerID,
+			Role:     OrgRoleOwner,
+			JoinedAt: now,
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create organization: %w", err)
+	}
+
+	slog.Info("Organization created", "org_id", org.ID, "owner_id", ownerID)
+	return org, nil
+}
+
+// GetOrganization gets an organization by ID
+func (s *Service) GetOrganization(ctx context.Context, orgID string) (*Organization, error) {
+	ctx, span := startSpan(ctx, "GetOrganization", organizationsCollection)
+	defer span.End()
+
+	doc, err := s.dbClient.Collection(organizationsCollection).Doc(orgID).Get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("organization not found: %w", err)
+	}
+
+	var org Organization
+	if err := doc.DataTo(&org); err != nil {
+		return nil, fmt.Errorf("failed to parse organization: %w", err)
+	}
+
+	return &org, nil
+}
+
+// GetOrgMember gets a user's membership in an organization
+func (s *Service) GetOrgMember(ctx context.Context, orgID, userID string) (*OrgMember, error) {
+	doc, err := s.orgMemberRef(orgID, userID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrNotOrgMember
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get organization member: %w", err)
+	}
+
+	var member OrgMember
+	if err := doc.DataTo(&member); err != nil {
+		return nil, fmt.Errorf("failed to parse organization member: %w", err)
+	}
+
+	return &member, nil
+}
+
+// ListOrgMembers lists the members of an organization
+func (s *Service) ListOrgMembers(ctx context.Context, orgID string) ([]*OrgMember, error) {
+	iter := s.dbClient.Collection(orgMembersCollection).Where("org_id", "==", orgID).Documents(ctx)
+	defer iter.Stop()
+
+	var members []*OrgMember
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list organization members: %w", err)
+		}
+
+		var member OrgMember
+		if err := doc.DataTo(&member); err != nil {
+			continue
+		}
+
+		members = append(members, &member)
+	}
+
+	return members, nil
+}
+
+// SetOrgMember adds a member to an organization or changes an existing member's role
+func (s *Service) SetOrgMember(ctx context.Context, orgID, userID string, role OrgRole) (*OrgMember, error) {
+	member := &OrgMember{
+		OrgID:    orgID,
+		UserID:   userID,
+		Role:     role,
+		JoinedAt: time.Now(),
+	}
+
+	// Keep the original join date when changing an existing member's role
+	if existing, err := s.GetOrgMember(ctx, orgID, userID); err == nil {
+		member.JoinedAt = existing.JoinedAt
+	} else if !errors.Is(err, ErrNotOrgMember) {
+		return nil, err
+	}
+
+	if _, err := s.orgMemberRef(orgID, userID).Set(ctx, member); err != nil {
+		return nil, fmt.Errorf("failed to set organization member: %w", err)
+	}
+
+	return member, nil
+}
+
+// RemoveOrgMember removes a member from an organization and revokes their organization API keys
+func (s *Service) RemoveOrgMember(ctx context.Context, orgID, userID string) error {
+	keys := s.dbClient.Collection("api_keys").
+		Where("org_id", "==", orgID).
+		Where("user_id", "==", userID).
+		Where("status", "==", "active")
+
+	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		docs, err := tx.Documents(keys).GetAll()
+		if err != nil {
+			return fmt.Errorf("failed to list member API keys: %w", err)
+		}
+
+		for _, doc := range docs {
+			if err := tx.Update(doc.Ref, []firestore.Update{{Path: "status", Value: "revoked"}}); err != nil {
+				return err
+			}
+		}
+
+		return tx.Delete(s.orgMemberRef(orgID, userID))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove organization member: %w", err)
+	}
+
+	slog.Info("Organization member removed", "org_id", orgID, "user_id", userID)
+	return nil
+}
+
+// UpdateOrgBalance updates an organization's shared balance and records the change,
+// attributed to the member who caused it, in the balance ledger
+func (s *Service) UpdateOrgBalance(ctx context.Context, orgID, memberID string, amount MicroUSD, entryType LedgerEntryType, requestID string) error {
+	ctx, span := startSpan(ctx, "UpdateOrgBalance", organizationsCollection)
+	defer span.End()
+
+	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		_, err := s.applyOrgBalanceChange(tx, orgID, memberID, amount, entryType, requestID)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update organization balance: %w", err)
+	}
+
+	slog.Info("Organization balance updated",
+		"org_id", orgID,
+		"member_id", memberID,
+		"amount", amount.String(),
+		"type", entryType,
+		"request_id", requestID,
+	)
+
+	return nil
+}
+
+// applyOrgBalanceChange updates an organization's balance and writes the matching ledger entry,
+// attributed to the member, within a transaction. Any reads the caller needs must happen before
+// calling it. Charges may leave the balance in debt; it returns the ledger entry written.
+func (s *Service) applyOrgBalanceChange(tx *firestore.Transaction, orgID, memberID string, amount MicroUSD, entryType LedgerEntryType, requestID string) (*LedgerEntry, error) {
+	orgRef := s.dbClient.Collection(organizationsCollection).Doc(orgID)
+
+	doc, err := tx.Get(orgRef)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get organization: %w", err)
+	}
+
+	var org Organization
+	if err := doc.DataTo(&org); err != nil {
+		return nil, fmt.Errorf("failed to parse organization: %w", err)
+	}
+
+	org.Balance += amount
+	org.UpdatedAt = time.Now()
+
+	debt, err := settleDebt(entryType, org.Balance, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Set(orgRef, org); err != nil {
+		return nil, err
+	}
+
+	entry := &LedgerEntry{
+		UserID:           memberID,
+		OrgID:            orgID,
+		Type:             entryType,
+		RequestID:        requestID,
+		Amount:           amount,
+		ResultingBalance: org.Balance,
+		Debt:             debt,
+		CreatedAt:        org.UpdatedAt,
+	}
+	if err := s.writeLedgerEntry(tx, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// GetOrgUsageByMember aggregates an organization's request logs per member for a date range
+func (s *Service) GetOrgUsageByMember(ctx context.Context, orgID string, startDate, endDate time.Time) ([]MemberUsage, error) {
+	iter := s.dbClient.Collection("request_logs").
+		Where("org_id", "==", orgID).
+		Where("request_timestamp", ">=", startDate).
+		Where("request_timestamp", "<=", endDate).
+		Documents(ctx)
+	defer iter.Stop()
+
+	usage := make(map[string]*MemberUsage)
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to query request logs: %w", err)
+		}
+
+		var log RequestLog
+		if err := doc.DataTo(&log); err != nil {
+			continue // Skip malformed logs
+		}
+
+		member, ok := usage[log.UserID]
+		if !ok {
+			member = &MemberUsage{UserID: log.UserID}
+			usage[log.UserID] = member
+		}
+		member.Requests++
+		member.InputTokens += log.InputTokens
+		member.OutputTokens += log.OutputTokens
+		if log.BYOK {
+			member.BYOKRequests++
+		}
+		member.TotalCost += log.TotalCost
+	}
+
+	members := make([]MemberUsage, 0, len(usage))
+	for _, member := range usage {
+		members = append(members, *member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].TotalCost > members[j].TotalCost
+	})
+
+	return members, nil
+}
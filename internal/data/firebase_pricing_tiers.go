@@ -0,0 +1,158 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// pricingTiersCollection holds the pricing tiers accounts are billed under
+const pricingTiersCollection = "pricing_tiers"
+
+// ErrPricingTierNotFound is returned when a pricing tier does not exist
+var ErrPricingTierNotFound = errors.New("pricing tier not found")
+
+// ListPricingTiers lists every pricing tier, ordered by ID
+func (s *Service) ListPricingTiers(ctx context.Context) ([]*PricingTier, error) {
+	iter := s.dbClient.Collection(pricingTiersCollection).OrderBy(firestore.DocumentID, firestore.Asc).Documents(ctx)
+	defer iter.Stop()
+
+	var tiers []*PricingTier
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list pricing tiers: %w", err)
+		}
+
+		var tier PricingTier
+		if err := doc.DataTo(&tier); err != nil {
+			slog.Warn("Failed to parse pricing tier", "doc_id", doc.Ref.ID, "error", err)
+			continue
+		}
+		if tier.ID == "" {
+			tier.ID = doc.Ref.ID
+		}
+		tiers = append(tiers, &tier)
+	}
+
+	return tiers, nil
+}
+
+// SetTierModelPricing sets a tier's custom pricing for a model, replacing any it already has
+func (s *Service) SetTierModelPricing(ctx context.Context, tierID string, pricing ModelPricing) error {
+	_, err := s.dbClient.Collection(pricingTiersCollection).Doc(tierID).Update(ctx, []firestore.Update{
+		{FieldPath: firestore.FieldPath{"custom_model_pricing", pricing.ModelID}, Value: pricing},
+	})
+	if status.Code(err) == codes.NotFound {
+		return ErrPricingTierNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set model pricing: %w", err)
+	}
+
+	slog.Info("Tier model pricing set", "tier_id", tierID, "model_id", pricing.ModelID)
+	return nil
+}
+
+// DeleteTierModelPricing removes a tier's custom pricing for a model
+func (s *Service) DeleteTierModelPricing(ctx context.Context, tierID, modelID string) error {
+	_, err := s.dbClient.Collection(pricingTiersCollection).Doc(tierID).Update(ctx, []firestore.Update{
+		{FieldPath: firestore.FieldPath{"custom_model_pricing", modelID}, Value: firestore.Delete},
+	})
+	if status.Code(err) == codes.NotFound {
+		return ErrPricingTierNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete model pricing: %w", err)
+	}
+
+	slog.Info("Tier model pricing deleted", "tier_id", tierID, "model_id", modelID)
+	return nil
+}
+
+// OptimizationSettings choose which of a tier's prompts are optimized. Optimizing a short prompt
+// costs more than it saves, and how short that is depends on the model's tokenizer, so model
+// families may set their own threshold or opt out.
+type OptimizationSettings struct {
+	// MinPromptChars is the length a prompt must exceed to be optimized; 0 uses the platform's
+	MinPromptChars int `firestore:"min_prompt_chars,omitempty" json:"min_prompt_chars,omitempty"`
+	// Models override the tier's settings for the models they match; the first match applies
+	Models []ModelOptimization `firestore:"models,omitempty" json:"models,omitempty"`
+}
+
+// ModelOptimization overrides a tier's optimization settings for a model family
+type ModelOptimization struct {
+	// Pattern matches model IDs, such as "claude-*" for a family
+	Pattern string `firestore:"pattern" json:"pattern"`
+	// MinPromptChars replaces the tier's threshold for the models; 0 keeps it
+	MinPromptChars int `firestore:"min_prompt_chars,omitempty" json:"min_prompt_chars,omitempty"`
+	// Disabled never optimizes the models' prompts
+	Disabled bool `firestore:"disabled,omitempty" json:"disabled,omitempty"`
+}
+
+// Threshold returns the length a prompt for a model must exceed to be optimized, falling back to
+// defaultChars, and whether the model's prompts are optimized at all
+func (s OptimizationSettings) Threshold(modelID string, defaultChars int) (int, bool) {
+	threshold := defaultChars
+	if s.MinPromptChars > 0 {
+		threshold = s.MinPromptChars
+	}
+	for _, model := range s.Models {
+		if matched, _ := path.Match(model.Pattern, modelID); !matched {
+			continue
+		}
+		if model.Disabled {
+			return 0, false
+		}
+		if model.MinPromptChars > 0 {
+			threshold = model.MinPromptChars
+		}
+		break
+	}
+	return threshold, true
+}
+
+// Validate checks the settings' thresholds and patterns
+func (s OptimizationSettings) Validate() error {
+	if s.MinPromptChars < 0 {
+		return fmt.Errorf("min_prompt_chars must not be negative")
+	}
+	for _, model := range s.Models {
+		if model.Pattern == "" {
+			return fmt.Errorf("model pattern must not be empty")
+		}
+		if _, err := path.Match(model.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid model pattern %q: %w", model.Pattern, err)
+		}
+		if model.MinPromptChars < 0 {
+			return fmt.Errorf("min_prompt_chars of %q must not be negative", model.Pattern)
+		}
+	}
+	return nil
+}
+
+// SetTierOptimization replaces a tier's optimization settings
+func (s *Service) SetTierOptimization(ctx context.Context, tierID string, settings OptimizationSettings) error {
+	_, err := s.dbClient.Collection(pricingTiersCollection).Doc(tierID).Update(ctx, []firestore.Update{
+		{Path: "optimization", Value: settings},
+	})
+	if status.Code(err) == codes.NotFound {
+		return ErrPricingTierNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set optimization settings: %w", err)
+	}
+
+	slog.Info("Tier optimization settings set", "tier_id", tierID)
+	return nil
+}
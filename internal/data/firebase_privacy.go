@@ -0,0 +1,445 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"firebase.google.com/go/v4/auth"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	dataExportsCollection      = "data_exports"
+	dataExportChunksCollection = "chunks"
+	// dataExportChunkSize keeps each chunk of an export well under Firestore's 1 MiB document limit
+	dataExportChunkSize = 512 << 10
+	// privacyBatchSize is how many documents are read or written per batch when exporting and erasing
+	privacyBatchSize = 400
+)
+
+// Data export statuses
+const (
+	DataExportPending   = "pending"
+	DataExportRunning   = "running"
+	DataExportCompleted = "completed"
+	DataExportFailed    = "failed"
+)
+
+// ErrDataExportNotFound is returned for data exports that do not exist
+var ErrDataExportNotFound = errors.New("data export not found")
+
+// DataExport is a user's request for a copy of all the data stored about them. The export itself
+// is kept in the document's chunks subcollection, since it can outgrow a single document.
+type DataExport struct {
+	ID          string    `firestore:"id" json:"id"`
+	UserID      string    `firestore:"user_id" json:"-"`
+	Status      string    `firestore:"status" json:"status"`
+	RequestedAt time.Time `firestore:"requested_at" json:"requested_at"`
+	// LeaseUntil stops other replicas building the export while one is
+	LeaseUntil  time.Time `firestore:"lease_until,omitempty" json:"-"`
+	CompletedAt time.Time `firestore:"completed_at,omitempty" json:"completed_at,omitempty"`
+	// ExpiresAt is when a completed export is deleted
+	ExpiresAt time.Time `firestore:"expires_at,omitempty" json:"expires_at,omitempty"`
+	Chunks    int       `firestore:"chunks,omitempty" json:"-"`
+	SizeBytes int       `firestore:"size_bytes,omitempty" json:"size_bytes,omitempty"`
+	Error     string    `firestore:"error,omitempty" json:"error,omitempty"`
+}
+
+// userDataCollections are the collections holding documents about a user, found by their user_id.
+// Each lists the fields left out of exports because they are secrets or hashes of them.
+var userDataCollections = map[string][]string{
+	"api_keys":                {"key_hash", "previous_key_hash"},
+	providerKeysCollection:    {"secret"},
+	"request_logs":            nil,
+	ledgerCollection:          nil,
+	paymentsCollection:        nil,
+	chargesCollection:         nil,
+	usageRollupsCollection:    nil,
+	orgMembersCollection:      nil,
+	sessionsCollection:        nil,
+	sessionMessagesCollection: nil,
+}
+
+// userSecretFields are the user document fields left out of exports
+var userSecretFields = []string{"spend_alerts.webhook_secret", "usage_export.webhook_secret", "usage_export.token"}
+
+// CreateDataExport records a pending data export for a user
+func (s *Service) CreateDataExport(ctx context.Context, userID string) (*DataExport, error) {
+	ref := s.dbClient.Collection(dataExportsCollection).NewDoc()
+	export := &DataExport{
+		ID:          ref.ID,
+		UserID:      userID,
+		Status:      DataExportPending,
+		RequestedAt: time.Now(),
+	}
+	if _, err := ref.Set(ctx, export); err != nil {
+		return nil, fmt.Errorf("failed to create data export: %w", err)
+	}
+	return export, nil
+}
+
+// GetDataExport gets a data export by its ID
+func (s *Service) GetDataExport(ctx context.Context, exportID string) (*DataExport, error) {
+	doc, err := s.dbClient.Collection(dataExportsCollection).Doc(exportID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrDataExportNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get data export: %w", err)
+	}
+
+	var export DataExport
+	if err := doc.DataTo(&export); err != nil {
+		return nil, fmt.Errorf("failed to parse data export: %w", err)
+	}
+	return &export, nil
+}
+
+// ClaimDataExport marks a pending export, or one whose builder's lease has run out, as being built
+// by this replica for lease. It returns nil when the export is done or another replica holds it.
+func (s *Service) ClaimDataExport(ctx context.Context, exportID string, lease time.Duration) (*DataExport, error) {
+	ref := s.dbClient.Collection(dataExportsCollection).Doc(exportID)
+	var claimed *DataExport
+	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		claimed = nil
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var export DataExport
+		if err := doc.DataTo(&export); err != nil {
+			return fmt.Errorf("failed to parse data export: %w", err)
+		}
+
+		now := time.Now()
+		if export.Status != DataExportPending && (export.Status != DataExportRunning || now.Before(export.LeaseUntil)) {
+			return nil
+		}
+		export.Status = DataExportRunning
+		export.LeaseUntil = now.Add(lease)
+		claimed = &export
+		return tx.Update(ref, []firestore.Update{
+			{Path: "status", Value: export.Status},
+			{Path: "lease_until", Value: export.LeaseUntil},
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim data export: %w", err)
+	}
+	return claimed, nil
+}
+
+// ListUnfinishedDataExports lists the exports still pending or being built, for retrying exports
+// whose builder was interrupted
+func (s *Service) ListUnfinishedDataExports(ctx context.Context) ([]*DataExport, error) {
+	return s.listDataExports(ctx, s.dbClient.Collection(dataExportsCollection).
+		Where("status", "in", []string{DataExportPending, DataExportRunning}))
+}
+
+// ListExpiredDataExports lists the exports that expired by now
+func (s *Service) ListExpiredDataExports(ctx context.Context, now time.Time) ([]*DataExport, error) {
+	return s.listDataExports(ctx, s.dbClient.Collection(dataExportsCollection).
+		Where("expires_at", "<=", now))
+}
+
+// listDataExports lists the exports a query matches
+func (s *Service) listDataExports(ctx context.Context, query firestore.Query) ([]*DataExport, error) {
+	iter := query.Limit(privacyBatchSize).Documents(ctx)
+	defer iter.Stop()
+
+	var exports []*DataExport
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list data exports: %w", err)
+		}
+
+		var export DataExport
+		if err := doc.DataTo(&export); err != nil {
+			continue // Skip malformed exports
+		}
+		exports = append(exports, &export)
+	}
+	return exports, nil
+}
+
+// CompleteDataExport stores a built export in chunks and marks it completed until expiresAt
+func (s *Service) CompleteDataExport(ctx context.Context, exportID string, content []byte, expiresAt time.Time) error {
+	ref := s.dbClient.Collection(dataExportsCollection).Doc(exportID)
+	chunks := 0
+	for offset := 0; offset < len(content); offset += dataExportChunkSize {
+		end := min(offset+dataExportChunkSize, len(content))
+		chunk := map[string]interface{}{"index": chunks, "data": content[offset:end]}
+		if _, err := ref.Collection(dataExportChunksCollection).Doc(fmt.Sprintf("%06d", chunks)).Set(ctx, chunk); err != nil {
+			return fmt.Errorf("failed to store data export: %w", err)
+		}
+		chunks++
+	}
+
+	_, err := ref.Update(ctx, []firestore.Update{
+		{Path: "status", Value: DataExportCompleted},
+		{Path: "completed_at", Value: time.Now()},
+		{Path: "expires_at", Value: expiresAt},
+		{Path: "chunks", Value: chunks},
+		{Path: "size_bytes", Value: len(content)},
+		{Path: "lease_until", Value: firestore.Delete},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete data export: %w", err)
+	}
+	return nil
+}
+
+// FailDataExport marks an export as failed with the reason
+func (s *Service) FailDataExport(ctx context.Context, exportID, reason string) error {
+	_, err := s.dbClient.Collection(dataExportsCollection).Doc(exportID).Update(ctx, []firestore.Update{
+		{Path: "status", Value: DataExportFailed},
+		{Path: "error", Value: reason},
+		{Path: "lease_until", Value: firestore.Delete},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mark data export failed: %w", err)
+	}
+	return nil
+}
+
+// ReadDataExport reads a completed export's content back from its chunks
+func (s *Service) ReadDataExport(ctx context.Context, export *DataExport) ([]byte, error) {
+	iter := s.dbClient.Collection(dataExportsCollection).Doc(export.ID).Collection(dataExportChunksCollection).
+		OrderBy("index", firestore.Asc).Documents(ctx)
+	defer iter.Stop()
+
+	var content bytes.Buffer
+	content.Grow(export.SizeBytes)
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read data export: %w", err)
+		}
+		chunk, _ := doc.Data()["data"].([]byte)
+		content.Write(chunk)
+	}
+	if content.Len() != export.SizeBytes {
+		return nil, fmt.Errorf("data export is incomplete: read %d of %d bytes", content.Len(), export.SizeBytes)
+	}
+	return content.Bytes(), nil
+}
+
+// DeleteDataExport deletes an export and its content
+func (s *Service) DeleteDataExport(ctx context.Context, exportID string) error {
+	ref := s.dbClient.Collection(dataExportsCollection).Doc(exportID)
+	if err := s.deleteQuery(ctx, ref.Collection(dataExportChunksCollection).Query); err != nil {
+		return fmt.Errorf("failed to delete data export: %w", err)
+	}
+	if _, err := ref.Delete(ctx); err != nil {
+		return fmt.Errorf("failed to delete data export: %w", err)
+	}
+	return nil
+}
+
+// ExportUserData returns every document stored about a user, as stored, by collection: the user
+// document under "users" and the documents of each user data collection. Secrets and their hashes
+// are left out.
+func (s *Service) ExportUserData(ctx context.Context, userID string) (map[string][]map[string]interface{}, error) {
+	doc, err := s.dbClient.Collection("users").Doc(userID).Get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("user not found: %w", err)
+	}
+	userData := doc.Data()
+	for _, path := range userSecretFields {
+		omitField(userData, path)
+	}
+	exported := map[string][]map[string]interface{}{"users": {userData}}
+
+	for collection, secrets := range userDataCollections {
+		documents := []map[string]interface{}{}
+		query := s.dbClient.Collection(collection).Where("user_id", "==", userID).OrderBy(firestore.DocumentID, firestore.Asc)
+		var last *firestore.DocumentSnapshot
+		for {
+			page := query.Limit(privacyBatchSize)
+			if last != nil {
+				page = page.StartAfter(last)
+			}
+			docs, err := page.Documents(ctx).GetAll()
+			if err != nil {
+				return nil, fmt.Errorf("failed to export %s: %w", collection, err)
+			}
+			for _, doc := range docs {
+				fields := doc.Data()
+				for _, path := range secrets {
+					omitField(fields, path)
+				}
+				documents = append(documents, fields)
+			}
+			if len(docs) < privacyBatchSize {
+				break
+			}
+			last = docs[len(docs)-1]
+		}
+		exported[collection] = documents
+	}
+	return exported, nil
+}
+
+// omitField removes a dotted field path from a document's fields
+func omitField(fields map[string]interface{}, path string) {
+	name, rest, nested := strings.Cut(path, ".")
+	if !nested {
+		delete(fields, name)
+		return
+	}
+	if inner, ok := fields[name].(map[string]interface{}); ok {
+		omitField(inner, rest)
+	}
+}
+
+// MarkUserDeleted deactivates a user who asked for their account to be deleted, and revokes their
+// API keys, leaving their data to be erased by PurgeUser after purgeAfter
+func (s *Service) MarkUserDeleted(ctx context.Context, userID string, purgeAfter time.Time) error {
+	_, err := s.dbClient.Collection("users").Doc(userID).Update(ctx, []firestore.Update{
+		{Path: "is_active", Value: false},
+		{Path: "deleted_at", Value: time.Now()},
+		{Path: "purge_after", Value: purgeAfter},
+		{Path: "updated_at", Value: time.Now()},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mark user deleted: %w", err)
+	}
+
+	keys, err := s.dbClient.Collection("api_keys").Where("user_id", "==", userID).Where("status", "==", "active").Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to list API keys to revoke: %w", err)
+	}
+	for _, doc := range keys {
+		if _, err := doc.Ref.Update(ctx, []firestore.Update{{Path: "status", Value: "revoked"}}); err != nil {
+			return fmt.Errorf("failed to revoke API key: %w", err)
+		}
+	}
+
+	slog.Info("User marked deleted", "user_id", userID, "purge_after", purgeAfter, "revoked_api_keys", len(keys))
+	return nil
+}
+
+// ListUsersDueForPurge lists the deleted users whose retention period ended by now
+func (s *Service) ListUsersDueForPurge(ctx context.Context, now time.Time) ([]*User, error) {
+	docs, err := s.dbClient.Collection("users").Where("purge_after", "<=", now).Limit(privacyBatchSize).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users due for purge: %w", err)
+	}
+
+	users := make([]*User, 0, len(docs))
+	for _, doc := range docs {
+		var user User
+		if err := doc.DataTo(&user); err != nil {
+			continue // Skip malformed users
+		}
+		users = append(users, &user)
+	}
+	return users, nil
+}
+
+// PurgeUser erases a deleted user. Their request logs are kept for billing and aggregate usage but
+// moved to pseudonym with the client details, metadata and payloads removed; their keys, sessions and data
+// exports are deleted; and their profile is stripped of everything but the balance and the deletion dates.
+// Ledger entries, payments and charges are kept as financial records. The Firebase Auth account is
+// deleted too.
+func (s *Service) PurgeUser(ctx context.Context, userID, pseudonym string) error {
+	logs, err := s.updateQuery(ctx, s.dbClient.Collection("request_logs").Where("user_id", "==", userID), anonymizedRequestLog(pseudonym))
+	if err != nil {
+		return fmt.Errorf("failed to anonymize request logs: %w", err)
+	}
+
+	for _, collection := range []string{"api_keys", providerKeysCollection, sessionsCollection, sessionMessagesCollection} {
+		if err := s.deleteQuery(ctx, s.dbClient.Collection(collection).Where("user_id", "==", userID)); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", collection, err)
+		}
+	}
+
+	exports, err := s.dbClient.Collection(dataExportsCollection).Where("user_id", "==", userID).Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to list data exports: %w", err)
+	}
+	for _, doc := range exports {
+		if err := s.DeleteDataExport(ctx, doc.Ref.ID); err != nil {
+			return err
+		}
+	}
+
+	_, err = s.dbClient.Collection("users").Doc(userID).Update(ctx, []firestore.Update{
+		{Path: "email", Value: ""},
+		{Path: "name", Value: firestore.Delete},
+		{Path: "stripe_customer_id", Value: firestore.Delete},
+		{Path: "auto_top_up", Value: firestore.Delete},
+		{Path: "spend_alerts", Value: firestore.Delete},
+		{Path: "usage_export", Value: firestore.Delete},
+		{Path: "referral_code", Value: firestore.Delete},
+		{Path: "referred_by", Value: firestore.Delete},
+		{Path: "purge_after", Value: firestore.Delete},
+		{Path: "purged_at", Value: time.Now()},
+		{Path: "updated_at", Value: time.Now()},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to erase user profile: %w", err)
+	}
+
+	if s.authClient != nil {
+		if err := s.authClient.DeleteUser(ctx, userID); err != nil && !auth.IsUserNotFound(err) {
+			return fmt.Errorf("failed to delete Firebase Auth user: %w", err)
+		}
+	}
+
+	slog.Info("User purged", "user_id", userID, "anonymized_request_logs", logs)
+	return nil
+}
+
+// updateQuery applies updates to every document a query matches, in batches, and returns how many
+// it updated. Updates must move documents out of the query, or it never ends.
+func (s *Service) updateQuery(ctx context.Context, query firestore.Query, updates []firestore.Update) (int, error) {
+	updated := 0
+	for {
+		n, err := s.writeQueryBatch(ctx, query, func(writer *firestore.BulkWriter, ref *firestore.DocumentRef) (*firestore.BulkWriterJob, error) {
+			return writer.Update(ref, updates)
+		})
+		updated += n
+		if err != nil || n == 0 {
+			return updated, err
+		}
+	}
+}
+
+// deleteQuery deletes every document a query matches, in batches
+func (s *Service) deleteQuery(ctx context.Context, query firestore.Query) error {
+	for {
+		n, err := s.writeQueryBatch(ctx, query, func(writer *firestore.BulkWriter, ref *firestore.DocumentRef) (*firestore.BulkWriterJob, error) {
+			return writer.Delete(ref)
+		})
+		if err != nil || n == 0 {
+			return err
+		}
+	}
+}
+
+// writeQueryBatch writes to a batch of the documents a query matches and returns how many it wrote
+func (s *Service) writeQueryBatch(ctx context.Context, query firestore.Query, write func(*firestore.BulkWriter, *firestore.DocumentRef) (*firestore.BulkWriterJob, error)) (int, error) {
+	docs, err := query.Limit(privacyBatchSize).Documents(ctx).GetAll()
+	if err != nil || len(docs) == 0 {
+		return 0, err
+	}
+	return s.writeDocs(ctx, docs, func(writer *firestore.BulkWriter, doc *firestore.DocumentSnapshot) (*firestore.BulkWriterJob, error) {
+		return write(writer, doc.Ref)
+	})
+}
@@ -0,0 +1,145 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// providerKeysCollection holds users' encrypted provider API keys
+const providerKeysCollection = "provider_keys"
+
+// StoredProviderKey is a user's own provider API key, encrypted at rest
+type StoredProviderKey struct {
+	UserID   string       `firestore:"user_id" json:"-"`
+	Provider string       `firestore:"provider" json:"provider"`
+	Secret   SealedSecret `firestore:"secret" json:"-"`
+	// KeyHint is the last four characters of the key, so users can tell keys apart
+	KeyHint   string    `firestore:"key_hint" json:"key_hint"`
+	CreatedAt time.Time `firestore:"created_at" json:"created_at"`
+	UpdatedAt time.Time `firestore:"updated_at" json:"updated_at"`
+}
+
+// providerKeyDocID returns the document ID for a user's key for a provider
+func providerKeyDocID(userID, provider string) string {
+	return userID + "_" + provider
+}
+
+// GetStoredProviderKey gets a user's stored key for a provider, returning nil if none is stored
+func (s *Service) GetStoredProviderKey(ctx context.Context, userID, provider string) (*StoredProviderKey, error) {
+	doc, err := s.dbClient.Collection(providerKeysCollection).Doc(providerKeyDocID(userID, provider)).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get provider key: %w", err)
+	}
+
+	var key StoredProviderKey
+	if err := doc.DataTo(&key); err != nil {
+		return nil, fmt.Errorf("failed to parse provider key: %w", err)
+	}
+
+	return &key, nil
+}
+
+// ListStoredProviderKeys lists the provider keys a user has stored
+func (s *Service) ListStoredProviderKeys(ctx context.Context, userID string) ([]*StoredProviderKey, error) {
+	return s.listStoredProviderKeys(ctx, s.dbClient.Collection(providerKeysCollection).Where("user_id", "==", userID))
+}
+
+// ListAllStoredProviderKeys lists every user's stored provider keys, for rewrapping them after
+// the vault key is rotated
+func (s *Service) ListAllStoredProviderKeys(ctx context.Context) ([]*StoredProviderKey, error) {
+	return s.listStoredProviderKeys(ctx, s.dbClient.Collection(providerKeysCollection).Query)
+}
+
+// listStoredProviderKeys lists the provider keys query matches
+func (s *Service) listStoredProviderKeys(ctx context.Context, query firestore.Query) ([]*StoredProviderKey, error) {
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+
+	var keys []*StoredProviderKey
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list provider keys: %w", err)
+		}
+
+		var key StoredProviderKey
+		if err := doc.DataTo(&key); err != nil {
+			slog.Warn("Failed to parse provider key", "doc_id", doc.Ref.ID, "error", err)
+			continue
+		}
+
+		keys = append(keys, &key)
+	}
+
+	return keys, nil
+}
+
+// SetStoredProviderKey creates or replaces a user's key for a provider
+func (s *Service) SetStoredProviderKey(ctx context.Context, key *StoredProviderKey) error {
+	now := time.Now()
+	if key.CreatedAt.IsZero() {
+		key.CreatedAt = now
+	}
+	key.UpdatedAt = now
+
+	if _, err := s.dbClient.Collection(providerKeysCollection).Doc(providerKeyDocID(key.UserID, key.Provider)).Set(ctx, key); err != nil {
+		return fmt.Errorf("failed to set provider key: %w", err)
+	}
+
+	slog.Info("Provider key stored", "user_id", key.UserID, "provider", key.Provider, "key_id", key.Secret.KeyID)
+	return nil
+}
+
+// RewrapStoredProviderKey replaces a stored key's secret with what rewrap returns for it, in a
+// transaction so a key the user replaces meanwhile is not overwritten. A nil result or a key that
+// no longer exists leaves nothing to do.
+func (s *Service) RewrapStoredProviderKey(ctx context.Context, userID, provider string, rewrap func(secret *SealedSecret) (*SealedSecret, error)) error {
+	ref := s.dbClient.Collection(providerKeysCollection).Doc(providerKeyDocID(userID, provider))
+
+	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var key StoredProviderKey
+		if err := doc.DataTo(&key); err != nil {
+			return fmt.Errorf("failed to parse provider key: %w", err)
+		}
+		secret, err := rewrap(&key.Secret)
+		if err != nil || secret == nil {
+			return err
+		}
+		return tx.Update(ref, []firestore.Update{{Path: "secret", Value: secret}})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to rewrap provider key: %w", err)
+	}
+	return nil
+}
+
+// DeleteStoredProviderKey removes a user's key for a provider
+func (s *Service) DeleteStoredProviderKey(ctx context.Context, userID, provider string) error {
+	if _, err := s.dbClient.Collection(providerKeysCollection).Doc(providerKeyDocID(userID, provider)).Delete(ctx); err != nil {
+		return fmt.Errorf("failed to delete provider key: %w", err)
+	}
+
+	slog.Info("Provider key deleted", "user_id", userID, "provider", provider)
+	return nil
+}
@@ -0,0 +1,127 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// qualityEvaluationsCollection holds the quality scores of sampled optimized requests
+const qualityEvaluationsCollection = "quality_evaluations"
+
+// QualityEvaluation scores how closely an optimized request's response matched the response to
+// the original, unoptimized prompt. Score is between 0 and 1, where 1 is the same response.
+type QualityEvaluation struct {
+	ID               string    `firestore:"id" json:"id"`
+	RequestID        string    `firestore:"request_id" json:"request_id"`
+	UserID           string    `firestore:"user_id" json:"user_id"`
+	ModelID          string    `firestore:"model_id" json:"model_id"`
+	OptimizationType string    `firestore:"optimization_type" json:"optimization_type"`
+	Scorer           string    `firestore:"scorer" json:"scorer"`
+	Score            float64   `firestore:"score" json:"score"`
+	CreatedAt        time.Time `firestore:"created_at" json:"created_at"`
+	// TokensSaved is the prompt tokens the optimization claimed to save
+	TokensSaved           int `firestore:"tokens_saved" json:"tokens_saved"`
+	OriginalInputTokens   int `firestore:"original_input_tokens" json:"original_input_tokens"`
+	OriginalOutputTokens  int `firestore:"original_output_tokens" json:"original_output_tokens"`
+	OptimizedInputTokens  int `firestore:"optimized_input_tokens" json:"optimized_input_tokens"`
+	OptimizedOutputTokens int `firestore:"optimized_output_tokens" json:"optimized_output_tokens"`
+	// Cost is the provider cost of the evaluation: the original prompt's generation and any judge call
+	Cost MicroUSD `firestore:"cost_micros" json:"cost"`
+	// Error is set when the evaluation failed; such evaluations have no score
+	Error string `firestore:"error,omitempty" json:"error,omitempty"`
+}
+
+// QualitySummary aggregates quality evaluations
+type QualitySummary struct {
+	Evaluations int `json:"evaluations"`
+	Errors      int `json:"errors"`
+	// AvgScore and MinScore cover the evaluations that succeeded
+	AvgScore float64 `json:"avg_score"`
+	MinScore float64 `json:"min_score"`
+	// TokensSaved is the prompt tokens the evaluated optimizations claimed to save, and
+	// OutputTokensDelta how many more output tokens the optimized prompts produced
+	TokensSaved       int      `json:"tokens_saved"`
+	OutputTokensDelta int      `json:"output_tokens_delta"`
+	Cost              MicroUSD `json:"cost"`
+}
+
+// CreateQualityEvaluation stores a quality evaluation
+func (s *Service) CreateQualityEvaluation(ctx context.Context, evaluation *QualityEvaluation) error {
+	ref := s.dbClient.Collection(qualityEvaluationsCollection).NewDoc()
+	evaluation.ID = ref.ID
+	if evaluation.CreatedAt.IsZero() {
+		evaluation.CreatedAt = time.Now()
+	}
+
+	if _, err := ref.Create(ctx, evaluation); err != nil {
+		return fmt.Errorf("failed to create quality evaluation: %w", err)
+	}
+	return nil
+}
+
+// ListQualityEvaluations lists up to limit quality evaluations in a date range, newest first,
+// optionally only those of one model
+func (s *Service) ListQualityEvaluations(ctx context.Context, modelID string, startDate, endDate time.Time, limit int) ([]*QualityEvaluation, error) {
+	query := s.dbClient.Collection(qualityEvaluationsCollection).Query
+	if modelID != "" {
+		query = query.Where("model_id", "==", modelID)
+	}
+	query = query.
+		Where("created_at", ">=", startDate).
+		Where("created_at", "<=", endDate).
+		OrderBy("created_at", firestore.Desc)
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+
+	var evaluations []*QualityEvaluation
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list quality evaluations: %w", err)
+		}
+
+		var evaluation QualityEvaluation
+		if err := doc.DataTo(&evaluation); err != nil {
+			continue // Skip malformed evaluations
+		}
+		evaluations = append(evaluations, &evaluation)
+	}
+
+	return evaluations, nil
+}
+
+// SummarizeQualityEvaluations aggregates quality evaluations
+func SummarizeQualityEvaluations(evaluations []*QualityEvaluation) QualitySummary {
+	var summary QualitySummary
+	var total float64
+	for _, evaluation := range evaluations {
+		summary.Evaluations++
+		summary.Cost += evaluation.Cost
+		if evaluation.Error != "" {
+			summary.Errors++
+			continue
+		}
+		if scored := summary.Evaluations - summary.Errors; scored == 1 || evaluation.Score < summary.MinScore {
+			summary.MinScore = evaluation.Score
+		}
+		total += evaluation.Score
+		summary.TokensSaved += evaluation.TokensSaved
+		summary.OutputTokensDelta += evaluation.OptimizedOutputTokens - evaluation.OriginalOutputTokens
+	}
+
+	if scored := summary.Evaluations - summary.Errors; scored > 0 {
+		summary.AvgScore = total / float64(scored)
+	}
+	return summary
+}
@@ -0,0 +1,221 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+const (
+	// providerCostsCollection holds the base cost of platform-paid requests per provider, model and
+	// day, maintained as requests are logged
+	providerCostsCollection = "provider_cost_rollups"
+	// providerBillingCollection holds what providers billed per model and day, from their exports
+	providerBillingCollection = "provider_billing_records"
+	// costReconciliationsCollection holds the latest comparison of the two per provider, model and day
+	costReconciliationsCollection = "cost_reconciliations"
+)
+
+// Where a provider billing record came from
+const (
+	BillingSourceCSV = "csv"
+	BillingSourceAPI = "api"
+)
+
+// ProviderCost totals the base cost AptRouter recorded for one provider's model over a UTC day.
+// Only requests paid on the platform's provider keys are counted: BYOK and test mode requests are not.
+type ProviderCost struct {
+	Provider     string    `firestore:"provider" json:"provider"`
+	ModelID      string    `firestore:"model_id" json:"model_id"`
+	Day          time.Time `firestore:"day" json:"day"`
+	Requests     int       `firestore:"requests" json:"requests"`
+	InputTokens  int       `firestore:"input_tokens" json:"input_tokens"`
+	OutputTokens int       `firestore:"output_tokens" json:"output_tokens"`
+	BaseCost     MicroUSD  `firestore:"base_cost_micros" json:"base_cost"`
+}
+
+// add folds a request log into the day's cost
+func (p *ProviderCost) add(log *RequestLog) {
+	p.Requests++
+	p.InputTokens += log.InputTokens
+	p.OutputTokens += log.OutputTokens
+	p.BaseCost += log.BaseCost
+}
+
+// ProviderBillingRecord is what a provider billed for one model over a UTC day
+type ProviderBillingRecord struct {
+	Provider string    `firestore:"provider" json:"provider"`
+	ModelID  string    `firestore:"model_id" json:"model_id"`
+	Day      time.Time `firestore:"day" json:"day"`
+	Cost     MicroUSD  `firestore:"cost_micros" json:"cost"`
+	// InputTokens and OutputTokens are reported by exports that include usage
+	InputTokens  int       `firestore:"input_tokens,omitempty" json:"input_tokens,omitempty"`
+	OutputTokens int       `firestore:"output_tokens,omitempty" json:"output_tokens,omitempty"`
+	Source       string    `firestore:"source" json:"source"`
+	ImportedAt   time.Time `firestore:"imported_at" json:"imported_at"`
+}
+
+// CostReconciliation compares the base cost recorded for a provider's model over a UTC day with
+// what the provider billed for it. Difference is billed less recorded.
+type CostReconciliation struct {
+	Provider          string    `firestore:"provider" json:"provider"`
+	ModelID           string    `firestore:"model_id" json:"model_id"`
+	Day               time.Time `firestore:"day" json:"day"`
+	RecordedCost      MicroUSD  `firestore:"recorded_cost_micros" json:"recorded_cost"`
+	BilledCost        MicroUSD  `firestore:"billed_cost_micros" json:"billed_cost"`
+	Difference        MicroUSD  `firestore:"difference_micros" json:"difference"`
+	DifferencePercent float64   `firestore:"difference_percent" json:"difference_percent"`
+	Requests          int       `firestore:"requests" json:"requests"`
+	// Billed is false when the provider billed nothing for a model and day that costs were
+	// recorded for, and Recorded false for the reverse
+	Billed    bool      `firestore:"billed" json:"billed"`
+	Recorded  bool      `firestore:"recorded" json:"recorded"`
+	Flagged   bool      `firestore:"flagged" json:"flagged"`
+	CheckedAt time.Time `firestore:"checked_at" json:"checked_at"`
+}
+
+// costDocID returns the document ID of a provider's model's record for a day. Model IDs may contain
+// slashes, which are not allowed in document IDs.
+func costDocID(provider, modelID string, day time.Time) string {
+	return fmt.Sprintf("%s_%s_%s", provider, day.Format("20060102"), strings.ReplaceAll(modelID, "/", "_"))
+}
+
+// incrementProviderCost adds a logged request's base cost to its provider's daily cost, unless the
+// platform did not pay for it
+func (s *Service) incrementProviderCost(ctx context.Context, log *RequestLog) error {
+	if log.BYOK || log.TestMode || log.Provider == "" {
+		return nil
+	}
+	day := RollupBucket(RollupDaily, log.RequestTimestamp)
+	_, err := s.dbClient.Collection(providerCostsCollection).Doc(costDocID(log.Provider, log.ModelID, day)).Set(ctx, map[string]interface{}{
+		"provider":         log.Provider,
+		"model_id":         log.ModelID,
+		"day":              day,
+		"requests":         firestore.Increment(1),
+		"input_tokens":     firestore.Increment(log.InputTokens),
+		"output_tokens":    firestore.Increment(log.OutputTokens),
+		"base_cost_micros": firestore.Increment(int64(log.BaseCost)),
+	}, firestore.MergeAll)
+	if err != nil {
+		return fmt.Errorf("failed to increment provider cost: %w", err)
+	}
+	return nil
+}
+
+// ListProviderCosts lists the daily provider costs recorded for the days from start through end
+func (s *Service) ListProviderCosts(ctx context.Context, start, end time.Time) ([]*ProviderCost, error) {
+	docs, err := s.dbClient.Collection(providerCostsCollection).
+		Where("day", ">=", RollupBucket(RollupDaily, start)).
+		Where("day", "<=", end).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list provider costs: %w", err)
+	}
+
+	costs := make([]*ProviderCost, 0, len(docs))
+	for _, doc := range docs {
+		var cost ProviderCost
+		if err := doc.DataTo(&cost); err != nil {
+			slog.Warn("Failed to parse provider cost", "doc_id", doc.Ref.ID, "error", err)
+			continue
+		}
+		costs = append(costs, &cost)
+	}
+	return costs, nil
+}
+
+// SetProviderBillingRecords stores what providers billed, replacing any record already held for the
+// same provider, model and day
+func (s *Service) SetProviderBillingRecords(ctx context.Context, records []*ProviderBillingRecord) error {
+	writer := s.dbClient.BulkWriter(ctx)
+	defer writer.End()
+
+	jobs := make([]*firestore.BulkWriterJob, 0, len(records))
+	for _, record := range records {
+		job, err := writer.Set(s.dbClient.Collection(providerBillingCollection).Doc(costDocID(record.Provider, record.ModelID, record.Day)), record)
+		if err != nil {
+			return fmt.Errorf("failed to write provider billing record: %w", err)
+		}
+		jobs = append(jobs, job)
+	}
+	writer.Flush()
+
+	for _, job := range jobs {
+		if _, err := job.Results(); err != nil {
+			return fmt.Errorf("failed to write provider billing record: %w", err)
+		}
+	}
+	return nil
+}
+
+// ListProviderBillingRecords lists what providers billed for the days from start through end
+func (s *Service) ListProviderBillingRecords(ctx context.Context, start, end time.Time) ([]*ProviderBillingRecord, error) {
+	docs, err := s.dbClient.Collection(providerBillingCollection).
+		Where("day", ">=", RollupBucket(RollupDaily, start)).
+		Where("day", "<=", end).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list provider billing records: %w", err)
+	}
+
+	records := make([]*ProviderBillingRecord, 0, len(docs))
+	for _, doc := range docs {
+		var record ProviderBillingRecord
+		if err := doc.DataTo(&record); err != nil {
+			slog.Warn("Failed to parse provider billing record", "doc_id", doc.Ref.ID, "error", err)
+			continue
+		}
+		records = append(records, &record)
+	}
+	return records, nil
+}
+
+// SetCostReconciliations stores reconciliations, replacing earlier ones for the same provider,
+// model and day
+func (s *Service) SetCostReconciliations(ctx context.Context, reconciliations []*CostReconciliation) error {
+	writer := s.dbClient.BulkWriter(ctx)
+	defer writer.End()
+
+	jobs := make([]*firestore.BulkWriterJob, 0, len(reconciliations))
+	for _, reconciliation := range reconciliations {
+		job, err := writer.Set(s.dbClient.Collection(costReconciliationsCollection).Doc(costDocID(reconciliation.Provider, reconciliation.ModelID, reconciliation.Day)), reconciliation)
+		if err != nil {
+			return fmt.Errorf("failed to write cost reconciliation: %w", err)
+		}
+		jobs = append(jobs, job)
+	}
+	writer.Flush()
+
+	for _, job := range jobs {
+		if _, err := job.Results(); err != nil {
+			return fmt.Errorf("failed to write cost reconciliation: %w", err)
+		}
+	}
+	return nil
+}
+
+// ListCostReconciliations lists the reconciliations of the days from start through end
+func (s *Service) ListCostReconciliations(ctx context.Context, start, end time.Time) ([]*CostReconciliation, error) {
+	docs, err := s.dbClient.Collection(costReconciliationsCollection).
+		Where("day", ">=", RollupBucket(RollupDaily, start)).
+		Where("day", "<=", end).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cost reconciliations: %w", err)
+	}
+
+	reconciliations := make([]*CostReconciliation, 0, len(docs))
+	for _, doc := range docs {
+		var reconciliation CostReconciliation
+		if err := doc.DataTo(&reconciliation); err != nil {
+			slog.Warn("Failed to parse cost reconciliation", "doc_id", doc.Ref.ID, "error", err)
+			continue
+		}
+		reconciliations = append(reconciliations, &reconciliation)
+	}
+	return reconciliations, nil
+}
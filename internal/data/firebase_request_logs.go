@@ -0,0 +1,42 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrRequestLogNotFound is returned when a request log does not exist
+var ErrRequestLogNotFound = errors.New("request log not found")
+
+// RequestPayload is what a request log stores of a request's content when payload logging is enabled
+type RequestPayload struct {
+	// Request is the generation request as the caller sent it, before aliases, templates and the
+	// optimizer rewrote it, with any provider keys removed
+	Request map[string]interface{} `firestore:"request"`
+	// Completion is the completion returned to the caller
+	Completion string `firestore:"completion"`
+}
+
+// GetRequestLog gets a request log by its request ID
+func (s *Service) GetRequestLog(ctx context.Context, requestID string) (*RequestLog, error) {
+	ctx, span := startSpan(ctx, "GetRequestLog", "request_logs")
+	defer span.End()
+
+	doc, err := s.dbClient.Collection("request_logs").Doc(requestID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrRequestLogNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get request log: %w", err)
+	}
+
+	var log RequestLog
+	if err := doc.DataTo(&log); err != nil {
+		return nil, fmt.Errorf("failed to parse request log: %w", err)
+	}
+	return &log, nil
+}
@@ -0,0 +1,165 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// retentionCursorsCollection holds how far each tier's request logs have been purged
+const retentionCursorsCollection = "retention_cursors"
+
+// AnonymizedUserIDPrefix starts the pseudonyms anonymized request logs are kept under
+const AnonymizedUserIDPrefix = "deleted-"
+
+// RetentionCursor is how far a tier's request logs have been purged. The purger resumes after it,
+// so logs it anonymized or stripped of payloads are not visited again.
+type RetentionCursor struct {
+	TierID string `firestore:"tier_id"`
+	// LogsThrough is the request timestamp through which logs were deleted or anonymized
+	LogsThrough time.Time `firestore:"logs_through,omitempty"`
+	// PayloadsThrough is the request timestamp through which stored payloads were removed
+	PayloadsThrough time.Time `firestore:"payloads_through,omitempty"`
+	UpdatedAt       time.Time `firestore:"updated_at"`
+}
+
+// GetRetentionCursor gets a tier's retention cursor, which is empty before the first purge
+func (s *Service) GetRetentionCursor(ctx context.Context, tierID string) (*RetentionCursor, error) {
+	doc, err := s.dbClient.Collection(retentionCursorsCollection).Doc(tierID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return &RetentionCursor{TierID: tierID}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get retention cursor: %w", err)
+	}
+
+	var cursor RetentionCursor
+	if err := doc.DataTo(&cursor); err != nil {
+		return nil, fmt.Errorf("failed to parse retention cursor: %w", err)
+	}
+	return &cursor, nil
+}
+
+// SetRetentionCursor stores a tier's retention cursor
+func (s *Service) SetRetentionCursor(ctx context.Context, cursor *RetentionCursor) error {
+	cursor.UpdatedAt = time.Now()
+	if _, err := s.dbClient.Collection(retentionCursorsCollection).Doc(cursor.TierID).Set(ctx, cursor); err != nil {
+		return fmt.Errorf("failed to set retention cursor: %w", err)
+	}
+	return nil
+}
+
+// anonymizedRequestLog are the updates that anonymize a request log under pseudonym: the user is
+// replaced and the client details, metadata and payload removed, leaving the usage and cost
+func anonymizedRequestLog(pseudonym string) []firestore.Update {
+	return []firestore.Update{
+		{Path: "user_id", Value: pseudonym},
+		{Path: "ip_address", Value: ""},
+		{Path: "user_agent", Value: ""},
+		{Path: "metadata", Value: firestore.Delete},
+		{Path: "payload", Value: firestore.Delete},
+	}
+}
+
+// DeleteRequestLogs deletes a tier's request logs made after after and up to cutoff. It returns
+// how many it deleted and the request timestamp it got through, which is after when there were none.
+func (s *Service) DeleteRequestLogs(ctx context.Context, tierID string, after, cutoff time.Time) (int, time.Time, error) {
+	return s.retainRequestLogs(ctx, tierID, after, cutoff, func(writer *firestore.BulkWriter, doc *firestore.DocumentSnapshot) (*firestore.BulkWriterJob, error) {
+		return writer.Delete(doc.Ref)
+	})
+}
+
+// AnonymizeRequestLogs anonymizes a tier's request logs made after after and up to cutoff, each
+// under the pseudonym of its user. Logs already anonymized are left alone. It returns how many it
+// anonymized and the request timestamp it got through.
+func (s *Service) AnonymizeRequestLogs(ctx context.Context, tierID string, after, cutoff time.Time, pseudonym func(userID string) string) (int, time.Time, error) {
+	return s.retainRequestLogs(ctx, tierID, after, cutoff, func(writer *firestore.BulkWriter, doc *firestore.DocumentSnapshot) (*firestore.BulkWriterJob, error) {
+		userID, _ := doc.Data()["user_id"].(string)
+		if strings.HasPrefix(userID, AnonymizedUserIDPrefix) {
+			return nil, nil
+		}
+		return writer.Update(doc.Ref, anonymizedRequestLog(pseudonym(userID)))
+	})
+}
+
+// RemoveRequestPayloads removes the stored payloads of a tier's request logs made after after and
+// up to cutoff, keeping the logs. It returns how many payloads it removed and the request timestamp
+// it got through.
+func (s *Service) RemoveRequestPayloads(ctx context.Context, tierID string, after, cutoff time.Time) (int, time.Time, error) {
+	return s.retainRequestLogs(ctx, tierID, after, cutoff, func(writer *firestore.BulkWriter, doc *firestore.DocumentSnapshot) (*firestore.BulkWriterJob, error) {
+		if doc.Data()["payload"] == nil {
+			return nil, nil
+		}
+		return writer.Update(doc.Ref, []firestore.Update{{Path: "payload", Value: firestore.Delete}})
+	})
+}
+
+// retainRequestLogs writes to a tier's request logs made after after and up to cutoff, oldest first
+// and in batches, through the tier_id + request_timestamp index. write may skip a log by returning
+// no job. It returns how many logs were written and the request timestamp it got through; on error
+// that is the end of the last batch written in full.
+func (s *Service) retainRequestLogs(ctx context.Context, tierID string, after, cutoff time.Time, write func(*firestore.BulkWriter, *firestore.DocumentSnapshot) (*firestore.BulkWriterJob, error)) (int, time.Time, error) {
+	query := s.dbClient.Collection("request_logs").
+		Where("tier_id", "==", tierID).
+		Where("request_timestamp", ">", after).
+		Where("request_timestamp", "<=", cutoff).
+		OrderBy("request_timestamp", firestore.Asc).
+		Limit(privacyBatchSize)
+
+	written := 0
+	through := after
+	var last *firestore.DocumentSnapshot
+	for {
+		page := query
+		if last != nil {
+			page = page.StartAfter(last)
+		}
+		docs, err := page.Documents(ctx).GetAll()
+		if err != nil {
+			return written, through, fmt.Errorf("failed to list request logs: %w", err)
+		}
+		if len(docs) == 0 {
+			return written, through, nil
+		}
+
+		n, err := s.writeDocs(ctx, docs, write)
+		if err != nil {
+			return written, through, fmt.Errorf("failed to purge request logs: %w", err)
+		}
+		written += n
+		last = docs[len(docs)-1]
+		if timestamp, ok := last.Data()["request_timestamp"].(time.Time); ok {
+			through = timestamp
+		}
+	}
+}
+
+// writeDocs writes to documents in one bulk write and returns how many were written
+func (s *Service) writeDocs(ctx context.Context, docs []*firestore.DocumentSnapshot, write func(*firestore.BulkWriter, *firestore.DocumentSnapshot) (*firestore.BulkWriterJob, error)) (int, error) {
+	writer := s.dbClient.BulkWriter(ctx)
+	defer writer.End()
+
+	jobs := make([]*firestore.BulkWriterJob, 0, len(docs))
+	for _, doc := range docs {
+		job, err := write(writer, doc)
+		if err != nil {
+			return 0, err
+		}
+		if job != nil {
+			jobs = append(jobs, job)
+		}
+	}
+	writer.Flush()
+
+	for _, job := range jobs {
+		if _, err := job.Results(); err != nil {
+			return 0, err
+		}
+	}
+	return len(jobs), nil
+}
@@ -0,0 +1,163 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// routingRulesCollection holds the rules that route requests to models by their size, tier and time
+const routingRulesCollection = "routing_rules"
+
+// RoutingRule routes requests matching all of its conditions to TargetModel. Enabled rules are
+// evaluated in Order, lowest first, and the first matching rule applies.
+type RoutingRule struct {
+	ID          string `firestore:"id" json:"id"`
+	Name        string `firestore:"name" json:"name"`
+	Description string `firestore:"description,omitempty" json:"description,omitempty"`
+	Order       int    `firestore:"order" json:"order"`
+	Enabled     bool   `firestore:"enabled" json:"enabled"`
+	// Conditions a request must meet for the rule to apply; empty conditions match every request
+	Conditions  RoutingConditions `firestore:"conditions" json:"conditions"`
+	TargetModel string            `firestore:"target_model" json:"target_model"`
+	CreatedAt   time.Time         `firestore:"created_at" json:"created_at"`
+	UpdatedAt   time.Time         `firestore:"updated_at" json:"updated_at"`
+}
+
+// RoutingConditions are what a request must meet for a routing rule to apply; unset conditions
+// match every request
+type RoutingConditions struct {
+	// MinPromptTokens and MaxPromptTokens bound the estimated tokens of the prompt and system
+	// instructions; 0 leaves a bound open
+	MinPromptTokens int `firestore:"min_prompt_tokens,omitempty" json:"min_prompt_tokens,omitempty"`
+	MaxPromptTokens int `firestore:"max_prompt_tokens,omitempty" json:"max_prompt_tokens,omitempty"`
+	// TierIDs limits the rule to requests on those pricing tiers
+	TierIDs []string `firestore:"tier_ids,omitempty" json:"tier_ids,omitempty"`
+	// Models matches the requested model against patterns such as "gpt-4o*", so one rule can cover
+	// a model family, and Providers matches its provider
+	Models    []string `firestore:"models,omitempty" json:"models,omitempty"`
+	Providers []string `firestore:"providers,omitempty" json:"providers,omitempty"`
+	// StartTime and EndTime ("15:04") limit the rule to a daily window in Timezone, UTC by default.
+	// A window whose end is before its start wraps past midnight.
+	StartTime string `firestore:"start_time,omitempty" json:"start_time,omitempty"`
+	EndTime   string `firestore:"end_time,omitempty" json:"end_time,omitempty"`
+	Timezone  string `firestore:"timezone,omitempty" json:"timezone,omitempty"`
+}
+
+// RoutingDecision records how the routing rules treated a request: every rule evaluated, in order,
+// and the rule that routed it, if any
+type RoutingDecision struct {
+	RuleID      string              `firestore:"rule_id,omitempty" json:"rule_id,omitempty"`
+	FromModel   string              `firestore:"from_model" json:"from_model"`
+	ToModel     string              `firestore:"to_model,omitempty" json:"to_model,omitempty"`
+	Evaluations []RoutingEvaluation `firestore:"evaluations" json:"evaluations"`
+}
+
+// RoutingEvaluation is one rule's outcome for a request. Reason explains a rule that did not
+// apply: the first condition it failed, or why its target could not be used.
+type RoutingEvaluation struct {
+	RuleID  string `firestore:"rule_id" json:"rule_id"`
+	Matched bool   `firestore:"matched" json:"matched"`
+	Reason  string `firestore:"reason,omitempty" json:"reason,omitempty"`
+}
+
+// CreateRoutingRule stores a new routing rule
+func (s *Service) CreateRoutingRule(ctx context.Context, rule *RoutingRule) error {
+	ref := s.dbClient.Collection(routingRulesCollection).NewDoc()
+	now := time.Now()
+	rule.ID = ref.ID
+	rule.CreatedAt = now
+	rule.UpdatedAt = now
+
+	if _, err := ref.Create(ctx, rule); err != nil {
+		return fmt.Errorf("failed to create routing rule: %w", err)
+	}
+
+	slog.Info("Routing rule created", "rule_id", rule.ID, "name", rule.Name)
+	return nil
+}
+
+// GetRoutingRule gets a routing rule, returning nil if it does not exist
+func (s *Service) GetRoutingRule(ctx context.Context, ruleID string) (*RoutingRule, error) {
+	doc, err := s.dbClient.Collection(routingRulesCollection).Doc(ruleID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get routing rule: %w", err)
+	}
+
+	var rule RoutingRule
+	if err := doc.DataTo(&rule); err != nil {
+		return nil, fmt.Errorf("failed to parse routing rule: %w", err)
+	}
+
+	return &rule, nil
+}
+
+// UpdateRoutingRule replaces a routing rule
+func (s *Service) UpdateRoutingRule(ctx context.Context, rule *RoutingRule) error {
+	rule.UpdatedAt = time.Now()
+
+	if _, err := s.dbClient.Collection(routingRulesCollection).Doc(rule.ID).Set(ctx, rule); err != nil {
+		return fmt.Errorf("failed to update routing rule: %w", err)
+	}
+
+	slog.Info("Routing rule updated", "rule_id", rule.ID, "enabled", rule.Enabled)
+	return nil
+}
+
+// DeleteRoutingRule deletes a routing rule
+func (s *Service) DeleteRoutingRule(ctx context.Context, ruleID string) error {
+	if _, err := s.dbClient.Collection(routingRulesCollection).Doc(ruleID).Delete(ctx); err != nil {
+		return fmt.Errorf("failed to delete routing rule: %w", err)
+	}
+
+	slog.Info("Routing rule deleted", "rule_id", ruleID)
+	return nil
+}
+
+// ListRoutingRules lists routing rules in evaluation order, optionally only the enabled ones
+func (s *Service) ListRoutingRules(ctx context.Context, enabledOnly bool) ([]*RoutingRule, error) {
+	query := s.dbClient.Collection(routingRulesCollection).Query
+	if enabledOnly {
+		query = query.Where("enabled", "==", true)
+	}
+
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+
+	var rules []*RoutingRule
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list routing rules: %w", err)
+		}
+
+		var rule RoutingRule
+		if err := doc.DataTo(&rule); err != nil {
+			slog.Warn("Failed to parse routing rule", "doc_id", doc.Ref.ID, "error", err)
+			continue
+		}
+
+		rules = append(rules, &rule)
+	}
+
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Order != rules[j].Order {
+			return rules[i].Order < rules[j].Order
+		}
+		return rules[i].CreatedAt.Before(rules[j].CreatedAt)
+	})
+
+	return rules, nil
+}
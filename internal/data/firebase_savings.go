@@ -0,0 +1,92 @@
+package data
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// SavingsStats totals what prompt optimization saved a user, for one model or bucket or overall
+type SavingsStats struct {
+	ModelID           string    `json:"model_id,omitempty"`
+	BucketStart       time.Time `json:"bucket_start,omitzero"`
+	Requests          int       `json:"requests"`
+	OptimizedRequests int       `json:"optimized_requests"`
+	InputTokens       int       `json:"input_tokens"`
+	TokensSaved       int       `json:"tokens_saved"`
+	// SavingsPercent is the share of the prompt tokens, before optimization, that were saved
+	SavingsPercent float64 `json:"savings_percent"`
+	// GrossSavings is the price of the tokens saved and NetSavings what is left of it once the
+	// optimizer and summarization calls are paid for; it may be negative
+	GrossSavings  MicroUSD `json:"gross_savings"`
+	OptimizerCost MicroUSD `json:"optimizer_cost"`
+	NetSavings    MicroUSD `json:"net_savings"`
+}
+
+// add folds a usage rollup into the stats
+func (s *SavingsStats) add(rollup *UsageRollup) {
+	s.Requests += rollup.Requests
+	s.OptimizedRequests += rollup.OptimizedRequests
+	s.InputTokens += rollup.InputTokens
+	s.TokensSaved += rollup.TokensSaved
+	s.GrossSavings += rollup.GrossSavings
+	s.OptimizerCost += rollup.OptimizerCost
+	s.NetSavings = s.GrossSavings - s.OptimizerCost
+	if prompt := s.InputTokens + s.TokensSaved; prompt > 0 {
+		s.SavingsPercent = float64(s.TokensSaved) / float64(prompt) * 100
+	}
+}
+
+// SavingsSummary is what prompt optimization saved a user over a date range, in total, per model
+// and per bucket
+type SavingsSummary struct {
+	SavingsStats
+	StartDate   time.Time       `json:"start_date"`
+	EndDate     time.Time       `json:"end_date"`
+	Granularity string          `json:"granularity"`
+	ByModel     []*SavingsStats `json:"by_model"`
+	Trend       []*SavingsStats `json:"trend"`
+}
+
+// GetUserSavings gets what prompt optimization saved a user from their rollups. Like GetUserUsage,
+// the range is widened to the buckets it touches.
+func (s *Service) GetUserSavings(ctx context.Context, userID, granularity string, startDate, endDate time.Time) (*SavingsSummary, error) {
+	rollups, err := s.ListUsageRollups(ctx, userID, granularity, startDate, endDate)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &SavingsSummary{
+		StartDate:   startDate,
+		EndDate:     endDate,
+		Granularity: granularity,
+		ByModel:     []*SavingsStats{},
+		Trend:       []*SavingsStats{},
+	}
+	byModel := make(map[string]*SavingsStats)
+	for _, rollup := range rollups {
+		summary.add(rollup)
+
+		model, ok := byModel[rollup.ModelID]
+		if !ok {
+			model = &SavingsStats{ModelID: rollup.ModelID}
+			byModel[rollup.ModelID] = model
+			summary.ByModel = append(summary.ByModel, model)
+		}
+		model.add(rollup)
+
+		// Rollups are ordered by bucket, so each bucket's models are adjacent
+		if len(summary.Trend) == 0 || !summary.Trend[len(summary.Trend)-1].BucketStart.Equal(rollup.BucketStart) {
+			summary.Trend = append(summary.Trend, &SavingsStats{BucketStart: rollup.BucketStart})
+		}
+		summary.Trend[len(summary.Trend)-1].add(rollup)
+	}
+
+	sort.Slice(summary.ByModel, func(i, j int) bool {
+		if summary.ByModel[i].NetSavings != summary.ByModel[j].NetSavings {
+			return summary.ByModel[i].NetSavings > summary.ByModel[j].NetSavings
+		}
+		return summary.ByModel[i].ModelID < summary.ByModel[j].ModelID
+	})
+	return summary, nil
+}
@@ -0,0 +1,157 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// SeedManagedField marks documents owned by a seed. Only managed documents are deactivated when
+// they disappear from it, so pruning never touches users or keys created through the API.
+const SeedManagedField = "managed_by"
+
+// SeedManagedBy is the SeedManagedField value of seeded documents
+const SeedManagedBy = "seed"
+
+// Seed change actions
+const (
+	SeedCreate     = "create"
+	SeedUpdate     = "update"
+	SeedDeactivate = "deactivate"
+)
+
+// SeedChange is one document write needed to bring Firestore in line with a seed
+type SeedChange struct {
+	Action     string
+	Collection string
+	ID         string
+	// Fields are the values to write: the whole document on create, the changed fields on
+	// update and the deactivation fields on deactivate
+	Fields map[string]interface{}
+}
+
+// ListSeedDocuments returns every document in a collection as stored, keyed by document ID
+func (s *Service) ListSeedDocuments(ctx context.Context, collection string) (map[string]map[string]interface{}, error) {
+	iter := s.dbClient.Collection(collection).Documents(ctx)
+	defer iter.Stop()
+
+	docs := make(map[string]map[string]interface{})
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", collection, err)
+		}
+		docs[doc.Ref.ID] = doc.Data()
+	}
+
+	return docs, nil
+}
+
+// ApplySeedChanges writes seed changes. Creates fail if the document appeared since the plan was
+// made, and updates only touch the listed fields.
+func (s *Service) ApplySeedChanges(ctx context.Context, changes []SeedChange) error {
+	writer := s.dbClient.BulkWriter(ctx)
+	defer writer.End()
+
+	jobs := make([]*firestore.BulkWriterJob, len(changes))
+	for i, change := range changes {
+		ref := s.dbClient.Collection(change.Collection).Doc(change.ID)
+
+		var job *firestore.BulkWriterJob
+		var err error
+		switch change.Action {
+		case SeedCreate:
+			job, err = writer.Create(ref, change.Fields)
+		case SeedUpdate, SeedDeactivate:
+			updates := make([]firestore.Update, 0, len(change.Fields))
+			for field, value := range change.Fields {
+				updates = append(updates, firestore.Update{FieldPath: firestore.FieldPath{field}, Value: value})
+			}
+			job, err = writer.Update(ref, updates)
+		default:
+			err = fmt.Errorf("unknown action %q", change.Action)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to %s %s/%s: %w", change.Action, change.Collection, change.ID, err)
+		}
+		jobs[i] = job
+	}
+	writer.Flush()
+
+	for i, job := range jobs {
+		if _, err := job.Results(); err != nil {
+			return fmt.Errorf("failed to %s %s/%s: %w", changes[i].Action, changes[i].Collection, changes[i].ID, err)
+		}
+	}
+	return nil
+}
+
+// migrationsCollection records which data migrations have run, keyed by migration name
+const migrationsCollection = "schema_migrations"
+
+// Migration is a named, idempotent data migration. Run takes the service first so methods can be
+// listed as method expressions.
+type Migration struct {
+	Name string
+	Run  func(s *Service, ctx context.Context) (int, error)
+}
+
+// Migrations lists the data migrations in the order they run. Append new ones; never rename or
+// reorder released entries, since applied migrations are recorded by name.
+var Migrations = []Migration{
+	{Name: "0001_money_micros", Run: (*Service).MigrateMoneyFields},
+}
+
+// PendingMigrations returns the migrations that have not been recorded as applied
+func (s *Service) PendingMigrations(ctx context.Context) ([]Migration, error) {
+	var pending []Migration
+	for _, migration := range Migrations {
+		_, err := s.dbClient.Collection(migrationsCollection).Doc(migration.Name).Get(ctx)
+		if status.Code(err) == codes.NotFound {
+			pending = append(pending, migration)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to check migration %s: %w", migration.Name, err)
+		}
+	}
+	return pending, nil
+}
+
+// RunMigrations runs the pending migrations in order, recording each once it succeeds, and
+// returns the names of those it ran
+func (s *Service) RunMigrations(ctx context.Context) ([]string, error) {
+	pending, err := s.PendingMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var ran []string
+	for _, migration := range pending {
+		count, err := migration.Run(s, ctx)
+		if err != nil {
+			return ran, fmt.Errorf("migration %s failed: %w", migration.Name, err)
+		}
+
+		_, err = s.dbClient.Collection(migrationsCollection).Doc(migration.Name).Set(ctx, map[string]interface{}{
+			"applied_at":         time.Now(),
+			"documents_migrated": count,
+		})
+		if err != nil {
+			return ran, fmt.Errorf("failed to record migration %s: %w", migration.Name, err)
+		}
+
+		slog.Info("Migration applied", "migration", migration.Name, "documents_migrated", count)
+		ran = append(ran, migration.Name)
+	}
+	return ran, nil
+}
@@ -2,6 +2,10 @@ package data
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log/slog"
 	"time"
@@ -9,15 +13,35 @@ import (
 	"cloud.google.com/go/firestore"
 	firebase "firebase.google.com/go/v4"
 	"firebase.google.com/go/v4/auth"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// tracer creates spans for Firestore operations on the request path.
+// The Firestore client adds its own RPC spans beneath these.
+var tracer = otel.Tracer("github.com/apt-router/api/internal/data")
+
+// startSpan starts a span for a Firestore operation on the given collection
+func startSpan(ctx context.Context, operation, collection string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "firestore."+operation, trace.WithAttributes(
+		attribute.String("db.system", "firestore"),
+		attribute.String("db.collection.name", collection),
+	))
+}
+
 // Service handles Firebase operations
 type Service struct {
 	app        *firebase.App
 	authClient *auth.Client
 	dbClient   *firestore.Client
 	config     *FirebaseConfig
+	// stopMemory stops the in-memory Firestore backend in development mode
+	stopMemory func()
 }
 
 // FirebaseConfig holds Firebase configuration
@@ -25,99 +49,262 @@ type FirebaseConfig struct {
 	ProjectID          string
 	ServiceAccountPath string
 	UseCLIAuth         bool
+	// InMemory serves Firestore from process memory instead of a project, for development
+	// mode and tests. Nothing persists and Firebase Auth is unavailable.
+	InMemory bool
 }
 
 // User represents a user in the system
 type User struct {
 	ID            string    `firestore:"id"`
 	Email         string    `firestore:"email"`
-	Balance       float64   `firestore:"balance"`
+	Balance       MicroUSD  `firestore:"balance_micros"`
 	TierID        string    `firestore:"tier_id"`
 	CreatedAt     time.Time `firestore:"created_at"`
 	UpdatedAt     time.Time `firestore:"updated_at"`
 	IsActive      bool      `firestore:"is_active"`
 	CustomPricing bool      `firestore:"custom_pricing"`
+	// Billing
+	StripeCustomerID string             `firestore:"stripe_customer_id,omitempty"`
+	AutoTopUp        AutoTopUpSettings  `firestore:"auto_top_up"`
+	SpendAlerts      SpendAlertSettings `firestore:"spend_alerts"`
+	// UsageExport pushes the user's per-request usage to their metering system
+	UsageExport UsageExportSettings `firestore:"usage_export"`
+	// Currency is the ISO 4217 code of the currency amounts are displayed in; empty is USD
+	Currency string `firestore:"currency,omitempty"`
+	// Promotional credits, consumed before the paid balance
+	Credits      []CreditGrant `firestore:"credits,omitempty"`
+	ReferralCode string        `firestore:"referral_code,omitempty"`
+	ReferredBy   string        `firestore:"referred_by,omitempty"`
+	// LegacyBalance is the pre-migration float64 USD balance, cleared once migrated
+	LegacyBalance float64 `firestore:"balance,omitempty"`
+	// Type is UserTypeServiceAccount for service accounts and empty for people
+	Type string `firestore:"type,omitempty"`
+	// Name names a service account, which has no email address
+	Name string `firestore:"name,omitempty"`
+	// CreatedBy is the admin who created a service account
+	CreatedBy string `firestore:"created_by,omitempty"`
+	// DeletedAt is when the user asked for their account to be deleted; their data is erased once
+	// PurgeAfter passes, at PurgedAt
+	DeletedAt  time.Time `firestore:"deleted_at,omitempty"`
+	PurgeAfter time.Time `firestore:"purge_after,omitempty"`
+	PurgedAt   time.Time `firestore:"purged_at,omitempty"`
+}
+
+// UserTypeServiceAccount marks machine users created for backend integrations. They have no email
+// address or login and only authenticate with API keys.
+const UserTypeServiceAccount = "service_account"
+
+// IsServiceAccount reports whether the user is a service account
+func (u *User) IsServiceAccount() bool {
+	return u.Type == UserTypeServiceAccount
 }
 
 // PricingTier represents a pricing tier
 type PricingTier struct {
-	ID                  string                  `firestore:"id"`
-	Name                string                  `firestore:"name"`
-	MinMonthlySpend     float64                 `firestore:"min_monthly_spend"`
-	InputMarkupPercent  float64                 `firestore:"input_markup_percent"`
-	OutputMarkupPercent float64                 `firestore:"output_markup_percent"`
-	IsActive            bool                    `firestore:"is_active"`
-	IsCustom            bool                    `firestore:"is_custom"`
-	CustomModelPricing  map[string]ModelPricing `firestore:"custom_model_pricing,omitempty"`
+	ID                  string                  `firestore:"id" json:"id"`
+	Name                string                  `firestore:"name" json:"name"`
+	MinMonthlySpend     float64                 `firestore:"min_monthly_spend" json:"min_monthly_spend"`
+	InputMarkupPercent  float64                 `firestore:"input_markup_percent" json:"input_markup_percent"`
+	OutputMarkupPercent float64                 `firestore:"output_markup_percent" json:"output_markup_percent"`
+	IsActive            bool                    `firestore:"is_active" json:"is_active"`
+	IsCustom            bool                    `firestore:"is_custom" json:"is_custom"`
+	CustomModelPricing  map[string]ModelPricing `firestore:"custom_model_pricing,omitempty" json:"custom_model_pricing,omitempty"`
+	Moderation          ModerationSettings      `firestore:"moderation,omitempty" json:"moderation,omitempty"`
+	// Priority is the priority class of the tier's requests: high, normal (the default) or low
+	Priority string `firestore:"priority,omitempty" json:"priority,omitempty"`
+	// MaxPromptTokens bounds the prompt of the tier's requests; 0 is unlimited
+	MaxPromptTokens int `firestore:"max_prompt_tokens,omitempty" json:"max_prompt_tokens,omitempty"`
+	// MaxStreamOutputTokens and MaxStreamOutputBytes cap the output of the tier's streams, which are
+	// ended with a length_capped finish reason once they reach either; 0 is unlimited
+	MaxStreamOutputTokens int `firestore:"max_stream_output_tokens,omitempty" json:"max_stream_output_tokens,omitempty"`
+	MaxStreamOutputBytes  int `firestore:"max_stream_output_bytes,omitempty" json:"max_stream_output_bytes,omitempty"`
+	// LogRetentionDays and PayloadRetentionDays are how long the tier's request logs and stored
+	// payloads are kept; 0 uses the platform's retention
+	LogRetentionDays     int `firestore:"log_retention_days,omitempty" json:"log_retention_days,omitempty"`
+	PayloadRetentionDays int `firestore:"payload_retention_days,omitempty" json:"payload_retention_days,omitempty"`
+	// Optimization chooses which of the tier's prompts are optimized
+	Optimization OptimizationSettings `firestore:"optimization,omitempty" json:"optimization,omitempty"`
 }
 
-// ModelPricing represents custom pricing for specific models
+// ModelPricing represents custom pricing for specific models. Zero prices and nil markups leave
+// the model's base price and the tier's markup in place.
 type ModelPricing struct {
-	ModelID               string  `firestore:"model_id"`
-	Provider              string  `firestore:"provider"`
-	InputPricePerMillion  float64 `firestore:"input_price_per_million"`
-	OutputPricePerMillion float64 `firestore:"output_price_per_million"`
+	ModelID               string  `firestore:"model_id" json:"model_id"`
+	Provider              string  `firestore:"provider" json:"provider"`
+	InputPricePerMillion  float64 `firestore:"input_price_per_million" json:"input_price_per_million"`
+	OutputPricePerMillion float64 `firestore:"output_price_per_million" json:"output_price_per_million"`
+	// InputMarkupPercent and OutputMarkupPercent replace the tier's markups for the model
+	InputMarkupPercent  *float64 `firestore:"input_markup_percent,omitempty" json:"input_markup_percent,omitempty"`
+	OutputMarkupPercent *float64 `firestore:"output_markup_percent,omitempty" json:"output_markup_percent,omitempty"`
+}
+
+// AppliedPricing is the pricing a tier applies to a model: per-million prices and markup
+// percentages, and whether they came from the tier's custom model pricing
+type AppliedPricing struct {
+	InputPricePerMillion  float64 `json:"input_price_per_million"`
+	OutputPricePerMillion float64 `json:"output_price_per_million"`
+	InputMarkupPercent    float64 `json:"input_markup_percent"`
+	OutputMarkupPercent   float64 `json:"output_markup_percent"`
+	Override              bool
 }
 
 // APIKey represents an API key
 type APIKey struct {
-	ID        string    `firestore:"id"`
-	UserID    string    `firestore:"user_id"`
-	KeyHash   string    `firestore:"key_hash"`
-	Name      string    `firestore:"name"`
-	Status    string    `firestore:"status"`
-	CreatedAt time.Time `firestore:"created_at"`
-	LastUsed  time.Time `firestore:"last_used,omitempty"`
+	ID           string          `firestore:"id"`
+	UserID       string          `firestore:"user_id"`
+	OrgID        string          `firestore:"org_id,omitempty"`
+	TenantID     string          `firestore:"tenant_id,omitempty"`
+	KeyHash      string          `firestore:"key_hash"`
+	Name         string          `firestore:"name"`
+	Status       string          `firestore:"status"`
+	Scopes       []string        `firestore:"scopes,omitempty"`
+	Restrictions KeyRestrictions `firestore:"restrictions"`
+	// PostProcessing transforms the key's completions before they are returned
+	PostProcessing PostProcessing `firestore:"post_processing"`
+	CreatedAt      time.Time      `firestore:"created_at"`
+	LastUsed       time.Time      `firestore:"last_used,omitempty"`
+	// TestMode keys are answered by a fake provider and never charged, so customers can integrate
+	// and run CI without spending money
+	TestMode bool `firestore:"test_mode,omitempty"`
+	// PreviousKeyHash is the hash of the secret the key had before it was last rotated, which is
+	// still accepted until PreviousKeyExpiresAt. The key's ID stays the hash of its first secret.
+	PreviousKeyHash      string    `firestore:"previous_key_hash,omitempty"`
+	PreviousKeyExpiresAt time.Time `firestore:"previous_key_expires_at,omitempty"`
+	RotatedAt            time.Time `firestore:"rotated_at,omitempty"`
+	// ExpiresAt is when the key stops working, if it expires. Expired keys are rejected at once and
+	// later set to the expired status.
+	ExpiresAt time.Time `firestore:"expires_at,omitempty"`
+	// ExpiryWarnedAt is when the key's owner was warned that it is about to expire
+	ExpiryWarnedAt time.Time `firestore:"expiry_warned_at,omitempty"`
+}
+
+// Expired reports whether the key has passed its expiry at now
+func (k *APIKey) Expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt)
 }
 
 // RequestLog represents a logged request for audit purposes
 type RequestLog struct {
-	ID                 string                 `firestore:"id"`
-	UserID             string                 `firestore:"user_id"`
-	APIKeyID           string                 `firestore:"api_key_id"`
-	RequestID          string                 `firestore:"request_id"`
-	ModelID            string                 `firestore:"model_id"`
-	Provider           string                 `firestore:"provider"`
-	InputTokens        int                    `firestore:"input_tokens"`
-	OutputTokens       int                    `firestore:"output_tokens"`
-	TotalTokens        int                    `firestore:"total_tokens"`
-	BaseCost           float64                `firestore:"base_cost"`
-	MarkupAmount       float64                `firestore:"markup_amount"`
-	TotalCost          float64                `firestore:"total_cost"`
-	TierID             string                 `firestore:"tier_id"`
-	MarkupPercent      float64                `firestore:"markup_percent"`
-	WasOptimized       bool                   `firestore:"was_optimized"`
-	OptimizationStatus string                 `firestore:"optimization_status"`
-	TokensSaved        int                    `firestore:"tokens_saved"`
-	SavingsAmount      float64                `firestore:"savings_amount"`
-	Streaming          bool                   `firestore:"streaming"`
-	RequestTimestamp   time.Time              `firestore:"request_timestamp"`
-	ResponseTimestamp  time.Time              `firestore:"response_timestamp"`
-	DurationMs         int64                  `firestore:"duration_ms"`
-	Status             string                 `firestore:"status"`
-	Error              string                 `firestore:"error,omitempty"`
-	Metadata           map[string]interface{} `firestore:"metadata,omitempty"`
-	IPAddress          string                 `firestore:"ip_address"`
-	UserAgent          string                 `firestore:"user_agent"`
+	ID                string            `firestore:"id"`
+	UserID            string            `firestore:"user_id"`
+	OrgID             string            `firestore:"org_id,omitempty"`
+	TenantID          string            `firestore:"tenant_id,omitempty"`
+	UserType          string            `firestore:"user_type,omitempty"`
+	APIKeyID          string            `firestore:"api_key_id"`
+	RequestID         string            `firestore:"request_id"`
+	ModelID           string            `firestore:"model_id"`
+	RequestedModel    string            `firestore:"requested_model,omitempty"`
+	BYOK              bool              `firestore:"byok,omitempty"`
+	BillingMode       string            `firestore:"billing_mode,omitempty"`
+	Moderation        *ModerationRecord `firestore:"moderation,omitempty"`
+	SystemPrompts     []SystemPromptRef `firestore:"system_prompts,omitempty"`
+	TemplateID        string            `firestore:"template_id,omitempty"`
+	TemplateVersion   int               `firestore:"template_version,omitempty"`
+	ExperimentID      string            `firestore:"experiment_id,omitempty"`
+	ExperimentVariant string            `firestore:"experiment_variant,omitempty"`
+	Provider          string            `firestore:"provider"`
+	InputTokens       int               `firestore:"input_tokens"`
+	OutputTokens      int               `firestore:"output_tokens"`
+	TotalTokens       int               `firestore:"total_tokens"`
+	BaseCost          MicroUSD          `firestore:"base_cost_micros"`
+	MarkupAmount      MicroUSD          `firestore:"markup_amount_micros"`
+	PlatformFee       MicroUSD          `firestore:"platform_fee_micros,omitempty"`
+	TotalCost         MicroUSD          `firestore:"total_cost_micros"`
+	// CreditsUsed is the part of TotalCost paid with promotional credit rather than the paid balance
+	CreditsUsed        MicroUSD `firestore:"credits_used_micros,omitempty"`
+	TierID             string   `firestore:"tier_id"`
+	MarkupPercent      float64  `firestore:"markup_percent"`
+	WasOptimized       bool     `firestore:"was_optimized"`
+	OptimizationStatus string   `firestore:"optimization_status"`
+	TokensSaved        int      `firestore:"tokens_saved"`
+	// SavingsAmount is the price of the tokens saved less the prompt optimizer's cost, and
+	// GrossSavings their price alone
+	SavingsAmount MicroUSD `firestore:"savings_amount_micros"`
+	GrossSavings  MicroUSD `firestore:"gross_savings_micros,omitempty"`
+	// OptimizerInputTokens and OptimizerOutputTokens are what the prompt optimizer model call used,
+	// and OptimizerCost its price, which TotalCost includes
+	OptimizerInputTokens  int                    `firestore:"optimizer_input_tokens,omitempty"`
+	OptimizerOutputTokens int                    `firestore:"optimizer_output_tokens,omitempty"`
+	OptimizerCost         MicroUSD               `firestore:"optimizer_cost_micros,omitempty"`
+	Streaming             bool                   `firestore:"streaming"`
+	RequestTimestamp      time.Time              `firestore:"request_timestamp"`
+	ResponseTimestamp     time.Time              `firestore:"response_timestamp"`
+	DurationMs            int64                  `firestore:"duration_ms"`
+	TimeToFirstTokenMs    int64                  `firestore:"time_to_first_token_ms,omitempty"`
+	Status                string                 `firestore:"status"`
+	Error                 string                 `firestore:"error,omitempty"`
+	Metadata              map[string]interface{} `firestore:"metadata,omitempty"`
+	IPAddress             string                 `firestore:"ip_address"`
+	UserAgent             string                 `firestore:"user_agent"`
+	// UsageEstimated marks requests billed on estimated token counts because the provider
+	// reported no usage
+	UsageEstimated bool `firestore:"usage_estimated,omitempty"`
+	// CachedInputTokens and CacheWriteInputTokens are the input tokens the provider read from and
+	// wrote to its prompt cache, which BaseCost prices at the cache's rates
+	CachedInputTokens     int `firestore:"cached_input_tokens,omitempty"`
+	CacheWriteInputTokens int `firestore:"cache_write_input_tokens,omitempty"`
+	// ReasoningTokens are the output tokens a reasoning model spent thinking, which BaseCost
+	// prices at the model's reasoning price
+	ReasoningTokens int `firestore:"reasoning_tokens,omitempty"`
+	// PricingOverride is set when the tier's custom pricing for the model priced the request
+	PricingOverride bool `firestore:"pricing_override,omitempty"`
+	// TestMode marks requests made with a test API key, which a fake provider answered for free
+	TestMode bool `firestore:"test_mode,omitempty"`
+	// Payload is the request as the caller sent it and its completion, stored when payload logging
+	// is enabled so the request can be replayed
+	Payload *RequestPayload `firestore:"payload,omitempty"`
+	// Routing records how the routing rules evaluated the request, when any were enabled
+	Routing *RoutingDecision `firestore:"routing,omitempty"`
+	// ErrorDetail says why a request with status "error" failed
+	ErrorDetail *ErrorDetail `firestore:"error_detail,omitempty"`
+}
+
+// RequestStatusError is the status of request logs for generations that failed at the provider
+const RequestStatusError = "error"
+
+// ErrorDetail describes a failed generation, from the provider's error where there was one
+type ErrorDetail struct {
+	// Code is the provider's error code; provider_error when the provider gave none, timeout when
+	// it did not answer in time and internal when the request failed before reaching it
+	Code string `firestore:"code" json:"code"`
+	// StatusCode is the HTTP status the provider answered with, if any
+	StatusCode int    `firestore:"status_code,omitempty" json:"status_code,omitempty"`
+	Provider   string `firestore:"provider,omitempty" json:"provider,omitempty"`
+	Retryable  bool   `firestore:"retryable" json:"retryable"`
+}
+
+// clientOptions are the options Google API clients for the project are created with. Firebase CLI
+// authentication and Application Default Credentials need none.
+func (c *FirebaseConfig) clientOptions() []option.ClientOption {
+	if !c.UseCLIAuth && c.ServiceAccountPath != "" {
+		return []option.ClientOption{option.WithCredentialsFile(c.ServiceAccountPath)}
+	}
+	return nil
 }
 
 // NewService creates a new Firebase service
 func NewService(config *FirebaseConfig) (*Service, error) {
-	var opts []option.ClientOption
+	if config.InMemory {
+		slog.Warn("Using in-memory Firestore; data will not persist")
+		dbClient, stop, err := newMemoryFirestoreClient(context.Background(), config.ProjectID)
+		if err != nil {
+			return nil, err
+		}
+		return &Service{dbClient: dbClient, config: config, stopMemory: stop}, nil
+	}
 
 	if config.UseCLIAuth {
 		// Use Firebase CLI authentication (recommended for development)
 		slog.Info("Using Firebase CLI authentication")
-		// No additional options needed - Firebase CLI handles auth automatically
 	} else if config.ServiceAccountPath != "" {
 		// Use service account key file (fallback for production)
 		slog.Info("Using service account key authentication", "path", config.ServiceAccountPath)
-		opts = append(opts, option.WithCredentialsFile(config.ServiceAccountPath))
 	} else {
 		// Use Application Default Credentials (ADC)
 		slog.Info("Using Application Default Credentials")
-		// No additional options needed - ADC will be used automatically
 	}
+	opts := config.clientOptions()
 
 	// Initialize Firebase app
 	app, err := firebase.NewApp(context.Background(), &firebase.Config{
@@ -149,10 +336,14 @@ func NewService(config *FirebaseConfig) (*Service, error) {
 
 // Close closes the Firebase connections
 func (s *Service) Close() error {
+	var err error
 	if s.dbClient != nil {
-		return s.dbClient.Close()
+		err = s.dbClient.Close()
 	}
-	return nil
+	if s.stopMemory != nil {
+		s.stopMemory()
+	}
+	return err
 }
 
 // DB returns the Firestore client
@@ -160,10 +351,75 @@ func (s *Service) DB() *firestore.Client {
 	return s.dbClient
 }
 
+// Ping checks that Firestore is reachable by reading at most one pricing tier
+func (s *Service) Ping(ctx context.Context) error {
+	if s == nil || s.dbClient == nil {
+		return errors.New("firestore client not initialized")
+	}
+
+	iter := s.dbClient.Collection("pricing_tiers").Limit(1).Documents(ctx)
+	defer iter.Stop()
+	if _, err := iter.Next(); err != nil && err != iterator.Done {
+		return fmt.Errorf("failed to reach firestore: %w", err)
+	}
+	return nil
+}
+
+// VerifyIDToken verifies a Firebase Auth ID token and returns the authenticated user ID
+func (s *Service) VerifyIDToken(ctx context.Context, idToken string) (string, error) {
+	// Development mode has no Firebase Auth; the token is taken as the user ID
+	if s.config != nil && s.config.InMemory {
+		if idToken == "" {
+			return "", fmt.Errorf("failed to verify ID token: empty token")
+		}
+		return idToken, nil
+	}
+
+	if s.authClient == nil {
+		return "", fmt.Errorf("firebase auth is not initialized")
+	}
+
+	token, err := s.authClient.VerifyIDToken(ctx, idToken)
+	if err != nil {
+		return "", fmt.Errorf("failed to verify ID token: %w", err)
+	}
+
+	return token.UID, nil
+}
+
 // GetUserByAPIKey gets a user by API key hash
 func (s *Service) GetUserByAPIKey(ctx context.Context, keyHash string) (*User, error) {
+	apiKey, err := s.GetAPIKeyByHash(ctx, keyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get user by ID
+	return s.GetUserByID(ctx, apiKey.UserID)
+}
+
+// GetAPIKeyByHash gets an active API key by its hash, or by the hash of the secret it was
+// rotated from while that secret's grace period lasts
+func (s *Service) GetAPIKeyByHash(ctx context.Context, keyHash string) (*APIKey, error) {
+	ctx, span := startSpan(ctx, "GetAPIKeyByHash", "api_keys")
+	defer span.End()
+
 	// Query API keys collection
-	iter := s.dbClient.Collection("api_keys").Where("key_hash", "==", keyHash).Where("status", "==", "active").Limit(1).Documents(ctx)
+	apiKey, err := s.findActiveAPIKey(ctx, "key_hash", keyHash)
+	if err == nil {
+		return apiKey, nil
+	}
+
+	previous, previousErr := s.findActiveAPIKey(ctx, "previous_key_hash", keyHash)
+	if previousErr != nil || !time.Now().Before(previous.PreviousKeyExpiresAt) {
+		return nil, err
+	}
+	return previous, nil
+}
+
+// findActiveAPIKey gets the active API key whose field has value
+func (s *Service) findActiveAPIKey(ctx context.Context, field, value string) (*APIKey, error) {
+	iter := s.dbClient.Collection("api_keys").Where(field, "==", value).Where("status", "==", "active").Limit(1).Documents(ctx)
 	defer iter.Stop()
 
 	doc, err := iter.Next()
@@ -176,12 +432,24 @@ func (s *Service) GetUserByAPIKey(ctx context.Context, keyHash string) (*User, e
 		return nil, fmt.Errorf("failed to parse API key: %w", err)
 	}
 
-	// Get user by ID
-	return s.GetUserByID(ctx, apiKey.UserID)
+	return &apiKey, nil
+}
+
+// CreateUser creates a user, failing if one with the same ID exists
+func (s *Service) CreateUser(ctx context.Context, user *User) error {
+	now := time.Now()
+	user.CreatedAt, user.UpdatedAt = now, now
+	if _, err := s.dbClient.Collection("users").Doc(user.ID).Create(ctx, user); err != nil {
+		return fmt.Errorf("failed to create user: %w", err)
+	}
+	return nil
 }
 
 // GetUserByID gets a user by ID
 func (s *Service) GetUserByID(ctx context.Context, userID string) (*User, error) {
+	ctx, span := startSpan(ctx, "GetUserByID", "users")
+	defer span.End()
+
 	doc, err := s.dbClient.Collection("users").Doc(userID).Get(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("user not found: %w", err)
@@ -191,15 +459,30 @@ func (s *Service) GetUserByID(ctx context.Context, userID string) (*User, error)
 	if err := doc.DataTo(&user); err != nil {
 		return nil, fmt.Errorf("failed to parse user: %w", err)
 	}
+	user.migrateLegacyBalance()
 
 	return &user, nil
 }
 
+// migrateLegacyBalance converts a pre-migration float64 balance into micro-USD
+func (u *User) migrateLegacyBalance() {
+	if u.Balance == 0 && u.LegacyBalance != 0 {
+		u.Balance = USDToMicros(u.LegacyBalance)
+	}
+	u.LegacyBalance = 0
+}
+
 // GetPricingTier gets a pricing tier by ID
 func (s *Service) GetPricingTier(ctx context.Context, tierID string) (*PricingTier, error) {
+	ctx, span := startSpan(ctx, "GetPricingTier", "pricing_tiers")
+	defer span.End()
+
 	doc, err := s.dbClient.Collection("pricing_tiers").Doc(tierID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrPricingTierNotFound
+	}
 	if err != nil {
-		return nil, fmt.Errorf("pricing tier not found: %w", err)
+		return nil, fmt.Errorf("failed to get pricing tier: %w", err)
 	}
 
 	var tier PricingTier
@@ -228,46 +511,82 @@ func (s *Service) GetDefaultPricingTier(ctx context.Context) (*PricingTier, erro
 	return &tier, nil
 }
 
-// CalculateCost calculates the cost with markup based on tier
-func (s *Service) CalculateCost(ctx context.Context, user *User, modelID, provider string, inputTokens, outputTokens int, baseInputPrice, baseOutputPrice float64) (float64, float64, error) {
-	// Get user's pricing tier
-	tier, err := s.GetPricingTier(ctx, user.TierID)
+// GetPricingTierOrDefault gets a pricing tier, falling back to the default tier when it can't be loaded
+func (s *Service) GetPricingTierOrDefault(ctx context.Context, tierID string) (*PricingTier, error) {
+	tier, err := s.GetPricingTier(ctx, tierID)
 	if err != nil {
-		// Fallback to default tier
 		tier, err = s.GetDefaultPricingTier(ctx)
 		if err != nil {
-			return 0, 0, fmt.Errorf("failed to get pricing tier: %w", err)
+			return nil, fmt.Errorf("failed to get pricing tier: %w", err)
 		}
 	}
+	return tier, nil
+}
 
-	// Check for custom model pricing
-	inputPrice := baseInputPrice
-	outputPrice := baseOutputPrice
-
-	if user.CustomPricing && tier.IsCustom && tier.CustomModelPricing != nil {
-		if modelPricing, exists := tier.CustomModelPricing[modelID]; exists {
-			inputPrice = modelPricing.InputPricePerMillion
-			outputPrice = modelPricing.OutputPricePerMillion
-		}
+// CalculateCost calculates the cost with markup based on tier.
+// Custom model pricing on the tier applies only when customPricing is set for the account.
+func (s *Service) CalculateCost(ctx context.Context, tierID string, customPricing bool, modelID, provider string, inputTokens, outputTokens int, details TokenDetails, rates TokenRates, baseInputPrice, baseOutputPrice float64) (CostBreakdown, error) {
+	// Get the account's pricing tier
+	tier, err := s.GetPricingTierOrDefault(ctx, tierID)
+	if err != nil {
+		return CostBreakdown{}, err
 	}
 
-	// Calculate base cost
-	inputCost := (float64(inputTokens) / 1000000) * inputPrice
-	outputCost := (float64(outputTokens) / 1000000) * outputPrice
-	baseCost := inputCost + outputCost
+	return tier.Cost(modelID, customPricing, inputTokens, outputTokens, details, rates, baseInputPrice, baseOutputPrice), nil
+}
 
-	// Calculate markup
-	inputMarkup := inputCost * (tier.InputMarkupPercent / 100)
-	outputMarkup := outputCost * (tier.OutputMarkupPercent / 100)
-	totalMarkup := inputMarkup + outputMarkup
+// Cost prices tokens for a model under the tier with the pricing PricingFor applies. Cached input
+// and reasoning tokens are charged at rates relative to whichever prices apply.
+func (t *PricingTier) Cost(modelID string, customPricing bool, inputTokens, outputTokens int, details TokenDetails, rates TokenRates, baseInputPrice, baseOutputPrice float64) CostBreakdown {
+	pricing := t.PricingFor(modelID, customPricing, baseInputPrice, baseOutputPrice)
+	return ComputeDetailedCost(inputTokens, outputTokens, details, rates, pricing.InputPricePerMillion, pricing.OutputPricePerMillion, pricing.InputMarkupPercent, pricing.OutputMarkupPercent)
+}
 
-	totalCost := baseCost + totalMarkup
+// PricingFor returns the pricing the tier applies to a model with the given base prices. The
+// tier's markups apply to the base prices unless the tier is custom, customPricing is set for the
+// account, and the tier has custom pricing for the model; then each price or markup the custom
+// pricing sets replaces the base price or tier markup.
+func (t *PricingTier) PricingFor(modelID string, customPricing bool, baseInputPrice, baseOutputPrice float64) AppliedPricing {
+	pricing := AppliedPricing{
+		InputPricePerMillion:  baseInputPrice,
+		OutputPricePerMillion: baseOutputPrice,
+		InputMarkupPercent:    t.InputMarkupPercent,
+		OutputMarkupPercent:   t.OutputMarkupPercent,
+	}
+	if !customPricing || !t.IsCustom {
+		return pricing
+	}
+	modelPricing, exists := t.CustomModelPricing[modelID]
+	if !exists {
+		return pricing
+	}
+
+	pricing.Override = true
+	if modelPricing.InputPricePerMillion > 0 {
+		pricing.InputPricePerMillion = modelPricing.InputPricePerMillion
+	}
+	if modelPricing.OutputPricePerMillion > 0 {
+		pricing.OutputPricePerMillion = modelPricing.OutputPricePerMillion
+	}
+	if modelPricing.InputMarkupPercent != nil {
+		pricing.InputMarkupPercent = *modelPricing.InputMarkupPercent
+	}
+	if modelPricing.OutputMarkupPercent != nil {
+		pricing.OutputMarkupPercent = *modelPricing.OutputMarkupPercent
+	}
+	return pricing
+}
 
-	return totalCost, totalMarkup, nil
+// MarkupPercent returns the average of the input and output markups, as request logs record it
+func (p AppliedPricing) MarkupPercent() float64 {
+	return (p.InputMarkupPercent + p.OutputMarkupPercent) / 2
 }
 
 // LogRequest logs a request for audit purposes
 func (s *Service) LogRequest(ctx context.Context, log *RequestLog) error {
+	ctx, span := startSpan(ctx, "LogRequest", "request_logs")
+	defer span.End()
+
 	// Set timestamps if not provided
 	if log.RequestTimestamp.IsZero() {
 		log.RequestTimestamp = time.Now()
@@ -285,61 +604,120 @@ func (s *Service) LogRequest(ctx context.Context, log *RequestLog) error {
 		return fmt.Errorf("failed to log request: %w", err)
 	}
 
+	// Rollups back the usage dashboards; a failed increment is logged rather than failing the request log.
+	// Test mode requests are kept out of them, so they only show real usage.
+	if !log.TestMode {
+		if err := s.incrementUsageRollups(ctx, log); err != nil {
+			slog.Warn("Failed to update usage rollups", "request_id", log.RequestID, "error", err)
+		}
+		if err := s.incrementProviderCost(ctx, log); err != nil {
+			slog.Warn("Failed to update provider costs", "request_id", log.RequestID, "error", err)
+		}
+	}
+
 	slog.Info("Request logged",
 		"request_id", log.RequestID,
 		"user_id", log.UserID,
 		"model", log.ModelID,
-		"total_cost", log.TotalCost,
+		"total_cost", log.TotalCost.String(),
 		"duration_ms", log.DurationMs,
+		"test_mode", log.TestMode,
 	)
 
 	return nil
 }
 
-// UpdateUserBalance updates a user's balance
-func (s *Service) UpdateUserBalance(ctx context.Context, userID string, amount float64) error {
+// UpdateUserBalance updates a user's balance and records the change in the balance ledger.
+// Charges consume promotional credits before the paid balance; it returns the credit consumed.
+func (s *Service) UpdateUserBalance(ctx context.Context, userID string, amount MicroUSD, entryType LedgerEntryType, requestID string) (MicroUSD, error) {
+	ctx, span := startSpan(ctx, "UpdateUserBalance", "users")
+	defer span.End()
+
 	// Use a transaction to ensure atomicity
+	var creditsUsed MicroUSD
 	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
-		userRef := s.dbClient.Collection("users").Doc(userID)
-
-		// Get current user
-		doc, err := tx.Get(userRef)
+		entry, err := s.applyBalanceChange(tx, userID, amount, entryType, requestID)
 		if err != nil {
-			return fmt.Errorf("failed to get user: %w", err)
-		}
-
-		var user User
-		if err := doc.DataTo(&user); err != nil {
-			return fmt.Errorf("failed to parse user: %w", err)
+			return err
 		}
-
-		// Update balance
-		user.Balance += amount
-		user.UpdatedAt = time.Now()
-
-		// Ensure balance doesn't go negative
-		if user.Balance < 0 {
-			return fmt.Errorf("insufficient balance: current balance %.2f, attempted charge %.2f", user.Balance-amount, -amount)
-		}
-
-		// Update user
-		return tx.Set(userRef, user)
+		creditsUsed = -entry.CreditAmount
+		return nil
 	})
 
 	if err != nil {
-		return fmt.Errorf("failed to update user balance: %w", err)
+		return 0, fmt.Errorf("failed to update user balance: %w", err)
 	}
 
 	slog.Info("User balance updated",
 		"user_id", userID,
-		"amount", amount,
+		"amount", amount.String(),
+		"credits_used", creditsUsed.String(),
+		"type", entryType,
+		"request_id", requestID,
 	)
 
-	return nil
+	return creditsUsed, nil
+}
+
+// applyBalanceChange updates a user's balance and writes the matching ledger entry within a transaction.
+// Any reads the caller needs must happen before calling it. Charges consume promotional credits
+// first, and may leave the balance in debt; it returns the ledger entry written.
+func (s *Service) applyBalanceChange(tx *firestore.Transaction, userID string, amount MicroUSD, entryType LedgerEntryType, requestID string) (*LedgerEntry, error) {
+	userRef := s.dbClient.Collection("users").Doc(userID)
+
+	// Get current user
+	user, err := s.getUserInTransaction(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	user.UpdatedAt = time.Now()
+
+	// Spend promotional credits before the paid balance, writing off any that have expired
+	var creditsUsed MicroUSD
+	if entryType == LedgerEntryCharge && amount < 0 {
+		creditsUsed = user.consumeCredits(-amount, user.UpdatedAt)
+	}
+	expired := user.pruneCredits(user.UpdatedAt)
+
+	// Update balance
+	balanceChange := amount + creditsUsed
+	user.Balance += balanceChange
+
+	debt, err := settleDebt(entryType, user.Balance, balanceChange)
+	if err != nil {
+		return nil, err
+	}
+
+	// Update user
+	if err := tx.Set(userRef, user); err != nil {
+		return nil, err
+	}
+
+	if err := s.writeCreditExpiry(tx, user, expired, user.UpdatedAt); err != nil {
+		return nil, err
+	}
+
+	// Record the change in the same transaction so the ledger always matches the balance
+	entry := &LedgerEntry{
+		UserID:           userID,
+		Type:             entryType,
+		RequestID:        requestID,
+		Amount:           balanceChange,
+		CreditAmount:     -creditsUsed,
+		ResultingBalance: user.Balance,
+		ResultingCredits: user.AvailableCredits(user.UpdatedAt),
+		Debt:             debt,
+		CreatedAt:        user.UpdatedAt,
+	}
+	if err := s.writeLedgerEntry(tx, entry); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
 }
 
 // GetUserBalance gets a user's current balance
-func (s *Service) GetUserBalance(ctx context.Context, userID string) (float64, error) {
+func (s *Service) GetUserBalance(ctx context.Context, userID string) (MicroUSD, error) {
 	user, err := s.GetUserByID(ctx, userID)
 	if err != nil {
 		return 0, err
@@ -348,21 +726,13 @@ func (s *Service) GetUserBalance(ctx context.Context, userID string) (float64, e
 	return user.Balance, nil
 }
 
-// GetUserUsage gets a user's usage statistics
-func (s *Service) GetUserUsage(ctx context.Context, userID string, startDate, endDate time.Time) (map[string]interface{}, error) {
-	// Query request logs for the user in the date range
-	iter := s.dbClient.Collection("request_logs").
-		Where("user_id", "==", userID).
-		Where("request_timestamp", ">=", startDate).
-		Where("request_timestamp", "<=", endDate).
-		Documents(ctx)
-	defer iter.Stop()
-
-	var totalCost float64
+// summarizeUsage totals the request logs returned by iter
+func summarizeUsage(iter *firestore.DocumentIterator, startDate, endDate time.Time) map[string]interface{} {
+	var totalCost MicroUSD
 	var totalTokens int
 	var totalRequests int
 	var totalTokensSaved int
-	var totalSavings float64
+	var totalSavings MicroUSD
 
 	for {
 		doc, err := iter.Next()
@@ -390,19 +760,36 @@ func (s *Service) GetUserUsage(ctx context.Context, userID string, startDate, en
 		"total_savings":      totalSavings,
 		"start_date":         startDate,
 		"end_date":           endDate,
-	}, nil
+	}
 }
 
-// CreateAPIKey creates a new API key for a user
-func (s *Service) CreateAPIKey(ctx context.Context, userID, keyHash, name string) (*APIKey, error) {
-	apiKey := &APIKey{
-		ID:        keyHash, // Use hash as ID for simplicity
-		UserID:    userID,
-		KeyHash:   keyHash,
-		Name:      name,
-		Status:    "active",
-		CreatedAt: time.Now(),
+// TestAPIKeyPrefix starts test mode API keys, so they can be told apart from live keys at a glance
+const TestAPIKeyPrefix = "apt-test-"
+
+// GenerateAPIKey generates a new random API key; test mode keys start with TestAPIKeyPrefix
+func GenerateAPIKey(testMode bool) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate API key: %w", err)
 	}
+	if testMode {
+		return TestAPIKeyPrefix + hex.EncodeToString(b), nil
+	}
+	return "apt-" + hex.EncodeToString(b), nil
+}
+
+// HashAPIKey returns the salted hash API keys are stored and looked up by
+func HashAPIKey(apiKey, salt string) string {
+	hash := sha256.Sum256([]byte(apiKey + salt))
+	return hex.EncodeToString(hash[:])
+}
+
+// CreateAPIKey creates a new API key for a user.
+// Keys with a non-empty OrgID bill the organization's shared balance.
+func (s *Service) CreateAPIKey(ctx context.Context, apiKey *APIKey) (*APIKey, error) {
+	apiKey.ID = apiKey.KeyHash // Use hash as ID for simplicity
+	apiKey.Status = "active"
+	apiKey.CreatedAt = time.Now()
 
 	_, err := s.dbClient.Collection("api_keys").Doc(apiKey.ID).Set(ctx, apiKey)
 	if err != nil {
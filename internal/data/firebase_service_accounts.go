@@ -0,0 +1,53 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+
+	"google.golang.org/api/iterator"
+)
+
+// CreateServiceAccount creates a service account user, failing if one with the same ID exists
+func (s *Service) CreateServiceAccount(ctx context.Context, user *User) error {
+	user.Type = UserTypeServiceAccount
+	user.Email = ""
+	if err := s.CreateUser(ctx, user); err != nil {
+		return err
+	}
+
+	slog.Info("Service account created", "user_id", user.ID, "name", user.Name, "tier_id", user.TierID)
+	return nil
+}
+
+// ListServiceAccounts lists every service account, oldest first
+func (s *Service) ListServiceAccounts(ctx context.Context) ([]*User, error) {
+	iter := s.dbClient.Collection("users").Where("type", "==", UserTypeServiceAccount).Documents(ctx)
+	defer iter.Stop()
+
+	var users []*User
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list service accounts: %w", err)
+		}
+
+		var user User
+		if err := doc.DataTo(&user); err != nil {
+			slog.Warn("Failed to parse service account", "doc_id", doc.Ref.ID, "error", err)
+			continue
+		}
+
+		users = append(users, &user)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].CreatedAt.Before(users[j].CreatedAt)
+	})
+
+	return users, nil
+}
@@ -0,0 +1,208 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	sessionsCollection = "sessions"
+	// sessionMessagesCollection holds every session's messages, with their user, so exports and
+	// account deletion find them as they find the user's other data
+	sessionMessagesCollection = "session_messages"
+)
+
+var (
+	// ErrSessionNotFound is returned for sessions that do not exist
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrSessionConflict is returned when a session gained messages since it was read, because
+	// another request to it finished first
+	ErrSessionConflict = errors.New("session was updated by another request")
+)
+
+// Session is a conversation whose history the server keeps, so stateless clients can send only
+// each new message. Its oldest messages are folded into Summary once the conversation outgrows
+// the context it may use.
+type Session struct {
+	ID       string `firestore:"id" json:"id"`
+	UserID   string `firestore:"user_id" json:"-"`
+	OrgID    string `firestore:"org_id,omitempty" json:"-"`
+	APIKeyID string `firestore:"api_key_id,omitempty" json:"-"`
+	Model    string `firestore:"model" json:"model"`
+	System   string `firestore:"system,omitempty" json:"system,omitempty"`
+	// MaxContextTokens bounds the prompt and completion of each request; 0 uses the server default
+	MaxContextTokens int `firestore:"max_context_tokens,omitempty" json:"max_context_tokens,omitempty"`
+	// The first SummarizedMessages messages are no longer sent. Summary stands for them, but for
+	// any dropped when they could not be summarized.
+	Summary            string `firestore:"summary,omitempty" json:"summary,omitempty"`
+	SummarizedMessages int    `firestore:"summarized_messages" json:"summarized_messages"`
+	MessageCount       int    `firestore:"message_count" json:"message_count"`
+	// TotalCost is what the session's requests have been charged
+	TotalCost MicroUSD  `firestore:"total_cost" json:"total_cost"`
+	CreatedAt time.Time `firestore:"created_at" json:"created_at"`
+	UpdatedAt time.Time `firestore:"updated_at" json:"updated_at"`
+	// ExpiresAt is when the session is deleted unless another message is sent
+	ExpiresAt time.Time `firestore:"expires_at" json:"expires_at"`
+}
+
+// SessionMessage is one message of a session. Seq numbers a session's messages from 0.
+type SessionMessage struct {
+	SessionID string    `firestore:"session_id" json:"-"`
+	UserID    string    `firestore:"user_id" json:"-"`
+	Seq       int       `firestore:"seq" json:"seq"`
+	Role      string    `firestore:"role" json:"role"`
+	Content   string    `firestore:"content" json:"content"`
+	RequestID string    `firestore:"request_id,omitempty" json:"request_id,omitempty"`
+	CreatedAt time.Time `firestore:"created_at" json:"created_at"`
+}
+
+// SessionTurn is what one request adds to a session: its messages, any summary that replaced
+// older messages, and what the request was charged
+type SessionTurn struct {
+	Messages           []SessionMessage
+	Summary            string
+	SummarizedMessages int
+	Cost               MicroUSD
+}
+
+// CreateSession stores a new session, setting its ID
+func (s *Service) CreateSession(ctx context.Context, session *Session) error {
+	ref := s.dbClient.Collection(sessionsCollection).NewDoc()
+	session.ID = ref.ID
+	if _, err := ref.Create(ctx, session); err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+	return nil
+}
+
+// GetSession gets a session by ID
+func (s *Service) GetSession(ctx context.Context, sessionID string) (*Session, error) {
+	doc, err := s.dbClient.Collection(sessionsCollection).Doc(sessionID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session: %w", err)
+	}
+
+	var session Session
+	if err := doc.DataTo(&session); err != nil {
+		return nil, fmt.Errorf("failed to parse session: %w", err)
+	}
+	return &session, nil
+}
+
+// ListSessionMessages lists a session's messages from seq from on, in order
+func (s *Service) ListSessionMessages(ctx context.Context, sessionID string, from int) ([]SessionMessage, error) {
+	docs, err := s.dbClient.Collection(sessionMessagesCollection).
+		Where("session_id", "==", sessionID).
+		Where("seq", ">=", from).
+		OrderBy("seq", firestore.Asc).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list session messages: %w", err)
+	}
+
+	messages := make([]SessionMessage, 0, len(docs))
+	for _, doc := range docs {
+		var message SessionMessage
+		if err := doc.DataTo(&message); err != nil {
+			return nil, fmt.Errorf("failed to parse session message: %w", err)
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// AppendSessionTurn adds a request's messages to a session that still has messageCount messages,
+// numbering them on from there, and records its summary and cost. It fails with
+// ErrSessionConflict if another request added messages first, and keeps the session for ttl
+// from now.
+func (s *Service) AppendSessionTurn(ctx context.Context, sessionID string, messageCount int, turn SessionTurn, ttl time.Duration) (*Session, error) {
+	sessionRef := s.dbClient.Collection(sessionsCollection).Doc(sessionID)
+
+	var updated Session
+	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(sessionRef)
+		if status.Code(err) == codes.NotFound {
+			return ErrSessionNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := doc.DataTo(&updated); err != nil {
+			return fmt.Errorf("failed to parse session: %w", err)
+		}
+		if updated.MessageCount != messageCount {
+			return ErrSessionConflict
+		}
+
+		now := time.Now()
+		for i, message := range turn.Messages {
+			message.SessionID = sessionID
+			message.UserID = updated.UserID
+			message.Seq = messageCount + i
+			message.CreatedAt = now
+			if err := tx.Create(s.dbClient.Collection(sessionMessagesCollection).Doc(sessionMessageID(sessionID, message.Seq)), message); err != nil {
+				return err
+			}
+		}
+
+		updated.MessageCount += len(turn.Messages)
+		if turn.SummarizedMessages > updated.SummarizedMessages {
+			updated.Summary = turn.Summary
+			updated.SummarizedMessages = turn.SummarizedMessages
+		}
+		updated.TotalCost += turn.Cost
+		updated.UpdatedAt = now
+		updated.ExpiresAt = now.Add(ttl)
+		return tx.Set(sessionRef, updated)
+	})
+	if errors.Is(err, ErrSessionNotFound) || errors.Is(err, ErrSessionConflict) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to append to session: %w", err)
+	}
+	return &updated, nil
+}
+
+// sessionMessageID is the document ID of a session's message, which orders a session's messages
+// by seq and stops two requests writing the same message
+func sessionMessageID(sessionID string, seq int) string {
+	return fmt.Sprintf("%s-%08d", sessionID, seq)
+}
+
+// DeleteSession deletes a session and its messages
+func (s *Service) DeleteSession(ctx context.Context, sessionID string) error {
+	if err := s.deleteQuery(ctx, s.dbClient.Collection(sessionMessagesCollection).Where("session_id", "==", sessionID)); err != nil {
+		return fmt.Errorf("failed to delete session messages: %w", err)
+	}
+	if _, err := s.dbClient.Collection(sessionsCollection).Doc(sessionID).Delete(ctx); err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+	return nil
+}
+
+// ListExpiredSessions lists the IDs of up to limit sessions that expired by now
+func (s *Service) ListExpiredSessions(ctx context.Context, now time.Time, limit int) ([]string, error) {
+	docs, err := s.dbClient.Collection(sessionsCollection).
+		Where("expires_at", "<=", now).
+		Limit(limit).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list expired sessions: %w", err)
+	}
+
+	ids := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		ids = append(ids, doc.Ref.ID)
+	}
+	return ids, nil
+}
@@ -0,0 +1,145 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// shadowResultsCollection holds the outcome of each request mirrored by an experiment's shadow traffic
+const shadowResultsCollection = "shadow_results"
+
+// ShadowResult compares a mirrored request with the request it mirrored. Costs are provider costs,
+// without markup, so the models compare on what they cost the platform.
+type ShadowResult struct {
+	ID           string    `firestore:"id" json:"id"`
+	ExperimentID string    `firestore:"experiment_id" json:"experiment_id"`
+	RequestID    string    `firestore:"request_id" json:"request_id"`
+	UserID       string    `firestore:"user_id" json:"user_id"`
+	Model        string    `firestore:"model" json:"model"`
+	ShadowModel  string    `firestore:"shadow_model" json:"shadow_model"`
+	CreatedAt    time.Time `firestore:"created_at" json:"created_at"`
+
+	InputTokens        int      `firestore:"input_tokens" json:"input_tokens"`
+	OutputTokens       int      `firestore:"output_tokens" json:"output_tokens"`
+	ShadowInputTokens  int      `firestore:"shadow_input_tokens" json:"shadow_input_tokens"`
+	ShadowOutputTokens int      `firestore:"shadow_output_tokens" json:"shadow_output_tokens"`
+	Cost               MicroUSD `firestore:"cost_micros" json:"cost"`
+	ShadowCost         MicroUSD `firestore:"shadow_cost_micros" json:"shadow_cost"`
+	DurationMs         int64    `firestore:"duration_ms" json:"duration_ms"`
+	ShadowDurationMs   int64    `firestore:"shadow_duration_ms" json:"shadow_duration_ms"`
+	// OutputMatches is set when the mirrored completion is identical to the original
+	OutputMatches bool `firestore:"output_matches" json:"output_matches"`
+	// Completion and ShadowCompletion are kept when the experiment stores results
+	Completion       string `firestore:"completion,omitempty" json:"completion,omitempty"`
+	ShadowCompletion string `firestore:"shadow_completion,omitempty" json:"shadow_completion,omitempty"`
+	// Error is set when the mirrored request failed
+	Error string `firestore:"error,omitempty" json:"error,omitempty"`
+}
+
+// ShadowSummary aggregates an experiment's shadow results
+type ShadowSummary struct {
+	Model              string   `json:"model"`
+	ShadowModel        string   `json:"shadow_model"`
+	Requests           int      `json:"requests"`
+	Errors             int      `json:"errors"`
+	OutputMatches      int      `json:"output_matches"`
+	InputTokens        int      `json:"input_tokens"`
+	OutputTokens       int      `json:"output_tokens"`
+	ShadowInputTokens  int      `json:"shadow_input_tokens"`
+	ShadowOutputTokens int      `json:"shadow_output_tokens"`
+	Cost               MicroUSD `json:"cost"`
+	ShadowCost         MicroUSD `json:"shadow_cost"`
+	AvgLatencyMs       float64  `json:"avg_latency_ms"`
+	ShadowAvgLatencyMs float64  `json:"shadow_avg_latency_ms"`
+}
+
+// RecordShadowResult stores a shadow result and adds its cost to the experiment's shadow spend
+func (s *Service) RecordShadowResult(ctx context.Context, result *ShadowResult) error {
+	ref := s.dbClient.Collection(shadowResultsCollection).NewDoc()
+	result.ID = ref.ID
+	if result.CreatedAt.IsZero() {
+		result.CreatedAt = time.Now()
+	}
+
+	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		if err := tx.Create(ref, result); err != nil {
+			return err
+		}
+		return tx.Update(s.dbClient.Collection(experimentsCollection).Doc(result.ExperimentID), []firestore.Update{
+			{Path: "shadow_spend_micros", Value: firestore.Increment(int64(result.ShadowCost))},
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record shadow result: %w", err)
+	}
+	return nil
+}
+
+// ListShadowResults lists up to limit of an experiment's shadow results in a date range, newest first
+func (s *Service) ListShadowResults(ctx context.Context, experimentID string, startDate, endDate time.Time, limit int) ([]*ShadowResult, error) {
+	query := s.dbClient.Collection(shadowResultsCollection).
+		Where("experiment_id", "==", experimentID).
+		Where("created_at", ">=", startDate).
+		Where("created_at", "<=", endDate).
+		OrderBy("created_at", firestore.Desc)
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+
+	var results []*ShadowResult
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list shadow results: %w", err)
+		}
+
+		var result ShadowResult
+		if err := doc.DataTo(&result); err != nil {
+			continue // Skip malformed results
+		}
+		results = append(results, &result)
+	}
+
+	return results, nil
+}
+
+// SummarizeShadowResults aggregates shadow results
+func SummarizeShadowResults(results []*ShadowResult) ShadowSummary {
+	var summary ShadowSummary
+	var latency, shadowLatency int64
+	for _, result := range results {
+		summary.Model, summary.ShadowModel = result.Model, result.ShadowModel
+		summary.Requests++
+		if result.Error != "" {
+			summary.Errors++
+			continue
+		}
+		if result.OutputMatches {
+			summary.OutputMatches++
+		}
+		summary.InputTokens += result.InputTokens
+		summary.OutputTokens += result.OutputTokens
+		summary.ShadowInputTokens += result.ShadowInputTokens
+		summary.ShadowOutputTokens += result.ShadowOutputTokens
+		summary.Cost += result.Cost
+		summary.ShadowCost += result.ShadowCost
+		latency += result.DurationMs
+		shadowLatency += result.ShadowDurationMs
+	}
+
+	if succeeded := summary.Requests - summary.Errors; succeeded > 0 {
+		summary.AvgLatencyMs = float64(latency) / float64(succeeded)
+		summary.ShadowAvgLatencyMs = float64(shadowLatency) / float64(succeeded)
+	}
+	return summary
+}
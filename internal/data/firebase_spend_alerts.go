@@ -0,0 +1,130 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// spendAlertPeriodLayout formats the calendar month (UTC) spend alerts are evaluated over
+const spendAlertPeriodLayout = "2006-01"
+
+// SpendAlertThreshold is a spend level that triggers an alert once per period.
+// Exactly one of Amount and Percent is set; Percent is relative to the monthly budget.
+type SpendAlertThreshold struct {
+	Amount  MicroUSD `firestore:"amount_micros,omitempty" json:"amount,omitempty"`
+	Percent float64  `firestore:"percent,omitempty" json:"percent,omitempty"`
+}
+
+// Key identifies the threshold in the list of alerts already fired this period
+func (t SpendAlertThreshold) Key() string {
+	if t.Percent > 0 {
+		return "percent:" + strconv.FormatFloat(t.Percent, 'f', -1, 64)
+	}
+	return "amount:" + strconv.FormatInt(int64(t.Amount), 10)
+}
+
+// Limit returns the spend at which the threshold fires, or 0 if it can't fire without a budget
+func (t SpendAlertThreshold) Limit(monthlyBudget MicroUSD) MicroUSD {
+	if t.Percent > 0 {
+		return MicroUSD(float64(monthlyBudget) * t.Percent / 100)
+	}
+	return t.Amount
+}
+
+// SpendAlertSettings configures a user's spend alerts and tracks which have fired this period
+type SpendAlertSettings struct {
+	Enabled    bool                  `firestore:"enabled" json:"enabled"`
+	Thresholds []SpendAlertThreshold `firestore:"thresholds,omitempty" json:"thresholds"`
+	// MonthlyBudget is the spend percentage thresholds are relative to; it is not enforced
+	MonthlyBudget MicroUSD `firestore:"monthly_budget_micros,omitempty" json:"monthly_budget,omitempty"`
+	// Email sends alerts to the user's email address
+	Email      bool   `firestore:"email" json:"email"`
+	WebhookURL string `firestore:"webhook_url,omitempty" json:"webhook_url,omitempty"`
+	// WebhookSecret signs webhook deliveries; it is only shown when generated
+	WebhookSecret string `firestore:"webhook_secret,omitempty" json:"-"`
+	// Period is the month PeriodSpend and Fired apply to
+	Period      string   `firestore:"period,omitempty" json:"period,omitempty"`
+	PeriodSpend MicroUSD `firestore:"period_spend_micros" json:"period_spend"`
+	Fired       []string `firestore:"fired,omitempty" json:"fired,omitempty"`
+}
+
+// SpendAlertPeriod returns the spend alert period containing t
+func SpendAlertPeriod(t time.Time) string {
+	return t.UTC().Format(spendAlertPeriodLayout)
+}
+
+// SpendAlertPeriodStart returns the start of the spend alert period containing t
+func SpendAlertPeriodStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// UpdateSpendAlertSettings replaces a user's spend alert settings
+func (s *Service) UpdateSpendAlertSettings(ctx context.Context, userID string, settings *SpendAlertSettings) error {
+	_, err := s.dbClient.Collection("users").Doc(userID).Update(ctx, []firestore.Update{
+		{Path: "spend_alerts", Value: settings},
+		{Path: "updated_at", Value: time.Now()},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update spend alert settings: %w", err)
+	}
+	return nil
+}
+
+// RecordSpend adds a charge to the user's spend for the current period and atomically claims every
+// threshold it crosses, so each fires once per period even when charges land on several replicas.
+// It returns the user and the newly crossed thresholds; users without alerts are left untouched.
+func (s *Service) RecordSpend(ctx context.Context, userID string, amount MicroUSD) (*User, []SpendAlertThreshold, error) {
+	userRef := s.dbClient.Collection("users").Doc(userID)
+
+	var user User
+	var crossed []SpendAlertThreshold
+	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		crossed = nil
+
+		doc, err := tx.Get(userRef)
+		if err != nil {
+			return fmt.Errorf("failed to get user: %w", err)
+		}
+		if err := doc.DataTo(&user); err != nil {
+			return fmt.Errorf("failed to parse user: %w", err)
+		}
+
+		alerts := &user.SpendAlerts
+		if !alerts.Enabled || len(alerts.Thresholds) == 0 {
+			return nil
+		}
+
+		if period := SpendAlertPeriod(time.Now()); alerts.Period != period {
+			alerts.Period = period
+			alerts.PeriodSpend = 0
+			alerts.Fired = nil
+		}
+		alerts.PeriodSpend += amount
+
+		for _, threshold := range alerts.Thresholds {
+			limit := threshold.Limit(alerts.MonthlyBudget)
+			if limit <= 0 || alerts.PeriodSpend < limit || slices.Contains(alerts.Fired, threshold.Key()) {
+				continue
+			}
+			alerts.Fired = append(alerts.Fired, threshold.Key())
+			crossed = append(crossed, threshold)
+		}
+
+		return tx.Update(userRef, []firestore.Update{
+			{Path: "spend_alerts.period", Value: alerts.Period},
+			{Path: "spend_alerts.period_spend_micros", Value: alerts.PeriodSpend},
+			{Path: "spend_alerts.fired", Value: alerts.Fired},
+		})
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to record spend: %w", err)
+	}
+
+	return &user, crossed, nil
+}
@@ -0,0 +1,144 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// systemPromptsCollection holds managed system prompts; each has a versions subcollection with its history
+const (
+	systemPromptsCollection        = "system_prompts"
+	systemPromptVersionsCollection = "versions"
+)
+
+// System prompt scopes. Organization prompts apply to every key billed to the organization,
+// and API key prompts to that key alone.
+const (
+	SystemPromptScopeOrg    = "org"
+	SystemPromptScopeAPIKey = "api_key"
+)
+
+// SystemPrompt is a managed system prompt prepended to every request made under an organization or API key
+type SystemPrompt struct {
+	Scope   string `firestore:"scope" json:"scope"`
+	OwnerID string `firestore:"owner_id" json:"owner_id"`
+	Content string `firestore:"content" json:"content"`
+	// Version starts at 1 and increases with every change
+	Version   int       `firestore:"version" json:"version"`
+	UpdatedBy string    `firestore:"updated_by,omitempty" json:"updated_by,omitempty"`
+	UpdatedAt time.Time `firestore:"updated_at" json:"updated_at"`
+}
+
+// SystemPromptRef identifies the version of a system prompt applied to a request
+type SystemPromptRef struct {
+	Scope   string `firestore:"scope" json:"scope"`
+	Version int    `firestore:"version" json:"version"`
+}
+
+// Ref returns the reference recorded on requests the prompt is applied to
+func (p *SystemPrompt) Ref() SystemPromptRef {
+	return SystemPromptRef{Scope: p.Scope, Version: p.Version}
+}
+
+// systemPromptRef returns the document for the system prompt of an organization or API key
+func (s *Service) systemPromptRef(scope, ownerID string) *firestore.DocumentRef {
+	return s.dbClient.Collection(systemPromptsCollection).Doc(scope + "_" + ownerID)
+}
+
+// GetSystemPrompt gets the current system prompt for an organization or API key, returning nil if none is set
+func (s *Service) GetSystemPrompt(ctx context.Context, scope, ownerID string) (*SystemPrompt, error) {
+	doc, err := s.systemPromptRef(scope, ownerID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get system prompt: %w", err)
+	}
+
+	var prompt SystemPrompt
+	if err := doc.DataTo(&prompt); err != nil {
+		return nil, fmt.Errorf("failed to parse system prompt: %w", err)
+	}
+
+	return &prompt, nil
+}
+
+// SetSystemPrompt stores a new version of a system prompt, keeping the previous versions as history.
+// The prompt's Version and UpdatedAt are set from the stored version.
+func (s *Service) SetSystemPrompt(ctx context.Context, prompt *SystemPrompt) error {
+	ref := s.systemPromptRef(prompt.Scope, prompt.OwnerID)
+
+	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		version := 1
+		doc, err := tx.Get(ref)
+		if err == nil {
+			var current SystemPrompt
+			if err := doc.DataTo(&current); err != nil {
+				return fmt.Errorf("failed to parse system prompt: %w", err)
+			}
+			version = current.Version + 1
+		} else if status.Code(err) != codes.NotFound {
+			return err
+		}
+
+		prompt.Version = version
+		prompt.UpdatedAt = time.Now()
+
+		if err := tx.Set(ref, prompt); err != nil {
+			return err
+		}
+		return tx.Set(ref.Collection(systemPromptVersionsCollection).Doc(strconv.Itoa(version)), prompt)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set system prompt: %w", err)
+	}
+
+	slog.Info("System prompt set", "scope", prompt.Scope, "owner_id", prompt.OwnerID, "version", prompt.Version, "updated_by", prompt.UpdatedBy)
+	return nil
+}
+
+// DeleteSystemPrompt removes the current system prompt; its version history is kept
+func (s *Service) DeleteSystemPrompt(ctx context.Context, scope, ownerID string) error {
+	if _, err := s.systemPromptRef(scope, ownerID).Delete(ctx); err != nil {
+		return fmt.Errorf("failed to delete system prompt: %w", err)
+	}
+
+	slog.Info("System prompt deleted", "scope", scope, "owner_id", ownerID)
+	return nil
+}
+
+// ListSystemPromptVersions lists every stored version of a system prompt, newest first
+func (s *Service) ListSystemPromptVersions(ctx context.Context, scope, ownerID string) ([]*SystemPrompt, error) {
+	iter := s.systemPromptRef(scope, ownerID).Collection(systemPromptVersionsCollection).
+		OrderBy("version", firestore.Desc).Documents(ctx)
+	defer iter.Stop()
+
+	var versions []*SystemPrompt
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list system prompt versions: %w", err)
+		}
+
+		var prompt SystemPrompt
+		if err := doc.DataTo(&prompt); err != nil {
+			slog.Warn("Failed to parse system prompt version", "doc_id", doc.Ref.ID, "error", err)
+			continue
+		}
+
+		versions = append(versions, &prompt)
+	}
+
+	return versions, nil
+}
@@ -0,0 +1,205 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// promptTemplatesCollection holds prompt templates; each has a versions subcollection with its history
+const (
+	promptTemplatesCollection        = "prompt_templates"
+	promptTemplateVersionsCollection = "versions"
+)
+
+// PromptTemplate is a named prompt with {{variable}} placeholders, owned by a user or shared with an organization
+type PromptTemplate struct {
+	ID          string `firestore:"id" json:"id"`
+	Name        string `firestore:"name" json:"name"`
+	Description string `firestore:"description,omitempty" json:"description,omitempty"`
+	Content     string `firestore:"content" json:"content"`
+	// Variables lists the placeholders in Content, each of which a request must supply
+	Variables []string `firestore:"variables" json:"variables"`
+	// Version starts at 1 and increases with every change to the content
+	Version   int       `firestore:"version" json:"version"`
+	OwnerID   string    `firestore:"owner_id" json:"owner_id"`
+	OrgID     string    `firestore:"org_id" json:"org_id,omitempty"`
+	UpdatedBy string    `firestore:"updated_by,omitempty" json:"updated_by,omitempty"`
+	CreatedAt time.Time `firestore:"created_at" json:"created_at"`
+	UpdatedAt time.Time `firestore:"updated_at" json:"updated_at"`
+}
+
+// promptTemplateVersionRef returns the history document for one version of a template
+func (s *Service) promptTemplateVersionRef(templateID string, version int) *firestore.DocumentRef {
+	return s.dbClient.Collection(promptTemplatesCollection).Doc(templateID).
+		Collection(promptTemplateVersionsCollection).Doc(strconv.Itoa(version))
+}
+
+// CreatePromptTemplate stores a new template as version 1
+func (s *Service) CreatePromptTemplate(ctx context.Context, template *PromptTemplate) error {
+	ref := s.dbClient.Collection(promptTemplatesCollection).NewDoc()
+	now := time.Now()
+	template.ID = ref.ID
+	template.Version = 1
+	template.CreatedAt = now
+	template.UpdatedAt = now
+
+	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		if err := tx.Create(ref, template); err != nil {
+			return err
+		}
+		return tx.Set(s.promptTemplateVersionRef(template.ID, template.Version), template)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create prompt template: %w", err)
+	}
+
+	slog.Info("Prompt template created", "template_id", template.ID, "owner_id", template.OwnerID, "org_id", template.OrgID)
+	return nil
+}
+
+// GetPromptTemplate gets the current version of a template, returning nil if it does not exist
+func (s *Service) GetPromptTemplate(ctx context.Context, templateID string) (*PromptTemplate, error) {
+	doc, err := s.dbClient.Collection(promptTemplatesCollection).Doc(templateID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get prompt template: %w", err)
+	}
+
+	var template PromptTemplate
+	if err := doc.DataTo(&template); err != nil {
+		return nil, fmt.Errorf("failed to parse prompt template: %w", err)
+	}
+
+	return &template, nil
+}
+
+// GetPromptTemplateVersion gets one version of a template, returning nil if it does not exist
+func (s *Service) GetPromptTemplateVersion(ctx context.Context, templateID string, version int) (*PromptTemplate, error) {
+	doc, err := s.promptTemplateVersionRef(templateID, version).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get prompt template version: %w", err)
+	}
+
+	var template PromptTemplate
+	if err := doc.DataTo(&template); err != nil {
+		return nil, fmt.Errorf("failed to parse prompt template version: %w", err)
+	}
+
+	return &template, nil
+}
+
+// UpdatePromptTemplate stores a new version of a template. The template's Version and UpdatedAt
+// are set from the stored version.
+func (s *Service) UpdatePromptTemplate(ctx context.Context, template *PromptTemplate) error {
+	ref := s.dbClient.Collection(promptTemplatesCollection).Doc(template.ID)
+
+	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+
+		var current PromptTemplate
+		if err := doc.DataTo(&current); err != nil {
+			return fmt.Errorf("failed to parse prompt template: %w", err)
+		}
+
+		template.Version = current.Version + 1
+		template.CreatedAt = current.CreatedAt
+		template.UpdatedAt = time.Now()
+
+		if err := tx.Set(ref, template); err != nil {
+			return err
+		}
+		return tx.Set(s.promptTemplateVersionRef(template.ID, template.Version), template)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update prompt template: %w", err)
+	}
+
+	slog.Info("Prompt template updated", "template_id", template.ID, "version", template.Version, "updated_by", template.UpdatedBy)
+	return nil
+}
+
+// DeletePromptTemplate removes a template; its version history is kept
+func (s *Service) DeletePromptTemplate(ctx context.Context, templateID string) error {
+	if _, err := s.dbClient.Collection(promptTemplatesCollection).Doc(templateID).Delete(ctx); err != nil {
+		return fmt.Errorf("failed to delete prompt template: %w", err)
+	}
+
+	slog.Info("Prompt template deleted", "template_id", templateID)
+	return nil
+}
+
+// ListPromptTemplates lists an organization's templates, or a user's own templates when orgID is empty
+func (s *Service) ListPromptTemplates(ctx context.Context, ownerID, orgID string) ([]*PromptTemplate, error) {
+	query := s.dbClient.Collection(promptTemplatesCollection).Where("org_id", "==", orgID)
+	if orgID == "" {
+		query = query.Where("owner_id", "==", ownerID)
+	}
+
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+
+	var templates []*PromptTemplate
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list prompt templates: %w", err)
+		}
+
+		var template PromptTemplate
+		if err := doc.DataTo(&template); err != nil {
+			slog.Warn("Failed to parse prompt template", "doc_id", doc.Ref.ID, "error", err)
+			continue
+		}
+
+		templates = append(templates, &template)
+	}
+
+	return templates, nil
+}
+
+// ListPromptTemplateVersions lists every stored version of a template, newest first
+func (s *Service) ListPromptTemplateVersions(ctx context.Context, templateID string) ([]*PromptTemplate, error) {
+	iter := s.dbClient.Collection(promptTemplatesCollection).Doc(templateID).
+		Collection(promptTemplateVersionsCollection).OrderBy("version", firestore.Desc).Documents(ctx)
+	defer iter.Stop()
+
+	var versions []*PromptTemplate
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list prompt template versions: %w", err)
+		}
+
+		var template PromptTemplate
+		if err := doc.DataTo(&template); err != nil {
+			slog.Warn("Failed to parse prompt template version", "doc_id", doc.Ref.ID, "error", err)
+			continue
+		}
+
+		versions = append(versions, &template)
+	}
+
+	return versions, nil
+}
@@ -0,0 +1,164 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// tenantsCollection holds the tenants served by a shared deployment
+const tenantsCollection = "tenants"
+
+var (
+	// ErrTenantExists is returned when creating a tenant whose ID is already taken
+	ErrTenantExists = errors.New("tenant already exists")
+	// ErrAPIKeyNotFound is returned when binding an API key that does not exist
+	ErrAPIKeyNotFound = errors.New("API key not found")
+)
+
+// Tenant is an isolated customer of a shared deployment. API keys are bound to a tenant with
+// their tenant_id, and every request made with them uses the tenant's catalog and pricing.
+type Tenant struct {
+	// ID is chosen by the operator and sent by clients in the X-Tenant-ID header
+	ID       string `firestore:"id" json:"id"`
+	Name     string `firestore:"name" json:"name"`
+	IsActive bool   `firestore:"is_active" json:"is_active"`
+	// AllowedModels is the tenant's model catalog; empty allows every active model
+	AllowedModels []string `firestore:"allowed_models,omitempty" json:"allowed_models,omitempty"`
+	// TierID prices every request in the tenant, overriding user and organization tiers; empty keeps them
+	TierID    string    `firestore:"tier_id,omitempty" json:"tier_id,omitempty"`
+	CreatedAt time.Time `firestore:"created_at" json:"created_at"`
+	UpdatedAt time.Time `firestore:"updated_at" json:"updated_at"`
+}
+
+// GetID returns the tenant's ID, or "" for a nil tenant, so requests outside any tenant need no check
+func (t *Tenant) GetID() string {
+	if t == nil {
+		return ""
+	}
+	return t.ID
+}
+
+// CheckModel returns an error if the model is not in the tenant's catalog
+func (t *Tenant) CheckModel(modelID string) error {
+	if t == nil || len(t.AllowedModels) == 0 || slices.Contains(t.AllowedModels, modelID) {
+		return nil
+	}
+	return fmt.Errorf("model %s is not available for tenant %s", modelID, t.ID)
+}
+
+// CreateTenant stores a new tenant under its ID
+func (s *Service) CreateTenant(ctx context.Context, tenant *Tenant) error {
+	now := time.Now()
+	tenant.CreatedAt = now
+	tenant.UpdatedAt = now
+
+	_, err := s.dbClient.Collection(tenantsCollection).Doc(tenant.ID).Create(ctx, tenant)
+	if status.Code(err) == codes.AlreadyExists {
+		return ErrTenantExists
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create tenant: %w", err)
+	}
+
+	slog.Info("Tenant created", "tenant_id", tenant.ID)
+	return nil
+}
+
+// GetTenant gets a tenant, returning nil if it does not exist
+func (s *Service) GetTenant(ctx context.Context, tenantID string) (*Tenant, error) {
+	doc, err := s.dbClient.Collection(tenantsCollection).Doc(tenantID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tenant: %w", err)
+	}
+
+	var tenant Tenant
+	if err := doc.DataTo(&tenant); err != nil {
+		return nil, fmt.Errorf("failed to parse tenant: %w", err)
+	}
+
+	return &tenant, nil
+}
+
+// UpdateTenant replaces a tenant
+func (s *Service) UpdateTenant(ctx context.Context, tenant *Tenant) error {
+	tenant.UpdatedAt = time.Now()
+
+	if _, err := s.dbClient.Collection(tenantsCollection).Doc(tenant.ID).Set(ctx, tenant); err != nil {
+		return fmt.Errorf("failed to update tenant: %w", err)
+	}
+
+	slog.Info("Tenant updated", "tenant_id", tenant.ID, "is_active", tenant.IsActive)
+	return nil
+}
+
+// ListTenants lists every tenant, ordered by ID
+func (s *Service) ListTenants(ctx context.Context) ([]*Tenant, error) {
+	iter := s.dbClient.Collection(tenantsCollection).Documents(ctx)
+	defer iter.Stop()
+
+	var tenants []*Tenant
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tenants: %w", err)
+		}
+
+		var tenant Tenant
+		if err := doc.DataTo(&tenant); err != nil {
+			slog.Warn("Failed to parse tenant", "doc_id", doc.Ref.ID, "error", err)
+			continue
+		}
+
+		tenants = append(tenants, &tenant)
+	}
+
+	sort.Slice(tenants, func(i, j int) bool {
+		return tenants[i].ID < tenants[j].ID
+	})
+
+	return tenants, nil
+}
+
+// SetAPIKeyTenant binds an API key to a tenant, or unbinds it when tenantID is empty
+func (s *Service) SetAPIKeyTenant(ctx context.Context, keyID, tenantID string) error {
+	_, err := s.dbClient.Collection("api_keys").Doc(keyID).Update(ctx, []firestore.Update{
+		{Path: "tenant_id", Value: tenantID},
+	})
+	if status.Code(err) == codes.NotFound {
+		return ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set API key tenant: %w", err)
+	}
+
+	slog.Info("API key tenant updated", "api_key_id", keyID, "tenant_id", tenantID)
+	return nil
+}
+
+// GetTenantUsage gets a tenant's usage statistics
+func (s *Service) GetTenantUsage(ctx context.Context, tenantID string, startDate, endDate time.Time) (map[string]interface{}, error) {
+	iter := s.dbClient.Collection("request_logs").
+		Where("tenant_id", "==", tenantID).
+		Where("request_timestamp", ">=", startDate).
+		Where("request_timestamp", "<=", endDate).
+		Documents(ctx)
+	defer iter.Stop()
+
+	return summarizeUsage(iter, startDate, endDate), nil
+}
@@ -0,0 +1,396 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// usageRollupsCollection holds per-user, per-model usage counters maintained as requests are logged
+const usageRollupsCollection = "usage_rollups"
+
+// Rollup granularities
+const (
+	RollupHourly = "hour"
+	RollupDaily  = "day"
+)
+
+// UsageRollup totals one user's usage of one model over an hour or a day (UTC)
+type UsageRollup struct {
+	ID           string    `firestore:"id" json:"-"`
+	UserID       string    `firestore:"user_id" json:"-"`
+	UserType     string    `firestore:"user_type,omitempty" json:"-"`
+	ModelID      string    `firestore:"model_id" json:"model_id"`
+	Granularity  string    `firestore:"granularity" json:"granularity"`
+	BucketStart  time.Time `firestore:"bucket_start" json:"bucket_start"`
+	Requests     int       `firestore:"requests" json:"requests"`
+	InputTokens  int       `firestore:"input_tokens" json:"input_tokens"`
+	OutputTokens int       `firestore:"output_tokens" json:"output_tokens"`
+	TotalTokens  int       `firestore:"total_tokens" json:"total_tokens"`
+	TotalCost    MicroUSD  `firestore:"total_cost_micros" json:"total_cost"`
+	TokensSaved  int       `firestore:"tokens_saved" json:"tokens_saved"`
+	Savings      MicroUSD  `firestore:"savings_amount_micros" json:"savings"`
+	MarkupAmount MicroUSD  `firestore:"markup_amount_micros" json:"markup_amount"`
+	// FailedRequests are the requests among Requests that failed at the provider
+	FailedRequests int `firestore:"failed_requests" json:"failed_requests"`
+	// OptimizedRequests are the requests whose prompts were optimized, GrossSavings the price of the
+	// tokens saved and OptimizerCost what the optimizer and summarization calls cost
+	OptimizedRequests int      `firestore:"optimized_requests" json:"optimized_requests"`
+	GrossSavings      MicroUSD `firestore:"gross_savings_micros" json:"gross_savings"`
+	OptimizerCost     MicroUSD `firestore:"optimizer_cost_micros" json:"optimizer_cost"`
+}
+
+// grossSavings returns the price of the tokens the log's optimization saved. Logs written before it
+// was recorded had no summarization, so their optimizer cost was the prompt optimizer's alone.
+func (l *RequestLog) grossSavings() MicroUSD {
+	if l.GrossSavings == 0 && l.TokensSaved > 0 {
+		return l.SavingsAmount + l.OptimizerCost
+	}
+	return l.GrossSavings
+}
+
+// add folds a request log into the rollup
+func (r *UsageRollup) add(log *RequestLog) {
+	r.Requests++
+	r.InputTokens += log.InputTokens
+	r.OutputTokens += log.OutputTokens
+	r.TotalTokens += log.TotalTokens
+	r.TotalCost += log.TotalCost
+	r.TokensSaved += log.TokensSaved
+	r.Savings += log.SavingsAmount
+	r.MarkupAmount += log.MarkupAmount
+	if log.Status == RequestStatusError {
+		r.FailedRequests++
+	}
+	if log.WasOptimized {
+		r.OptimizedRequests++
+	}
+	r.GrossSavings += log.grossSavings()
+	r.OptimizerCost += log.OptimizerCost
+}
+
+// merge folds another rollup into this one
+func (r *UsageRollup) merge(other *UsageRollup) {
+	r.Requests += other.Requests
+	r.InputTokens += other.InputTokens
+	r.OutputTokens += other.OutputTokens
+	r.TotalTokens += other.TotalTokens
+	r.TotalCost += other.TotalCost
+	r.TokensSaved += other.TokensSaved
+	r.Savings += other.Savings
+	r.MarkupAmount += other.MarkupAmount
+	r.FailedRequests += other.FailedRequests
+	r.OptimizedRequests += other.OptimizedRequests
+	r.GrossSavings += other.GrossSavings
+	r.OptimizerCost += other.OptimizerCost
+}
+
+// RollupBucket returns the start of the UTC hour or day containing t
+func RollupBucket(granularity string, t time.Time) time.Time {
+	t = t.UTC()
+	if granularity == RollupDaily {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return t.Truncate(time.Hour)
+}
+
+// rollupDocID returns the document ID of a user's rollup for a model and bucket.
+// Model IDs may contain slashes, which are not allowed in document IDs.
+func rollupDocID(userID, modelID, granularity string, bucket time.Time) string {
+	return fmt.Sprintf("%s_%s_%s_%s", userID, granularity, bucket.Format("2006010215"), strings.ReplaceAll(modelID, "/", "_"))
+}
+
+// incrementUsageRollups adds a logged request to the user's hourly and daily rollups
+func (s *Service) incrementUsageRollups(ctx context.Context, log *RequestLog) error {
+	failed, optimized := 0, 0
+	if log.Status == RequestStatusError {
+		failed = 1
+	}
+	if log.WasOptimized {
+		optimized = 1
+	}
+	for _, granularity := range []string{RollupHourly, RollupDaily} {
+		bucket := RollupBucket(granularity, log.RequestTimestamp)
+		id := rollupDocID(log.UserID, log.ModelID, granularity, bucket)
+		fields := map[string]interface{}{
+			"id":                    id,
+			"user_id":               log.UserID,
+			"model_id":              log.ModelID,
+			"granularity":           granularity,
+			"bucket_start":          bucket,
+			"requests":              firestore.Increment(1),
+			"input_tokens":          firestore.Increment(log.InputTokens),
+			"output_tokens":         firestore.Increment(log.OutputTokens),
+			"total_tokens":          firestore.Increment(log.TotalTokens),
+			"total_cost_micros":     firestore.Increment(int64(log.TotalCost)),
+			"tokens_saved":          firestore.Increment(log.TokensSaved),
+			"savings_amount_micros": firestore.Increment(int64(log.SavingsAmount)),
+			"markup_amount_micros":  firestore.Increment(int64(log.MarkupAmount)),
+			"failed_requests":       firestore.Increment(failed),
+			"optimized_requests":    firestore.Increment(optimized),
+			"gross_savings_micros":  firestore.Increment(int64(log.grossSavings())),
+			"optimizer_cost_micros": firestore.Increment(int64(log.OptimizerCost)),
+		}
+		if log.UserType != "" {
+			fields["user_type"] = log.UserType
+		}
+		_, err := s.dbClient.Collection(usageRollupsCollection).Doc(id).Set(ctx, fields, firestore.MergeAll)
+		if err != nil {
+			return fmt.Errorf("failed to increment %s usage rollup: %w", granularity, err)
+		}
+	}
+	return nil
+}
+
+// ListUsageRollups lists a user's rollups of one granularity whose buckets overlap the date range, oldest first
+func (s *Service) ListUsageRollups(ctx context.Context, userID, granularity string, startDate, endDate time.Time) ([]*UsageRollup, error) {
+	iter := s.dbClient.Collection(usageRollupsCollection).
+		Where("user_id", "==", userID).
+		Where("granularity", "==", granularity).
+		Where("bucket_start", ">=", RollupBucket(granularity, startDate)).
+		Where("bucket_start", "<=", endDate).
+		OrderBy("bucket_start", firestore.Asc).
+		Documents(ctx)
+	defer iter.Stop()
+
+	var rollups []*UsageRollup
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list usage rollups: %w", err)
+		}
+
+		var rollup UsageRollup
+		if err := doc.DataTo(&rollup); err != nil {
+			slog.Warn("Failed to parse usage rollup", "doc_id", doc.Ref.ID, "error", err)
+			continue
+		}
+
+		rollups = append(rollups, &rollup)
+	}
+
+	return rollups, nil
+}
+
+// UsageSummary is a user's usage over a date range, with totals per model and per bucket
+type UsageSummary struct {
+	TotalCost        MicroUSD       `json:"total_cost"`
+	TotalTokens      int            `json:"total_tokens"`
+	TotalRequests    int            `json:"total_requests"`
+	FailedRequests   int            `json:"failed_requests"`
+	TotalTokensSaved int            `json:"total_tokens_saved"`
+	TotalSavings     MicroUSD       `json:"total_savings"`
+	StartDate        time.Time      `json:"start_date"`
+	EndDate          time.Time      `json:"end_date"`
+	Granularity      string         `json:"granularity"`
+	ByModel          []*UsageRollup `json:"by_model"`
+	Buckets          []*UsageRollup `json:"buckets"`
+}
+
+// GetUserUsage gets a user's usage statistics from their rollups, with totals per model and per bucket.
+// Buckets are whole UTC hours or days, so the range is widened to the buckets it touches.
+func (s *Service) GetUserUsage(ctx context.Context, userID, granularity string, startDate, endDate time.Time) (*UsageSummary, error) {
+	rollups, err := s.ListUsageRollups(ctx, userID, granularity, startDate, endDate)
+	if err != nil {
+		return nil, err
+	}
+
+	var total UsageRollup
+	byModel := make(map[string]*UsageRollup)
+	var buckets []*UsageRollup
+	for _, rollup := range rollups {
+		total.merge(rollup)
+
+		model, ok := byModel[rollup.ModelID]
+		if !ok {
+			model = &UsageRollup{ModelID: rollup.ModelID, Granularity: granularity}
+			byModel[rollup.ModelID] = model
+		}
+		model.merge(rollup)
+
+		// Rollups are ordered by bucket, so each bucket's models are adjacent
+		if len(buckets) == 0 || !buckets[len(buckets)-1].BucketStart.Equal(rollup.BucketStart) {
+			buckets = append(buckets, &UsageRollup{Granularity: granularity, BucketStart: rollup.BucketStart})
+		}
+		buckets[len(buckets)-1].merge(rollup)
+	}
+
+	models := make([]*UsageRollup, 0, len(byModel))
+	for _, model := range byModel {
+		models = append(models, model)
+	}
+	sort.Slice(models, func(i, j int) bool {
+		return models[i].TotalCost > models[j].TotalCost
+	})
+	if buckets == nil {
+		buckets = []*UsageRollup{}
+	}
+
+	return &UsageSummary{
+		TotalCost:        total.TotalCost,
+		TotalTokens:      total.TotalTokens,
+		TotalRequests:    total.Requests,
+		FailedRequests:   total.FailedRequests,
+		TotalTokensSaved: total.TokensSaved,
+		TotalSavings:     total.Savings,
+		StartDate:        startDate,
+		EndDate:          endDate,
+		Granularity:      granularity,
+		ByModel:          models,
+		Buckets:          buckets,
+	}, nil
+}
+
+// ListRecentRequestLogs lists up to limit request logs after since, newest first, for one user or,
+// when userID is empty, for everyone
+func (s *Service) ListRecentRequestLogs(ctx context.Context, userID string, since time.Time, limit int) ([]*RequestLog, error) {
+	query := s.dbClient.Collection("request_logs").Where("request_timestamp", ">", since)
+	if userID != "" {
+		query = query.Where("user_id", "==", userID)
+	}
+
+	iter := query.OrderBy("request_timestamp", firestore.Desc).Limit(limit).Documents(ctx)
+	defer iter.Stop()
+
+	var logs []*RequestLog
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list request logs: %w", err)
+		}
+
+		var log RequestLog
+		if err := doc.DataTo(&log); err != nil {
+			continue // Skip malformed logs
+		}
+		logs = append(logs, &log)
+	}
+
+	return logs, nil
+}
+
+// ListUserRequestLogs lists a user's raw request logs in a date range, newest first, optionally for one model
+func (s *Service) ListUserRequestLogs(ctx context.Context, userID, modelID string, startDate, endDate time.Time, limit int, startAfter string) ([]*RequestLog, error) {
+	query := s.dbClient.Collection("request_logs").
+		Where("user_id", "==", userID).
+		Where("request_timestamp", ">=", startDate).
+		Where("request_timestamp", "<=", endDate)
+	if modelID != "" {
+		query = query.Where("model_id", "==", modelID)
+	}
+	query = query.OrderBy("request_timestamp", firestore.Desc).Limit(limit)
+
+	if startAfter != "" {
+		cursor, err := s.dbClient.Collection("request_logs").Doc(startAfter).Get(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("invalid request log cursor: %w", err)
+		}
+		query = query.StartAfter(cursor)
+	}
+
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+
+	var logs []*RequestLog
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list request logs: %w", err)
+		}
+
+		var log RequestLog
+		if err := doc.DataTo(&log); err != nil {
+			continue // Skip malformed logs
+		}
+
+		logs = append(logs, &log)
+	}
+
+	return logs, nil
+}
+
+// RebuildUsageRollups recomputes every rollup, and the daily provider costs, for the whole UTC days
+// touched by the date range from the raw request logs, replacing the stored ones. It backfills requests logged before rollups
+// existed. Increments made while it runs can be overwritten, so rebuild days that have ended.
+func (s *Service) RebuildUsageRollups(ctx context.Context, startDate, endDate time.Time) (int, error) {
+	startDate = RollupBucket(RollupDaily, startDate)
+	endDate = RollupBucket(RollupDaily, endDate).AddDate(0, 0, 1)
+
+	iter := s.dbClient.Collection("request_logs").
+		Where("request_timestamp", ">=", startDate).
+		Where("request_timestamp", "<", endDate).
+		Documents(ctx)
+	defer iter.Stop()
+
+	rollups := make(map[string]*UsageRollup)
+	costs := make(map[string]*ProviderCost)
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read request logs: %w", err)
+		}
+
+		var log RequestLog
+		if err := doc.DataTo(&log); err != nil {
+			continue // Skip malformed logs
+		}
+
+		for _, granularity := range []string{RollupHourly, RollupDaily} {
+			bucket := RollupBucket(granularity, log.RequestTimestamp)
+			id := rollupDocID(log.UserID, log.ModelID, granularity, bucket)
+			rollup, ok := rollups[id]
+			if !ok {
+				rollup = &UsageRollup{ID: id, UserID: log.UserID, UserType: log.UserType, ModelID: log.ModelID, Granularity: granularity, BucketStart: bucket}
+				rollups[id] = rollup
+			}
+			rollup.add(&log)
+		}
+
+		if !log.BYOK && !log.TestMode && log.Provider != "" {
+			day := RollupBucket(RollupDaily, log.RequestTimestamp)
+			id := costDocID(log.Provider, log.ModelID, day)
+			cost, ok := costs[id]
+			if !ok {
+				cost = &ProviderCost{Provider: log.Provider, ModelID: log.ModelID, Day: day}
+				costs[id] = cost
+			}
+			cost.add(&log)
+		}
+	}
+
+	writer := s.dbClient.BulkWriter(ctx)
+	defer writer.End()
+
+	for id, rollup := range rollups {
+		if _, err := writer.Set(s.dbClient.Collection(usageRollupsCollection).Doc(id), rollup); err != nil {
+			return 0, fmt.Errorf("failed to write usage rollup %s: %w", id, err)
+		}
+	}
+	for id, cost := range costs {
+		if _, err := writer.Set(s.dbClient.Collection(providerCostsCollection).Doc(id), cost); err != nil {
+			return 0, fmt.Errorf("failed to write provider cost %s: %w", id, err)
+		}
+	}
+	writer.Flush()
+
+	slog.Info("Usage rollups rebuilt", "start_date", startDate, "end_date", endDate, "rollups", len(rollups), "provider_costs", len(costs))
+	return len(rollups), nil
+}
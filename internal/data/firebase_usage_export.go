@@ -0,0 +1,308 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// Usage export sinks
+const (
+	// UsageExportSinkHTTP posts signed JSON batches to the user's endpoint
+	UsageExportSinkHTTP = "http"
+	// UsageExportSinkOpenMeter ingests CloudEvents into an OpenMeter instance
+	UsageExportSinkOpenMeter = "openmeter"
+	// UsageExportSinkStripe reports Stripe billing meter events
+	UsageExportSinkStripe = "stripe"
+)
+
+// UsageExportSettings configures where a user's per-request usage is exported and tracks how far
+// export has got. Requests are exported in response_timestamp order after ExportedThrough.
+type UsageExportSettings struct {
+	Enabled bool   `firestore:"enabled" json:"enabled"`
+	Sink    string `firestore:"sink,omitempty" json:"sink,omitempty"`
+	// URL is the http sink's endpoint or the OpenMeter instance's base URL
+	URL string `firestore:"url,omitempty" json:"url,omitempty"`
+	// WebhookSecret signs http sink deliveries; it is only shown when generated
+	WebhookSecret string `firestore:"webhook_secret,omitempty" json:"-"`
+	// Token is the OpenMeter or Stripe API key, encrypted; TokenHint identifies it
+	Token     *SealedSecret `firestore:"token,omitempty" json:"-"`
+	TokenHint string        `firestore:"token_hint,omitempty" json:"token_hint,omitempty"`
+	// StripeEventName is the Stripe billing meter's event name
+	StripeEventName string `firestore:"stripe_event_name,omitempty" json:"stripe_event_name,omitempty"`
+	// StripeCustomers maps event subjects to Stripe customer IDs; events for other subjects are skipped
+	StripeCustomers map[string]string `firestore:"stripe_customers,omitempty" json:"stripe_customers,omitempty"`
+	// ExportedThrough and ExportedThroughID are the response timestamp and ID of the last exported request
+	ExportedThrough   time.Time `firestore:"exported_through" json:"exported_through"`
+	ExportedThroughID string    `firestore:"exported_through_id,omitempty" json:"-"`
+	// LeaseUntil stops other replicas exporting the user's usage while one is
+	LeaseUntil  time.Time `firestore:"lease_until,omitempty" json:"-"`
+	Failures    int       `firestore:"failures,omitempty" json:"failures,omitempty"`
+	LastError   string    `firestore:"last_error,omitempty" json:"last_error,omitempty"`
+	LastErrorAt time.Time `firestore:"last_error_at,omitempty" json:"last_error_at,omitempty"`
+}
+
+// Redacted returns the settings without the webhook secret and token, for audit records
+func (s UsageExportSettings) Redacted() UsageExportSettings {
+	s.WebhookSecret = ""
+	s.Token = nil
+	return s
+}
+
+// UsageEvent is one request's usage as exported to a metering system
+type UsageEvent struct {
+	// ID is the request log ID; sinks deduplicate on it, since delivery is at least once
+	ID       string `json:"id"`
+	UserID   string `json:"user_id"`
+	OrgID    string `json:"org_id,omitempty"`
+	TenantID string `json:"tenant_id,omitempty"`
+	APIKeyID string `json:"api_key_id"`
+	// Subject is who the customer bills: the tenant, or the API key outside tenants
+	Subject      string    `json:"subject"`
+	RequestID    string    `json:"request_id"`
+	Model        string    `json:"model"`
+	Provider     string    `json:"provider"`
+	InputTokens  int       `json:"input_tokens"`
+	OutputTokens int       `json:"output_tokens"`
+	TotalTokens  int       `json:"total_tokens"`
+	Cost         MicroUSD  `json:"cost"`
+	Streaming    bool      `json:"streaming"`
+	Status       string    `json:"status"`
+	Timestamp    time.Time `json:"timestamp"`
+	// UsageEstimated marks token counts estimated because the provider reported no usage
+	UsageEstimated bool `json:"usage_estimated,omitempty"`
+	// CachedInputTokens are the input tokens served from the provider's prompt cache
+	CachedInputTokens int `json:"cached_input_tokens,omitempty"`
+	// ReasoningTokens are the output tokens spent thinking
+	ReasoningTokens int `json:"reasoning_tokens,omitempty"`
+}
+
+// NewUsageEvent converts a request log into a usage event
+func NewUsageEvent(log *RequestLog) UsageEvent {
+	subject := log.TenantID
+	if subject == "" {
+		subject = log.APIKeyID
+	}
+	return UsageEvent{
+		ID:           log.ID,
+		UserID:       log.UserID,
+		OrgID:        log.OrgID,
+		TenantID:     log.TenantID,
+		APIKeyID:     log.APIKeyID,
+		Subject:      subject,
+		RequestID:    log.RequestID,
+		Model:        log.ModelID,
+		Provider:     log.Provider,
+		InputTokens:  log.InputTokens,
+		OutputTokens: log.OutputTokens,
+		TotalTokens:  log.TotalTokens,
+		Cost:         log.TotalCost,
+		Streaming:    log.Streaming,
+		Status:       log.Status,
+		Timestamp:    log.ResponseTimestamp,
+
+		UsageEstimated: log.UsageEstimated,
+
+		CachedInputTokens: log.CachedInputTokens,
+		ReasoningTokens:   log.ReasoningTokens,
+	}
+}
+
+// UpdateUsageExportSettings replaces a user's usage export settings
+func (s *Service) UpdateUsageExportSettings(ctx context.Context, userID string, settings *UsageExportSettings) error {
+	_, err := s.dbClient.Collection("users").Doc(userID).Update(ctx, []firestore.Update{
+		{Path: "usage_export", Value: settings},
+		{Path: "updated_at", Value: time.Now()},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update usage export settings: %w", err)
+	}
+	return nil
+}
+
+// ListUsageExportUserIDs lists the users with usage export enabled
+func (s *Service) ListUsageExportUserIDs(ctx context.Context) ([]string, error) {
+	iter := s.dbClient.Collection("users").Where("usage_export.enabled", "==", true).Select().Documents(ctx)
+	defer iter.Stop()
+
+	var userIDs []string
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list usage export users: %w", err)
+		}
+		userIDs = append(userIDs, doc.Ref.ID)
+	}
+	return userIDs, nil
+}
+
+// ListUsageExportTokenUserIDs lists the users with a stored usage export token, for rewrapping
+// them after the vault key is rotated
+func (s *Service) ListUsageExportTokenUserIDs(ctx context.Context) ([]string, error) {
+	iter := s.dbClient.Collection("users").Where("usage_export.token.key_id", ">", "").Select().Documents(ctx)
+	defer iter.Stop()
+
+	var userIDs []string
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list usage export tokens: %w", err)
+		}
+		userIDs = append(userIDs, doc.Ref.ID)
+	}
+	return userIDs, nil
+}
+
+// RewrapUsageExportToken replaces a user's usage export token with what rewrap returns for it, in
+// a transaction so a token the user replaces meanwhile is not overwritten. A nil result or no
+// stored token leaves nothing to do.
+func (s *Service) RewrapUsageExportToken(ctx context.Context, userID string, rewrap func(secret *SealedSecret) (*SealedSecret, error)) error {
+	userRef := s.dbClient.Collection("users").Doc(userID)
+
+	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(userRef)
+		if err != nil {
+			return fmt.Errorf("failed to get user: %w", err)
+		}
+
+		var user User
+		if err := doc.DataTo(&user); err != nil {
+			return fmt.Errorf("failed to parse user: %w", err)
+		}
+		if user.UsageExport.Token == nil {
+			return nil
+		}
+		secret, err := rewrap(user.UsageExport.Token)
+		if err != nil || secret == nil {
+			return err
+		}
+		return tx.Update(userRef, []firestore.Update{{Path: "usage_export.token", Value: secret}})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to rewrap usage export token: %w", err)
+	}
+	return nil
+}
+
+// ClaimUsageExport leases a user's usage export so only one replica exports it at a time. It
+// returns the user when the lease was claimed.
+func (s *Service) ClaimUsageExport(ctx context.Context, userID string, lease time.Duration) (*User, bool, error) {
+	userRef := s.dbClient.Collection("users").Doc(userID)
+
+	var claimed *User
+	err := s.dbClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		claimed = nil
+
+		doc, err := tx.Get(userRef)
+		if err != nil {
+			return fmt.Errorf("failed to get user: %w", err)
+		}
+
+		var user User
+		if err := doc.DataTo(&user); err != nil {
+			return fmt.Errorf("failed to parse user: %w", err)
+		}
+		if !user.UsageExport.Enabled || time.Now().Before(user.UsageExport.LeaseUntil) {
+			return nil
+		}
+
+		leaseUntil := time.Now().Add(lease)
+		if err := tx.Update(userRef, []firestore.Update{{Path: "usage_export.lease_until", Value: leaseUntil}}); err != nil {
+			return err
+		}
+
+		user.UsageExport.LeaseUntil = leaseUntil
+		claimed = &user
+		return nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to claim usage export: %w", err)
+	}
+
+	return claimed, claimed != nil, nil
+}
+
+// ListRequestLogsForExport lists up to limit of a user's request logs after the export cursor
+// and with a response timestamp before until, oldest first
+func (s *Service) ListRequestLogsForExport(ctx context.Context, userID string, after time.Time, afterID string, until time.Time, limit int) ([]*RequestLog, error) {
+	query := s.dbClient.Collection("request_logs").
+		Where("user_id", "==", userID).
+		Where("response_timestamp", ">=", after).
+		Where("response_timestamp", "<", until).
+		OrderBy("response_timestamp", firestore.Asc).
+		OrderBy(firestore.DocumentID, firestore.Asc).
+		Limit(limit)
+	if afterID != "" {
+		query = query.StartAfter(after, afterID)
+	}
+
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+
+	var logs []*RequestLog
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list request logs for export: %w", err)
+		}
+
+		var log RequestLog
+		if err := doc.DataTo(&log); err != nil {
+			continue // Skip malformed logs
+		}
+		log.ID = doc.Ref.ID
+		logs = append(logs, &log)
+	}
+
+	return logs, nil
+}
+
+// AdvanceUsageExport moves a user's export cursor past a delivered batch and clears any failure
+func (s *Service) AdvanceUsageExport(ctx context.Context, userID string, through time.Time, throughID string) error {
+	_, err := s.dbClient.Collection("users").Doc(userID).Update(ctx, []firestore.Update{
+		{Path: "usage_export.exported_through", Value: through},
+		{Path: "usage_export.exported_through_id", Value: throughID},
+		{Path: "usage_export.failures", Value: 0},
+		{Path: "usage_export.last_error", Value: firestore.Delete},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to advance usage export: %w", err)
+	}
+	return nil
+}
+
+// RecordUsageExportFailure records a failed delivery; the batch is retried from the same cursor
+func (s *Service) RecordUsageExportFailure(ctx context.Context, userID string, exportErr error) error {
+	_, err := s.dbClient.Collection("users").Doc(userID).Update(ctx, []firestore.Update{
+		{Path: "usage_export.failures", Value: firestore.Increment(1)},
+		{Path: "usage_export.last_error", Value: exportErr.Error()},
+		{Path: "usage_export.last_error_at", Value: time.Now()},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record usage export failure: %w", err)
+	}
+	return nil
+}
+
+// ReleaseUsageExport ends a user's usage export lease early
+func (s *Service) ReleaseUsageExport(ctx context.Context, userID string) error {
+	_, err := s.dbClient.Collection("users").Doc(userID).Update(ctx, []firestore.Update{
+		{Path: "usage_export.lease_until", Value: time.Time{}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to release usage export: %w", err)
+	}
+	return nil
+}
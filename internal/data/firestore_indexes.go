@@ -0,0 +1,207 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	admin "cloud.google.com/go/firestore/apiv1/admin"
+	"cloud.google.com/go/firestore/apiv1/admin/adminpb"
+	"google.golang.org/api/iterator"
+)
+
+// IndexField is a field of a composite index and its order
+type IndexField struct {
+	FieldPath string `json:"fieldPath"`
+	// Order is ASCENDING or DESCENDING
+	Order string `json:"order"`
+}
+
+// CompositeIndex is a composite index a query needs. Firestore answers queries that only compare
+// fields for equality, or filter and order on a single field, from its automatic single-field
+// indexes; anything else fails until a composite index is built.
+type CompositeIndex struct {
+	CollectionGroup string       `json:"collectionGroup"`
+	QueryScope      string       `json:"queryScope"`
+	Fields          []IndexField `json:"fields"`
+}
+
+// Index field orders
+const (
+	IndexAscending  = "ASCENDING"
+	IndexDescending = "DESCENDING"
+)
+
+// compositeIndex declares a collection's composite index over fields, given as path and order pairs
+func compositeIndex(collection string, fields ...string) CompositeIndex {
+	index := CompositeIndex{CollectionGroup: collection, QueryScope: "COLLECTION"}
+	for i := 0; i+1 < len(fields); i += 2 {
+		index.Fields = append(index.Fields, IndexField{FieldPath: fields[i], Order: fields[i+1]})
+	}
+	return index
+}
+
+// RequiredIndexes are the composite indexes the service's queries need. firestore.indexes.json is
+// generated from them with aptrouter-admin indexes, so add an index here with the query that needs it.
+var RequiredIndexes = []CompositeIndex{
+	// Ledger listings and statements
+	compositeIndex(ledgerCollection, "user_id", IndexAscending, "created_at", IndexDescending),
+	compositeIndex(ledgerCollection, "user_id", IndexAscending, "created_at", IndexAscending),
+	// Organization, tenant and experiment usage
+	compositeIndex("request_logs", "org_id", IndexAscending, "request_timestamp", IndexAscending),
+	compositeIndex("request_logs", "tenant_id", IndexAscending, "request_timestamp", IndexAscending),
+	compositeIndex("request_logs", "experiment_id", IndexAscending, "request_timestamp", IndexAscending),
+	// Organization API keys
+	compositeIndex("api_keys", "org_id", IndexAscending, "user_id", IndexAscending, "status", IndexAscending),
+	// API key expiry sweep
+	compositeIndex("api_keys", "status", IndexAscending, "expires_at", IndexAscending),
+	// Usage rollups
+	compositeIndex(usageRollupsCollection, "user_id", IndexAscending, "granularity", IndexAscending, "bucket_start", IndexAscending),
+	// A user's usage logs, optionally by model
+	compositeIndex("request_logs", "user_id", IndexAscending, "request_timestamp", IndexDescending),
+	compositeIndex("request_logs", "user_id", IndexAscending, "model_id", IndexAscending, "request_timestamp", IndexDescending),
+	// Usage export
+	compositeIndex("request_logs", "user_id", IndexAscending, "response_timestamp", IndexAscending),
+	// Request log retention
+	compositeIndex("request_logs", "tier_id", IndexAscending, "request_timestamp", IndexAscending),
+	// Quality evaluations and shadow results
+	compositeIndex(qualityEvaluationsCollection, "model_id", IndexAscending, "created_at", IndexDescending),
+	compositeIndex(shadowResultsCollection, "experiment_id", IndexAscending, "created_at", IndexDescending),
+	// The default pricing tier
+	compositeIndex(pricingTiersCollection, "is_active", IndexAscending, "is_custom", IndexAscending, "min_monthly_spend", IndexAscending),
+	// Audit event queries by type, actor or organization
+	compositeIndex(auditEventsCollection, "type", IndexAscending, "created_at", IndexDescending),
+	compositeIndex(auditEventsCollection, "actor_id", IndexAscending, "created_at", IndexDescending),
+	compositeIndex(auditEventsCollection, "org_id", IndexAscending, "created_at", IndexDescending),
+	// Session history
+	compositeIndex(sessionMessagesCollection, "session_id", IndexAscending, "seq", IndexAscending),
+}
+
+// FieldOverride sets a field's TTL policy. Firestore deletes a document some time after the
+// timestamp in its TTL field has passed; the field is left unindexed, since nothing queries it.
+type FieldOverride struct {
+	CollectionGroup string       `json:"collectionGroup"`
+	FieldPath       string       `json:"fieldPath"`
+	TTL             bool         `json:"ttl"`
+	Indexes         []IndexField `json:"indexes"`
+}
+
+// ttlField declares a collection's TTL field
+func ttlField(collection, field string) FieldOverride {
+	return FieldOverride{CollectionGroup: collection, FieldPath: field, TTL: true, Indexes: []IndexField{}}
+}
+
+// TTLFields are the fields whose TTL policies expire documents nothing else deletes, deployed
+// with the indexes
+var TTLFields = []FieldOverride{
+	// Shared cache entries, and invalidations once every listener has seen them
+	ttlField(cacheEntriesCollection, "expires_at"),
+	ttlField(cacheInvalidationsCollection, "expires_at"),
+}
+
+// IndexesFile renders indexes and TTL fields as a firestore.indexes.json file, for firebase
+// deploy --only firestore:indexes
+func IndexesFile(indexes []CompositeIndex, ttlFields []FieldOverride) ([]byte, error) {
+	file, err := json.MarshalIndent(struct {
+		Indexes        []CompositeIndex `json:"indexes"`
+		FieldOverrides []FieldOverride  `json:"fieldOverrides"`
+	}{indexes, ttlFields}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(file, '\n'), nil
+}
+
+// IndexStatus is whether a required index exists in the project
+type IndexStatus struct {
+	Index CompositeIndex
+	// Exists is false for indexes that were never created
+	Exists bool
+	// Ready is false for indexes that are still being built
+	Ready bool
+}
+
+// CheckIndexes reports which of the required indexes exist and are ready in the project. The
+// in-memory datastore needs no indexes, so every index is ready there.
+func (s *Service) CheckIndexes(ctx context.Context, required []CompositeIndex) ([]IndexStatus, error) {
+	statuses := make([]IndexStatus, len(required))
+	for i, index := range required {
+		statuses[i] = IndexStatus{Index: index}
+	}
+	if s.config.InMemory {
+		for i := range statuses {
+			statuses[i].Exists, statuses[i].Ready = true, true
+		}
+		return statuses, nil
+	}
+
+	client, err := admin.NewFirestoreAdminClient(ctx, s.config.clientOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Firestore admin client: %w", err)
+	}
+	defer client.Close()
+
+	existing := make(map[string]adminpb.Index_State)
+	iter := client.ListIndexes(ctx, &adminpb.ListIndexesRequest{
+		Parent: fmt.Sprintf("projects/%s/databases/(default)/collectionGroups/-", s.config.ProjectID),
+	})
+	for {
+		index, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list Firestore indexes: %w", err)
+		}
+		existing[deployedIndexKey(index)] = index.GetState()
+	}
+
+	for i, index := range required {
+		state, ok := existing[indexKey(index)]
+		statuses[i].Exists = ok
+		statuses[i].Ready = ok && state == adminpb.Index_READY
+	}
+	return statuses, nil
+}
+
+// indexKey identifies a composite index by its collection group, scope and fields
+func indexKey(index CompositeIndex) string {
+	var key strings.Builder
+	fmt.Fprintf(&key, "%s/%s", index.CollectionGroup, index.QueryScope)
+	for _, field := range index.Fields {
+		fmt.Fprintf(&key, "/%s:%s", field.FieldPath, field.Order)
+	}
+	return key.String()
+}
+
+// deployedIndexKey identifies an index listed by the admin API like indexKey. The admin API lists
+// the document ID field Firestore appends to every index, which declarations leave out.
+func deployedIndexKey(index *adminpb.Index) string {
+	// Index names are projects/{project}/databases/{database}/collectionGroups/{collection}/indexes/{id}
+	parts := strings.Split(index.GetName(), "/")
+	collection := ""
+	if len(parts) >= 6 {
+		collection = parts[5]
+	}
+
+	deployed := CompositeIndex{CollectionGroup: collection, QueryScope: index.GetQueryScope().String()}
+	for _, field := range index.GetFields() {
+		if field.GetFieldPath() == "__name__" {
+			continue
+		}
+		deployed.Fields = append(deployed.Fields, IndexField{FieldPath: field.GetFieldPath(), Order: field.GetOrder().String()})
+	}
+	return indexKey(deployed)
+}
+
+// IndexCreateCommand is the gcloud command that creates an index
+func IndexCreateCommand(projectID string, index CompositeIndex) string {
+	var command strings.Builder
+	fmt.Fprintf(&command, "gcloud firestore indexes composite create --project=%s --collection-group=%s --query-scope=%s",
+		projectID, index.CollectionGroup, strings.ToLower(index.QueryScope))
+	for _, field := range index.Fields {
+		fmt.Fprintf(&command, " --field-config=field-path=%s,order=%s", field.FieldPath, strings.ToLower(field.Order))
+	}
+	return command.String()
+}
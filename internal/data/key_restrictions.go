@@ -0,0 +1,148 @@
+package data
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// API key scopes
+const (
+	ScopeGenerate   = "generate"
+	ScopeEmbeddings = "embeddings"
+	ScopeAdmin      = "admin"
+)
+
+// KeyRestrictions limits which models and providers an API key may use.
+// Deny lists take precedence over allow lists; an empty allow list allows everything.
+type KeyRestrictions struct {
+	AllowedModels    []string `firestore:"allowed_models,omitempty" json:"allowed_models,omitempty"`
+	DeniedModels     []string `firestore:"denied_models,omitempty" json:"denied_models,omitempty"`
+	AllowedProviders []string `firestore:"allowed_providers,omitempty" json:"allowed_providers,omitempty"`
+	DeniedProviders  []string `firestore:"denied_providers,omitempty" json:"denied_providers,omitempty"`
+	// MaxTokens caps max_tokens per request; zero means no cap
+	MaxTokens int `firestore:"max_tokens,omitempty" json:"max_tokens,omitempty"`
+	// AllowedIPs lists the client IPs or CIDR ranges the key may be used from
+	AllowedIPs []string `firestore:"allowed_ips,omitempty" json:"allowed_ips,omitempty"`
+	// AllowedReferers lists the referer hosts the key may be used from; "*.example.com" matches subdomains
+	AllowedReferers []string `firestore:"allowed_referers,omitempty" json:"allowed_referers,omitempty"`
+}
+
+// Validate checks that the IP allowlist entries are valid addresses or CIDR ranges and that the
+// referer allowlist entries are bare hosts, since a referer's scheme, port and path aren't matched
+func (r *KeyRestrictions) Validate() error {
+	for _, entry := range r.AllowedIPs {
+		if _, _, err := net.ParseCIDR(entry); err == nil {
+			continue
+		}
+		if net.ParseIP(entry) == nil {
+			return fmt.Errorf("invalid IP or CIDR range: %s", entry)
+		}
+	}
+	for _, entry := range r.AllowedReferers {
+		host := strings.TrimPrefix(entry, "*.")
+		if _, _, err := net.SplitHostPort(host); host == "" || err == nil || strings.Contains(host, "/") {
+			return fmt.Errorf("invalid referer host: %s (expected a host such as app.example.com or *.example.com)", entry)
+		}
+	}
+	return nil
+}
+
+// ValidScope reports whether scope is a known API key scope
+func ValidScope(scope string) bool {
+	return scope == ScopeGenerate || scope == ScopeEmbeddings || scope == ScopeAdmin
+}
+
+// HasScope reports whether the key grants the given scope.
+// Keys created before scopes existed carry none and keep full access.
+func (k *APIKey) HasScope(scope string) bool {
+	if len(k.Scopes) == 0 {
+		return true
+	}
+	return slices.Contains(k.Scopes, scope) || slices.Contains(k.Scopes, ScopeAdmin)
+}
+
+// CheckModel returns an error if the restrictions forbid the model or its provider
+func (r *KeyRestrictions) CheckModel(modelID, provider string) error {
+	if r == nil {
+		return nil
+	}
+
+	if slices.Contains(r.DeniedProviders, provider) {
+		return fmt.Errorf("provider %s is not allowed for this API key", provider)
+	}
+	if slices.Contains(r.DeniedModels, modelID) {
+		return fmt.Errorf("model %s is not allowed for this API key", modelID)
+	}
+	if len(r.AllowedProviders) > 0 && !slices.Contains(r.AllowedProviders, provider) {
+		return fmt.Errorf("provider %s is not allowed for this API key", provider)
+	}
+	if len(r.AllowedModels) > 0 && !slices.Contains(r.AllowedModels, modelID) {
+		return fmt.Errorf("model %s is not allowed for this API key", modelID)
+	}
+
+	return nil
+}
+
+// CapMaxTokens returns maxTokens limited to the key's token cap.
+// An unset maxTokens (zero) is replaced by the cap so the provider default can't exceed it.
+func (r *KeyRestrictions) CapMaxTokens(maxTokens int) int {
+	if r == nil || r.MaxTokens <= 0 || (maxTokens > 0 && maxTokens <= r.MaxTokens) {
+		return maxTokens
+	}
+	return r.MaxTokens
+}
+
+// CheckClientIP returns an error if the key has an IP allowlist that doesn't include clientIP
+func (r *KeyRestrictions) CheckClientIP(clientIP string) error {
+	if r == nil || len(r.AllowedIPs) == 0 {
+		return nil
+	}
+
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return fmt.Errorf("client IP %q is not allowed for this API key", clientIP)
+	}
+
+	for _, entry := range r.AllowedIPs {
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if network.Contains(ip) {
+				return nil
+			}
+		} else if allowed := net.ParseIP(entry); allowed != nil && allowed.Equal(ip) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("client IP %s is not allowed for this API key", clientIP)
+}
+
+// CheckReferer returns an error if the key has a referer allowlist that doesn't match referer's
+// host; its scheme and port are not checked. Requests without a referer are rejected when an
+// allowlist is set.
+func (r *KeyRestrictions) CheckReferer(referer string) error {
+	if r == nil || len(r.AllowedReferers) == 0 {
+		return nil
+	}
+
+	parsed, err := url.Parse(referer)
+	if referer == "" || err != nil || parsed.Hostname() == "" {
+		return fmt.Errorf("a valid Referer header is required for this API key")
+	}
+	host := strings.ToLower(parsed.Hostname())
+
+	for _, pattern := range r.AllowedReferers {
+		pattern = strings.ToLower(pattern)
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if host == suffix || strings.HasSuffix(host, "."+suffix) {
+				return nil
+			}
+		} else if host == pattern {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("referer %s is not allowed for this API key", host)
+}
@@ -0,0 +1,195 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyRestrictionsCheckClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowedIPs []string
+		clientIP   string
+		wantErr    bool
+	}{
+		{"NoAllowlist", nil, "198.51.100.1", false},
+		{"EmptyAllowlist", []string{}, "198.51.100.1", false},
+		{"NoAllowlistUnparsableIP", nil, "not-an-ip", false},
+
+		{"SingleIPMatches", []string{"203.0.113.7"}, "203.0.113.7", false},
+		{"SingleIPOtherAddress", []string{"203.0.113.7"}, "203.0.113.8", true},
+		{"SingleIPIsNotARange", []string{"10.0.0.0"}, "10.0.0.1", true},
+		{"CIDRContains", []string{"10.0.0.0/8"}, "10.200.3.4", false},
+		{"CIDROutside", []string{"10.0.0.0/8"}, "11.0.0.1", true},
+		{"CIDRHostRange", []string{"203.0.113.7/32"}, "203.0.113.7", false},
+		{"AnyEntryMatches", []string{"203.0.113.7", "10.0.0.0/8"}, "10.1.1.1", false},
+
+		{"IPv6SingleIP", []string{"2001:db8::1"}, "2001:db8::1", false},
+		{"IPv6SingleIPExpanded", []string{"2001:db8::1"}, "2001:0db8:0000:0000:0000:0000:0000:0001", false},
+		{"IPv6SingleIPOtherAddress", []string{"2001:db8::1"}, "2001:db8::2", true},
+		{"IPv6CIDRContains", []string{"2001:db8::/32"}, "2001:db8:ffff::1", false},
+		{"IPv6CIDROutside", []string{"2001:db8::/32"}, "2001:db9::1", true},
+		{"IPv4MappedIPv6", []string{"203.0.113.0/24"}, "::ffff:203.0.113.9", false},
+		{"IPv6NotInIPv4Range", []string{"10.0.0.0/8"}, "::1", true},
+
+		{"UnparsableIP", []string{"10.0.0.0/8"}, "not-an-ip", true},
+		{"EmptyIP", []string{"10.0.0.0/8"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &KeyRestrictions{AllowedIPs: tt.allowedIPs}
+			err := r.CheckClientIP(tt.clientIP)
+			if tt.wantErr {
+				assert.ErrorContains(t, err, "is not allowed for this API key")
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	var r *KeyRestrictions
+	assert.NoError(t, r.CheckClientIP("198.51.100.1"), "a key without restrictions allows any IP")
+}
+
+func TestKeyRestrictionsCheckReferer(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		referer string
+		wantErr bool
+	}{
+		{"NoAllowlist", nil, "", false},
+		{"NoAllowlistAnyReferer", nil, "https://evil.example.net/", false},
+
+		{"ExactHost", []string{"app.example.com"}, "https://app.example.com/page", false},
+		{"ExactHostOtherHost", []string{"app.example.com"}, "https://example.com/", true},
+		{"ExactHostNotSubdomains", []string{"example.com"}, "https://app.example.com/", true},
+		{"HostIsCaseInsensitive", []string{"App.Example.com"}, "https://APP.example.COM/", false},
+
+		{"WildcardSubdomain", []string{"*.example.com"}, "https://app.example.com/", false},
+		{"WildcardNestedSubdomain", []string{"*.example.com"}, "https://a.b.example.com/", false},
+		{"WildcardApexHost", []string{"*.example.com"}, "https://example.com/", false},
+		{"WildcardSuffixIsALabel", []string{"*.example.com"}, "https://badexample.com/", true},
+		{"WildcardOtherDomain", []string{"*.example.com"}, "https://example.com.evil.net/", true},
+
+		// Only the host is matched
+		{"HTTPScheme", []string{"app.example.com"}, "http://app.example.com/", false},
+		{"OtherScheme", []string{"app.example.com"}, "chrome-extension://app.example.com/", false},
+		{"Port", []string{"app.example.com"}, "https://app.example.com:8443/page", false},
+		{"WildcardPort", []string{"*.example.com"}, "http://app.example.com:3000/", false},
+		{"UserInfo", []string{"app.example.com"}, "https://app.example.com@evil.net/", true},
+		{"IPv6Host", []string{"::1"}, "http://[::1]:3000/", false},
+
+		{"Missing", []string{"app.example.com"}, "", true},
+		{"NoScheme", []string{"app.example.com"}, "app.example.com/page", true},
+		{"Unparsable", []string{"app.example.com"}, "https://app.example.com:port/", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &KeyRestrictions{AllowedReferers: tt.allowed}
+			err := r.CheckReferer(tt.referer)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestKeyRestrictionsCheckModel(t *testing.T) {
+	// Allow and deny lists applied together, with the deny lists taking precedence
+	r := &KeyRestrictions{
+		AllowedModels:    []string{"gpt-4o", "gpt-4o-mini", "claude-3-5-sonnet"},
+		DeniedModels:     []string{"gpt-4o"},
+		AllowedProviders: []string{"openai", "anthropic"},
+		DeniedProviders:  []string{"anthropic"},
+	}
+
+	tests := []struct {
+		name     string
+		modelID  string
+		provider string
+		wantErr  string
+	}{
+		{"AllowedModelAndProvider", "gpt-4o-mini", "openai", ""},
+		{"DeniedModelOnAllowList", "gpt-4o", "openai", "model gpt-4o is not allowed"},
+		{"DeniedProviderOnAllowList", "claude-3-5-sonnet", "anthropic", "provider anthropic is not allowed"},
+		{"ModelNotOnAllowList", "gpt-3.5-turbo", "openai", "model gpt-3.5-turbo is not allowed"},
+		{"ProviderNotOnAllowList", "gpt-4o-mini", "azure", "provider azure is not allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := r.CheckModel(tt.modelID, tt.provider)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.wantErr)
+			}
+		})
+	}
+
+	var unrestricted *KeyRestrictions
+	assert.NoError(t, unrestricted.CheckModel("gpt-4o", "openai"))
+	assert.NoError(t, (&KeyRestrictions{}).CheckModel("gpt-4o", "openai"))
+}
+
+func TestKeyRestrictionsCapMaxTokens(t *testing.T) {
+	tests := []struct {
+		name      string
+		cap       int
+		maxTokens int
+		want      int
+	}{
+		{"UnderCap", 1000, 500, 500},
+		{"AtCap", 1000, 1000, 1000},
+		{"OverCap", 1000, 5000, 1000},
+		{"UnsetUsesCap", 1000, 0, 1000},
+		{"NegativeUsesCap", 1000, -1, 1000},
+
+		// A zero or negative cap means no cap
+		{"ZeroCap", 0, 5000, 5000},
+		{"ZeroCapUnset", 0, 0, 0},
+		{"NegativeCap", -1, 5000, 5000},
+		{"NegativeCapUnset", -1, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &KeyRestrictions{MaxTokens: tt.cap}
+			assert.Equal(t, tt.want, r.CapMaxTokens(tt.maxTokens))
+		})
+	}
+
+	var r *KeyRestrictions
+	assert.Equal(t, 5000, r.CapMaxTokens(5000))
+}
+
+func TestKeyRestrictionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		r       KeyRestrictions
+		wantErr bool
+	}{
+		{"Empty", KeyRestrictions{}, false},
+		{"IPsAndRanges", KeyRestrictions{AllowedIPs: []string{"203.0.113.7", "10.0.0.0/8", "2001:db8::/32", "::1"}}, false},
+		{"InvalidIP", KeyRestrictions{AllowedIPs: []string{"203.0.113"}}, true},
+		{"InvalidCIDR", KeyRestrictions{AllowedIPs: []string{"10.0.0.0/33"}}, true},
+		{"RefererHosts", KeyRestrictions{AllowedReferers: []string{"app.example.com", "*.example.org", "::1"}}, false},
+		{"RefererWithScheme", KeyRestrictions{AllowedReferers: []string{"https://app.example.com"}}, true},
+		{"RefererWithPort", KeyRestrictions{AllowedReferers: []string{"app.example.com:8443"}}, true},
+		{"RefererWithPath", KeyRestrictions{AllowedReferers: []string{"app.example.com/page"}}, true},
+		{"EmptyReferer", KeyRestrictions{AllowedReferers: []string{""}}, true},
+		{"WildcardOnly", KeyRestrictions{AllowedReferers: []string{"*."}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.r.Validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
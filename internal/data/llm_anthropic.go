@@ -2,20 +2,28 @@ package data
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"reflect"
+	"math"
+	"unicode/utf8"
 
 	anthropic "github.com/anthropics/anthropic-sdk-go"
 	"github.com/anthropics/anthropic-sdk-go/option"
+	"github.com/anthropics/anthropic-sdk-go/packages/param"
 	ssestream "github.com/anthropics/anthropic-sdk-go/packages/ssestream"
 )
 
+// anthropicThinkingCharsPerToken estimates the tokens in thinking text, which Anthropic bills as
+// output tokens without counting separately
+const anthropicThinkingCharsPerToken = 3.5
+
 // AnthropicClient implements LLMClient for Anthropic
 type AnthropicClient struct {
-	modelID string
-	apiKey  string
+	modelID  string
+	apiKey   string
+	endpoint *Endpoint
 }
 
 // NewAnthropicClient creates a new Anthropic client
@@ -26,7 +34,105 @@ func NewAnthropicClient(modelID, apiKey string) (LLMClient, error) {
 	}, nil
 }
 
-// GenerateWithParams generates text using Anthropic's API
+// requestOptions authenticates with the client's key and directs calls to its endpoint, or to the
+// provider's configured network
+func (c *AnthropicClient) requestOptions() []option.RequestOption {
+	client, baseURL := providerHTTP("anthropic")
+	opts := []option.RequestOption{option.WithHTTPClient(client)}
+	if c.endpoint == nil {
+		if baseURL != "" {
+			opts = append(opts, option.WithBaseURL(baseURL))
+		}
+		return append(opts, option.WithAPIKey(c.apiKey))
+	}
+	opts = append(opts, option.WithBaseURL(c.endpoint.BaseURL))
+	if c.endpoint.AuthHeader != "" {
+		return append(opts, option.WithHeader(c.endpoint.AuthHeader, c.apiKey))
+	}
+	return append(opts, option.WithAPIKey(c.apiKey))
+}
+
+// anthropicMessageParams builds the Messages API request for a prompt, shared by the
+// streaming and non-streaming calls
+func anthropicMessageParams(model anthropic.Model, prompt string, params map[string]interface{}) anthropic.MessageNewParams {
+	maxTokens := 1000
+	if mt, ok := params["max_tokens"].(int); ok {
+		maxTokens = mt
+	}
+	temperature := 0.7
+	if temp, ok := floatParam(params, "temperature"); ok {
+		temperature = temp
+	}
+
+	messageParams := anthropic.MessageNewParams{
+		MaxTokens: int64(maxTokens),
+		Messages: []anthropic.MessageParam{{
+			Content: []anthropic.ContentBlockParamUnion{{
+				OfText: &anthropic.TextBlockParam{Text: prompt},
+			}},
+			Role: anthropic.MessageParamRoleUser,
+		}},
+		Model:         model,
+		Temperature:   anthropic.Float(temperature),
+		StopSequences: stopSequences(params),
+	}
+	if topP, ok := floatParam(params, "top_p"); ok {
+		messageParams.TopP = anthropic.Float(topP)
+	}
+	cacheSystem, cachePrompt := cacheParams(params)
+	if system := systemParam(params); system != "" {
+		messageParams.System = []anthropic.TextBlockParam{{Text: system}}
+		if cacheSystem {
+			messageParams.System[0].CacheControl = anthropic.CacheControlEphemeralParam{}
+		}
+	}
+	// A breakpoint on the prompt caches the system instructions along with it
+	if cachePrompt {
+		messageParams.Messages[0].Content[0].OfText.CacheControl = anthropic.CacheControlEphemeralParam{}
+	}
+	// Extended thinking counts against max_tokens, so the budget is added to it to leave the
+	// answer the tokens asked for; it also requires the default temperature
+	if budget := thinkingBudget(params); budget > 0 {
+		messageParams.Thinking = anthropic.ThinkingConfigParamOfEnabled(int64(budget))
+		messageParams.MaxTokens += int64(budget)
+		messageParams.Temperature = param.Opt[float64]{}
+	}
+
+	return messageParams
+}
+
+// CountTokens counts the prompt's input tokens with Anthropic's token counting endpoint
+func (c *AnthropicClient) CountTokens(ctx context.Context, params map[string]interface{}) (int, error) {
+	prompt, _ := params["prompt"].(string)
+	client := anthropic.NewClient(c.requestOptions()...)
+
+	countParams := anthropic.MessageCountTokensParams{
+		Messages: []anthropic.MessageParam{{
+			Content: []anthropic.ContentBlockParamUnion{{
+				OfText: &anthropic.TextBlockParam{Text: prompt},
+			}},
+			Role: anthropic.MessageParamRoleUser,
+		}},
+		Model: anthropic.Model(c.modelID),
+	}
+	if system := systemParam(params); system != "" {
+		countParams.System = anthropic.MessageCountTokensParamsSystemUnion{OfString: anthropic.String(system)}
+	}
+
+	count, err := client.Messages.CountTokens(ctx, countParams)
+	if err != nil {
+		return 0, &ProviderError{
+			Provider:  "anthropic",
+			ModelID:   c.modelID,
+			Message:   fmt.Sprintf("failed to count tokens: %v", err),
+			Retryable: true,
+		}
+	}
+	return int(count.InputTokens), nil
+}
+
+// GenerateWithParams generates text using Anthropic's API.
+// Anthropic has no frequency or presence penalties, so those parameters are ignored.
 func (c *AnthropicClient) GenerateWithParams(ctx context.Context, params map[string]interface{}) (*GenerateResponse, error) {
 	slog.Info("Anthropic client: Starting real API call", "model", c.modelID, "api_key_length", len(c.apiKey))
 
@@ -40,19 +146,10 @@ func (c *AnthropicClient) GenerateWithParams(ctx context.Context, params map[str
 		}
 	}
 
-	maxTokens := 1000
-	if mt, ok := params["max_tokens"].(int); ok {
-		maxTokens = mt
-	}
-	temperature := 0.7
-	if temp, ok := params["temperature"].(float64); ok {
-		temperature = temp
-	}
-
 	slog.Info("Anthropic client: Creating client and making API call", "model", c.modelID, "prompt_length", len(prompt))
 
 	// Create Anthropic client
-	client := anthropic.NewClient(option.WithAPIKey(c.apiKey))
+	client := anthropic.NewClient(c.requestOptions()...)
 
 	// Map model ID to Anthropic model - use actual model IDs
 	anthropicModel := anthropic.Model(c.modelID)
@@ -75,34 +172,35 @@ func (c *AnthropicClient) GenerateWithParams(ctx context.Context, params map[str
 	slog.Info("Anthropic client: Making API call", "model", c.modelID, "anthropic_model", anthropicModel)
 
 	// Make API call
-	resp, err := client.Messages.New(ctx, anthropic.MessageNewParams{
-		MaxTokens: int64(maxTokens),
-		Messages: []anthropic.MessageParam{{
-			Content: []anthropic.ContentBlockParamUnion{{
-				OfText: &anthropic.TextBlockParam{Text: prompt},
-			}},
-			Role: anthropic.MessageParamRoleUser,
-		}},
-		Model:       anthropicModel,
-		Temperature: anthropic.Float(temperature),
-	})
+	resp, err := client.Messages.New(ctx, anthropicMessageParams(anthropicModel, prompt, params))
 	if err != nil {
 		slog.Error("Anthropic client: API call failed", "error", err, "model", c.modelID)
+		// Keep the status the API answered with, so failed requests are logged with it
+		statusCode := 0
+		var apiErr *anthropic.Error
+		if errors.As(err, &apiErr) {
+			statusCode = apiErr.StatusCode
+		}
 		return nil, &ProviderError{
-			Provider:  "anthropic",
-			ModelID:   c.modelID,
-			Message:   fmt.Sprintf("API call failed: %v", err),
-			Retryable: true,
+			Provider:   "anthropic",
+			ModelID:    c.modelID,
+			StatusCode: statusCode,
+			Message:    fmt.Sprintf("API call failed: %v", err),
+			Retryable:  true,
 		}
 	}
 
 	slog.Info("Anthropic client: API call successful", "model", c.modelID, "content_blocks", len(resp.Content))
 
-	// Extract response text
+	// Extract response text, leaving out any thinking
 	responseText := ""
+	thinkingText := ""
 	for _, content := range resp.Content {
-		if content.Type == "text" {
+		switch content.Type {
+		case "text":
 			responseText += content.Text
+		case "thinking":
+			thinkingText += content.Thinking
 		}
 	}
 
@@ -118,12 +216,18 @@ func (c *AnthropicClient) GenerateWithParams(ctx context.Context, params map[str
 
 	slog.Info("Anthropic client: Response received", "model", c.modelID, "response_length", len(responseText))
 
-	// Use actual token usage from provider response if available
+	// Use actual token usage from provider response if available. Anthropic's input tokens leave out
+	// those read from and written to the prompt cache, so they are added back.
 	var inputTokens, outputTokens int
+	details := TokenDetails{
+		CacheReadTokens:  int(resp.Usage.CacheReadInputTokens),
+		CacheWriteTokens: int(resp.Usage.CacheCreationInputTokens),
+	}
 	if resp.Usage.InputTokens > 0 || resp.Usage.OutputTokens > 0 {
 		// Use actual token counts from Anthropic response
-		inputTokens = int(resp.Usage.InputTokens)
+		inputTokens = int(resp.Usage.InputTokens) + details.CacheReadTokens + details.CacheWriteTokens
 		outputTokens = int(resp.Usage.OutputTokens)
+		details.ReasoningTokens = anthropicThinkingTokens(utf8.RuneCountInString(thinkingText), outputTokens)
 		slog.Info("Anthropic client: Using actual token usage from provider",
 			"input_tokens", inputTokens, "output_tokens", outputTokens)
 	} else {
@@ -140,11 +244,14 @@ func (c *AnthropicClient) GenerateWithParams(ctx context.Context, params map[str
 		InputTokens:  inputTokens,
 		OutputTokens: outputTokens,
 		Usage: &UsageInfo{
-			PromptTokens:     inputTokens,
-			CompletionTokens: outputTokens,
-			TotalTokens:      inputTokens + outputTokens,
+			PromptTokens:          inputTokens,
+			CompletionTokens:      outputTokens,
+			TotalTokens:           inputTokens + outputTokens,
+			CachedInputTokens:     details.CacheReadTokens,
+			CacheWriteInputTokens: details.CacheWriteTokens,
+			ReasoningTokens:       details.ReasoningTokens,
 		},
-		FinishReason: "end_turn",
+		FinishReason: NormalizeFinishReason(string(resp.StopReason)),
 		ModelID:      c.modelID,
 		Provider:     "anthropic",
 	}, nil
@@ -166,7 +273,7 @@ func (c *AnthropicClient) GenerateStream(ctx context.Context, params map[string]
 
 	slog.Info("Anthropic client: Creating streaming client", "model", c.modelID, "prompt_length", len(prompt))
 
-	client := anthropic.NewClient(option.WithAPIKey(c.apiKey))
+	client := anthropic.NewClient(c.requestOptions()...)
 
 	// Map model ID to Anthropic model - use actual model IDs
 	anthropicModel := anthropic.Model(c.modelID)
@@ -186,17 +293,7 @@ func (c *AnthropicClient) GenerateStream(ctx context.Context, params map[string]
 		anthropicModel = anthropic.Model(c.modelID)
 	}
 
-	stream := client.Messages.NewStreaming(ctx, anthropic.MessageNewParams{
-		MaxTokens: int64(1000),
-		Messages: []anthropic.MessageParam{{
-			Content: []anthropic.ContentBlockParamUnion{{
-				OfText: &anthropic.TextBlockParam{Text: prompt},
-			}},
-			Role: anthropic.MessageParamRoleUser,
-		}},
-		Model:       anthropicModel,
-		Temperature: anthropic.Float(0.7),
-	})
+	stream := client.Messages.NewStreaming(ctx, anthropicMessageParams(anthropicModel, prompt, params))
 
 	streamReader := &AnthropicStreamReader{
 		stream: stream,
@@ -211,132 +308,119 @@ func (c *AnthropicClient) GenerateStream(ctx context.Context, params map[string]
 	}, nil
 }
 
-// AnthropicStreamReader is a stream reader for Anthropic Claude
-// Uses the concrete ssestream.Stream[anthropic.MessageStreamEventUnion]
+// AnthropicStreamReader is a stream reader for Anthropic Claude.
+// It emits text deltas and tracks usage from the typed stream events.
 type AnthropicStreamReader struct {
 	stream *ssestream.Stream[anthropic.MessageStreamEventUnion]
 	buffer []byte
 	pos    int
 	closed bool
-	// Usage tracking
+	// Usage tracking; Anthropic reports cumulative counts, so later events replace earlier ones
 	inputTokens  int
 	outputTokens int
-	usageFound   bool
+	stopReason   string
+	// details are the prompt cache usage, which inputTokens includes, and the estimated thinking
+	// tokens, which outputTokens includes
+	details TokenDetails
+	// thinkingChars counts the thinking text streamed so far
+	thinkingChars int
 }
 
 func (r *AnthropicStreamReader) Read(p []byte) (n int, err error) {
-	slog.Info("AnthropicStreamReader: Read called", "closed", r.closed, "pos", r.pos, "buffer_len", len(r.buffer))
 	if r.closed {
 		return 0, io.EOF
 	}
 
-	if r.pos < len(r.buffer) {
-		n = copy(p, r.buffer[r.pos:])
-		r.pos += n
-		if r.pos >= len(r.buffer) {
-			r.buffer = nil
-			r.pos = 0
-		}
-		slog.Info("AnthropicStreamReader: Returning buffered content", "n", n)
-		return n, nil
-	}
-
-	if !r.stream.Next() {
-		if r.stream.Err() != nil {
+	// Skip events without text rather than returning empty reads
+	for r.pos >= len(r.buffer) {
+		if !r.stream.Next() {
 			r.closed = true
-			slog.Error("AnthropicStreamReader: Stream error", "error", r.stream.Err())
-			return 0, r.stream.Err()
-		}
-		r.closed = true
-		slog.Debug("AnthropicStreamReader: Stream ended")
-		return 0, io.EOF
-	}
-
-	event := r.stream.Current()
-	slog.Info("AnthropicStreamReader: Event received", "event_type", fmt.Sprintf("%T", event))
-
-	// Check for usage information in the final chunk
-	// Anthropic provides usage data in the final message event
-	if !r.usageFound {
-		// Use reflection to check for usage data in the event
-		eventValue := reflect.ValueOf(event)
-		if eventValue.Kind() == reflect.Ptr {
-			eventValue = eventValue.Elem()
-		}
-
-		// Look for usage fields
-		if usageField := eventValue.FieldByName("Usage"); usageField.IsValid() {
-			if inputField := usageField.FieldByName("InputTokens"); inputField.IsValid() && inputField.Kind() == reflect.Int64 {
-				r.inputTokens = int(inputField.Int())
-			}
-			if outputField := usageField.FieldByName("OutputTokens"); outputField.IsValid() && outputField.Kind() == reflect.Int64 {
-				r.outputTokens = int(outputField.Int())
-			}
-			if r.inputTokens > 0 || r.outputTokens > 0 {
-				r.usageFound = true
-				slog.Info("Anthropic streaming: Captured usage from final chunk",
-					"input_tokens", r.inputTokens, "output_tokens", r.outputTokens)
+			if err := r.stream.Err(); err != nil {
+				slog.Error("AnthropicStreamReader: Stream error", "error", err)
+				return 0, err
 			}
+			return 0, io.EOF
 		}
-	}
-
-	var content string
 
-	// Try to extract content using reflection and type assertions
-	if textEvent, ok := any(event).(interface{ GetText() string }); ok {
-		content = textEvent.GetText()
-		slog.Info("AnthropicStreamReader: Content extracted via GetText", "content", content)
+		r.buffer = []byte(r.handleEvent(r.stream.Current()))
+		r.pos = 0
 	}
 
-	// If no content found, try to extract from the event structure
-	if content == "" {
-		// Use reflection to explore the event structure
-		eventValue := reflect.ValueOf(event)
-		if eventValue.Kind() == reflect.Ptr {
-			eventValue = eventValue.Elem()
-		}
+	n = copy(p, r.buffer[r.pos:])
+	r.pos += n
+	return n, nil
+}
 
-		// Look for common fields that might contain text
-		if deltaField := eventValue.FieldByName("Delta"); deltaField.IsValid() {
-			if textField := deltaField.FieldByName("Text"); textField.IsValid() && textField.Kind() == reflect.String {
-				content = textField.String()
-				slog.Info("AnthropicStreamReader: Content extracted from Delta.Text", "content", content)
-			}
+// handleEvent records usage from a stream event and returns any text it carries
+func (r *AnthropicStreamReader) handleEvent(event anthropic.MessageStreamEventUnion) string {
+	switch variant := event.AsAny().(type) {
+	case anthropic.MessageStartEvent:
+		r.details = TokenDetails{
+			CacheReadTokens:  int(variant.Message.Usage.CacheReadInputTokens),
+			CacheWriteTokens: int(variant.Message.Usage.CacheCreationInputTokens),
+		}
+		r.inputTokens = int(variant.Message.Usage.InputTokens) + r.details.CacheReadTokens + r.details.CacheWriteTokens
+		r.outputTokens = int(variant.Message.Usage.OutputTokens)
+
+	case anthropic.ContentBlockDeltaEvent:
+		switch delta := variant.Delta.AsAny().(type) {
+		case anthropic.TextDelta:
+			return delta.Text
+		case anthropic.ThinkingDelta:
+			r.thinkingChars += utf8.RuneCountInString(delta.Thinking)
 		}
 
-		if contentField := eventValue.FieldByName("Content"); contentField.IsValid() {
-			if textField := contentField.FieldByName("Text"); textField.IsValid() && textField.Kind() == reflect.String {
-				content = textField.String()
-				slog.Info("AnthropicStreamReader: Content extracted from Content.Text", "content", content)
+	case anthropic.MessageDeltaEvent:
+		// message_delta usage is cumulative; input tokens are only present on some API versions
+		if variant.Usage.InputTokens > 0 {
+			if variant.Usage.CacheReadInputTokens > 0 || variant.Usage.CacheCreationInputTokens > 0 {
+				r.details = TokenDetails{
+					CacheReadTokens:  int(variant.Usage.CacheReadInputTokens),
+					CacheWriteTokens: int(variant.Usage.CacheCreationInputTokens),
+				}
 			}
+			r.inputTokens = int(variant.Usage.InputTokens) + r.details.CacheReadTokens + r.details.CacheWriteTokens
+		}
+		r.outputTokens = int(variant.Usage.OutputTokens)
+		if variant.Delta.StopReason != "" {
+			r.stopReason = string(variant.Delta.StopReason)
 		}
-	}
 
-	if content == "" {
-		slog.Debug("AnthropicStreamReader: No text content found in event", "event_type", fmt.Sprintf("%T", event))
-		return 0, nil
+	case anthropic.MessageStopEvent:
+		slog.Debug("Anthropic streaming: Message complete",
+			"input_tokens", r.inputTokens,
+			"output_tokens", r.outputTokens,
+			"stop_reason", r.stopReason,
+		)
 	}
 
-	r.buffer = []byte(content)
-	r.pos = 0
-
-	n = copy(p, r.buffer)
-	r.pos += n
-	if r.pos >= len(r.buffer) {
-		r.buffer = nil
-		r.pos = 0
-	}
-
-	slog.Info("AnthropicStreamReader: Returning new content", "n", n, "content", content)
-	return n, nil
+	return ""
 }
 
 func (r *AnthropicStreamReader) Close() error {
 	r.closed = true
-	return nil
+	return r.stream.Close()
 }
 
 // GetUsage returns the captured usage information
 func (r *AnthropicStreamReader) GetUsage() (int, int) {
 	return r.inputTokens, r.outputTokens
 }
+
+// ProviderFinishReason returns why Anthropic ended the stream, normalized
+func (r *AnthropicStreamReader) ProviderFinishReason() string {
+	return NormalizeFinishReason(r.stopReason)
+}
+
+// GetTokenDetails returns the prompt cache usage reported with the message and the estimated
+// thinking tokens
+func (r *AnthropicStreamReader) GetTokenDetails() TokenDetails {
+	details := r.details
+	details.ReasoningTokens = anthropicThinkingTokens(r.thinkingChars, r.outputTokens)
+	return details
+}
+
+// anthropicThinkingTokens estimates the output tokens spent on thinkingChars characters of thinking
+func anthropicThinkingTokens(thinkingChars, outputTokens int) int {
+	return min(int(math.Ceil(float64(thinkingChars)/anthropicThinkingCharsPerToken)), outputTokens)
+}
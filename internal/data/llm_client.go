@@ -4,8 +4,17 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
+// providerHTTPClient is shared by all provider SDK clients so outbound calls are traced
+// and carry the caller's trace context
+var providerHTTPClient = &http.Client{
+	Transport: otelhttp.NewTransport(http.DefaultTransport),
+}
+
 // LLMClient interface defines the contract for all LLM provider clients
 type LLMClient interface {
 	// GenerateWithParams generates text using the specified parameters
@@ -15,6 +24,13 @@ type LLMClient interface {
 	GenerateStream(ctx context.Context, params map[string]interface{}) (*StreamResponse, error)
 }
 
+// TokenCounter is implemented by clients whose provider can count a prompt's tokens without
+// generating a response
+type TokenCounter interface {
+	// CountTokens returns the input tokens the prompt and system instructions in params use
+	CountTokens(ctx context.Context, params map[string]interface{}) (int, error)
+}
+
 // ProviderError represents errors from LLM providers with additional context
 type ProviderError struct {
 	Provider   string `json:"provider"`
@@ -40,6 +56,32 @@ type GenerateResponse struct {
 	ModelID      string            `json:"model_id"`
 	Provider     string            `json:"provider"`
 	Metadata     map[string]string `json:"metadata,omitempty"`
+	// Logprobs holds the log probability of each generated token when they were requested and
+	// the provider reports them
+	Logprobs []TokenLogprob `json:"logprobs,omitempty"`
+}
+
+// TokenLogprob is the log probability of one generated token, with the most likely alternatives
+// at its position when top logprobs were requested
+type TokenLogprob struct {
+	Token       string       `json:"token"`
+	Logprob     float64      `json:"logprob"`
+	Bytes       []int64      `json:"bytes,omitempty"`
+	TopLogprobs []TopLogprob `json:"top_logprobs,omitempty"`
+}
+
+// TopLogprob is one of the most likely tokens at a position
+type TopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int64 `json:"bytes,omitempty"`
+}
+
+// LogprobsReader is implemented by streams that report the log probabilities of the tokens they
+// produce
+type LogprobsReader interface {
+	// TakeLogprobs returns the logprobs received since the last call
+	TakeLogprobs() []TokenLogprob
 }
 
 // UsageInfo contains token usage information
@@ -47,6 +89,85 @@ type UsageInfo struct {
 	PromptTokens     int `json:"prompt_tokens"`
 	CompletionTokens int `json:"completion_tokens"`
 	TotalTokens      int `json:"total_tokens"`
+	// CachedInputTokens and CacheWriteInputTokens are the prompt tokens the provider read from and
+	// wrote to its prompt cache; both are included in PromptTokens
+	CachedInputTokens     int `json:"cached_input_tokens,omitempty"`
+	CacheWriteInputTokens int `json:"cache_write_input_tokens,omitempty"`
+	// ReasoningTokens are the completion tokens a reasoning model spent thinking; they are included
+	// in CompletionTokens
+	ReasoningTokens int `json:"reasoning_tokens,omitempty"`
+}
+
+// TokenDetailsReader is implemented by streams that report prompt cache or reasoning usage along
+// with GetUsage
+type TokenDetailsReader interface {
+	// GetTokenDetails returns the cached input tokens and reasoning output tokens of the stream
+	GetTokenDetails() TokenDetails
+}
+
+// Finish reasons, normalized from each provider's own so clients can branch on them whichever
+// provider served the request
+const (
+	// FinishReasonStop is a natural end of the completion or a stop sequence
+	FinishReasonStop = "stop"
+	// FinishReasonLength is the completion reaching max_tokens or the context window
+	FinishReasonLength = "length"
+	// FinishReasonContentFilter is the provider withholding the rest of the completion, such as
+	// for safety, recitation or a refusal
+	FinishReasonContentFilter = "content_filter"
+	// FinishReasonToolCalls is the model stopping to call a tool
+	FinishReasonToolCalls = "tool_calls"
+	// FinishReasonOther is any reason the provider gives that has no normalized equivalent
+	FinishReasonOther = "other"
+)
+
+// providerFinishReasons map the finish and stop reasons of OpenAI, Anthropic and Google to the
+// normalized ones. The providers' spellings don't collide, so one map serves them all.
+var providerFinishReasons = map[string]string{
+	// OpenAI
+	"stop":           FinishReasonStop,
+	"length":         FinishReasonLength,
+	"content_filter": FinishReasonContentFilter,
+	"tool_calls":     FinishReasonToolCalls,
+	"function_call":  FinishReasonToolCalls,
+	// Anthropic
+	"end_turn":                      FinishReasonStop,
+	"stop_sequence":                 FinishReasonStop,
+	"pause_turn":                    FinishReasonStop,
+	"max_tokens":                    FinishReasonLength,
+	"model_context_window_exceeded": FinishReasonLength,
+	"tool_use":                      FinishReasonToolCalls,
+	"refusal":                       FinishReasonContentFilter,
+	// Google
+	"STOP":                    FinishReasonStop,
+	"MAX_TOKENS":              FinishReasonLength,
+	"SAFETY":                  FinishReasonContentFilter,
+	"RECITATION":              FinishReasonContentFilter,
+	"BLOCKLIST":               FinishReasonContentFilter,
+	"PROHIBITED_CONTENT":      FinishReasonContentFilter,
+	"SPII":                    FinishReasonContentFilter,
+	"IMAGE_SAFETY":            FinishReasonContentFilter,
+	"MALFORMED_FUNCTION_CALL": FinishReasonToolCalls,
+	"UNEXPECTED_TOOL_CALL":    FinishReasonToolCalls,
+}
+
+// NormalizeFinishReason maps a provider's finish reason to a normalized one. An empty reason,
+// or Google's unspecified one, stays empty since the provider didn't say.
+func NormalizeFinishReason(reason string) string {
+	if reason == "" || reason == "FINISH_REASON_UNSPECIFIED" {
+		return ""
+	}
+	if normalized, ok := providerFinishReasons[reason]; ok {
+		return normalized
+	}
+	return FinishReasonOther
+}
+
+// FinishReasonReader is implemented by streams that report why the provider ended them, once
+// they have been read to the end
+type FinishReasonReader interface {
+	// ProviderFinishReason returns the normalized finish reason, or "" if none was reported
+	ProviderFinishReason() string
 }
 
 // GenerateParams represents the parameters for text generation
@@ -75,20 +196,106 @@ type StreamChunk struct {
 	Metadata     map[string]string `json:"metadata,omitempty"`
 }
 
+// Endpoint directs a provider client to an endpoint other than the provider's default, such as
+// another region or an Azure OpenAI resource
+type Endpoint struct {
+	Name    string
+	BaseURL string
+	// AuthHeader sends the API key in this header rather than the provider's usual one
+	AuthHeader string
+}
+
 // NewClientForModel creates a specific provider client instance using the provided API key
 func NewClientForModel(modelID, provider, apiKey string) (LLMClient, error) {
+	return NewClientForEndpoint(modelID, provider, apiKey, nil)
+}
+
+// NewClientForEndpoint creates a provider client that calls endpoint, or the provider's default
+// endpoint when it is nil
+func NewClientForEndpoint(modelID, provider, apiKey string, endpoint *Endpoint) (LLMClient, error) {
 	switch provider {
 	case "openai":
-		return NewOpenAIClient(modelID, apiKey)
+		return &OpenAIClient{modelID: modelID, apiKey: apiKey, endpoint: endpoint}, nil
 	case "anthropic":
-		return NewAnthropicClient(modelID, apiKey)
+		return &AnthropicClient{modelID: modelID, apiKey: apiKey, endpoint: endpoint}, nil
 	case "google":
-		return NewGoogleClient(modelID, apiKey)
+		client, err := NewGoogleClient(modelID, apiKey)
+		if err != nil {
+			return nil, err
+		}
+		client.(*GoogleClient).endpoint = endpoint
+		return client, nil
 	default:
 		return nil, fmt.Errorf("unsupported provider: %s", provider)
 	}
 }
 
+// stopSequences returns the "stop" parameter as a list, accepting a single string or a list
+func stopSequences(params map[string]interface{}) []string {
+	switch stop := params["stop"].(type) {
+	case string:
+		if stop != "" {
+			return []string{stop}
+		}
+	case []string:
+		return stop
+	}
+	return nil
+}
+
+// systemParam returns the "system" parameter, the instructions sent ahead of the prompt
+func systemParam(params map[string]interface{}) string {
+	system, _ := params["system"].(string)
+	return system
+}
+
+// floatParam returns a float parameter and whether it was set
+func floatParam(params map[string]interface{}, key string) (float64, bool) {
+	value, ok := params[key].(float64)
+	return value, ok
+}
+
+// seedParam returns the "seed" parameter and whether it was set
+func seedParam(params map[string]interface{}) (int64, bool) {
+	seed, ok := params["seed"].(int64)
+	return seed, ok
+}
+
+// cacheParams returns whether the "cache_system" and "cache_prompt" parameters ask for the system
+// instructions, and everything up to the end of the prompt, to be written to the prompt cache
+func cacheParams(params map[string]interface{}) (system, prompt bool) {
+	system, _ = params["cache_system"].(bool)
+	prompt, _ = params["cache_prompt"].(bool)
+	return system, prompt
+}
+
+// effortThinkingBudgets are the thinking budgets the reasoning efforts stand for on providers that
+// take a budget rather than an effort, as in Gemini's OpenAI compatibility
+var effortThinkingBudgets = map[string]int{"low": 1024, "medium": 8192, "high": 24576}
+
+// reasoningEffort returns the "reasoning_effort" parameter: low, medium or high
+func reasoningEffort(params map[string]interface{}) string {
+	effort, _ := params["reasoning_effort"].(string)
+	return effort
+}
+
+// thinkingBudget returns the "thinking_budget" parameter, the most tokens a model may spend
+// thinking, or else the budget "reasoning_effort" stands for; 0 leaves thinking at the default
+func thinkingBudget(params map[string]interface{}) int {
+	if budget, ok := params["thinking_budget"].(int); ok && budget > 0 {
+		return budget
+	}
+	return effortThinkingBudgets[reasoningEffort(params)]
+}
+
+// logprobsParams returns whether the "logprobs" parameter requests token log probabilities and
+// the "top_logprobs" number of alternatives to return at each position
+func logprobsParams(params map[string]interface{}) (bool, int) {
+	enabled, _ := params["logprobs"].(bool)
+	top, _ := params["top_logprobs"].(int)
+	return enabled, top
+}
+
 // IsRetryableError checks if an error is retryable
 func IsRetryableError(err error) bool {
 	if providerErr, ok := err.(*ProviderError); ok {
@@ -0,0 +1,178 @@
+package data
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultFakeResponse is the fake client's response template: it echoes the prompt
+const DefaultFakeResponse = "[{{provider}}/{{model}}] {{prompt}}"
+
+// FakeClient is a deterministic LLMClient for development mode and tests. It answers without
+// calling a provider, filling a template with the prompt, and reports synthetic usage of about
+// one token per four characters, so pricing, billing and logging run as they would in production.
+type FakeClient struct {
+	modelID  string
+	provider string
+	template string
+}
+
+// NewFakeClient creates a fake client that answers as provider's modelID. The template may use
+// {{prompt}}, {{system}}, {{model}} and {{provider}}; empty uses DefaultFakeResponse.
+func NewFakeClient(modelID, provider, template string) *FakeClient {
+	if template == "" {
+		template = DefaultFakeResponse
+	}
+	return &FakeClient{modelID: modelID, provider: provider, template: template}
+}
+
+// GenerateWithParams returns the templated response
+func (c *FakeClient) GenerateWithParams(ctx context.Context, params map[string]interface{}) (*GenerateResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	text, inputTokens, outputTokens, finishReason, err := c.respond(params)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := map[string]string{"fake": "true"}
+	if seed, ok := seedParam(params); ok {
+		metadata["seed"] = strconv.FormatInt(seed, 10)
+	}
+
+	return &GenerateResponse{
+		Text:         text,
+		InputTokens:  inputTokens,
+		OutputTokens: outputTokens,
+		Usage: &UsageInfo{
+			PromptTokens:     inputTokens,
+			CompletionTokens: outputTokens,
+			TotalTokens:      inputTokens + outputTokens,
+		},
+		FinishReason: finishReason,
+		ModelID:      c.modelID,
+		Provider:     c.provider,
+		Metadata:     metadata,
+	}, nil
+}
+
+// GenerateStream streams the templated response a word at a time
+func (c *FakeClient) GenerateStream(ctx context.Context, params map[string]interface{}) (*StreamResponse, error) {
+	text, inputTokens, outputTokens, finishReason, err := c.respond(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StreamResponse{
+		Stream: &FakeStreamReader{
+			ctx:          ctx,
+			chunks:       strings.SplitAfter(text, " "),
+			inputTokens:  inputTokens,
+			outputTokens: outputTokens,
+			finishReason: finishReason,
+		},
+		Metadata: map[string]string{
+			"provider": c.provider,
+			"model_id": c.modelID,
+			"fake":     "true",
+		},
+	}, nil
+}
+
+// respond renders the response for params, cut at the first stop sequence and at max_tokens
+func (c *FakeClient) respond(params map[string]interface{}) (text string, inputTokens, outputTokens int, finishReason string, err error) {
+	prompt, ok := params["prompt"].(string)
+	if !ok {
+		return "", 0, 0, "", &ProviderError{
+			Provider:  c.provider,
+			ModelID:   c.modelID,
+			Message:   "prompt parameter is required and must be a string",
+			Retryable: false,
+		}
+	}
+	system := systemParam(params)
+
+	text = strings.NewReplacer(
+		"{{prompt}}", prompt,
+		"{{system}}", system,
+		"{{model}}", c.modelID,
+		"{{provider}}", c.provider,
+	).Replace(c.template)
+
+	finishReason = "stop"
+	for _, stop := range stopSequences(params) {
+		if i := strings.Index(text, stop); i >= 0 {
+			text = text[:i]
+		}
+	}
+	if maxTokens, ok := params["max_tokens"].(int); ok && maxTokens > 0 && fakeTokens(text) > maxTokens {
+		text = truncateRunes(text, maxTokens*4)
+		finishReason = "length"
+	}
+
+	return text, fakeTokens(system) + fakeTokens(prompt), fakeTokens(text), finishReason, nil
+}
+
+// fakeTokens approximates a token count at four characters per token
+func fakeTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// truncateRunes returns at most n runes of s
+func truncateRunes(s string, n int) string {
+	for i := range s {
+		if n == 0 {
+			return s[:i]
+		}
+		n--
+	}
+	return s
+}
+
+// FakeStreamReader streams a fake response in chunks
+type FakeStreamReader struct {
+	ctx          context.Context
+	chunks       []string
+	pending      string
+	inputTokens  int
+	outputTokens int
+	finishReason string
+}
+
+func (r *FakeStreamReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	for r.pending == "" {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		r.pending, r.chunks = r.chunks[0], r.chunks[1:]
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *FakeStreamReader) Close() error {
+	r.chunks, r.pending = nil, ""
+	return nil
+}
+
+// GetUsage returns the synthetic usage of the streamed response
+func (r *FakeStreamReader) GetUsage() (int, int) {
+	return r.inputTokens, r.outputTokens
+}
+
+// ProviderFinishReason returns why the streamed response ended, once it has been read to the end
+func (r *FakeStreamReader) ProviderFinishReason() string {
+	if len(r.chunks) > 0 || r.pending != "" {
+		return ""
+	}
+	return r.finishReason
+}
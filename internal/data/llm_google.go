@@ -6,24 +6,140 @@ import (
 	"io"
 	"iter"
 	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
 
 	"google.golang.org/genai"
 )
 
 // GoogleClient implements LLMClient for Google
 type GoogleClient struct {
-	modelID string
-	apiKey  string
+	modelID  string
+	apiKey   string
+	endpoint *Endpoint
 }
 
-// NewGoogleClient creates a new Google client
+// googleModelPrefixes are the model families served by the Gemini API
+var googleModelPrefixes = []string{"gemini-", "gemma-"}
+
+// NewGoogleClient creates a new Google client.
+// Model IDs are passed to the Gemini API unchanged, so unsupported models are rejected up front.
 func NewGoogleClient(modelID, apiKey string) (LLMClient, error) {
+	supported := false
+	for _, prefix := range googleModelPrefixes {
+		if strings.HasPrefix(modelID, prefix) {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return nil, &ProviderError{
+			Provider:  "google",
+			ModelID:   modelID,
+			Message:   fmt.Sprintf("unsupported model: %s", modelID),
+			Retryable: false,
+		}
+	}
+
 	return &GoogleClient{
 		modelID: modelID,
 		apiKey:  apiKey,
 	}, nil
 }
 
+// clientConfig authenticates with the client's key and directs calls to its endpoint, or to the
+// provider's configured network
+func (c *GoogleClient) clientConfig() *genai.ClientConfig {
+	client, baseURL := providerHTTP("google")
+	config := &genai.ClientConfig{
+		APIKey:     c.apiKey,
+		Backend:    genai.BackendGeminiAPI,
+		HTTPClient: client,
+	}
+	config.HTTPOptions.BaseURL = baseURL
+	if c.endpoint != nil {
+		config.HTTPOptions.BaseURL = c.endpoint.BaseURL
+		if c.endpoint.AuthHeader != "" {
+			config.HTTPOptions.Headers = http.Header{c.endpoint.AuthHeader: []string{c.apiKey}}
+		}
+	}
+	return config
+}
+
+// googleGenerationConfig builds the Gemini generation config from request parameters
+func googleGenerationConfig(params map[string]interface{}) *genai.GenerateContentConfig {
+	config := &genai.GenerateContentConfig{}
+
+	if maxTokens, ok := params["max_tokens"].(int); ok && maxTokens > 0 {
+		config.MaxOutputTokens = int32(maxTokens)
+	}
+	if temperature, ok := params["temperature"].(float64); ok {
+		config.Temperature = genai.Ptr(float32(temperature))
+	}
+	if topP, ok := params["top_p"].(float64); ok {
+		config.TopP = genai.Ptr(float32(topP))
+	}
+
+	config.StopSequences = stopSequences(params)
+	if penalty, ok := floatParam(params, "frequency_penalty"); ok {
+		config.FrequencyPenalty = genai.Ptr(float32(penalty))
+	}
+	if penalty, ok := floatParam(params, "presence_penalty"); ok {
+		config.PresencePenalty = genai.Ptr(float32(penalty))
+	}
+	if seed, ok := seedParam(params); ok {
+		config.Seed = genai.Ptr(int32(seed))
+	}
+	if system := systemParam(params); system != "" {
+		config.SystemInstruction = &genai.Content{Parts: []*genai.Part{{Text: system}}}
+	}
+	if budget := thinkingBudget(params); budget > 0 {
+		config.ThinkingConfig = &genai.ThinkingConfig{ThinkingBudget: genai.Ptr(int32(budget))}
+	}
+
+	return config
+}
+
+// googleUsage returns the input, output and reasoning tokens in usage metadata. Gemini reports
+// thinking apart from the candidates but bills it as output, so output includes it.
+func googleUsage(usage *genai.GenerateContentResponseUsageMetadata) (inputTokens, outputTokens, reasoningTokens int) {
+	reasoningTokens = int(usage.ThoughtsTokenCount)
+	return int(usage.PromptTokenCount), int(usage.CandidatesTokenCount) + reasoningTokens, reasoningTokens
+}
+
+// CountTokens counts the prompt's input tokens with the Gemini API's countTokens method. The
+// Gemini API does not accept system instructions there, so they are counted as a leading turn.
+func (c *GoogleClient) CountTokens(ctx context.Context, params map[string]interface{}) (int, error) {
+	prompt, _ := params["prompt"].(string)
+	client, err := genai.NewClient(ctx, c.clientConfig())
+	if err != nil {
+		return 0, &ProviderError{
+			Provider:  "google",
+			ModelID:   c.modelID,
+			Message:   fmt.Sprintf("failed to create client: %v", err),
+			Retryable: false,
+		}
+	}
+
+	var contents []*genai.Content
+	if system := systemParam(params); system != "" {
+		contents = append(contents, &genai.Content{Parts: []*genai.Part{{Text: system}}})
+	}
+	contents = append(contents, &genai.Content{Parts: []*genai.Part{{Text: prompt}}})
+
+	resp, err := client.Models.CountTokens(ctx, c.modelID, contents, nil)
+	if err != nil {
+		return 0, &ProviderError{
+			Provider:  "google",
+			ModelID:   c.modelID,
+			Message:   fmt.Sprintf("failed to count tokens: %v", err),
+			Retryable: true,
+		}
+	}
+	return int(resp.TotalTokens), nil
+}
+
 // GenerateWithParams generates text using Google's API
 func (c *GoogleClient) GenerateWithParams(ctx context.Context, params map[string]interface{}) (*GenerateResponse, error) {
 	slog.Info("Google client: Starting real API call", "model", c.modelID, "api_key_length", len(c.apiKey))
@@ -38,17 +154,10 @@ func (c *GoogleClient) GenerateWithParams(ctx context.Context, params map[string
 		}
 	}
 
-	// Note: maxTokens is not used in the current Gemini API implementation
-	// but kept for future use with generation config
-	_ = params["max_tokens"]
-
 	slog.Info("Google client: Creating client and making API call", "model", c.modelID, "prompt_length", len(prompt))
 
 	// Create Google Gemini client
-	client, err := genai.NewClient(ctx, &genai.ClientConfig{
-		APIKey:  c.apiKey,
-		Backend: genai.BackendGeminiAPI,
-	})
+	client, err := genai.NewClient(ctx, c.clientConfig())
 	if err != nil {
 		slog.Error("Google client: Failed to create client", "error", err, "model", c.modelID)
 		return nil, &ProviderError{
@@ -59,26 +168,13 @@ func (c *GoogleClient) GenerateWithParams(ctx context.Context, params map[string
 		}
 	}
 
-	// Map model ID to Gemini model
-	geminiModel := "gemini-2.0-flash"
-	switch c.modelID {
-	case "gemini-1.5-pro":
-		geminiModel = "gemini-1.5-pro"
-	case "gemini-1.5-flash":
-		geminiModel = "gemini-1.5-flash"
-	case "gemini-2.0-flash":
-		geminiModel = "gemini-2.0-flash"
-	default:
-		geminiModel = "gemini-2.0-flash"
-	}
-
 	// Create content with text
 	content := []*genai.Content{{
 		Parts: []*genai.Part{{Text: prompt}},
 	}}
 
 	// Call the Gemini API
-	resp, err := client.Models.GenerateContent(ctx, geminiModel, content, nil)
+	resp, err := client.Models.GenerateContent(ctx, c.modelID, content, googleGenerationConfig(params))
 	if err != nil {
 		// Try to extract status code and error code from error if possible
 		statusCode := 0
@@ -132,12 +228,19 @@ func (c *GoogleClient) GenerateWithParams(ctx context.Context, params map[string
 
 	slog.Info("Google client: Response received", "model", c.modelID, "response_length", len(responseText))
 
+	metadata := map[string]string{}
+	if seed, ok := seedParam(params); ok {
+		metadata["seed"] = strconv.FormatInt(seed, 10)
+	}
+	if resp.ModelVersion != "" {
+		metadata["model_version"] = resp.ModelVersion
+	}
+
 	// Use actual token usage from provider response if available
-	var inputTokens, outputTokens int
+	var inputTokens, outputTokens, reasoningTokens int
 	if resp.UsageMetadata != nil && (resp.UsageMetadata.PromptTokenCount > 0 || resp.UsageMetadata.CandidatesTokenCount > 0) {
 		// Use actual token counts from Google response
-		inputTokens = int(resp.UsageMetadata.PromptTokenCount)
-		outputTokens = int(resp.UsageMetadata.CandidatesTokenCount)
+		inputTokens, outputTokens, reasoningTokens = googleUsage(resp.UsageMetadata)
 		slog.Info("Google client: Using actual token usage from provider",
 			"input_tokens", inputTokens, "output_tokens", outputTokens)
 	} else {
@@ -157,13 +260,23 @@ func (c *GoogleClient) GenerateWithParams(ctx context.Context, params map[string
 			PromptTokens:     inputTokens,
 			CompletionTokens: outputTokens,
 			TotalTokens:      inputTokens + outputTokens,
+			ReasoningTokens:  reasoningTokens,
 		},
-		FinishReason: "STOP",
+		FinishReason: googleFinishReason(resp),
 		ModelID:      c.modelID,
 		Provider:     "google",
+		Metadata:     metadata,
 	}, nil
 }
 
+// googleFinishReason returns the normalized finish reason of a response's first candidate
+func googleFinishReason(resp *genai.GenerateContentResponse) string {
+	if len(resp.Candidates) == 0 {
+		return ""
+	}
+	return NormalizeFinishReason(string(resp.Candidates[0].FinishReason))
+}
+
 // GenerateStream generates text with streaming response using Google's API
 func (c *GoogleClient) GenerateStream(ctx context.Context, params map[string]interface{}) (*StreamResponse, error) {
 	slog.Info("Google client: Starting streaming API call", "model", c.modelID, "api_key_length", len(c.apiKey))
@@ -180,10 +293,7 @@ func (c *GoogleClient) GenerateStream(ctx context.Context, params map[string]int
 
 	slog.Info("Google client: Creating streaming client", "model", c.modelID, "prompt_length", len(prompt))
 
-	client, err := genai.NewClient(ctx, &genai.ClientConfig{
-		APIKey:  c.apiKey,
-		Backend: genai.BackendGeminiAPI,
-	})
+	client, err := genai.NewClient(ctx, c.clientConfig())
 	if err != nil {
 		slog.Error("Google client: Failed to create client", "error", err, "model", c.modelID)
 		return nil, &ProviderError{
@@ -194,16 +304,11 @@ func (c *GoogleClient) GenerateStream(ctx context.Context, params map[string]int
 		}
 	}
 
-	// Use gemini-2.0-flash as the model
-	geminiModel := "gemini-2.0-flash"
-
-	slog.Info("Google client: Using Gemini model", "input_model", c.modelID, "gemini_model", geminiModel)
-
 	content := []*genai.Content{{
 		Parts: []*genai.Part{{Text: prompt}},
 	}}
 
-	stream := client.Models.GenerateContentStream(ctx, geminiModel, content, nil)
+	stream := client.Models.GenerateContentStream(ctx, c.modelID, content, googleGenerationConfig(params))
 
 	streamReader := &GoogleStreamReader{
 		stream: stream,
@@ -237,6 +342,10 @@ type GoogleStreamReader struct {
 	inputTokens  int
 	outputTokens int
 	usageFound   bool
+	// reasoningTokens are the thinking tokens, which outputTokens includes
+	reasoningTokens int
+	// finishReason is the normalized finish reason of the last response that had one
+	finishReason string
 }
 
 func (r *GoogleStreamReader) Read(p []byte) (n int, err error) {
@@ -298,8 +407,7 @@ func (r *GoogleStreamReader) Read(p []byte) (n int, err error) {
 
 		// Check for usage information in the response
 		if !r.usageFound && resp.UsageMetadata != nil {
-			r.inputTokens = int(resp.UsageMetadata.PromptTokenCount)
-			r.outputTokens = int(resp.UsageMetadata.CandidatesTokenCount)
+			r.inputTokens, r.outputTokens, r.reasoningTokens = googleUsage(resp.UsageMetadata)
 			if r.inputTokens > 0 || r.outputTokens > 0 {
 				r.usageFound = true
 				slog.Info("Google streaming: Captured usage from response",
@@ -311,8 +419,7 @@ func (r *GoogleStreamReader) Read(p []byte) (n int, err error) {
 		if !r.usageFound && (len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0) {
 			// This might be the final chunk with usage data
 			if resp.UsageMetadata != nil {
-				r.inputTokens = int(resp.UsageMetadata.PromptTokenCount)
-				r.outputTokens = int(resp.UsageMetadata.CandidatesTokenCount)
+				r.inputTokens, r.outputTokens, r.reasoningTokens = googleUsage(resp.UsageMetadata)
 				if r.inputTokens > 0 || r.outputTokens > 0 {
 					r.usageFound = true
 					slog.Info("Google streaming: Captured usage from final chunk",
@@ -335,14 +442,17 @@ func (r *GoogleStreamReader) Read(p []byte) (n int, err error) {
 		if resp.UsageMetadata != nil {
 			// Update usage data if we haven't found it yet or if this response has more complete data
 			if !r.usageFound || (resp.UsageMetadata.PromptTokenCount > 0 && resp.UsageMetadata.CandidatesTokenCount > 0) {
-				r.inputTokens = int(resp.UsageMetadata.PromptTokenCount)
-				r.outputTokens = int(resp.UsageMetadata.CandidatesTokenCount)
+				r.inputTokens, r.outputTokens, r.reasoningTokens = googleUsage(resp.UsageMetadata)
 				r.usageFound = true
 				slog.Info("Google streaming: Updated usage from response",
 					"input_tokens", r.inputTokens, "output_tokens", r.outputTokens)
 			}
 		}
 
+		if reason := googleFinishReason(resp); reason != "" {
+			r.finishReason = reason
+		}
+
 		if len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0 {
 			slog.Debug("GoogleStreamReader: No candidates or content parts in response")
 			return 0, nil
@@ -395,3 +505,13 @@ func (r *GoogleStreamReader) Close() error {
 func (r *GoogleStreamReader) GetUsage() (int, int) {
 	return r.inputTokens, r.outputTokens
 }
+
+// ProviderFinishReason returns why Google ended the stream, normalized
+func (r *GoogleStreamReader) ProviderFinishReason() string {
+	return r.finishReason
+}
+
+// GetTokenDetails returns the thinking tokens, which GetUsage's output tokens include
+func (r *GoogleStreamReader) GetTokenDetails() TokenDetails {
+	return TokenDetails{ReasoningTokens: r.reasoningTokens}
+}
@@ -0,0 +1,172 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+)
+
+// Moderation actions configured per pricing tier
+const (
+	// ModerationActionBlock rejects flagged content
+	ModerationActionBlock = "block"
+	// ModerationActionFlag allows flagged content and records the result in the request log
+	ModerationActionFlag = "flag"
+	// ModerationActionAnnotate also returns the result to the caller in the response metadata
+	ModerationActionAnnotate = "annotate"
+)
+
+// ModerationSettings configures content moderation for a pricing tier
+type ModerationSettings struct {
+	// Prompts and Completions choose which side of the conversation is checked
+	Prompts     bool   `firestore:"prompts" json:"prompts"`
+	Completions bool   `firestore:"completions" json:"completions"`
+	Action      string `firestore:"action" json:"action"`
+}
+
+// Enabled reports whether any moderation is configured
+func (m ModerationSettings) Enabled() bool {
+	return m.Prompts || m.Completions
+}
+
+// ModerationResult is a classifier's verdict on a piece of text
+type ModerationResult struct {
+	Flagged bool `firestore:"flagged" json:"flagged"`
+	// Categories lists the flagged categories, with their scores in Scores
+	Categories []string           `firestore:"categories,omitempty" json:"categories,omitempty"`
+	Scores     map[string]float64 `firestore:"scores,omitempty" json:"scores,omitempty"`
+	Model      string             `firestore:"model,omitempty" json:"model,omitempty"`
+}
+
+// ModerationRecord holds the moderation results for a request, stored on its request log
+type ModerationRecord struct {
+	Action     string            `firestore:"action" json:"action"`
+	Prompt     *ModerationResult `firestore:"prompt,omitempty" json:"prompt,omitempty"`
+	Completion *ModerationResult `firestore:"completion,omitempty" json:"completion,omitempty"`
+	Blocked    bool              `firestore:"blocked" json:"blocked"`
+}
+
+// Moderator classifies text for unsafe content
+type Moderator interface {
+	Moderate(ctx context.Context, text string) (*ModerationResult, error)
+}
+
+// moderationResponse is the OpenAI moderation response shape, which HTTP classifiers also return
+type moderationResponse struct {
+	Model   string `json:"model"`
+	Results []struct {
+		Flagged        bool               `json:"flagged"`
+		Categories     map[string]bool    `json:"categories"`
+		CategoryScores map[string]float64 `json:"category_scores"`
+	} `json:"results"`
+}
+
+// toResult converts the first result, keeping scores only for flagged categories
+func (r *moderationResponse) toResult() (*ModerationResult, error) {
+	if len(r.Results) == 0 {
+		return nil, fmt.Errorf("moderation response has no results")
+	}
+
+	first := r.Results[0]
+	result := &ModerationResult{Flagged: first.Flagged, Model: r.Model}
+	for category, flagged := range first.Categories {
+		if !flagged {
+			continue
+		}
+		result.Categories = append(result.Categories, category)
+		if result.Scores == nil {
+			result.Scores = make(map[string]float64)
+		}
+		result.Scores[category] = first.CategoryScores[category]
+	}
+	sort.Strings(result.Categories)
+
+	return result, nil
+}
+
+// OpenAIModerator classifies text with the OpenAI moderation endpoint
+type OpenAIModerator struct {
+	apiKey string
+	model  string
+}
+
+// NewOpenAIModerator creates a moderator using the OpenAI moderation endpoint
+func NewOpenAIModerator(apiKey, model string) *OpenAIModerator {
+	return &OpenAIModerator{apiKey: apiKey, model: model}
+}
+
+// Moderate classifies text with the OpenAI moderation endpoint
+func (m *OpenAIModerator) Moderate(ctx context.Context, text string) (*ModerationResult, error) {
+	httpClient, baseURL := providerHTTP("openai")
+	opts := []option.RequestOption{option.WithAPIKey(m.apiKey), option.WithHTTPClient(httpClient)}
+	if baseURL != "" {
+		opts = append(opts, option.WithBaseURL(baseURL))
+	}
+	client := openai.NewClient(opts...)
+
+	resp, err := client.Moderations.New(ctx, openai.ModerationNewParams{
+		Input: openai.ModerationNewParamsInputUnion{OfString: openai.String(text)},
+		Model: openai.ModerationModel(m.model),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("moderation request failed: %w", err)
+	}
+
+	// The typed categories are fixed structs; the raw JSON gives them as a map
+	var parsed moderationResponse
+	if err := json.Unmarshal([]byte(resp.RawJSON()), &parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse moderation response: %w", err)
+	}
+	return parsed.toResult()
+}
+
+// HTTPModerator classifies text with a self-hosted classifier that accepts {"input": "..."}
+// and returns an OpenAI-compatible moderation response
+type HTTPModerator struct {
+	endpoint string
+	apiKey   string
+}
+
+// NewHTTPModerator creates a moderator that calls a classifier endpoint
+func NewHTTPModerator(endpoint, apiKey string) *HTTPModerator {
+	return &HTTPModerator{endpoint: endpoint, apiKey: apiKey}
+}
+
+// Moderate classifies text with the configured classifier endpoint
+func (m *HTTPModerator) Moderate(ctx context.Context, text string) (*ModerationResult, error) {
+	body, err := json.Marshal(map[string]string{"input": text})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode moderation request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create moderation request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if m.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+m.apiKey)
+	}
+
+	resp, err := providerHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("moderation request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("moderation endpoint returned status %d", resp.StatusCode)
+	}
+
+	var parsed moderationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse moderation response: %w", err)
+	}
+	return parsed.toResult()
+}
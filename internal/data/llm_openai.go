@@ -5,16 +5,19 @@ import (
 	"errors"
 	"io"
 	"log/slog"
-	"reflect"
+	"strconv"
 
 	openai "github.com/openai/openai-go"
 	"github.com/openai/openai-go/option"
+	"github.com/openai/openai-go/packages/param"
+	"github.com/openai/openai-go/packages/ssestream"
 )
 
 // OpenAIClient implements LLMClient for OpenAI
 type OpenAIClient struct {
-	modelID string
-	apiKey  string
+	modelID  string
+	apiKey   string
+	endpoint *Endpoint
 }
 
 // NewOpenAIClient creates a new OpenAI client
@@ -25,6 +28,85 @@ func NewOpenAIClient(modelID, apiKey string) (LLMClient, error) {
 	}, nil
 }
 
+// requestOptions authenticates with the client's key and directs calls to its endpoint, or to the
+// provider's configured network
+func (c *OpenAIClient) requestOptions() []option.RequestOption {
+	client, baseURL := providerHTTP("openai")
+	opts := []option.RequestOption{option.WithHTTPClient(client)}
+	if c.endpoint == nil {
+		if baseURL != "" {
+			opts = append(opts, option.WithBaseURL(baseURL))
+		}
+		return append(opts, option.WithAPIKey(c.apiKey))
+	}
+	opts = append(opts, option.WithBaseURL(c.endpoint.BaseURL))
+	if c.endpoint.AuthHeader != "" {
+		return append(opts, option.WithHeader(c.endpoint.AuthHeader, c.apiKey))
+	}
+	return append(opts, option.WithAPIKey(c.apiKey))
+}
+
+// applyOpenAISamplingParams sets stop sequences and penalties from request parameters
+func applyOpenAISamplingParams(chatParams *openai.ChatCompletionNewParams, params map[string]interface{}) {
+	if topP, ok := floatParam(params, "top_p"); ok {
+		chatParams.TopP = openai.Float(topP)
+	}
+	if stop := stopSequences(params); len(stop) > 0 {
+		chatParams.Stop = openai.ChatCompletionNewParamsStopUnion{OfStringArray: stop}
+	}
+	if penalty, ok := floatParam(params, "frequency_penalty"); ok {
+		chatParams.FrequencyPenalty = openai.Float(penalty)
+	}
+	if penalty, ok := floatParam(params, "presence_penalty"); ok {
+		chatParams.PresencePenalty = openai.Float(penalty)
+	}
+	if seed, ok := seedParam(params); ok {
+		chatParams.Seed = openai.Int(seed)
+	}
+	if logprobs, top := logprobsParams(params); logprobs {
+		chatParams.Logprobs = openai.Bool(true)
+		if top > 0 {
+			chatParams.TopLogprobs = openai.Int(int64(top))
+		}
+	}
+	// Reasoning models take max_completion_tokens, which also bounds their reasoning, and reject
+	// a temperature
+	if effort := reasoningEffort(params); effort != "" {
+		chatParams.ReasoningEffort = openai.ReasoningEffort(effort)
+		chatParams.MaxCompletionTokens = chatParams.MaxTokens
+		chatParams.MaxTokens = param.Opt[int64]{}
+		chatParams.Temperature = param.Opt[float64]{}
+	}
+}
+
+// openAILogprobs converts OpenAI token logprobs
+func openAILogprobs(content []openai.ChatCompletionTokenLogprob) []TokenLogprob {
+	if len(content) == 0 {
+		return nil
+	}
+	logprobs := make([]TokenLogprob, len(content))
+	for i, token := range content {
+		logprobs[i] = TokenLogprob{Token: token.Token, Logprob: token.Logprob, Bytes: token.Bytes}
+		for _, top := range token.TopLogprobs {
+			logprobs[i].TopLogprobs = append(logprobs[i].TopLogprobs, TopLogprob{Token: top.Token, Logprob: top.Logprob, Bytes: top.Bytes})
+		}
+	}
+	return logprobs
+}
+
+// openAIMessages builds the chat messages for a prompt, preceded by any system instructions
+func openAIMessages(prompt string, params map[string]interface{}) []openai.ChatCompletionMessageParamUnion {
+	if system := systemParam(params); system != "" {
+		return []openai.ChatCompletionMessageParamUnion{
+			openai.SystemMessage(system),
+			openai.UserMessage(prompt),
+		}
+	}
+	return []openai.ChatCompletionMessageParamUnion{
+		openai.UserMessage(prompt),
+	}
+}
+
 // GenerateWithParams generates text using OpenAI's API
 func (c *OpenAIClient) GenerateWithParams(ctx context.Context, params map[string]interface{}) (*GenerateResponse, error) {
 	slog.Info("OpenAI client: Starting real API call", "model", c.modelID, "api_key_length", len(c.apiKey))
@@ -50,15 +132,16 @@ func (c *OpenAIClient) GenerateWithParams(ctx context.Context, params map[string
 
 	slog.Info("OpenAI client: Creating client and making API call", "model", c.modelID, "prompt_length", len(prompt))
 
-	client := openai.NewClient(option.WithAPIKey(c.apiKey))
-	resp, err := client.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
-		Messages: []openai.ChatCompletionMessageParamUnion{
-			openai.UserMessage(prompt),
-		},
+	client := openai.NewClient(c.requestOptions()...)
+	chatParams := openai.ChatCompletionNewParams{
+		Messages:    openAIMessages(prompt, params),
 		Model:       openai.ChatModel(c.modelID),
 		MaxTokens:   openai.Int(int64(maxTokens)),
 		Temperature: openai.Float(temperature),
-	})
+	}
+	applyOpenAISamplingParams(&chatParams, params)
+
+	resp, err := client.Chat.Completions.New(ctx, chatParams)
 	if err != nil {
 		// Try to extract structured error info
 		var apiErr *openai.Error
@@ -120,18 +203,31 @@ func (c *OpenAIClient) GenerateWithParams(ctx context.Context, params map[string
 		outputTokens = 0
 	}
 
+	// Report what determinism depends on, so callers can tell when a backend change breaks reproducibility
+	metadata := map[string]string{}
+	if resp.SystemFingerprint != "" {
+		metadata["system_fingerprint"] = resp.SystemFingerprint
+	}
+	if seed, ok := seedParam(params); ok {
+		metadata["seed"] = strconv.FormatInt(seed, 10)
+	}
+
 	return &GenerateResponse{
 		Text:         responseText,
 		InputTokens:  inputTokens,
 		OutputTokens: outputTokens,
 		Usage: &UsageInfo{
-			PromptTokens:     inputTokens,
-			CompletionTokens: outputTokens,
-			TotalTokens:      inputTokens + outputTokens,
+			PromptTokens:      inputTokens,
+			CompletionTokens:  outputTokens,
+			TotalTokens:       inputTokens + outputTokens,
+			CachedInputTokens: int(resp.Usage.PromptTokensDetails.CachedTokens),
+			ReasoningTokens:   int(resp.Usage.CompletionTokensDetails.ReasoningTokens),
 		},
-		FinishReason: string(resp.Choices[0].FinishReason),
+		FinishReason: NormalizeFinishReason(string(resp.Choices[0].FinishReason)),
 		ModelID:      c.modelID,
 		Provider:     "openai",
+		Metadata:     metadata,
+		Logprobs:     openAILogprobs(resp.Choices[0].Logprobs.Content),
 	}, nil
 }
 
@@ -160,7 +256,7 @@ func (c *OpenAIClient) GenerateStream(ctx context.Context, params map[string]int
 
 	slog.Info("OpenAI client: Creating streaming client", "model", c.modelID, "prompt_length", len(prompt))
 
-	client := openai.NewClient(option.WithAPIKey(c.apiKey))
+	client := openai.NewClient(c.requestOptions()...)
 
 	// Check if include_usage is requested
 	includeUsage := false
@@ -169,13 +265,12 @@ func (c *OpenAIClient) GenerateStream(ctx context.Context, params map[string]int
 	}
 
 	streamParams := openai.ChatCompletionNewParams{
-		Messages: []openai.ChatCompletionMessageParamUnion{
-			openai.UserMessage(prompt),
-		},
+		Messages:    openAIMessages(prompt, params),
 		Model:       openai.ChatModel(c.modelID),
 		MaxTokens:   openai.Int(int64(maxTokens)),
 		Temperature: openai.Float(temperature),
 	}
+	applyOpenAISamplingParams(&streamParams, params)
 
 	// Add stream options if include_usage is requested
 	if includeUsage {
@@ -200,17 +295,28 @@ func (c *OpenAIClient) GenerateStream(ctx context.Context, params map[string]int
 	}, nil
 }
 
-// OpenAIStreamReader wraps the OpenAI stream to implement io.ReadCloser
+// OpenAIStreamReader is a stream reader for OpenAI chat completions.
+// It emits content deltas and captures usage from the terminal chunk.
 type OpenAIStreamReader struct {
-	stream  interface{}
+	stream  *ssestream.Stream[openai.ChatCompletionChunk]
 	modelID string
 	buffer  []byte
 	pos     int
 	closed  bool
-	// Usage tracking
+	// Usage tracking; with include_usage every chunk carries a null usage except the last, which
+	// has no choices and reports the whole request's usage
 	inputTokens  int
 	outputTokens int
 	usageFound   bool
+	// cachedTokens are the prompt tokens OpenAI served from its prompt cache, which caches long
+	// prompts automatically
+	cachedTokens int
+	// reasoningTokens are the completion tokens a reasoning model spent thinking
+	reasoningTokens int
+	// logprobs holds the token logprobs received since TakeLogprobs was last called
+	logprobs []TokenLogprob
+	// finishReason is the finish reason of the last chunk that had one
+	finishReason string
 }
 
 func (r *OpenAIStreamReader) Read(p []byte) (n int, err error) {
@@ -218,91 +324,74 @@ func (r *OpenAIStreamReader) Read(p []byte) (n int, err error) {
 		return 0, io.EOF
 	}
 
-	// If buffer has data, return it
-	if r.pos < len(r.buffer) {
-		n = copy(p, r.buffer[r.pos:])
-		r.pos += n
-		if r.pos >= len(r.buffer) {
-			r.buffer = nil
-			r.pos = 0
-		}
-		return n, nil
-	}
-
-	// Use reflection to call Next() and Current()
-	streamValue := reflect.ValueOf(r.stream)
-	// Call Next()
-	nextMethod := streamValue.MethodByName("Next")
-	if !nextMethod.IsValid() {
-		r.closed = true
-		return 0, io.EOF
-	}
-	nextResult := nextMethod.Call(nil)
-	if len(nextResult) == 0 || !nextResult[0].Bool() {
-		// Check for error
-		errMethod := streamValue.MethodByName("Err")
-		if errMethod.IsValid() {
-			errResult := errMethod.Call(nil)
-			if len(errResult) > 0 && !errResult[0].IsNil() {
-				r.closed = true
-				return 0, errResult[0].Interface().(error)
+	// Skip chunks without content rather than returning empty reads
+	for r.pos >= len(r.buffer) {
+		if !r.stream.Next() {
+			r.closed = true
+			if err := r.stream.Err(); err != nil {
+				slog.Error("OpenAIStreamReader: Stream error", "error", err)
+				return 0, err
+			}
+			if !r.usageFound {
+				slog.Warn("OpenAI streaming: Stream ended without a usage chunk", "model", r.modelID)
 			}
+			return 0, io.EOF
 		}
-		r.closed = true
-		return 0, io.EOF
-	}
-	// Call Current()
-	currentMethod := streamValue.MethodByName("Current")
-	if !currentMethod.IsValid() {
-		r.closed = true
-		return 0, io.EOF
-	}
-	currentResult := currentMethod.Call(nil)
-	if len(currentResult) == 0 {
-		r.closed = true
-		return 0, io.EOF
-	}
 
-	// Type assert to openai.ChatCompletionChunk
-	chunk, ok := currentResult[0].Interface().(openai.ChatCompletionChunk)
-	if !ok {
-		return 0, nil
+		r.buffer = []byte(r.handleChunk(r.stream.Current()))
+		r.pos = 0
 	}
 
-	// Check for usage information in the final chunk
-	// According to OpenAI docs, when include_usage=true, the final chunk has usage data
-	if !r.usageFound && (chunk.Usage.PromptTokens > 0 || chunk.Usage.CompletionTokens > 0) {
+	n = copy(p, r.buffer[r.pos:])
+	r.pos += n
+	return n, nil
+}
+
+// handleChunk records usage from a stream chunk and returns any content it carries
+func (r *OpenAIStreamReader) handleChunk(chunk openai.ChatCompletionChunk) string {
+	if chunk.JSON.Usage.Valid() {
 		r.inputTokens = int(chunk.Usage.PromptTokens)
 		r.outputTokens = int(chunk.Usage.CompletionTokens)
+		r.cachedTokens = int(chunk.Usage.PromptTokensDetails.CachedTokens)
+		r.reasoningTokens = int(chunk.Usage.CompletionTokensDetails.ReasoningTokens)
 		r.usageFound = true
-		slog.Info("OpenAI streaming: Captured usage from final chunk",
+		slog.Debug("OpenAI streaming: Captured usage from final chunk",
 			"input_tokens", r.inputTokens, "output_tokens", r.outputTokens)
 	}
 
-	var content string
-	if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
-		content = chunk.Choices[0].Delta.Content
-	}
-	if content != "" {
-		r.buffer = []byte(content)
-		r.pos = 0
-		n = copy(p, r.buffer)
-		r.pos += n
-		if r.pos >= len(r.buffer) {
-			r.buffer = nil
-			r.pos = 0
+	if len(chunk.Choices) > 0 {
+		if chunk.Choices[0].FinishReason != "" {
+			r.finishReason = chunk.Choices[0].FinishReason
 		}
-		return n, nil
+		r.logprobs = append(r.logprobs, openAILogprobs(chunk.Choices[0].Logprobs.Content)...)
+		return chunk.Choices[0].Delta.Content
 	}
-	return 0, nil
+	return ""
 }
 
 func (r *OpenAIStreamReader) Close() error {
 	r.closed = true
-	return nil
+	return r.stream.Close()
 }
 
 // GetUsage returns the captured usage information
 func (r *OpenAIStreamReader) GetUsage() (int, int) {
 	return r.inputTokens, r.outputTokens
 }
+
+// ProviderFinishReason returns why OpenAI ended the stream, normalized
+func (r *OpenAIStreamReader) ProviderFinishReason() string {
+	return NormalizeFinishReason(r.finishReason)
+}
+
+// GetTokenDetails returns the prompt tokens served from OpenAI's prompt cache and the reasoning tokens
+func (r *OpenAIStreamReader) GetTokenDetails() TokenDetails {
+	return TokenDetails{CacheReadTokens: r.cachedTokens, ReasoningTokens: r.reasoningTokens}
+}
+
+// TakeLogprobs returns the token logprobs received since the last call
+func (r *OpenAIStreamReader) TakeLogprobs() []TokenLogprob {
+	logprobs := r.logprobs
+	r.logprobs = nil
+	return logprobs
+}
@@ -0,0 +1,240 @@
+package data
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// ErrInvalidPriceList is returned for price lists that can't be used
+var ErrInvalidPriceList = errors.New("invalid model price list")
+
+// modelPricesJSON is the canonical model price list. Change prices there, bumping its version,
+// and never in code or seed files.
+//
+//go:embed model_prices.json
+var modelPricesJSON []byte
+
+// ModelPriceList is the canonical list of the models AptRouter routes to, priced as their
+// providers publish them. The pricing service falls back to it, seeds write it to
+// model_configurations, and aptrouter-admin check-prices reports where Firestore or the
+// providers' published prices have drifted from it.
+type ModelPriceList struct {
+	// Version identifies the list, as the date its prices were last checked
+	Version string `json:"version"`
+	// Sources are the providers' pricing pages, by provider
+	Sources map[string]string `json:"sources"`
+	Models  []ModelPrice      `json:"models"`
+}
+
+// ModelPrice is a model's entry in the price list. Its fields are named as in
+// model_configurations documents. Prices are USD per million tokens.
+type ModelPrice struct {
+	ModelID                    string            `json:"model_id"`
+	Provider                   string            `json:"provider"`
+	InputPricePerMillion       float64           `json:"input_price_per_million"`
+	OutputPricePerMillion      float64           `json:"output_price_per_million"`
+	CachedInputPricePerMillion float64           `json:"cached_input_price_per_million,omitempty"`
+	CacheWritePricePerMillion  float64           `json:"cache_write_price_per_million,omitempty"`
+	ReasoningPricePerMillion   float64           `json:"reasoning_price_per_million,omitempty"`
+	ContextWindowSize          int               `json:"context_window_size"`
+	TimeoutSeconds             int               `json:"timeout_seconds,omitempty"`
+	Capabilities               ModelCapabilities `json:"capabilities"`
+}
+
+// ModelCapabilities flags the features a model supports
+type ModelCapabilities struct {
+	Streaming bool `firestore:"streaming" json:"streaming"`
+	Vision    bool `firestore:"vision" json:"vision"`
+	Tools     bool `firestore:"tools" json:"tools"`
+}
+
+// PriceDrift is a field of a model whose value differs from the price list's
+type PriceDrift struct {
+	ModelID string  `json:"model_id"`
+	Field   string  `json:"field"`
+	Listed  float64 `json:"listed"`
+	Actual  float64 `json:"actual"`
+}
+
+// modelPrices parses the embedded price list once
+var modelPrices = sync.OnceValue(func() *ModelPriceList {
+	list, err := ParseModelPriceList(modelPricesJSON)
+	if err != nil {
+		panic(err)
+	}
+	return list
+})
+
+// ModelPrices returns the canonical model price list
+func ModelPrices() *ModelPriceList {
+	return modelPrices()
+}
+
+// ParseModelPriceList parses and validates a price list
+func ParseModelPriceList(raw []byte) (*ModelPriceList, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	var list ModelPriceList
+	if err := decoder.Decode(&list); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPriceList, err)
+	}
+	if err := list.Validate(); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// Validate checks every model is listed once, for a provider with a pricing source, with prices
+// that are not negative and a context window
+func (l *ModelPriceList) Validate() error {
+	if l.Version == "" {
+		return fmt.Errorf("%w: version is required", ErrInvalidPriceList)
+	}
+	seen := make(map[string]bool, len(l.Models))
+	for _, model := range l.Models {
+		switch {
+		case model.ModelID == "":
+			return fmt.Errorf("%w: a model has no model_id", ErrInvalidPriceList)
+		case seen[model.ModelID]:
+			return fmt.Errorf("%w: %s is listed more than once", ErrInvalidPriceList, model.ModelID)
+		case l.Sources[model.Provider] == "":
+			return fmt.Errorf("%w: %s: provider %q has no pricing source", ErrInvalidPriceList, model.ModelID, model.Provider)
+		case model.ContextWindowSize <= 0:
+			return fmt.Errorf("%w: %s: context_window_size must be positive", ErrInvalidPriceList, model.ModelID)
+		}
+		for _, field := range model.priceFields() {
+			if field.price < 0 {
+				return fmt.Errorf("%w: %s: %s must not be negative", ErrInvalidPriceList, model.ModelID, field.name)
+			}
+		}
+		seen[model.ModelID] = true
+	}
+	return nil
+}
+
+// Lookup returns a model's entry
+func (l *ModelPriceList) Lookup(modelID string) (ModelPrice, bool) {
+	for _, model := range l.Models {
+		if model.ModelID == modelID {
+			return model, true
+		}
+	}
+	return ModelPrice{}, false
+}
+
+// modelPriceField is one of a model's prices, named as in model_configurations
+type modelPriceField struct {
+	name  string
+	price float64
+	// optional prices stand for the provider's published rate when 0
+	optional bool
+}
+
+// priceFields returns the model's prices in a fixed order
+func (p ModelPrice) priceFields() []modelPriceField {
+	return []modelPriceField{
+		{"input_price_per_million", p.InputPricePerMillion, false},
+		{"output_price_per_million", p.OutputPricePerMillion, false},
+		{"cached_input_price_per_million", p.CachedInputPricePerMillion, true},
+		{"cache_write_price_per_million", p.CacheWritePricePerMillion, true},
+		{"reasoning_price_per_million", p.ReasoningPricePerMillion, true},
+	}
+}
+
+// Drift lists the prices and context window of actual that differ from the listed model's.
+// Optional prices are only compared where both set them.
+func (p ModelPrice) Drift(actual ModelPrice) []PriceDrift {
+	var drift []PriceDrift
+	got := actual.priceFields()
+	for i, listed := range p.priceFields() {
+		if listed.optional && (listed.price == 0 || got[i].price == 0) {
+			continue
+		}
+		// Prices are compared to a millionth of a cent per million tokens, below float noise
+		if math.Abs(listed.price-got[i].price) > 1e-8 {
+			drift = append(drift, PriceDrift{ModelID: p.ModelID, Field: listed.name, Listed: listed.price, Actual: got[i].price})
+		}
+	}
+	if actual.ContextWindowSize != 0 && actual.ContextWindowSize != p.ContextWindowSize {
+		drift = append(drift, PriceDrift{ModelID: p.ModelID, Field: "context_window_size", Listed: float64(p.ContextWindowSize), Actual: float64(actual.ContextWindowSize)})
+	}
+	return drift
+}
+
+// Document returns the model_configurations fields the model's entry sets
+func (p ModelPrice) Document() map[string]interface{} {
+	doc := map[string]interface{}{
+		"model_id":            p.ModelID,
+		"provider":            p.Provider,
+		"context_window_size": int64(p.ContextWindowSize),
+		"is_active":           true,
+		"capabilities": map[string]interface{}{
+			"streaming": p.Capabilities.Streaming,
+			"vision":    p.Capabilities.Vision,
+			"tools":     p.Capabilities.Tools,
+		},
+	}
+	for _, field := range p.priceFields() {
+		if !field.optional || field.price != 0 {
+			doc[field.name] = field.price
+		}
+	}
+	if p.TimeoutSeconds != 0 {
+		doc["timeout_seconds"] = int64(p.TimeoutSeconds)
+	}
+	return doc
+}
+
+// publishedPrice is a model's entry in LiteLLM's model_prices_and_context_window.json, a
+// community-maintained copy of the providers' published prices, priced per token
+type publishedPrice struct {
+	InputCostPerToken  float64 `json:"input_cost_per_token"`
+	OutputCostPerToken float64 `json:"output_cost_per_token"`
+	CacheReadCost      float64 `json:"cache_read_input_token_cost"`
+	CacheWriteCost     float64 `json:"cache_creation_input_token_cost"`
+}
+
+// publishedKeyPrefixes are the prefixes published prices may key a provider's models by
+var publishedKeyPrefixes = map[string][]string{
+	"openai":    {"openai/"},
+	"anthropic": {"anthropic/"},
+	"google":    {"gemini/", "google/"},
+}
+
+// PublishedDrift compares the list with providers' published prices, given in the format of
+// LiteLLM's model_prices_and_context_window.json. It returns the prices that differ and the
+// listed models with no published price.
+func (l *ModelPriceList) PublishedDrift(raw []byte) ([]PriceDrift, []string, error) {
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse published prices: %w", err)
+	}
+
+	var drift []PriceDrift
+	var unpublished []string
+	for _, model := range l.Models {
+		entry, ok := entries[model.ModelID]
+		for _, prefix := range publishedKeyPrefixes[model.Provider] {
+			if !ok {
+				entry, ok = entries[prefix+model.ModelID]
+			}
+		}
+		var published publishedPrice
+		if !ok || json.Unmarshal(entry, &published) != nil || published.InputCostPerToken == 0 && published.OutputCostPerToken == 0 {
+			unpublished = append(unpublished, model.ModelID)
+			continue
+		}
+		drift = append(drift, model.Drift(ModelPrice{
+			InputPricePerMillion:       published.InputCostPerToken * 1_000_000,
+			OutputPricePerMillion:      published.OutputCostPerToken * 1_000_000,
+			CachedInputPricePerMillion: published.CacheReadCost * 1_000_000,
+			CacheWritePricePerMillion:  published.CacheWriteCost * 1_000_000,
+		})...)
+	}
+	return drift, unpublished, nil
+}
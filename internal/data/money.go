@@ -0,0 +1,280 @@
+package data
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// MicroUSD is a monetary amount in millionths of a US dollar.
+// All balances, charges, and logged costs are stored as integer micro-USD so that
+// billing arithmetic is exact; catalog rates (price per million tokens, markup
+// percentages) stay as floats and are converted once per calculation.
+type MicroUSD int64
+
+// microsPerUSD is the number of micro-USD in one US dollar
+const microsPerUSD = 1_000_000
+
+// USDToMicros converts a floating point USD amount to micro-USD, rounding to the nearest micro
+func USDToMicros(usd float64) MicroUSD {
+	return MicroUSD(math.Round(usd * microsPerUSD))
+}
+
+// USD returns the amount as a floating point USD value, for display only
+func (m MicroUSD) USD() float64 {
+	return float64(m) / microsPerUSD
+}
+
+// String formats the amount as a fixed six-decimal USD string
+func (m MicroUSD) String() string {
+	sign := ""
+	v := int64(m)
+	if v < 0 {
+		sign = "-"
+		v = -v
+	}
+	return fmt.Sprintf("%s%d.%06d", sign, v/microsPerUSD, v%microsPerUSD)
+}
+
+// MarshalJSON encodes the amount as an exact decimal USD number
+func (m MicroUSD) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON decodes an exact decimal USD number (or quoted string)
+func (m *MicroUSD) UnmarshalJSON(b []byte) error {
+	parsed, err := ParseUSD(strings.Trim(string(b), `"`))
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// ParseUSD parses a decimal USD string such as "12.345678" without floating point rounding.
+// Digits past the sixth decimal place round half away from zero.
+func ParseUSD(s string) (MicroUSD, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "null" {
+		return 0, nil
+	}
+
+	negative := strings.HasPrefix(s, "-")
+	if negative || strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" && frac == "" || !isDigits(whole) || !isDigits(frac) {
+		return 0, fmt.Errorf("invalid USD amount %q", s)
+	}
+
+	// Round half up on the seventh fractional digit
+	roundUp := false
+	if len(frac) > 6 {
+		roundUp = frac[6] >= '5'
+		frac = frac[:6]
+	}
+
+	v, err := parseMicros(whole, frac)
+	if err != nil {
+		return 0, err
+	}
+	if roundUp {
+		if v == math.MaxInt64 {
+			return 0, fmt.Errorf("USD amount %q is out of range", s)
+		}
+		v++
+	}
+	if negative {
+		v = -v
+	}
+	return v, nil
+}
+
+// isDigits reports whether s holds only the digits 0-9
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseMicros combines whole and fractional digit strings into micro-USD
+func parseMicros(whole, frac string) (MicroUSD, error) {
+	if whole == "" {
+		whole = "0"
+	}
+	w, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid USD amount: %w", err)
+	}
+
+	frac = (frac + "000000")[:6]
+	f, err := strconv.ParseInt(frac, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid USD amount: %w", err)
+	}
+
+	if w > (math.MaxInt64-f)/microsPerUSD {
+		return 0, fmt.Errorf("USD amount %s.%s is out of range", whole, frac)
+	}
+	return MicroUSD(w*microsPerUSD + f), nil
+}
+
+// zeroDecimalCurrencies are the ISO 4217 currencies without minor units
+var zeroDecimalCurrencies = map[string]bool{
+	"CLP": true, "ISK": true, "JPY": true, "KRW": true, "PYG": true, "UGX": true, "VND": true,
+}
+
+// CurrencyDecimals returns the number of minor unit digits amounts in a currency are shown with
+func CurrencyDecimals(currency string) int {
+	if zeroDecimalCurrencies[currency] {
+		return 0
+	}
+	return 2
+}
+
+// DisplayAmount is an amount converted from USD into another currency for display, rounded to the
+// currency's minor units. It is never stored or charged.
+type DisplayAmount struct {
+	// Minor is the amount in minor units, such as cents
+	Minor    int64
+	Decimals int
+}
+
+// Convert converts the amount at rate units of a currency per USD, rounding half away from zero
+// to the currency's minor units
+func (m MicroUSD) Convert(rate float64, decimals int) DisplayAmount {
+	scale := math.Pow10(decimals)
+	return DisplayAmount{
+		Minor:    int64(math.Round(float64(m) * rate * scale / microsPerUSD)),
+		Decimals: decimals,
+	}
+}
+
+// String formats the amount as a fixed-decimal string in its currency's minor units
+func (d DisplayAmount) String() string {
+	sign := ""
+	v := d.Minor
+	if v < 0 {
+		sign = "-"
+		v = -v
+	}
+	if d.Decimals == 0 {
+		return fmt.Sprintf("%s%d", sign, v)
+	}
+	scale := int64(math.Pow10(d.Decimals))
+	return fmt.Sprintf("%s%d.%0*d", sign, v/scale, d.Decimals, v%scale)
+}
+
+// MarshalJSON encodes the amount as an exact decimal number
+func (d DisplayAmount) MarshalJSON() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// CostForTokens returns the cost of tokens at a USD price per million tokens, rounded to the nearest micro
+func CostForTokens(tokens int, pricePerMillionUSD float64) MicroUSD {
+	// tokens * (USD / 1M tokens) * 1M micros/USD = tokens * price micros
+	return MicroUSD(math.Round(float64(tokens) * pricePerMillionUSD))
+}
+
+// ApplyPercent returns percent% of the amount, rounded to the nearest micro
+func (m MicroUSD) ApplyPercent(percent float64) MicroUSD {
+	return MicroUSD(math.Round(float64(m) * percent / 100))
+}
+
+// CostBreakdown itemizes the cost of a single request
+type CostBreakdown struct {
+	BaseInput    MicroUSD `json:"base_input" firestore:"base_input_micros"`
+	BaseOutput   MicroUSD `json:"base_output" firestore:"base_output_micros"`
+	InputMarkup  MicroUSD `json:"input_markup" firestore:"input_markup_micros"`
+	OutputMarkup MicroUSD `json:"output_markup" firestore:"output_markup_micros"`
+	// PlatformFee is a flat per-request fee, charged instead of provider cost for BYOK requests
+	PlatformFee MicroUSD `json:"platform_fee,omitempty" firestore:"platform_fee_micros,omitempty"`
+	// Optimizer is the cost of the prompt optimizer call, charged at cost. It runs on the platform's
+	// key, so BYOK requests pay it too.
+	Optimizer MicroUSD `json:"optimizer,omitempty" firestore:"optimizer_micros,omitempty"`
+}
+
+// Billing modes recorded on request logs
+const (
+	// BillingModeStandard charges provider cost plus markup
+	BillingModeStandard = "standard"
+	// BillingModeBYOKMarkup charges only the markup; the caller's own key pays the provider
+	BillingModeBYOKMarkup = "byok_markup"
+	// BillingModeBYOKFlat charges only a flat per-request platform fee
+	BillingModeBYOKFlat = "byok_flat"
+	// BillingModeTest charges nothing; test API keys are answered by a fake provider
+	BillingModeTest = "test"
+)
+
+// TokenDetails breaks down a request's usage: the input tokens a provider read from and wrote to
+// its prompt cache, which are part of its input tokens, and the reasoning tokens a reasoning model
+// spent thinking, which are part of its output tokens
+type TokenDetails struct {
+	CacheReadTokens  int
+	CacheWriteTokens int
+	ReasoningTokens  int
+}
+
+// TokenRates price the tokens in TokenDetails as fractions of the model's prices: CacheRead and
+// CacheWrite of the input price, and Reasoning of the output price
+type TokenRates struct {
+	CacheRead  float64
+	CacheWrite float64
+	Reasoning  float64
+}
+
+// ComputeCost prices a request from token counts, per-million prices, and markup percentages.
+// This is the single formula used by every billing path.
+func ComputeCost(inputTokens, outputTokens int, inputPricePerMillion, outputPricePerMillion, inputMarkupPercent, outputMarkupPercent float64) CostBreakdown {
+	return ComputeDetailedCost(inputTokens, outputTokens, TokenDetails{}, TokenRates{}, inputPricePerMillion, outputPricePerMillion, inputMarkupPercent, outputMarkupPercent)
+}
+
+// ComputeDetailedCost prices a request like ComputeCost, charging cached input tokens and
+// reasoning tokens at their rates
+func ComputeDetailedCost(inputTokens, outputTokens int, details TokenDetails, rates TokenRates, inputPricePerMillion, outputPricePerMillion, inputMarkupPercent, outputMarkupPercent float64) CostBreakdown {
+	uncached := max(inputTokens-details.CacheReadTokens-details.CacheWriteTokens, 0)
+	reasoning := min(details.ReasoningTokens, outputTokens)
+	// Rounded once, so requests without details cost exactly what CostForTokens gives
+	baseInput := MicroUSD(math.Round(inputPricePerMillion * (float64(uncached) +
+		float64(details.CacheReadTokens)*rates.CacheRead +
+		float64(details.CacheWriteTokens)*rates.CacheWrite)))
+	baseOutput := MicroUSD(math.Round(outputPricePerMillion * (float64(outputTokens-reasoning) +
+		float64(reasoning)*rates.Reasoning)))
+
+	return CostBreakdown{
+		BaseInput:    baseInput,
+		BaseOutput:   baseOutput,
+		InputMarkup:  baseInput.ApplyPercent(inputMarkupPercent),
+		OutputMarkup: baseOutput.ApplyPercent(outputMarkupPercent),
+	}
+}
+
+// Base returns the provider cost before markup
+func (b CostBreakdown) Base() MicroUSD {
+	return b.BaseInput + b.BaseOutput
+}
+
+// Markup returns the total markup amount
+func (b CostBreakdown) Markup() MicroUSD {
+	return b.InputMarkup + b.OutputMarkup
+}
+
+// Total returns the amount charged to the user
+func (b CostBreakdown) Total() MicroUSD {
+	return b.Base() + b.Markup() + b.PlatformFee + b.Optimizer
+}
+
+// ForBYOK returns the charge for a request whose provider cost the caller pays with their own key:
+// the markup alone, or the flat fee when mode is BillingModeBYOKFlat
+func (b CostBreakdown) ForBYOK(mode string, flatFee MicroUSD) CostBreakdown {
+	if mode == BillingModeBYOKFlat {
+		return CostBreakdown{PlatformFee: flatFee, Optimizer: b.Optimizer}
+	}
+	return CostBreakdown{InputMarkup: b.InputMarkup, OutputMarkup: b.OutputMarkup, Optimizer: b.Optimizer}
+}
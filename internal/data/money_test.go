@@ -0,0 +1,215 @@
+package data
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUSD(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    MicroUSD
+		wantErr bool
+	}{
+		{"Micros", "12.345678", 12_345_678, false},
+		{"Whole", "1", 1_000_000, false},
+		{"LeadingPoint", ".5", 500_000, false},
+		{"TrailingPoint", "5.", 5_000_000, false},
+		{"PlusSign", "+1.5", 1_500_000, false},
+		{"Negative", "-1.5", -1_500_000, false},
+		{"Whitespace", " 2.5 ", 2_500_000, false},
+		{"Empty", "", 0, false},
+		{"Null", "null", 0, false},
+
+		// The seventh decimal place rounds half away from zero
+		{"BelowHalfMicro", "0.0000004", 0, false},
+		{"HalfMicro", "0.0000005", 1, false},
+		{"JustBelowHalfMicro", "0.00000049999", 0, false},
+		{"NegativeHalfMicro", "-0.0000005", -1, false},
+		{"RoundsIntoWhole", "0.9999995", 1_000_000, false},
+
+		{"Largest", "9223372036854.775807", math.MaxInt64, false},
+		{"LargestNegative", "-9223372036854.775807", -math.MaxInt64, false},
+		{"RoundsOutOfRange", "9223372036854.7758075", 0, true},
+		{"OutOfRange", "9223372036854.775808", 0, true},
+		{"WholeOutOfRange", "9223372036855", 0, true},
+		{"WholeOverflowsInt64", "99999999999999999999", 0, true},
+
+		{"Letters", "abc", 0, true},
+		{"TwoPoints", "1.2.3", 0, true},
+		{"ThousandsSeparator", "1,000", 0, true},
+		{"SignInFraction", "1.-5", 0, true},
+		{"DoubleSign", "--1", 0, true},
+		{"MixedSigns", "+-1", 0, true},
+		{"SignOnly", "-", 0, true},
+		{"PointOnly", ".", 0, true},
+		{"Exponent", "1e6", 0, true},
+		{"CurrencySymbol", "$1", 0, true},
+		{"Hex", "0x10", 0, true},
+		{"JunkPastMicros", "1.1234567x", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseUSD(tt.input)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMicroUSD(t *testing.T) {
+	t.Run("String", func(t *testing.T) {
+		tests := []struct {
+			amount MicroUSD
+			want   string
+		}{
+			{0, "0.000000"},
+			{1, "0.000001"},
+			{-1, "-0.000001"},
+			{12_345_678, "12.345678"},
+			{-1_500_000, "-1.500000"},
+			{math.MaxInt64, "9223372036854.775807"},
+		}
+		for _, tt := range tests {
+			assert.Equal(t, tt.want, tt.amount.String())
+
+			// Every amount survives a round trip through its string
+			parsed, err := ParseUSD(tt.amount.String())
+			require.NoError(t, err)
+			assert.Equal(t, tt.amount, parsed)
+		}
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		body, err := json.Marshal(struct {
+			Cost MicroUSD `json:"cost"`
+		}{1_500_000})
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"cost": 1.5}`, string(body))
+
+		for _, input := range []string{`2.5`, `"2.5"`} {
+			var m MicroUSD
+			require.NoError(t, json.Unmarshal([]byte(input), &m))
+			assert.Equal(t, MicroUSD(2_500_000), m)
+		}
+		var m MicroUSD
+		assert.Error(t, json.Unmarshal([]byte(`"2.5 USD"`), &m))
+	})
+
+	t.Run("Arithmetic", func(t *testing.T) {
+		tests := []struct {
+			name string
+			got  MicroUSD
+			want MicroUSD
+		}{
+			{"USDToMicros", USDToMicros(0.1), 100_000},
+			{"USDToMicrosRoundsDown", USDToMicros(1.0000004), 1_000_000},
+			{"USDToMicrosNegative", USDToMicros(-0.25), -250_000},
+			{"CostForTokens", CostForTokens(1000, 0.5), 500},
+			{"CostForTokensBelowHalfMicro", CostForTokens(1, 0.4), 0},
+			{"CostForTokensHalfMicro", CostForTokens(3, 0.5), 2},
+			{"CostForTokensLarge", CostForTokens(1_000_000_000, 60), 60_000_000_000},
+			{"ApplyPercent", MicroUSD(1000).ApplyPercent(10), 100},
+			{"ApplyPercentHalfMicro", MicroUSD(15).ApplyPercent(10), 2},
+			{"ApplyPercentNegative", MicroUSD(-15).ApplyPercent(10), -2},
+			{"ApplyPercentZero", MicroUSD(1000).ApplyPercent(0), 0},
+		}
+		for _, tt := range tests {
+			assert.Equal(t, tt.want, tt.got, tt.name)
+		}
+	})
+
+	t.Run("Convert", func(t *testing.T) {
+		assert.Equal(t, "1.23", MicroUSD(1_234_567).Convert(1, 2).String())
+		assert.Equal(t, "-0.92", MicroUSD(-1_000_000).Convert(0.92, 2).String())
+		assert.Equal(t, "150", MicroUSD(1_000_000).Convert(149.5, 0).String())
+	})
+}
+
+func TestComputeCost(t *testing.T) {
+	const flatFee = MicroUSD(2000)
+
+	tests := []struct {
+		name          string
+		mode          string
+		inputTokens   int
+		outputTokens  int
+		inputPrice    float64
+		outputPrice   float64
+		markupPercent float64
+		optimizer     MicroUSD
+		want          CostBreakdown
+		wantTotal     MicroUSD
+	}{
+		{
+			name: "Standard", mode: BillingModeStandard,
+			inputTokens: 1000, outputTokens: 2000, inputPrice: 0.5, outputPrice: 1.5, markupPercent: 10,
+			want:      CostBreakdown{BaseInput: 500, BaseOutput: 3000, InputMarkup: 50, OutputMarkup: 300},
+			wantTotal: 3850,
+		},
+		{
+			name: "StandardWithOptimizer", mode: BillingModeStandard,
+			inputTokens: 1000, outputTokens: 2000, inputPrice: 0.5, outputPrice: 1.5, markupPercent: 10, optimizer: 25,
+			want:      CostBreakdown{BaseInput: 500, BaseOutput: 3000, InputMarkup: 50, OutputMarkup: 300, Optimizer: 25},
+			wantTotal: 3875,
+		},
+		{
+			// A single cheap token costs under half a micro and rounds to nothing
+			name: "StandardSubMicro", mode: BillingModeStandard,
+			inputTokens: 1, outputTokens: 1, inputPrice: 0.4, outputPrice: 0.5, markupPercent: 10,
+			want:      CostBreakdown{BaseInput: 0, BaseOutput: 1, InputMarkup: 0, OutputMarkup: 0},
+			wantTotal: 1,
+		},
+		{
+			name: "StandardLarge", mode: BillingModeStandard,
+			inputTokens: 1_000_000_000, outputTokens: 1_000_000_000, inputPrice: 60, outputPrice: 120, markupPercent: 10,
+			want:      CostBreakdown{BaseInput: 60_000_000_000, BaseOutput: 120_000_000_000, InputMarkup: 6_000_000_000, OutputMarkup: 12_000_000_000},
+			wantTotal: 198_000_000_000,
+		},
+		{
+			name: "NoTokens", mode: BillingModeStandard,
+			inputPrice: 0.5, outputPrice: 1.5, markupPercent: 10,
+			want:      CostBreakdown{},
+			wantTotal: 0,
+		},
+		{
+			name: "BYOKMarkup", mode: BillingModeBYOKMarkup,
+			inputTokens: 1000, outputTokens: 2000, inputPrice: 0.5, outputPrice: 1.5, markupPercent: 10, optimizer: 25,
+			want:      CostBreakdown{InputMarkup: 50, OutputMarkup: 300, Optimizer: 25},
+			wantTotal: 375,
+		},
+		{
+			name: "BYOKFlat", mode: BillingModeBYOKFlat,
+			inputTokens: 1000, outputTokens: 2000, inputPrice: 0.5, outputPrice: 1.5, markupPercent: 10, optimizer: 25,
+			want:      CostBreakdown{PlatformFee: flatFee, Optimizer: 25},
+			wantTotal: 2025,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cost := ComputeCost(tt.inputTokens, tt.outputTokens, tt.inputPrice, tt.outputPrice, tt.markupPercent, tt.markupPercent)
+			cost.Optimizer = tt.optimizer
+			if tt.mode != BillingModeStandard {
+				cost = cost.ForBYOK(tt.mode, flatFee)
+			}
+			assert.Equal(t, tt.want, cost)
+			assert.Equal(t, tt.wantTotal, cost.Total())
+			assert.Equal(t, cost.Base()+cost.Markup()+cost.PlatformFee+cost.Optimizer, cost.Total())
+		})
+	}
+
+	t.Run("DetailedCostWithoutDetailsMatches", func(t *testing.T) {
+		assert.Equal(t,
+			ComputeCost(1234, 567, 3, 15, 20, 10),
+			ComputeDetailedCost(1234, 567, TokenDetails{}, TokenRates{CacheRead: 0.1, CacheWrite: 1.25, Reasoning: 1}, 3, 15, 20, 10))
+	})
+}
@@ -0,0 +1,10 @@
+package data
+
+// PostProcessing configures the transforms applied to an API key's completions before they are
+// returned, streamed or not
+type PostProcessing struct {
+	// Transforms names the transforms to apply, in order: trim_whitespace and redact_secrets
+	Transforms []string `firestore:"transforms,omitempty" json:"transforms,omitempty"`
+	// MaxLength truncates completions to this many characters; zero means no limit
+	MaxLength int `firestore:"max_length,omitempty" json:"max_length,omitempty"`
+}
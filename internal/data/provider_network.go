@@ -0,0 +1,93 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// ProviderNetwork is how a provider's API is reached from restricted networks: through a proxy,
+// at a base URL other than the provider's own such as a gateway appliance, or both
+type ProviderNetwork struct {
+	// BaseURL replaces the provider's default API URL; empty keeps it
+	BaseURL string
+	// Proxy sends the provider's calls through this HTTP, HTTPS or SOCKS5 proxy; nil uses the
+	// environment's HTTPS_PROXY and NO_PROXY
+	Proxy *url.URL
+}
+
+// defaultBaseURLs are the providers' own API URLs, which connectivity checks reach when no base
+// URL is configured
+var defaultBaseURLs = map[string]string{
+	"openai":    "https://api.openai.com/v1/",
+	"anthropic": "https://api.anthropic.com/",
+	"google":    "https://generativelanguage.googleapis.com/",
+}
+
+// providerRoute is the HTTP client and base URL of a provider's calls
+type providerRoute struct {
+	client  *http.Client
+	baseURL string
+}
+
+var (
+	providerRoutesMu sync.RWMutex
+	providerRoutes   = make(map[string]providerRoute)
+)
+
+// SetProviderNetwork directs a provider's calls through network. Endpoints configured with their
+// own base URL keep it but still go through the proxy.
+func SetProviderNetwork(provider string, network ProviderNetwork) {
+	route := providerRoute{client: providerHTTPClient, baseURL: network.BaseURL}
+	if network.Proxy != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = http.ProxyURL(network.Proxy)
+		route.client = &http.Client{Transport: otelhttp.NewTransport(transport)}
+	}
+
+	providerRoutesMu.Lock()
+	defer providerRoutesMu.Unlock()
+	providerRoutes[provider] = route
+}
+
+// providerHTTP returns the HTTP client a provider's calls use and the base URL replacing its
+// default, if any
+func providerHTTP(provider string) (*http.Client, string) {
+	providerRoutesMu.RLock()
+	defer providerRoutesMu.RUnlock()
+
+	route, ok := providerRoutes[provider]
+	if !ok {
+		return providerHTTPClient, ""
+	}
+	return route.client, route.baseURL
+}
+
+// CheckProviderConnectivity verifies a provider's API can be reached over its network. Any HTTP
+// response counts, since the check is unauthenticated and only the route is in question.
+func CheckProviderConnectivity(ctx context.Context, provider string) error {
+	client, baseURL := providerHTTP(provider)
+	if baseURL == "" {
+		baseURL = defaultBaseURLs[provider]
+	}
+	if baseURL == "" {
+		return fmt.Errorf("unsupported provider: %s", provider)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL, nil)
+	if err != nil {
+		return fmt.Errorf("invalid %s base URL %q: %w", provider, baseURL, err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s API at %s is unreachable: %w", provider, baseURL, err)
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	return nil
+}
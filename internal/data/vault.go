@@ -0,0 +1,173 @@
+package data
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+)
+
+// KeyWrapper wraps and unwraps data keys with a key-encryption key. A KMS-backed
+// implementation keeps the key-encryption key out of process entirely.
+type KeyWrapper interface {
+	// KeyID identifies the key-encryption key so secrets record which key wrapped them
+	KeyID() string
+
+	// WrapKey encrypts a data key
+	WrapKey(ctx context.Context, dataKey []byte) ([]byte, error)
+
+	// UnwrapKey decrypts a data key wrapped by WrapKey
+	UnwrapKey(ctx context.Context, wrappedKey []byte) ([]byte, error)
+}
+
+// SealedSecret is a secret encrypted with its own data key, stored alongside the wrapped data key
+type SealedSecret struct {
+	Ciphertext []byte `firestore:"ciphertext"`
+	Nonce      []byte `firestore:"nonce"`
+	WrappedKey []byte `firestore:"wrapped_key"`
+	KeyID      string `firestore:"key_id"`
+	// Bound marks secrets sealed with their owner as additional authenticated data, so the
+	// ciphertext cannot be copied to another user's or provider's record. Secrets sealed before
+	// binding open without it until they are rewrapped.
+	Bound bool `firestore:"bound,omitempty"`
+}
+
+// LocalKeyWrapper wraps data keys with an AES-256-GCM master key held in memory
+type LocalKeyWrapper struct {
+	keyID string
+	aead  cipher.AEAD
+}
+
+// NewLocalKeyWrapper creates a key wrapper from a 32-byte master key
+func NewLocalKeyWrapper(keyID string, masterKey []byte) (*LocalKeyWrapper, error) {
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid master key: %w", err)
+	}
+	return &LocalKeyWrapper{keyID: keyID, aead: aead}, nil
+}
+
+// KeyID returns the master key's identifier
+func (w *LocalKeyWrapper) KeyID() string {
+	return w.keyID
+}
+
+// WrapKey encrypts a data key with the master key, prefixing the nonce
+func (w *LocalKeyWrapper) WrapKey(ctx context.Context, dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, w.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return w.aead.Seal(nonce, nonce, dataKey, []byte(w.keyID)), nil
+}
+
+// UnwrapKey decrypts a data key wrapped by WrapKey
+func (w *LocalKeyWrapper) UnwrapKey(ctx context.Context, wrappedKey []byte) ([]byte, error) {
+	nonceSize := w.aead.NonceSize()
+	if len(wrappedKey) < nonceSize {
+		return nil, fmt.Errorf("wrapped key is too short")
+	}
+	dataKey, err := w.aead.Open(nil, wrappedKey[:nonceSize], wrappedKey[nonceSize:], []byte(w.keyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return dataKey, nil
+}
+
+// SealSecret encrypts plaintext under a fresh data key and wraps the data key with wrapper.
+// aad names what the secret belongs to, and must be given again to open it.
+func SealSecret(ctx context.Context, wrapper KeyWrapper, plaintext, aad string) (*SealedSecret, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	wrappedKey, err := wrapper.WrapKey(ctx, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+
+	return &SealedSecret{
+		Ciphertext: aead.Seal(nil, nonce, []byte(plaintext), []byte(aad)),
+		Nonce:      nonce,
+		WrappedKey: wrappedKey,
+		KeyID:      wrapper.KeyID(),
+		Bound:      true,
+	}, nil
+}
+
+// OpenSecret decrypts a secret sealed by SealSecret with the same aad
+func OpenSecret(ctx context.Context, wrapper KeyWrapper, secret *SealedSecret, aad string) (string, error) {
+	if secret.KeyID != wrapper.KeyID() {
+		return "", fmt.Errorf("secret was sealed with key %q, not %q", secret.KeyID, wrapper.KeyID())
+	}
+
+	dataKey, err := wrapper.UnwrapKey(ctx, secret.WrappedKey)
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+	var additionalData []byte
+	if secret.Bound {
+		additionalData = []byte(aad)
+	}
+	plaintext, err := aead.Open(nil, secret.Nonce, secret.Ciphertext, additionalData)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// RewrapSecret moves a secret from the key-encryption key in from to the one in to. Bound
+// secrets only have their data key rewrapped; unbound secrets are resealed bound to aad.
+func RewrapSecret(ctx context.Context, from, to KeyWrapper, secret *SealedSecret, aad string) (*SealedSecret, error) {
+	if !secret.Bound {
+		plaintext, err := OpenSecret(ctx, from, secret, aad)
+		if err != nil {
+			return nil, err
+		}
+		return SealSecret(ctx, to, plaintext, aad)
+	}
+
+	if secret.KeyID != from.KeyID() {
+		return nil, fmt.Errorf("secret was sealed with key %q, not %q", secret.KeyID, from.KeyID())
+	}
+	dataKey, err := from.UnwrapKey(ctx, secret.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, err := to.WrapKey(ctx, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+
+	rewrapped := *secret
+	rewrapped.WrappedKey, rewrapped.KeyID = wrappedKey, to.KeyID()
+	return &rewrapped, nil
+}
+
+// newGCM creates an AES-GCM cipher for a 32-byte key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
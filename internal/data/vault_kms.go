@@ -0,0 +1,63 @@
+package data
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/option"
+)
+
+// KMSKeyWrapper wraps data keys with a Cloud KMS symmetric key, so the key-encryption key never
+// leaves KMS. Rotating the key's primary version in KMS needs no rewrap: KMS decrypts with
+// whichever version encrypted the data key.
+type KMSKeyWrapper struct {
+	keyName   string
+	cryptoKey *cloudkms.ProjectsLocationsKeyRingsCryptoKeysService
+}
+
+// NewKMSKeyWrapper creates a key wrapper for a Cloud KMS CryptoKey, named as
+// projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>
+func NewKMSKeyWrapper(ctx context.Context, keyName string, opts ...option.ClientOption) (*KMSKeyWrapper, error) {
+	service, err := cloudkms.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create KMS client: %w", err)
+	}
+	return &KMSKeyWrapper{keyName: keyName, cryptoKey: service.Projects.Locations.KeyRings.CryptoKeys}, nil
+}
+
+// KeyID returns the CryptoKey's resource name
+func (w *KMSKeyWrapper) KeyID() string {
+	return w.keyName
+}
+
+// WrapKey encrypts a data key with the CryptoKey's primary version
+func (w *KMSKeyWrapper) WrapKey(ctx context.Context, dataKey []byte) ([]byte, error) {
+	resp, err := w.cryptoKey.Encrypt(w.keyName, &cloudkms.EncryptRequest{
+		Plaintext: base64.StdEncoding.EncodeToString(dataKey),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("KMS encrypt failed: %w", err)
+	}
+	wrappedKey, err := base64.StdEncoding.DecodeString(resp.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode KMS ciphertext: %w", err)
+	}
+	return wrappedKey, nil
+}
+
+// UnwrapKey decrypts a data key wrapped by WrapKey
+func (w *KMSKeyWrapper) UnwrapKey(ctx context.Context, wrappedKey []byte) ([]byte, error) {
+	resp, err := w.cryptoKey.Decrypt(w.keyName, &cloudkms.DecryptRequest{
+		Ciphertext: base64.StdEncoding.EncodeToString(wrappedKey),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: KMS decrypt failed: %w", err)
+	}
+	dataKey, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode KMS plaintext: %w", err)
+	}
+	return dataKey, nil
+}
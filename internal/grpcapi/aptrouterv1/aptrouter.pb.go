@@ -0,0 +1,1061 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        (unknown)
+// source: aptrouter/v1/aptrouter.proto
+
+package aptrouterv1
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type GenerateRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Model string                 `protobuf:"bytes,1,opt,name=model,proto3" json:"model,omitempty"`
+	// prompt is required unless template_id names a stored template to render with variables
+	Prompt           string            `protobuf:"bytes,2,opt,name=prompt,proto3" json:"prompt,omitempty"`
+	TemplateId       string            `protobuf:"bytes,3,opt,name=template_id,json=templateId,proto3" json:"template_id,omitempty"`
+	TemplateVersion  int32             `protobuf:"varint,4,opt,name=template_version,json=templateVersion,proto3" json:"template_version,omitempty"`
+	Variables        map[string]string `protobuf:"bytes,5,rep,name=variables,proto3" json:"variables,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	MaxTokens        *int32            `protobuf:"varint,6,opt,name=max_tokens,json=maxTokens,proto3,oneof" json:"max_tokens,omitempty"`
+	Temperature      *float64          `protobuf:"fixed64,7,opt,name=temperature,proto3,oneof" json:"temperature,omitempty"`
+	TopP             *float64          `protobuf:"fixed64,8,opt,name=top_p,json=topP,proto3,oneof" json:"top_p,omitempty"`
+	Stop             []string          `protobuf:"bytes,9,rep,name=stop,proto3" json:"stop,omitempty"`
+	FrequencyPenalty *float64          `protobuf:"fixed64,10,opt,name=frequency_penalty,json=frequencyPenalty,proto3,oneof" json:"frequency_penalty,omitempty"`
+	PresencePenalty  *float64          `protobuf:"fixed64,11,opt,name=presence_penalty,json=presencePenalty,proto3,oneof" json:"presence_penalty,omitempty"`
+	Seed             *int64            `protobuf:"varint,12,opt,name=seed,proto3,oneof" json:"seed,omitempty"`
+	// timeout_seconds overrides the model's provider timeout, up to the server's maximum
+	TimeoutSeconds *int32 `protobuf:"varint,13,opt,name=timeout_seconds,json=timeoutSeconds,proto3,oneof" json:"timeout_seconds,omitempty"`
+	// optimization_mode is "context" (the default) or "efficiency"
+	OptimizationMode string `protobuf:"bytes,14,opt,name=optimization_mode,json=optimizationMode,proto3" json:"optimization_mode,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *GenerateRequest) Reset() {
+	*x = GenerateRequest{}
+	mi := &file_aptrouter_v1_aptrouter_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GenerateRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GenerateRequest) ProtoMessage() {}
+
+func (x *GenerateRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_aptrouter_v1_aptrouter_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GenerateRequest.ProtoReflect.Descriptor instead.
+func (*GenerateRequest) Descriptor() ([]byte, []int) {
+	return file_aptrouter_v1_aptrouter_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *GenerateRequest) GetModel() string {
+	if x != nil {
+		return x.Model
+	}
+	return ""
+}
+
+func (x *GenerateRequest) GetPrompt() string {
+	if x != nil {
+		return x.Prompt
+	}
+	return ""
+}
+
+func (x *GenerateRequest) GetTemplateId() string {
+	if x != nil {
+		return x.TemplateId
+	}
+	return ""
+}
+
+func (x *GenerateRequest) GetTemplateVersion() int32 {
+	if x != nil {
+		return x.TemplateVersion
+	}
+	return 0
+}
+
+func (x *GenerateRequest) GetVariables() map[string]string {
+	if x != nil {
+		return x.Variables
+	}
+	return nil
+}
+
+func (x *GenerateRequest) GetMaxTokens() int32 {
+	if x != nil && x.MaxTokens != nil {
+		return *x.MaxTokens
+	}
+	return 0
+}
+
+func (x *GenerateRequest) GetTemperature() float64 {
+	if x != nil && x.Temperature != nil {
+		return *x.Temperature
+	}
+	return 0
+}
+
+func (x *GenerateRequest) GetTopP() float64 {
+	if x != nil && x.TopP != nil {
+		return *x.TopP
+	}
+	return 0
+}
+
+func (x *GenerateRequest) GetStop() []string {
+	if x != nil {
+		return x.Stop
+	}
+	return nil
+}
+
+func (x *GenerateRequest) GetFrequencyPenalty() float64 {
+	if x != nil && x.FrequencyPenalty != nil {
+		return *x.FrequencyPenalty
+	}
+	return 0
+}
+
+func (x *GenerateRequest) GetPresencePenalty() float64 {
+	if x != nil && x.PresencePenalty != nil {
+		return *x.PresencePenalty
+	}
+	return 0
+}
+
+func (x *GenerateRequest) GetSeed() int64 {
+	if x != nil && x.Seed != nil {
+		return *x.Seed
+	}
+	return 0
+}
+
+func (x *GenerateRequest) GetTimeoutSeconds() int32 {
+	if x != nil && x.TimeoutSeconds != nil {
+		return *x.TimeoutSeconds
+	}
+	return 0
+}
+
+func (x *GenerateRequest) GetOptimizationMode() string {
+	if x != nil {
+		return x.OptimizationMode
+	}
+	return ""
+}
+
+type Usage struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	InputTokens   int32                  `protobuf:"varint,1,opt,name=input_tokens,json=inputTokens,proto3" json:"input_tokens,omitempty"`
+	OutputTokens  int32                  `protobuf:"varint,2,opt,name=output_tokens,json=outputTokens,proto3" json:"output_tokens,omitempty"`
+	TotalTokens   int32                  `protobuf:"varint,3,opt,name=total_tokens,json=totalTokens,proto3" json:"total_tokens,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Usage) Reset() {
+	*x = Usage{}
+	mi := &file_aptrouter_v1_aptrouter_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Usage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Usage) ProtoMessage() {}
+
+func (x *Usage) ProtoReflect() protoreflect.Message {
+	mi := &file_aptrouter_v1_aptrouter_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Usage.ProtoReflect.Descriptor instead.
+func (*Usage) Descriptor() ([]byte, []int) {
+	return file_aptrouter_v1_aptrouter_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Usage) GetInputTokens() int32 {
+	if x != nil {
+		return x.InputTokens
+	}
+	return 0
+}
+
+func (x *Usage) GetOutputTokens() int32 {
+	if x != nil {
+		return x.OutputTokens
+	}
+	return 0
+}
+
+func (x *Usage) GetTotalTokens() int32 {
+	if x != nil {
+		return x.TotalTokens
+	}
+	return 0
+}
+
+// Cost is a request's price in micro-USD
+type Cost struct {
+	state             protoimpl.MessageState `protogen:"open.v1"`
+	BaseMicros        int64                  `protobuf:"varint,1,opt,name=base_micros,json=baseMicros,proto3" json:"base_micros,omitempty"`
+	MarkupMicros      int64                  `protobuf:"varint,2,opt,name=markup_micros,json=markupMicros,proto3" json:"markup_micros,omitempty"`
+	PlatformFeeMicros int64                  `protobuf:"varint,3,opt,name=platform_fee_micros,json=platformFeeMicros,proto3" json:"platform_fee_micros,omitempty"`
+	TotalMicros       int64                  `protobuf:"varint,4,opt,name=total_micros,json=totalMicros,proto3" json:"total_micros,omitempty"`
+	// credits_used_micros is the part of the total paid with promotional credits
+	CreditsUsedMicros int64  `protobuf:"varint,5,opt,name=credits_used_micros,json=creditsUsedMicros,proto3" json:"credits_used_micros,omitempty"`
+	BillingMode       string `protobuf:"bytes,6,opt,name=billing_mode,json=billingMode,proto3" json:"billing_mode,omitempty"`
+	unknownFields     protoimpl.UnknownFields
+	sizeCache         protoimpl.SizeCache
+}
+
+func (x *Cost) Reset() {
+	*x = Cost{}
+	mi := &file_aptrouter_v1_aptrouter_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Cost) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Cost) ProtoMessage() {}
+
+func (x *Cost) ProtoReflect() protoreflect.Message {
+	mi := &file_aptrouter_v1_aptrouter_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Cost.ProtoReflect.Descriptor instead.
+func (*Cost) Descriptor() ([]byte, []int) {
+	return file_aptrouter_v1_aptrouter_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Cost) GetBaseMicros() int64 {
+	if x != nil {
+		return x.BaseMicros
+	}
+	return 0
+}
+
+func (x *Cost) GetMarkupMicros() int64 {
+	if x != nil {
+		return x.MarkupMicros
+	}
+	return 0
+}
+
+func (x *Cost) GetPlatformFeeMicros() int64 {
+	if x != nil {
+		return x.PlatformFeeMicros
+	}
+	return 0
+}
+
+func (x *Cost) GetTotalMicros() int64 {
+	if x != nil {
+		return x.TotalMicros
+	}
+	return 0
+}
+
+func (x *Cost) GetCreditsUsedMicros() int64 {
+	if x != nil {
+		return x.CreditsUsedMicros
+	}
+	return 0
+}
+
+func (x *Cost) GetBillingMode() string {
+	if x != nil {
+		return x.BillingMode
+	}
+	return ""
+}
+
+type GenerateResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Text          string                 `protobuf:"bytes,2,opt,name=text,proto3" json:"text,omitempty"`
+	Model         string                 `protobuf:"bytes,3,opt,name=model,proto3" json:"model,omitempty"`
+	Provider      string                 `protobuf:"bytes,4,opt,name=provider,proto3" json:"provider,omitempty"`
+	FinishReason  string                 `protobuf:"bytes,5,opt,name=finish_reason,json=finishReason,proto3" json:"finish_reason,omitempty"`
+	Usage         *Usage                 `protobuf:"bytes,6,opt,name=usage,proto3" json:"usage,omitempty"`
+	Cost          *Cost                  `protobuf:"bytes,7,opt,name=cost,proto3" json:"cost,omitempty"`
+	CreatedAt     *timestamppb.Timestamp `protobuf:"bytes,8,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	Metadata      map[string]string      `protobuf:"bytes,9,rep,name=metadata,proto3" json:"metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GenerateResponse) Reset() {
+	*x = GenerateResponse{}
+	mi := &file_aptrouter_v1_aptrouter_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GenerateResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GenerateResponse) ProtoMessage() {}
+
+func (x *GenerateResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_aptrouter_v1_aptrouter_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GenerateResponse.ProtoReflect.Descriptor instead.
+func (*GenerateResponse) Descriptor() ([]byte, []int) {
+	return file_aptrouter_v1_aptrouter_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *GenerateResponse) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *GenerateResponse) GetText() string {
+	if x != nil {
+		return x.Text
+	}
+	return ""
+}
+
+func (x *GenerateResponse) GetModel() string {
+	if x != nil {
+		return x.Model
+	}
+	return ""
+}
+
+func (x *GenerateResponse) GetProvider() string {
+	if x != nil {
+		return x.Provider
+	}
+	return ""
+}
+
+func (x *GenerateResponse) GetFinishReason() string {
+	if x != nil {
+		return x.FinishReason
+	}
+	return ""
+}
+
+func (x *GenerateResponse) GetUsage() *Usage {
+	if x != nil {
+		return x.Usage
+	}
+	return nil
+}
+
+func (x *GenerateResponse) GetCost() *Cost {
+	if x != nil {
+		return x.Cost
+	}
+	return nil
+}
+
+func (x *GenerateResponse) GetCreatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return nil
+}
+
+func (x *GenerateResponse) GetMetadata() map[string]string {
+	if x != nil {
+		return x.Metadata
+	}
+	return nil
+}
+
+// GenerateStreamResponse carries a chunk of generated text. The last message of a stream
+// has done set and carries the stream's metadata instead.
+type GenerateStreamResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Text          string                 `protobuf:"bytes,1,opt,name=text,proto3" json:"text,omitempty"`
+	Done          bool                   `protobuf:"varint,2,opt,name=done,proto3" json:"done,omitempty"`
+	Metadata      map[string]string      `protobuf:"bytes,3,rep,name=metadata,proto3" json:"metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GenerateStreamResponse) Reset() {
+	*x = GenerateStreamResponse{}
+	mi := &file_aptrouter_v1_aptrouter_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GenerateStreamResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GenerateStreamResponse) ProtoMessage() {}
+
+func (x *GenerateStreamResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_aptrouter_v1_aptrouter_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GenerateStreamResponse.ProtoReflect.Descriptor instead.
+func (*GenerateStreamResponse) Descriptor() ([]byte, []int) {
+	return file_aptrouter_v1_aptrouter_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *GenerateStreamResponse) GetText() string {
+	if x != nil {
+		return x.Text
+	}
+	return ""
+}
+
+func (x *GenerateStreamResponse) GetDone() bool {
+	if x != nil {
+		return x.Done
+	}
+	return false
+}
+
+func (x *GenerateStreamResponse) GetMetadata() map[string]string {
+	if x != nil {
+		return x.Metadata
+	}
+	return nil
+}
+
+type GetUsageRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// since and until default to the last 30 days
+	Since *timestamppb.Timestamp `protobuf:"bytes,1,opt,name=since,proto3" json:"since,omitempty"`
+	Until *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=until,proto3" json:"until,omitempty"`
+	// granularity is "day" (the default) or "hour", which is limited to a 7 day range
+	Granularity   string `protobuf:"bytes,3,opt,name=granularity,proto3" json:"granularity,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetUsageRequest) Reset() {
+	*x = GetUsageRequest{}
+	mi := &file_aptrouter_v1_aptrouter_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetUsageRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetUsageRequest) ProtoMessage() {}
+
+func (x *GetUsageRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_aptrouter_v1_aptrouter_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetUsageRequest.ProtoReflect.Descriptor instead.
+func (*GetUsageRequest) Descriptor() ([]byte, []int) {
+	return file_aptrouter_v1_aptrouter_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *GetUsageRequest) GetSince() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Since
+	}
+	return nil
+}
+
+func (x *GetUsageRequest) GetUntil() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Until
+	}
+	return nil
+}
+
+func (x *GetUsageRequest) GetGranularity() string {
+	if x != nil {
+		return x.Granularity
+	}
+	return ""
+}
+
+type UsageRollup struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	ModelId         string                 `protobuf:"bytes,1,opt,name=model_id,json=modelId,proto3" json:"model_id,omitempty"`
+	BucketStart     *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=bucket_start,json=bucketStart,proto3" json:"bucket_start,omitempty"`
+	Requests        int64                  `protobuf:"varint,3,opt,name=requests,proto3" json:"requests,omitempty"`
+	InputTokens     int64                  `protobuf:"varint,4,opt,name=input_tokens,json=inputTokens,proto3" json:"input_tokens,omitempty"`
+	OutputTokens    int64                  `protobuf:"varint,5,opt,name=output_tokens,json=outputTokens,proto3" json:"output_tokens,omitempty"`
+	TotalTokens     int64                  `protobuf:"varint,6,opt,name=total_tokens,json=totalTokens,proto3" json:"total_tokens,omitempty"`
+	TotalCostMicros int64                  `protobuf:"varint,7,opt,name=total_cost_micros,json=totalCostMicros,proto3" json:"total_cost_micros,omitempty"`
+	TokensSaved     int64                  `protobuf:"varint,8,opt,name=tokens_saved,json=tokensSaved,proto3" json:"tokens_saved,omitempty"`
+	SavingsMicros   int64                  `protobuf:"varint,9,opt,name=savings_micros,json=savingsMicros,proto3" json:"savings_micros,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *UsageRollup) Reset() {
+	*x = UsageRollup{}
+	mi := &file_aptrouter_v1_aptrouter_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UsageRollup) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UsageRollup) ProtoMessage() {}
+
+func (x *UsageRollup) ProtoReflect() protoreflect.Message {
+	mi := &file_aptrouter_v1_aptrouter_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UsageRollup.ProtoReflect.Descriptor instead.
+func (*UsageRollup) Descriptor() ([]byte, []int) {
+	return file_aptrouter_v1_aptrouter_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *UsageRollup) GetModelId() string {
+	if x != nil {
+		return x.ModelId
+	}
+	return ""
+}
+
+func (x *UsageRollup) GetBucketStart() *timestamppb.Timestamp {
+	if x != nil {
+		return x.BucketStart
+	}
+	return nil
+}
+
+func (x *UsageRollup) GetRequests() int64 {
+	if x != nil {
+		return x.Requests
+	}
+	return 0
+}
+
+func (x *UsageRollup) GetInputTokens() int64 {
+	if x != nil {
+		return x.InputTokens
+	}
+	return 0
+}
+
+func (x *UsageRollup) GetOutputTokens() int64 {
+	if x != nil {
+		return x.OutputTokens
+	}
+	return 0
+}
+
+func (x *UsageRollup) GetTotalTokens() int64 {
+	if x != nil {
+		return x.TotalTokens
+	}
+	return 0
+}
+
+func (x *UsageRollup) GetTotalCostMicros() int64 {
+	if x != nil {
+		return x.TotalCostMicros
+	}
+	return 0
+}
+
+func (x *UsageRollup) GetTokensSaved() int64 {
+	if x != nil {
+		return x.TokensSaved
+	}
+	return 0
+}
+
+func (x *UsageRollup) GetSavingsMicros() int64 {
+	if x != nil {
+		return x.SavingsMicros
+	}
+	return 0
+}
+
+type GetUsageResponse struct {
+	state              protoimpl.MessageState `protogen:"open.v1"`
+	TotalCostMicros    int64                  `protobuf:"varint,1,opt,name=total_cost_micros,json=totalCostMicros,proto3" json:"total_cost_micros,omitempty"`
+	TotalTokens        int64                  `protobuf:"varint,2,opt,name=total_tokens,json=totalTokens,proto3" json:"total_tokens,omitempty"`
+	TotalRequests      int64                  `protobuf:"varint,3,opt,name=total_requests,json=totalRequests,proto3" json:"total_requests,omitempty"`
+	TotalTokensSaved   int64                  `protobuf:"varint,4,opt,name=total_tokens_saved,json=totalTokensSaved,proto3" json:"total_tokens_saved,omitempty"`
+	TotalSavingsMicros int64                  `protobuf:"varint,5,opt,name=total_savings_micros,json=totalSavingsMicros,proto3" json:"total_savings_micros,omitempty"`
+	Start              *timestamppb.Timestamp `protobuf:"bytes,6,opt,name=start,proto3" json:"start,omitempty"`
+	End                *timestamppb.Timestamp `protobuf:"bytes,7,opt,name=end,proto3" json:"end,omitempty"`
+	Granularity        string                 `protobuf:"bytes,8,opt,name=granularity,proto3" json:"granularity,omitempty"`
+	ByModel            []*UsageRollup         `protobuf:"bytes,9,rep,name=by_model,json=byModel,proto3" json:"by_model,omitempty"`
+	Buckets            []*UsageRollup         `protobuf:"bytes,10,rep,name=buckets,proto3" json:"buckets,omitempty"`
+	unknownFields      protoimpl.UnknownFields
+	sizeCache          protoimpl.SizeCache
+}
+
+func (x *GetUsageResponse) Reset() {
+	*x = GetUsageResponse{}
+	mi := &file_aptrouter_v1_aptrouter_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetUsageResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetUsageResponse) ProtoMessage() {}
+
+func (x *GetUsageResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_aptrouter_v1_aptrouter_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetUsageResponse.ProtoReflect.Descriptor instead.
+func (*GetUsageResponse) Descriptor() ([]byte, []int) {
+	return file_aptrouter_v1_aptrouter_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *GetUsageResponse) GetTotalCostMicros() int64 {
+	if x != nil {
+		return x.TotalCostMicros
+	}
+	return 0
+}
+
+func (x *GetUsageResponse) GetTotalTokens() int64 {
+	if x != nil {
+		return x.TotalTokens
+	}
+	return 0
+}
+
+func (x *GetUsageResponse) GetTotalRequests() int64 {
+	if x != nil {
+		return x.TotalRequests
+	}
+	return 0
+}
+
+func (x *GetUsageResponse) GetTotalTokensSaved() int64 {
+	if x != nil {
+		return x.TotalTokensSaved
+	}
+	return 0
+}
+
+func (x *GetUsageResponse) GetTotalSavingsMicros() int64 {
+	if x != nil {
+		return x.TotalSavingsMicros
+	}
+	return 0
+}
+
+func (x *GetUsageResponse) GetStart() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Start
+	}
+	return nil
+}
+
+func (x *GetUsageResponse) GetEnd() *timestamppb.Timestamp {
+	if x != nil {
+		return x.End
+	}
+	return nil
+}
+
+func (x *GetUsageResponse) GetGranularity() string {
+	if x != nil {
+		return x.Granularity
+	}
+	return ""
+}
+
+func (x *GetUsageResponse) GetByModel() []*UsageRollup {
+	if x != nil {
+		return x.ByModel
+	}
+	return nil
+}
+
+func (x *GetUsageResponse) GetBuckets() []*UsageRollup {
+	if x != nil {
+		return x.Buckets
+	}
+	return nil
+}
+
+type GetBalanceRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetBalanceRequest) Reset() {
+	*x = GetBalanceRequest{}
+	mi := &file_aptrouter_v1_aptrouter_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetBalanceRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetBalanceRequest) ProtoMessage() {}
+
+func (x *GetBalanceRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_aptrouter_v1_aptrouter_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetBalanceRequest.ProtoReflect.Descriptor instead.
+func (*GetBalanceRequest) Descriptor() ([]byte, []int) {
+	return file_aptrouter_v1_aptrouter_proto_rawDescGZIP(), []int{8}
+}
+
+type GetBalanceResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// balance_micros is the paid balance of the key's user, or of its organization for organization keys
+	BalanceMicros int64 `protobuf:"varint,1,opt,name=balance_micros,json=balanceMicros,proto3" json:"balance_micros,omitempty"`
+	// credits_micros is the user's unexpired promotional credit; organization balances have none
+	CreditsMicros int64  `protobuf:"varint,2,opt,name=credits_micros,json=creditsMicros,proto3" json:"credits_micros,omitempty"`
+	OrgId         string `protobuf:"bytes,3,opt,name=org_id,json=orgId,proto3" json:"org_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetBalanceResponse) Reset() {
+	*x = GetBalanceResponse{}
+	mi := &file_aptrouter_v1_aptrouter_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetBalanceResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetBalanceResponse) ProtoMessage() {}
+
+func (x *GetBalanceResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_aptrouter_v1_aptrouter_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetBalanceResponse.ProtoReflect.Descriptor instead.
+func (*GetBalanceResponse) Descriptor() ([]byte, []int) {
+	return file_aptrouter_v1_aptrouter_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *GetBalanceResponse) GetBalanceMicros() int64 {
+	if x != nil {
+		return x.BalanceMicros
+	}
+	return 0
+}
+
+func (x *GetBalanceResponse) GetCreditsMicros() int64 {
+	if x != nil {
+		return x.CreditsMicros
+	}
+	return 0
+}
+
+func (x *GetBalanceResponse) GetOrgId() string {
+	if x != nil {
+		return x.OrgId
+	}
+	return ""
+}
+
+var File_aptrouter_v1_aptrouter_proto protoreflect.FileDescriptor
+
+const file_aptrouter_v1_aptrouter_proto_rawDesc = "" +
+	"\n" +
+	"\x1captrouter/v1/aptrouter.proto\x12\faptrouter.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"\xd5\x05\n" +
+	"\x0fGenerateRequest\x12\x14\n" +
+	"\x05model\x18\x01 \x01(\tR\x05model\x12\x16\n" +
+	"\x06prompt\x18\x02 \x01(\tR\x06prompt\x12\x1f\n" +
+	"\vtemplate_id\x18\x03 \x01(\tR\n" +
+	"templateId\x12)\n" +
+	"\x10template_version\x18\x04 \x01(\x05R\x0ftemplateVersion\x12J\n" +
+	"\tvariables\x18\x05 \x03(\v2,.aptrouter.v1.GenerateRequest.VariablesEntryR\tvariables\x12\"\n" +
+	"\n" +
+	"max_tokens\x18\x06 \x01(\x05H\x00R\tmaxTokens\x88\x01\x01\x12%\n" +
+	"\vtemperature\x18\a \x01(\x01H\x01R\vtemperature\x88\x01\x01\x12\x18\n" +
+	"\x05top_p\x18\b \x01(\x01H\x02R\x04topP\x88\x01\x01\x12\x12\n" +
+	"\x04stop\x18\t \x03(\tR\x04stop\x120\n" +
+	"\x11frequency_penalty\x18\n" +
+	" \x01(\x01H\x03R\x10frequencyPenalty\x88\x01\x01\x12.\n" +
+	"\x10presence_penalty\x18\v \x01(\x01H\x04R\x0fpresencePenalty\x88\x01\x01\x12\x17\n" +
+	"\x04seed\x18\f \x01(\x03H\x05R\x04seed\x88\x01\x01\x12,\n" +
+	"\x0ftimeout_seconds\x18\r \x01(\x05H\x06R\x0etimeoutSeconds\x88\x01\x01\x12+\n" +
+	"\x11optimization_mode\x18\x0e \x01(\tR\x10optimizationMode\x1a<\n" +
+	"\x0eVariablesEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01B\r\n" +
+	"\v_max_tokensB\x0e\n" +
+	"\f_temperatureB\b\n" +
+	"\x06_top_pB\x14\n" +
+	"\x12_frequency_penaltyB\x13\n" +
+	"\x11_presence_penaltyB\a\n" +
+	"\x05_seedB\x12\n" +
+	"\x10_timeout_seconds\"r\n" +
+	"\x05Usage\x12!\n" +
+	"\finput_tokens\x18\x01 \x01(\x05R\vinputTokens\x12#\n" +
+	"\routput_tokens\x18\x02 \x01(\x05R\foutputTokens\x12!\n" +
+	"\ftotal_tokens\x18\x03 \x01(\x05R\vtotalTokens\"\xf2\x01\n" +
+	"\x04Cost\x12\x1f\n" +
+	"\vbase_micros\x18\x01 \x01(\x03R\n" +
+	"baseMicros\x12#\n" +
+	"\rmarkup_micros\x18\x02 \x01(\x03R\fmarkupMicros\x12.\n" +
+	"\x13platform_fee_micros\x18\x03 \x01(\x03R\x11platformFeeMicros\x12!\n" +
+	"\ftotal_micros\x18\x04 \x01(\x03R\vtotalMicros\x12.\n" +
+	"\x13credits_used_micros\x18\x05 \x01(\x03R\x11creditsUsedMicros\x12!\n" +
+	"\fbilling_mode\x18\x06 \x01(\tR\vbillingMode\"\xa2\x03\n" +
+	"\x10GenerateResponse\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x12\n" +
+	"\x04text\x18\x02 \x01(\tR\x04text\x12\x14\n" +
+	"\x05model\x18\x03 \x01(\tR\x05model\x12\x1a\n" +
+	"\bprovider\x18\x04 \x01(\tR\bprovider\x12#\n" +
+	"\rfinish_reason\x18\x05 \x01(\tR\ffinishReason\x12)\n" +
+	"\x05usage\x18\x06 \x01(\v2\x13.aptrouter.v1.UsageR\x05usage\x12&\n" +
+	"\x04cost\x18\a \x01(\v2\x12.aptrouter.v1.CostR\x04cost\x129\n" +
+	"\n" +
+	"created_at\x18\b \x01(\v2\x1a.google.protobuf.TimestampR\tcreatedAt\x12H\n" +
+	"\bmetadata\x18\t \x03(\v2,.aptrouter.v1.GenerateResponse.MetadataEntryR\bmetadata\x1a;\n" +
+	"\rMetadataEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\xcd\x01\n" +
+	"\x16GenerateStreamResponse\x12\x12\n" +
+	"\x04text\x18\x01 \x01(\tR\x04text\x12\x12\n" +
+	"\x04done\x18\x02 \x01(\bR\x04done\x12N\n" +
+	"\bmetadata\x18\x03 \x03(\v22.aptrouter.v1.GenerateStreamResponse.MetadataEntryR\bmetadata\x1a;\n" +
+	"\rMetadataEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\x97\x01\n" +
+	"\x0fGetUsageRequest\x120\n" +
+	"\x05since\x18\x01 \x01(\v2\x1a.google.protobuf.TimestampR\x05since\x120\n" +
+	"\x05until\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\x05until\x12 \n" +
+	"\vgranularity\x18\x03 \x01(\tR\vgranularity\"\xe4\x02\n" +
+	"\vUsageRollup\x12\x19\n" +
+	"\bmodel_id\x18\x01 \x01(\tR\amodelId\x12=\n" +
+	"\fbucket_start\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\vbucketStart\x12\x1a\n" +
+	"\brequests\x18\x03 \x01(\x03R\brequests\x12!\n" +
+	"\finput_tokens\x18\x04 \x01(\x03R\vinputTokens\x12#\n" +
+	"\routput_tokens\x18\x05 \x01(\x03R\foutputTokens\x12!\n" +
+	"\ftotal_tokens\x18\x06 \x01(\x03R\vtotalTokens\x12*\n" +
+	"\x11total_cost_micros\x18\a \x01(\x03R\x0ftotalCostMicros\x12!\n" +
+	"\ftokens_saved\x18\b \x01(\x03R\vtokensSaved\x12%\n" +
+	"\x0esavings_micros\x18\t \x01(\x03R\rsavingsMicros\"\xd5\x03\n" +
+	"\x10GetUsageResponse\x12*\n" +
+	"\x11total_cost_micros\x18\x01 \x01(\x03R\x0ftotalCostMicros\x12!\n" +
+	"\ftotal_tokens\x18\x02 \x01(\x03R\vtotalTokens\x12%\n" +
+	"\x0etotal_requests\x18\x03 \x01(\x03R\rtotalRequests\x12,\n" +
+	"\x12total_tokens_saved\x18\x04 \x01(\x03R\x10totalTokensSaved\x120\n" +
+	"\x14total_savings_micros\x18\x05 \x01(\x03R\x12totalSavingsMicros\x120\n" +
+	"\x05start\x18\x06 \x01(\v2\x1a.google.protobuf.TimestampR\x05start\x12,\n" +
+	"\x03end\x18\a \x01(\v2\x1a.google.protobuf.TimestampR\x03end\x12 \n" +
+	"\vgranularity\x18\b \x01(\tR\vgranularity\x124\n" +
+	"\bby_model\x18\t \x03(\v2\x19.aptrouter.v1.UsageRollupR\abyModel\x123\n" +
+	"\abuckets\x18\n" +
+	" \x03(\v2\x19.aptrouter.v1.UsageRollupR\abuckets\"\x13\n" +
+	"\x11GetBalanceRequest\"y\n" +
+	"\x12GetBalanceResponse\x12%\n" +
+	"\x0ebalance_micros\x18\x01 \x01(\x03R\rbalanceMicros\x12%\n" +
+	"\x0ecredits_micros\x18\x02 \x01(\x03R\rcreditsMicros\x12\x15\n" +
+	"\x06org_id\x18\x03 \x01(\tR\x05orgId2\xcb\x02\n" +
+	"\tAptRouter\x12I\n" +
+	"\bGenerate\x12\x1d.aptrouter.v1.GenerateRequest\x1a\x1e.aptrouter.v1.GenerateResponse\x12W\n" +
+	"\x0eGenerateStream\x12\x1d.aptrouter.v1.GenerateRequest\x1a$.aptrouter.v1.GenerateStreamResponse0\x01\x12I\n" +
+	"\bGetUsage\x12\x1d.aptrouter.v1.GetUsageRequest\x1a\x1e.aptrouter.v1.GetUsageResponse\x12O\n" +
+	"\n" +
+	"GetBalance\x12\x1f.aptrouter.v1.GetBalanceRequest\x1a .aptrouter.v1.GetBalanceResponseBDZBgithub.com/apt-router/api/internal/grpcapi/aptrouterv1;aptrouterv1b\x06proto3"
+
+var (
+	file_aptrouter_v1_aptrouter_proto_rawDescOnce sync.Once
+	file_aptrouter_v1_aptrouter_proto_rawDescData []byte
+)
+
+func file_aptrouter_v1_aptrouter_proto_rawDescGZIP() []byte {
+	file_aptrouter_v1_aptrouter_proto_rawDescOnce.Do(func() {
+		file_aptrouter_v1_aptrouter_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_aptrouter_v1_aptrouter_proto_rawDesc), len(file_aptrouter_v1_aptrouter_proto_rawDesc)))
+	})
+	return file_aptrouter_v1_aptrouter_proto_rawDescData
+}
+
+var file_aptrouter_v1_aptrouter_proto_msgTypes = make([]protoimpl.MessageInfo, 13)
+var file_aptrouter_v1_aptrouter_proto_goTypes = []any{
+	(*GenerateRequest)(nil),        // 0: aptrouter.v1.GenerateRequest
+	(*Usage)(nil),                  // 1: aptrouter.v1.Usage
+	(*Cost)(nil),                   // 2: aptrouter.v1.Cost
+	(*GenerateResponse)(nil),       // 3: aptrouter.v1.GenerateResponse
+	(*GenerateStreamResponse)(nil), // 4: aptrouter.v1.GenerateStreamResponse
+	(*GetUsageRequest)(nil),        // 5: aptrouter.v1.GetUsageRequest
+	(*UsageRollup)(nil),            // 6: aptrouter.v1.UsageRollup
+	(*GetUsageResponse)(nil),       // 7: aptrouter.v1.GetUsageResponse
+	(*GetBalanceRequest)(nil),      // 8: aptrouter.v1.GetBalanceRequest
+	(*GetBalanceResponse)(nil),     // 9: aptrouter.v1.GetBalanceResponse
+	nil,                            // 10: aptrouter.v1.GenerateRequest.VariablesEntry
+	nil,                            // 11: aptrouter.v1.GenerateResponse.MetadataEntry
+	nil,                            // 12: aptrouter.v1.GenerateStreamResponse.MetadataEntry
+	(*timestamppb.Timestamp)(nil),  // 13: google.protobuf.Timestamp
+}
+var file_aptrouter_v1_aptrouter_proto_depIdxs = []int32{
+	10, // 0: aptrouter.v1.GenerateRequest.variables:type_name -> aptrouter.v1.GenerateRequest.VariablesEntry
+	1,  // 1: aptrouter.v1.GenerateResponse.usage:type_name -> aptrouter.v1.Usage
+	2,  // 2: aptrouter.v1.GenerateResponse.cost:type_name -> aptrouter.v1.Cost
+	13, // 3: aptrouter.v1.GenerateResponse.created_at:type_name -> google.protobuf.Timestamp
+	11, // 4: aptrouter.v1.GenerateResponse.metadata:type_name -> aptrouter.v1.GenerateResponse.MetadataEntry
+	12, // 5: aptrouter.v1.GenerateStreamResponse.metadata:type_name -> aptrouter.v1.GenerateStreamResponse.MetadataEntry
+	13, // 6: aptrouter.v1.GetUsageRequest.since:type_name -> google.protobuf.Timestamp
+	13, // 7: aptrouter.v1.GetUsageRequest.until:type_name -> google.protobuf.Timestamp
+	13, // 8: aptrouter.v1.UsageRollup.bucket_start:type_name -> google.protobuf.Timestamp
+	13, // 9: aptrouter.v1.GetUsageResponse.start:type_name -> google.protobuf.Timestamp
+	13, // 10: aptrouter.v1.GetUsageResponse.end:type_name -> google.protobuf.Timestamp
+	6,  // 11: aptrouter.v1.GetUsageResponse.by_model:type_name -> aptrouter.v1.UsageRollup
+	6,  // 12: aptrouter.v1.GetUsageResponse.buckets:type_name -> aptrouter.v1.UsageRollup
+	0,  // 13: aptrouter.v1.AptRouter.Generate:input_type -> aptrouter.v1.GenerateRequest
+	0,  // 14: aptrouter.v1.AptRouter.GenerateStream:input_type -> aptrouter.v1.GenerateRequest
+	5,  // 15: aptrouter.v1.AptRouter.GetUsage:input_type -> aptrouter.v1.GetUsageRequest
+	8,  // 16: aptrouter.v1.AptRouter.GetBalance:input_type -> aptrouter.v1.GetBalanceRequest
+	3,  // 17: aptrouter.v1.AptRouter.Generate:output_type -> aptrouter.v1.GenerateResponse
+	4,  // 18: aptrouter.v1.AptRouter.GenerateStream:output_type -> aptrouter.v1.GenerateStreamResponse
+	7,  // 19: aptrouter.v1.AptRouter.GetUsage:output_type -> aptrouter.v1.GetUsageResponse
+	9,  // 20: aptrouter.v1.AptRouter.GetBalance:output_type -> aptrouter.v1.GetBalanceResponse
+	17, // [17:21] is the sub-list for method output_type
+	13, // [13:17] is the sub-list for method input_type
+	13, // [13:13] is the sub-list for extension type_name
+	13, // [13:13] is the sub-list for extension extendee
+	0,  // [0:13] is the sub-list for field type_name
+}
+
+func init() { file_aptrouter_v1_aptrouter_proto_init() }
+func file_aptrouter_v1_aptrouter_proto_init() {
+	if File_aptrouter_v1_aptrouter_proto != nil {
+		return
+	}
+	file_aptrouter_v1_aptrouter_proto_msgTypes[0].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_aptrouter_v1_aptrouter_proto_rawDesc), len(file_aptrouter_v1_aptrouter_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   13,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_aptrouter_v1_aptrouter_proto_goTypes,
+		DependencyIndexes: file_aptrouter_v1_aptrouter_proto_depIdxs,
+		MessageInfos:      file_aptrouter_v1_aptrouter_proto_msgTypes,
+	}.Build()
+	File_aptrouter_v1_aptrouter_proto = out.File
+	file_aptrouter_v1_aptrouter_proto_goTypes = nil
+	file_aptrouter_v1_aptrouter_proto_depIdxs = nil
+}
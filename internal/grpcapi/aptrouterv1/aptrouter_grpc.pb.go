@@ -0,0 +1,257 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: aptrouter/v1/aptrouter.proto
+
+package aptrouterv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	AptRouter_Generate_FullMethodName       = "/aptrouter.v1.AptRouter/Generate"
+	AptRouter_GenerateStream_FullMethodName = "/aptrouter.v1.AptRouter/GenerateStream"
+	AptRouter_GetUsage_FullMethodName       = "/aptrouter.v1.AptRouter/GetUsage"
+	AptRouter_GetBalance_FullMethodName     = "/aptrouter.v1.AptRouter/GetBalance"
+)
+
+// AptRouterClient is the client API for AptRouter service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// AptRouter mirrors the generate, usage and balance HTTP endpoints for internal consumers.
+// Calls authenticate with an API key in the "authorization" metadata, as on the HTTP API, and
+// are priced, billed and logged the same way.
+type AptRouterClient interface {
+	// Generate runs a generation to completion
+	Generate(ctx context.Context, in *GenerateRequest, opts ...grpc.CallOption) (*GenerateResponse, error)
+	// GenerateStream streams a generation's text as it is produced. Cancelling the call aborts the
+	// provider stream; the tokens generated so far are still billed.
+	GenerateStream(ctx context.Context, in *GenerateRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[GenerateStreamResponse], error)
+	// GetUsage summarizes the key owner's usage from the hourly or daily rollups
+	GetUsage(ctx context.Context, in *GetUsageRequest, opts ...grpc.CallOption) (*GetUsageResponse, error)
+	// GetBalance returns the balance of the account the key bills
+	GetBalance(ctx context.Context, in *GetBalanceRequest, opts ...grpc.CallOption) (*GetBalanceResponse, error)
+}
+
+type aptRouterClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAptRouterClient(cc grpc.ClientConnInterface) AptRouterClient {
+	return &aptRouterClient{cc}
+}
+
+func (c *aptRouterClient) Generate(ctx context.Context, in *GenerateRequest, opts ...grpc.CallOption) (*GenerateResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GenerateResponse)
+	err := c.cc.Invoke(ctx, AptRouter_Generate_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aptRouterClient) GenerateStream(ctx context.Context, in *GenerateRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[GenerateStreamResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &AptRouter_ServiceDesc.Streams[0], AptRouter_GenerateStream_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[GenerateRequest, GenerateStreamResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AptRouter_GenerateStreamClient = grpc.ServerStreamingClient[GenerateStreamResponse]
+
+func (c *aptRouterClient) GetUsage(ctx context.Context, in *GetUsageRequest, opts ...grpc.CallOption) (*GetUsageResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetUsageResponse)
+	err := c.cc.Invoke(ctx, AptRouter_GetUsage_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aptRouterClient) GetBalance(ctx context.Context, in *GetBalanceRequest, opts ...grpc.CallOption) (*GetBalanceResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetBalanceResponse)
+	err := c.cc.Invoke(ctx, AptRouter_GetBalance_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AptRouterServer is the server API for AptRouter service.
+// All implementations must embed UnimplementedAptRouterServer
+// for forward compatibility.
+//
+// AptRouter mirrors the generate, usage and balance HTTP endpoints for internal consumers.
+// Calls authenticate with an API key in the "authorization" metadata, as on the HTTP API, and
+// are priced, billed and logged the same way.
+type AptRouterServer interface {
+	// Generate runs a generation to completion
+	Generate(context.Context, *GenerateRequest) (*GenerateResponse, error)
+	// GenerateStream streams a generation's text as it is produced. Cancelling the call aborts the
+	// provider stream; the tokens generated so far are still billed.
+	GenerateStream(*GenerateRequest, grpc.ServerStreamingServer[GenerateStreamResponse]) error
+	// GetUsage summarizes the key owner's usage from the hourly or daily rollups
+	GetUsage(context.Context, *GetUsageRequest) (*GetUsageResponse, error)
+	// GetBalance returns the balance of the account the key bills
+	GetBalance(context.Context, *GetBalanceRequest) (*GetBalanceResponse, error)
+	mustEmbedUnimplementedAptRouterServer()
+}
+
+// UnimplementedAptRouterServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedAptRouterServer struct{}
+
+func (UnimplementedAptRouterServer) Generate(context.Context, *GenerateRequest) (*GenerateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Generate not implemented")
+}
+func (UnimplementedAptRouterServer) GenerateStream(*GenerateRequest, grpc.ServerStreamingServer[GenerateStreamResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method GenerateStream not implemented")
+}
+func (UnimplementedAptRouterServer) GetUsage(context.Context, *GetUsageRequest) (*GetUsageResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUsage not implemented")
+}
+func (UnimplementedAptRouterServer) GetBalance(context.Context, *GetBalanceRequest) (*GetBalanceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBalance not implemented")
+}
+func (UnimplementedAptRouterServer) mustEmbedUnimplementedAptRouterServer() {}
+func (UnimplementedAptRouterServer) testEmbeddedByValue()                   {}
+
+// UnsafeAptRouterServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AptRouterServer will
+// result in compilation errors.
+type UnsafeAptRouterServer interface {
+	mustEmbedUnimplementedAptRouterServer()
+}
+
+func RegisterAptRouterServer(s grpc.ServiceRegistrar, srv AptRouterServer) {
+	// If the following call pancis, it indicates UnimplementedAptRouterServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&AptRouter_ServiceDesc, srv)
+}
+
+func _AptRouter_Generate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GenerateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AptRouterServer).Generate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AptRouter_Generate_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AptRouterServer).Generate(ctx, req.(*GenerateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AptRouter_GenerateStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(GenerateRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AptRouterServer).GenerateStream(m, &grpc.GenericServerStream[GenerateRequest, GenerateStreamResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AptRouter_GenerateStreamServer = grpc.ServerStreamingServer[GenerateStreamResponse]
+
+func _AptRouter_GetUsage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetUsageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AptRouterServer).GetUsage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AptRouter_GetUsage_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AptRouterServer).GetUsage(ctx, req.(*GetUsageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AptRouter_GetBalance_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetBalanceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AptRouterServer).GetBalance(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AptRouter_GetBalance_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AptRouterServer).GetBalance(ctx, req.(*GetBalanceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// AptRouter_ServiceDesc is the grpc.ServiceDesc for AptRouter service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (not even as a copy)
+var AptRouter_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "aptrouter.v1.AptRouter",
+	HandlerType: (*AptRouterServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Generate",
+			Handler:    _AptRouter_Generate_Handler,
+		},
+		{
+			MethodName: "GetUsage",
+			Handler:    _AptRouter_GetUsage_Handler,
+		},
+		{
+			MethodName: "GetBalance",
+			Handler:    _AptRouter_GetBalance_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "GenerateStream",
+			Handler:       _AptRouter_GenerateStream_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "aptrouter/v1/aptrouter.proto",
+}
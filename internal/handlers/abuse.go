@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// failureGuard blocks requests that keep failing identically, such as a client retrying a malformed
+// request in a loop, once they have failed limit times within window
+type failureGuard struct {
+	limit  int
+	window time.Duration
+	block  time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]*failureEntry
+	lastSweep time.Time
+}
+
+// failureEntry counts one request fingerprint's failures since first
+type failureEntry struct {
+	first        time.Time
+	failures     int
+	blockedUntil time.Time
+}
+
+// newFailureGuard creates a guard blocking a request after limit failures, or nil when limit is 0
+func newFailureGuard(limit int, window, block time.Duration) *failureGuard {
+	if limit <= 0 {
+		return nil
+	}
+	return &failureGuard{
+		limit:   limit,
+		window:  window,
+		block:   block,
+		entries: make(map[string]*failureEntry),
+	}
+}
+
+// blocked returns how much longer the request is blocked for, if it is
+func (g *failureGuard) blocked(key string, now time.Time) (time.Duration, bool) {
+	if g == nil {
+		return 0, false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	entry, ok := g.entries[key]
+	if !ok || !now.Before(entry.blockedUntil) {
+		return 0, false
+	}
+	return entry.blockedUntil.Sub(now), true
+}
+
+// fail counts a failure of the request, reporting whether it is now blocked
+func (g *failureGuard) fail(key string, now time.Time) bool {
+	if g == nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.sweep(now)
+
+	entry, ok := g.entries[key]
+	if !ok || now.Sub(entry.first) > g.window {
+		entry = &failureEntry{first: now}
+		g.entries[key] = entry
+	}
+	entry.failures++
+	if entry.failures < g.limit {
+		return false
+	}
+	// The next failure after the block starts a new window
+	entry.blockedUntil = now.Add(g.block)
+	entry.first = entry.blockedUntil
+	entry.failures = 0
+	return true
+}
+
+// succeed forgets the request's failures
+func (g *failureGuard) succeed(key string) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.entries, key)
+}
+
+// sweep drops entries whose window and block have passed, at most once per window. The caller
+// holds g.mu.
+func (g *failureGuard) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < g.window {
+		return
+	}
+	g.lastSweep = now
+	for key, entry := range g.entries {
+		if now.Sub(entry.first) > g.window && !now.Before(entry.blockedUntil) {
+			delete(g.entries, key)
+		}
+	}
+}
+
+// requestFingerprint identifies identical requests from one API key
+func requestFingerprint(apiKeyID string, r *http.Request, body []byte) string {
+	sum := sha256.New()
+	io.WriteString(sum, r.Method+" "+r.URL.Path+"\n")
+	sum.Write(body)
+	return apiKeyID + ":" + hex.EncodeToString(sum.Sum(nil))
+}
+
+// countsAsRepeatedFailure reports whether a response status is the caller's fault and so counts
+// towards blocking the request. Rate limits pass on their own, and server and provider errors may
+// succeed when retried.
+func countsAsRepeatedFailure(status int) bool {
+	return status >= 400 && status < 500 && status != http.StatusTooManyRequests
+}
+
+// RepeatedFailureMiddleware blocks an API key's request for a while once the identical request has
+// failed with a client error too many times in a row, answering 429 with the repeated_failing_request
+// code instead of running it again. Any success clears the request's failures. It must run after
+// AuthMiddleware.
+func (h *Handler) RepeatedFailureMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestCtx, exists := h.getRequestContext(c)
+		if !exists || h.failureGuard == nil || c.Request.Body == nil || c.Request.Body == http.NoBody {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error": "Failed to read request body",
+			})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		if len(body) == 0 {
+			c.Next()
+			return
+		}
+
+		key := requestFingerprint(requestCtx.APIKeyID, c.Request, body)
+		if remaining, blocked := h.failureGuard.blocked(key, time.Now()); blocked {
+			retryAfter := int(math.Ceil(remaining.Seconds()))
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error":       "This request has failed repeatedly and is temporarily blocked: fix the request before retrying",
+				"code":        "repeated_failing_request",
+				"retry_after": retryAfter,
+			})
+			return
+		}
+
+		c.Next()
+
+		status := c.Writer.Status()
+		switch {
+		case countsAsRepeatedFailure(status):
+			if h.failureGuard.fail(key, time.Now()) {
+				requestCtx.Logger.Warn("Blocking repeatedly failing request",
+					"status", status,
+					"limit", h.config.RateLimit.RepeatedFailureLimit,
+					"block", h.config.RateLimit.RepeatedFailureBlock)
+			}
+		case status < http.StatusBadRequest:
+			h.failureGuard.succeed(key)
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// ExperimentRequest represents a request to create or replace an experiment
+type ExperimentRequest struct {
+	Name             string                 `json:"name" binding:"required,max=100"`
+	Description      string                 `json:"description,omitempty"`
+	Status           string                 `json:"status,omitempty"`
+	TierIDs          []string               `json:"tier_ids,omitempty"`
+	UserIDs          []string               `json:"user_ids,omitempty"`
+	TreatmentPercent float64                `json:"treatment_percent"`
+	Treatment        data.ExperimentVariant `json:"treatment"`
+	// Shadow mirrors a sample of the experiment's traffic to a secondary model
+	Shadow *data.ShadowTraffic `json:"shadow,omitempty"`
+}
+
+// toExperiment converts the request into an experiment
+func (r *ExperimentRequest) toExperiment() *data.Experiment {
+	return &data.Experiment{
+		Name:             r.Name,
+		Description:      r.Description,
+		Status:           r.Status,
+		TierIDs:          r.TierIDs,
+		UserIDs:          r.UserIDs,
+		TreatmentPercent: r.TreatmentPercent,
+		Treatment:        r.Treatment,
+		Shadow:           r.Shadow,
+	}
+}
+
+// AdminMiddleware restricts platform admin endpoints to the configured admin users.
+// It must run after JWTAuthMiddleware.
+func (h *Handler) AdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := h.getAuthenticatedUserID(c)
+		if !h.config.IsAdmin(userID) {
+			h.recordAudit(c, &data.AuditEvent{
+				Type:    data.AuditAdminAccessDenied,
+				Details: map[string]interface{}{"path": c.FullPath()},
+			})
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "Requires platform admin",
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// ListAuditEvents handles querying the audit log, newest first
+func (h *Handler) ListAuditEvents(c *gin.Context) {
+	logger := h.getLogger(c)
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "limit must be between 1 and 500",
+		})
+		return
+	}
+
+	filter := data.AuditEventFilter{
+		Type:       data.AuditEventType(c.Query("type")),
+		ActorID:    c.Query("actor_id"),
+		OrgID:      c.Query("org_id"),
+		Limit:      limit,
+		StartAfter: c.Query("starting_after"),
+	}
+	if since := c.Query("since"); since != "" {
+		parsed, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "since must be an RFC 3339 timestamp",
+			})
+			return
+		}
+		filter.Since = parsed
+	}
+	if until := c.Query("until"); until != "" {
+		parsed, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "until must be an RFC 3339 timestamp",
+			})
+			return
+		}
+		filter.Until = parsed
+	}
+
+	events, err := h.auditService.List(c.Request.Context(), filter)
+	if err != nil {
+		logger.Error("Failed to list audit events", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to list audit events",
+		})
+		return
+	}
+
+	response := gin.H{
+		"events":   events,
+		"has_more": len(events) == limit,
+	}
+	if len(events) > 0 {
+		response["next_cursor"] = events[len(events)-1].ID
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// ListExperiments handles listing experiments, optionally filtered by ?status=
+func (h *Handler) ListExperiments(c *gin.Context) {
+	experiments, err := h.experimentService.List(c.Request.Context(), c.Query("status"))
+	if err != nil {
+		h.getLogger(c).Error("Failed to list experiments", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to list experiments",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"experiments": experiments,
+	})
+}
+
+// CreateExperiment handles creating an experiment
+func (h *Handler) CreateExperiment(c *gin.Context) {
+	var req ExperimentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	experiment := req.toExperiment()
+	experiment.CreatedBy, _ = h.getAuthenticatedUserID(c)
+
+	err := h.experimentService.Create(c.Request.Context(), experiment)
+	if errors.Is(err, services.ErrInvalidExperiment) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		h.getLogger(c).Error("Failed to create experiment", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create experiment",
+		})
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditExperimentUpdated,
+		TargetID: experiment.ID,
+		After:    experiment,
+	})
+
+	c.JSON(http.StatusCreated, experiment)
+}
+
+// UpdateExperiment handles replacing an experiment's settings, e.g. to pause it or change its traffic split
+func (h *Handler) UpdateExperiment(c *gin.Context) {
+	var req ExperimentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	before, _ := h.experimentService.Get(c.Request.Context(), c.Param("experiment_id"))
+
+	experiment := req.toExperiment()
+	experiment.ID = c.Param("experiment_id")
+	if experiment.Status == "" && before != nil {
+		experiment.Status = before.Status
+	}
+
+	err := h.experimentService.Update(c.Request.Context(), experiment)
+	if errors.Is(err, services.ErrExperimentNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Experiment not found",
+		})
+		return
+	}
+	if errors.Is(err, services.ErrInvalidExperiment) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		h.getLogger(c).Error("Failed to update experiment", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to update experiment",
+		})
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditExperimentUpdated,
+		TargetID: experiment.ID,
+		Before:   before,
+		After:    experiment,
+	})
+
+	c.JSON(http.StatusOK, experiment)
+}
+
+// GetExperimentResults handles comparing cost, latency and tokens saved per experiment variant.
+// The range defaults to the last 30 days.
+func (h *Handler) GetExperimentResults(c *gin.Context) {
+	startDate, endDate, ok := parseDateRange(c, 30)
+	if !ok {
+		return
+	}
+
+	results, err := h.experimentService.Results(c.Request.Context(), c.Param("experiment_id"), startDate, endDate)
+	if errors.Is(err, services.ErrExperimentNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Experiment not found",
+		})
+		return
+	}
+	if err != nil {
+		h.getLogger(c).Error("Failed to get experiment results", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get experiment results",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"experiment_id": c.Param("experiment_id"),
+		"start_date":    startDate,
+		"end_date":      endDate,
+		"variants":      results,
+	})
+}
+
+// GetShadowResults handles listing the requests an experiment mirrored to its shadow model, newest
+// first, with a summary comparing them with the originals. The range defaults to the last 30 days.
+func (h *Handler) GetShadowResults(c *gin.Context) {
+	startDate, endDate, ok := parseDateRange(c, 30)
+	if !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "limit must be between 1 and 500",
+		})
+		return
+	}
+
+	experiment, err := h.experimentService.Get(c.Request.Context(), c.Param("experiment_id"))
+	if errors.Is(err, services.ErrExperimentNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Experiment not found",
+		})
+		return
+	}
+	if err != nil {
+		h.getLogger(c).Error("Failed to get experiment", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get shadow results",
+		})
+		return
+	}
+
+	results, err := h.experimentService.ShadowResults(c.Request.Context(), experiment.ID, startDate, endDate, limit)
+	if err != nil {
+		h.getLogger(c).Error("Failed to list shadow results", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get shadow results",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"experiment_id": experiment.ID,
+		"shadow":        experiment.Shadow,
+		"shadow_spend":  experiment.ShadowSpend,
+		"start_date":    startDate,
+		"end_date":      endDate,
+		"summary":       data.SummarizeShadowResults(results),
+		"results":       results,
+	})
+}
+
+// ListQualityEvaluations handles listing the quality scores of sampled optimized requests, newest
+// first, optionally for one ?model=, with a summary. The range defaults to the last 30 days.
+func (h *Handler) ListQualityEvaluations(c *gin.Context) {
+	startDate, endDate, ok := parseDateRange(c, 30)
+	if !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "limit must be between 1 and 500",
+		})
+		return
+	}
+
+	evaluations, err := h.firebaseService.ListQualityEvaluations(c.Request.Context(), c.Query("model"), startDate, endDate, limit)
+	if err != nil {
+		h.getLogger(c).Error("Failed to list quality evaluations", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to list quality evaluations",
+		})
+		return
+	}
+	if evaluations == nil {
+		evaluations = []*data.QualityEvaluation{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"start_date":  startDate,
+		"end_date":    endDate,
+		"summary":     data.SummarizeQualityEvaluations(evaluations),
+		"evaluations": evaluations,
+	})
+}
+
+// ListProviderEndpoints handles reporting the health and average latency of each configured
+// provider endpoint, as seen by this replica
+func (h *Handler) ListProviderEndpoints(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"endpoints": h.generationService.Endpoints().Status(),
+	})
+}
+
+// ListProviderKeyPool handles reporting the load and health of each provider's pooled platform keys,
+// as seen by this replica. Keys are identified by their last four characters only.
+func (h *Handler) ListProviderKeyPool(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"keys": h.generationService.KeyPool().Status(),
+	})
+}
+
+// ListJobs lists the scheduled jobs with their last runs, and the replica elected to run them
+func (h *Handler) ListJobs(c *gin.Context) {
+	leader, jobs, err := h.jobScheduler.Status(c.Request.Context())
+	if err != nil {
+		h.getLogger(c).Error("Failed to get scheduled job status", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get scheduled job status",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"instance_id": h.jobScheduler.InstanceID(),
+		"leader":      leader,
+		"jobs":        jobs,
+	})
+}
+
+// parseDateRange reads the RFC 3339 ?since= and ?until= parameters, defaulting to the last
+// defaultDays days. It writes a 400 and returns false if either is malformed.
+func parseDateRange(c *gin.Context, defaultDays int) (time.Time, time.Time, bool) {
+	endDate := time.Now()
+	startDate := endDate.AddDate(0, 0, -defaultDays)
+	if since := c.Query("since"); since != "" {
+		parsed, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "since must be an RFC 3339 timestamp",
+			})
+			return time.Time{}, time.Time{}, false
+		}
+		startDate = parsed
+	}
+	if until := c.Query("until"); until != "" {
+		parsed, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "until must be an RFC 3339 timestamp",
+			})
+			return time.Time{}, time.Time{}, false
+		}
+		endDate = parsed
+	}
+	return startDate, endDate, true
+}
+
+// RebuildUsageRollups handles recomputing usage rollups from raw request logs, e.g. to backfill
+// history logged before rollups existed. The range defaults to the last day and is widened to whole UTC days.
+func (h *Handler) RebuildUsageRollups(c *gin.Context) {
+	startDate, endDate, ok := parseDateRange(c, 1)
+	if !ok {
+		return
+	}
+
+	count, err := h.firebaseService.RebuildUsageRollups(c.Request.Context(), startDate, endDate)
+	if err != nil {
+		h.getLogger(c).Error("Failed to rebuild usage rollups", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to rebuild usage rollups",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"rollups_written": count,
+		"start_date":      data.RollupBucket(data.RollupDaily, startDate),
+		"end_date":        data.RollupBucket(data.RollupDaily, endDate).AddDate(0, 0, 1),
+	})
+}
@@ -0,0 +1,713 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// CheckoutRequest represents a request to top up the user's balance
+type CheckoutRequest struct {
+	Amount data.MicroUSD `json:"amount" binding:"required"`
+}
+
+// AutoTopUpRequest represents a request to configure automatic top-ups
+type AutoTopUpRequest struct {
+	Enabled   bool          `json:"enabled"`
+	Threshold data.MicroUSD `json:"threshold"`
+	Amount    data.MicroUSD `json:"amount"`
+}
+
+// SpendAlertsRequest represents a request to configure spend alerts
+type SpendAlertsRequest struct {
+	Enabled       bool                       `json:"enabled"`
+	Thresholds    []data.SpendAlertThreshold `json:"thresholds"`
+	MonthlyBudget data.MicroUSD              `json:"monthly_budget"`
+	Email         bool                       `json:"email"`
+	WebhookURL    string                     `json:"webhook_url"`
+}
+
+// UsageExportRequest represents a request to configure usage export
+type UsageExportRequest struct {
+	Enabled bool   `json:"enabled"`
+	Sink    string `json:"sink"`
+	URL     string `json:"url"`
+	// Token is the OpenMeter or Stripe API key; omit it to keep the stored one
+	Token           string            `json:"token"`
+	StripeEventName string            `json:"stripe_event_name"`
+	StripeCustomers map[string]string `json:"stripe_customers"`
+}
+
+// CurrencyRequest represents a request to set the currency amounts are displayed in
+type CurrencyRequest struct {
+	Currency string `json:"currency" binding:"required"`
+}
+
+// exchangeRate returns the rate the caller's amounts are displayed at for at's day: in the
+// ?currency= given, else their preferred currency, else USD. It responds with an error and
+// returns false when the currency is not supported or has no rate yet.
+func (h *Handler) exchangeRate(c *gin.Context, preferred string, at time.Time) (*services.ExchangeRate, bool) {
+	currency := strings.ToUpper(c.DefaultQuery("currency", preferred))
+	if currency == "" {
+		currency = "USD"
+	}
+
+	rate, err := h.currencyService.ExchangeRate(c.Request.Context(), currency, at)
+	switch {
+	case errors.Is(err, services.ErrUnsupportedCurrency):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return nil, false
+	case errors.Is(err, services.ErrNoExchangeRate):
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": err.Error(),
+		})
+		return nil, false
+	case err != nil:
+		h.getLogger(c).Error("Failed to get exchange rate", "currency", currency, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get exchange rate",
+		})
+		return nil, false
+	}
+	return rate, true
+}
+
+// GetCurrency handles getting the currency the user's amounts are displayed in, the currencies
+// supported and their latest exchange rates
+func (h *Handler) GetCurrency(c *gin.Context) {
+	logger := h.getLogger(c)
+
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	ctx := c.Request.Context()
+	user, err := h.firebaseService.GetUserByID(ctx, userID)
+	if err != nil {
+		logger.Error("Failed to get user", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get currency",
+		})
+		return
+	}
+
+	response := gin.H{
+		"currency":  "USD",
+		"supported": h.currencyService.Supported(),
+	}
+	if user.Currency != "" {
+		response["currency"] = user.Currency
+	}
+	// Rates are missing until they are first fetched, which only limits the currencies shown
+	rates, err := h.currencyService.LatestRates(ctx)
+	if err != nil && !errors.Is(err, data.ErrExchangeRatesNotFound) {
+		logger.Error("Failed to get exchange rates", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get currency",
+		})
+		return
+	}
+	if rates != nil {
+		response["exchange_rates"] = rates
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// UpdateCurrency handles setting the currency the user's balances, costs and statements are
+// displayed in. Charges and balances stay in USD.
+func (h *Handler) UpdateCurrency(c *gin.Context) {
+	logger := h.getLogger(c)
+
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	var req CurrencyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+	req.Currency = strings.ToUpper(req.Currency)
+	if err := h.currencyService.ValidateCurrency(req.Currency); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	ctx := c.Request.Context()
+	user, err := h.firebaseService.GetUserByID(ctx, userID)
+	if err != nil {
+		logger.Error("Failed to get user", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to update currency",
+		})
+		return
+	}
+
+	// USD is the default, so it is stored as no preference
+	currency := req.Currency
+	if currency == "USD" {
+		currency = ""
+	}
+	if err := h.firebaseService.UpdateUserCurrency(ctx, userID, currency); err != nil {
+		logger.Error("Failed to update currency", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to update currency",
+		})
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditCurrencyUpdated,
+		TargetID: userID,
+		Before:   user.Currency,
+		After:    currency,
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"currency": req.Currency,
+	})
+}
+
+// CreateCheckoutSession handles creating a Stripe Checkout session for a balance top-up
+func (h *Handler) CreateCheckoutSession(c *gin.Context) {
+	logger := h.getLogger(c)
+
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	var req CheckoutRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	if !h.billingService.Enabled() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": "Billing is not configured",
+		})
+		return
+	}
+
+	if err := h.billingService.ValidateTopUpAmount(req.Amount); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	url, err := h.billingService.CreateCheckoutSession(c.Request.Context(), userID, req.Amount)
+	if err != nil {
+		logger.Error("Failed to create checkout session", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create checkout session",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"checkout_url": url,
+	})
+}
+
+// StripeWebhook handles Stripe webhook events
+func (h *Handler) StripeWebhook(c *gin.Context) {
+	logger := h.getLogger(c)
+
+	payload, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Failed to read request body",
+		})
+		return
+	}
+
+	err = h.billingService.HandleWebhook(c.Request.Context(), payload, c.GetHeader("Stripe-Signature"))
+	if err != nil {
+		if errors.Is(err, services.ErrBillingDisabled) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error": "Billing is not configured",
+			})
+			return
+		}
+		// Non-2xx responses make Stripe retry the delivery
+		logger.Error("Failed to handle Stripe webhook", "error", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Failed to handle webhook",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"received": true,
+	})
+}
+
+// UpdateAutoTopUp handles configuring automatic balance top-ups
+func (h *Handler) UpdateAutoTopUp(c *gin.Context) {
+	logger := h.getLogger(c)
+
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	var req AutoTopUpRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	if req.Enabled {
+		if err := h.billingService.ValidateTopUpAmount(req.Amount); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+
+	// The previous settings are only needed for the audit trail
+	var before interface{}
+	if user, err := h.firebaseService.GetUserByID(c.Request.Context(), userID); err == nil {
+		before = AutoTopUpRequest{
+			Enabled:   user.AutoTopUp.Enabled,
+			Threshold: user.AutoTopUp.Threshold,
+			Amount:    user.AutoTopUp.Amount,
+		}
+	}
+
+	if err := h.billingService.UpdateAutoTopUp(c.Request.Context(), userID, req.Enabled, req.Threshold, req.Amount); err != nil {
+		logger.Error("Failed to update auto top-up settings", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to update auto top-up settings",
+		})
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditAutoTopUpUpdated,
+		TargetID: userID,
+		Before:   before,
+		After:    req,
+	})
+
+	c.JSON(http.StatusOK, req)
+}
+
+// GetSpendAlerts handles getting the user's spend alert settings and spend this period
+func (h *Handler) GetSpendAlerts(c *gin.Context) {
+	logger := h.getLogger(c)
+
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	user, err := h.firebaseService.GetUserByID(c.Request.Context(), userID)
+	if err != nil {
+		logger.Error("Failed to get user", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get spend alerts",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, user.SpendAlerts)
+}
+
+// UpdateSpendAlerts handles configuring spend alerts. A webhook signing secret is generated, and
+// returned once, whenever the webhook URL changes.
+func (h *Handler) UpdateSpendAlerts(c *gin.Context) {
+	logger := h.getLogger(c)
+
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	var req SpendAlertsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	ctx := c.Request.Context()
+	user, err := h.firebaseService.GetUserByID(ctx, userID)
+	if err != nil {
+		logger.Error("Failed to get user", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to update spend alerts",
+		})
+		return
+	}
+	before := user.SpendAlerts
+
+	settings := data.SpendAlertSettings{
+		Enabled:       req.Enabled,
+		Thresholds:    req.Thresholds,
+		MonthlyBudget: req.MonthlyBudget,
+		Email:         req.Email,
+		WebhookURL:    req.WebhookURL,
+		WebhookSecret: before.WebhookSecret,
+		Period:        before.Period,
+		Fired:         before.Fired,
+	}
+
+	var newSecret string
+	if settings.WebhookURL == "" {
+		settings.WebhookSecret = ""
+	} else if settings.WebhookURL != before.WebhookURL || settings.WebhookSecret == "" {
+		newSecret, err = services.NewWebhookSecret()
+		if err != nil {
+			logger.Error("Failed to generate webhook secret", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to update spend alerts",
+			})
+			return
+		}
+		settings.WebhookSecret = newSecret
+	}
+
+	if err := h.billingService.UpdateSpendAlerts(ctx, userID, &settings); err != nil {
+		if errors.Is(err, services.ErrInvalidSpendAlerts) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		logger.Error("Failed to update spend alerts", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to update spend alerts",
+		})
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditSpendAlertsUpdated,
+		TargetID: userID,
+		Before:   before,
+		After:    settings,
+	})
+
+	response := gin.H{
+		"spend_alerts": settings,
+	}
+	if newSecret != "" {
+		response["webhook_secret"] = newSecret
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// GetUsageExport handles getting the user's usage export settings and progress
+func (h *Handler) GetUsageExport(c *gin.Context) {
+	logger := h.getLogger(c)
+
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	user, err := h.firebaseService.GetUserByID(c.Request.Context(), userID)
+	if err != nil {
+		logger.Error("Failed to get user", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get usage export",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, user.UsageExport)
+}
+
+// UpdateUsageExport handles configuring usage export. For the http sink a webhook signing secret is
+// generated, and returned once, whenever the URL changes.
+func (h *Handler) UpdateUsageExport(c *gin.Context) {
+	logger := h.getLogger(c)
+
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	var req UsageExportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	ctx := c.Request.Context()
+	user, err := h.firebaseService.GetUserByID(ctx, userID)
+	if err != nil {
+		logger.Error("Failed to get user", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to update usage export",
+		})
+		return
+	}
+	before := user.UsageExport
+
+	settings := data.UsageExportSettings{
+		Enabled:         req.Enabled,
+		Sink:            req.Sink,
+		URL:             req.URL,
+		StripeEventName: req.StripeEventName,
+		StripeCustomers: req.StripeCustomers,
+	}
+
+	var newSecret string
+	if settings.Sink == data.UsageExportSinkHTTP {
+		settings.WebhookSecret = before.WebhookSecret
+		if settings.URL != before.URL || before.Sink != data.UsageExportSinkHTTP || settings.WebhookSecret == "" {
+			newSecret, err = services.NewWebhookSecret()
+			if err != nil {
+				logger.Error("Failed to generate webhook secret", "error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": "Failed to update usage export",
+				})
+				return
+			}
+			settings.WebhookSecret = newSecret
+		}
+	}
+
+	if err := h.usageExportService.UpdateSettings(ctx, userID, before, &settings, req.Token); err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidUsageExport):
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+		case errors.Is(err, services.ErrVaultDisabled):
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error": "Storing usage export tokens is not configured",
+			})
+		default:
+			logger.Error("Failed to update usage export", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to update usage export",
+			})
+		}
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditUsageExportUpdated,
+		TargetID: userID,
+		Before:   before.Redacted(),
+		After:    settings.Redacted(),
+	})
+
+	response := gin.H{
+		"usage_export": settings,
+	}
+	if newSecret != "" {
+		response["webhook_secret"] = newSecret
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// RunUsageExport exports users' usage to their metering systems until ctx is cancelled
+func (h *Handler) RunUsageExport(ctx context.Context) {
+	h.usageExportService.Run(ctx)
+}
+
+// GetInvoiceLineItems handles listing per-model invoice line items for a billing period
+func (h *Handler) GetInvoiceLineItems(c *gin.Context) {
+	logger := h.getLogger(c)
+
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	// Default to the current calendar month
+	now := time.Now().UTC()
+	startDate := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	endDate := startDate.AddDate(0, 1, 0)
+
+	if start := c.Query("start"); start != "" {
+		parsed, err := time.Parse(time.RFC3339, start)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "start must be an RFC 3339 timestamp",
+			})
+			return
+		}
+		startDate = parsed
+	}
+	if end := c.Query("end"); end != "" {
+		parsed, err := time.Parse(time.RFC3339, end)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "end must be an RFC 3339 timestamp",
+			})
+			return
+		}
+		endDate = parsed
+	}
+
+	ctx := c.Request.Context()
+	user, err := h.firebaseService.GetUserByID(ctx, userID)
+	if err != nil {
+		logger.Error("Failed to get user", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get invoice line items",
+		})
+		return
+	}
+	// Ranges are converted at the rate of their last day, or today's when they reach the future
+	rateTime := endDate.Add(-time.Nanosecond)
+	if rateTime.After(now) {
+		rateTime = now
+	}
+	rate, ok := h.exchangeRate(c, user.Currency, rateTime)
+	if !ok {
+		return
+	}
+
+	lineItems, err := h.firebaseService.GetInvoiceLineItems(ctx, userID, startDate, endDate)
+	if err != nil {
+		logger.Error("Failed to get invoice line items", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get invoice line items",
+		})
+		return
+	}
+
+	var total data.MicroUSD
+	converted := make([]map[string]data.DisplayAmount, 0, len(lineItems))
+	for _, item := range lineItems {
+		total += item.Amount
+		converted = append(converted, rate.ConvertAll(map[string]data.MicroUSD{
+			"platform_fees":   item.PlatformFees,
+			"optimizer_costs": item.OptimizerCosts,
+			"amount":          item.Amount,
+		}))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"start_date": startDate,
+		"end_date":   endDate,
+		"line_items": lineItems,
+		"total":      total,
+		"currency":   rate,
+		// converted holds the total, and each line item's amounts in line_items order
+		"converted": gin.H{
+			"total":      rate.Convert(total),
+			"line_items": converted,
+		},
+	})
+}
+
+// GetInvoice handles producing the caller's statement for a month, given as ?period=YYYY-MM and
+// defaulting to the current month, as JSON or, with ?format=pdf, as a PDF. Amounts are also shown
+// in the caller's currency, converted at the rate of the period's last day once it has ended.
+func (h *Handler) GetInvoice(c *gin.Context) {
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "pdf" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "format must be json or pdf",
+		})
+		return
+	}
+	start, err := services.ParseStatementPeriod(c.Query("period"), time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	ctx := c.Request.Context()
+	user, err := h.firebaseService.GetUserByID(ctx, userID)
+	if err != nil {
+		h.getLogger(c).Error("Failed to get user", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to build statement",
+		})
+		return
+	}
+
+	statement, err := h.invoiceService.Statement(ctx, userID, start)
+	if err != nil {
+		h.getLogger(c).Error("Failed to build statement", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to build statement",
+		})
+		return
+	}
+	rate, ok := h.exchangeRate(c, user.Currency, statement.RateTime())
+	if !ok {
+		return
+	}
+	statement.Convert(rate)
+
+	if format == "pdf" {
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="aptrouter-statement-%s.pdf"`, statement.Period))
+		c.Data(http.StatusOK, "application/pdf", services.RenderStatementPDF(statement))
+		return
+	}
+	c.JSON(http.StatusOK, statement)
+}
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/apt-router/api/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// errConcurrencyLimit is returned when a key or user is at its concurrency limit and its queue is full
+	errConcurrencyLimit = errors.New("too many concurrent requests")
+	// errConcurrencyQueueTimeout is returned when a queued request waits too long for a slot
+	errConcurrencyQueueTimeout = errors.New("timed out waiting for a concurrent request slot")
+)
+
+// concurrencyLimiter bounds the in-flight requests per key, queueing a bounded number of waiters
+type concurrencyLimiter struct {
+	limit        int
+	queueSize    int
+	queueTimeout time.Duration
+
+	mu    sync.Mutex
+	slots map[string]*concurrencySlots
+}
+
+// concurrencySlots tracks one key's in-flight requests; users counts holders and waiters so
+// the entry can be dropped once the key is idle
+type concurrencySlots struct {
+	sem   chan struct{}
+	users int
+}
+
+// newConcurrencyLimiter creates a limiter allowing limit requests per key, or nil when limit is 0
+func newConcurrencyLimiter(limit, queueSize int, queueTimeout time.Duration) *concurrencyLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &concurrencyLimiter{
+		limit:        limit,
+		queueSize:    queueSize,
+		queueTimeout: queueTimeout,
+		slots:        make(map[string]*concurrencySlots),
+	}
+}
+
+// acquire takes a slot for key, waiting up to the queue timeout if the key is at its limit.
+// High-priority requests never wait: they take a free slot if there is one and otherwise run over
+// the limit. Low-priority requests never queue, so freed slots go to waiting requests first.
+// The returned function releases the slot.
+func (l *concurrencyLimiter) acquire(ctx context.Context, key, priority string) (func(), error) {
+	if l == nil || key == "" {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	slots, ok := l.slots[key]
+	if !ok {
+		slots = &concurrencySlots{sem: make(chan struct{}, l.limit)}
+		l.slots[key] = slots
+	}
+	if priority != services.PriorityHigh && slots.users >= l.limit+l.queueSize {
+		l.mu.Unlock()
+		return nil, errConcurrencyLimit
+	}
+	// Low-priority requests only take a slot nobody is waiting for
+	if priority == services.PriorityLow && slots.users >= l.limit {
+		l.mu.Unlock()
+		return nil, errConcurrencyLimit
+	}
+	slots.users++
+	l.mu.Unlock()
+
+	release := func() {
+		<-slots.sem
+		l.leave(key, slots)
+	}
+
+	select {
+	case slots.sem <- struct{}{}:
+		return sync.OnceFunc(release), nil
+	default:
+	}
+	if priority == services.PriorityHigh {
+		l.leave(key, slots)
+		return func() {}, nil
+	}
+	if l.queueSize == 0 || priority == services.PriorityLow {
+		l.leave(key, slots)
+		return nil, errConcurrencyLimit
+	}
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case slots.sem <- struct{}{}:
+		return sync.OnceFunc(release), nil
+	case <-timer.C:
+		l.leave(key, slots)
+		return nil, errConcurrencyQueueTimeout
+	case <-ctx.Done():
+		l.leave(key, slots)
+		return nil, ctx.Err()
+	}
+}
+
+// leave drops a holder or waiter, removing the key's entry once nothing references it
+func (l *concurrencyLimiter) leave(key string, slots *concurrencySlots) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	slots.users--
+	if slots.users == 0 {
+		delete(l.slots, key)
+	}
+}
+
+// acquireGenerationSlot takes the caller's per-user and per-key concurrency slots for a generation.
+// The returned function releases both.
+func (h *Handler) acquireGenerationSlot(ctx context.Context, requestCtx *RequestContext) (func(), error) {
+	releaseUser, err := h.userConcurrency.acquire(ctx, requestCtx.UserID, requestCtx.Priority)
+	if err != nil {
+		return nil, fmt.Errorf("user %s: %w", requestCtx.UserID, err)
+	}
+	releaseKey, err := h.keyConcurrency.acquire(ctx, requestCtx.APIKeyID, requestCtx.Priority)
+	if err != nil {
+		releaseUser()
+		return nil, fmt.Errorf("API key %s: %w", requestCtx.APIKeyID, err)
+	}
+	return func() {
+		releaseKey()
+		releaseUser()
+	}, nil
+}
+
+// ConcurrencyLimitMiddleware bounds the generations a user and API key may have in flight. Requests
+// over the limit wait in a bounded queue and are rejected with 429 when it is full or they time out;
+// high-priority requests skip the queue and low-priority ones are rejected instead of queueing.
+// It must run after AuthMiddleware.
+func (h *Handler) ConcurrencyLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestCtx, exists := h.getRequestContext(c)
+		if !exists {
+			c.Next()
+			return
+		}
+
+		release, err := h.acquireGenerationSlot(c.Request.Context(), requestCtx)
+		if err != nil {
+			if c.Request.Context().Err() != nil {
+				// The client went away while queued
+				c.Abort()
+				return
+			}
+			requestCtx.Logger.Warn("Request rejected by concurrency limit", "error", err)
+			c.Header("Retry-After", "1")
+			c.JSON(http.StatusTooManyRequests, gin.H{
+				"error": "Too many concurrent requests: wait for an in-flight request to finish",
+			})
+			c.Abort()
+			return
+		}
+		// Streams hold their slot until they finish, since c.Next returns only then
+		defer release()
+
+		c.Next()
+	}
+}
@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// GrantCreditsRequest represents a request to grant a user promotional credit
+type GrantCreditsRequest struct {
+	Amount data.MicroUSD `json:"amount" binding:"required"`
+	// ExpiresAt defaults to the configured credit expiry
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+	Reason    string    `json:"reason" binding:"max=200"`
+}
+
+// RedeemReferralRequest represents a request to redeem a referral code
+type RedeemReferralRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// GetCredits handles listing the user's unexpired promotional credits
+func (h *Handler) GetCredits(c *gin.Context) {
+	logger := h.getLogger(c)
+
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	user, err := h.firebaseService.GetUserByID(c.Request.Context(), userID)
+	if err != nil {
+		logger.Error("Failed to get user", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get credits",
+		})
+		return
+	}
+
+	now := time.Now()
+	rate, ok := h.exchangeRate(c, user.Currency, now)
+	if !ok {
+		return
+	}
+	grants := []data.CreditGrant{}
+	for _, grant := range user.Credits {
+		if grant.Remaining > 0 && now.Before(grant.ExpiresAt) {
+			grants = append(grants, grant)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"available": user.AvailableCredits(now),
+		"balance":   user.Balance,
+		"grants":    grants,
+		"currency":  rate,
+		"converted": rate.ConvertAll(map[string]data.MicroUSD{
+			"available": user.AvailableCredits(now),
+			"balance":   user.Balance,
+		}),
+	})
+}
+
+// GetReferralCode handles getting the user's referral code, creating it on first use
+func (h *Handler) GetReferralCode(c *gin.Context) {
+	logger := h.getLogger(c)
+
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	code, err := h.creditService.ReferralCode(c.Request.Context(), userID)
+	if errors.Is(err, services.ErrReferralsDisabled) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Referrals are not enabled",
+		})
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to get referral code", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get referral code",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, code)
+}
+
+// RedeemReferralCode handles redeeming another user's referral code for promotional credit
+func (h *Handler) RedeemReferralCode(c *gin.Context) {
+	logger := h.getLogger(c)
+
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	var req RedeemReferralRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	grant, err := h.creditService.Redeem(c.Request.Context(), userID, req.Code)
+	switch {
+	case errors.Is(err, services.ErrReferralsDisabled):
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Referrals are not enabled",
+		})
+		return
+	case errors.Is(err, data.ErrReferralCodeNotFound):
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	case errors.Is(err, data.ErrOwnReferralCode), errors.Is(err, data.ErrAlreadyReferred), errors.Is(err, data.ErrReferralCodeExhausted):
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+		return
+	case err != nil:
+		logger.Error("Failed to redeem referral code", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to redeem referral code",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"granted": grant,
+	})
+}
+
+// GrantCredits handles granting a user promotional credit
+func (h *Handler) GrantCredits(c *gin.Context) {
+	var req GrantCreditsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	userID := c.Param("user_id")
+	grant, err := h.creditService.Grant(c.Request.Context(), userID, req.Amount, req.ExpiresAt, req.Reason)
+	if errors.Is(err, services.ErrInvalidCreditGrant) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		h.getLogger(c).Error("Failed to grant credits", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to grant credits",
+		})
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditCreditGranted,
+		TargetID: userID,
+		After:    grant,
+	})
+
+	c.JSON(http.StatusCreated, grant)
+}
@@ -0,0 +1,435 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/grpcapi/aptrouterv1"
+	"github.com/apt-router/api/internal/services"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcServer serves the AptRouter gRPC API with the same authentication, billing and logging as the HTTP endpoints
+type grpcServer struct {
+	aptrouterv1.UnimplementedAptRouterServer
+	handler *Handler
+}
+
+// NewGRPCServer creates a gRPC server exposing the AptRouter service
+func NewGRPCServer(h *Handler) *grpc.Server {
+	server := grpc.NewServer(grpc.MaxRecvMsgSize(int(h.config.Server.MaxRequestBodyBytes)))
+	aptrouterv1.RegisterAptRouterServer(server, &grpcServer{handler: h})
+	return server
+}
+
+// authenticate authenticates the API key in a call's authorization metadata
+func (s *grpcServer) authenticate(ctx context.Context, requiredScopes ...string) (*RequestContext, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	get := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	requestID := get("x-request-id")
+	if requestID == "" {
+		requestID = uuid.New().String()
+	}
+	method, _ := grpc.Method(ctx)
+
+	client := &apiKeyClient{
+		APIKey:    apiKeyFromAuthorization(get("authorization")),
+		UserAgent: get("user-agent"),
+		Tenant:    get(strings.ToLower(tenantHeader)),
+		Priority:  get(strings.ToLower(priorityHeader)),
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		client.ClientIP = p.Addr.String()
+		if host, _, err := net.SplitHostPort(client.ClientIP); err == nil {
+			client.ClientIP = host
+		}
+	}
+
+	logger := slog.With(
+		"request_id", requestID,
+		"grpc_method", method,
+		"user_agent", client.UserAgent,
+		"remote_addr", client.ClientIP,
+	)
+
+	requestCtx, authErr := s.handler.authenticateAPIKey(ctx, requestID, logger, client, requiredScopes)
+	if authErr != nil {
+		if authErr.Reason != "" {
+			details := authErr.Details
+			if details == nil {
+				details = make(map[string]interface{})
+			}
+			details["reason"] = authErr.Reason
+			details["path"] = method
+			s.handler.auditService.Record(ctx, &data.AuditEvent{
+				Type:      data.AuditAuthFailed,
+				ActorType: data.AuditActorAnonymous,
+				IPAddress: client.ClientIP,
+				UserAgent: client.UserAgent,
+				RequestID: requestID,
+				Details:   details,
+			})
+		}
+		return nil, status.Error(grpcCode(authErr.Status), authErr.Message)
+	}
+	return requestCtx, nil
+}
+
+// Generate runs a generation to completion
+func (s *grpcServer) Generate(ctx context.Context, req *aptrouterv1.GenerateRequest) (*aptrouterv1.GenerateResponse, error) {
+	startTime := time.Now()
+
+	requestCtx, err := s.authenticate(ctx, data.ScopeGenerate)
+	if err != nil {
+		return nil, err
+	}
+	release, err := s.acquireSlot(ctx, requestCtx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	serviceReq, err := s.generationRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, genErr := s.handler.runGeneration(ctx, requestCtx, serviceReq, startTime)
+	if genErr != nil {
+		return nil, genErr.grpcStatus()
+	}
+
+	out := &aptrouterv1.GenerateResponse{
+		Id:           resp.ID,
+		Text:         resp.Text,
+		Model:        resp.Model,
+		Provider:     resp.Provider,
+		FinishReason: resp.FinishReason,
+		CreatedAt:    timestamppb.New(time.Unix(resp.CreatedAt, 0)),
+		Cost: &aptrouterv1.Cost{
+			BaseMicros:        int64(resp.Cost.Base()),
+			MarkupMicros:      int64(resp.Cost.Markup()),
+			PlatformFeeMicros: int64(resp.Cost.PlatformFee),
+			TotalMicros:       int64(resp.Cost.Total()),
+			CreditsUsedMicros: int64(resp.CreditsUsed),
+			BillingMode:       resp.BillingMode,
+		},
+		Metadata: grpcMetadata(resp.Metadata),
+	}
+	if resp.Usage != nil {
+		out.Usage = &aptrouterv1.Usage{
+			InputTokens:  int32(resp.Usage.InputTokens),
+			OutputTokens: int32(resp.Usage.OutputTokens),
+			TotalTokens:  int32(resp.Usage.TotalTokens),
+		}
+	}
+	return out, nil
+}
+
+// GenerateStream streams a generation's text as it is produced
+func (s *grpcServer) GenerateStream(req *aptrouterv1.GenerateRequest, stream grpc.ServerStreamingServer[aptrouterv1.GenerateStreamResponse]) error {
+	startTime := time.Now()
+	ctx := stream.Context()
+
+	requestCtx, err := s.authenticate(ctx, data.ScopeGenerate)
+	if err != nil {
+		return err
+	}
+	release, err := s.acquireSlot(ctx, requestCtx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	serviceReq, err := s.generationRequest(req)
+	if err != nil {
+		return err
+	}
+	serviceReq.Stream = true
+
+	// The call's context aborts the provider stream when the client cancels
+	streamResp, err := s.handler.generationService.GenerateStream(ctx, serviceReq, requestCtx.serviceContext())
+	if err != nil {
+		s.handler.logGenerationFailure(ctx, requestCtx, serviceReq, err, startTime)
+		requestCtx.Logger.Warn("gRPC streaming generation failed", "error", err, "model", serviceReq.Model)
+		return streamStartError(err).grpcStatus()
+	}
+	// Closing the stream releases its timeout and records usage and billing, including for cancelled streams
+	defer streamResp.Stream.Close()
+
+	var pending []byte
+	buf := services.GetStreamBuffer()
+	defer services.PutStreamBuffer(buf)
+	for {
+		n, readErr := streamResp.Stream.Read(*buf)
+		if n > 0 {
+			pending = append(pending, (*buf)[:n]...)
+			// Hold back a rune split across reads, since proto strings must be valid UTF-8
+			complete := completeUTF8Prefix(pending)
+			if complete > 0 {
+				if err := stream.Send(&aptrouterv1.GenerateStreamResponse{Text: strings.ToValidUTF8(string(pending[:complete]), "�")}); err != nil {
+					return err
+				}
+				pending = append(pending[:0], pending[complete:]...)
+			}
+		}
+
+		if readErr == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			requestCtx.Logger.Info("gRPC stream cancelled by client", "duration_ms", time.Since(startTime).Milliseconds())
+			return status.FromContextError(ctx.Err()).Err()
+		}
+		if readErr != io.EOF {
+			requestCtx.Logger.Warn("gRPC stream read failed", "error", readErr)
+			return streamStartError(readErr).grpcStatus()
+		}
+
+		if len(pending) > 0 {
+			if err := stream.Send(&aptrouterv1.GenerateStreamResponse{Text: strings.ToValidUTF8(string(pending), "�")}); err != nil {
+				return err
+			}
+		}
+		requestCtx.Logger.Info("gRPC stream completed", "duration_ms", time.Since(startTime).Milliseconds())
+		if timer, ok := streamResp.Stream.(streamTimer); ok {
+			stream.SetTrailer(timingTrailer(timer.Timing()))
+		}
+		done := streamResp.Metadata
+		if reason := streamFinishReason(streamResp.Stream); reason != "" {
+			done = make(map[string]string, len(streamResp.Metadata)+1)
+			for k, v := range streamResp.Metadata {
+				done[k] = v
+			}
+			done["finish_reason"] = reason
+		}
+		return stream.Send(&aptrouterv1.GenerateStreamResponse{
+			Done:     true,
+			Metadata: done,
+		})
+	}
+}
+
+// timingTrailer reports a stream's timing in milliseconds as trailer metadata
+func timingTrailer(timing services.StreamTiming) metadata.MD {
+	info := newTimingInfo(timing)
+	md := metadata.Pairs("x-stream-duration-ms", strconv.FormatInt(info.DurationMs, 10))
+	if info.TimeToFirstTokenMs > 0 {
+		md.Set("x-time-to-first-token-ms", strconv.FormatInt(info.TimeToFirstTokenMs, 10))
+	}
+	return md
+}
+
+// GetUsage summarizes the key owner's usage from the hourly or daily rollups
+func (s *grpcServer) GetUsage(ctx context.Context, req *aptrouterv1.GetUsageRequest) (*aptrouterv1.GetUsageResponse, error) {
+	requestCtx, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	endDate := time.Now()
+	if req.Until != nil {
+		endDate = req.Until.AsTime()
+	}
+	startDate := endDate.AddDate(0, 0, -30)
+	if req.Since != nil {
+		startDate = req.Since.AsTime()
+	}
+	granularity := req.Granularity
+	if granularity == "" {
+		granularity = data.RollupDaily
+	}
+	if err := validateUsageGranularity(granularity, startDate, endDate); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	usage, err := s.handler.firebaseService.GetUserUsage(ctx, requestCtx.UserID, granularity, startDate, endDate)
+	if err != nil {
+		requestCtx.Logger.Error("Failed to get usage", "error", err)
+		return nil, status.Error(codes.Internal, "Failed to get usage")
+	}
+
+	return &aptrouterv1.GetUsageResponse{
+		TotalCostMicros:    int64(usage.TotalCost),
+		TotalTokens:        int64(usage.TotalTokens),
+		TotalRequests:      int64(usage.TotalRequests),
+		TotalTokensSaved:   int64(usage.TotalTokensSaved),
+		TotalSavingsMicros: int64(usage.TotalSavings),
+		Start:              timestamppb.New(usage.StartDate),
+		End:                timestamppb.New(usage.EndDate),
+		Granularity:        usage.Granularity,
+		ByModel:            grpcUsageRollups(usage.ByModel),
+		Buckets:            grpcUsageRollups(usage.Buckets),
+	}, nil
+}
+
+// GetBalance returns the balance of the account the key bills
+func (s *grpcServer) GetBalance(ctx context.Context, _ *aptrouterv1.GetBalanceRequest) (*aptrouterv1.GetBalanceResponse, error) {
+	requestCtx, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if requestCtx.OrgID != "" {
+		org, err := s.handler.firebaseService.GetOrganization(ctx, requestCtx.OrgID)
+		if err != nil {
+			requestCtx.Logger.Error("Failed to get organization", "error", err)
+			return nil, status.Error(codes.Internal, "Failed to get balance")
+		}
+		return &aptrouterv1.GetBalanceResponse{
+			BalanceMicros: int64(org.Balance),
+			OrgId:         requestCtx.OrgID,
+		}, nil
+	}
+
+	user, err := s.handler.firebaseService.GetUserByID(ctx, requestCtx.UserID)
+	if err != nil {
+		requestCtx.Logger.Error("Failed to get user", "error", err)
+		return nil, status.Error(codes.Internal, "Failed to get balance")
+	}
+	return &aptrouterv1.GetBalanceResponse{
+		BalanceMicros: int64(user.Balance),
+		CreditsMicros: int64(user.AvailableCredits(time.Now())),
+	}, nil
+}
+
+// acquireSlot takes the caller's concurrency slots for a generation, as ConcurrencyLimitMiddleware does over HTTP
+func (s *grpcServer) acquireSlot(ctx context.Context, requestCtx *RequestContext) (func(), error) {
+	release, err := s.handler.acquireGenerationSlot(ctx, requestCtx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+		requestCtx.Logger.Warn("Request rejected by concurrency limit", "error", err)
+		return nil, status.Error(codes.ResourceExhausted, "Too many concurrent requests: wait for an in-flight request to finish")
+	}
+	return release, nil
+}
+
+// generationRequest validates a gRPC generate request the way the HTTP endpoints bind theirs and converts it to a service request
+func (s *grpcServer) generationRequest(req *aptrouterv1.GenerateRequest) (*services.GenerationRequest, error) {
+	httpReq := &GenerateRequest{
+		Model:            req.Model,
+		Prompt:           req.Prompt,
+		TemplateID:       req.TemplateId,
+		TemplateVersion:  int(req.TemplateVersion),
+		Variables:        req.Variables,
+		Temperature:      req.Temperature,
+		TopP:             req.TopP,
+		Stop:             req.Stop,
+		FrequencyPenalty: req.FrequencyPenalty,
+		PresencePenalty:  req.PresencePenalty,
+		Seed:             req.Seed,
+		OptimizationMode: req.OptimizationMode,
+	}
+	if req.MaxTokens != nil {
+		maxTokens := int(*req.MaxTokens)
+		httpReq.MaxTokens = &maxTokens
+	}
+	if req.TimeoutSeconds != nil {
+		timeoutSeconds := int(*req.TimeoutSeconds)
+		httpReq.TimeoutSeconds = &timeoutSeconds
+	}
+
+	if err := binding.Validator.ValidateStruct(httpReq); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Invalid request format: "+err.Error())
+	}
+	serviceReq, err := s.handler.newGenerationRequest(httpReq)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return serviceReq, nil
+}
+
+// grpcStatus converts a generation error to a gRPC status
+func (e *generationError) grpcStatus() error {
+	message, _ := e.Body["error"].(string)
+	return status.Error(grpcCode(e.Status), message)
+}
+
+// grpcCode maps the HTTP status an error is reported with to the closest gRPC code
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusPaymentRequired:
+		return codes.FailedPrecondition
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	default:
+		return codes.Internal
+	}
+}
+
+// grpcMetadata converts response metadata to strings, leaving out the cost reported in the Cost message
+func grpcMetadata(metadata map[string]interface{}) map[string]string {
+	out := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		switch key {
+		case "total_cost", "markup_amount", "base_cost", "platform_fee", "billing_mode", "credits_used":
+			continue
+		}
+		if s, ok := value.(string); ok {
+			out[key] = s
+			continue
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			out[key] = fmt.Sprint(value)
+			continue
+		}
+		out[key] = string(encoded)
+	}
+	return out
+}
+
+// grpcUsageRollups converts usage rollups to their gRPC messages
+func grpcUsageRollups(rollups []*data.UsageRollup) []*aptrouterv1.UsageRollup {
+	out := make([]*aptrouterv1.UsageRollup, len(rollups))
+	for i, rollup := range rollups {
+		out[i] = &aptrouterv1.UsageRollup{
+			ModelId:         rollup.ModelID,
+			BucketStart:     timestamppb.New(rollup.BucketStart),
+			Requests:        int64(rollup.Requests),
+			InputTokens:     int64(rollup.InputTokens),
+			OutputTokens:    int64(rollup.OutputTokens),
+			TotalTokens:     int64(rollup.TotalTokens),
+			TotalCostMicros: int64(rollup.TotalCost),
+			TokensSaved:     int64(rollup.TokensSaved),
+			SavingsMicros:   int64(rollup.Savings),
+		}
+	}
+	return out
+}
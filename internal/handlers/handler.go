@@ -2,43 +2,137 @@ package handlers
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/apt-router/api/internal/data"
 	"github.com/apt-router/api/internal/services"
 	"github.com/apt-router/api/internal/utils"
 	"github.com/gin-gonic/gin"
-	"github.com/patrickmn/go-cache"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
 // Handler handles all API requests
 type Handler struct {
-	config            *utils.Config
-	firebaseService   *data.Service
-	cache             *cache.Cache
-	pricingService    *services.PricingService
-	generationService *services.GenerationService
+	config              *utils.Config
+	firebaseService     *data.Service
+	cache               services.Cache
+	pricingService      *services.PricingService
+	billingService      *services.BillingService
+	auditService        *services.AuditService
+	providerKeyService  *services.ProviderKeyService
+	systemPromptService *services.SystemPromptService
+	templateService     *services.TemplateService
+	experimentService   *services.ExperimentService
+	routingService      *services.RoutingService
+	creditService       *services.CreditService
+	generationService   *services.GenerationService
+	usageExportService  *services.UsageExportService
+	privacyService      *services.PrivacyService
+	sessionService      *services.SessionService
+	reconciliation      *services.ReconciliationService
+	jobScheduler        *services.JobScheduler
+	invoiceService      *services.InvoiceService
+	currencyService     *services.CurrencyService
+	// keyConcurrency and userConcurrency bound in-flight generations; nil when unlimited
+	keyConcurrency  *concurrencyLimiter
+	userConcurrency *concurrencyLimiter
+	// failureGuard blocks requests that keep failing identically; nil when disabled
+	failureGuard *failureGuard
+	httpMetrics  *httpMetrics
 }
 
 // NewHandler creates a new API handler
 func NewHandler(
 	cfg *utils.Config,
 	firebaseService *data.Service,
-	cache *cache.Cache,
+	cache services.Cache,
 	pricingService *services.PricingService,
 ) *Handler {
-	generationService := services.NewGenerationService(cfg, firebaseService, cache, pricingService)
+	auditService := services.NewAuditService(firebaseService)
+	notificationService := services.NewNotificationService(cfg)
+	billingService := services.NewBillingService(cfg, firebaseService, cache, auditService, notificationService)
+	providerKeyService := services.NewProviderKeyService(cfg, firebaseService)
+	systemPromptService := services.NewSystemPromptService(firebaseService, cache)
+	templateService := services.NewTemplateService(firebaseService, cache)
+	experimentService := services.NewExperimentService(firebaseService, pricingService)
+	routingService := services.NewRoutingService(firebaseService, pricingService)
+	creditService := services.NewCreditService(cfg, firebaseService, cache, auditService)
+	generationService := services.NewGenerationService(cfg, firebaseService, cache, pricingService, billingService, providerKeyService, systemPromptService, templateService, experimentService, routingService)
+	usageExportService := services.NewUsageExportService(cfg, firebaseService, notificationService)
+	privacyService := services.NewPrivacyService(cfg, firebaseService, cache, auditService)
+	sessionService := services.NewSessionService(cfg, firebaseService, generationService)
+	reconciliationService := services.NewReconciliationService(cfg, firebaseService)
+	currencyService := services.NewCurrencyService(cfg, firebaseService)
+
+	// Sweeps run on the replica elected to run scheduled jobs
+	jobScheduler := services.NewJobScheduler(cfg, firebaseService)
+	jobScheduler.Register(services.Job{
+		Name:     "api_key_expiry",
+		Interval: cfg.Security.APIKeyExpirySweepInterval,
+		Run:      services.NewAPIKeyExpiryService(cfg, firebaseService, notificationService, auditService).Sweep,
+	})
+	jobScheduler.Register(services.Job{
+		Name:     "privacy_sweep",
+		Interval: cfg.Privacy.SweepInterval,
+		Run:      privacyService.Sweep,
+	})
+	jobScheduler.Register(services.Job{
+		Name:     "request_log_retention",
+		Interval: cfg.Privacy.RetentionInterval,
+		Run:      services.NewRetentionService(cfg, firebaseService, privacyService).Sweep,
+	})
+	jobScheduler.Register(services.Job{
+		Name:     "session_expiry",
+		Interval: cfg.Sessions.SweepInterval,
+		Run:      sessionService.Sweep,
+	})
+	jobScheduler.Register(services.Job{
+		Name:     "provider_cost_reconciliation",
+		Interval: cfg.Reconciliation.Interval,
+		Run:      reconciliationService.Sweep,
+	})
+	jobScheduler.Register(services.Job{
+		Name:     "exchange_rates",
+		Interval: cfg.Currency.RefreshInterval,
+		Run:      currencyService.Refresh,
+	})
 
 	return &Handler{
-		config:            cfg,
-		firebaseService:   firebaseService,
-		cache:             cache,
-		pricingService:    pricingService,
-		generationService: generationService,
+		config:              cfg,
+		firebaseService:     firebaseService,
+		cache:               cache,
+		pricingService:      pricingService,
+		billingService:      billingService,
+		auditService:        auditService,
+		providerKeyService:  providerKeyService,
+		systemPromptService: systemPromptService,
+		templateService:     templateService,
+		experimentService:   experimentService,
+		routingService:      routingService,
+		creditService:       creditService,
+		generationService:   generationService,
+		usageExportService:  usageExportService,
+		privacyService:      privacyService,
+		sessionService:      sessionService,
+		reconciliation:      reconciliationService,
+		jobScheduler:        jobScheduler,
+		invoiceService:      services.NewInvoiceService(firebaseService),
+		currencyService:     currencyService,
+		keyConcurrency:      newConcurrencyLimiter(cfg.RateLimit.MaxConcurrentPerKey, cfg.RateLimit.QueueSize, cfg.RateLimit.QueueTimeout),
+		userConcurrency:     newConcurrencyLimiter(cfg.RateLimit.MaxConcurrentPerUser, cfg.RateLimit.QueueSize, cfg.RateLimit.QueueTimeout),
+		failureGuard:        newFailureGuard(cfg.RateLimit.RepeatedFailureLimit, cfg.RateLimit.RepeatedFailureWindow, cfg.RateLimit.RepeatedFailureBlock),
+		httpMetrics:         newHTTPMetrics(),
 	}
 }
 
@@ -48,139 +142,410 @@ func (h *Handler) HealthCheck(c *gin.Context) {
 		"status":  "healthy",
 		"service": "apt-router-api",
 		"version": "1.0.0",
+		// Snapshot listener health shows how fresh model and pricing data is
+		"config_listeners": h.pricingService.GetListenerStats(),
 	})
 }
 
-// AuthMiddleware authenticates API key requests and sets up request context
-func (h *Handler) AuthMiddleware() gin.HandlerFunc {
+// AuthMiddleware authenticates API key requests and sets up request context.
+// Requests are rejected unless the key grants every one of requiredScopes.
+func (h *Handler) AuthMiddleware(requiredScopes ...string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		requestID := h.getRequestID(c)
-		logger := h.getLogger(c)
+		requestCtx, authErr := h.authenticateAPIKey(c.Request.Context(), h.getRequestID(c), h.getLogger(c), &apiKeyClient{
+			APIKey:    apiKeyFromRequest(c),
+			ClientIP:  c.ClientIP(),
+			UserAgent: c.Request.UserAgent(),
+			Referer:   c.GetHeader("Referer"),
+			Tenant:    c.GetHeader(tenantHeader),
+			Priority:  c.GetHeader(priorityHeader),
+		}, requiredScopes)
+		if authErr != nil {
+			if authErr.Reason != "" {
+				h.recordAuthFailure(c, authErr.Reason, authErr.Details)
+			}
+			c.JSON(authErr.Status, gin.H{
+				"error": authErr.Message,
+			})
+			c.Abort()
+			return
+		}
 
-		// Extract API key from Authorization header
-		authHeader := c.GetHeader("Authorization")
-		var apiKey string
+		// Store request context in Gin context
+		c.Set(string(requestContextGinKey), requestCtx)
 
-		if authHeader != "" {
-			// Handle "Bearer <token>" format
-			if strings.HasPrefix(authHeader, "Bearer ") {
-				apiKey = strings.TrimPrefix(authHeader, "Bearer ")
-			} else {
-				// Handle direct API key format
-				apiKey = authHeader
-			}
+		// Continue to next middleware/handler
+		c.Next()
+	}
+}
+
+// apiKeyClient is what a caller presents when authenticating with an API key
+type apiKeyClient struct {
+	APIKey    string
+	ClientIP  string
+	UserAgent string
+	Referer   string
+	// Tenant is the tenant the caller asserts the request belongs to, if any
+	Tenant string
+	// Priority is the priority class the caller asks for, if any
+	Priority string
+}
+
+// priorityHeader lets callers lower a request's priority below their tier's, e.g. for batch traffic
+const priorityHeader = "X-Priority"
+
+// authError is a rejected API key authentication and the HTTP status it maps to.
+// Reason and Details, when set, are recorded as an auth.failed audit event.
+type authError struct {
+	Status  int
+	Message string
+	Reason  string
+	Details map[string]interface{}
+}
+
+// apiKeyFromAuthorization extracts an API key from an Authorization header, with or without a Bearer prefix
+func apiKeyFromAuthorization(header string) string {
+	return strings.TrimPrefix(header, "Bearer ")
+}
+
+// apiKeyFromRequest extracts the caller's API key from the Authorization header, falling back to the
+// x-api-key header that Anthropic SDK clients send
+func apiKeyFromRequest(c *gin.Context) string {
+	if key := apiKeyFromAuthorization(c.GetHeader("Authorization")); key != "" {
+		return key
+	}
+	return c.GetHeader("X-API-Key")
+}
+
+// authenticateAPIKey validates an API key and its restrictions and builds the request context for it
+func (h *Handler) authenticateAPIKey(ctx context.Context, requestID string, logger *slog.Logger, client *apiKeyClient, requiredScopes []string) (*RequestContext, *authError) {
+	// The auth span covers key lookup and request context setup, not the handler itself
+	ctx, span := tracer.Start(ctx, "auth.api_key")
+	defer span.End()
+
+	apiKey := client.APIKey
+
+	fail := func(authErr *authError) (*RequestContext, *authError) {
+		span.SetStatus(codes.Error, "authentication failed")
+		return nil, authErr
+	}
+
+	// Outside production, fall back to a development key like jwtAuth falls back to the development user
+	mockKey := apiKey == ""
+	if mockKey {
+		if h.config.IsProduction() {
+			return fail(&authError{
+				Status:  http.StatusUnauthorized,
+				Message: "Missing API key",
+				Reason:  "missing_api_key",
+			})
 		}
+		logger.Warn("No API key provided, using mock key for development")
+		apiKey = "mock-api-key-for-development"
+	}
+
+	// Hash the API key for logging (don't log the actual key)
+	keyHash := h.hashAPIKey(apiKey)
+	logger.Info("API key authentication", "key_hash", keyHash[:8]+"...")
+
+	// Get user from Firebase (for development, use mock user)
+	var apiKeyRecord *data.APIKey
+	var err error
 
-		// For development/testing, accept any API key and create a mock context
-		// In production, this would validate the API key against Firebase
-		if apiKey == "" {
-			logger.Warn("No API key provided, using mock key for development")
-			apiKey = "mock-api-key-for-development"
+	if mockKey {
+		// Create mock key for development
+		apiKeyRecord = &data.APIKey{
+			ID:     keyHash,
+			UserID: "mock-user-id",
+			Status: "active",
 		}
+	} else {
+		// Get real API key from Firebase
+		apiKeyRecord, err = h.firebaseService.GetAPIKeyByHash(ctx, keyHash)
+		if err != nil {
+			logger.Error("Failed to get user by API key", "error", err)
+			return fail(&authError{
+				Status:  http.StatusUnauthorized,
+				Message: "Invalid API key",
+				Reason:  "invalid_api_key",
+				Details: map[string]interface{}{"key_hash_prefix": keyHash[:8]},
+			})
+		}
+	}
 
-		// Hash the API key for logging (don't log the actual key)
-		keyHash := h.hashAPIKey(apiKey)
-		logger.Info("API key authentication", "key_hash", keyHash[:8]+"...")
-
-		// Get user from Firebase (for development, use mock user)
-		var user *data.User
-		var err error
-
-		if apiKey == "mock-api-key-for-development" {
-			// Create mock user for development
-			user = &data.User{
-				ID:            "mock-user-id",
-				Email:         "dev@example.com",
-				Balance:       100.0,
-				TierID:        "tier-1",
-				IsActive:      true,
-				CustomPricing: false,
-			}
-		} else {
-			// Get real user from Firebase
-			user, err = h.firebaseService.GetUserByAPIKey(c.Request.Context(), keyHash)
-			if err != nil {
-				logger.Error("Failed to get user by API key", "error", err)
+	// Expired keys are rejected even before the expiry sweep deactivates them
+	if apiKeyRecord.Expired(time.Now()) {
+		logger.Warn("Expired API key used", "api_key_id", apiKeyRecord.ID, "expires_at", apiKeyRecord.ExpiresAt)
+		return fail(&authError{
+			Status:  http.StatusUnauthorized,
+			Message: "API key has expired",
+			Reason:  "expired_api_key",
+			Details: map[string]interface{}{"api_key_id": apiKeyRecord.ID, "user_id": apiKeyRecord.UserID, "expires_at": apiKeyRecord.ExpiresAt},
+		})
+	}
+
+	for _, scope := range requiredScopes {
+		if !apiKeyRecord.HasScope(scope) {
+			logger.Warn("API key missing required scope", "scope", scope)
+			return fail(&authError{
+				Status:  http.StatusForbidden,
+				Message: fmt.Sprintf("API key does not have the %s scope", scope),
+				Reason:  "missing_scope",
+				Details: map[string]interface{}{"api_key_id": apiKeyRecord.ID, "user_id": apiKeyRecord.UserID, "scope": scope},
+			})
+		}
+	}
+
+	// Keys locked to specific networks or frontends are useless if leaked elsewhere
+	if err := apiKeyRecord.Restrictions.CheckClientIP(client.ClientIP); err != nil {
+		logger.Warn("API key used from disallowed IP", "client_ip", client.ClientIP)
+		return fail(&authError{
+			Status:  http.StatusForbidden,
+			Message: err.Error(),
+			Reason:  "disallowed_ip",
+			Details: map[string]interface{}{"api_key_id": apiKeyRecord.ID, "user_id": apiKeyRecord.UserID},
+		})
+	}
+	if err := apiKeyRecord.Restrictions.CheckReferer(client.Referer); err != nil {
+		logger.Warn("API key used from disallowed referer", "referer", client.Referer)
+		return fail(&authError{
+			Status:  http.StatusForbidden,
+			Message: err.Error(),
+			Reason:  "disallowed_referer",
+			Details: map[string]interface{}{"api_key_id": apiKeyRecord.ID, "user_id": apiKeyRecord.UserID, "referer": client.Referer},
+		})
+	}
+
+	// Get cached user data for performance
+	cachedUser, err := h.getUserFromCache(ctx, apiKeyRecord.UserID)
+	if err != nil {
+		logger.Error("Failed to get cached user data", "error", err)
+		return fail(&authError{Status: http.StatusInternalServerError, Message: "Failed to load user data"})
+	}
+
+	// Organization keys use the organization's pooled tier
+	tierID := cachedUser.TierID
+	if apiKeyRecord.OrgID != "" {
+		org, err := h.getOrganizationFromCache(ctx, apiKeyRecord.OrgID)
+		if err != nil {
+			logger.Error("Failed to get organization", "error", err, "org_id", apiKeyRecord.OrgID)
+			return fail(&authError{Status: http.StatusInternalServerError, Message: "Failed to load organization data"})
+		}
+		if !org.IsActive {
+			return fail(&authError{Status: http.StatusForbidden, Message: "Organization is inactive"})
+		}
+		tierID = org.TierID
+	}
+
+	// Keys bound to a tenant use its catalog, and its tier when it sets one
+	tenant, authErr := h.resolveTenant(ctx, logger, client.Tenant, apiKeyRecord)
+	if authErr != nil {
+		return fail(authErr)
+	}
+	if tenant != nil && tenant.TierID != "" {
+		tierID = tenant.TierID
+	}
+
+	// Get pricing tier from cache
+	tier, err := h.getPricingTierFromCache(ctx, tierID)
+	if err != nil {
+		logger.Error("Failed to get pricing tier", "error", err)
+		return fail(&authError{Status: http.StatusInternalServerError, Message: "Failed to load pricing information"})
+	}
+
+	priority, err := services.ResolvePriority(tier.Priority, strings.ToLower(client.Priority))
+	if err != nil {
+		return fail(&authError{Status: http.StatusBadRequest, Message: err.Error()})
+	}
+
+	span.SetAttributes(
+		attribute.String("user.id", apiKeyRecord.UserID),
+		attribute.String("org.id", apiKeyRecord.OrgID),
+		attribute.String("tenant.id", apiKeyRecord.TenantID),
+		attribute.String("tier.id", tier.ID),
+	)
+
+	// Label everything a test key's requests log, so test traffic is never mistaken for live traffic
+	if apiKeyRecord.TestMode {
+		logger = logger.With("test_mode", true)
+	}
+
+	// Create request context with cached user data
+	return &RequestContext{
+		RequestID: requestID,
+		UserID:    apiKeyRecord.UserID,
+		OrgID:     apiKeyRecord.OrgID,
+		// Keys keep their ID when rotated, so requests are attributed to the key rather than its secret
+		APIKeyID:  apiKeyRecord.ID,
+		ClientIP:  client.ClientIP,
+		UserAgent: client.UserAgent,
+		PricingTier: services.PricingTier{
+			ID:                    tier.ID,
+			TierName:              tier.TierName,
+			MinMonthlySpend:       tier.MinMonthlySpend,
+			InputMarkupPercent:    tier.InputMarkupPercent,
+			OutputMarkupPercent:   tier.OutputMarkupPercent,
+			IsActive:              tier.IsActive,
+			IsCustom:              tier.IsCustom,
+			CustomModelPricing:    tier.CustomModelPricing,
+			Moderation:            tier.Moderation,
+			Priority:              tier.Priority,
+			MaxPromptTokens:       tier.MaxPromptTokens,
+			MaxStreamOutputTokens: tier.MaxStreamOutputTokens,
+			MaxStreamOutputBytes:  tier.MaxStreamOutputBytes,
+			Optimization:          tier.Optimization,
+		},
+		Priority:       priority,
+		Restrictions:   &apiKeyRecord.Restrictions,
+		PostProcessing: &apiKeyRecord.PostProcessing,
+		Tenant:         tenant,
+		TestMode:       apiKeyRecord.TestMode,
+		Logger:         logger,
+		CachedUser:     cachedUser,
+	}, nil
+}
+
+// JWTAuthMiddleware authenticates Firebase Auth ID tokens for user-facing endpoints
+func (h *Handler) JWTAuthMiddleware() gin.HandlerFunc {
+	return h.jwtAuth(false)
+}
+
+// UserViewAuthMiddleware authenticates like JWTAuthMiddleware, but also lets admins read the
+// endpoints as a user with an impersonation token from ImpersonateUser
+func (h *Handler) UserViewAuthMiddleware() gin.HandlerFunc {
+	return h.jwtAuth(true)
+}
+
+// jwtAuth authenticates Firebase Auth ID tokens, and impersonation tokens on read-only requests
+// when allowImpersonation is set
+func (h *Handler) jwtAuth(allowImpersonation bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := h.getLogger(c)
+
+		idToken := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+
+		// Outside production, fall back to the development user like AuthMiddleware does
+		if idToken == "" {
+			if h.config.IsProduction() {
 				c.JSON(http.StatusUnauthorized, gin.H{
-					"error": "Invalid API key",
+					"error": "Missing authorization token",
 				})
 				c.Abort()
 				return
 			}
+			logger.Warn("No ID token provided, using mock user for development")
+			c.Set(string(userIDGinKey), "mock-user-id")
+			c.Next()
+			return
 		}
 
-		// Get cached user data for performance
-		cachedUser, err := h.getUserFromCache(c.Request.Context(), user.ID)
-		if err != nil {
-			logger.Error("Failed to get cached user data", "error", err)
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": "Failed to load user data",
-			})
-			c.Abort()
+		if isImpersonationToken(idToken) {
+			h.authenticateImpersonation(c, idToken, allowImpersonation)
 			return
 		}
 
-		// Get pricing tier from cache
-		tier, err := h.getPricingTierFromCache(c.Request.Context(), cachedUser.TierID)
+		userID, err := h.firebaseService.VerifyIDToken(c.Request.Context(), idToken)
 		if err != nil {
-			logger.Error("Failed to get pricing tier", "error", err)
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": "Failed to load pricing information",
+			logger.Warn("Failed to verify ID token", "error", err)
+			h.recordAuthFailure(c, "invalid_id_token", nil)
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": "Invalid authorization token",
 			})
 			c.Abort()
 			return
 		}
 
-		// Create request context with cached user data
-		requestCtx := &RequestContext{
-			RequestID: requestID,
-			UserID:    user.ID,
-			APIKeyID:  keyHash,
-			PricingTier: services.PricingTier{
-				ID:                  tier.ID,
-				TierName:            tier.TierName,
-				MinMonthlySpend:     tier.MinMonthlySpend,
-				InputMarkupPercent:  tier.InputMarkupPercent,
-				OutputMarkupPercent: tier.OutputMarkupPercent,
-				IsActive:            tier.IsActive,
-				IsCustom:            tier.IsCustom,
-				CustomModelPricing:  tier.CustomModelPricing,
-			},
-			Logger:     logger,
-			CachedUser: cachedUser,
-		}
-
-		// Store request context in Gin context
-		c.Set(string(requestContextGinKey), requestCtx)
-
-		// Continue to next middleware/handler
-		c.Next()
-	}
-}
-
-// JWTAuthMiddleware authenticates JWT requests
-func (h *Handler) JWTAuthMiddleware() gin.HandlerFunc {
-	// TODO: Implement JWT authentication with Firebase Auth
-	return func(c *gin.Context) {
+		c.Set(string(userIDGinKey), userID)
 		c.Next()
 	}
 }
 
 // GenerateRequest represents a text generation request from HTTP
 type GenerateRequest struct {
-	Model       string                 `json:"model" binding:"required"`
-	Prompt      string                 `json:"prompt" binding:"required"`
-	MaxTokens   *int                   `json:"max_tokens,omitempty"`
-	Temperature *float64               `json:"temperature,omitempty"`
-	TopP        *float64               `json:"top_p,omitempty"`
-	Stream      *bool                  `json:"stream,omitempty"`
-	Extra       map[string]interface{} `json:"extra,omitempty"`
+	Model string `json:"model" binding:"required"`
+	// Prompt is required unless TemplateID names a stored template to render with Variables
+	Prompt          string                 `json:"prompt"`
+	TemplateID      string                 `json:"template_id,omitempty"`
+	TemplateVersion int                    `json:"template_version,omitempty" binding:"omitempty,min=1"`
+	Variables       map[string]string      `json:"variables,omitempty"`
+	MaxTokens       *int                   `json:"max_tokens,omitempty"`
+	Temperature     *float64               `json:"temperature,omitempty" binding:"omitempty,min=0,max=2"`
+	TopP            *float64               `json:"top_p,omitempty" binding:"omitempty,min=0,max=1"`
+	Stream          *bool                  `json:"stream,omitempty"`
+	Extra           map[string]interface{} `json:"extra,omitempty"`
+	// Stop accepts a single string or a list of up to 4 sequences, as in the OpenAI API
+	Stop             StopSequences `json:"stop,omitempty" binding:"max=4"`
+	FrequencyPenalty *float64      `json:"frequency_penalty,omitempty" binding:"omitempty,min=-2,max=2"`
+	PresencePenalty  *float64      `json:"presence_penalty,omitempty" binding:"omitempty,min=-2,max=2"`
+	// Seed requests deterministic sampling (OpenAI and Google); Anthropic ignores it
+	Seed *int64 `json:"seed,omitempty"`
+	// TimeoutSeconds overrides the model's provider timeout, up to the server's maximum
+	TimeoutSeconds *int `json:"timeout_seconds,omitempty" binding:"omitempty,min=1"`
 	// BYOK fields
 	OpenAIAPIKey    string `json:"openai_api_key,omitempty"`
 	AnthropicAPIKey string `json:"anthropic_api_key,omitempty"`
 	GoogleAPIKey    string `json:"google_api_key,omitempty"`
 	// Optimization mode: "context" (default) or "efficiency"
 	OptimizationMode string `json:"optimization_mode,omitempty"`
+	// DisableRuleOptimization leaves the prompt's wording alone; AI optimization may still apply
+	DisableRuleOptimization bool `json:"disable_rule_optimization,omitempty"`
+	// Optimization controls prompt optimization for this request
+	Optimization *OptimizationOptions `json:"optimization,omitempty"`
+	// Logprobs returns the log probability of each generated token, with the TopLogprobs most
+	// likely alternatives at each position (OpenAI); other providers ignore them
+	Logprobs    *bool `json:"logprobs,omitempty"`
+	TopLogprobs *int  `json:"top_logprobs,omitempty" binding:"omitempty,min=0,max=20"`
+	// CacheControl writes the system instructions and prompt to the provider's prompt cache where
+	// caching has to be requested (Anthropic); OpenAI and Google cache long prompts automatically
+	CacheControl *CacheControl `json:"cache_control,omitempty"`
+	// ReasoningEffort and ThinkingBudget control reasoning models: OpenAI takes the effort, and
+	// Anthropic and Google a budget of thinking tokens, which the effort stands for when unset
+	ReasoningEffort string `json:"reasoning_effort,omitempty" binding:"omitempty,oneof=low medium high"`
+	ThinkingBudget  *int   `json:"thinking_budget,omitempty" binding:"omitempty,min=1024"`
+}
+
+// CacheControl marks content for the provider's prompt cache. Only "ephemeral" is supported.
+type CacheControl struct {
+	Type string `json:"type" binding:"required,oneof=ephemeral"`
+}
+
+// OptimizationOptions are the per-request prompt optimization settings
+type OptimizationOptions struct {
+	// Enabled set to false sends the prompt to the provider unoptimized
+	Enabled *bool `json:"enabled,omitempty"`
+}
+
+// validatePromptSource checks that the request sets exactly one of a prompt or a template
+func (r *GenerateRequest) validatePromptSource() error {
+	if r.Prompt == "" && r.TemplateID == "" {
+		return fmt.Errorf("prompt or template_id is required")
+	}
+	if r.Prompt != "" && r.TemplateID != "" {
+		return fmt.Errorf("prompt and template_id cannot both be set")
+	}
+	return nil
+}
+
+// StopSequences is a list of stop sequences that also unmarshals from a single string
+type StopSequences []string
+
+// UnmarshalJSON accepts either a string or an array of strings
+func (s *StopSequences) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		if single == "" {
+			*s = nil
+		} else {
+			*s = StopSequences{single}
+		}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("stop must be a string or an array of strings")
+	}
+	*s = list
+	return nil
 }
 
 // GenerateResponse represents a text generation response for HTTP
@@ -193,6 +558,163 @@ type GenerateResponse struct {
 	FinishReason string                 `json:"finish_reason,omitempty"`
 	CreatedAt    int64                  `json:"created_at"`
 	Metadata     map[string]interface{} `json:"metadata,omitempty"`
+	Logprobs     []data.TokenLogprob    `json:"logprobs,omitempty"`
+	// Cost, CreditsUsed and BillingMode are reported in CostInfo and Metadata over HTTP
+	Cost        data.CostBreakdown `json:"-"`
+	CreditsUsed data.MicroUSD      `json:"-"`
+	BillingMode string             `json:"-"`
+	// CostInfo itemizes the cost, so clients needn't piece it together from Metadata
+	CostInfo *CostInfo `json:"cost,omitempty"`
+}
+
+// CostInfo itemizes what a request cost, as reported on responses and in the final event of streams
+type CostInfo struct {
+	BaseInput  data.MicroUSD `json:"base_input"`
+	BaseOutput data.MicroUSD `json:"base_output"`
+	Markup     data.MicroUSD `json:"markup"`
+	// PlatformFee is the flat fee BYOK requests may be charged instead of provider cost
+	PlatformFee   data.MicroUSD `json:"platform_fee,omitempty"`
+	OptimizerCost data.MicroUSD `json:"optimizer_cost"`
+	Total         data.MicroUSD `json:"total"`
+	// CreditsUsed is the part of Total paid with promotional credit
+	CreditsUsed data.MicroUSD `json:"credits_used,omitempty"`
+	Currency    string        `json:"currency"`
+}
+
+// newCostInfo itemizes a request's billable cost
+func newCostInfo(cost data.CostBreakdown, creditsUsed data.MicroUSD) *CostInfo {
+	return &CostInfo{
+		BaseInput:     cost.BaseInput,
+		BaseOutput:    cost.BaseOutput,
+		Markup:        cost.Markup(),
+		PlatformFee:   cost.PlatformFee,
+		OptimizerCost: cost.Optimizer,
+		Total:         cost.Total(),
+		CreditsUsed:   creditsUsed,
+		Currency:      "USD",
+	}
+}
+
+// streamFinisher is implemented by the service's streams, which charge their usage once read to the end
+type streamFinisher interface {
+	Finish() (data.CostBreakdown, data.MicroUSD)
+}
+
+// streamUsageReporter is implemented by the service's streams, which report their billed usage
+// and savings once finished
+type streamUsageReporter interface {
+	Usage() services.StreamUsage
+}
+
+// SavingsInfo is what prompt optimization saved a request
+type SavingsInfo struct {
+	InputTokensSaved  int `json:"input_tokens_saved"`
+	OutputTokensSaved int `json:"output_tokens_saved"`
+	TotalTokensSaved  int `json:"total_tokens_saved"`
+	// NetSavings is what the saved tokens would have cost, less the optimizer's cost
+	NetSavings data.MicroUSD `json:"net_savings"`
+}
+
+// newStreamUsageInfo reports a finished stream's usage and savings as a non-streaming response would
+func newStreamUsageInfo(usage services.StreamUsage) (*UsageInfo, *SavingsInfo) {
+	info := &UsageInfo{
+		InputTokens:           usage.InputTokens,
+		OutputTokens:          usage.OutputTokens,
+		TotalTokens:           usage.InputTokens + usage.OutputTokens,
+		CachedInputTokens:     usage.Details.CacheReadTokens,
+		CacheWriteInputTokens: usage.Details.CacheWriteTokens,
+		ReasoningTokens:       usage.Details.ReasoningTokens,
+		Estimated:             usage.Estimated,
+	}
+	savings := &SavingsInfo{
+		InputTokensSaved:  usage.InputTokensSaved,
+		OutputTokensSaved: usage.OutputTokensSaved,
+		TotalTokensSaved:  usage.TotalTokensSaved,
+		NetSavings:        usage.NetSavings,
+	}
+	return info, savings
+}
+
+// streamTimer is implemented by the service's streams, which time their first output and end
+type streamTimer interface {
+	Timing() services.StreamTiming
+}
+
+// streamFinishReasoner is implemented by the service's streams, which report why the provider or
+// the server ended them
+type streamFinishReasoner interface {
+	FinishReason() string
+}
+
+// streamFinishReason returns why a stream ended, or "" when that isn't known
+func streamFinishReason(stream io.Reader) string {
+	if reasoner, ok := stream.(streamFinishReasoner); ok {
+		return reasoner.FinishReason()
+	}
+	return ""
+}
+
+// TimingInfo is how long a stream took, sent before its cost
+type TimingInfo struct {
+	// TimeToFirstTokenMs is omitted when the stream produced no output
+	TimeToFirstTokenMs int64 `json:"time_to_first_token_ms,omitempty"`
+	DurationMs         int64 `json:"duration_ms"`
+}
+
+// newTimingInfo reports a stream's timing in milliseconds
+func newTimingInfo(timing services.StreamTiming) *TimingInfo {
+	return &TimingInfo{
+		TimeToFirstTokenMs: timing.TimeToFirstToken.Milliseconds(),
+		DurationMs:         timing.Duration.Milliseconds(),
+	}
+}
+
+// EstimateRequest represents a request to price a prompt without running it
+type EstimateRequest struct {
+	Model     string `json:"model" binding:"required"`
+	Prompt    string `json:"prompt" binding:"required"`
+	MaxTokens *int   `json:"max_tokens,omitempty" binding:"omitempty,min=1"`
+}
+
+// EstimateResponse is the estimated token usage and cost of a request. Output is priced at
+// max_output_tokens, so total_cost is an upper bound.
+type EstimateResponse struct {
+	Model           string             `json:"model"`
+	RequestedModel  string             `json:"requested_model,omitempty"`
+	Provider        string             `json:"provider"`
+	InputTokens     int                `json:"input_tokens"`
+	MaxOutputTokens int                `json:"max_output_tokens"`
+	InputCost       data.MicroUSD      `json:"input_cost"`
+	TotalCost       data.MicroUSD      `json:"total_cost"`
+	Cost            data.CostBreakdown `json:"cost"`
+}
+
+// OptimizeRequest represents a request to preview what the optimizer does to a prompt
+type OptimizeRequest struct {
+	Prompt string `json:"prompt" binding:"required"`
+	// Strategy is auto (rule-based rewriting, then the optimizer model, as generation does),
+	// rule_based or ai
+	Strategy         string `json:"strategy,omitempty"`
+	OptimizationMode string `json:"optimization_mode,omitempty"`
+	// Model, when set, prices the savings at the caller's input price for that model
+	Model string `json:"model,omitempty"`
+}
+
+// OptimizeResponse is the optimized prompt and its estimated savings. Token counts are the same
+// estimates generation uses.
+type OptimizeResponse struct {
+	OriginalPrompt   string  `json:"original_prompt"`
+	OptimizedPrompt  string  `json:"optimized_prompt"`
+	WasOptimized     bool    `json:"was_optimized"`
+	OptimizationType string  `json:"optimization_type"`
+	FallbackReason   string  `json:"fallback_reason,omitempty"`
+	OriginalTokens   int     `json:"original_tokens"`
+	OptimizedTokens  int     `json:"optimized_tokens"`
+	TokensSaved      int     `json:"tokens_saved"`
+	SavingsPercent   float64 `json:"savings_percent"`
+	// Model and EstimatedSavings are set when the request names a model
+	Model            string        `json:"model,omitempty"`
+	EstimatedSavings data.MicroUSD `json:"estimated_savings,omitempty"`
 }
 
 // UsageInfo contains token usage information for HTTP responses
@@ -200,6 +722,15 @@ type UsageInfo struct {
 	InputTokens  int `json:"input_tokens"`
 	OutputTokens int `json:"output_tokens"`
 	TotalTokens  int `json:"total_tokens"`
+	// CachedInputTokens and CacheWriteInputTokens are the input tokens the provider read from and
+	// wrote to its prompt cache, which are priced at the cache's rates
+	CachedInputTokens     int `json:"cached_input_tokens,omitempty"`
+	CacheWriteInputTokens int `json:"cache_write_input_tokens,omitempty"`
+	// ReasoningTokens are the output tokens a reasoning model spent thinking
+	ReasoningTokens int `json:"reasoning_tokens,omitempty"`
+	// Estimated is set on streams billed for estimated tokens, because the provider reported no
+	// usage or the stream was capped
+	Estimated bool `json:"estimated,omitempty"`
 }
 
 // Generate handles the main generation endpoint
@@ -217,78 +748,86 @@ func (h *Handler) Generate(c *gin.Context) {
 	requestCtx.Logger.Info("Handler entered", "request_id", requestCtx.RequestID, "timestamp", time.Now().Format(time.RFC3339Nano))
 
 	// Parse request
-	var req GenerateRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Invalid request format: " + err.Error(),
-		})
+	serviceReq, ok := h.bindGenerateRequest(c)
+	if !ok {
 		return
 	}
 
-	// Convert HTTP request to service request
-	serviceReq := &services.GenerationRequest{
-		Model:            req.Model,
-		Prompt:           req.Prompt,
-		MaxTokens:        h.getIntValue(req.MaxTokens, 1000),
-		Temperature:      h.getFloatValue(req.Temperature, 0.7),
-		TopP:             h.getFloatValue(req.TopP, 1.0),
-		Stream:           h.getBoolValue(req.Stream, false),
-		Extra:            req.Extra,
-		OpenAIAPIKey:     req.OpenAIAPIKey,
-		AnthropicAPIKey:  req.AnthropicAPIKey,
-		GoogleAPIKey:     req.GoogleAPIKey,
-		OptimizationMode: req.OptimizationMode,
+	// OpenAI-style clients set stream on the same endpoint, so switch to the streaming pipeline
+	if serviceReq.Stream {
+		h.streamGeneration(c, requestCtx, serviceReq, startTime)
+		return
 	}
 
-	// Call service layer
-	result, err := h.generationService.Generate(c.Request.Context(), serviceReq, &services.RequestContext{
-		RequestID:   requestCtx.RequestID,
-		UserID:      requestCtx.UserID,
-		APIKeyID:    requestCtx.APIKeyID,
-		PricingTier: requestCtx.PricingTier,
-		Logger:      requestCtx.Logger,
-		CachedUser:  convertCachedUserData(requestCtx.CachedUser),
-	})
-	if err != nil {
-		requestCtx.Logger.Error("Generation failed", "error", err, "model", req.Model, "provider", "openai")
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": fmt.Sprintf("Generation failed: %v", err),
-		})
+	resp, genErr := h.runGeneration(c.Request.Context(), requestCtx, serviceReq, startTime)
+	if genErr != nil {
+		c.JSON(genErr.Status, genErr.Body)
 		return
 	}
 
-	// Calculate cost with percentage-based pricing
-	totalCost, markupAmount, err := h.pricingService.CalculateCost(
-		c.Request.Context(),
-		requestCtx.UserID,
-		req.Model,
-		result.Response.Usage.InputTokens,
-		result.Response.Usage.OutputTokens,
-	)
+	c.JSON(http.StatusOK, resp)
+}
+
+// generationError is a failed generation and the HTTP status and body it maps to
+type generationError struct {
+	Status int
+	Body   gin.H
+}
+
+// runGeneration runs a non-streaming generation, then prices, charges and logs it
+func (h *Handler) runGeneration(ctx context.Context, requestCtx *RequestContext, serviceReq *services.GenerationRequest, startTime time.Time) (*GenerateResponse, *generationError) {
+	// Call service layer
+	result, err := h.generationService.Generate(ctx, serviceReq, requestCtx.serviceContext())
 	if err != nil {
-		requestCtx.Logger.Error("Failed to calculate cost", "error", err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to calculate cost",
-		})
-		return
+		h.logGenerationFailure(ctx, requestCtx, serviceReq, err, startTime)
+	}
+	if genErr := promptLimitError(err); genErr != nil {
+		return nil, genErr
+	}
+	if errors.Is(err, services.ErrKeyRestricted) || errors.Is(err, services.ErrAccountInactive) {
+		return nil, &generationError{http.StatusForbidden, gin.H{
+			"error": err.Error(),
+		}}
+	}
+	if errors.Is(err, services.ErrInsufficientBalance) {
+		return nil, &generationError{http.StatusPaymentRequired, gin.H{
+			"error": err.Error(),
+		}}
+	}
+	if errors.Is(err, services.ErrTemplateNotFound) || errors.Is(err, services.ErrTemplateVariables) || errors.Is(err, services.ErrContextWindowExceeded) {
+		return nil, &generationError{http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		}}
+	}
+	var moderationErr *services.ModerationError
+	if errors.As(err, &moderationErr) {
+		return nil, &generationError{http.StatusUnprocessableEntity, contentBlockedResponse(moderationErr.Stage, moderationErr.Result)}
+	}
+	if errors.Is(err, services.ErrProviderRateLimited) {
+		return nil, &generationError{http.StatusTooManyRequests, gin.H{
+			"error": err.Error(),
+		}}
+	}
+	if errors.Is(err, services.ErrProviderTimeout) {
+		requestCtx.Logger.Warn("Generation timed out", "error", err, "model", serviceReq.Model)
+		return nil, &generationError{http.StatusGatewayTimeout, gin.H{
+			"error": err.Error(),
+		}}
 	}
-
-	// Check user balance
-	balance, err := h.firebaseService.GetUserBalance(c.Request.Context(), requestCtx.UserID)
 	if err != nil {
-		requestCtx.Logger.Error("Failed to get user balance", "error", err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to check balance",
-		})
-		return
+		requestCtx.Logger.Error("Generation failed", "error", err, "model", serviceReq.Model, "provider", "openai")
+		return nil, &generationError{http.StatusInternalServerError, gin.H{
+			"error": fmt.Sprintf("Generation failed: %v", err),
+		}}
 	}
 
-	if balance < totalCost {
-		c.JSON(http.StatusPaymentRequired, gin.H{
-			"error": fmt.Sprintf("Insufficient balance: %.6f required, %.6f available", totalCost, balance),
-		})
-		return
-	}
+	// The service reserved the generation's cost at max_tokens before calling the provider, and
+	// keeps it held until the completion it already produced is charged
+	defer result.BalanceHold.Release()
+
+	// The service prices the generation the same way streams are priced
+	cost := result.Cost
+	totalCost := cost.Total()
 
 	// Convert service response to HTTP response
 	httpResp := &GenerateResponse{
@@ -299,6 +838,7 @@ func (h *Handler) Generate(c *gin.Context) {
 		FinishReason: result.Response.FinishReason,
 		CreatedAt:    result.Response.CreatedAt,
 		Metadata:     result.Response.Metadata,
+		Logprobs:     result.Response.Logprobs,
 	}
 
 	// Convert usage info
@@ -307,6 +847,10 @@ func (h *Handler) Generate(c *gin.Context) {
 			InputTokens:  result.Response.Usage.InputTokens,
 			OutputTokens: result.Response.Usage.OutputTokens,
 			TotalTokens:  result.Response.Usage.InputTokens + result.Response.Usage.OutputTokens,
+
+			CachedInputTokens:     result.Response.Usage.Details.CacheReadTokens,
+			CacheWriteInputTokens: result.Response.Usage.Details.CacheWriteTokens,
+			ReasoningTokens:       result.Response.Usage.Details.ReasoningTokens,
 		}
 	}
 
@@ -314,28 +858,70 @@ func (h *Handler) Generate(c *gin.Context) {
 	if httpResp.Metadata == nil {
 		httpResp.Metadata = make(map[string]interface{})
 	}
-	httpResp.Metadata["total_cost"] = totalCost
-	httpResp.Metadata["markup_amount"] = markupAmount
-	httpResp.Metadata["base_cost"] = totalCost - markupAmount
+	// total_cost, markup_amount, base_cost and platform_fee are deprecated aliases of the cost
+	// object's total, markup, base_input plus base_output, and platform_fee, kept for clients
+	// written before it
+	httpResp.Metadata["total_cost"] = cost.Total()
+	httpResp.Metadata["markup_amount"] = cost.Markup()
+	httpResp.Metadata["base_cost"] = cost.Base()
+	httpResp.Metadata["billing_mode"] = h.generationService.BillingMode(serviceReq.BYOK, requestCtx.TestMode)
+	httpResp.Cost = cost
+	httpResp.BillingMode = h.generationService.BillingMode(serviceReq.BYOK, requestCtx.TestMode)
+	if cost.PlatformFee > 0 {
+		httpResp.Metadata["platform_fee"] = cost.PlatformFee
+	}
+	if result.Moderation != nil && result.Moderation.Action == data.ModerationActionAnnotate {
+		httpResp.Metadata["moderation"] = result.Moderation
+	}
+	if h.modelPricing(requestCtx, serviceReq.Model).Override {
+		httpResp.Metadata["custom_pricing"] = true
+	}
+	if requestCtx.TestMode {
+		httpResp.Metadata["test_mode"] = true
+	}
+
+	// Charge the user or their organization before logging, so the log records any promotional
+	// credit the charge consumed; BYOK requests may cost nothing to charge
+	creditsUsed, chargeErr := h.billingService.Charge(ctx, requestCtx.RequestID, requestCtx.UserID, requestCtx.OrgID, totalCost)
 
 	// Log the request for audit purposes
-	err = h.logRequest(c.Request.Context(), requestCtx, serviceReq, result, totalCost, markupAmount, startTime, time.Now(), false)
+	err = h.logRequest(ctx, requestCtx, serviceReq, result, cost, creditsUsed, startTime, time.Now(), false)
 	if err != nil {
 		requestCtx.Logger.Error("Failed to log request", "error", err)
 		// Don't fail the request, just log the error
 	}
 
-	// Charge the user
-	err = h.firebaseService.UpdateUserBalance(c.Request.Context(), requestCtx.UserID, -totalCost)
-	if err != nil {
-		requestCtx.Logger.Error("Failed to charge user", "error", err)
-		c.JSON(http.StatusInternalServerError, gin.H{
+	if chargeErr != nil {
+		requestCtx.Logger.Error("Failed to charge user", "error", chargeErr)
+		return nil, &generationError{http.StatusInternalServerError, gin.H{
 			"error": "Failed to process payment",
-		})
-		return
+		}}
+	}
+	if creditsUsed > 0 {
+		httpResp.Metadata["credits_used"] = creditsUsed
+		httpResp.CreditsUsed = creditsUsed
+	}
+	httpResp.CostInfo = newCostInfo(cost, creditsUsed)
+
+	// A blocked completion has been billed but is withheld from the caller
+	if result.Moderation != nil && result.Moderation.Blocked {
+		return nil, &generationError{http.StatusUnprocessableEntity, contentBlockedResponse(services.ModerationStageCompletion, result.Moderation.Completion)}
+	}
+
+	return httpResp, nil
+}
+
+// requestTimeout converts a request's timeout_seconds into a duration, rejecting values above the server maximum
+func (h *Handler) requestTimeout(seconds *int) (time.Duration, error) {
+	if seconds == nil {
+		return 0, nil
 	}
 
-	c.JSON(http.StatusOK, httpResp)
+	timeout := time.Duration(*seconds) * time.Second
+	if timeout > h.config.Timeouts.MaxRequest {
+		return 0, fmt.Errorf("timeout_seconds must not exceed %d", int(h.config.Timeouts.MaxRequest.Seconds()))
+	}
+	return timeout, nil
 }
 
 // getIntValue safely extracts int value from pointer
@@ -363,23 +949,37 @@ func (h *Handler) getBoolValue(ptr *bool, defaultValue bool) bool {
 }
 
 // logRequest logs the generation request to Firebase for audit purposes
-func (h *Handler) logRequest(ctx context.Context, requestCtx *RequestContext, req *services.GenerationRequest, result *services.GenerationResult, totalCost, markupAmount float64, startTime, endTime time.Time, streaming bool) error {
+func (h *Handler) logRequest(ctx context.Context, requestCtx *RequestContext, req *services.GenerationRequest, result *services.GenerationResult, cost data.CostBreakdown, creditsUsed data.MicroUSD, startTime, endTime time.Time, streaming bool) error {
+	pricing := h.modelPricing(requestCtx, req.Model)
+
 	// Create request log
 	log := &data.RequestLog{
 		ID:                 requestCtx.RequestID,
 		UserID:             requestCtx.UserID,
+		OrgID:              requestCtx.OrgID,
+		TenantID:           requestCtx.Tenant.GetID(),
+		UserType:           requestCtx.userType(),
 		APIKeyID:           requestCtx.APIKeyID,
 		RequestID:          requestCtx.RequestID,
 		ModelID:            req.Model,
+		RequestedModel:     req.RequestedModel,
+		BYOK:               req.BYOK,
+		BillingMode:        h.generationService.BillingMode(req.BYOK, requestCtx.TestMode),
+		Moderation:         result.Moderation,
+		SystemPrompts:      req.SystemPrompts,
+		TemplateID:         req.TemplateID,
+		TemplateVersion:    req.TemplateVersion,
 		Provider:           result.Response.Provider,
 		InputTokens:        result.Response.Usage.InputTokens,
 		OutputTokens:       result.Response.Usage.OutputTokens,
 		TotalTokens:        result.Response.Usage.InputTokens + result.Response.Usage.OutputTokens,
-		BaseCost:           totalCost - markupAmount,
-		MarkupAmount:       markupAmount,
-		TotalCost:          totalCost,
+		BaseCost:           cost.Base(),
+		MarkupAmount:       cost.Markup(),
+		PlatformFee:        cost.PlatformFee,
+		TotalCost:          cost.Total(),
+		CreditsUsed:        creditsUsed,
 		TierID:             requestCtx.PricingTier.ID,
-		MarkupPercent:      requestCtx.PricingTier.InputMarkupPercent, // Use input markup as representative
+		MarkupPercent:      pricing.MarkupPercent(),
 		WasOptimized:       result.WasOptimized,
 		OptimizationStatus: result.OptimizationStatus,
 		TokensSaved:        0, // Will be calculated if optimization occurred
@@ -389,99 +989,427 @@ func (h *Handler) logRequest(ctx context.Context, requestCtx *RequestContext, re
 		ResponseTimestamp:  endTime,
 		DurationMs:         endTime.Sub(startTime).Milliseconds(),
 		Status:             "success",
-		IPAddress:          "", // TODO: Extract from request
-		UserAgent:          "", // TODO: Extract from request
+		IPAddress:          requestCtx.ClientIP,
+		UserAgent:          requestCtx.UserAgent,
 		Metadata:           result.Response.Metadata,
+
+		CachedInputTokens:     result.Response.Usage.Details.CacheReadTokens,
+		CacheWriteInputTokens: result.Response.Usage.Details.CacheWriteTokens,
+		ReasoningTokens:       result.Response.Usage.Details.ReasoningTokens,
+		PricingOverride:       pricing.Override,
+		TestMode:              requestCtx.TestMode,
+		Payload:               result.Payload,
+	}
+
+	if result.Moderation != nil && result.Moderation.Blocked {
+		log.Status = "blocked"
 	}
+	if req.Experiment != nil {
+		log.ExperimentID = req.Experiment.ExperimentID
+		log.ExperimentVariant = req.Experiment.Variant
+	}
+	log.Routing = req.Routing
 
 	// Calculate tokens saved if optimization occurred
 	if result.PromptOptimizationResult != nil {
 		log.TokensSaved = result.PromptOptimizationResult.TokensSaved
-		log.SavingsAmount = float64(result.PromptOptimizationResult.TokensSaved) * (requestCtx.PricingTier.InputMarkupPercent / 100) / 1000000
+		log.SavingsAmount = result.PromptOptimizationResult.NetSavings
+		log.GrossSavings = result.PromptOptimizationResult.NetSavings + result.PromptOptimizationResult.OptimizerCost
+		log.OptimizerInputTokens = result.PromptOptimizationResult.OptimizerInputTokens
+		log.OptimizerOutputTokens = result.PromptOptimizationResult.OptimizerOutputTokens
+		log.OptimizerCost = result.PromptOptimizationResult.OptimizerCost
+	}
+	if compression := req.ContextCompression; compression != nil {
+		log.OptimizerInputTokens += compression.SummaryInputTokens
+		log.OptimizerOutputTokens += compression.SummaryOutputTokens
+		log.OptimizerCost += compression.Cost
 	}
 
 	// Log to Firebase
 	return h.firebaseService.LogRequest(ctx, log)
 }
 
-// GenerateStream handles the streaming generation endpoint
-func (h *Handler) GenerateStream(c *gin.Context) {
-	startTime := time.Now()
+// logBlockedRequest logs a request whose prompt was blocked by moderation before reaching a provider
+func (h *Handler) logBlockedRequest(ctx context.Context, requestCtx *RequestContext, req *services.GenerationRequest, moderationErr *services.ModerationError, startTime time.Time) {
+	endTime := time.Now()
+	log := &data.RequestLog{
+		ID:                requestCtx.RequestID,
+		UserID:            requestCtx.UserID,
+		OrgID:             requestCtx.OrgID,
+		TenantID:          requestCtx.Tenant.GetID(),
+		UserType:          requestCtx.userType(),
+		APIKeyID:          requestCtx.APIKeyID,
+		RequestID:         requestCtx.RequestID,
+		ModelID:           req.Model,
+		RequestedModel:    req.RequestedModel,
+		Routing:           req.Routing,
+		Moderation:        moderationErr.Record,
+		TierID:            requestCtx.PricingTier.ID,
+		Streaming:         req.Stream,
+		RequestTimestamp:  startTime,
+		ResponseTimestamp: endTime,
+		DurationMs:        endTime.Sub(startTime).Milliseconds(),
+		Status:            "blocked",
+		Error:             moderationErr.Error(),
+		IPAddress:         requestCtx.ClientIP,
+		UserAgent:         requestCtx.UserAgent,
+		TestMode:          requestCtx.TestMode,
+	}
 
-	// Get request context
-	requestCtx, exists := h.getRequestContext(c)
-	if !exists {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Request context not found",
-		})
-		return
+	if err := h.firebaseService.LogRequest(ctx, log); err != nil {
+		requestCtx.Logger.Error("Failed to log blocked request", "error", err)
 	}
-	requestCtx.Logger.Info("Streaming handler entered", "request_id", requestCtx.RequestID, "timestamp", time.Now().Format(time.RFC3339Nano))
+}
 
-	// Parse request
-	var req GenerateRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Invalid request format: " + err.Error(),
-		})
-		return
+// logGenerationFailure logs a generation that failed before it produced a response: a prompt
+// blocked by moderation as blocked, and a provider failure as an error. Requests rejected before
+// reaching a provider, such as for an exhausted balance or a rate limit, are not logged.
+func (h *Handler) logGenerationFailure(ctx context.Context, requestCtx *RequestContext, req *services.GenerationRequest, err error, startTime time.Time) {
+	var moderationErr *services.ModerationError
+	switch {
+	case errors.As(err, &moderationErr):
+		h.logBlockedRequest(ctx, requestCtx, req, moderationErr, startTime)
+	case streamStartError(err).Status >= http.StatusInternalServerError:
+		h.logFailedRequest(ctx, requestCtx, req, err, startTime)
 	}
+}
 
-	// Convert HTTP request to service request
-	serviceReq := &services.GenerationRequest{
-		Model:            req.Model,
-		Prompt:           req.Prompt,
-		MaxTokens:        h.getIntValue(req.MaxTokens, 1000),
-		Temperature:      h.getFloatValue(req.Temperature, 0.7),
-		TopP:             h.getFloatValue(req.TopP, 1.0),
-		Stream:           true, // Force streaming for this endpoint
-		Extra:            req.Extra,
-		OpenAIAPIKey:     req.OpenAIAPIKey,
-		AnthropicAPIKey:  req.AnthropicAPIKey,
-		GoogleAPIKey:     req.GoogleAPIKey,
-		OptimizationMode: req.OptimizationMode,
+// logFailedRequest logs a generation that failed at the provider, at no cost
+func (h *Handler) logFailedRequest(ctx context.Context, requestCtx *RequestContext, req *services.GenerationRequest, err error, startTime time.Time) {
+	endTime := time.Now()
+	detail := services.RequestErrorDetail(err)
+	provider := detail.Provider
+	if provider == "" {
+		modelConfig, _ := h.pricingService.GetModelConfig(req.Model)
+		provider = modelConfig.Provider
 	}
 
-	// Set up streaming response headers immediately
-	c.Header("Content-Type", "text/event-stream")
-	c.Header("Cache-Control", "no-cache")
-	c.Header("Connection", "keep-alive")
-	c.Header("X-Request-ID", requestCtx.RequestID)
+	log := &data.RequestLog{
+		ID:                requestCtx.RequestID,
+		UserID:            requestCtx.UserID,
+		OrgID:             requestCtx.OrgID,
+		TenantID:          requestCtx.Tenant.GetID(),
+		UserType:          requestCtx.userType(),
+		APIKeyID:          requestCtx.APIKeyID,
+		RequestID:         requestCtx.RequestID,
+		ModelID:           req.Model,
+		RequestedModel:    req.RequestedModel,
+		BYOK:              req.BYOK,
+		BillingMode:       h.generationService.BillingMode(req.BYOK, requestCtx.TestMode),
+		Routing:           req.Routing,
+		Provider:          provider,
+		TierID:            requestCtx.PricingTier.ID,
+		Streaming:         req.Stream,
+		RequestTimestamp:  startTime,
+		ResponseTimestamp: endTime,
+		DurationMs:        endTime.Sub(startTime).Milliseconds(),
+		Status:            data.RequestStatusError,
+		Error:             err.Error(),
+		ErrorDetail:       detail,
+		IPAddress:         requestCtx.ClientIP,
+		UserAgent:         requestCtx.UserAgent,
+		TestMode:          requestCtx.TestMode,
+	}
+	if req.Experiment != nil {
+		log.ExperimentID = req.Experiment.ExperimentID
+		log.ExperimentVariant = req.Experiment.Variant
+	}
 
-	// Call service layer for streaming
-	streamResp, err := h.generationService.GenerateStream(c.Request.Context(), serviceReq, &services.RequestContext{
-		RequestID:   requestCtx.RequestID,
-		UserID:      requestCtx.UserID,
-		APIKeyID:    requestCtx.APIKeyID,
-		PricingTier: requestCtx.PricingTier,
-		Logger:      requestCtx.Logger,
-		CachedUser:  convertCachedUserData(requestCtx.CachedUser),
-	})
-	if err != nil {
-		requestCtx.Logger.Error("Streaming generation failed", "error", err)
-		// Don't try to write to the response if the stream failed to start
-		// just return since the connection might be closed.
-		return
+	if err := h.firebaseService.LogRequest(ctx, log); err != nil {
+		requestCtx.Logger.Error("Failed to log failed request", "error", err)
 	}
+}
 
-	// Use c.Stream for a more robust streaming implementation
+// contentBlockedResponse builds the 422 body returned when moderation blocks a prompt or completion
+func contentBlockedResponse(stage string, result *data.ModerationResult) gin.H {
+	body := gin.H{
+		"error": fmt.Sprintf("The %s was blocked by content moderation", stage),
+		"code":  "content_blocked",
+		"stage": stage,
+	}
+	if result != nil {
+		body["categories"] = result.Categories
+	}
+	return body
+}
+
+// streamStartError maps an error starting a streaming generation to the status and body it is reported with
+func streamStartError(err error) *generationError {
+	if genErr := promptLimitError(err); genErr != nil {
+		return genErr
+	}
+	var moderationErr *services.ModerationError
+	switch {
+	case errors.Is(err, services.ErrKeyRestricted), errors.Is(err, services.ErrAccountInactive):
+		return &generationError{http.StatusForbidden, gin.H{"error": err.Error()}}
+	case errors.Is(err, services.ErrInsufficientBalance):
+		return &generationError{http.StatusPaymentRequired, gin.H{"error": err.Error()}}
+	case errors.Is(err, services.ErrTemplateNotFound), errors.Is(err, services.ErrTemplateVariables), errors.Is(err, services.ErrContextWindowExceeded):
+		return &generationError{http.StatusBadRequest, gin.H{"error": err.Error()}}
+	case errors.As(err, &moderationErr):
+		return &generationError{http.StatusUnprocessableEntity, contentBlockedResponse(moderationErr.Stage, moderationErr.Result)}
+	case errors.Is(err, services.ErrProviderRateLimited):
+		return &generationError{http.StatusTooManyRequests, gin.H{"error": err.Error()}}
+	case errors.Is(err, services.ErrProviderTimeout):
+		return &generationError{http.StatusGatewayTimeout, gin.H{"error": err.Error()}}
+	default:
+		return &generationError{http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Streaming generation failed: %v", err)}}
+	}
+}
+
+// promptLimitError reports a prompt rejected for its size with its error code, or nil for other errors
+func promptLimitError(err error) *generationError {
+	switch {
+	case errors.Is(err, services.ErrPromptTooLarge):
+		return &generationError{http.StatusRequestEntityTooLarge, gin.H{"error": err.Error(), "code": "prompt_too_large"}}
+	case errors.Is(err, services.ErrPromptTooLong):
+		return &generationError{http.StatusBadRequest, gin.H{"error": err.Error(), "code": "prompt_too_long"}}
+	default:
+		return nil
+	}
+}
+
+// completeUTF8Prefix returns the length of b without a trailing rune that was split across
+// stream reads, so streamed text can be sent in valid UTF-8 chunks
+func completeUTF8Prefix(b []byte) int {
+	complete := len(b)
+	for complete > 0 && complete > len(b)-utf8.UTFMax && !utf8.Valid(b[:complete]) {
+		complete--
+	}
+	return complete
+}
+
+// streamChunk is one read from a generation stream
+type streamChunk struct {
+	data []byte
+	err  error
+	// logprobs are the token logprobs the stream reported with the read, if requested
+	logprobs []data.TokenLogprob
+	// buf is the pooled buffer data was read into
+	buf *[]byte
+}
+
+// release returns the chunk's buffer to the pool once its data has been written
+func (c streamChunk) release() {
+	services.PutStreamBuffer(c.buf)
+}
+
+// readStreamChunks reads a generation stream in the background, so SSE writers can send heartbeats
+// while the provider is silent. The channel is closed after the read that returns an error, including io.EOF.
+// Receivers release each chunk once they have written it, so its buffer can be reused.
+func readStreamChunks(stream io.Reader) <-chan streamChunk {
+	chunks := make(chan streamChunk)
+	go func() {
+		defer close(chunks)
+		for {
+			buf := services.GetStreamBuffer()
+			n, err := stream.Read(*buf)
+			var logprobs []data.TokenLogprob
+			if reader, ok := stream.(data.LogprobsReader); ok {
+				logprobs = reader.TakeLogprobs()
+			}
+			if n > 0 || err != nil || len(logprobs) > 0 {
+				chunks <- streamChunk{data: (*buf)[:n], err: err, logprobs: logprobs, buf: buf}
+			} else {
+				services.PutStreamBuffer(buf)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return chunks
+}
+
+// stopStreamChunks aborts the provider stream and waits for the background reader to exit, so the
+// stream is never closed while a read is in progress
+func stopStreamChunks(cancel context.CancelFunc, chunks <-chan streamChunk) {
+	cancel()
+	for range chunks {
+	}
+}
+
+// sseHeartbeat returns a channel that fires at the configured heartbeat interval, or never when
+// heartbeats are disabled, and a function that stops it
+func (h *Handler) sseHeartbeat() (<-chan time.Time, func()) {
+	if h.config.Timeouts.StreamHeartbeat <= 0 {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(h.config.Timeouts.StreamHeartbeat)
+	return ticker.C, ticker.Stop
+}
+
+// writeSSEHeartbeat writes an SSE comment, which clients ignore but which keeps proxies and load
+// balancers from closing a connection while a provider is slow to produce the next chunk
+func writeSSEHeartbeat(w io.Writer) bool {
+	_, err := io.WriteString(w, ": ping\n\n")
+	return err == nil
+}
+
+// GenerateStream handles the streaming generation endpoint
+func (h *Handler) GenerateStream(c *gin.Context) {
+	startTime := time.Now()
+
+	// Get request context
+	requestCtx, exists := h.getRequestContext(c)
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Request context not found",
+		})
+		return
+	}
+	requestCtx.Logger.Info("Streaming handler entered", "request_id", requestCtx.RequestID, "timestamp", time.Now().Format(time.RFC3339Nano))
+
+	// Parse request
+	serviceReq, ok := h.bindGenerateRequest(c)
+	if !ok {
+		return
+	}
+	serviceReq.Stream = true // Force streaming for this endpoint
+
+	h.streamGeneration(c, requestCtx, serviceReq, startTime)
+}
+
+// newGenerationRequest validates a generate request and converts it to a service request
+func (h *Handler) newGenerationRequest(req *GenerateRequest) (*services.GenerationRequest, error) {
+	if err := req.validatePromptSource(); err != nil {
+		return nil, err
+	}
+
+	timeout, err := h.requestTimeout(req.TimeoutSeconds)
+	if err != nil {
+		return nil, err
+	}
+
+	logprobs := h.getBoolValue(req.Logprobs, false)
+	if req.TopLogprobs != nil && !logprobs {
+		return nil, fmt.Errorf("top_logprobs requires logprobs to be true")
+	}
+
+	return &services.GenerationRequest{
+		Model:                   req.Model,
+		Prompt:                  req.Prompt,
+		MaxTokens:               h.getIntValue(req.MaxTokens, 1000),
+		Temperature:             req.Temperature,
+		TopP:                    req.TopP,
+		Stop:                    req.Stop,
+		FrequencyPenalty:        req.FrequencyPenalty,
+		PresencePenalty:         req.PresencePenalty,
+		Seed:                    req.Seed,
+		Stream:                  h.getBoolValue(req.Stream, false),
+		Extra:                   req.Extra,
+		OpenAIAPIKey:            req.OpenAIAPIKey,
+		AnthropicAPIKey:         req.AnthropicAPIKey,
+		GoogleAPIKey:            req.GoogleAPIKey,
+		OptimizationMode:        req.OptimizationMode,
+		DisableOptimization:     req.Optimization != nil && !h.getBoolValue(req.Optimization.Enabled, true),
+		DisableRuleOptimization: req.DisableRuleOptimization,
+		TemplateID:              req.TemplateID,
+		TemplateVersion:         req.TemplateVersion,
+		Variables:               req.Variables,
+		Timeout:                 timeout,
+		Logprobs:                logprobs,
+		TopLogprobs:             req.TopLogprobs,
+		CachePrompt:             req.CacheControl != nil,
+		ReasoningEffort:         req.ReasoningEffort,
+		ThinkingBudget:          h.getIntValue(req.ThinkingBudget, 0),
+	}, nil
+}
+
+// streamGeneration runs a streaming generation and writes it to the client in the stream format it
+// asked for, server-sent events by default
+func (h *Handler) streamGeneration(c *gin.Context, requestCtx *RequestContext, serviceReq *services.GenerationRequest, startTime time.Time) {
+	format, err := streamFormat(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Set up streaming response headers immediately
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Request-ID", requestCtx.RequestID)
+
+	// Cancelling ctx aborts the provider stream, so the background reader can be stopped
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	// Call service layer for streaming
+	streamResp, err := h.generationService.GenerateStream(ctx, serviceReq, requestCtx.serviceContext())
+	if err != nil {
+		h.logGenerationFailure(c.Request.Context(), requestCtx, serviceReq, err, startTime)
+		var moderationErr *services.ModerationError
+		switch {
+		case errors.As(err, &moderationErr):
+		case errors.Is(err, services.ErrProviderTimeout):
+			requestCtx.Logger.Warn("Streaming generation timed out before the first chunk", "error", err, "model", serviceReq.Model)
+		case errors.Is(err, services.ErrKeyRestricted), errors.Is(err, services.ErrTemplateNotFound), errors.Is(err, services.ErrTemplateVariables), errors.Is(err, services.ErrProviderRateLimited), errors.Is(err, services.ErrContextWindowExceeded),
+			errors.Is(err, services.ErrInsufficientBalance), errors.Is(err, services.ErrAccountInactive), errors.Is(err, services.ErrPromptTooLarge), errors.Is(err, services.ErrPromptTooLong):
+		default:
+			requestCtx.Logger.Error("Streaming generation failed", "error", err)
+		}
+		// Nothing has been written yet, so the failure can still be reported as JSON
+		genErr := streamStartError(err)
+		c.Header("Content-Type", "application/json; charset=utf-8")
+		c.JSON(genErr.Status, genErr.Body)
+		return
+	}
+	// Closing the stream releases its timeout and records usage and billing
+	defer streamResp.Stream.Close()
+	encoder := streamEncoders[format](newStreamInfo(requestCtx.RequestID, serviceReq.Model))
+	c.Header("Content-Type", encoder.ContentType())
+	chunks := readStreamChunks(streamResp.Stream)
+	defer stopStreamChunks(cancel, chunks)
+	heartbeat, stopHeartbeat := h.sseHeartbeat()
+	defer stopHeartbeat()
+
+	// Use c.Stream for a more robust streaming implementation
 	c.Stream(func(w io.Writer) bool {
-		buf := make([]byte, 1024)
-		n, err := streamResp.Stream.Read(buf)
+		var chunk streamChunk
+		select {
+		case chunk = <-chunks:
+		case <-heartbeat:
+			return encoder.Heartbeat(w)
+		}
+		defer chunk.release()
+		n, err := len(chunk.data), chunk.err
 		if n > 0 {
-			// SSE format: data: <json-payload>\n\n
-			data := fmt.Sprintf("data: %s\n\n", string(buf[:n]))
-			if _, writeErr := w.Write([]byte(data)); writeErr != nil {
+			if writeErr := encoder.Text(w, chunk.data); writeErr != nil {
 				requestCtx.Logger.Error("Failed to write chunk to stream", "error", writeErr)
 				return false // Stop streaming
 			}
 		}
+		if len(chunk.logprobs) > 0 {
+			if writeErr := encoder.Logprobs(w, chunk.logprobs); writeErr != nil {
+				requestCtx.Logger.Error("Failed to write logprobs to stream", "error", writeErr)
+				return false
+			}
+		}
 
 		if err != nil {
-			if err != io.EOF {
+			// Headers are already sent, so failures are reported in the stream rather than ending it
+			// as if it had finished
+			if errors.Is(err, services.ErrProviderTimeout) {
+				requestCtx.Logger.Warn("Streaming: Provider timed out", "error", err)
+				encoder.Error(w, err)
+			} else if err != io.EOF {
 				requestCtx.Logger.Error("Streaming: Read error from source", "error", err)
+				encoder.Error(w, err)
 			} else {
 				requestCtx.Logger.Info("Streaming: EOF reached from source")
+				end := &streamEnd{FinishReason: streamFinishReason(streamResp.Stream)}
+				if timer, ok := streamResp.Stream.(streamTimer); ok {
+					end.Timing = newTimingInfo(timer.Timing())
+				}
+				if finisher, ok := streamResp.Stream.(streamFinisher); ok {
+					end.Cost = newCostInfo(finisher.Finish())
+				}
+				if reporter, ok := streamResp.Stream.(streamUsageReporter); ok {
+					end.Usage, end.Savings = newStreamUsageInfo(reporter.Usage())
+				}
+				encoder.End(w, end)
 			}
 			// Stop streaming on any error, including EOF
 			return false
@@ -490,9 +1418,225 @@ func (h *Handler) GenerateStream(c *gin.Context) {
 		return true // Continue streaming
 	})
 
+	// The request log, with its token counts and cost, is written when the deferred Close settles the stream
 	requestCtx.Logger.Info("Streaming request completed", "request_id", requestCtx.RequestID, "duration_ms", time.Since(startTime).Milliseconds())
-	// Note: Full request logging (with token counts, cost, etc.) is more complex for streams.
-	// This would typically be handled by the generation service after the stream is fully consumed.
+}
+
+// Estimate handles pricing a prompt against the caller's tier without calling a provider
+func (h *Handler) Estimate(c *gin.Context) {
+	requestCtx, exists := h.getRequestContext(c)
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Request context not found",
+		})
+		return
+	}
+
+	var req EstimateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format: " + err.Error(),
+		})
+		return
+	}
+
+	estimate, err := h.generationService.Estimate(c.Request.Context(), &services.GenerationRequest{
+		Model:     req.Model,
+		Prompt:    req.Prompt,
+		MaxTokens: h.getIntValue(req.MaxTokens, 1000),
+	}, requestCtx.serviceContext())
+	if errors.Is(err, services.ErrKeyRestricted) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if genErr := promptLimitError(err); genErr != nil {
+		c.JSON(genErr.Status, genErr.Body)
+		return
+	}
+	if errors.Is(err, services.ErrUnknownModel) || errors.Is(err, services.ErrContextWindowExceeded) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		requestCtx.Logger.Error("Estimate failed", "error", err, "model", req.Model)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to estimate cost",
+		})
+		return
+	}
+
+	// Price at the caller's tier, then take the share billing would charge: only the platform's
+	// share for the caller's own provider key, and nothing in test mode
+	cost, err := h.calculateCost(c.Request.Context(), requestCtx, estimate.Model, estimate.InputTokens, estimate.MaxOutputTokens, data.TokenDetails{})
+	if err != nil {
+		requestCtx.Logger.Error("Failed to calculate cost", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to calculate cost",
+		})
+		return
+	}
+	cost = h.generationService.BillableCost(estimate.BYOK, requestCtx.TestMode, cost)
+
+	c.JSON(http.StatusOK, &EstimateResponse{
+		Model:           estimate.Model,
+		RequestedModel:  estimate.RequestedModel,
+		Provider:        estimate.Provider,
+		InputTokens:     estimate.InputTokens,
+		MaxOutputTokens: estimate.MaxOutputTokens,
+		InputCost:       cost.BaseInput + cost.InputMarkup,
+		TotalCost:       cost.Total(),
+		Cost:            cost,
+	})
+}
+
+// Optimize handles previewing the prompt optimizer without running a generation
+func (h *Handler) Optimize(c *gin.Context) {
+	requestCtx, exists := h.getRequestContext(c)
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Request context not found",
+		})
+		return
+	}
+
+	var req OptimizeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format: " + err.Error(),
+		})
+		return
+	}
+
+	result, err := h.generationService.PreviewOptimization(c.Request.Context(), req.Prompt, req.OptimizationMode, req.Strategy)
+	if errors.Is(err, services.ErrUnknownOptimizationStrategy) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if errors.Is(err, services.ErrOptimizerUnavailable) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		requestCtx.Logger.Error("Optimization preview failed", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to optimize prompt",
+		})
+		return
+	}
+
+	resp := &OptimizeResponse{
+		OriginalPrompt:   result.OriginalText,
+		OptimizedPrompt:  result.OptimizedText,
+		WasOptimized:     result.WasOptimized,
+		OptimizationType: result.OptimizationType,
+		FallbackReason:   result.FallbackReason,
+		OriginalTokens:   result.OriginalTokens,
+		OptimizedTokens:  result.OptimizedTokens,
+		TokensSaved:      result.TokensSaved,
+		SavingsPercent:   result.SavingsPercent,
+	}
+	if req.Model == "" {
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	// Resolve the model as generation would, so aliases and key restrictions apply
+	estimate, err := h.generationService.Estimate(c.Request.Context(), &services.GenerationRequest{
+		Model:  req.Model,
+		Prompt: result.OriginalText,
+	}, requestCtx.serviceContext())
+	if errors.Is(err, services.ErrKeyRestricted) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if errors.Is(err, services.ErrUnknownModel) || errors.Is(err, services.ErrContextWindowExceeded) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		requestCtx.Logger.Error("Failed to resolve model for optimization preview", "error", err, "model", req.Model)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to estimate savings",
+		})
+		return
+	}
+
+	// Price both prompts at the caller's tier and take the billable share of each, as for estimates
+	originalCost, err := h.calculateCost(c.Request.Context(), requestCtx, estimate.Model, result.OriginalTokens, 0, data.TokenDetails{})
+	if err != nil {
+		requestCtx.Logger.Error("Failed to calculate cost", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to estimate savings",
+		})
+		return
+	}
+	optimizedCost, err := h.calculateCost(c.Request.Context(), requestCtx, estimate.Model, result.OptimizedTokens, 0, data.TokenDetails{})
+	if err != nil {
+		requestCtx.Logger.Error("Failed to calculate cost", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to estimate savings",
+		})
+		return
+	}
+
+	originalCost = h.generationService.BillableCost(estimate.BYOK, requestCtx.TestMode, originalCost)
+	optimizedCost = h.generationService.BillableCost(estimate.BYOK, requestCtx.TestMode, optimizedCost)
+
+	resp.Model = estimate.Model
+	resp.EstimatedSavings = originalCost.Total() - optimizedCost.Total()
+	c.JSON(http.StatusOK, resp)
+}
+
+// ListModels handles listing the active models with prices for the caller's tier
+func (h *Handler) ListModels(c *gin.Context) {
+	requestCtx, exists := h.getRequestContext(c)
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Request context not found",
+		})
+		return
+	}
+
+	var models []services.ModelListing
+	var err error
+	switch {
+	case requestCtx.Tenant != nil && requestCtx.Tenant.TierID != "":
+		models, err = h.pricingService.ListTierModels(c.Request.Context(), requestCtx.Tenant.TierID)
+	case requestCtx.OrgID != "":
+		models, err = h.pricingService.ListOrgModels(c.Request.Context(), requestCtx.OrgID)
+	default:
+		models, err = h.pricingService.ListModels(c.Request.Context(), requestCtx.UserID)
+	}
+	if err != nil {
+		requestCtx.Logger.Error("Failed to list models", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to list models",
+		})
+		return
+	}
+
+	// Tenants only see their own catalog
+	if requestCtx.Tenant != nil {
+		models = slices.DeleteFunc(models, func(model services.ModelListing) bool {
+			return requestCtx.Tenant.CheckModel(model.ID) != nil
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"models": models,
+	})
 }
 
 // GetProfile handles getting user profile
@@ -503,22 +1647,341 @@ func (h *Handler) GetProfile(c *gin.Context) {
 	})
 }
 
-// GetBalance handles getting user balance
+// GetBalance handles getting user balance, also shown in their display currency
 func (h *Handler) GetBalance(c *gin.Context) {
-	// TODO: Implement get balance logic with Firebase
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	user, err := h.firebaseService.GetUserByID(c.Request.Context(), userID)
+	if err != nil {
+		h.getLogger(c).Error("Failed to get user", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get balance",
+		})
+		return
+	}
+
+	now := time.Now()
+	rate, ok := h.exchangeRate(c, user.Currency, now)
+	if !ok {
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"message": "GetBalance endpoint - not implemented yet",
+		"balance":           user.Balance,
+		"available_credits": user.AvailableCredits(now),
+		"tier_id":           user.TierID,
+		"currency":          rate,
+		"converted": rate.ConvertAll(map[string]data.MicroUSD{
+			"balance":           user.Balance,
+			"available_credits": user.AvailableCredits(now),
+		}),
 	})
 }
 
-// GetUsage handles getting user usage
+// maxHourlyUsageRange bounds hourly usage queries, which read one rollup per model per hour
+const maxHourlyUsageRange = 7 * 24 * time.Hour
+
+// validateUsageGranularity checks a usage query's granularity and that hourly queries stay within maxHourlyUsageRange
+func validateUsageGranularity(granularity string, startDate, endDate time.Time) error {
+	switch granularity {
+	case data.RollupDaily:
+		return nil
+	case data.RollupHourly:
+		if endDate.Sub(startDate) > maxHourlyUsageRange {
+			return fmt.Errorf("hourly usage is limited to a 7 day range")
+		}
+		return nil
+	default:
+		return fmt.Errorf("granularity must be hour or day")
+	}
+}
+
+// GetUsage handles getting user usage. The range defaults to the last 30 days, summarized from daily rollups, or hourly ones with granularity=hour.
 func (h *Handler) GetUsage(c *gin.Context) {
-	// TODO: Implement get usage logic with Firebase
-	c.JSON(http.StatusOK, gin.H{
-		"message": "GetUsage endpoint - not implemented yet",
+	logger := h.getLogger(c)
+
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	startDate, endDate, ok := parseDateRange(c, 30)
+	if !ok {
+		return
+	}
+
+	granularity := c.DefaultQuery("granularity", data.RollupDaily)
+	if err := validateUsageGranularity(granularity, startDate, endDate); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	ctx := c.Request.Context()
+	user, err := h.firebaseService.GetUserByID(ctx, userID)
+	if err != nil {
+		logger.Error("Failed to get user", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get usage",
+		})
+		return
+	}
+	rateTime := endDate
+	if now := time.Now(); rateTime.After(now) {
+		rateTime = now
+	}
+	rate, ok := h.exchangeRate(c, user.Currency, rateTime)
+	if !ok {
+		return
+	}
+
+	usage, err := h.firebaseService.GetUserUsage(ctx, userID, granularity, startDate, endDate)
+	if err != nil {
+		logger.Error("Failed to get usage", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get usage",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, UsageResponse{
+		UsageSummary: usage,
+		Currency:     rate,
+		Converted: rate.ConvertAll(map[string]data.MicroUSD{
+			"total_cost":    usage.TotalCost,
+			"total_savings": usage.TotalSavings,
+		}),
+	})
+}
+
+// UsageResponse is a user's usage, with its totals also shown in their display currency
+type UsageResponse struct {
+	*data.UsageSummary
+	Currency  *services.ExchangeRate        `json:"currency"`
+	Converted map[string]data.DisplayAmount `json:"converted"`
+}
+
+// GetSavings handles getting what prompt optimization saved the user: tokens saved, their price
+// before and after the optimizer's cost, per model and over time. The range defaults to the last 30
+// days, trended per day, or per hour with granularity=hour.
+func (h *Handler) GetSavings(c *gin.Context) {
+	logger := h.getLogger(c)
+
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	startDate, endDate, ok := parseDateRange(c, 30)
+	if !ok {
+		return
+	}
+
+	granularity := c.DefaultQuery("granularity", data.RollupDaily)
+	if err := validateUsageGranularity(granularity, startDate, endDate); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	ctx := c.Request.Context()
+	user, err := h.firebaseService.GetUserByID(ctx, userID)
+	if err != nil {
+		logger.Error("Failed to get user", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get savings",
+		})
+		return
+	}
+	rateTime := endDate
+	if now := time.Now(); rateTime.After(now) {
+		rateTime = now
+	}
+	rate, ok := h.exchangeRate(c, user.Currency, rateTime)
+	if !ok {
+		return
+	}
+
+	savings, err := h.firebaseService.GetUserSavings(ctx, userID, granularity, startDate, endDate)
+	if err != nil {
+		logger.Error("Failed to get savings", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get savings",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, SavingsResponse{
+		SavingsSummary: savings,
+		Currency:       rate,
+		Converted: rate.ConvertAll(map[string]data.MicroUSD{
+			"gross_savings":  savings.GrossSavings,
+			"optimizer_cost": savings.OptimizerCost,
+			"net_savings":    savings.NetSavings,
+		}),
 	})
 }
 
+// SavingsResponse is what optimization saved a user, with its totals also shown in their display
+// currency
+type SavingsResponse struct {
+	*data.SavingsSummary
+	Currency  *services.ExchangeRate        `json:"currency"`
+	Converted map[string]data.DisplayAmount `json:"converted"`
+}
+
+// UsageLogEntry is one raw request log returned when drilling down from usage rollups
+type UsageLogEntry struct {
+	ID           string        `json:"id"`
+	RequestID    string        `json:"request_id"`
+	ModelID      string        `json:"model_id"`
+	APIKeyID     string        `json:"api_key_id"`
+	InputTokens  int           `json:"input_tokens"`
+	OutputTokens int           `json:"output_tokens"`
+	TotalTokens  int           `json:"total_tokens"`
+	TotalCost    data.MicroUSD `json:"total_cost"`
+	TokensSaved  int           `json:"tokens_saved"`
+	Savings      data.MicroUSD `json:"savings"`
+	Streaming    bool          `json:"streaming"`
+	Status       string        `json:"status"`
+	DurationMs   int64         `json:"duration_ms"`
+	CreatedAt    time.Time     `json:"created_at"`
+	// UsageEstimated is set when the provider reported no usage and the tokens were estimated
+	UsageEstimated bool `json:"usage_estimated,omitempty"`
+	// CachedInputTokens are the input tokens served from the provider's prompt cache
+	CachedInputTokens int `json:"cached_input_tokens,omitempty"`
+	// ReasoningTokens are the output tokens spent thinking
+	ReasoningTokens int `json:"reasoning_tokens,omitempty"`
+}
+
+// GetUsageLogs handles listing the raw request logs behind the user's usage, newest first.
+// Filter with since, until and model to drill down into a rollup bucket.
+func (h *Handler) GetUsageLogs(c *gin.Context) {
+	logger := h.getLogger(c)
+
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	startDate, endDate, ok := parseDateRange(c, 1)
+	if !ok {
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "limit must be between 1 and 500",
+		})
+		return
+	}
+
+	logs, err := h.firebaseService.ListUserRequestLogs(c.Request.Context(), userID, c.Query("model"), startDate, endDate, limit, c.Query("starting_after"))
+	if err != nil {
+		logger.Error("Failed to list request logs", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to list request logs",
+		})
+		return
+	}
+
+	entries := make([]UsageLogEntry, 0, len(logs))
+	for _, log := range logs {
+		entries = append(entries, UsageLogEntry{
+			ID:           log.ID,
+			RequestID:    log.RequestID,
+			ModelID:      log.ModelID,
+			APIKeyID:     log.APIKeyID,
+			InputTokens:  log.InputTokens,
+			OutputTokens: log.OutputTokens,
+			TotalTokens:  log.TotalTokens,
+			TotalCost:    log.TotalCost,
+			TokensSaved:  log.TokensSaved,
+			Savings:      log.SavingsAmount,
+			Streaming:    log.Streaming,
+			Status:       log.Status,
+			DurationMs:   log.DurationMs,
+			CreatedAt:    log.RequestTimestamp,
+
+			UsageEstimated:    log.UsageEstimated,
+			CachedInputTokens: log.CachedInputTokens,
+			ReasoningTokens:   log.ReasoningTokens,
+		})
+	}
+
+	response := gin.H{
+		"logs":     entries,
+		"has_more": len(entries) == limit,
+	}
+	if len(entries) > 0 {
+		response["next_cursor"] = entries[len(entries)-1].ID
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// GetLedger handles listing the user's balance ledger entries
+func (h *Handler) GetLedger(c *gin.Context) {
+	logger := h.getLogger(c)
+
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "limit must be between 1 and 500",
+		})
+		return
+	}
+
+	entries, err := h.firebaseService.ListLedgerEntries(c.Request.Context(), userID, limit, c.Query("starting_after"))
+	if err != nil {
+		logger.Error("Failed to list ledger entries", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to list ledger entries",
+		})
+		return
+	}
+
+	if entries == nil {
+		entries = []*data.LedgerEntry{}
+	}
+
+	response := gin.H{
+		"entries":  entries,
+		"has_more": len(entries) == limit,
+	}
+	if len(entries) > 0 {
+		response["next_cursor"] = entries[len(entries)-1].ID
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
 // CreateAPIKey handles creating new API keys
 func (h *Handler) CreateAPIKey(c *gin.Context) {
 	// TODO: Implement create API key logic with Firebase
@@ -529,9 +1992,49 @@ func (h *Handler) CreateAPIKey(c *gin.Context) {
 
 // ListAPIKeys handles listing user's API keys
 func (h *Handler) ListAPIKeys(c *gin.Context) {
-	// TODO: Implement list API keys logic with Firebase
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	apiKeys, err := h.firebaseService.ListUserAPIKeys(c.Request.Context(), userID)
+	if err != nil {
+		h.getLogger(c).Error("Failed to list API keys", "error", err, "user_id", userID)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to list API keys",
+		})
+		return
+	}
+
+	// Only hashes of the keys' secrets are stored, and they are never returned
+	keys := make([]gin.H, 0, len(apiKeys))
+	for _, apiKey := range apiKeys {
+		key := gin.H{
+			"id":         apiKey.ID,
+			"name":       apiKey.Name,
+			"status":     apiKey.Status,
+			"org_id":     apiKey.OrgID,
+			"scopes":     apiKey.Scopes,
+			"test_mode":  apiKey.TestMode,
+			"created_at": apiKey.CreatedAt,
+		}
+		if !apiKey.LastUsed.IsZero() {
+			key["last_used"] = apiKey.LastUsed
+		}
+		if !apiKey.RotatedAt.IsZero() {
+			key["rotated_at"] = apiKey.RotatedAt
+		}
+		if !apiKey.ExpiresAt.IsZero() {
+			key["expires_at"] = apiKey.ExpiresAt
+		}
+		keys = append(keys, key)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"message": "ListAPIKeys endpoint - not implemented yet",
+		"keys": keys,
 	})
 }
 
@@ -543,6 +2046,93 @@ func (h *Handler) RevokeAPIKey(c *gin.Context) {
 	})
 }
 
+// RotateAPIKeyRequest optionally shortens how long a rotated key's old secret keeps working
+type RotateAPIKeyRequest struct {
+	GracePeriodSeconds *int `json:"grace_period_seconds,omitempty" binding:"omitempty,min=0"`
+}
+
+// RotateAPIKey handles issuing a new secret for an API key. The key keeps its ID, name, scopes and
+// restrictions, and its old secret keeps working for the grace period so callers can roll the new
+// one out without downtime.
+func (h *Handler) RotateAPIKey(c *gin.Context) {
+	key, ok := h.requireAPIKeyOwner(c)
+	if !ok {
+		return
+	}
+
+	var req RotateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body: " + err.Error(),
+		})
+		return
+	}
+
+	grace := h.config.Security.APIKeyRotationGracePeriod
+	if req.GracePeriodSeconds != nil {
+		requested := time.Duration(*req.GracePeriodSeconds) * time.Second
+		if requested < 0 || requested > grace {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("grace_period_seconds must be between 0 and %d", int(grace.Seconds())),
+			})
+			return
+		}
+		grace = requested
+	}
+
+	rawKey, err := generateAPIKey(key.TestMode)
+	if err != nil {
+		h.getLogger(c).Error("Failed to generate API key", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to rotate API key",
+		})
+		return
+	}
+
+	rotated, err := h.firebaseService.RotateAPIKey(c.Request.Context(), key.ID, h.hashAPIKey(rawKey), grace)
+	if errors.Is(err, data.ErrAPIKeyNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "API key not found",
+		})
+		return
+	}
+	if err != nil {
+		h.getLogger(c).Error("Failed to rotate API key", "error", err, "api_key_id", key.ID)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to rotate API key",
+		})
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditAPIKeyRotated,
+		OrgID:    rotated.OrgID,
+		TargetID: rotated.ID,
+		Details: map[string]interface{}{
+			"grace_period_seconds":    int(grace.Seconds()),
+			"previous_key_expires_at": rotated.PreviousKeyExpiresAt,
+		},
+	})
+
+	// The new raw key is only ever returned once
+	c.JSON(http.StatusOK, gin.H{
+		"id":                      rotated.ID,
+		"name":                    rotated.Name,
+		"org_id":                  rotated.OrgID,
+		"scopes":                  rotated.Scopes,
+		"test_mode":               rotated.TestMode,
+		"key":                     rawKey,
+		"rotated_at":              rotated.RotatedAt,
+		"previous_key_expires_at": rotated.PreviousKeyExpiresAt,
+	})
+}
+
+// RunJobs stands for election to run the scheduled jobs, running them while elected, until ctx is
+// cancelled
+func (h *Handler) RunJobs(ctx context.Context) {
+	h.jobScheduler.Run(ctx)
+}
+
 // convertCachedUserData converts handlers.CachedUserData to services.CachedUserData
 func convertCachedUserData(cachedUser *CachedUserData) *services.CachedUserData {
 	if cachedUser == nil {
@@ -556,5 +2146,7 @@ func convertCachedUserData(cachedUser *CachedUserData) *services.CachedUserData
 		IsActive:      cachedUser.IsActive,
 		CustomPricing: cachedUser.CustomPricing,
 		LastUpdated:   cachedUser.LastUpdated,
+		Credits:       cachedUser.Credits,
+		UserType:      cachedUser.UserType,
 	}
 }
@@ -2,23 +2,53 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"maps"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/grpcapi/aptrouterv1"
 	"github.com/apt-router/api/internal/services"
+	apttesting "github.com/apt-router/api/internal/testing"
 	"github.com/apt-router/api/internal/utils"
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 	"github.com/patrickmn/go-cache"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-// setupTestHandler creates a test handler with mock dependencies
-func setupTestHandler(t *testing.T) *Handler {
+// testSeed is the data setupTestHandler seeds: a funded user, an API key and one model
+var testSeed = services.Seed{
+	"users": {
+		"mock-user-id": {"email": "mock@example.com", "tier_id": "tier-1", "balance_micros": int64(10_000_000), "is_active": true},
+	},
+	"api_keys": {
+		"mock-key-id": {"user_id": "mock-user-id", "key": "valid-api-key", "status": "active", "scopes": []interface{}{"generate"}},
+	},
+	"pricing_tiers": {
+		"tier-1": {"name": "Standard", "input_markup_percent": int64(10), "output_markup_percent": int64(10), "is_active": true},
+	},
+	"model_configurations": {
+		"gpt-3.5-turbo": {"model_id": "gpt-3.5-turbo", "provider": "openai", "input_price_per_million": 0.5, "output_price_per_million": 1.5, "context_window_size": int64(16385), "is_active": true},
+	},
+}
+
+// setupTestHandler creates a test handler backed by an in-memory datastore holding testSeed. Its
+// provider calls are answered by a fake LLM client; tests replace it to script responses.
+func setupTestHandler(t testing.TB) *Handler {
 	// Create test configuration
 	cfg := &utils.Config{
 		Server: utils.ServerConfig{
@@ -46,19 +76,38 @@ func setupTestHandler(t *testing.T) *Handler {
 			Level:  "info",
 			Format: "json",
 		},
+		Privacy: utils.PrivacyConfig{
+			DataExportExpiry:  time.Hour,
+			DeletionRetention: 30 * 24 * time.Hour,
+		},
+		Sessions: utils.SessionsConfig{
+			TTL: 24 * time.Hour,
+		},
+		Reconciliation: utils.ReconciliationConfig{
+			LookbackDays:     7,
+			ThresholdPercent: 5,
+			MinDifferenceUSD: 1,
+		},
+		Currency: utils.CurrencyConfig{
+			Currencies: []string{"EUR", "JPY"},
+		},
 	}
 
-	// Create mock Firebase service
-	firebaseService := &data.Service{}
+	// Create in-memory Firebase service
+	firebaseService := apttesting.NewDatastore(t)
+	apttesting.ApplySeed(t, firebaseService, cfg.Security.APIKeySalt, testSeed)
 
 	// Create memory cache
 	memoryCache := cache.New(5*time.Minute, 10*time.Minute)
 
 	// Create pricing service
-	pricingService := services.NewPricingService(firebaseService)
+	sharedCache := services.NewSharedCache(memoryCache, firebaseService, false)
+	pricingService := services.NewPricingService(firebaseService, sharedCache, services.NewAuditService(firebaseService))
+	require.NoError(t, pricingService.PreCacheData(context.Background()))
 
 	// Create handler
-	handler := NewHandler(cfg, firebaseService, memoryCache, pricingService)
+	handler := NewHandler(cfg, firebaseService, sharedCache, pricingService)
+	handler.generationService.SetClientFactory(apttesting.NewLLMClient().Factory())
 
 	return handler
 }
@@ -72,8 +121,10 @@ func setupTestRouter(handler *Handler) *gin.Engine {
 
 	// Register routes
 	router.GET("/healthz", handler.HealthCheck)
+	router.GET("/readyz", handler.ReadinessCheck)
 
 	v1 := router.Group("/v1")
+	v1.Use(handler.APIVersionMiddleware(APIVersionV1))
 	{
 		generate := v1.Group("/generate")
 		generate.Use(handler.AuthMiddleware())
@@ -81,21 +132,50 @@ func setupTestRouter(handler *Handler) *gin.Engine {
 			generate.POST("", handler.Generate)
 			generate.POST("/stream", handler.GenerateStream)
 		}
+		v1.POST("/estimate", handler.AuthMiddleware(data.ScopeGenerate), handler.Estimate)
 
 		user := v1.Group("/user")
-		user.Use(handler.JWTAuthMiddleware())
+		user.Use(handler.UserViewAuthMiddleware())
 		{
 			user.GET("/profile", handler.GetProfile)
 			user.GET("/balance", handler.GetBalance)
 			user.GET("/usage", handler.GetUsage)
+			user.GET("/usage/logs", handler.GetUsageLogs)
+			user.GET("/savings", handler.GetSavings)
+			user.POST("/referral-code/redeem", handler.RedeemReferralCode)
+			user.POST("/data-export", handler.RequestDataExport)
+			user.GET("/data-export/:export_id", handler.GetDataExport)
+			user.GET("/data-export/:export_id/download", handler.DownloadDataExport)
+			user.POST("/delete", handler.DeleteAccount)
 		}
 
 		keys := v1.Group("/keys")
-		keys.Use(handler.JWTAuthMiddleware())
+		keys.Use(handler.UserViewAuthMiddleware())
 		{
 			keys.POST("", handler.CreateAPIKey)
 			keys.GET("", handler.ListAPIKeys)
 			keys.DELETE(":key_id", handler.RevokeAPIKey)
+			keys.POST(":key_id/rotate", handler.RotateAPIKey)
+		}
+
+		sessions := v1.Group("/sessions")
+		sessions.Use(handler.AuthMiddleware(data.ScopeGenerate))
+		{
+			sessions.POST("", handler.CreateSession)
+			sessions.GET("/:session_id", handler.GetSession)
+			sessions.DELETE("/:session_id", handler.DeleteSession)
+			sessions.POST("/:session_id/messages", handler.SendSessionMessage)
+		}
+	}
+
+	v2 := router.Group("/v2")
+	v2.Use(handler.APIVersionMiddleware(APIVersionV2))
+	{
+		generate := v2.Group("/generate")
+		generate.Use(handler.AuthMiddleware())
+		{
+			generate.POST("", handler.Generate)
+			generate.POST("/stream", handler.GenerateStream)
 		}
 	}
 
@@ -128,10 +208,47 @@ func TestHealthCheck(t *testing.T) {
 	assert.Equal(t, "1.0.0", response["version"])
 }
 
+func TestReadinessCheck(t *testing.T) {
+	handler := setupTestHandler(t)
+
+	readyz := func(handler *Handler) (int, string, map[string]DependencyStatus) {
+		req, err := http.NewRequest("GET", "/readyz", nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		setupTestRouter(handler).ServeHTTP(w, req)
+
+		var response struct {
+			Status string                      `json:"status"`
+			Checks map[string]DependencyStatus `json:"checks"`
+		}
+		err = json.Unmarshal(w.Body.Bytes(), &response)
+		require.NoError(t, err)
+		return w.Code, response.Status, response.Checks
+	}
+
+	code, status, checks := readyz(handler)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ready", status)
+	assert.Equal(t, "ok", checks["firestore"].Status)
+
+	// Without a Firestore client, a critical dependency, the service is unavailable
+	code, status, checks = readyz(NewHandler(handler.config, &data.Service{}, handler.cache, handler.pricingService))
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unavailable", status)
+	assert.Equal(t, "down", checks["firestore"].Status)
+	assert.Equal(t, "ok", checks["providers"].Status)
+	assert.Contains(t, checks, "pricing")
+	assert.Contains(t, checks, "optimizer")
+}
+
 func TestGenerateEndpoint(t *testing.T) {
 	handler := setupTestHandler(t)
 	router := setupTestRouter(handler)
 
+	llm := apttesting.NewLLMClient(apttesting.Response{Text: "Hi there!", InputTokens: 1000, OutputTokens: 2000})
+	handler.generationService.SetClientFactory(llm.Factory())
+
 	// Create request body
 	requestBody := GenerateRequest{
 		Model:  "gpt-3.5-turbo",
@@ -144,24 +261,159 @@ func TestGenerateEndpoint(t *testing.T) {
 	req, err := http.NewRequest("POST", "/v1/generate", bytes.NewBuffer(bodyBytes))
 	require.NoError(t, err)
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer test-api-key")
+	req.Header.Set("Authorization", "Bearer valid-api-key")
 
 	// Create response recorder
 	w := httptest.NewRecorder()
 
 	// Serve request
 	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var response map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "Hi there!", response["text"])
+
+	// The request is routed to the model's provider with the platform key
+	calls := llm.Calls()
+	require.Len(t, calls, 1)
+	assert.Equal(t, "gpt-3.5-turbo", calls[0].ModelID)
+	assert.Equal(t, "openai", calls[0].Provider)
+	assert.Equal(t, "test-openai-key", calls[0].APIKey)
+	assert.Equal(t, "Hello, world!", calls[0].Params["prompt"])
+
+	// The provider's usage is billed at the model's prices plus the tier's 10% markup
+	user, err := handler.firebaseService.GetUserByID(context.Background(), "mock-user-id")
+	require.NoError(t, err)
+	assert.Equal(t, data.MicroUSD(10_000_000-3850), user.Balance)
+
+	// The response itemizes what was charged
+	var itemized GenerateResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &itemized))
+	assert.Equal(t, &CostInfo{BaseInput: 500, BaseOutput: 3000, Markup: 350, Total: 3850, Currency: "USD"}, itemized.CostInfo)
+
+	generate := func(t *testing.T, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/v1/generate", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer valid-api-key")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
 
-	// Note: This will likely fail due to missing API keys, but we're testing the endpoint structure
-	// In a real test environment, you'd mock the LLM clients
-	t.Logf("Response status: %d", w.Code)
-	t.Logf("Response body: %s", w.Body.String())
+	t.Run("Logprobs", func(t *testing.T) {
+		logprobs := []data.TokenLogprob{{Token: "Hi", Logprob: -0.1, TopLogprobs: []data.TopLogprob{{Token: "Hi", Logprob: -0.1}, {Token: "Hello", Logprob: -2.3}}}}
+		llm.Queue(apttesting.Response{Text: "Hi", InputTokens: 10, OutputTokens: 1, Logprobs: logprobs})
+
+		w := generate(t, `{"model": "gpt-3.5-turbo", "prompt": "Hello", "logprobs": true, "top_logprobs": 2}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var response GenerateResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, logprobs, response.Logprobs)
+
+		calls := llm.Calls()
+		assert.Equal(t, true, calls[len(calls)-1].Params["logprobs"])
+		assert.Equal(t, 2, calls[len(calls)-1].Params["top_logprobs"])
+	})
+
+	t.Run("TopLogprobsRequiresLogprobs", func(t *testing.T) {
+		w := generate(t, `{"model": "gpt-3.5-turbo", "prompt": "Hello", "top_logprobs": 2}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("CachedInputTokens", func(t *testing.T) {
+		before, err := handler.firebaseService.GetUserByID(context.Background(), "mock-user-id")
+		require.NoError(t, err)
+
+		llm.Queue(apttesting.Response{Text: "Hi", InputTokens: 1000, OutputTokens: 2000, Details: data.TokenDetails{CacheReadTokens: 1000}})
+		w := generate(t, `{"model": "gpt-3.5-turbo", "prompt": "Hello", "cache_control": {"type": "ephemeral"}}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var response GenerateResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		require.NotNil(t, response.Usage)
+		assert.Equal(t, 1000, response.Usage.CachedInputTokens)
+
+		calls := llm.Calls()
+		assert.Equal(t, true, calls[len(calls)-1].Params["cache_prompt"])
+
+		// OpenAI serves cached input at half the input price, so the input costs 250 rather than 500
+		after, err := handler.firebaseService.GetUserByID(context.Background(), "mock-user-id")
+		require.NoError(t, err)
+		assert.Equal(t, data.MicroUSD(3575), before.Balance-after.Balance)
+	})
+
+	t.Run("InvalidCacheControl", func(t *testing.T) {
+		w := generate(t, `{"model": "gpt-3.5-turbo", "prompt": "Hello", "cache_control": {"type": "persistent"}}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("ReasoningTokens", func(t *testing.T) {
+		llm.Queue(apttesting.Response{Text: "42", InputTokens: 10, OutputTokens: 500, Details: data.TokenDetails{ReasoningTokens: 400}})
+		w := generate(t, `{"model": "gpt-3.5-turbo", "prompt": "Think", "reasoning_effort": "high"}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var response GenerateResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		require.NotNil(t, response.Usage)
+		assert.Equal(t, 400, response.Usage.ReasoningTokens)
+
+		calls := llm.Calls()
+		assert.Equal(t, "high", calls[len(calls)-1].Params["reasoning_effort"])
+	})
+
+	t.Run("InvalidReasoningEffort", func(t *testing.T) {
+		w := generate(t, `{"model": "gpt-3.5-turbo", "prompt": "Hello", "reasoning_effort": "maximum"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("PromptLimits", func(t *testing.T) {
+		handler.config.Server.MaxPromptBytes = 64
+		defer func() { handler.config.Server.MaxPromptBytes = 0 }()
+
+		w := generate(t, `{"model": "gpt-3.5-turbo", "prompt": "`+strings.Repeat("a", 65)+`"}`)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		assert.Contains(t, w.Body.String(), `"code":"prompt_too_large"`)
+	})
+
+	t.Run("ProviderFailure", func(t *testing.T) {
+		handler.config.Timeouts = utils.TimeoutConfig{Provider: 10 * time.Second, Streaming: 10 * time.Second, MaxRequest: time.Minute}
+		ctx := context.Background()
+		before, err := handler.firebaseService.GetUserByID(ctx, "mock-user-id")
+		require.NoError(t, err)
+
+		llm.Queue(apttesting.Response{Err: &data.ProviderError{Provider: "openai", StatusCode: http.StatusBadGateway, ErrorCode: "server_error", Message: "upstream unavailable"}})
+		w := generate(t, `{"model": "gpt-3.5-turbo", "prompt": "Hello"}`)
+		require.Equal(t, http.StatusInternalServerError, w.Code, w.Body.String())
+
+		// The failure is logged at zero cost with the provider's error
+		logs, err := handler.firebaseService.ListRecentRequestLogs(ctx, "mock-user-id", time.Now().Add(-time.Hour), 1)
+		require.NoError(t, err)
+		require.Len(t, logs, 1)
+		assert.Equal(t, data.RequestStatusError, logs[0].Status)
+		assert.Equal(t, data.MicroUSD(0), logs[0].TotalCost)
+		require.NotNil(t, logs[0].ErrorDetail)
+		assert.Equal(t, &data.ErrorDetail{Code: "server_error", StatusCode: http.StatusBadGateway, Provider: "openai"}, logs[0].ErrorDetail)
+
+		after, err := handler.firebaseService.GetUserByID(ctx, "mock-user-id")
+		require.NoError(t, err)
+		assert.Equal(t, before.Balance, after.Balance)
+
+		usage, err := handler.firebaseService.GetUserUsage(ctx, "mock-user-id", "day", time.Now().Add(-24*time.Hour), time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, 1, usage.FailedRequests)
+	})
 }
 
 func TestGenerateStreamEndpoint(t *testing.T) {
 	handler := setupTestHandler(t)
 	router := setupTestRouter(handler)
 
+	llm := apttesting.NewLLMClient(apttesting.Response{Text: "Hi there, streamed!", InputTokens: 1000, OutputTokens: 2000})
+	handler.generationService.SetClientFactory(llm.Factory())
+
 	// Create request body
 	requestBody := GenerateRequest{
 		Model:  "gpt-3.5-turbo",
@@ -170,202 +422,2657 @@ func TestGenerateStreamEndpoint(t *testing.T) {
 	bodyBytes, err := json.Marshal(requestBody)
 	require.NoError(t, err)
 
+	// Streaming needs a real connection, which a response recorder does not provide
+	server := httptest.NewServer(router)
+	defer server.Close()
+
 	// Create request
-	req, err := http.NewRequest("POST", "/v1/generate/stream", bytes.NewBuffer(bodyBytes))
+	req, err := http.NewRequest("POST", server.URL+"/v1/generate/stream", bytes.NewBuffer(bodyBytes))
 	require.NoError(t, err)
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer test-api-key")
-
-	// Create response recorder
-	w := httptest.NewRecorder()
+	req.Header.Set("Authorization", "Bearer valid-api-key")
 
-	// Serve request
-	router.ServeHTTP(w, req)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	assert.Contains(t, string(body), "streamed!")
+
+	// The stream ends with its usage, which repeats the cost and finish reason
+	events := strings.Split(strings.TrimSpace(string(body)), "\n\n")
+	last := events[len(events)-1]
+	require.True(t, strings.HasPrefix(last, "event: usage\ndata: "), last)
+	var usageEvent streamUsageEvent
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(last, "event: usage\ndata: ")), &usageEvent))
+	assert.Equal(t, &UsageInfo{InputTokens: 1000, OutputTokens: 2000, TotalTokens: 3000}, usageEvent.Usage)
+	assert.Equal(t, &SavingsInfo{}, usageEvent.Savings)
+	assert.Equal(t, data.FinishReasonStop, usageEvent.FinishReason)
+
+	// It is preceded by an event itemizing what the stream was charged
+	cost := events[len(events)-2]
+	require.True(t, strings.HasPrefix(cost, "event: cost\ndata: "), cost)
+	var costEvent struct {
+		Cost CostInfo `json:"cost"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(cost, "event: cost\ndata: ")), &costEvent))
+	assert.Equal(t, CostInfo{BaseInput: 500, BaseOutput: 3000, Markup: 350, Total: 3850, Currency: "USD"}, costEvent.Cost)
+	assert.Equal(t, &costEvent.Cost, usageEvent.Cost)
+
+	// And before that by the stream's timing
+	timing := events[len(events)-3]
+	require.True(t, strings.HasPrefix(timing, "event: timing\ndata: "), timing)
+	var timingEvent struct {
+		Timing *TimingInfo `json:"timing"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(timing, "event: timing\ndata: ")), &timingEvent))
+	require.NotNil(t, timingEvent.Timing)
+	assert.GreaterOrEqual(t, timingEvent.Timing.DurationMs, timingEvent.Timing.TimeToFirstTokenMs)
+
+	calls := llm.Calls()
+	require.Len(t, calls, 1)
+	assert.True(t, calls[0].Stream)
+
+	// Usage reported at the end of the stream is billed once the handler closes the stream
+	ctx := context.Background()
+	assert.Eventually(t, func() bool {
+		user, err := handler.firebaseService.GetUserByID(ctx, "mock-user-id")
+		return err == nil && user.Balance == data.MicroUSD(10_000_000-3850)
+	}, time.Second, 10*time.Millisecond)
+
+	stream := func(t *testing.T) {
+		req, err := http.NewRequest("POST", server.URL+"/v1/generate/stream", bytes.NewBuffer(bodyBytes))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer valid-api-key")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_, err = io.Copy(io.Discard, resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	// latestLog waits for the nth request log and returns the newest
+	latestLog := func(t *testing.T, n int) *data.RequestLog {
+		var logs []*data.RequestLog
+		require.Eventually(t, func() bool {
+			var err error
+			logs, err = handler.firebaseService.ListUserRequestLogs(ctx, "mock-user-id", "", time.Time{}, time.Now().Add(time.Minute), 10, "")
+			return err == nil && len(logs) == n
+		}, time.Second, 10*time.Millisecond)
+		return logs[0]
+	}
 
-	// Note: This will likely fail due to missing API keys, but we're testing the endpoint structure
-	// In a real test environment, you'd mock the LLM clients
-	t.Logf("Response status: %d", w.Code)
-	t.Logf("Response body: %s", w.Body.String())
+	t.Run("MissingUsageIsEstimated", func(t *testing.T) {
+		llm.Queue(apttesting.Response{Text: "No usage here"})
+		stream(t)
+
+		log := latestLog(t, 2)
+		assert.True(t, log.UsageEstimated, "the stream without usage is flagged")
+		assert.Equal(t, services.EstimatorCL100K.Count("Hello, world!"), log.InputTokens)
+		assert.Equal(t, services.EstimatorCL100K.Count("No usage here"), log.OutputTokens)
+		assert.Positive(t, log.TotalCost)
+	})
+
+	t.Run("MissingUsageNotBilledWhenDisabled", func(t *testing.T) {
+		handler.config.Cost.MissingUsageMode = "none"
+		llm.Queue(apttesting.Response{Text: "No usage here"})
+		stream(t)
+
+		log := latestLog(t, 3)
+		assert.False(t, log.UsageEstimated)
+		assert.Zero(t, log.TotalCost)
+	})
 }
 
-func TestUserEndpoints(t *testing.T) {
+func TestStreamUsageEventMatchesResponse(t *testing.T) {
 	handler := setupTestHandler(t)
+	handler.config.Timeouts = utils.TimeoutConfig{Provider: 10 * time.Second, Streaming: 10 * time.Second, MaxRequest: time.Minute}
 	router := setupTestRouter(handler)
 
-	testCases := []struct {
-		name     string
-		method   string
-		endpoint string
-	}{
-		{"GetProfile", "GET", "/v1/user/profile"},
-		{"GetBalance", "GET", "/v1/user/balance"},
-		{"GetUsage", "GET", "/v1/user/usage"},
+	response := apttesting.Response{
+		Text: "Hi there!", InputTokens: 1000, OutputTokens: 2000, FinishReason: "max_tokens",
+		Details: data.TokenDetails{CacheReadTokens: 200, ReasoningTokens: 500},
+	}
+	llm := apttesting.NewLLMClient(response, response, response)
+	handler.generationService.SetClientFactory(llm.Factory())
+
+	// Streaming needs a real connection, which a response recorder does not provide
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	post := func(t *testing.T, path string) []byte {
+		req, err := http.NewRequest(http.MethodPost, server.URL+path, strings.NewReader(`{"model": "gpt-3.5-turbo", "prompt": "Hello, world!"}`))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer valid-api-key")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+		return body
 	}
 
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			req, err := http.NewRequest(tc.method, tc.endpoint, nil)
-			require.NoError(t, err)
-
-			w := httptest.NewRecorder()
-			router.ServeHTTP(w, req)
-
-			assert.Equal(t, http.StatusOK, w.Code)
-
-			var response map[string]interface{}
-			err = json.Unmarshal(w.Body.Bytes(), &response)
-			require.NoError(t, err)
-
-			assert.Contains(t, response, "message")
+	var generated GenerateResponse
+	require.NoError(t, json.Unmarshal(post(t, "/v1/generate"), &generated))
+	want := UsageInfo{InputTokens: 1000, OutputTokens: 2000, TotalTokens: 3000, CachedInputTokens: 200, ReasoningTokens: 500}
+	require.NotNil(t, generated.Usage)
+	assert.Equal(t, want, *generated.Usage)
+	require.NotNil(t, generated.CostInfo)
+	assert.Positive(t, generated.CostInfo.Total)
+	assert.Equal(t, data.FinishReasonLength, generated.FinishReason)
+
+	// Both SSE formats end with a usage event holding the accounting the response above carries
+	for _, format := range []string{StreamFormatSSE, StreamFormatSSEJSON} {
+		t.Run(format, func(t *testing.T) {
+			events := strings.Split(strings.TrimSpace(string(post(t, "/v1/generate/stream?stream_format="+format))), "\n\n")
+			last := events[len(events)-1]
+			require.True(t, strings.HasPrefix(last, "event: usage\ndata: "), last)
+
+			var fields map[string]json.RawMessage
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(last, "event: usage\ndata: ")), &fields))
+			assert.ElementsMatch(t, []string{"usage", "cost", "savings", "finish_reason"}, slices.Collect(maps.Keys(fields)))
+
+			var event streamUsageEvent
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(last, "event: usage\ndata: ")), &event))
+			assert.Equal(t, generated.Usage, event.Usage)
+			assert.Equal(t, generated.CostInfo, event.Cost)
+			assert.Equal(t, generated.FinishReason, event.FinishReason)
+
+			// Savings are reported as the response's metadata reports them
+			require.NotNil(t, event.Savings)
+			assert.Equal(t, generated.Metadata["input_tokens_saved"], float64(event.Savings.InputTokensSaved))
+			assert.Equal(t, generated.Metadata["output_tokens_saved"], float64(event.Savings.OutputTokensSaved))
+			assert.Equal(t, generated.Metadata["total_tokens_saved"], float64(event.Savings.TotalTokensSaved))
 		})
 	}
 }
 
-func TestAPIKeyEndpoints(t *testing.T) {
+func TestGenerateStreamReadError(t *testing.T) {
 	handler := setupTestHandler(t)
 	router := setupTestRouter(handler)
 
-	testCases := []struct {
-		name     string
-		method   string
-		endpoint string
-	}{
-		{"CreateAPIKey", "POST", "/v1/keys"},
-		{"ListAPIKeys", "GET", "/v1/keys"},
-		{"RevokeAPIKey", "DELETE", "/v1/keys/test-key-id"},
-	}
-
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			req, err := http.NewRequest(tc.method, tc.endpoint, nil)
-			require.NoError(t, err)
+	handler.config.Timeouts = utils.TimeoutConfig{Provider: 10 * time.Second, Streaming: 10 * time.Second, MaxRequest: time.Minute}
+	llm := apttesting.NewLLMClient(apttesting.Response{Text: "Partial answer", StreamErr: errors.New("connection reset by provider")})
+	handler.generationService.SetClientFactory(llm.Factory())
 
-			w := httptest.NewRecorder()
-			router.ServeHTTP(w, req)
+	bodyBytes, err := json.Marshal(GenerateRequest{Model: "gpt-3.5-turbo", Prompt: "Hello, world!"})
+	require.NoError(t, err)
 
-			assert.Equal(t, http.StatusOK, w.Code)
+	server := httptest.NewServer(router)
+	defer server.Close()
 
-			var response map[string]interface{}
-			err = json.Unmarshal(w.Body.Bytes(), &response)
-			require.NoError(t, err)
+	req, err := http.NewRequest("POST", server.URL+"/v1/generate/stream", bytes.NewBuffer(bodyBytes))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer valid-api-key")
 
-			assert.Contains(t, response, "message")
-		})
-	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+
+	// A stream the provider breaks off ends with an error event, not as if it had finished
+	events := strings.Split(strings.TrimSpace(string(body)), "\n\n")
+	last := events[len(events)-1]
+	require.True(t, strings.HasPrefix(last, "event: error\ndata: "), last)
+	assert.Contains(t, last, "connection reset by provider")
+	assert.NotContains(t, string(body), "event: usage")
 }
 
-func TestAuthMiddleware(t *testing.T) {
+func TestGenerateStreamOutputCap(t *testing.T) {
 	handler := setupTestHandler(t)
+	handler.config.Timeouts = utils.TimeoutConfig{Provider: 10 * time.Second, Streaming: 10 * time.Second, MaxRequest: time.Minute}
+	apttesting.ApplySeed(t, handler.firebaseService, "test-salt", services.Seed{
+		"pricing_tiers": {
+			"tier-1": {"name": "Standard", "input_markup_percent": int64(10), "output_markup_percent": int64(10), "is_active": true, "max_stream_output_bytes": int64(12)},
+		},
+	})
+	server := httptest.NewServer(setupTestRouter(handler))
+	defer server.Close()
 
-	// Test with valid API key
-	req, err := http.NewRequest("GET", "/test", nil)
+	llm := apttesting.NewLLMClient(apttesting.Response{Text: "Hello there, this goes on and on", InputTokens: 1000, OutputTokens: 2000})
+	handler.generationService.SetClientFactory(llm.Factory())
+
+	bodyBytes, err := json.Marshal(GenerateRequest{Model: "gpt-3.5-turbo", Prompt: "Hello, world!"})
 	require.NoError(t, err)
+	req, err := http.NewRequest("POST", server.URL+"/v1/generate/stream", bytes.NewBuffer(bodyBytes))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer valid-api-key")
 
-	c, _ := gin.CreateTestContext(httptest.NewRecorder())
-	c.Request = req
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+
+	// The stream stops at the tier's cap and says why before its timing, cost and usage
+	var text strings.Builder
+	var events []string
+	for _, event := range strings.Split(strings.TrimSpace(string(body)), "\n\n") {
+		if data, ok := strings.CutPrefix(event, "data: "); ok {
+			text.WriteString(data)
+			continue
+		}
+		events = append(events, event)
+	}
+	assert.Equal(t, "Hello there,", text.String())
+	require.Len(t, events, 4)
+	assert.Equal(t, `event: finish`+"\n"+`data: {"finish_reason":"length_capped"}`, events[0])
+	var usageEvent streamUsageEvent
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(events[3], "event: usage\ndata: ")), &usageEvent))
+	assert.True(t, usageEvent.Usage.Estimated, "capped output is billed as estimated")
+	assert.Equal(t, services.FinishReasonLengthCapped, usageEvent.FinishReason)
+
+	// Only the output that was sent is billed
+	ctx := context.Background()
+	var logs []*data.RequestLog
+	require.Eventually(t, func() bool {
+		logs, err = handler.firebaseService.ListUserRequestLogs(ctx, "mock-user-id", "", time.Time{}, time.Now().Add(time.Minute), 10, "")
+		return err == nil && len(logs) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1000, logs[0].InputTokens)
+	assert.Equal(t, services.EstimatorCL100K.Count("Hello there,"), logs[0].OutputTokens)
+	assert.Equal(t, logs[0].OutputTokens, usageEvent.Usage.OutputTokens)
+	assert.Equal(t, services.FinishReasonLengthCapped, logs[0].Metadata["finish_reason"])
+}
 
-	// Call middleware
-	handler.AuthMiddleware()(c)
+func TestStreamFormats(t *testing.T) {
+	handler := setupTestHandler(t)
+	server := httptest.NewServer(setupTestRouter(handler))
+	defer server.Close()
 
-	// Verify request context was set
-	requestCtx, exists := handler.getRequestContext(c)
-	assert.True(t, exists)
-	assert.NotNil(t, requestCtx)
-	assert.Equal(t, "mock-user-id", requestCtx.UserID)
+	llm := apttesting.NewLLMClient()
+	handler.generationService.SetClientFactory(llm.Factory())
+
+	bodyBytes, err := json.Marshal(GenerateRequest{Model: "gpt-3.5-turbo", Prompt: "Hello, world!"})
+	require.NoError(t, err)
+	stream := func(t *testing.T, query, accept string) (*http.Response, string) {
+		llm.Queue(apttesting.Response{Text: "Two\nlines", InputTokens: 1000, OutputTokens: 2000})
+		req, err := http.NewRequest("POST", server.URL+"/v1/generate/stream"+query, bytes.NewBuffer(bodyBytes))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer valid-api-key")
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	t.Run("Text", func(t *testing.T) {
+		resp, body := stream(t, "", "text/plain")
+		require.Equal(t, http.StatusOK, resp.StatusCode, body)
+		assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "Two\nlines", body)
+	})
+
+	t.Run("SSEJSON", func(t *testing.T) {
+		resp, body := stream(t, "", "text/event-stream; format=json")
+		require.Equal(t, http.StatusOK, resp.StatusCode, body)
+		events := strings.Split(strings.TrimSpace(body), "\n\n")
+		var text strings.Builder
+		for _, event := range events {
+			if payload, ok := strings.CutPrefix(event, "data: "); ok {
+				var chunk struct {
+					Text string `json:"text"`
+				}
+				require.NoError(t, json.Unmarshal([]byte(payload), &chunk))
+				text.WriteString(chunk.Text)
+			}
+		}
+		assert.Equal(t, "Two\nlines", text.String())
+		assert.True(t, strings.HasPrefix(events[len(events)-1], "event: usage\ndata: "))
+	})
+
+	t.Run("OpenAI", func(t *testing.T) {
+		resp, body := stream(t, "?stream_format=openai", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode, body)
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+		events := strings.Split(strings.TrimSpace(body), "\n\n")
+		require.Equal(t, "data: [DONE]", events[len(events)-1])
+
+		var text strings.Builder
+		var last openAIChunk
+		for i, event := range events[:len(events)-1] {
+			last = openAIChunk{}
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(event, "data: ")), &last))
+			assert.Equal(t, "chat.completion.chunk", last.Object)
+			assert.Equal(t, "gpt-3.5-turbo", last.Model)
+			if i == 0 {
+				assert.Equal(t, "assistant", last.Choices[0].Delta.Role)
+			}
+			text.WriteString(last.Choices[0].Delta.Content)
+		}
+		assert.Equal(t, "Two\nlines", text.String())
+		require.NotNil(t, last.Choices[0].FinishReason)
+		assert.Equal(t, "stop", *last.Choices[0].FinishReason)
+		require.NotNil(t, last.Cost)
+		assert.Equal(t, data.MicroUSD(3850), last.Cost.Total)
+		assert.Equal(t, &openAIUsage{PromptTokens: 1000, CompletionTokens: 2000, TotalTokens: 3000}, last.Usage)
+	})
+
+	t.Run("UnknownFormat", func(t *testing.T) {
+		resp, body := stream(t, "?stream_format=xml", "")
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, body)
+		assert.Contains(t, body, "unknown stream_format")
+	})
 }
 
-func TestRequestLogger(t *testing.T) {
+func TestFinishReason(t *testing.T) {
 	handler := setupTestHandler(t)
+	server := httptest.NewServer(setupTestRouter(handler))
+	defer server.Close()
 
-	req, err := http.NewRequest("GET", "/test", nil)
-	require.NoError(t, err)
+	llm := apttesting.NewLLMClient()
+	handler.generationService.SetClientFactory(llm.Factory())
 
-	w := httptest.NewRecorder()
-	c, _ := gin.CreateTestContext(w)
-	c.Request = req
+	bodyBytes, err := json.Marshal(GenerateRequest{Model: "gpt-3.5-turbo", Prompt: "Hello, world!"})
+	require.NoError(t, err)
+	post := func(t *testing.T, path string) string {
+		req, err := http.NewRequest("POST", server.URL+path, bytes.NewBuffer(bodyBytes))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer valid-api-key")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+		return string(body)
+	}
 
-	// Call middleware
-	handler.RequestLogger()(c)
+	// Each provider's reasons are reported as the normalized ones
+	for _, tc := range []struct{ provider, normalized string }{
+		{"end_turn", data.FinishReasonStop},
+		{"MAX_TOKENS", data.FinishReasonLength},
+		{"refusal", data.FinishReasonContentFilter},
+		{"tool_calls", data.FinishReasonToolCalls},
+		{"OTHER", data.FinishReasonOther},
+	} {
+		t.Run(tc.provider, func(t *testing.T) {
+			llm.Queue(apttesting.Response{Text: "Hi there!", InputTokens: 1000, OutputTokens: 2000, FinishReason: tc.provider})
+			var response GenerateResponse
+			require.NoError(t, json.Unmarshal([]byte(post(t, "/v1/generate")), &response))
+			assert.Equal(t, tc.normalized, response.FinishReason)
+		})
+	}
 
-	// Verify logger was set in context
-	logger := handler.getLogger(c)
-	assert.NotNil(t, logger)
+	t.Run("Stream", func(t *testing.T) {
+		llm.Queue(apttesting.Response{Text: "Hi there!", InputTokens: 1000, OutputTokens: 2000, FinishReason: "max_tokens"})
+		events := strings.Split(strings.TrimSpace(post(t, "/v1/generate/stream")), "\n\n")
+		require.GreaterOrEqual(t, len(events), 4)
+		assert.Equal(t, `event: finish`+"\n"+`data: {"finish_reason":"length"}`, events[len(events)-4])
+
+		llm.Queue(apttesting.Response{Text: "Hi there!", InputTokens: 1000, OutputTokens: 2000, FinishReason: "SAFETY"})
+		events = strings.Split(strings.TrimSpace(post(t, "/v1/generate/stream?stream_format=openai")), "\n\n")
+		require.GreaterOrEqual(t, len(events), 2)
+		var final openAIChunk
+		require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(events[len(events)-2], "data: ")), &final))
+		require.NotNil(t, final.Choices[0].FinishReason)
+		assert.Equal(t, data.FinishReasonContentFilter, *final.Choices[0].FinishReason)
+	})
 }
 
-func TestHelperFunctions(t *testing.T) {
+func TestAPIVersioning(t *testing.T) {
 	handler := setupTestHandler(t)
+	handler.config.Server.PromptSunset = "2027-06-30"
+	router := setupTestRouter(handler)
 
-	// Test getIntValue
-	intPtr := 42
-	assert.Equal(t, 42, handler.getIntValue(&intPtr, 0))
-	assert.Equal(t, 0, handler.getIntValue(nil, 0))
+	llm := apttesting.NewLLMClient()
+	handler.generationService.SetClientFactory(llm.Factory())
 
-	// Test getFloatValue
-	floatPtr := 3.14
-	assert.Equal(t, 3.14, handler.getFloatValue(&floatPtr, 0.0))
-	assert.Equal(t, 0.0, handler.getFloatValue(nil, 0.0))
+	generate := func(t *testing.T, path, body string, header http.Header) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		require.NoError(t, err)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer valid-api-key")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
 
-	// Test getBoolValue
-	boolPtr := true
-	assert.Equal(t, true, handler.getBoolValue(&boolPtr, false))
-	assert.Equal(t, false, handler.getBoolValue(nil, false))
+	t.Run("V1PromptIsDeprecated", func(t *testing.T) {
+		llm.Queue(apttesting.Response{Text: "Hi", InputTokens: 10, OutputTokens: 1})
+		w := generate(t, "/v1/generate", `{"model": "gpt-3.5-turbo", "prompt": "Hello"}`, nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, "v1", w.Header().Get("X-API-Version"))
+		assert.Equal(t, "@1792108800", w.Header().Get("Deprecation"))
+		assert.Equal(t, "Wed, 30 Jun 2027 00:00:00 GMT", w.Header().Get("Sunset"))
+		assert.Equal(t, `</v2/generate>; rel="successor-version"`, w.Header().Get("Link"))
+	})
+
+	t.Run("V2Messages", func(t *testing.T) {
+		llm.Queue(apttesting.Response{Text: "Paris", InputTokens: 10, OutputTokens: 1})
+		w := generate(t, "/v2/generate", `{"model": "gpt-3.5-turbo", "messages": [
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": "Capital of France?"}
+		]}`, nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, "v2", w.Header().Get("X-API-Version"))
+		assert.Empty(t, w.Header().Get("Deprecation"))
+
+		var response GenerateResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, "Paris", response.Text)
+
+		calls := llm.Calls()
+		assert.Equal(t, "Capital of France?", calls[len(calls)-1].Params["prompt"])
+		assert.Equal(t, "Be brief.", calls[len(calls)-1].Params["system"])
+	})
+
+	t.Run("V2RejectsPrompt", func(t *testing.T) {
+		w := generate(t, "/v2/generate", `{"model": "gpt-3.5-turbo", "prompt": "Hello"}`, nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = generate(t, "/v2/generate", `{"model": "gpt-3.5-turbo", "messages": [{"role": "assistant", "content": "Hi"}]}`, nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("VersionMismatch", func(t *testing.T) {
+		w := generate(t, "/v1/generate", `{"model": "gpt-3.5-turbo", "prompt": "Hello"}`, http.Header{"X-Api-Version": {"v2"}})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "use the /v2 path")
+
+		w = generate(t, "/v2/generate", `{"model": "gpt-3.5-turbo", "prompt": "Hello"}`, http.Header{"X-Api-Version": {"v3"}})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "unsupported API version")
+	})
 }
 
-func TestRequestContext(t *testing.T) {
-	handler := setupTestHandler(t)
+func TestDevModeGenerate(t *testing.T) {
+	cfg := &utils.Config{
+		Server:   utils.ServerConfig{Port: 8080, Env: "test"},
+		Cache:    utils.CacheConfig{DefaultExpiration: 5 * time.Minute, CleanupInterval: 10 * time.Minute},
+		Security: utils.SecurityConfig{JWTSecret: "test-jwt-secret", APIKeySalt: "test-salt"},
+		Timeouts: utils.TimeoutConfig{Provider: 10 * time.Second, Streaming: 10 * time.Second, MaxRequest: time.Minute},
+		Dev:      utils.DevConfig{Enabled: true},
+	}
 
-	// Test getRequestID
-	req, err := http.NewRequest("GET", "/test", nil)
+	firebaseService, err := data.NewService(&data.FirebaseConfig{ProjectID: "test-project", InMemory: true})
+	require.NoError(t, err)
+	defer firebaseService.Close()
+
+	ctx := context.Background()
+	seed, err := services.LoadSeed("../../seeds", "../../seeds/dev")
+	require.NoError(t, err)
+	require.NoError(t, seed.AddModelPrices(data.ModelPrices()))
+	seeder := services.NewSeedService(firebaseService, cfg.Security.APIKeySalt)
+	changes, err := seeder.Plan(ctx, seed, false)
+	require.NoError(t, err)
+	require.NoError(t, seeder.Apply(ctx, changes))
+
+	sharedCache := services.NewSharedCache(cache.New(5*time.Minute, 10*time.Minute), firebaseService, false)
+	pricingService := services.NewPricingService(firebaseService, sharedCache, services.NewAuditService(firebaseService))
+	require.NoError(t, pricingService.PreCacheData(ctx))
+	router := setupTestRouter(NewHandler(cfg, firebaseService, sharedCache, pricingService))
+
+	before, err := firebaseService.GetUserByID(ctx, "test-user-1")
 	require.NoError(t, err)
 
+	bodyBytes, err := json.Marshal(GenerateRequest{Model: "gpt-4o", Prompt: "Hello, world!"})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/v1/generate", bytes.NewReader(bodyBytes))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer apt-dev-test-key")
 	w := httptest.NewRecorder()
-	c, _ := gin.CreateTestContext(w)
-	c.Request = req
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
 
-	requestID := handler.getRequestID(c)
-	assert.NotEmpty(t, requestID)
+	var response map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "[openai/gpt-4o] Hello, world!", response["text"])
 
-	// Test getLogger
-	logger := handler.getLogger(c)
-	assert.NotNil(t, logger)
+	after, err := firebaseService.GetUserByID(ctx, "test-user-1")
+	require.NoError(t, err)
+	assert.Less(t, after.Balance, before.Balance, "the fake provider's usage is billed")
 
-	// Test getRequestContext when not set
-	requestCtx, exists := handler.getRequestContext(c)
-	assert.False(t, exists)
-	assert.Nil(t, requestCtx)
+	// Seeding again changes nothing, since the balance is the only field billing touched
+	seed, err = services.LoadSeed("../../seeds")
+	require.NoError(t, err)
+	require.NoError(t, seed.AddModelPrices(data.ModelPrices()))
+	changes, err = seeder.Plan(ctx, seed, false)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
 }
 
-func BenchmarkHealthCheck(b *testing.B) {
-	handler := setupTestHandler(&testing.T{})
+func TestFirestoreIndexesFile(t *testing.T) {
+	// firestore.indexes.json is generated from the declared indexes with aptrouter-admin indexes
+	generated, err := data.IndexesFile(data.RequiredIndexes, data.TTLFields)
+	require.NoError(t, err)
+	committed, err := os.ReadFile("../../firestore.indexes.json")
+	require.NoError(t, err)
+	assert.Equal(t, string(generated), string(committed), "regenerate firestore.indexes.json with aptrouter-admin indexes -o firestore.indexes.json")
+
+	// The in-memory datastore needs no indexes
+	firebaseService := apttesting.NewDatastore(t)
+	statuses, err := firebaseService.CheckIndexes(context.Background(), data.RequiredIndexes)
+	require.NoError(t, err)
+	for _, status := range statuses {
+		assert.True(t, status.Ready)
+	}
+}
+
+func TestTestModeGenerate(t *testing.T) {
+	handler := setupTestHandler(t)
 	router := setupTestRouter(handler)
+	apttesting.ApplySeed(t, handler.firebaseService, "test-salt", services.Seed{
+		"api_keys": {
+			"test-key-id": {"user_id": "mock-user-id", "key": "apt-test-key", "status": "active", "scopes": []interface{}{"generate"}, "test_mode": true},
+		},
+	})
 
-	req, err := http.NewRequest("GET", "/healthz", nil)
-	if err != nil {
-		b.Fatal(err)
+	// The fake provider honours the provider timeout, as a real one would
+	handler.config.Timeouts = utils.TimeoutConfig{Provider: 10 * time.Second, Streaming: 10 * time.Second, MaxRequest: time.Minute}
+	llm := apttesting.NewLLMClient()
+	handler.generationService.SetClientFactory(llm.Factory())
+
+	bodyBytes, err := json.Marshal(GenerateRequest{Model: "gpt-3.5-turbo", Prompt: "Hello, world!"})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/v1/generate", bytes.NewReader(bodyBytes))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer apt-test-key")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// The fake provider answers and reports usage, but nothing is charged
+	var response GenerateResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "[openai/gpt-3.5-turbo] Hello, world!", response.Text)
+	require.NotNil(t, response.Usage)
+	assert.Positive(t, response.Usage.TotalTokens)
+	assert.Equal(t, data.BillingModeTest, response.Metadata["billing_mode"])
+	assert.Equal(t, true, response.Metadata["test_mode"])
+	require.NotNil(t, response.CostInfo)
+	assert.Zero(t, response.CostInfo.Total)
+	assert.Zero(t, response.CostInfo.Markup)
+	assert.Equal(t, float64(0), response.Metadata["total_cost"], "the deprecated alias matches the cost object")
+	assert.Empty(t, llm.Calls(), "test keys never reach a provider")
+
+	ctx := context.Background()
+	user, err := handler.firebaseService.GetUserByID(ctx, "mock-user-id")
+	require.NoError(t, err)
+	assert.Equal(t, data.MicroUSD(10_000_000), user.Balance)
+
+	// Test requests are logged, labelled, but kept out of the usage rollups
+	logs, err := handler.firebaseService.ListRecentRequestLogs(ctx, "mock-user-id", time.Now().Add(-time.Hour), 10)
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+	assert.True(t, logs[0].TestMode)
+	assert.Equal(t, data.BillingModeTest, logs[0].BillingMode)
+	rollups, err := handler.firebaseService.ListUsageRollups(ctx, "mock-user-id", data.RollupDaily, time.Now().AddDate(0, 0, -1), time.Now().AddDate(0, 0, 1))
+	require.NoError(t, err)
+	assert.Empty(t, rollups)
+}
+
+func TestGenerateCostObject(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		billingMode string
+		flatFee     float64
+		want        CostInfo
+		wantAPIKey  string
+	}{
+		{
+			// 1000 input tokens at $0.50 and 2000 output tokens at $1.50 per million, plus tier-1's 10% markup
+			name:        "Standard",
+			body:        `{"model": "gpt-3.5-turbo", "prompt": "Hello, world!"}`,
+			billingMode: data.BillingModeStandard,
+			want:        CostInfo{BaseInput: 500, BaseOutput: 3000, Markup: 350, Total: 3850, Currency: "USD"},
+			wantAPIKey:  "test-openai-key",
+		},
+		{
+			// The caller's key pays the provider, so only the markup is charged
+			name:        "BYOKMarkup",
+			body:        `{"model": "gpt-3.5-turbo", "prompt": "Hello, world!", "openai_api_key": "sk-caller-key"}`,
+			billingMode: data.BillingModeBYOKMarkup,
+			want:        CostInfo{Markup: 350, Total: 350, Currency: "USD"},
+			wantAPIKey:  "sk-caller-key",
+		},
+		{
+			name:        "BYOKFlat",
+			body:        `{"model": "gpt-3.5-turbo", "prompt": "Hello, world!", "openai_api_key": "sk-caller-key"}`,
+			billingMode: data.BillingModeBYOKFlat,
+			flatFee:     0.002,
+			want:        CostInfo{PlatformFee: 2000, Total: 2000, Currency: "USD"},
+			wantAPIKey:  "sk-caller-key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := setupTestHandler(t)
+			handler.config.Timeouts = utils.TimeoutConfig{Provider: 10 * time.Second, Streaming: 10 * time.Second, MaxRequest: time.Minute}
+			if tt.flatFee > 0 {
+				handler.config.Cost.BYOKBillingMode = "flat"
+				handler.config.Cost.BYOKFlatFeeUSD = tt.flatFee
+			}
+			router := setupTestRouter(handler)
+
+			llm := apttesting.NewLLMClient(apttesting.Response{Text: "Hi there!", InputTokens: 1000, OutputTokens: 2000})
+			handler.generationService.SetClientFactory(llm.Factory())
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/generate", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer valid-api-key")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+			calls := llm.Calls()
+			require.Len(t, calls, 1)
+			assert.Equal(t, tt.wantAPIKey, calls[0].APIKey)
+
+			var response GenerateResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			require.NotNil(t, response.CostInfo)
+			assert.Equal(t, tt.want, *response.CostInfo)
+			assert.Equal(t, tt.billingMode, response.Metadata["billing_mode"])
+
+			// The deprecated metadata aliases report the same amounts
+			assert.Equal(t, tt.want.Total.USD(), response.Metadata["total_cost"])
+			assert.Equal(t, tt.want.Markup.USD(), response.Metadata["markup_amount"])
+			assert.Equal(t, (tt.want.BaseInput + tt.want.BaseOutput).USD(), response.Metadata["base_cost"])
+			if tt.want.PlatformFee > 0 {
+				assert.Equal(t, tt.want.PlatformFee.USD(), response.Metadata["platform_fee"])
+			} else {
+				assert.NotContains(t, response.Metadata, "platform_fee")
+			}
+
+			// The cost object's total is what the balance was charged
+			user, err := handler.firebaseService.GetUserByID(context.Background(), "mock-user-id")
+			require.NoError(t, err)
+			assert.Equal(t, data.MicroUSD(10_000_000)-tt.want.Total, user.Balance)
+		})
 	}
+}
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
+func TestGenerateKeyRestrictions(t *testing.T) {
+	handler := setupTestHandler(t)
+	router := setupTestRouter(handler)
+	apttesting.ApplySeed(t, handler.firebaseService, "test-salt", services.Seed{
+		"api_keys": {
+			"allow-key-id":  {"user_id": "mock-user-id", "key": "apt-allow-key", "status": "active", "restrictions": map[string]interface{}{"allowed_models": []interface{}{"other-model"}}},
+			"deny-key-id":   {"user_id": "mock-user-id", "key": "apt-deny-key", "status": "active", "restrictions": map[string]interface{}{"denied_providers": []interface{}{"openai"}}},
+			"capped-key-id": {"user_id": "mock-user-id", "key": "apt-capped-key", "status": "active", "restrictions": map[string]interface{}{"allowed_models": []interface{}{"gpt-3.5-turbo"}, "max_tokens": int64(5)}},
+		},
+	})
+	handler.config.Timeouts = utils.TimeoutConfig{Provider: 10 * time.Second, Streaming: 10 * time.Second, MaxRequest: time.Minute}
+	llm := apttesting.NewLLMClient()
+	handler.generationService.SetClientFactory(llm.Factory())
+
+	generate := func(apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/generate", strings.NewReader(`{"model": "gpt-3.5-turbo", "prompt": "Hello, world!", "max_tokens": 500}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+apiKey)
 		w := httptest.NewRecorder()
 		router.ServeHTTP(w, req)
+		return w
 	}
-}
-
-func BenchmarkAuthMiddleware(b *testing.B) {
-	handler := setupTestHandler(&testing.T{})
 
-	req, err := http.NewRequest("GET", "/test", nil)
-	if err != nil {
-		b.Fatal(err)
+	// Non-streaming requests are held to the key's restrictions, as streams are
+	for _, apiKey := range []string{"apt-allow-key", "apt-deny-key"} {
+		w := generate(apiKey)
+		assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
 	}
-	req.Header.Set("Authorization", "Bearer test-api-key")
+	assert.Empty(t, llm.Calls(), "restricted requests never reach a provider")
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
+	w := generate("apt-capped-key")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	calls := llm.Calls()
+	require.Len(t, calls, 1)
+	assert.Equal(t, 5, calls[0].Params["max_tokens"], "max_tokens is capped to the key's limit")
+}
+
+func TestGenerateTenantCatalog(t *testing.T) {
+	handler := setupTestHandler(t)
+	router := setupTestRouter(handler)
+	require.NoError(t, handler.firebaseService.CreateTenant(context.Background(),
+		&data.Tenant{ID: "acme", Name: "Acme", IsActive: true, AllowedModels: []string{"other-model"}}))
+	apttesting.ApplySeed(t, handler.firebaseService, "test-salt", services.Seed{
+		"api_keys": {
+			"tenant-key-id": {"user_id": "mock-user-id", "tenant_id": "acme", "key": "apt-tenant-key", "status": "active"},
+		},
+	})
+	llm := apttesting.NewLLMClient()
+	handler.generationService.SetClientFactory(llm.Factory())
+
+	// A tenant's keys only reach the tenant's catalog, streamed or not
+	for _, path := range []string{"/v1/generate", "/v1/generate/stream"} {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"model": "gpt-3.5-turbo", "prompt": "Hello, world!"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer apt-tenant-key")
 		w := httptest.NewRecorder()
-		c, _ := gin.CreateTestContext(w)
-		c.Request = req
-		handler.AuthMiddleware()(c)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code, path)
+		assert.Contains(t, w.Body.String(), "not available for tenant acme", path)
 	}
+	assert.Empty(t, llm.Calls())
+}
+
+func TestReplayRequestLog(t *testing.T) {
+	handler := setupTestHandler(t)
+	handler.config.Logging.RequestPayloads = true
+	router := setupTestRouter(handler)
+	router.POST("/v1/admin/request-logs/:request_id/replay", handler.ReplayRequestLog)
+
+	llm := apttesting.NewLLMClient(apttesting.Response{Text: "Hi there!", InputTokens: 1000, OutputTokens: 2000})
+	handler.generationService.SetClientFactory(llm.Factory())
+
+	ctx := context.Background()
+	generate := func(t *testing.T) *data.RequestLog {
+		req := httptest.NewRequest(http.MethodPost, "/v1/generate", strings.NewReader(`{"model": "gpt-3.5-turbo", "prompt": "Hello, world!"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer valid-api-key")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		logs, err := handler.firebaseService.ListRecentRequestLogs(ctx, "mock-user-id", time.Now().Add(-time.Hour), 1)
+		require.NoError(t, err)
+		require.Len(t, logs, 1)
+		return logs[0]
+	}
+	replay := func(t *testing.T, requestID, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/admin/request-logs/"+requestID+"/replay", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	log := generate(t)
+	require.NotNil(t, log.Payload)
+	assert.Equal(t, "Hello, world!", log.Payload.Request["prompt"])
+	assert.Equal(t, "Hi there!", log.Payload.Completion)
+
+	t.Run("DryRun", func(t *testing.T) {
+		w := replay(t, log.RequestID, `{}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var result services.ReplayResult
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+		assert.Equal(t, services.ReplayDryRun, result.Mode)
+		assert.Equal(t, data.MicroUSD(3850), result.Original.Cost)
+		assert.Equal(t, "gpt-3.5-turbo", result.Replay.Model)
+		assert.False(t, result.ModelChanged)
+		assert.Empty(t, result.Replay.Output)
+		assert.Len(t, llm.Calls(), 1, "dry runs never call the provider")
+	})
+
+	t.Run("Shadow", func(t *testing.T) {
+		llm.Queue(apttesting.Response{Text: "Hello!", InputTokens: 1000, OutputTokens: 2000})
+		w := replay(t, log.RequestID, `{"mode": "shadow"}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var result services.ReplayResult
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+		assert.Equal(t, "Hi there!", result.Original.Output)
+		assert.Equal(t, "Hello!", result.Replay.Output)
+		assert.False(t, result.OutputMatches)
+		assert.Equal(t, data.MicroUSD(0), result.CostDelta)
+
+		calls := llm.Calls()
+		require.Len(t, calls, 2)
+		assert.Equal(t, "Hello, world!", calls[1].Params["prompt"])
+
+		// Replays are neither charged nor logged
+		user, err := handler.firebaseService.GetUserByID(ctx, "mock-user-id")
+		require.NoError(t, err)
+		assert.Equal(t, data.MicroUSD(10_000_000-3850), user.Balance)
+		logs, err := handler.firebaseService.ListRecentRequestLogs(ctx, "mock-user-id", time.Now().Add(-time.Hour), 10)
+		require.NoError(t, err)
+		assert.Len(t, logs, 1)
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, replay(t, log.RequestID, `{"mode": "live"}`).Code)
+		assert.Equal(t, http.StatusNotFound, replay(t, "missing-request", `{}`).Code)
+
+		handler.config.Logging.RequestPayloads = false
+		llm.Queue(apttesting.Response{Text: "Hi there!", InputTokens: 1000, OutputTokens: 2000})
+		unlogged := generate(t)
+		assert.Nil(t, unlogged.Payload)
+		assert.Equal(t, http.StatusConflict, replay(t, unlogged.RequestID, `{}`).Code)
+	})
+}
+
+func TestGenerateWebSocketValidation(t *testing.T) {
+	handler := setupTestHandler(t)
+
+	// Stand in for API key authentication, which needs Firestore
+	router := gin.New()
+	router.GET("/v1/generate/ws", func(c *gin.Context) {
+		c.Set(string(requestContextGinKey), &RequestContext{
+			RequestID: "test-request",
+			UserID:    "test-user",
+			Logger:    slog.Default(),
+		})
+	}, handler.GenerateWebSocket)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	testCases := []struct {
+		name    string
+		payload string
+	}{
+		{"MalformedJSON", `{"model":`},
+		{"MissingModel", `{"prompt": "Hello, world!"}`},
+		{"MissingPrompt", `{"model": "gpt-3.5-turbo"}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/generate/ws", nil)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(tc.payload)))
+
+			var frame WebSocketFrame
+			require.NoError(t, conn.ReadJSON(&frame))
+			assert.Equal(t, wsFrameError, frame.Type)
+			assert.Equal(t, http.StatusBadRequest, frame.Status)
+			assert.NotEmpty(t, frame.Error)
+		})
+	}
+}
+
+func TestMessagesValidation(t *testing.T) {
+	handler := setupTestHandler(t)
+
+	// Stand in for API key authentication, which needs Firestore
+	router := gin.New()
+	router.POST("/v1/messages", func(c *gin.Context) {
+		c.Set(string(requestContextGinKey), &RequestContext{
+			RequestID: "test-request",
+			UserID:    "test-user",
+			Logger:    slog.Default(),
+		})
+	}, handler.Messages)
+
+	testCases := []struct {
+		name    string
+		payload string
+	}{
+		{"MissingMaxTokens", `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hello"}]}`},
+		{"NoMessages", `{"model": "gpt-4o", "max_tokens": 10, "messages": []}`},
+		{"InvalidRole", `{"model": "gpt-4o", "max_tokens": 10, "messages": [{"role": "system", "content": "Hello"}]}`},
+		{"AssistantFirst", `{"model": "gpt-4o", "max_tokens": 10, "messages": [{"role": "assistant", "content": "Hi"}]}`},
+		{"ImageContent", `{"model": "gpt-4o", "max_tokens": 10, "messages": [{"role": "user", "content": [{"type": "image"}]}]}`},
+		{"Tools", `{"model": "gpt-4o", "max_tokens": 10, "messages": [{"role": "user", "content": "Hello"}], "tools": [{"name": "get_weather"}]}`},
+		{"ThinkingBudgetExceedsMaxTokens", `{"model": "gpt-4o", "max_tokens": 2000, "messages": [{"role": "user", "content": "Hello"}], "thinking": {"type": "enabled", "budget_tokens": 2000}}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/v1/messages", strings.NewReader(tc.payload))
+			req.Header.Set("Content-Type", "application/json")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			var body struct {
+				Type  string `json:"type"`
+				Error struct {
+					Type    string `json:"type"`
+					Message string `json:"message"`
+				} `json:"error"`
+			}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.Equal(t, "error", body.Type)
+			assert.Equal(t, "invalid_request_error", body.Error.Type)
+			assert.NotEmpty(t, body.Error.Message)
+		})
+	}
+
+	prompt, err := messagesPrompt([]Message{
+		{Role: "user", Content: MessageContent{{Type: "text", Text: "Hi"}}},
+		{Role: "assistant", Content: MessageContent{{Type: "text", Text: "Hello!"}}},
+		{Role: "user", Content: MessageContent{{Type: "text", Text: "How are you?"}}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Human: Hi\n\nAssistant: Hello!\n\nHuman: How are you?\n\nAssistant:", prompt)
+}
+
+func TestMessagesContextCompression(t *testing.T) {
+	handler := setupTestHandler(t)
+	router := setupTestRouter(handler)
+	router.POST("/v1/messages", handler.AuthMiddleware(data.ScopeGenerate), handler.Messages)
+	handler.config.Optimization.SummaryMaxTokens = 100
+
+	llm := apttesting.NewLLMClient()
+	handler.generationService.SetClientFactory(llm.Factory())
+
+	// About 18,000 tokens, past gpt-3.5-turbo's 16,385-token window with max_tokens
+	request := func(compression string, stream bool) string {
+		body, err := json.Marshal(gin.H{
+			"model":      "gpt-3.5-turbo",
+			"max_tokens": 1000,
+			"system":     "Be brief.",
+			"stream":     stream,
+			"messages": []gin.H{
+				{"role": "user", "content": "Hello"},
+				{"role": "assistant", "content": "Hi! How can I help?"},
+				{"role": "user", "content": strings.Repeat("alpha ", 9000)},
+				{"role": "assistant", "content": strings.Repeat("beta ", 9000)},
+				{"role": "user", "content": "What comes next?"},
+			},
+			"context_compression": compression,
+		})
+		require.NoError(t, err)
+		return string(body)
+	}
+	serve := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer valid-api-key")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("OffByDefault", func(t *testing.T) {
+		w := serve(request("", false))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "context window")
+		assert.Empty(t, llm.Calls())
+	})
+
+	t.Run("InvalidMode", func(t *testing.T) {
+		w := serve(request("truncate", false))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Summarize", func(t *testing.T) {
+		llm.Queue(
+			apttesting.Response{Text: "The user greeted the assistant and sent alphas; it answered with betas.", InputTokens: 18000, OutputTokens: 20},
+			apttesting.Response{Text: "Gamma.", InputTokens: 60, OutputTokens: 2},
+		)
+		w := serve(request("summarize", false))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var response MessagesResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, "Gamma.", response.Content[0].Text)
+		require.NotNil(t, response.ContextCompression)
+		assert.Equal(t, services.ContextCompressionSummarize, response.ContextCompression.Strategy)
+		assert.Equal(t, 4, response.ContextCompression.TurnsCompressed)
+		assert.Equal(t, 18000, response.ContextCompression.SummaryInputTokens)
+		assert.Less(t, response.ContextCompression.InputTokensAfter, 1000)
+
+		// The oldest turns are replaced by their summary, sent after the caller's system prompt
+		calls := llm.Calls()
+		require.Len(t, calls, 2)
+		assert.Equal(t, "gemma-3-27b-it", calls[0].ModelID)
+		assert.Equal(t, "gpt-3.5-turbo", calls[1].ModelID)
+		assert.Equal(t, "What comes next?", calls[1].Params["prompt"])
+		assert.Equal(t, "Be brief.\n\nSummary of the conversation so far:\nThe user greeted the assistant and sent alphas; it answered with betas.", calls[1].Params["system"])
+
+		// The summary call is logged as optimizer usage
+		logs, err := handler.firebaseService.ListRecentRequestLogs(context.Background(), "mock-user-id", time.Now().Add(-time.Hour), 1)
+		require.NoError(t, err)
+		require.Len(t, logs, 1)
+		assert.Equal(t, 18000, logs[0].OptimizerInputTokens)
+		assert.Equal(t, 20, logs[0].OptimizerOutputTokens)
+	})
+
+	t.Run("Stream", func(t *testing.T) {
+		llm.Queue(
+			apttesting.Response{Text: "The user sent alphas; the assistant answered with betas.", InputTokens: 18000, OutputTokens: 20},
+			apttesting.Response{Text: "Gamma, streamed.", InputTokens: 60, OutputTokens: 3},
+		)
+		server := httptest.NewServer(router)
+		defer server.Close()
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/v1/messages", strings.NewReader(request("summarize", true)))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer valid-api-key")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+
+		// The compression is reported when the message starts
+		start := strings.SplitN(string(body), "\n\n", 2)[0]
+		require.True(t, strings.HasPrefix(start, "event: message_start\ndata: "), start)
+		var event struct {
+			Message struct {
+				ContextCompression *services.ContextCompression `json:"context_compression"`
+			} `json:"message"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(start, "event: message_start\ndata: ")), &event))
+		require.NotNil(t, event.Message.ContextCompression)
+		assert.Equal(t, 4, event.Message.ContextCompression.TurnsCompressed)
+		assert.Contains(t, string(body), `"text":"streamed."`)
+	})
+}
+
+func TestEstimateChargesBillableCost(t *testing.T) {
+	handler := setupTestHandler(t)
+	router := setupTestRouter(handler)
+	apttesting.ApplySeed(t, handler.firebaseService, "test-salt", services.Seed{
+		"api_keys": {
+			"test-key-id": {"user_id": "mock-user-id", "key": "apt-test-key", "status": "active", "scopes": []interface{}{"generate"}, "test_mode": true},
+		},
+	})
+
+	estimate := func(apiKey string) EstimateResponse {
+		req := httptest.NewRequest(http.MethodPost, "/v1/estimate", strings.NewReader(`{"model": "gpt-3.5-turbo", "prompt": "Hello, world!"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp EstimateResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+
+	live := estimate("valid-api-key")
+	assert.Positive(t, live.TotalCost)
+
+	// Test mode requests are charged nothing, so they are estimated at nothing
+	test := estimate("apt-test-key")
+	assert.Equal(t, live.InputTokens, test.InputTokens)
+	assert.Zero(t, test.TotalCost)
+	assert.Zero(t, test.InputCost)
+}
+
+func TestOptimize(t *testing.T) {
+	handler := setupTestHandler(t)
+
+	// Stand in for API key authentication, which needs Firestore
+	router := gin.New()
+	router.POST("/v1/optimize", func(c *gin.Context) {
+		c.Set(string(requestContextGinKey), &RequestContext{
+			RequestID: "test-request",
+			UserID:    "test-user",
+			Logger:    slog.Default(),
+		})
+	}, handler.Optimize)
+
+	testCases := []struct {
+		name           string
+		payload        string
+		expectedStatus int
+		expectedPrompt string
+	}{
+		{"RuleBased", `{"prompt": "Please summarize this text in order to save time.", "strategy": "rule_based"}`, http.StatusOK, "Summarize this text to save time."},
+		{"RuleBasedUnchanged", `{"prompt": "Summarize this text.", "strategy": "rule_based"}`, http.StatusOK, "Summarize this text."},
+		{"MissingPrompt", `{"strategy": "rule_based"}`, http.StatusBadRequest, ""},
+		{"UnknownStrategy", `{"prompt": "Hello", "strategy": "magic"}`, http.StatusBadRequest, ""},
+		{"OptimizerDisabled", `{"prompt": "Hello", "strategy": "ai"}`, http.StatusServiceUnavailable, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/v1/optimize", strings.NewReader(tc.payload))
+			req.Header.Set("Content-Type", "application/json")
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tc.expectedStatus, w.Code)
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+			var resp OptimizeResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, tc.expectedPrompt, resp.OptimizedPrompt)
+			assert.Equal(t, resp.OptimizedPrompt != resp.OriginalPrompt, resp.WasOptimized)
+			assert.Equal(t, resp.OriginalTokens-resp.OptimizedTokens, resp.TokensSaved)
+		})
+	}
+}
+
+func TestReadStreamChunks(t *testing.T) {
+	chunks := readStreamChunks(strings.NewReader("hello"))
+	chunk := <-chunks
+	assert.Equal(t, "hello", string(chunk.data))
+	assert.NoError(t, chunk.err)
+	chunk = <-chunks
+	assert.ErrorIs(t, chunk.err, io.EOF)
+	_, ok := <-chunks
+	assert.False(t, ok)
+
+	// Stopping a stream the provider is still writing aborts it and waits for the reader to exit
+	reader, writer := io.Pipe()
+	chunks = readStreamChunks(reader)
+	stopStreamChunks(func() { writer.CloseWithError(context.Canceled) }, chunks)
+	_, ok = <-chunks
+	assert.False(t, ok)
+}
+
+func TestSSEEncoderText(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"SingleLine", "Hello", "data: Hello\n\n"},
+		{"MultiLine", "Hello\nworld", "data: Hello\ndata: world\n\n"},
+		{"BlankLine", "Hello\n\nworld", "data: Hello\ndata: \ndata: world\n\n"},
+		{"TrailingNewline", "Hello\n", "data: Hello\ndata: \n\n"},
+		{"Newline", "\n", "data: \ndata: \n\n"},
+	}
+	encoder := &sseEncoder{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, encoder.Text(&buf, []byte(tt.text)))
+			assert.Equal(t, tt.want, buf.String())
+
+			// Joining the event's data lines gives back the text
+			var lines []string
+			for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n\n"), "\n") {
+				lines = append(lines, strings.TrimPrefix(line, "data: "))
+			}
+			assert.Equal(t, tt.text, strings.Join(lines, "\n"))
+		})
+	}
+}
+
+func TestSSEHeartbeat(t *testing.T) {
+	handler := setupTestHandler(t)
+
+	handler.config.Timeouts.StreamHeartbeat = 0
+	heartbeat, stop := handler.sseHeartbeat()
+	assert.Nil(t, heartbeat)
+	stop()
+
+	handler.config.Timeouts.StreamHeartbeat = time.Millisecond
+	heartbeat, stop = handler.sseHeartbeat()
+	defer stop()
+	<-heartbeat
+
+	var buf bytes.Buffer
+	assert.True(t, writeSSEHeartbeat(&buf))
+	assert.Equal(t, ": ping\n\n", buf.String())
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	limiter := newConcurrencyLimiter(1, 1, 50*time.Millisecond)
+	ctx := context.Background()
+
+	release, err := limiter.acquire(ctx, "key", services.PriorityNormal)
+	require.NoError(t, err)
+
+	// A second request queues and times out while the slot is held
+	_, err = limiter.acquire(ctx, "key", services.PriorityNormal)
+	assert.ErrorIs(t, err, errConcurrencyQueueTimeout)
+
+	// Other keys are unaffected
+	releaseOther, err := limiter.acquire(ctx, "other-key", services.PriorityNormal)
+	require.NoError(t, err)
+	releaseOther()
+
+	// With the queue full, further requests are rejected immediately
+	queued := make(chan error, 1)
+	go func() {
+		releaseQueued, err := limiter.acquire(ctx, "key", services.PriorityNormal)
+		if err == nil {
+			releaseQueued()
+		}
+		queued <- err
+	}()
+	require.Eventually(t, func() bool {
+		limiter.mu.Lock()
+		defer limiter.mu.Unlock()
+		return limiter.slots["key"].users == 2
+	}, time.Second, time.Millisecond)
+	_, err = limiter.acquire(ctx, "key", services.PriorityNormal)
+	assert.ErrorIs(t, err, errConcurrencyLimit)
+
+	// Releasing the slot hands it to the queued request
+	release()
+	require.NoError(t, <-queued)
+	assert.Empty(t, limiter.slots)
+}
+
+func TestConcurrencyLimiterPriority(t *testing.T) {
+	limiter := newConcurrencyLimiter(1, 1, time.Second)
+	ctx := context.Background()
+
+	release, err := limiter.acquire(ctx, "key", services.PriorityNormal)
+	require.NoError(t, err)
+
+	// Low-priority requests are rejected rather than queued behind the held slot
+	_, err = limiter.acquire(ctx, "key", services.PriorityLow)
+	assert.ErrorIs(t, err, errConcurrencyLimit)
+
+	// High-priority requests run over the limit without waiting
+	releaseHigh, err := limiter.acquire(ctx, "key", services.PriorityHigh)
+	require.NoError(t, err)
+	releaseHigh()
+
+	release()
+	assert.Empty(t, limiter.slots)
+
+	// With the slot free, low-priority requests take it
+	releaseLow, err := limiter.acquire(ctx, "key", services.PriorityLow)
+	require.NoError(t, err)
+	releaseLow()
+}
+
+func TestConcurrencyLimitMiddleware(t *testing.T) {
+	handler := setupTestHandler(t)
+	handler.userConcurrency = newConcurrencyLimiter(1, 0, time.Second)
+
+	inFlight := make(chan struct{})
+	finish := make(chan struct{})
+	router := gin.New()
+	router.POST("/v1/generate", func(c *gin.Context) {
+		c.Set(string(requestContextGinKey), &RequestContext{
+			RequestID: "test-request",
+			UserID:    "test-user",
+			Logger:    slog.Default(),
+		})
+	}, handler.ConcurrencyLimitMiddleware(), func(c *gin.Context) {
+		if c.Query("block") != "" {
+			close(inFlight)
+			<-finish
+		}
+		c.Status(http.StatusOK)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/generate?block=1", nil))
+	}()
+	<-inFlight
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/generate", nil))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	close(finish)
+	<-done
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/generate", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRepeatedFailureMiddleware(t *testing.T) {
+	handler := setupTestHandler(t)
+	handler.failureGuard = newFailureGuard(3, time.Minute, time.Minute)
+
+	router := gin.New()
+	router.POST("/v1/generate", func(c *gin.Context) {
+		c.Set(string(requestContextGinKey), &RequestContext{
+			RequestID: "test-request",
+			APIKeyID:  "test-key",
+			Logger:    slog.Default(),
+		})
+	}, handler.RepeatedFailureMiddleware(), func(c *gin.Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		if strings.Contains(string(body), "bad") {
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+	send := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/generate", strings.NewReader(body)))
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusBadRequest, send(`{"prompt": "bad"}`).Code)
+	}
+
+	// The failing request is blocked, but other requests from the key are not
+	w := send(`{"prompt": "bad"}`)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), "repeated_failing_request")
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusBadRequest, send(`{"prompt": "bad", "n": 2}`).Code)
+	assert.Equal(t, http.StatusOK, send(`{"prompt": "good"}`).Code)
+}
+
+func TestFailureGuard(t *testing.T) {
+	guard := newFailureGuard(2, time.Minute, 5*time.Minute)
+	now := time.Now()
+
+	assert.False(t, guard.fail("key", now))
+	// A success clears the failures
+	guard.succeed("key")
+	assert.False(t, guard.fail("key", now))
+	// Failures outside the window start a new count
+	assert.False(t, guard.fail("key", now.Add(2*time.Minute)))
+	assert.True(t, guard.fail("key", now.Add(2*time.Minute+time.Second)))
+
+	remaining, blocked := guard.blocked("key", now.Add(3*time.Minute))
+	assert.True(t, blocked)
+	assert.Equal(t, 4*time.Minute+time.Second, remaining)
+
+	_, blocked = guard.blocked("key", now.Add(8*time.Minute))
+	assert.False(t, blocked, "the block expires")
+
+	var disabled *failureGuard
+	assert.False(t, disabled.fail("key", now))
+	_, blocked = disabled.blocked("key", now)
+	assert.False(t, blocked)
+}
+
+func TestProviderLimiter(t *testing.T) {
+	limiter := services.NewProviderLimiter(utils.RateLimitConfig{
+		Providers: map[string]utils.ProviderRateLimit{
+			"openai":    {RequestsPerMinute: 1},
+			"anthropic": {TokensPerMinute: 100},
+		},
+	})
+	ctx := context.Background()
+
+	// Providers without a budget are unlimited
+	reservation, err := limiter.Acquire(ctx, "google", 1_000_000, services.PriorityNormal)
+	require.NoError(t, err)
+	assert.Nil(t, reservation)
+
+	// Without a queue timeout, requests over the budget are rejected rather than delayed
+	_, err = limiter.Acquire(ctx, "openai", 10, services.PriorityNormal)
+	require.NoError(t, err)
+	_, err = limiter.Acquire(ctx, "openai", 10, services.PriorityNormal)
+	assert.ErrorIs(t, err, services.ErrProviderRateLimited)
+
+	// Settling a reservation returns the tokens it did not use
+	reservation, err = limiter.Acquire(ctx, "anthropic", 80, services.PriorityNormal)
+	require.NoError(t, err)
+	_, err = limiter.Acquire(ctx, "anthropic", 80, services.PriorityNormal)
+	assert.ErrorIs(t, err, services.ErrProviderRateLimited)
+	reservation.Settle(20)
+	_, err = limiter.Acquire(ctx, "anthropic", 80, services.PriorityNormal)
+	assert.NoError(t, err)
+}
+
+func TestProviderLimiterPriority(t *testing.T) {
+	limiter := services.NewProviderLimiter(utils.RateLimitConfig{
+		Providers: map[string]utils.ProviderRateLimit{
+			"openai": {TokensPerMinute: 100},
+		},
+	})
+	ctx := context.Background()
+
+	// Low-priority requests leave a quarter of the budget for other traffic
+	_, err := limiter.Acquire(ctx, "openai", 60, services.PriorityLow)
+	require.NoError(t, err)
+	_, err = limiter.Acquire(ctx, "openai", 20, services.PriorityLow)
+	assert.ErrorIs(t, err, services.ErrProviderRateLimited)
+	_, err = limiter.Acquire(ctx, "openai", 20, services.PriorityNormal)
+	require.NoError(t, err)
+
+	// High-priority requests are admitted even with the budget spent
+	_, err = limiter.Acquire(ctx, "openai", 50, services.PriorityNormal)
+	assert.ErrorIs(t, err, services.ErrProviderRateLimited)
+	_, err = limiter.Acquire(ctx, "openai", 50, services.PriorityHigh)
+	assert.NoError(t, err)
+}
+
+func TestResolvePriority(t *testing.T) {
+	priority, err := services.ResolvePriority("", "")
+	require.NoError(t, err)
+	assert.Equal(t, services.PriorityNormal, priority)
+
+	// Callers may lower their tier's priority but not raise it
+	priority, err = services.ResolvePriority(services.PriorityHigh, services.PriorityLow)
+	require.NoError(t, err)
+	assert.Equal(t, services.PriorityLow, priority)
+	priority, err = services.ResolvePriority(services.PriorityNormal, services.PriorityHigh)
+	require.NoError(t, err)
+	assert.Equal(t, services.PriorityNormal, priority)
+
+	_, err = services.ResolvePriority(services.PriorityNormal, "urgent")
+	assert.ErrorIs(t, err, services.ErrInvalidPriority)
+}
+
+func TestGRPCGenerationRequestValidation(t *testing.T) {
+	server := &grpcServer{handler: setupTestHandler(t)}
+	temperature := 3.0
+
+	testCases := []struct {
+		name string
+		req  *aptrouterv1.GenerateRequest
+	}{
+		{"MissingModel", &aptrouterv1.GenerateRequest{Prompt: "Hello, world!"}},
+		{"MissingPrompt", &aptrouterv1.GenerateRequest{Model: "gpt-3.5-turbo"}},
+		{"TemperatureOutOfRange", &aptrouterv1.GenerateRequest{Model: "gpt-3.5-turbo", Prompt: "Hello, world!", Temperature: &temperature}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := server.generationRequest(tc.req)
+			assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		})
+	}
+
+	serviceReq, err := server.generationRequest(&aptrouterv1.GenerateRequest{Model: "gpt-3.5-turbo", Prompt: "Hello, world!"})
+	require.NoError(t, err)
+	assert.Equal(t, 1000, serviceReq.MaxTokens)
+	assert.False(t, serviceReq.Stream)
+
+	assert.Equal(t, codes.FailedPrecondition, status.Code((&generationError{http.StatusPaymentRequired, gin.H{"error": "Insufficient balance"}}).grpcStatus()))
+}
+
+func TestUserEndpoints(t *testing.T) {
+	handler := setupTestHandler(t)
+	router := setupTestRouter(handler)
+
+	testCases := []struct {
+		name     string
+		method   string
+		endpoint string
+	}{
+		{"GetProfile", "GET", "/v1/user/profile"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, tc.endpoint, nil)
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			var response map[string]interface{}
+			err = json.Unmarshal(w.Body.Bytes(), &response)
+			require.NoError(t, err)
+
+			assert.Contains(t, response, "message")
+		})
+	}
+}
+
+func TestGetUsageValidation(t *testing.T) {
+	handler := setupTestHandler(t)
+	router := setupTestRouter(handler)
+
+	testCases := []struct {
+		name     string
+		endpoint string
+	}{
+		{"UnknownGranularity", "/v1/user/usage?granularity=week"},
+		{"HourlyRangeTooLong", "/v1/user/usage?granularity=hour&since=2025-01-01T00:00:00Z&until=2025-02-01T00:00:00Z"},
+		{"MalformedSince", "/v1/user/usage?since=yesterday"},
+		{"LogsLimitOutOfRange", "/v1/user/usage/logs?limit=1000"},
+		{"SavingsUnknownGranularity", "/v1/user/savings?granularity=week"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", tc.endpoint, nil)
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+
+			var response map[string]interface{}
+			err = json.Unmarshal(w.Body.Bytes(), &response)
+			require.NoError(t, err)
+
+			assert.Contains(t, response, "error")
+		})
+	}
+}
+
+func TestGetSavings(t *testing.T) {
+	handler := setupTestHandler(t)
+	router := setupTestRouter(handler)
+
+	ctx := context.Background()
+	today := data.RollupBucket(data.RollupDaily, time.Now())
+	yesterday := today.AddDate(0, 0, -1)
+	for _, log := range []*data.RequestLog{
+		{ID: "req-1", UserID: "mock-user-id", ModelID: "gpt-4o", InputTokens: 600, WasOptimized: true, TokensSaved: 400,
+			SavingsAmount: 900, GrossSavings: 1_000, OptimizerCost: 100, RequestTimestamp: yesterday.Add(time.Hour)},
+		{ID: "req-2", UserID: "mock-user-id", ModelID: "gpt-4o", InputTokens: 1_000, RequestTimestamp: today.Add(time.Minute)},
+		// Summarizing a long conversation costs without saving prompt tokens
+		{ID: "req-3", UserID: "mock-user-id", ModelID: "claude-sonnet-4", InputTokens: 500, OptimizerCost: 300, RequestTimestamp: today.Add(time.Minute)},
+		// Logs from before gross savings were recorded only hold them net of the optimizer's cost
+		{ID: "req-4", UserID: "mock-user-id", ModelID: "gpt-4o-mini", InputTokens: 100, WasOptimized: true, TokensSaved: 100,
+			SavingsAmount: 50, OptimizerCost: 25, RequestTimestamp: today.Add(time.Minute)},
+	} {
+		require.NoError(t, handler.firebaseService.LogRequest(ctx, log))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/user/savings?since="+yesterday.Format(time.RFC3339), nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var savings data.SavingsSummary
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &savings))
+	assert.Equal(t, 4, savings.Requests)
+	assert.Equal(t, 2, savings.OptimizedRequests)
+	assert.Equal(t, 500, savings.TokensSaved)
+	assert.InDelta(t, 500.0/2700*100, savings.SavingsPercent, 0.001)
+	assert.Equal(t, data.MicroUSD(1_075), savings.GrossSavings)
+	assert.Equal(t, data.MicroUSD(425), savings.OptimizerCost)
+	assert.Equal(t, data.MicroUSD(650), savings.NetSavings)
+
+	require.Len(t, savings.ByModel, 3)
+	assert.Equal(t, "gpt-4o", savings.ByModel[0].ModelID)
+	assert.Equal(t, data.MicroUSD(900), savings.ByModel[0].NetSavings)
+	assert.Equal(t, "claude-sonnet-4", savings.ByModel[2].ModelID)
+	assert.Equal(t, data.MicroUSD(-300), savings.ByModel[2].NetSavings)
+
+	require.Len(t, savings.Trend, 2)
+	assert.True(t, savings.Trend[0].BucketStart.Equal(yesterday))
+	assert.Equal(t, data.MicroUSD(900), savings.Trend[0].NetSavings)
+	assert.Equal(t, data.MicroUSD(-250), savings.Trend[1].NetSavings)
+	assert.Contains(t, w.Body.String(), `"converted":{`)
+}
+
+func TestRedeemReferralCode(t *testing.T) {
+	handler := setupTestHandler(t)
+	router := setupTestRouter(handler)
+
+	testCases := []struct {
+		name           string
+		body           string
+		expectedStatus int
+	}{
+		{"MissingCode", `{}`, http.StatusBadRequest},
+		{"ReferralsDisabled", `{"code": "K7MQ2XPA"}`, http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "/v1/user/referral-code/redeem", bytes.NewBufferString(tc.body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tc.expectedStatus, w.Code)
+		})
+	}
+}
+
+func TestAPIKeyEndpoints(t *testing.T) {
+	handler := setupTestHandler(t)
+	router := setupTestRouter(handler)
+
+	testCases := []struct {
+		name     string
+		method   string
+		endpoint string
+	}{
+		{"CreateAPIKey", "POST", "/v1/keys"},
+		{"RevokeAPIKey", "DELETE", "/v1/keys/test-key-id"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, tc.endpoint, nil)
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			var response map[string]interface{}
+			err = json.Unmarshal(w.Body.Bytes(), &response)
+			require.NoError(t, err)
+
+			assert.Contains(t, response, "message")
+		})
+	}
+}
+
+func TestRotateAPIKey(t *testing.T) {
+	handler := setupTestHandler(t)
+	handler.config.Security.APIKeyRotationGracePeriod = time.Hour
+	handler.config.Timeouts = utils.TimeoutConfig{Provider: 10 * time.Second, Streaming: 10 * time.Second, MaxRequest: time.Minute}
+	router := setupTestRouter(handler)
+
+	rotate := func(keyID, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/keys/"+keyID+"/rotate", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	generate := func(apiKey string) int {
+		req := httptest.NewRequest(http.MethodPost, "/v1/generate", strings.NewReader(`{"model": "gpt-3.5-turbo", "prompt": "Hello"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	w := rotate("mock-key-id", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var rotated struct {
+		ID     string   `json:"id"`
+		Key    string   `json:"key"`
+		Scopes []string `json:"scopes"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rotated))
+	assert.Equal(t, "mock-key-id", rotated.ID)
+	assert.Equal(t, []string{"generate"}, rotated.Scopes)
+	require.NotEmpty(t, rotated.Key)
+
+	// Both secrets work during the grace period
+	assert.Equal(t, http.StatusOK, generate(rotated.Key))
+	assert.Equal(t, http.StatusOK, generate("valid-api-key"))
+
+	t.Run("NoGracePeriod", func(t *testing.T) {
+		w := rotate("mock-key-id", `{"grace_period_seconds": 0}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var next struct {
+			Key string `json:"key"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &next))
+
+		assert.Equal(t, http.StatusOK, generate(next.Key))
+		assert.Equal(t, http.StatusUnauthorized, generate(rotated.Key))
+		assert.Equal(t, http.StatusUnauthorized, generate("valid-api-key"))
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, rotate("mock-key-id", `{"grace_period_seconds": 7200}`).Code)
+		assert.Equal(t, http.StatusBadRequest, rotate("mock-key-id", `{"grace_period_seconds": -1}`).Code)
+		assert.Equal(t, http.StatusNotFound, rotate("missing-key", "").Code)
+	})
+}
+
+func TestServiceAccounts(t *testing.T) {
+	handler := setupTestHandler(t)
+	handler.config.Timeouts = utils.TimeoutConfig{Provider: 10 * time.Second, Streaming: 10 * time.Second, MaxRequest: time.Minute}
+	router := setupTestRouter(handler)
+	router.GET("/v1/admin/service-accounts", handler.ListServiceAccounts)
+	router.POST("/v1/admin/service-accounts", handler.CreateServiceAccount)
+	router.POST("/v1/admin/service-accounts/:user_id/keys", handler.CreateServiceAccountAPIKey)
+
+	llm := apttesting.NewLLMClient(apttesting.Response{Text: "Hi there!", InputTokens: 1000, OutputTokens: 2000})
+	handler.generationService.SetClientFactory(llm.Factory())
+
+	serve := func(method, path, body, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(http.MethodPost, "/v1/admin/service-accounts", `{"name": "Nightly batch", "tier_id": "tier-1", "balance": 5}`, "")
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var account ServiceAccountResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &account))
+	assert.True(t, strings.HasPrefix(account.ID, "sa-"))
+	assert.Equal(t, data.UserTypeServiceAccount, account.Type)
+	assert.Equal(t, data.MicroUSD(5_000_000), account.Balance)
+
+	w = serve(http.MethodGet, "/v1/admin/service-accounts", "", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), account.ID)
+	assert.NotContains(t, w.Body.String(), "mock-user-id", "people are not service accounts")
+
+	w = serve(http.MethodPost, "/v1/admin/service-accounts/"+account.ID+"/keys", `{"name": "batch"}`, "")
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var key struct {
+		Key    string   `json:"key"`
+		UserID string   `json:"user_id"`
+		Scopes []string `json:"scopes"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &key))
+	assert.Equal(t, account.ID, key.UserID)
+	assert.Equal(t, []string{data.ScopeGenerate}, key.Scopes)
+
+	// The account's requests are billed to it and logged as a service account's
+	w = serve(http.MethodPost, "/v1/generate", `{"model": "gpt-3.5-turbo", "prompt": "Hello"}`, key.Key)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	ctx := context.Background()
+	logs, err := handler.firebaseService.ListRecentRequestLogs(ctx, account.ID, time.Now().Add(-time.Hour), 1)
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+	assert.Equal(t, data.UserTypeServiceAccount, logs[0].UserType)
+
+	rollups, err := handler.firebaseService.ListUsageRollups(ctx, account.ID, data.RollupDaily, time.Now().Add(-24*time.Hour), time.Now())
+	require.NoError(t, err)
+	require.Len(t, rollups, 1)
+	assert.Equal(t, data.UserTypeServiceAccount, rollups[0].UserType)
+
+	t.Run("Errors", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, "/v1/admin/service-accounts", `{"name": "x", "tier_id": "missing-tier"}`, "").Code)
+		assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, "/v1/admin/service-accounts", `{"tier_id": "tier-1"}`, "").Code)
+		assert.Equal(t, http.StatusNotFound, serve(http.MethodPost, "/v1/admin/service-accounts/mock-user-id/keys", `{"name": "x"}`, "").Code)
+	})
+}
+
+func TestImpersonateUser(t *testing.T) {
+	handler := setupTestHandler(t)
+	handler.config.Security.AdminUserIDs = []string{"admin-user-id"}
+	handler.config.Security.ImpersonationTokenTTL = 15 * time.Minute
+	router := setupTestRouter(handler)
+	router.POST("/v1/admin/users/:user_id/impersonate", func(c *gin.Context) {
+		c.Set(string(userIDGinKey), "admin-user-id")
+		handler.ImpersonateUser(c)
+	})
+
+	serve := func(method, path, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(http.MethodPost, "/v1/admin/users/mock-user-id/impersonate", `{}`, "")
+	assert.Equal(t, http.StatusBadRequest, w.Code, "a reason is required")
+	w = serve(http.MethodPost, "/v1/admin/users/unknown-user/impersonate", `{"reason": "TICKET-42"}`, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = serve(http.MethodPost, "/v1/admin/users/mock-user-id/impersonate", `{"reason": "TICKET-42"}`, "")
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var issued struct {
+		Token     string    `json:"token"`
+		UserID    string    `json:"user_id"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &issued))
+	assert.Equal(t, "mock-user-id", issued.UserID)
+	assert.WithinDuration(t, time.Now().Add(15*time.Minute), issued.ExpiresAt, time.Minute)
+
+	// The admin sees the user's balance and keys, without the keys' secrets
+	w = serve(http.MethodGet, "/v1/user/balance", "", issued.Token)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"balance": 10, "available_credits": 0, "tier_id": "tier-1", "currency": {"code": "USD", "rate": 1}, "converted": {"balance": 10.00, "available_credits": 0.00}}`, w.Body.String())
+	w = serve(http.MethodGet, "/v1/keys", "", issued.Token)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"id":"mock-key-id"`)
+	assert.NotContains(t, w.Body.String(), "key_hash")
+
+	// Impersonation is read-only
+	w = serve(http.MethodPost, "/v1/user/referral-code/redeem", `{"code": "FRIEND"}`, issued.Token)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Data exports hand over a copy of the user's data, so impersonation cannot read them either
+	export, err := handler.firebaseService.CreateDataExport(context.Background(), "mock-user-id")
+	require.NoError(t, err)
+	for _, path := range []string{
+		"/v1/user/data-export/" + export.ID,
+		"/v1/user/data-export/" + export.ID + "/download",
+	} {
+		w = serve(http.MethodGet, path, "", issued.Token)
+		assert.Equal(t, http.StatusForbidden, w.Code, path)
+	}
+
+	// Tampered tokens and tokens of admins since removed are rejected
+	w = serve(http.MethodGet, "/v1/user/balance", "", issued.Token+"x")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	handler.config.Security.AdminUserIDs = nil
+	w = serve(http.MethodGet, "/v1/user/balance", "", issued.Token)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Issuing the token and each impersonated request are audited as the admin's actions
+	ctx := context.Background()
+	require.Eventually(t, func() bool {
+		events, err := handler.firebaseService.ListAuditEvents(ctx, data.AuditEventFilter{ActorID: "admin-user-id", Limit: 10})
+		return err == nil && len(events) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	events, err := handler.firebaseService.ListAuditEvents(ctx, data.AuditEventFilter{Type: data.AuditImpersonatedRequest, Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	for _, event := range events {
+		assert.Equal(t, "mock-user-id", event.TargetID)
+		assert.Equal(t, "mock-user-id", event.Details["impersonated_user_id"])
+	}
+}
+
+func TestOrgMemberRoles(t *testing.T) {
+	handler := setupTestHandler(t)
+	router := setupTestRouter(handler)
+	org := router.Group("/v1/org", func(c *gin.Context) {
+		c.Set(string(userIDGinKey), c.GetHeader("X-Test-User"))
+	})
+	org.GET("/:org_id/members", handler.ListOrgMembers)
+	org.POST("/:org_id/members", handler.SetOrgMember)
+	org.PUT("/:org_id/members/:user_id", handler.SetOrgMember)
+	org.DELETE("/:org_id/members/:user_id", handler.RemoveOrgMember)
+	org.GET("/:org_id/usage", handler.GetOrgUsage)
+	org.PUT("/:org_id/aliases/:alias", handler.SetOrgModelAlias)
+
+	user := func(email string) map[string]interface{} {
+		return map[string]interface{}{"email": email, "balance_micros": int64(0), "tier_id": "tier-1", "is_active": true}
+	}
+	apttesting.ApplySeed(t, handler.firebaseService, "test-salt", services.Seed{
+		"users": {
+			"owner-1":  user("owner@example.com"),
+			"admin-1":  user("admin@example.com"),
+			"member-1": user("member@example.com"),
+			"member-2": user("member2@example.com"),
+		},
+	})
+
+	ctx := context.Background()
+	created, err := handler.firebaseService.CreateOrganization(ctx, "Acme", "owner-1", "tier-1")
+	require.NoError(t, err)
+	for userID, role := range map[string]data.OrgRole{"admin-1": data.OrgRoleAdmin, "member-1": data.OrgRoleMember, "member-2": data.OrgRoleMember} {
+		_, err := handler.firebaseService.SetOrgMember(ctx, created.ID, userID, role)
+		require.NoError(t, err)
+	}
+
+	serve := func(method, path, body, callerID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/v1/org/"+created.ID+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Test-User", callerID)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	role := func(t *testing.T, userID string) data.OrgRole {
+		member, err := handler.firebaseService.GetOrgMember(ctx, created.ID, userID)
+		require.NoError(t, err)
+		return member.Role
+	}
+
+	t.Run("MemberDeniedAdminActions", func(t *testing.T) {
+		denied := []struct {
+			method, path, body string
+		}{
+			{http.MethodPost, "/members", `{"user_id": "owner-1", "role": "member"}`},
+			{http.MethodPut, "/members/member-2", `{"role": "admin"}`},
+			{http.MethodPut, "/members/member-1", `{"role": "admin"}`},
+			{http.MethodDelete, "/members/member-2", ""},
+			{http.MethodGet, "/usage", ""},
+			{http.MethodPut, "/aliases/fast", `{"model_id": "gpt-3.5-turbo"}`},
+		}
+		for _, req := range denied {
+			w := serve(req.method, req.path, req.body, "member-1")
+			assert.Equal(t, http.StatusForbidden, w.Code, "%s %s: %s", req.method, req.path, w.Body.String())
+			assert.Contains(t, w.Body.String(), "Requires organization owner or admin")
+		}
+		assert.Equal(t, data.OrgRoleMember, role(t, "member-1"), "a member can't promote themselves")
+		assert.Equal(t, data.OrgRoleMember, role(t, "member-2"))
+
+		// Members may still read the organization
+		assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/members", "", "member-1").Code)
+	})
+
+	t.Run("AdminDeniedOwnerActions", func(t *testing.T) {
+		w := serve(http.MethodPut, "/members/member-2", `{"role": "admin"}`, "admin-1")
+		assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+		assert.Equal(t, data.OrgRoleMember, role(t, "member-2"))
+
+		// Admins manage members, but not each other
+		w = serve(http.MethodPut, "/members/member-2", `{"role": "member"}`, "admin-1")
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	})
+
+	t.Run("OwnerCannotBeDemoted", func(t *testing.T) {
+		// The owner is the organization's only owner, so demoting them would leave it without one
+		for _, callerID := range []string{"owner-1", "admin-1"} {
+			for _, newRole := range []string{"admin", "member"} {
+				w := serve(http.MethodPut, "/members/owner-1", `{"role": "`+newRole+`"}`, callerID)
+				assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+				assert.Contains(t, w.Body.String(), "owner's role cannot be changed")
+			}
+			w := serve(http.MethodDelete, "/members/owner-1", "", callerID)
+			assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+		}
+
+		// Nor can another member be made an owner in their place
+		w := serve(http.MethodPut, "/members/admin-1", `{"role": "owner"}`, "owner-1")
+		assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+		assert.Equal(t, data.OrgRoleOwner, role(t, "owner-1"))
+		assert.Equal(t, data.OrgRoleAdmin, role(t, "admin-1"))
+	})
+}
+
+func TestTierModelPricing(t *testing.T) {
+	handler := setupTestHandler(t)
+	apttesting.ApplySeed(t, handler.firebaseService, "test-salt", services.Seed{
+		"users": {
+			"mock-user-id": {"email": "mock@example.com", "tier_id": "tier-custom", "custom_pricing": true, "balance_micros": int64(10_000_000), "is_active": true},
+		},
+		"pricing_tiers": {
+			"tier-custom": {"name": "Enterprise", "input_markup_percent": int64(10), "output_markup_percent": int64(10), "is_active": true, "is_custom": true},
+		},
+	})
+	router := setupTestRouter(handler)
+	router.GET("/v1/admin/pricing-tiers", handler.ListPricingTiers)
+	router.PUT("/v1/admin/pricing-tiers/:tier_id/models/:model_id", handler.SetTierModelPricing)
+	router.DELETE("/v1/admin/pricing-tiers/:tier_id/models/:model_id", handler.DeleteTierModelPricing)
+	router.PUT("/v1/admin/pricing-tiers/:tier_id/optimization", handler.SetTierOptimization)
+
+	llm := apttesting.NewLLMClient()
+	handler.generationService.SetClientFactory(llm.Factory())
+
+	serve := func(method, path, body string, apiKey bool) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		if apiKey {
+			req.Header.Set("Authorization", "Bearer valid-api-key")
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	// generate bills 1000 input and 2000 output tokens and returns what they cost
+	generate := func(t *testing.T) (data.MicroUSD, map[string]interface{}) {
+		before, err := handler.firebaseService.GetUserByID(context.Background(), "mock-user-id")
+		require.NoError(t, err)
+
+		llm.Queue(apttesting.Response{Text: "Hi", InputTokens: 1000, OutputTokens: 2000})
+		w := serve("POST", "/v1/generate", `{"model": "gpt-3.5-turbo", "prompt": "Hello"}`, true)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var response GenerateResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		after, err := handler.firebaseService.GetUserByID(context.Background(), "mock-user-id")
+		require.NoError(t, err)
+		return before.Balance - after.Balance, response.Metadata
+	}
+
+	// Without custom pricing for the model, the tier's markup applies to the base prices
+	cost, metadata := generate(t)
+	assert.Equal(t, data.MicroUSD(3850), cost)
+	assert.NotContains(t, metadata, "custom_pricing")
+
+	const path = "/v1/admin/pricing-tiers/tier-custom/models/gpt-3.5-turbo"
+	assert.Equal(t, http.StatusBadRequest, serve("PUT", "/v1/admin/pricing-tiers/tier-1/models/gpt-3.5-turbo", `{"input_price_per_million": 1}`, false).Code, "standard tiers take no model pricing")
+	assert.Equal(t, http.StatusNotFound, serve("PUT", "/v1/admin/pricing-tiers/missing/models/gpt-3.5-turbo", `{"input_price_per_million": 1}`, false).Code)
+	assert.Equal(t, http.StatusNotFound, serve("PUT", "/v1/admin/pricing-tiers/tier-custom/models/missing", `{"input_price_per_million": 1}`, false).Code)
+	assert.Equal(t, http.StatusBadRequest, serve("PUT", path, `{"output_markup_percent": -5}`, false).Code)
+
+	// The input price is overridden and the output keeps its base price with its own markup
+	w := serve("PUT", path, `{"input_price_per_million": 1, "output_markup_percent": 50}`, false)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var set struct {
+		Applied data.AppliedPricing `json:"applied"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &set))
+	assert.Equal(t, data.AppliedPricing{InputPricePerMillion: 1, OutputPricePerMillion: 1.5, InputMarkupPercent: 10, OutputMarkupPercent: 50, Override: true}, set.Applied)
+
+	cost, metadata = generate(t)
+	assert.Equal(t, data.MicroUSD(1100+4500), cost)
+	assert.Equal(t, true, metadata["custom_pricing"])
+
+	w = serve("GET", "/v1/admin/pricing-tiers", "", false)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var list struct {
+		PricingTiers []data.PricingTier `json:"pricing_tiers"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list.PricingTiers, 2)
+	assert.Contains(t, list.PricingTiers[1].CustomModelPricing, "gpt-3.5-turbo")
+
+	// Removing the model's pricing restores the tier's markup on the base prices
+	assert.Equal(t, http.StatusNoContent, serve("DELETE", path, "", false).Code)
+	assert.Equal(t, http.StatusNotFound, serve("DELETE", path, "", false).Code)
+	cost, _ = generate(t)
+	assert.Equal(t, data.MicroUSD(3850), cost)
+
+	// Any tier may set its optimization settings
+	const optimizationPath = "/v1/admin/pricing-tiers/tier-custom/optimization"
+	assert.Equal(t, http.StatusBadRequest, serve("PUT", optimizationPath, `{"models": [{"pattern": "gpt-["}]}`, false).Code)
+	assert.Equal(t, http.StatusNotFound, serve("PUT", "/v1/admin/pricing-tiers/missing/optimization", `{}`, false).Code)
+	w = serve("PUT", optimizationPath, `{"min_prompt_chars": 400, "models": [{"pattern": "claude-*", "disabled": true}]}`, false)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	tier, err := handler.firebaseService.GetPricingTier(context.Background(), "tier-custom")
+	require.NoError(t, err)
+	assert.Equal(t, 400, tier.Optimization.MinPromptChars)
+	assert.Equal(t, []data.ModelOptimization{{Pattern: "claude-*", Disabled: true}}, tier.Optimization.Models)
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	handler := setupTestHandler(t)
+
+	// Test with valid API key
+	req, err := http.NewRequest("GET", "/test", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer valid-api-key")
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = req
+
+	// Call middleware
+	handler.AuthMiddleware()(c)
+
+	// Verify request context was set
+	requestCtx, exists := handler.getRequestContext(c)
+	assert.True(t, exists)
+	assert.NotNil(t, requestCtx)
+	assert.Equal(t, "mock-user-id", requestCtx.UserID)
+
+	t.Run("ExpiredKey", func(t *testing.T) {
+		apttesting.ApplySeed(t, handler.firebaseService, "test-salt", services.Seed{
+			"api_keys": {
+				"expired-key-id": {"user_id": "mock-user-id", "key": "expired-api-key", "status": "active", "expires_at": time.Now().Add(-time.Minute)},
+			},
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/test", nil)
+		req.Header.Set("Authorization", "Bearer expired-api-key")
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = req
+
+		// Keys are rejected once they expire, before the sweep deactivates them
+		handler.AuthMiddleware()(c)
+		assert.True(t, c.IsAborted())
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Body.String(), "API key has expired")
+	})
+
+	t.Run("MissingKey", func(t *testing.T) {
+		authenticate := func() (*gin.Context, *httptest.ResponseRecorder) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/test", nil)
+			handler.AuthMiddleware()(c)
+			return c, w
+		}
+
+		// Outside production a request without a key runs as the development user
+		c, _ := authenticate()
+		assert.False(t, c.IsAborted())
+		requestCtx, exists := handler.getRequestContext(c)
+		require.True(t, exists)
+		assert.Equal(t, "mock-user-id", requestCtx.UserID)
+
+		// In production it is rejected, like a request without an ID token
+		env := handler.config.Server.Env
+		handler.config.Server.Env = "production"
+		defer func() { handler.config.Server.Env = env }()
+		c, w := authenticate()
+		assert.True(t, c.IsAborted())
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Body.String(), "Missing API key")
+		_, exists = handler.getRequestContext(c)
+		assert.False(t, exists)
+	})
+}
+
+func TestRequestLogger(t *testing.T) {
+	handler := setupTestHandler(t)
+
+	req, err := http.NewRequest("GET", "/test", nil)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = req
+
+	// Call middleware
+	handler.RequestLogger()(c)
+
+	// Verify logger was set in context
+	logger := handler.getLogger(c)
+	assert.NotNil(t, logger)
+}
+
+func TestRequestLoggerSlowRequest(t *testing.T) {
+	handler := setupTestHandler(t)
+	handler.config.Logging.SlowRequestThreshold = time.Millisecond
+	handler.config.Logging.SlowRequestSnippetBytes = 512
+
+	var logs bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	defer slog.SetDefault(previous)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(handler.RequestLogger())
+	router.POST("/slow/:id", func(c *gin.Context) {
+		_, _ = io.ReadAll(c.Request.Body)
+		time.Sleep(5 * time.Millisecond)
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+
+	body := `{"model":"gpt-4o","prompt":"tell me a secret","api_key":"sk-live-123","messages":[{"role":"user","content":"hello"}]}`
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/slow/42", strings.NewReader(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var slow map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		if entry["msg"] == "Slow request" {
+			slow = entry
+		}
+	}
+	require.NotNil(t, slow, "slow request should be logged")
+	assert.Equal(t, "/slow/:id", slow["route"])
+	assert.EqualValues(t, http.StatusOK, slow["status"])
+
+	payload := slow["payload"].(string)
+	assert.Contains(t, payload, `"model":"gpt-4o"`)
+	assert.Contains(t, payload, `"api_key":"[REDACTED]"`)
+	assert.Contains(t, payload, `"prompt":"[16 chars]"`)
+	assert.Contains(t, payload, `"role":"user"`)
+	assert.NotContains(t, payload, "sk-live-123")
+	assert.NotContains(t, payload, "hello")
+}
+
+func TestPayloadSnippet(t *testing.T) {
+	record := func(body string) *payloadRecorder {
+		r := &payloadRecorder{ReadCloser: io.NopCloser(strings.NewReader(body))}
+		_, _ = io.ReadAll(r)
+		return r
+	}
+
+	// Payloads are logged in full only when request payloads are
+	assert.Equal(t, `{"prompt":"hi"}`, record(`{"prompt":"hi"}`).snippet(100, true))
+	assert.Equal(t, `{"prompt":"[2 chars]"}`, record(`{"prompt":"hi"}`).snippet(100, false))
+
+	// Snippets are truncated, and bodies that are not JSON are not shown
+	assert.Equal(t, `{"model":"...`, record(`{"model":"gpt-4o"}`).snippet(10, false))
+	assert.Equal(t, "[8 bytes not shown]", record("not json").snippet(100, true))
+	assert.Equal(t, "", record("").snippet(100, true))
+}
+
+func TestHelperFunctions(t *testing.T) {
+	handler := setupTestHandler(t)
+
+	// Test getIntValue
+	intPtr := 42
+	assert.Equal(t, 42, handler.getIntValue(&intPtr, 0))
+	assert.Equal(t, 0, handler.getIntValue(nil, 0))
+
+	// Test getFloatValue
+	floatPtr := 3.14
+	assert.Equal(t, 3.14, handler.getFloatValue(&floatPtr, 0.0))
+	assert.Equal(t, 0.0, handler.getFloatValue(nil, 0.0))
+
+	// Test getBoolValue
+	boolPtr := true
+	assert.Equal(t, true, handler.getBoolValue(&boolPtr, false))
+	assert.Equal(t, false, handler.getBoolValue(nil, false))
+}
+
+func TestStopSequencesUnmarshal(t *testing.T) {
+	var req GenerateRequest
+
+	// A single string becomes a one-element list
+	require.NoError(t, json.Unmarshal([]byte(`{"stop": "\n\n"}`), &req))
+	assert.Equal(t, StopSequences{"\n\n"}, req.Stop)
+
+	// A list is kept as is
+	require.NoError(t, json.Unmarshal([]byte(`{"stop": ["END", "STOP"]}`), &req))
+	assert.Equal(t, StopSequences{"END", "STOP"}, req.Stop)
+
+	// Anything else is rejected
+	assert.Error(t, json.Unmarshal([]byte(`{"stop": 42}`), &req))
+}
+
+func TestRequestContext(t *testing.T) {
+	handler := setupTestHandler(t)
+
+	// Test getRequestID
+	req, err := http.NewRequest("GET", "/test", nil)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = req
+
+	requestID := handler.getRequestID(c)
+	assert.NotEmpty(t, requestID)
+
+	// Test getLogger
+	logger := handler.getLogger(c)
+	assert.NotNil(t, logger)
+
+	// Test getRequestContext when not set
+	requestCtx, exists := handler.getRequestContext(c)
+	assert.False(t, exists)
+	assert.Nil(t, requestCtx)
+}
+
+func BenchmarkHealthCheck(b *testing.B) {
+	handler := setupTestHandler(b)
+	router := setupTestRouter(handler)
+
+	req, err := http.NewRequest("GET", "/healthz", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+	}
+}
+
+func BenchmarkAuthMiddleware(b *testing.B) {
+	handler := setupTestHandler(b)
+
+	req, err := http.NewRequest("GET", "/test", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer test-api-key")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = req
+		handler.AuthMiddleware()(c)
+	}
+}
+
+// setupBenchmarkHandler creates a test handler that serves the generate path the way development
+// mode does: every model is answered by the fake provider, the user's balance never runs out and
+// request logging is discarded so it doesn't dominate the measurements
+func setupBenchmarkHandler(b *testing.B) *Handler {
+	handler := setupTestHandler(b)
+	handler.config.Dev.Enabled = true
+	handler.config.Timeouts = utils.TimeoutConfig{Provider: 10 * time.Second, Streaming: 10 * time.Second, MaxRequest: time.Minute}
+
+	_, err := handler.firebaseService.UpdateUserBalance(context.Background(), "mock-user-id", data.USDToMicros(1_000_000), data.LedgerEntryAdjustment, "")
+	require.NoError(b, err)
+
+	logger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.Cleanup(func() { slog.SetDefault(logger) })
+
+	return handler
+}
+
+// benchmarkGenerateBody is the request body of the generate benchmarks
+func benchmarkGenerateBody(b *testing.B) []byte {
+	body, err := json.Marshal(GenerateRequest{
+		Model:  "gpt-3.5-turbo",
+		Prompt: "Summarize the plot of Hamlet in three sentences.",
+	})
+	require.NoError(b, err)
+	return body
+}
+
+// BenchmarkGenerate measures a generate request through authentication, routing, the provider
+// call, billing and request logging
+func BenchmarkGenerate(b *testing.B) {
+	handler := setupBenchmarkHandler(b)
+	router := setupTestRouter(handler)
+	body := benchmarkGenerateBody(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest("POST", "/v1/generate", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer valid-api-key")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			b.Fatalf("status %d: %s", w.Code, w.Body.String())
+		}
+	}
+}
+
+// BenchmarkGenerateParallel measures concurrent generate requests by the same user, which contend
+// for their balance and usage rollups
+func BenchmarkGenerateParallel(b *testing.B) {
+	handler := setupBenchmarkHandler(b)
+	router := setupTestRouter(handler)
+	body := benchmarkGenerateBody(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req := httptest.NewRequest("POST", "/v1/generate", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer valid-api-key")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				b.Errorf("status %d: %s", w.Code, w.Body.String())
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkGenerateStream measures a streamed generate request read to its end. Streaming needs a
+// real connection, so the client's allocations are included.
+func BenchmarkGenerateStream(b *testing.B) {
+	handler := setupBenchmarkHandler(b)
+	server := httptest.NewServer(setupTestRouter(handler))
+	defer server.Close()
+	body := benchmarkGenerateBody(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req, err := http.NewRequest("POST", server.URL+"/v1/generate/stream", bytes.NewReader(body))
+		if err != nil {
+			b.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer valid-api-key")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			b.Fatalf("status %d", resp.StatusCode)
+		}
+	}
+}
+
+func TestDataExportAndAccountDeletion(t *testing.T) {
+	handler := setupTestHandler(t)
+	router := setupTestRouter(handler)
+
+	serve := func(method, path, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(http.MethodPost, "/v1/user/data-export", "", "")
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	var export data.DataExport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &export))
+	assert.Equal(t, data.DataExportPending, export.Status)
+
+	require.Eventually(t, func() bool {
+		w = serve(http.MethodGet, "/v1/user/data-export/"+export.ID, "", "")
+		return w.Code == http.StatusOK && strings.Contains(w.Body.String(), `"status":"completed"`)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	w = serve(http.MethodGet, "/v1/user/data-export/"+export.ID+"/download", "", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "attachment")
+	var content services.DataExportContent
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &content))
+	assert.Equal(t, "mock-user-id", content.UserID)
+	require.Len(t, content.Collections["api_keys"], 1)
+	assert.NotContains(t, content.Collections["api_keys"][0], "key_hash")
+
+	// Other users cannot see the export
+	w = serve(http.MethodGet, "/v1/user/data-export/"+export.ID+"/download", "", "other-user-id")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Deletion must be confirmed, and deactivates the account until it is purged
+	w = serve(http.MethodPost, "/v1/user/delete", `{}`, "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = serve(http.MethodPost, "/v1/user/delete", `{"confirm": true}`, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var deleted struct {
+		PurgeAfter time.Time `json:"purge_after"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &deleted))
+	assert.WithinDuration(t, time.Now().Add(30*24*time.Hour), deleted.PurgeAfter, time.Minute)
+
+	user, err := handler.firebaseService.GetUserByID(context.Background(), "mock-user-id")
+	require.NoError(t, err)
+	assert.False(t, user.IsActive)
+}
+
+func TestSessions(t *testing.T) {
+	handler := setupTestHandler(t)
+	router := setupTestRouter(handler)
+	handler.config.Optimization.SummaryMaxTokens = 40
+
+	llm := apttesting.NewLLMClient()
+	handler.generationService.SetClientFactory(llm.Factory())
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer valid-api-key")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(http.MethodPost, "/v1/sessions", `{"model": "no-such-model"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = serve(http.MethodPost, "/v1/sessions", `{"model": "gpt-3.5-turbo", "system": "Be brief.", "max_context_tokens": 300}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var session data.Session
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &session))
+	require.NotEmpty(t, session.ID)
+	path := "/v1/sessions/" + session.ID
+	maxTokens := 50
+
+	send := func(t *testing.T, content string) SessionMessageResponse {
+		body, err := json.Marshal(SessionMessageRequest{Content: content, MaxTokens: &maxTokens})
+		require.NoError(t, err)
+		w := serve(http.MethodPost, path+"/messages", string(body))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var response SessionMessageResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+
+	// The first message is sent as is, with the session's system instructions
+	llm.Queue(apttesting.Response{Text: "Hi! How can I help?", InputTokens: 10, OutputTokens: 5})
+	response := send(t, "Hello")
+	assert.Equal(t, "Hi! How can I help?", response.Text)
+	assert.Equal(t, 2, response.Session.MessageCount)
+	calls := llm.Calls()
+	require.Len(t, calls, 1)
+	assert.Equal(t, "Hello", calls[0].Params["prompt"])
+	assert.Equal(t, "Be brief.", calls[0].Params["system"])
+
+	// Later messages are sent with the history
+	llm.Queue(apttesting.Response{Text: strings.Repeat("beta ", 100), InputTokens: 120, OutputTokens: 100})
+	response = send(t, strings.Repeat("alpha ", 100))
+	assert.Equal(t, 4, response.Session.MessageCount)
+	calls = llm.Calls()
+	require.Len(t, calls, 2)
+	assert.Contains(t, calls[1].Params["prompt"], "Human: Hello\n\nAssistant: Hi! How can I help?\n\nHuman: alpha")
+	assert.Nil(t, response.Metadata["context_compression"])
+
+	// Once the history outgrows the session's context, its oldest messages are summarized by the
+	// optimizer model and the summary is sent in their place
+	llm.Queue(
+		apttesting.Response{Text: "The user greeted the assistant and listed alphas; it answered with betas.", InputTokens: 1000, OutputTokens: 100},
+		apttesting.Response{Text: "Gamma noted.", InputTokens: 150, OutputTokens: 3},
+	)
+	response = send(t, strings.Repeat("gamma ", 100))
+	assert.Equal(t, "Gamma noted.", response.Text)
+	calls = llm.Calls()
+	require.Len(t, calls, 4)
+	assert.Equal(t, "gemma-3-27b-it", calls[2].ModelID)
+	assert.Contains(t, calls[2].Params["prompt"], "Human: Hello")
+	assert.Equal(t, "gpt-3.5-turbo", calls[3].ModelID)
+	assert.NotContains(t, calls[3].Params["prompt"], "alpha")
+	assert.Equal(t, "Be brief.\n\nSummary of the conversation so far:\nThe user greeted the assistant and listed alphas; it answered with betas.", calls[3].Params["system"])
+
+	compression, ok := response.Metadata["context_compression"].(map[string]interface{})
+	require.True(t, ok, "compression is reported in the metadata")
+	assert.Equal(t, services.ContextCompressionSummarize, compression["strategy"])
+	assert.Equal(t, float64(4), compression["turns_compressed"])
+	assert.Equal(t, 6, response.Session.MessageCount)
+	assert.Equal(t, 4, response.Session.SummarizedMessages)
+	assert.Equal(t, "The user greeted the assistant and listed alphas; it answered with betas.", response.Session.Summary)
+
+	// Every message is kept, including the summarized ones
+	w = serve(http.MethodGet, path, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var history struct {
+		Session  data.Session          `json:"session"`
+		Messages []data.SessionMessage `json:"messages"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &history))
+	require.Len(t, history.Messages, 6)
+	assert.Equal(t, "Hello", history.Messages[0].Content)
+	assert.Equal(t, "Gamma noted.", history.Messages[5].Content)
+	assert.Equal(t, response.Session.TotalCost, history.Session.TotalCost)
+
+	// A message that cannot fit even alone is rejected
+	body, err := json.Marshal(SessionMessageRequest{Content: strings.Repeat("delta ", 400), MaxTokens: &maxTokens})
+	require.NoError(t, err)
+	w = serve(http.MethodPost, path+"/messages", string(body))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = serve(http.MethodDelete, path, "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = serve(http.MethodGet, path, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestCostReconciliation(t *testing.T) {
+	handler := setupTestHandler(t)
+	router := setupTestRouter(handler)
+	router.GET("/v1/admin/reconciliation", handler.ListCostReconciliations)
+	router.POST("/v1/admin/reconciliation/run", handler.RunCostReconciliation)
+	router.POST("/v1/admin/reconciliation/billing/:provider", handler.ImportBillingExport)
+
+	ctx := context.Background()
+	day := data.RollupBucket(data.RollupDaily, time.Now()).AddDate(0, 0, -1)
+	for _, log := range []*data.RequestLog{
+		{ID: "req-1", UserID: "mock-user-id", Provider: "openai", ModelID: "gpt-4o", BaseCost: 10_000_000, RequestTimestamp: day.Add(time.Hour)},
+		{ID: "req-2", UserID: "mock-user-id", Provider: "openai", ModelID: "gpt-4o-mini", BaseCost: 2_000_000, RequestTimestamp: day.Add(time.Hour)},
+	} {
+		require.NoError(t, handler.firebaseService.LogRequest(ctx, log))
+	}
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "text/csv")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	csv := "date,model,cost\n" + day.Format(time.DateOnly) + ",gpt-4o,14.50\n" + day.Format(time.DateOnly) + ",gpt-4o-mini,2.00\n"
+	w := serve(http.MethodPost, "/v1/admin/reconciliation/billing/openai", csv)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"cost":14.500000`)
+
+	w = serve(http.MethodPost, "/v1/admin/reconciliation/run", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"flagged":1`)
+
+	// The gpt-4o pricing is $4.50 behind the bill
+	w = serve(http.MethodGet, "/v1/admin/reconciliation?flagged=true", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var listed struct {
+		Reconciliations []*data.CostReconciliation `json:"reconciliations"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	require.Len(t, listed.Reconciliations, 1)
+	assert.Equal(t, "gpt-4o", listed.Reconciliations[0].ModelID)
+	assert.Equal(t, data.MicroUSD(4_500_000), listed.Reconciliations[0].Difference)
+
+	t.Run("Errors", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, "/v1/admin/reconciliation/billing/mistral", csv).Code)
+		assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, "/v1/admin/reconciliation/billing/openai", "date,model\n").Code)
+		assert.Equal(t, http.StatusBadRequest, serve(http.MethodGet, "/v1/admin/reconciliation?since=yesterday", "").Code)
+	})
+}
+
+func TestDisplayCurrency(t *testing.T) {
+	handler := setupTestHandler(t)
+	router := setupTestRouter(handler)
+	withUser := func(handle gin.HandlerFunc) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.Set(string(userIDGinKey), "mock-user-id")
+			handle(c)
+		}
+	}
+	router.GET("/v1/billing/currency", withUser(handler.GetCurrency))
+	router.PUT("/v1/billing/currency", withUser(handler.UpdateCurrency))
+	router.GET("/v1/billing/invoices", withUser(handler.GetInvoice))
+
+	ctx := context.Background()
+	require.NoError(t, handler.firebaseService.SetExchangeRates(ctx, &data.ExchangeRates{
+		Day:   data.RollupBucket(data.RollupDaily, time.Now()).AddDate(0, 0, -1),
+		Rates: map[string]float64{"EUR": 0.9, "JPY": 150},
+	}))
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	var balance struct {
+		Currency  services.ExchangeRate `json:"currency"`
+		Converted map[string]float64    `json:"converted"`
+	}
+
+	w := serve(http.MethodGet, "/v1/billing/currency", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"currency":"USD"`)
+	assert.Contains(t, w.Body.String(), `"supported":["USD","EUR","JPY"]`)
+
+	// The balance is accounted in USD and converted on request
+	w = serve(http.MethodGet, "/v1/user/balance?currency=eur", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &balance))
+	assert.Equal(t, "EUR", balance.Currency.Currency)
+	assert.Equal(t, 9.0, balance.Converted["balance"])
+	assert.Contains(t, w.Body.String(), `"balance":10.000000`)
+
+	// A preferred currency applies without the query parameter
+	w = serve(http.MethodPut, "/v1/billing/currency", `{"currency": "JPY"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = serve(http.MethodGet, "/v1/user/balance", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &balance))
+	assert.Equal(t, "JPY", balance.Currency.Currency)
+	assert.Equal(t, 1500.0, balance.Converted["balance"])
+
+	w = serve(http.MethodGet, "/v1/billing/invoices", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"code":"JPY"`)
+	assert.Contains(t, w.Body.String(), `"total_spend":0`)
+
+	t.Run("Errors", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, serve(http.MethodPut, "/v1/billing/currency", `{"currency": "XYZ"}`).Code)
+		assert.Equal(t, http.StatusBadRequest, serve(http.MethodGet, "/v1/user/balance?currency=GBP", "").Code)
+		// Statements of months before the first rates can't be converted
+		assert.Equal(t, http.StatusServiceUnavailable, serve(http.MethodGet, "/v1/billing/invoices?period=2020-01", "").Code)
+		assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/v1/billing/invoices?period=2020-01&currency=USD", "").Code)
+	})
 }
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// readinessTimeout bounds how long the readiness probe waits on Firestore
+const readinessTimeout = 3 * time.Second
+
+// Dependency statuses reported by the readiness probe
+const (
+	dependencyOK       = "ok"
+	dependencyDegraded = "degraded"
+	dependencyDown     = "down"
+	dependencyDisabled = "disabled"
+)
+
+// DependencyStatus reports the state of one dependency in a readiness probe
+type DependencyStatus struct {
+	Status string `json:"status"`
+	// Critical dependencies being down make the service unready
+	Critical  bool                   `json:"critical"`
+	Error     string                 `json:"error,omitempty"`
+	LatencyMs int64                  `json:"latency_ms,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+// ReadinessCheck handles the readiness probe, returning 503 while a critical dependency is down
+func (h *Handler) ReadinessCheck(c *gin.Context) {
+	checks := map[string]DependencyStatus{
+		"firestore": h.checkFirestore(c.Request.Context()),
+		"pricing":   h.checkPricing(),
+		"providers": h.checkProviders(),
+		"optimizer": h.checkOptimizer(),
+	}
+
+	status, code := "ready", http.StatusOK
+	for _, check := range checks {
+		if check.Status == dependencyDown && check.Critical {
+			status, code = "unavailable", http.StatusServiceUnavailable
+			break
+		}
+		if check.Status == dependencyDown || check.Status == dependencyDegraded {
+			status = "degraded"
+		}
+	}
+
+	if code != http.StatusOK {
+		h.getLogger(c).Warn("Readiness check failed", "checks", checks)
+	}
+
+	c.JSON(code, gin.H{
+		"status":  status,
+		"service": "apt-router-api",
+		"checks":  checks,
+	})
+}
+
+// checkFirestore verifies Firestore answers a read within the readiness timeout
+func (h *Handler) checkFirestore(ctx context.Context) DependencyStatus {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := h.firebaseService.Ping(ctx)
+	check := DependencyStatus{Status: dependencyOK, Critical: true, LatencyMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		check.Status = dependencyDown
+		check.Error = err.Error()
+	}
+	return check
+}
+
+// checkPricing verifies model configurations are loaded and the snapshot listeners keeping them fresh are connected
+func (h *Handler) checkPricing() DependencyStatus {
+	count := h.pricingService.ModelConfigCount()
+	listeners := h.pricingService.GetListenerStats()
+	check := DependencyStatus{
+		Status:   dependencyOK,
+		Critical: true,
+		Details: map[string]interface{}{
+			"model_configs": count,
+			"listeners":     listeners,
+		},
+	}
+
+	if count == 0 {
+		check.Status = dependencyDown
+		check.Error = "no model configurations loaded"
+		return check
+	}
+	for collection, listener := range listeners {
+		if !listener.Connected {
+			// Cached pricing still serves requests, it just may be stale
+			check.Status = dependencyDegraded
+			check.Error = collection + " listener disconnected"
+		}
+	}
+	return check
+}
+
+// checkProviders verifies at least one LLM provider has an API key configured
+func (h *Handler) checkProviders() DependencyStatus {
+	google := h.config.ProviderKey("google") != ""
+	openai := h.config.ProviderKey("openai") != ""
+	anthropic := h.config.ProviderKey("anthropic") != ""
+
+	check := DependencyStatus{
+		Status:   dependencyOK,
+		Critical: true,
+		Details: map[string]interface{}{
+			"google":    google,
+			"openai":    openai,
+			"anthropic": anthropic,
+		},
+	}
+	if !google && !openai && !anthropic {
+		check.Status = dependencyDown
+		check.Error = "no provider API keys configured"
+	}
+	return check
+}
+
+// checkOptimizer reports whether prompt optimization is available; requests run unoptimized without it
+func (h *Handler) checkOptimizer() DependencyStatus {
+	switch {
+	case !h.config.Optimization.Enabled:
+		return DependencyStatus{Status: dependencyDisabled}
+	case !h.generationService.OptimizerAvailable():
+		return DependencyStatus{Status: dependencyDown, Error: "optimizer failed to initialize"}
+	default:
+		return DependencyStatus{Status: dependencyOK}
+	}
+}
@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+)
+
+// impersonationIssuer marks the tokens AptRouter signs for admins to view a user's account, telling
+// them apart from Firebase ID tokens
+const impersonationIssuer = "aptrouter-impersonation"
+
+// impersonatorGinKey holds the admin behind an impersonated request
+const impersonatorGinKey ginContextKey = "impersonator"
+
+// impersonationDeniedRoutes are the route prefixes impersonation tokens may not read even though
+// they are GET endpoints under /v1/user, because they hand over a copy of the user's data
+var impersonationDeniedRoutes = []string{
+	"/v1/user/data-export",
+}
+
+// impersonationClaims are the claims of an impersonation token; the subject is the user viewed
+type impersonationClaims struct {
+	jwt.RegisteredClaims
+	// AdminID is the platform admin the token was issued to
+	AdminID string `json:"admin_id"`
+	Reason  string `json:"reason"`
+}
+
+// ImpersonateUserRequest represents a request for an impersonation token
+type ImpersonateUserRequest struct {
+	// Reason says why support needs the user's view, such as a ticket reference; it is audited
+	Reason string `json:"reason" binding:"required,max=500"`
+}
+
+// ImpersonateUser handles issuing a short-lived token that lets an admin make read-only requests to
+// the /v1/user and /v1/keys endpoints as a user, to reproduce what the user sees. Issuing the token
+// and every request made with it are audited with the admin as the actor.
+func (h *Handler) ImpersonateUser(c *gin.Context) {
+	var req ImpersonateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body: a reason is required",
+		})
+		return
+	}
+
+	user, err := h.firebaseService.GetUserByID(c.Request.Context(), c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "User not found",
+		})
+		return
+	}
+
+	adminID, _ := h.getAuthenticatedUserID(c)
+	now := time.Now()
+	claims := impersonationClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Issuer:    impersonationIssuer,
+			Subject:   user.ID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(h.config.Security.ImpersonationTokenTTL)),
+		},
+		AdminID: adminID,
+		Reason:  req.Reason,
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(h.config.Security.JWTSecret))
+	if err != nil {
+		h.getLogger(c).Error("Failed to sign impersonation token", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create impersonation token",
+		})
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditImpersonationStarted,
+		TargetID: user.ID,
+		Details: map[string]interface{}{
+			"reason":     req.Reason,
+			"token_id":   claims.ID,
+			"expires_at": claims.ExpiresAt.Time,
+		},
+	})
+
+	c.JSON(http.StatusCreated, gin.H{
+		"token":      token,
+		"token_type": "Bearer",
+		"user_id":    user.ID,
+		"expires_at": claims.ExpiresAt.Time,
+	})
+}
+
+// isImpersonationToken reports whether a bearer token claims to be an impersonation token, without
+// verifying it
+func isImpersonationToken(token string) bool {
+	var claims impersonationClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(token, &claims); err != nil {
+		return false
+	}
+	return claims.Issuer == impersonationIssuer
+}
+
+// verifyImpersonationToken checks an impersonation token's signature and expiry, and that the admin
+// it was issued to still is one
+func (h *Handler) verifyImpersonationToken(token string) (*impersonationClaims, error) {
+	var claims impersonationClaims
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if _, err := parser.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) {
+		return []byte(h.config.Security.JWTSecret), nil
+	}); err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" || !h.config.IsAdmin(claims.AdminID) {
+		return nil, errors.New("impersonation token was not issued to a platform admin")
+	}
+	return &claims, nil
+}
+
+// impersonationDenied reports whether route is closed to impersonation tokens
+func impersonationDenied(route string) bool {
+	for _, prefix := range impersonationDeniedRoutes {
+		if strings.HasPrefix(route, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateImpersonation authenticates a request made with an impersonation token, allowing
+// only read-only requests where allowed, and audits it once handled
+func (h *Handler) authenticateImpersonation(c *gin.Context, token string, allowed bool) {
+	claims, err := h.verifyImpersonationToken(token)
+	if err != nil {
+		h.getLogger(c).Warn("Failed to verify impersonation token", "error", err)
+		h.recordAuthFailure(c, "invalid_impersonation_token", nil)
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Invalid authorization token",
+		})
+		c.Abort()
+		return
+	}
+
+	if !allowed || c.Request.Method != http.MethodGet || impersonationDenied(c.FullPath()) {
+		h.recordAuthFailure(c, "impersonation_not_allowed", map[string]interface{}{
+			"admin_id": claims.AdminID,
+			"user_id":  claims.Subject,
+			"method":   c.Request.Method,
+		})
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "Impersonation tokens can only read /v1/user and /v1/keys endpoints, except data exports",
+		})
+		c.Abort()
+		return
+	}
+
+	c.Set(string(userIDGinKey), claims.Subject)
+	c.Set(string(impersonatorGinKey), claims.AdminID)
+	c.Next()
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditImpersonatedRequest,
+		TargetID: claims.Subject,
+		Details: map[string]interface{}{
+			"method":   c.Request.Method,
+			"path":     c.Request.URL.Path,
+			"status":   c.Writer.Status(),
+			"token_id": claims.ID,
+		},
+	})
+}
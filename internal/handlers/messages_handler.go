@@ -0,0 +1,429 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// MessagesRequest is an Anthropic Messages API request. Any model in the catalog can be named;
+// the conversation is routed through the same pipeline as /v1/generate.
+type MessagesRequest struct {
+	Model         string          `json:"model" binding:"required"`
+	MaxTokens     int             `json:"max_tokens" binding:"required,min=1"`
+	Messages      []Message       `json:"messages" binding:"required,min=1,dive"`
+	System        MessageContent  `json:"system,omitempty"`
+	Temperature   *float64        `json:"temperature,omitempty" binding:"omitempty,min=0,max=1"`
+	TopP          *float64        `json:"top_p,omitempty" binding:"omitempty,min=0,max=1"`
+	StopSequences []string        `json:"stop_sequences,omitempty" binding:"max=4"`
+	Stream        bool            `json:"stream,omitempty"`
+	Tools         json.RawMessage `json:"tools,omitempty"`
+	// Thinking enables extended thinking with a budget of thinking tokens
+	Thinking *MessagesThinking `json:"thinking,omitempty"`
+	// ContextCompression set to "summarize" summarizes the oldest messages with the optimizer model
+	// when the conversation does not fit the model's context window, rather than rejecting it
+	ContextCompression string `json:"context_compression,omitempty" binding:"omitempty,oneof=none summarize"`
+}
+
+// MessagesThinking is the Messages API extended thinking configuration
+type MessagesThinking struct {
+	Type         string `json:"type" binding:"required,oneof=enabled disabled"`
+	BudgetTokens int    `json:"budget_tokens" binding:"omitempty,min=1024"`
+}
+
+// Message is one turn of a Messages API conversation
+type Message struct {
+	Role    string         `json:"role" binding:"required,oneof=user assistant"`
+	Content MessageContent `json:"content" binding:"required"`
+}
+
+// MessageContentBlock is a content block of a message. Only text blocks are supported.
+type MessageContentBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+	// CacheControl asks for the content up to and including the block to be cached
+	CacheControl *CacheControl `json:"cache_control,omitempty"`
+}
+
+// MessageContent is a list of content blocks that also unmarshals from a single string
+type MessageContent []MessageContentBlock
+
+// UnmarshalJSON accepts either a string or an array of content blocks
+func (m *MessageContent) UnmarshalJSON(b []byte) error {
+	var text string
+	if err := json.Unmarshal(b, &text); err == nil {
+		*m = MessageContent{{Type: "text", Text: text}}
+		return nil
+	}
+
+	var blocks []MessageContentBlock
+	if err := json.Unmarshal(b, &blocks); err != nil {
+		return fmt.Errorf("content must be a string or an array of content blocks")
+	}
+	*m = blocks
+	return nil
+}
+
+// text joins the content's text blocks, rejecting blocks of any other type
+func (m MessageContent) text() (string, error) {
+	parts := make([]string, 0, len(m))
+	for _, block := range m {
+		if block.Type != "text" {
+			return "", fmt.Errorf("content blocks of type %q are not supported", block.Type)
+		}
+		parts = append(parts, block.Text)
+	}
+	return strings.Join(parts, "\n\n"), nil
+}
+
+// cached reports whether any block asks to be cached
+func (m MessageContent) cached() bool {
+	for _, block := range m {
+		if block.CacheControl != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// MessagesResponse is an Anthropic Messages API response
+type MessagesResponse struct {
+	ID           string                `json:"id"`
+	Type         string                `json:"type"`
+	Role         string                `json:"role"`
+	Model        string                `json:"model"`
+	Content      []MessageContentBlock `json:"content"`
+	StopReason   *string               `json:"stop_reason"`
+	StopSequence *string               `json:"stop_sequence"`
+	Usage        MessagesUsage         `json:"usage"`
+	// ContextCompression reports how the conversation was compressed to fit, when it was
+	ContextCompression *services.ContextCompression `json:"context_compression,omitempty"`
+}
+
+// MessagesUsage is the token usage of a Messages API response
+type MessagesUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	// Cache reads and writes, which Anthropic reports apart from input_tokens
+	CacheReadInputTokens     int `json:"cache_read_input_tokens,omitempty"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens,omitempty"`
+}
+
+// Messages handles the Anthropic Messages-compatible endpoint, so clients built on the Anthropic
+// SDK can be pointed at the router. Responses, stream events and errors use Anthropic's formats.
+func (h *Handler) Messages(c *gin.Context) {
+	startTime := time.Now()
+
+	requestCtx, exists := h.getRequestContext(c)
+	if !exists {
+		messagesError(c, http.StatusInternalServerError, "Request context not found")
+		return
+	}
+
+	var req MessagesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		messagesError(c, http.StatusBadRequest, "Invalid request format: "+err.Error())
+		return
+	}
+
+	serviceReq, err := newMessagesGenerationRequest(&req)
+	if err != nil {
+		messagesError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if serviceReq.Stream {
+		h.streamMessages(c, requestCtx, serviceReq, startTime)
+		return
+	}
+
+	resp, genErr := h.runGeneration(c.Request.Context(), requestCtx, serviceReq, startTime)
+	if genErr != nil {
+		message, _ := genErr.Body["error"].(string)
+		messagesError(c, genErr.Status, message)
+		return
+	}
+
+	stopReason := messagesStopReason(resp.FinishReason)
+	out := &MessagesResponse{
+		ID:         "msg_" + requestCtx.RequestID,
+		Type:       "message",
+		Role:       "assistant",
+		Model:      resp.Model,
+		Content:    []MessageContentBlock{{Type: "text", Text: resp.Text}},
+		StopReason: &stopReason,
+		// The request is compressed by the service, which reports it on the request
+		ContextCompression: serviceReq.ContextCompression,
+	}
+	if resp.Usage != nil {
+		out.Usage = MessagesUsage{
+			InputTokens:              resp.Usage.InputTokens - resp.Usage.CachedInputTokens - resp.Usage.CacheWriteInputTokens,
+			OutputTokens:             resp.Usage.OutputTokens,
+			CacheReadInputTokens:     resp.Usage.CachedInputTokens,
+			CacheCreationInputTokens: resp.Usage.CacheWriteInputTokens,
+		}
+	}
+
+	c.Header("X-Request-ID", requestCtx.RequestID)
+	c.JSON(http.StatusOK, out)
+}
+
+// newMessagesGenerationRequest converts a Messages request into a service request. The system
+// prompt is sent as the caller's system instructions, after any managed system prompt.
+func newMessagesGenerationRequest(req *MessagesRequest) (*services.GenerationRequest, error) {
+	if len(req.Tools) > 0 && string(req.Tools) != "null" && string(req.Tools) != "[]" {
+		return nil, fmt.Errorf("tools are not supported")
+	}
+	if req.Messages[0].Role != "user" {
+		return nil, fmt.Errorf("the first message must use the user role")
+	}
+
+	conversation, err := messagesConversation(req.Messages)
+	if err != nil {
+		return nil, err
+	}
+	system, err := req.System.text()
+	if err != nil {
+		return nil, fmt.Errorf("system: %w", err)
+	}
+	conversation.System = system
+
+	serviceReq := &services.GenerationRequest{
+		Model:       req.Model,
+		Prompt:      conversation.Prompt(),
+		MaxTokens:   req.MaxTokens,
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+		Stop:        req.StopSequences,
+		Stream:      req.Stream,
+	}
+	if system != "" {
+		serviceReq.Extra = map[string]interface{}{"system": system}
+	}
+	if req.ContextCompression == services.ContextCompressionSummarize {
+		serviceReq.Conversation = &conversation
+	}
+	// max_tokens includes the thinking budget here, while the pipeline's excludes it
+	if req.Thinking != nil && req.Thinking.Type == "enabled" {
+		if req.Thinking.BudgetTokens == 0 {
+			return nil, fmt.Errorf("thinking.budget_tokens is required when thinking is enabled")
+		}
+		if req.Thinking.BudgetTokens >= req.MaxTokens {
+			return nil, fmt.Errorf("max_tokens must be greater than thinking.budget_tokens")
+		}
+		serviceReq.ThinkingBudget = req.Thinking.BudgetTokens
+		serviceReq.MaxTokens -= req.Thinking.BudgetTokens
+	}
+	serviceReq.CacheSystem = req.System.cached()
+	for _, message := range req.Messages {
+		serviceReq.CachePrompt = serviceReq.CachePrompt || message.Content.cached()
+	}
+	return serviceReq, nil
+}
+
+// messagesPrompt flattens a conversation into the single prompt the generation pipeline sends
+func messagesPrompt(messages []Message) (string, error) {
+	conversation, err := messagesConversation(messages)
+	if err != nil {
+		return "", err
+	}
+	return conversation.Prompt(), nil
+}
+
+// messagesConversation converts messages into the turns of a conversation
+func messagesConversation(messages []Message) (services.Conversation, error) {
+	conversation := services.Conversation{Turns: make([]services.ConversationTurn, len(messages))}
+	for i, message := range messages {
+		text, err := message.Content.text()
+		if err != nil {
+			return services.Conversation{}, fmt.Errorf("messages[%d]: %w", i, err)
+		}
+		conversation.Turns[i] = services.ConversationTurn{Role: message.Role, Text: text}
+	}
+	return conversation, nil
+}
+
+// messagesStopReason maps a normalized finish reason to an Anthropic stop reason
+func messagesStopReason(finishReason string) string {
+	switch finishReason {
+	case data.FinishReasonLength, services.FinishReasonLengthCapped:
+		return "max_tokens"
+	case data.FinishReasonToolCalls:
+		return "tool_use"
+	case data.FinishReasonContentFilter:
+		return "refusal"
+	default:
+		return "end_turn"
+	}
+}
+
+// messagesErrorType returns the Anthropic error type for an HTTP status
+func messagesErrorType(status int) string {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusPaymentRequired:
+		return "billing_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case http.StatusGatewayTimeout:
+		return "timeout_error"
+	default:
+		return "api_error"
+	}
+}
+
+// messagesErrorBody builds an error in the Anthropic format
+func messagesErrorBody(status int, message string) gin.H {
+	return gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    messagesErrorType(status),
+			"message": message,
+		},
+	}
+}
+
+// messagesError writes an error response in the Anthropic format
+func messagesError(c *gin.Context, status int, message string) {
+	c.JSON(status, messagesErrorBody(status, message))
+}
+
+// streamMessages runs a streaming generation and writes it as Anthropic Messages stream events.
+// Providers report streaming usage only to billing, so the usage in the events is estimated.
+func (h *Handler) streamMessages(c *gin.Context, requestCtx *RequestContext, serviceReq *services.GenerationRequest, startTime time.Time) {
+	inputTokens := services.EstimateTokens(serviceReq.Prompt)
+
+	// Cancelling ctx aborts the provider stream, so the background reader can be stopped
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	streamResp, err := h.generationService.GenerateStream(ctx, serviceReq, requestCtx.serviceContext())
+	if err != nil {
+		h.logGenerationFailure(c.Request.Context(), requestCtx, serviceReq, err, startTime)
+		requestCtx.Logger.Warn("Messages stream failed to start", "error", err, "model", serviceReq.Model)
+		// Nothing has been written yet, so the failure can still be reported as JSON
+		genErr := streamStartError(err)
+		message, _ := genErr.Body["error"].(string)
+		messagesError(c, genErr.Status, message)
+		return
+	}
+	// Closing the stream releases its timeout and records usage and billing
+	defer streamResp.Stream.Close()
+	chunks := readStreamChunks(streamResp.Stream)
+	defer stopStreamChunks(cancel, chunks)
+	heartbeat, stopHeartbeat := h.sseHeartbeat()
+	defer stopHeartbeat()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Request-ID", requestCtx.RequestID)
+
+	writeEvent := func(w io.Writer, event string, payload gin.H) bool {
+		payload["type"] = event
+		body, _ := json.Marshal(payload)
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, body); err != nil {
+			requestCtx.Logger.Warn("Failed to write messages stream event", "event", event, "error", err)
+			return false
+		}
+		return true
+	}
+
+	// serviceReq.Model has been resolved from any alias by the service, and its conversation compressed
+	message := gin.H{
+		"id":            "msg_" + requestCtx.RequestID,
+		"type":          "message",
+		"role":          "assistant",
+		"model":         serviceReq.Model,
+		"content":       []MessageContentBlock{},
+		"stop_reason":   nil,
+		"stop_sequence": nil,
+		"usage":         MessagesUsage{InputTokens: inputTokens},
+	}
+	if serviceReq.ContextCompression != nil {
+		message["context_compression"] = serviceReq.ContextCompression
+		message["usage"] = MessagesUsage{InputTokens: services.EstimateTokens(serviceReq.Prompt)}
+	}
+	started := writeEvent(c.Writer, "message_start", gin.H{"message": message}) &&
+		writeEvent(c.Writer, "content_block_start", gin.H{"index": 0, "content_block": MessageContentBlock{Type: "text"}}) &&
+		writeEvent(c.Writer, "ping", gin.H{})
+	if !started {
+		return
+	}
+	c.Writer.Flush()
+
+	var pending []byte
+	// The output is counted as it streams rather than kept, for its usage estimate
+	var outputRunes int
+	c.Stream(func(w io.Writer) bool {
+		var chunk streamChunk
+		select {
+		case chunk = <-chunks:
+		case <-heartbeat:
+			return writeSSEHeartbeat(w)
+		}
+		defer chunk.release()
+		readErr := chunk.err
+		if len(chunk.data) > 0 {
+			pending = append(pending, chunk.data...)
+			// Hold back a rune split across reads so every delta is valid UTF-8
+			complete := completeUTF8Prefix(pending)
+			if complete > 0 {
+				outputRunes += utf8.RuneCount(pending[:complete])
+				if !writeEvent(w, "content_block_delta", gin.H{"index": 0, "delta": gin.H{"type": "text_delta", "text": string(pending[:complete])}}) {
+					return false
+				}
+				pending = append(pending[:0], pending[complete:]...)
+			}
+		}
+		if readErr == nil {
+			return true
+		}
+
+		if readErr != io.EOF {
+			// Headers are already sent, so report the failure as an error event
+			requestCtx.Logger.Warn("Messages stream read failed", "error", readErr)
+			status := http.StatusInternalServerError
+			if errors.Is(readErr, services.ErrProviderTimeout) {
+				status = http.StatusGatewayTimeout
+			}
+			writeEvent(w, "error", messagesErrorBody(status, readErr.Error()))
+			return false
+		}
+
+		if len(pending) > 0 {
+			outputRunes += utf8.RuneCount(pending)
+			if !writeEvent(w, "content_block_delta", gin.H{"index": 0, "delta": gin.H{"type": "text_delta", "text": string(pending)}}) {
+				return false
+			}
+		}
+		if writeEvent(w, "content_block_stop", gin.H{"index": 0}) && writeEvent(w, "message_delta", gin.H{
+			"delta": gin.H{"stop_reason": messagesStopReason(streamFinishReason(streamResp.Stream)), "stop_sequence": nil},
+			"usage": gin.H{"output_tokens": services.EstimateTokensFromRunes(outputRunes)},
+		}) {
+			writeEvent(w, "message_stop", gin.H{})
+		}
+		return false
+	})
+
+	requestCtx.Logger.Info("Messages stream completed", "duration_ms", time.Since(startTime).Milliseconds())
+}
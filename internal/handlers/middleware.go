@@ -1,18 +1,34 @@
 package handlers
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/apt-router/api/internal/data"
 	"github.com/apt-router/api/internal/services"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// tracer creates spans for the HTTP layer
+var tracer = otel.Tracer("github.com/apt-router/api/internal/handlers")
+
 // ContextKey types to avoid collisions with built-in string keys
 type contextKey string
 
@@ -27,26 +43,76 @@ const (
 type RequestContext struct {
 	RequestID   string
 	UserID      string
+	OrgID       string
 	APIKeyID    string
 	PricingTier services.PricingTier
-	Logger      *slog.Logger
+	// Priority is the request's priority class, from its tier and the X-Priority header
+	Priority string
+	// ClientIP and UserAgent identify the caller for request logs
+	ClientIP  string
+	UserAgent string
+	// Restrictions limits the models and token counts the API key may use
+	Restrictions *data.KeyRestrictions
+	// PostProcessing transforms the API key's completions before they are returned
+	PostProcessing *data.PostProcessing
+	// Tenant is the tenant the API key is bound to, or nil
+	Tenant *data.Tenant
+	// TestMode is set for test API keys, whose requests a fake provider answers for free
+	TestMode bool
+	Logger   *slog.Logger
 	// Cached user data for performance
 	CachedUser *CachedUserData
 }
 
+// userType returns the type of the request's user, empty for people
+func (r *RequestContext) userType() string {
+	if r.CachedUser == nil {
+		return ""
+	}
+	return r.CachedUser.UserType
+}
+
+// serviceContext returns the request's context for the service layer, which every transport
+// passes on to generation, estimates and sessions
+func (r *RequestContext) serviceContext() *services.RequestContext {
+	return &services.RequestContext{
+		RequestID:      r.RequestID,
+		UserID:         r.UserID,
+		OrgID:          r.OrgID,
+		APIKeyID:       r.APIKeyID,
+		ClientIP:       r.ClientIP,
+		UserAgent:      r.UserAgent,
+		PricingTier:    r.PricingTier,
+		Priority:       r.Priority,
+		Restrictions:   r.Restrictions,
+		PostProcessing: r.PostProcessing,
+		Tenant:         r.Tenant,
+		TestMode:       r.TestMode,
+		Logger:         r.Logger,
+		CachedUser:     convertCachedUserData(r.CachedUser),
+	}
+}
+
 // CachedUserData contains frequently accessed user information
 type CachedUserData struct {
-	ID            string    `json:"id"`
-	Email         string    `json:"email"`
-	Balance       float64   `json:"balance"`
-	TierID        string    `json:"tier_id"`
-	IsActive      bool      `json:"is_active"`
-	CustomPricing bool      `json:"custom_pricing"`
-	LastUpdated   time.Time `json:"last_updated"`
+	ID            string        `json:"id"`
+	Email         string        `json:"email"`
+	Balance       data.MicroUSD `json:"balance"`
+	TierID        string        `json:"tier_id"`
+	IsActive      bool          `json:"is_active"`
+	CustomPricing bool          `json:"custom_pricing"`
+	LastUpdated   time.Time     `json:"last_updated"`
+	// Credits is the user's unexpired promotional credit when the data was cached
+	Credits data.MicroUSD `json:"credits"`
+	// UserType is data.UserTypeServiceAccount for service accounts
+	UserType string `json:"user_type,omitempty"`
 }
 
-// RequestLogger middleware generates a unique request_id and injects a request-scoped logger
+// RequestLogger middleware generates a unique request_id and injects a request-scoped logger.
+// Completed requests are logged and recorded in the request metrics by route template; requests
+// slower than the configured threshold are also logged with a sanitized snippet of their payload.
 func (h *Handler) RequestLogger() gin.HandlerFunc {
+	slowThreshold := h.config.Logging.SlowRequestThreshold
 	return func(c *gin.Context) {
 		start := time.Now()
 		requestID := uuid.New().String()
@@ -60,6 +126,12 @@ func (h *Handler) RequestLogger() gin.HandlerFunc {
 			"remote_addr", c.ClientIP(),
 		)
 
+		// Correlate logs with the request's trace
+		if span := trace.SpanFromContext(c.Request.Context()); span.SpanContext().IsValid() {
+			span.SetAttributes(attribute.String("request.id", requestID))
+			logger = logger.With("trace_id", span.SpanContext().TraceID().String())
+		}
+
 		// Store logger in context
 		ctx := context.WithValue(c.Request.Context(), loggerKey, logger)
 		c.Request = c.Request.WithContext(ctx)
@@ -68,17 +140,250 @@ func (h *Handler) RequestLogger() gin.HandlerFunc {
 		ctx = context.WithValue(ctx, requestIDKey, requestID)
 		c.Request = c.Request.WithContext(ctx)
 
+		// Keep the start of the body in case the request turns out to be slow
+		var payload *payloadRecorder
+		if slowThreshold > 0 && c.Request.Body != nil && c.Request.Body != http.NoBody {
+			payload = &payloadRecorder{ReadCloser: c.Request.Body}
+			c.Request.Body = payload
+		}
+
 		// Process request
 		c.Next()
 
-		// Log request completion with performance metrics
+		// Name requests by route template to keep metric cardinality low
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := c.Writer.Status()
+		size := max(c.Writer.Size(), 0)
 		duration := time.Since(start)
+
+		h.httpMetrics.record(c.Request.Context(), c.Request.Method, route, status, duration, size)
+
+		// Log request completion with performance metrics
 		logger.Info("Request completed",
-			"status", c.Writer.Status(),
+			"route", route,
+			"status", status,
 			"duration_ms", duration.Milliseconds(),
-			"bytes", c.Writer.Size(),
+			"bytes", size,
+		)
+
+		if slowThreshold > 0 && duration > slowThreshold {
+			attrs := []any{
+				"route", route,
+				"status", status,
+				"duration_ms", duration.Milliseconds(),
+				"threshold_ms", slowThreshold.Milliseconds(),
+				"bytes", size,
+			}
+			if requestCtx, ok := h.getRequestContext(c); ok {
+				attrs = append(attrs, "user_id", requestCtx.UserID, "api_key_id", requestCtx.APIKeyID)
+			}
+			if payload != nil {
+				attrs = append(attrs,
+					"request_bytes", payload.total,
+					"payload", payload.snippet(h.config.Logging.SlowRequestSnippetBytes, h.config.Logging.RequestPayloads),
+				)
+			}
+			logger.Warn("Slow request", attrs...)
+		}
+	}
+}
+
+// TracingMiddleware starts a server span for each request, continuing any trace propagated by the caller
+func (h *Handler) TracingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+		// Name spans by route template to keep cardinality low
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		ctx, span := tracer.Start(ctx, c.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", c.Request.Method),
+				attribute.String("http.route", route),
+				attribute.String("client.address", c.ClientIP()),
+				attribute.String("user_agent.original", c.Request.UserAgent()),
+			),
 		)
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// BodyLimitMiddleware rejects request bodies larger than the configured limit with 413.
+// The body is read up front so oversized requests fail before JSON binding starts.
+func (h *Handler) BodyLimitMiddleware() gin.HandlerFunc {
+	limit := h.config.Server.MaxRequestBodyBytes
+	return func(c *gin.Context) {
+		if c.Request.Body == nil || c.Request.Body == http.NoBody {
+			c.Next()
+			return
+		}
+
+		if c.Request.ContentLength > limit {
+			h.abortBodyTooLarge(c, limit)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, limit))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				h.abortBodyTooLarge(c, limit)
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error": "Failed to read request body",
+			})
+			return
+		}
+
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		c.Next()
+	}
+}
+
+// abortBodyTooLarge aborts the request with a 413 naming the limit
+func (h *Handler) abortBodyTooLarge(c *gin.Context, limit int64) {
+	h.getLogger(c).Warn("Request body too large", "content_length", c.Request.ContentLength, "limit", limit)
+	c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{
+		"error":     fmt.Sprintf("Request body exceeds the %d byte limit", limit),
+		"code":      "request_too_large",
+		"max_bytes": limit,
+	})
+}
+
+// compressor is implemented by both gzip.Writer and flate.Writer
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// compressorPools reuse encoders across responses, keyed by Content-Encoding
+var compressorPools = map[string]*sync.Pool{
+	"gzip": {New: func() any { return gzip.NewWriter(io.Discard) }},
+	"deflate": {New: func() any {
+		w, _ := flate.NewWriter(io.Discard, flate.DefaultCompression)
+		return w
+	}},
+}
+
+// CompressionMiddleware gzip or deflate encodes JSON responses for clients that accept it.
+// Other content types, including SSE streams, are written unchanged.
+func (h *Handler) CompressionMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(c.GetHeader("Accept-Encoding"))
+		if encoding == "" {
+			c.Next()
+			return
+		}
+
+		writer := &compressWriter{ResponseWriter: c.Writer, encoding: encoding}
+		c.Writer = writer
+		defer writer.close()
+
+		c.Next()
+	}
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header, preferring gzip
+func negotiateEncoding(header string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		// q=0 explicitly refuses an encoding
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				continue
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = true
 	}
+
+	switch {
+	case accepted["gzip"], accepted["*"]:
+		return "gzip"
+	case accepted["deflate"]:
+		return "deflate"
+	default:
+		return ""
+	}
+}
+
+// compressWriter decides on its first write whether to compress the response, based on its Content-Type
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding string
+	encoder  compressor
+	decided  bool
+}
+
+// Write implements io.Writer
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.decide()
+	}
+	if w.encoder == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.encoder.Write(b)
+}
+
+// WriteString implements io.StringWriter
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush flushes buffered compressed data before flushing the connection
+func (w *compressWriter) Flush() {
+	if w.encoder != nil {
+		_ = w.encoder.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// decide starts compressing if the response is JSON and not already encoded
+func (w *compressWriter) decide() {
+	w.decided = true
+
+	header := w.Header()
+	if header.Get("Content-Encoding") != "" || !strings.HasPrefix(header.Get("Content-Type"), "application/json") {
+		return
+	}
+
+	header.Set("Content-Encoding", w.encoding)
+	header.Del("Content-Length")
+
+	w.encoder = compressorPools[w.encoding].Get().(compressor)
+	w.encoder.Reset(w.ResponseWriter)
+}
+
+// close finishes the compressed stream and returns the encoder to its pool
+func (w *compressWriter) close() {
+	if w.encoder == nil {
+		return
+	}
+	_ = w.encoder.Close()
+	w.encoder.Reset(io.Discard)
+	compressorPools[w.encoding].Put(w.encoder)
+	w.encoder = nil
 }
 
 // APIKeyData represents an API key from the database
@@ -92,17 +397,19 @@ type APIKeyData struct {
 
 // UserProfile represents a user profile from the database
 type UserProfile struct {
-	ID      string  `json:"id"`
-	Email   string  `json:"email"`
-	Balance float64 `json:"balance"`
+	ID      string        `json:"id"`
+	Email   string        `json:"email"`
+	Balance data.MicroUSD `json:"balance"`
 }
 
 // hashAPIKey hashes the API key using SHA-256 with salt
 func (h *Handler) hashAPIKey(apiKey string) string {
-	// Add salt to the API key before hashing
-	saltedKey := apiKey + h.config.Security.APIKeySalt
-	hash := sha256.Sum256([]byte(saltedKey))
-	return hex.EncodeToString(hash[:])
+	return data.HashAPIKey(apiKey, h.config.Security.APIKeySalt)
+}
+
+// generateAPIKey generates a new random API key
+func generateAPIKey(testMode bool) (string, error) {
+	return data.GenerateAPIKey(testMode)
 }
 
 // lookupAPIKey looks up an API key by its hash
@@ -128,7 +435,7 @@ func (h *Handler) getUserProfile(ctx context.Context, userID string) (*UserProfi
 	return &UserProfile{
 		ID:      userID,
 		Email:   "user@example.com",
-		Balance: 100.00,
+		Balance: data.USDToMicros(100.00),
 	}, nil
 }
 
@@ -148,11 +455,21 @@ func (h *Handler) getLogger(c *gin.Context) *slog.Logger {
 	return slog.Default()
 }
 
+// getLoggerFromContext gets the request-scoped logger from a standard context
+func (h *Handler) getLoggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, exists := ctx.Value(loggerKey).(*slog.Logger); exists {
+		return logger
+	}
+	return slog.Default()
+}
+
 // GinContextKey types to avoid collisions with built-in string keys
 type ginContextKey string
 
 const (
 	requestContextGinKey ginContextKey = "requestContext"
+	userIDGinKey         ginContextKey = "userID"
+	apiVersionGinKey     ginContextKey = "apiVersion"
 )
 
 // getRequestContext gets the request context from Gin context
@@ -165,17 +482,68 @@ func (h *Handler) getRequestContext(c *gin.Context) (*RequestContext, bool) {
 	return nil, false
 }
 
+// getAuthenticatedUserID gets the user ID set by JWTAuthMiddleware
+func (h *Handler) getAuthenticatedUserID(c *gin.Context) (string, bool) {
+	userID := c.GetString(string(userIDGinKey))
+	return userID, userID != ""
+}
+
+// recordAudit records an audit event for the current request, filling in the client details
+// and, unless already set, the authenticated caller as the actor
+func (h *Handler) recordAudit(c *gin.Context, event *data.AuditEvent) {
+	event.IPAddress = c.ClientIP()
+	event.UserAgent = c.Request.UserAgent()
+	event.RequestID = h.getRequestID(c)
+
+	if event.ActorType == "" {
+		if adminID := c.GetString(string(impersonatorGinKey)); adminID != "" {
+			// Requests made while impersonating are the admin's actions on the user's account
+			event.ActorType = data.AuditActorUser
+			event.ActorID = adminID
+			if event.Details == nil {
+				event.Details = make(map[string]interface{})
+			}
+			event.Details["impersonated_user_id"], _ = h.getAuthenticatedUserID(c)
+		} else if requestCtx, ok := h.getRequestContext(c); ok {
+			event.ActorType = data.AuditActorAPIKey
+			event.ActorID = requestCtx.UserID
+		} else if userID, ok := h.getAuthenticatedUserID(c); ok {
+			event.ActorType = data.AuditActorUser
+			event.ActorID = userID
+		} else {
+			event.ActorType = data.AuditActorAnonymous
+		}
+	}
+
+	h.auditService.Record(c.Request.Context(), event)
+}
+
+// recordAuthFailure records a rejected authentication or authorization attempt
+func (h *Handler) recordAuthFailure(c *gin.Context, reason string, details map[string]interface{}) {
+	if details == nil {
+		details = make(map[string]interface{})
+	}
+	details["reason"] = reason
+	details["path"] = c.FullPath()
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:    data.AuditAuthFailed,
+		Details: details,
+	})
+}
+
 // getUserFromCache retrieves user data from cache or loads from Firebase
 func (h *Handler) getUserFromCache(ctx context.Context, userID string) (*CachedUserData, error) {
-	cacheKey := fmt.Sprintf("user:%s", userID)
+	cacheKey := services.UserCacheKey(userID)
 
 	// Try to get from cache first
-	if cached, found := h.cache.Get(cacheKey); found {
-		if userData, ok := cached.(*CachedUserData); ok {
-			// Check if cache is still valid (5 minutes)
-			if time.Since(userData.LastUpdated) < 5*time.Minute {
-				return userData, nil
-			}
+	var userData CachedUserData
+	if found, err := h.cache.Get(ctx, cacheKey, &userData); err != nil {
+		h.getLoggerFromContext(ctx).Warn("Failed to read user from cache", "error", err)
+	} else if found {
+		// Check if cache is still valid (5 minutes)
+		if time.Since(userData.LastUpdated) < 5*time.Minute {
+			return &userData, nil
 		}
 	}
 
@@ -194,16 +562,20 @@ func (h *Handler) getUserFromCache(ctx context.Context, userID string) (*CachedU
 		IsActive:      user.IsActive,
 		CustomPricing: user.CustomPricing,
 		LastUpdated:   time.Now(),
+		Credits:       user.AvailableCredits(time.Now()),
+		UserType:      user.Type,
 	}
 
 	// Store in cache for 5 minutes
-	h.cache.Set(cacheKey, cachedUser, 5*time.Minute)
+	if err := h.cache.Set(ctx, cacheKey, cachedUser, 5*time.Minute); err != nil {
+		h.getLoggerFromContext(ctx).Warn("Failed to store user in cache", "error", err)
+	}
 
 	return cachedUser, nil
 }
 
 // checkUserBalance performs a quick balance check before processing expensive operations
-func (h *Handler) checkUserBalance(ctx context.Context, userID string, estimatedCost float64) (bool, float64, error) {
+func (h *Handler) checkUserBalance(ctx context.Context, userID string, estimatedCost data.MicroUSD) (bool, data.MicroUSD, error) {
 	// Get user from cache
 	cachedUser, err := h.getUserFromCache(ctx, userID)
 	if err != nil {
@@ -220,30 +592,82 @@ func (h *Handler) checkUserBalance(ctx context.Context, userID string, estimated
 	return true, cachedUser.Balance, nil
 }
 
-// updateUserBalance updates user balance in both cache and Firebase
-func (h *Handler) updateUserBalance(ctx context.Context, userID string, amount float64) error {
-	// Update in Firebase first
-	err := h.firebaseService.UpdateUserBalance(ctx, userID, amount)
+// getOrganizationFromCache retrieves an organization from cache or loads it from Firebase
+func (h *Handler) getOrganizationFromCache(ctx context.Context, orgID string) (*data.Organization, error) {
+	cacheKey := services.OrgCacheKey(orgID)
+
+	var org data.Organization
+	if found, err := h.cache.Get(ctx, cacheKey, &org); err != nil {
+		h.getLoggerFromContext(ctx).Warn("Failed to read organization from cache", "error", err)
+	} else if found {
+		return &org, nil
+	}
+
+	loaded, err := h.firebaseService.GetOrganization(ctx, orgID)
 	if err != nil {
-		return fmt.Errorf("failed to update user balance in Firebase: %w", err)
+		return nil, fmt.Errorf("failed to get organization from Firebase: %w", err)
 	}
 
-	// Invalidate cache to force refresh on next request
-	cacheKey := fmt.Sprintf("user:%s", userID)
-	h.cache.Delete(cacheKey)
+	if err := h.cache.Set(ctx, cacheKey, loaded, 5*time.Minute); err != nil {
+		h.getLoggerFromContext(ctx).Warn("Failed to store organization in cache", "error", err)
+	}
 
-	return nil
+	return loaded, nil
+}
+
+// getTenantFromCache gets a tenant from cache or Firebase, returning nil if it does not exist
+func (h *Handler) getTenantFromCache(ctx context.Context, tenantID string) (*data.Tenant, error) {
+	cacheKey := services.TenantCacheKey(tenantID)
+
+	var tenant data.Tenant
+	if found, err := h.cache.Get(ctx, cacheKey, &tenant); err != nil {
+		h.getLoggerFromContext(ctx).Warn("Failed to read tenant from cache", "error", err)
+	} else if found {
+		return &tenant, nil
+	}
+
+	loaded, err := h.firebaseService.GetTenant(ctx, tenantID)
+	if err != nil || loaded == nil {
+		return nil, err
+	}
+
+	if err := h.cache.Set(ctx, cacheKey, loaded, 5*time.Minute); err != nil {
+		h.getLoggerFromContext(ctx).Warn("Failed to store tenant in cache", "error", err)
+	}
+
+	return loaded, nil
+}
+
+// calculateCost prices a request against the tier of the account being billed, or the tenant's tier when it sets one
+func (h *Handler) calculateCost(ctx context.Context, requestCtx *RequestContext, modelID string, inputTokens, outputTokens int, details data.TokenDetails) (data.CostBreakdown, error) {
+	if requestCtx.Tenant != nil && requestCtx.Tenant.TierID != "" {
+		return h.pricingService.CalculateTierCost(ctx, requestCtx.Tenant.TierID, modelID, inputTokens, outputTokens, details)
+	}
+	if requestCtx.OrgID != "" {
+		return h.pricingService.CalculateOrgCost(ctx, requestCtx.OrgID, modelID, inputTokens, outputTokens, details)
+	}
+	return h.pricingService.CalculateCost(ctx, requestCtx.UserID, modelID, inputTokens, outputTokens, details)
+}
+
+// modelPricing returns the prices and markups the request's pricing tier applies to a model
+func (h *Handler) modelPricing(requestCtx *RequestContext, modelID string) data.AppliedPricing {
+	// An unknown model still gets the tier's markups
+	modelConfig, _ := h.pricingService.GetModelConfig(modelID)
+	modelConfig.ModelID = modelID
+	customPricing := requestCtx.CachedUser != nil && requestCtx.CachedUser.CustomPricing
+	return requestCtx.PricingTier.PricingFor(modelConfig, services.UsesCustomPricing(requestCtx.OrgID, requestCtx.Tenant, customPricing))
 }
 
 // getPricingTierFromCache retrieves pricing tier from cache or loads from Firebase
 func (h *Handler) getPricingTierFromCache(ctx context.Context, tierID string) (*services.PricingTier, error) {
-	cacheKey := fmt.Sprintf("tier:%s", tierID)
+	cacheKey := services.TierCacheKey(tierID)
 
 	// Try to get from cache first
-	if cached, found := h.cache.Get(cacheKey); found {
-		if tier, ok := cached.(*services.PricingTier); ok {
-			return tier, nil
-		}
+	var cachedTier services.PricingTier
+	if found, err := h.cache.Get(ctx, cacheKey, &cachedTier); err != nil {
+		h.getLoggerFromContext(ctx).Warn("Failed to read pricing tier from cache", "error", err)
+	} else if found {
+		return &cachedTier, nil
 	}
 
 	// Cache miss, load from Firebase
@@ -256,31 +680,28 @@ func (h *Handler) getPricingTierFromCache(ctx context.Context, tierID string) (*
 		}
 	}
 
-	// Convert Firebase ModelPricing to pricing.ModelPricing
-	customModelPricing := make(map[string]services.ModelPricing)
-	for modelID, modelPricing := range firebaseTier.CustomModelPricing {
-		customModelPricing[modelID] = services.ModelPricing{
-			ModelID:               modelPricing.ModelID,
-			Provider:              modelPricing.Provider,
-			InputPricePerMillion:  modelPricing.InputPricePerMillion,
-			OutputPricePerMillion: modelPricing.OutputPricePerMillion,
-		}
-	}
-
 	// Create pricing tier
 	tier := &services.PricingTier{
-		ID:                  firebaseTier.ID,
-		TierName:            firebaseTier.Name,
-		MinMonthlySpend:     firebaseTier.MinMonthlySpend,
-		InputMarkupPercent:  firebaseTier.InputMarkupPercent,
-		OutputMarkupPercent: firebaseTier.OutputMarkupPercent,
-		IsActive:            firebaseTier.IsActive,
-		IsCustom:            firebaseTier.IsCustom,
-		CustomModelPricing:  customModelPricing,
+		ID:                    firebaseTier.ID,
+		TierName:              firebaseTier.Name,
+		MinMonthlySpend:       firebaseTier.MinMonthlySpend,
+		InputMarkupPercent:    firebaseTier.InputMarkupPercent,
+		OutputMarkupPercent:   firebaseTier.OutputMarkupPercent,
+		IsActive:              firebaseTier.IsActive,
+		IsCustom:              firebaseTier.IsCustom,
+		CustomModelPricing:    firebaseTier.CustomModelPricing,
+		Moderation:            firebaseTier.Moderation,
+		Priority:              firebaseTier.Priority,
+		MaxPromptTokens:       firebaseTier.MaxPromptTokens,
+		MaxStreamOutputTokens: firebaseTier.MaxStreamOutputTokens,
+		MaxStreamOutputBytes:  firebaseTier.MaxStreamOutputBytes,
+		Optimization:          firebaseTier.Optimization,
 	}
 
 	// Store in cache for 10 minutes (pricing tiers change less frequently)
-	h.cache.Set(cacheKey, tier, 10*time.Minute)
+	if err := h.cache.Set(ctx, cacheKey, tier, 10*time.Minute); err != nil {
+		h.getLoggerFromContext(ctx).Warn("Failed to store pricing tier in cache", "error", err)
+	}
 
 	return tier, nil
 }
@@ -0,0 +1,579 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// CreateOrgRequest represents a request to create an organization
+type CreateOrgRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+// SetOrgMemberRequest represents a request to add a member or change their role
+type SetOrgMemberRequest struct {
+	UserID string       `json:"user_id"`
+	Role   data.OrgRole `json:"role" binding:"required"`
+}
+
+// CreateAPIKeyRequest represents a request to create an API key, such as a member key billed to
+// an organization or a service account's key
+type CreateAPIKeyRequest struct {
+	Name           string               `json:"name" binding:"required"`
+	Scopes         []string             `json:"scopes,omitempty"`
+	Restrictions   data.KeyRestrictions `json:"restrictions"`
+	PostProcessing data.PostProcessing  `json:"post_processing"`
+	// TestMode creates a test key, answered by a fake provider and never charged
+	TestMode bool `json:"test_mode,omitempty"`
+	// ExpiresAt is when the key stops working; keys without it never expire
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// SetModelAliasRequest represents a request to pin a model alias to a concrete model version
+type SetModelAliasRequest struct {
+	ModelID string `json:"model_id" binding:"required"`
+}
+
+// CreateOrganization handles creating an organization owned by the caller
+func (h *Handler) CreateOrganization(c *gin.Context) {
+	logger := h.getLogger(c)
+
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	var req CreateOrgRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	// New organizations start on the owner's tier
+	user, err := h.getUserFromCache(c.Request.Context(), userID)
+	if err != nil {
+		logger.Error("Failed to get user", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to load user data",
+		})
+		return
+	}
+
+	org, err := h.firebaseService.CreateOrganization(c.Request.Context(), req.Name, userID, user.TierID)
+	if err != nil {
+		logger.Error("Failed to create organization", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create organization",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, org)
+}
+
+// GetOrganization handles getting an organization the caller belongs to
+func (h *Handler) GetOrganization(c *gin.Context) {
+	if _, ok := h.requireOrgRole(c, false); !ok {
+		return
+	}
+
+	org, err := h.firebaseService.GetOrganization(c.Request.Context(), c.Param("org_id"))
+	if err != nil {
+		h.getLogger(c).Error("Failed to get organization", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get organization",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, org)
+}
+
+// ListOrgMembers handles listing an organization's members
+func (h *Handler) ListOrgMembers(c *gin.Context) {
+	if _, ok := h.requireOrgRole(c, false); !ok {
+		return
+	}
+
+	members, err := h.firebaseService.ListOrgMembers(c.Request.Context(), c.Param("org_id"))
+	if err != nil {
+		h.getLogger(c).Error("Failed to list organization members", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to list organization members",
+		})
+		return
+	}
+
+	if members == nil {
+		members = []*data.OrgMember{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"members": members,
+	})
+}
+
+// SetOrgMember handles adding a member to an organization or changing a member's role.
+// Owners and admins may add members; only the owner may grant or revoke the admin role.
+func (h *Handler) SetOrgMember(c *gin.Context) {
+	caller, ok := h.requireOrgRole(c, true)
+	if !ok {
+		return
+	}
+
+	var req SetOrgMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	// PUT /members/:user_id takes the user from the path
+	if userID := c.Param("user_id"); userID != "" {
+		req.UserID = userID
+	}
+	if req.UserID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "user_id is required",
+		})
+		return
+	}
+
+	if !req.Role.Valid() || req.Role == data.OrgRoleOwner {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "role must be admin or member",
+		})
+		return
+	}
+
+	orgID := c.Param("org_id")
+	existing, err := h.firebaseService.GetOrgMember(c.Request.Context(), orgID, req.UserID)
+	if err != nil && !errors.Is(err, data.ErrNotOrgMember) {
+		h.getLogger(c).Error("Failed to get organization member", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to update organization member",
+		})
+		return
+	}
+
+	if existing != nil && existing.Role == data.OrgRoleOwner {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "The organization owner's role cannot be changed",
+		})
+		return
+	}
+	if caller.Role != data.OrgRoleOwner && (req.Role == data.OrgRoleAdmin || (existing != nil && existing.Role == data.OrgRoleAdmin)) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "Only the organization owner can manage admins",
+		})
+		return
+	}
+
+	if _, err := h.firebaseService.GetUserByID(c.Request.Context(), req.UserID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "User not found",
+		})
+		return
+	}
+
+	member, err := h.firebaseService.SetOrgMember(c.Request.Context(), orgID, req.UserID, req.Role)
+	if err != nil {
+		h.getLogger(c).Error("Failed to set organization member", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to update organization member",
+		})
+		return
+	}
+
+	event := &data.AuditEvent{
+		Type:     data.AuditOrgMemberUpdated,
+		OrgID:    orgID,
+		TargetID: req.UserID,
+		After:    member,
+	}
+	if existing != nil {
+		event.Before = existing
+	}
+	h.recordAudit(c, event)
+
+	c.JSON(http.StatusOK, member)
+}
+
+// RemoveOrgMember handles removing a member from an organization.
+// Members may remove themselves; removing anyone else requires owner or admin.
+func (h *Handler) RemoveOrgMember(c *gin.Context) {
+	orgID := c.Param("org_id")
+	targetID := c.Param("user_id")
+
+	callerID, _ := h.getAuthenticatedUserID(c)
+	caller, ok := h.requireOrgRole(c, callerID != targetID)
+	if !ok {
+		return
+	}
+
+	target, err := h.firebaseService.GetOrgMember(c.Request.Context(), orgID, targetID)
+	if errors.Is(err, data.ErrNotOrgMember) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Member not found",
+		})
+		return
+	}
+	if err != nil {
+		h.getLogger(c).Error("Failed to get organization member", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to remove organization member",
+		})
+		return
+	}
+
+	if target.Role == data.OrgRoleOwner {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "The organization owner cannot be removed",
+		})
+		return
+	}
+	if target.Role == data.OrgRoleAdmin && caller.Role != data.OrgRoleOwner && callerID != targetID {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "Only the organization owner can remove admins",
+		})
+		return
+	}
+
+	if err := h.firebaseService.RemoveOrgMember(c.Request.Context(), orgID, targetID); err != nil {
+		h.getLogger(c).Error("Failed to remove organization member", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to remove organization member",
+		})
+		return
+	}
+
+	// Removing a member also revokes their organization keys
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditOrgMemberRemoved,
+		OrgID:    orgID,
+		TargetID: targetID,
+		Before:   target,
+	})
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditAPIKeyRevoked,
+		OrgID:    orgID,
+		TargetID: targetID,
+		Details:  map[string]interface{}{"reason": "org_member_removed"},
+	})
+
+	c.Status(http.StatusNoContent)
+}
+
+// CreateOrgAPIKey handles creating an API key for the calling member, billed to the organization
+func (h *Handler) CreateOrgAPIKey(c *gin.Context) {
+	caller, ok := h.requireOrgRole(c, false)
+	if !ok {
+		return
+	}
+
+	var req CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	// Only owners and admins may hand out admin keys
+	if slices.Contains(req.Scopes, data.ScopeAdmin) && !caller.Role.CanManageMembers() {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "Requires organization owner or admin",
+		})
+		return
+	}
+
+	h.issueAPIKey(c, &req, caller.UserID, caller.OrgID)
+}
+
+// issueAPIKey validates a request for a new API key, creates it for the user, billed to orgID when
+// set, and answers with the raw key
+func (h *Handler) issueAPIKey(c *gin.Context, req *CreateAPIKeyRequest, userID, orgID string) {
+	for _, scope := range req.Scopes {
+		if !data.ValidScope(scope) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Unknown scope: " + scope,
+			})
+			return
+		}
+	}
+
+	if err := req.Restrictions.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if err := services.ValidatePostProcessing(req.PostProcessing); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	var expiresAt time.Time
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(time.Now()) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "expires_at must be in the future",
+			})
+			return
+		}
+		expiresAt = *req.ExpiresAt
+	}
+
+	// An empty scope list would grant full access, so default new keys to generation only
+	if len(req.Scopes) == 0 {
+		req.Scopes = []string{data.ScopeGenerate}
+	}
+
+	rawKey, err := generateAPIKey(req.TestMode)
+	if err != nil {
+		h.getLogger(c).Error("Failed to generate API key", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create API key",
+		})
+		return
+	}
+
+	apiKey, err := h.firebaseService.CreateAPIKey(c.Request.Context(), &data.APIKey{
+		UserID:         userID,
+		OrgID:          orgID,
+		KeyHash:        h.hashAPIKey(rawKey),
+		Name:           req.Name,
+		Scopes:         req.Scopes,
+		Restrictions:   req.Restrictions,
+		PostProcessing: req.PostProcessing,
+		TestMode:       req.TestMode,
+		ExpiresAt:      expiresAt,
+	})
+	if err != nil {
+		h.getLogger(c).Error("Failed to create API key", "error", err, "user_id", userID, "org_id", orgID)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create API key",
+		})
+		return
+	}
+
+	after := map[string]interface{}{
+		"user_id":         apiKey.UserID,
+		"name":            apiKey.Name,
+		"scopes":          apiKey.Scopes,
+		"restrictions":    apiKey.Restrictions,
+		"post_processing": apiKey.PostProcessing,
+		"test_mode":       apiKey.TestMode,
+	}
+	// The raw key is only ever returned once
+	response := gin.H{
+		"id":              apiKey.ID,
+		"name":            apiKey.Name,
+		"user_id":         apiKey.UserID,
+		"org_id":          apiKey.OrgID,
+		"scopes":          apiKey.Scopes,
+		"restrictions":    apiKey.Restrictions,
+		"post_processing": apiKey.PostProcessing,
+		"test_mode":       apiKey.TestMode,
+		"key":             rawKey,
+		"created_at":      apiKey.CreatedAt,
+	}
+	if !apiKey.ExpiresAt.IsZero() {
+		after["expires_at"] = apiKey.ExpiresAt
+		response["expires_at"] = apiKey.ExpiresAt
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditAPIKeyCreated,
+		OrgID:    apiKey.OrgID,
+		TargetID: apiKey.ID,
+		After:    after,
+	})
+
+	c.JSON(http.StatusCreated, response)
+}
+
+// GetOrgUsage handles per-member usage attribution for an organization
+func (h *Handler) GetOrgUsage(c *gin.Context) {
+	if _, ok := h.requireOrgRole(c, true); !ok {
+		return
+	}
+
+	endDate := time.Now()
+	startDate := endDate.AddDate(0, 0, -30)
+	if start := c.Query("start"); start != "" {
+		parsed, err := time.Parse(time.RFC3339, start)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "start must be an RFC 3339 timestamp",
+			})
+			return
+		}
+		startDate = parsed
+	}
+	if end := c.Query("end"); end != "" {
+		parsed, err := time.Parse(time.RFC3339, end)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "end must be an RFC 3339 timestamp",
+			})
+			return
+		}
+		endDate = parsed
+	}
+
+	usage, err := h.firebaseService.GetOrgUsageByMember(c.Request.Context(), c.Param("org_id"), startDate, endDate)
+	if err != nil {
+		h.getLogger(c).Error("Failed to get organization usage", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get organization usage",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"start_date": startDate,
+		"end_date":   endDate,
+		"members":    usage,
+	})
+}
+
+// ListOrgModelAliases handles listing the model aliases an organization has pinned
+func (h *Handler) ListOrgModelAliases(c *gin.Context) {
+	if _, ok := h.requireOrgRole(c, false); !ok {
+		return
+	}
+
+	aliases, err := h.pricingService.ListOrgModelAliases(c.Request.Context(), c.Param("org_id"))
+	if err != nil {
+		h.getLogger(c).Error("Failed to list model aliases", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to list model aliases",
+		})
+		return
+	}
+
+	if aliases == nil {
+		aliases = []*data.ModelAlias{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"aliases": aliases,
+	})
+}
+
+// SetOrgModelAlias handles pointing one of an organization's model aliases at a concrete model version
+func (h *Handler) SetOrgModelAlias(c *gin.Context) {
+	caller, ok := h.requireOrgRole(c, true)
+	if !ok {
+		return
+	}
+
+	var req SetModelAliasRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	alias, err := h.pricingService.SetOrgModelAlias(c.Request.Context(), caller.OrgID, c.Param("alias"), req.ModelID, caller.UserID)
+	if errors.Is(err, services.ErrUnknownModel) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		h.getLogger(c).Error("Failed to set model alias", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to set model alias",
+		})
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditModelAliasUpdated,
+		OrgID:    caller.OrgID,
+		TargetID: alias.Alias,
+		After:    alias,
+	})
+
+	c.JSON(http.StatusOK, alias)
+}
+
+// DeleteOrgModelAlias handles removing an organization's model alias, reverting to the global alias
+func (h *Handler) DeleteOrgModelAlias(c *gin.Context) {
+	caller, ok := h.requireOrgRole(c, true)
+	if !ok {
+		return
+	}
+
+	if err := h.pricingService.DeleteOrgModelAlias(c.Request.Context(), caller.OrgID, c.Param("alias")); err != nil {
+		h.getLogger(c).Error("Failed to delete model alias", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to delete model alias",
+		})
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditModelAliasDeleted,
+		OrgID:    caller.OrgID,
+		TargetID: c.Param("alias"),
+	})
+
+	c.Status(http.StatusNoContent)
+}
+
+// requireOrgRole checks that the caller is a member of the organization in the path,
+// and optionally that they can manage members. It writes the error response on failure.
+func (h *Handler) requireOrgRole(c *gin.Context, manage bool) (*data.OrgMember, bool) {
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return nil, false
+	}
+
+	member, err := h.firebaseService.GetOrgMember(c.Request.Context(), c.Param("org_id"), userID)
+	if errors.Is(err, data.ErrNotOrgMember) {
+		// Don't reveal whether the organization exists
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Organization not found",
+		})
+		return nil, false
+	}
+	if err != nil {
+		h.getLogger(c).Error("Failed to check organization membership", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to check organization membership",
+		})
+		return nil, false
+	}
+
+	if manage && !member.Role.CanManageMembers() {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "Requires organization owner or admin",
+		})
+		return nil, false
+	}
+
+	return member, true
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// ModelPricingRequest represents a request to set a custom tier's pricing for a model. Omitted
+// prices keep the model's base price and omitted markups keep the tier's markup.
+type ModelPricingRequest struct {
+	InputPricePerMillion  float64  `json:"input_price_per_million" binding:"min=0"`
+	OutputPricePerMillion float64  `json:"output_price_per_million" binding:"min=0"`
+	InputMarkupPercent    *float64 `json:"input_markup_percent,omitempty" binding:"omitempty,min=0"`
+	OutputMarkupPercent   *float64 `json:"output_markup_percent,omitempty" binding:"omitempty,min=0"`
+}
+
+// ListPricingTiers handles listing every pricing tier with its custom model pricing
+func (h *Handler) ListPricingTiers(c *gin.Context) {
+	tiers, err := h.firebaseService.ListPricingTiers(c.Request.Context())
+	if err != nil {
+		h.getLogger(c).Error("Failed to list pricing tiers", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to list pricing tiers",
+		})
+		return
+	}
+	if tiers == nil {
+		tiers = []*data.PricingTier{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"pricing_tiers": tiers,
+	})
+}
+
+// SetTierModelPricing handles setting a custom tier's pricing for a model
+func (h *Handler) SetTierModelPricing(c *gin.Context) {
+	var req ModelPricingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	modelConfig, err := h.pricingService.GetModelConfig(c.Param("model_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Model not found",
+		})
+		return
+	}
+
+	before, ok := h.customPricingTier(c)
+	if !ok {
+		return
+	}
+
+	pricing := data.ModelPricing{
+		ModelID:               modelConfig.ModelID,
+		Provider:              modelConfig.Provider,
+		InputPricePerMillion:  req.InputPricePerMillion,
+		OutputPricePerMillion: req.OutputPricePerMillion,
+		InputMarkupPercent:    req.InputMarkupPercent,
+		OutputMarkupPercent:   req.OutputMarkupPercent,
+	}
+	if err := h.firebaseService.SetTierModelPricing(c.Request.Context(), before.ID, pricing); err != nil {
+		h.getLogger(c).Error("Failed to set tier model pricing", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to update pricing tier",
+		})
+		return
+	}
+	var previous interface{}
+	if existing, exists := before.CustomModelPricing[modelConfig.ModelID]; exists {
+		previous = existing
+	}
+	h.pricingTierChanged(c, before, previous, pricing)
+
+	// Report the prices and markups accounts on the tier are now billed at for the model
+	after := *before
+	after.CustomModelPricing = map[string]data.ModelPricing{modelConfig.ModelID: pricing}
+	c.JSON(http.StatusOK, gin.H{
+		"tier_id": before.ID,
+		"pricing": pricing,
+		"applied": after.PricingFor(modelConfig.ModelID, true, modelConfig.InputPricePerMillion, modelConfig.OutputPricePerMillion),
+	})
+}
+
+// DeleteTierModelPricing handles removing a custom tier's pricing for a model, so the model is
+// billed at its base prices and the tier's markups again
+func (h *Handler) DeleteTierModelPricing(c *gin.Context) {
+	before, ok := h.customPricingTier(c)
+	if !ok {
+		return
+	}
+
+	modelID := c.Param("model_id")
+	previous, exists := before.CustomModelPricing[modelID]
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Tier has no custom pricing for the model",
+		})
+		return
+	}
+
+	if err := h.firebaseService.DeleteTierModelPricing(c.Request.Context(), before.ID, modelID); err != nil {
+		h.getLogger(c).Error("Failed to delete tier model pricing", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to update pricing tier",
+		})
+		return
+	}
+	h.pricingTierChanged(c, before, previous, nil)
+
+	c.Status(http.StatusNoContent)
+}
+
+// SetTierOptimization handles replacing a tier's optimization settings: the length a prompt must
+// exceed to be optimized and the model families whose threshold differs or that are not optimized
+func (h *Handler) SetTierOptimization(c *gin.Context) {
+	var settings data.OptimizationSettings
+	if err := c.ShouldBindJSON(&settings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+	if err := settings.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	before, ok := h.pricingTier(c)
+	if !ok {
+		return
+	}
+
+	if err := h.firebaseService.SetTierOptimization(c.Request.Context(), before.ID, settings); err != nil {
+		h.getLogger(c).Error("Failed to set tier optimization settings", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to update pricing tier",
+		})
+		return
+	}
+	h.pricingTierChanged(c, before, before.Optimization, settings)
+
+	c.JSON(http.StatusOK, gin.H{
+		"tier_id":      before.ID,
+		"optimization": settings,
+	})
+}
+
+// customPricingTier loads the tier named by the tier_id path parameter, answering the request
+// when it does not exist or is not custom, since only custom tiers apply custom model pricing
+func (h *Handler) customPricingTier(c *gin.Context) (*data.PricingTier, bool) {
+	tier, ok := h.pricingTier(c)
+	if !ok {
+		return nil, false
+	}
+	if !tier.IsCustom {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Custom model pricing requires a custom pricing tier",
+		})
+		return nil, false
+	}
+	return tier, true
+}
+
+// pricingTier loads the tier named by the tier_id path parameter, answering the request when it
+// does not exist
+func (h *Handler) pricingTier(c *gin.Context) (*data.PricingTier, bool) {
+	tierID := c.Param("tier_id")
+	tier, err := h.firebaseService.GetPricingTier(c.Request.Context(), tierID)
+	if errors.Is(err, data.ErrPricingTierNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Pricing tier not found",
+		})
+		return nil, false
+	}
+	if err != nil {
+		h.getLogger(c).Error("Failed to get pricing tier", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to update pricing tier",
+		})
+		return nil, false
+	}
+	// Tiers are updated and cached by their document ID
+	tier.ID = tierID
+
+	return tier, true
+}
+
+// pricingTierChanged evicts a tier whose pricing or settings changed from the cache, so requests
+// pick up the change before the tier listener does, and audits the change
+func (h *Handler) pricingTierChanged(c *gin.Context, tier *data.PricingTier, before, after interface{}) {
+	if err := h.cache.Invalidate(c.Request.Context(), services.TierCacheKey(tier.ID)); err != nil {
+		h.getLogger(c).Warn("Failed to invalidate cached pricing tier", "error", err)
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditPricingTierUpdated,
+		TargetID: tier.ID,
+		Before:   before,
+		After:    after,
+	})
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/gin-gonic/gin"
+)
+
+// DeleteAccountRequest represents a request to delete the caller's account
+type DeleteAccountRequest struct {
+	// Confirm must be true, so the account is not deleted by a stray request
+	Confirm bool `json:"confirm"`
+}
+
+// RequestDataExport handles starting an export of everything stored about the user: their
+// profile, API key metadata, request logs, ledger entries and payments. The export is built in the
+// background; its status is polled with GetDataExport.
+func (h *Handler) RequestDataExport(c *gin.Context) {
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	export, err := h.privacyService.RequestExport(c.Request.Context(), userID)
+	if err != nil {
+		h.getLogger(c).Error("Failed to request data export", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to request data export",
+		})
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditDataExportRequested,
+		TargetID: export.ID,
+	})
+
+	c.JSON(http.StatusAccepted, export)
+}
+
+// GetDataExport handles reporting a data export's status
+func (h *Handler) GetDataExport(c *gin.Context) {
+	export, ok := h.userDataExport(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, export)
+}
+
+// DownloadDataExport handles downloading a completed data export as a JSON file
+func (h *Handler) DownloadDataExport(c *gin.Context) {
+	export, ok := h.userDataExport(c)
+	if !ok {
+		return
+	}
+	if export.Status != data.DataExportCompleted {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":  "Data export is not ready",
+			"status": export.Status,
+		})
+		return
+	}
+
+	content, err := h.privacyService.ReadExport(c.Request.Context(), export)
+	if err != nil {
+		h.getLogger(c).Error("Failed to read data export", "export_id", export.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to read data export",
+		})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="aptrouter-data-export-%s.json"`, export.ID))
+	c.Data(http.StatusOK, "application/json", content)
+}
+
+// userDataExport gets the data export in the path if it belongs to the caller, responding with an
+// error otherwise
+func (h *Handler) userDataExport(c *gin.Context) (*data.DataExport, bool) {
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return nil, false
+	}
+
+	export, err := h.privacyService.GetExport(c.Request.Context(), userID, c.Param("export_id"))
+	if errors.Is(err, data.ErrDataExportNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Data export not found",
+		})
+		return nil, false
+	}
+	if err != nil {
+		h.getLogger(c).Error("Failed to get data export", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get data export",
+		})
+		return nil, false
+	}
+	return export, true
+}
+
+// DeleteAccount handles deleting the caller's account. The account is deactivated and its API keys
+// revoked at once; its data is erased and its request logs anonymized once the configured retention
+// period ends.
+func (h *Handler) DeleteAccount(c *gin.Context) {
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	var req DeleteAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil || !req.Confirm {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": `Deleting an account must be confirmed with {"confirm": true}`,
+		})
+		return
+	}
+
+	purgeAfter, err := h.privacyService.DeleteUser(c.Request.Context(), userID)
+	if err != nil {
+		h.getLogger(c).Error("Failed to delete account", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to delete account",
+		})
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditUserDeleted,
+		TargetID: userID,
+		Details:  map[string]interface{}{"purge_after": purgeAfter},
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Account deleted",
+		"user_id":     userID,
+		"purge_after": purgeAfter,
+	})
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// StoreProviderKeyRequest represents a request to store the user's own provider API key
+type StoreProviderKeyRequest struct {
+	APIKey string `json:"api_key" binding:"required,min=8"`
+}
+
+// ListProviderKeys handles listing the providers the user has stored keys for
+func (h *Handler) ListProviderKeys(c *gin.Context) {
+	logger := h.getLogger(c)
+
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	keys, err := h.providerKeyService.ListKeys(c.Request.Context(), userID)
+	if err != nil {
+		logger.Error("Failed to list provider keys", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to list provider keys",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"provider_keys": keys,
+	})
+}
+
+// StoreProviderKey handles storing or replacing the user's key for a provider
+func (h *Handler) StoreProviderKey(c *gin.Context) {
+	logger := h.getLogger(c)
+
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	var req StoreProviderKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	key, err := h.providerKeyService.StoreKey(c.Request.Context(), userID, c.Param("provider"), req.APIKey)
+	if errors.Is(err, services.ErrVaultDisabled) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": "Stored provider keys are not configured",
+		})
+		return
+	}
+	if errors.Is(err, services.ErrUnsupportedProvider) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to store provider key", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to store provider key",
+		})
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditProviderKeyStored,
+		TargetID: key.Provider,
+		After:    map[string]interface{}{"provider": key.Provider, "key_hint": key.KeyHint, "key_id": key.Secret.KeyID},
+	})
+
+	c.JSON(http.StatusOK, key)
+}
+
+// DeleteProviderKey handles removing the user's key for a provider
+func (h *Handler) DeleteProviderKey(c *gin.Context) {
+	logger := h.getLogger(c)
+
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	err := h.providerKeyService.DeleteKey(c.Request.Context(), userID, c.Param("provider"))
+	if errors.Is(err, services.ErrUnsupportedProvider) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to delete provider key", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to delete provider key",
+		})
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditProviderKeyDeleted,
+		TargetID: c.Param("provider"),
+	})
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// ImportBillingExport handles uploading a provider's billing export as CSV, with date, model and
+// cost columns. Records already held for the days and models it covers are replaced.
+func (h *Handler) ImportBillingExport(c *gin.Context) {
+	provider := c.Param("provider")
+	switch provider {
+	case "openai", "anthropic", "google":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "provider must be one of openai, anthropic or google",
+		})
+		return
+	}
+
+	records, err := h.reconciliation.ImportCSV(c.Request.Context(), provider, c.Request.Body)
+	if errors.Is(err, services.ErrInvalidBillingExport) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		h.getLogger(c).Error("Failed to import billing export", "provider", provider, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to import billing export",
+		})
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditBillingExportImported,
+		TargetID: provider,
+		Details: map[string]interface{}{
+			"records": len(records),
+			"from":    records[0].Day,
+			"through": records[len(records)-1].Day,
+		},
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"provider": provider,
+		"records":  records,
+	})
+}
+
+// ListCostReconciliations handles listing how the costs recorded per provider, model and day
+// compared with what was billed, as of the last reconciliation. ?flagged=true lists only
+// discrepancies over the threshold, and ?provider= one provider's.
+func (h *Handler) ListCostReconciliations(c *gin.Context) {
+	startDate, endDate, ok := parseDateRange(c, h.config.Reconciliation.LookbackDays)
+	if !ok {
+		return
+	}
+
+	reconciliations, err := h.reconciliation.List(c.Request.Context(), startDate, endDate)
+	if err != nil {
+		h.getLogger(c).Error("Failed to list cost reconciliations", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to list cost reconciliations",
+		})
+		return
+	}
+
+	provider, flaggedOnly := c.Query("provider"), c.Query("flagged") == "true"
+	filtered := make([]*data.CostReconciliation, 0, len(reconciliations))
+	flagged := 0
+	for _, reconciliation := range reconciliations {
+		if (provider != "" && reconciliation.Provider != provider) || (flaggedOnly && !reconciliation.Flagged) {
+			continue
+		}
+		if reconciliation.Flagged {
+			flagged++
+		}
+		filtered = append(filtered, reconciliation)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"reconciliations":   filtered,
+		"flagged":           flagged,
+		"threshold_percent": h.config.Reconciliation.ThresholdPercent,
+		"min_difference":    data.USDToMicros(h.config.Reconciliation.MinDifferenceUSD),
+	})
+}
+
+// RunCostReconciliation handles reconciling a date range now, e.g. after importing an export,
+// rather than waiting for the scheduled reconciliation. It does not read the billing APIs.
+func (h *Handler) RunCostReconciliation(c *gin.Context) {
+	startDate, endDate, ok := parseDateRange(c, h.config.Reconciliation.LookbackDays)
+	if !ok {
+		return
+	}
+
+	reconciliations, err := h.reconciliation.Reconcile(c.Request.Context(), startDate, endDate)
+	if err != nil {
+		h.getLogger(c).Error("Failed to reconcile provider costs", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to reconcile provider costs",
+		})
+		return
+	}
+
+	flagged := 0
+	for _, reconciliation := range reconciliations {
+		if reconciliation.Flagged {
+			flagged++
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"reconciliations": reconciliations,
+		"flagged":         flagged,
+	})
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// ReplayRequestLogRequest represents a request to replay a logged request
+type ReplayRequestLogRequest struct {
+	// Mode is dry_run (the default) or shadow
+	Mode string `json:"mode"`
+	// Model replays the request on another model
+	Model string `json:"model,omitempty"`
+}
+
+// ReplayRequestLog handles re-executing a logged request from its stored payload, comparing the
+// replay's model, output and cost with the original's. Replays are never charged or logged.
+func (h *Handler) ReplayRequestLog(c *gin.Context) {
+	var req ReplayRequestLogRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid request body",
+			})
+			return
+		}
+	}
+
+	ctx := c.Request.Context()
+	log, err := h.firebaseService.GetRequestLog(ctx, c.Param("request_id"))
+	if errors.Is(err, data.ErrRequestLogNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Request log not found",
+		})
+		return
+	}
+	if err != nil {
+		h.getLogger(c).Error("Failed to get request log", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to replay request",
+		})
+		return
+	}
+
+	requestCtx, err := h.replayContext(c, log)
+	if err != nil {
+		h.getLogger(c).Error("Failed to load replayed request's account", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to replay request",
+		})
+		return
+	}
+
+	result, err := h.generationService.Replay(ctx, log, req.Mode, req.Model, requestCtx)
+	if errors.Is(err, services.ErrInvalidReplayMode) || errors.Is(err, services.ErrUnknownModel) ||
+		errors.Is(err, services.ErrKeyRestricted) || errors.Is(err, services.ErrContextWindowExceeded) ||
+		errors.Is(err, services.ErrPromptTooLarge) || errors.Is(err, services.ErrPromptTooLong) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if errors.Is(err, services.ErrPayloadNotLogged) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		h.getLogger(c).Error("Replay failed", "error", err, "replayed_request_id", log.RequestID)
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": "Replay failed: " + err.Error(),
+		})
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditRequestReplayed,
+		OrgID:    log.OrgID,
+		TargetID: log.RequestID,
+		Details: map[string]interface{}{
+			"mode":       result.Mode,
+			"model":      result.Replay.Model,
+			"cost_delta": result.CostDelta,
+		},
+	})
+
+	c.JSON(http.StatusOK, result)
+}
+
+// replayContext rebuilds the context a logged request ran in from its account's current pricing
+// tier, tenant and API key, so a replay resolves and prices it as the account's requests are now
+func (h *Handler) replayContext(c *gin.Context, log *data.RequestLog) (*services.RequestContext, error) {
+	ctx := c.Request.Context()
+
+	cachedUser, err := h.getUserFromCache(ctx, log.UserID)
+	if err != nil {
+		return nil, err
+	}
+	tier, err := h.getPricingTierFromCache(ctx, log.TierID)
+	if err != nil {
+		return nil, err
+	}
+	var tenant *data.Tenant
+	if log.TenantID != "" {
+		if tenant, err = h.getTenantFromCache(ctx, log.TenantID); err != nil {
+			return nil, err
+		}
+	}
+
+	requestCtx := &services.RequestContext{
+		RequestID:   h.getRequestID(c),
+		UserID:      log.UserID,
+		OrgID:       log.OrgID,
+		APIKeyID:    log.APIKeyID,
+		ClientIP:    c.ClientIP(),
+		UserAgent:   c.Request.UserAgent(),
+		PricingTier: *tier,
+		Tenant:      tenant,
+		TestMode:    log.TestMode,
+		Logger:      h.getLogger(c).With("replayed_request_id", log.RequestID),
+		CachedUser:  convertCachedUserData(cachedUser),
+	}
+
+	// Replays apply the API key's current restrictions, or none once the key is gone
+	if apiKey, err := h.firebaseService.GetAPIKey(ctx, log.APIKeyID); err == nil {
+		requestCtx.Restrictions = &apiKey.Restrictions
+		requestCtx.PostProcessing = &apiKey.PostProcessing
+	} else {
+		requestCtx.Logger.Warn("Replaying request without its API key's restrictions", "error", err)
+	}
+
+	return requestCtx, nil
+}
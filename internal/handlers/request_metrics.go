@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// meter records the HTTP layer's request metrics
+var meter = otel.Meter("github.com/apt-router/api/internal/handlers")
+
+// httpMetrics records request latency and response sizes by route template
+type httpMetrics struct {
+	duration metric.Float64Histogram
+	size     metric.Int64Histogram
+}
+
+// newHTTPMetrics creates the request instruments; instruments that fail to register are skipped
+func newHTTPMetrics() *httpMetrics {
+	duration, err := meter.Float64Histogram("http.server.request.duration",
+		metric.WithDescription("Time taken to serve HTTP requests"),
+		metric.WithUnit("s"),
+		// Generations run for seconds to minutes, well past the default bucket bounds
+		metric.WithExplicitBucketBoundaries(0.005, 0.025, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600))
+	if err != nil {
+		slog.Warn("Failed to create request duration histogram", "error", err)
+	}
+	size, err := meter.Int64Histogram("http.server.response.body.size",
+		metric.WithDescription("Size of HTTP response bodies"),
+		metric.WithUnit("By"))
+	if err != nil {
+		slog.Warn("Failed to create response size histogram", "error", err)
+	}
+	return &httpMetrics{duration: duration, size: size}
+}
+
+// record adds a completed request to the histograms
+func (m *httpMetrics) record(ctx context.Context, method, route string, status int, duration time.Duration, bytes int) {
+	attrs := metric.WithAttributes(
+		attribute.String("http.request.method", method),
+		attribute.String("http.route", route),
+		attribute.Int("http.response.status_code", status),
+	)
+	if m.duration != nil {
+		m.duration.Record(ctx, duration.Seconds(), attrs)
+	}
+	if m.size != nil {
+		m.size.Record(ctx, int64(bytes), attrs)
+	}
+}
+
+// maxPayloadCapture bounds how much of a request body is kept for slow request logs; larger
+// bodies cannot be parsed to sanitize them, so they are only reported by size
+const maxPayloadCapture = 64 << 10
+
+// payloadRecorder keeps a copy of the start of a request body as it is read
+type payloadRecorder struct {
+	io.ReadCloser
+	buf   bytes.Buffer
+	total int
+}
+
+// Read implements io.Reader
+func (r *payloadRecorder) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.total += n
+	if room := maxPayloadCapture - r.buf.Len(); room > 0 {
+		r.buf.Write(p[:min(n, room)])
+	}
+	return n, err
+}
+
+// secretPayloadFields are redacted from payload snippets whatever the logging settings
+var secretPayloadFields = map[string]bool{
+	"api_key": true, "apikey": true, "key": true, "provider_key": true, "authorization": true,
+	"token": true, "secret": true, "password": true,
+}
+
+// contentPayloadFields hold customer prompts and completions, which are only logged when request
+// payloads are
+var contentPayloadFields = map[string]bool{
+	"prompt": true, "system": true, "messages": true, "content": true, "text": true,
+	"variables": true, "input": true,
+}
+
+// snippet renders the recorded body for a slow request log: JSON with secrets redacted and, unless
+// includeContent is set, prompt text reduced to its length, truncated to limit bytes
+func (r *payloadRecorder) snippet(limit int, includeContent bool) string {
+	if r.total == 0 || limit == 0 {
+		return ""
+	}
+
+	var payload interface{}
+	if r.total > r.buf.Len() || json.Unmarshal(r.buf.Bytes(), &payload) != nil {
+		return fmt.Sprintf("[%d bytes not shown]", r.total)
+	}
+
+	encoded, err := json.Marshal(sanitizePayload(payload, includeContent))
+	if err != nil {
+		return fmt.Sprintf("[%d bytes not shown]", r.total)
+	}
+	if len(encoded) > limit {
+		return string(encoded[:limit]) + "..."
+	}
+	return string(encoded)
+}
+
+// sanitizePayload redacts secret fields and, unless includeContent is set, content fields from a
+// decoded JSON value
+func sanitizePayload(value interface{}, includeContent bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for field, nested := range v {
+			name := strings.ToLower(field)
+			switch {
+			case secretPayloadFields[name]:
+				v[field] = "[REDACTED]"
+			case contentPayloadFields[name] && !includeContent:
+				v[field] = redactContent(nested)
+			default:
+				v[field] = sanitizePayload(nested, includeContent)
+			}
+		}
+		return v
+	case []interface{}:
+		for i, nested := range v {
+			v[i] = sanitizePayload(nested, includeContent)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// redactContent replaces every string in a content value with its length, keeping its shape, such
+// as message roles, readable
+func redactContent(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return fmt.Sprintf("[%d chars]", len(v))
+	case map[string]interface{}:
+		for field, nested := range v {
+			// Message roles and block types say nothing about the content
+			if field == "role" || field == "type" {
+				continue
+			}
+			v[field] = redactContent(nested)
+		}
+		return v
+	case []interface{}:
+		for i, nested := range v {
+			v[i] = redactContent(nested)
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// RoutingRuleRequest represents a request to create or replace a routing rule
+type RoutingRuleRequest struct {
+	Name        string                 `json:"name" binding:"required,max=100"`
+	Description string                 `json:"description,omitempty"`
+	Order       int                    `json:"order"`
+	Enabled     *bool                  `json:"enabled,omitempty"`
+	Conditions  data.RoutingConditions `json:"conditions"`
+	TargetModel string                 `json:"target_model" binding:"required"`
+}
+
+// toRoutingRule converts the request into a routing rule; rules are enabled unless the request says otherwise
+func (r *RoutingRuleRequest) toRoutingRule() *data.RoutingRule {
+	return &data.RoutingRule{
+		Name:        r.Name,
+		Description: r.Description,
+		Order:       r.Order,
+		Enabled:     r.Enabled == nil || *r.Enabled,
+		Conditions:  r.Conditions,
+		TargetModel: r.TargetModel,
+	}
+}
+
+// ListRoutingRules handles listing routing rules in evaluation order
+func (h *Handler) ListRoutingRules(c *gin.Context) {
+	rules, err := h.routingService.List(c.Request.Context())
+	if err != nil {
+		h.getLogger(c).Error("Failed to list routing rules", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to list routing rules",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"routing_rules": rules,
+	})
+}
+
+// CreateRoutingRule handles creating a routing rule
+func (h *Handler) CreateRoutingRule(c *gin.Context) {
+	var req RoutingRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	rule := req.toRoutingRule()
+	err := h.routingService.Create(c.Request.Context(), rule)
+	if errors.Is(err, services.ErrInvalidRoutingRule) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		h.getLogger(c).Error("Failed to create routing rule", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create routing rule",
+		})
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditRoutingRuleUpdated,
+		TargetID: rule.ID,
+		After:    rule,
+	})
+
+	c.JSON(http.StatusCreated, rule)
+}
+
+// UpdateRoutingRule handles replacing a routing rule, e.g. to disable it or change its target
+func (h *Handler) UpdateRoutingRule(c *gin.Context) {
+	var req RoutingRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	before, _ := h.routingService.Get(c.Request.Context(), c.Param("rule_id"))
+
+	rule := req.toRoutingRule()
+	rule.ID = c.Param("rule_id")
+	err := h.routingService.Update(c.Request.Context(), rule)
+	if errors.Is(err, services.ErrRoutingRuleNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Routing rule not found",
+		})
+		return
+	}
+	if errors.Is(err, services.ErrInvalidRoutingRule) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		h.getLogger(c).Error("Failed to update routing rule", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to update routing rule",
+		})
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditRoutingRuleUpdated,
+		TargetID: rule.ID,
+		Before:   before,
+		After:    rule,
+	})
+
+	c.JSON(http.StatusOK, rule)
+}
+
+// DeleteRoutingRule handles deleting a routing rule
+func (h *Handler) DeleteRoutingRule(c *gin.Context) {
+	rule, err := h.routingService.Delete(c.Request.Context(), c.Param("rule_id"))
+	if errors.Is(err, services.ErrRoutingRuleNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Routing rule not found",
+		})
+		return
+	}
+	if err != nil {
+		h.getLogger(c).Error("Failed to delete routing rule", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to delete routing rule",
+		})
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditRoutingRuleDeleted,
+		TargetID: rule.ID,
+		Before:   rule,
+	})
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// serviceAccountIDPrefix starts service account user IDs, so they can't collide with Firebase Auth UIDs
+const serviceAccountIDPrefix = "sa-"
+
+// CreateServiceAccountRequest represents a request to create a service account
+type CreateServiceAccountRequest struct {
+	Name string `json:"name" binding:"required,max=100"`
+	// TierID is the pricing tier of the account's requests; empty uses the default tier
+	TierID string `json:"tier_id,omitempty"`
+	// Balance is the account's starting balance in USD, the budget its keys spend from
+	Balance float64 `json:"balance,omitempty" binding:"min=0"`
+}
+
+// ServiceAccountResponse describes a service account
+type ServiceAccountResponse struct {
+	ID        string        `json:"id"`
+	Name      string        `json:"name"`
+	Type      string        `json:"type"`
+	TierID    string        `json:"tier_id,omitempty"`
+	Balance   data.MicroUSD `json:"balance"`
+	IsActive  bool          `json:"is_active"`
+	CreatedBy string        `json:"created_by,omitempty"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+// newServiceAccountResponse describes a service account user
+func newServiceAccountResponse(user *data.User) ServiceAccountResponse {
+	return ServiceAccountResponse{
+		ID:        user.ID,
+		Name:      user.Name,
+		Type:      user.Type,
+		TierID:    user.TierID,
+		Balance:   user.Balance,
+		IsActive:  user.IsActive,
+		CreatedBy: user.CreatedBy,
+		CreatedAt: user.CreatedAt,
+	}
+}
+
+// ListServiceAccounts handles listing every service account
+func (h *Handler) ListServiceAccounts(c *gin.Context) {
+	users, err := h.firebaseService.ListServiceAccounts(c.Request.Context())
+	if err != nil {
+		h.getLogger(c).Error("Failed to list service accounts", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to list service accounts",
+		})
+		return
+	}
+
+	accounts := make([]ServiceAccountResponse, 0, len(users))
+	for _, user := range users {
+		accounts = append(accounts, newServiceAccountResponse(user))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"service_accounts": accounts,
+	})
+}
+
+// CreateServiceAccount handles creating a service account: a user without an email address or
+// login for backend integrations, with its own tier and balance, that only authenticates with the
+// API keys created for it
+func (h *Handler) CreateServiceAccount(c *gin.Context) {
+	var req CreateServiceAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	if req.TierID != "" {
+		if _, err := h.firebaseService.GetPricingTier(c.Request.Context(), req.TierID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("Unknown pricing tier %s", req.TierID),
+			})
+			return
+		}
+	}
+
+	adminID, _ := h.getAuthenticatedUserID(c)
+	user := &data.User{
+		ID:        serviceAccountIDPrefix + uuid.NewString(),
+		Name:      req.Name,
+		TierID:    req.TierID,
+		IsActive:  true,
+		CreatedBy: adminID,
+	}
+	if err := h.firebaseService.CreateServiceAccount(c.Request.Context(), user); err != nil {
+		h.getLogger(c).Error("Failed to create service account", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create service account",
+		})
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditServiceAccountCreated,
+		TargetID: user.ID,
+		After: map[string]interface{}{
+			"name":    user.Name,
+			"tier_id": user.TierID,
+		},
+	})
+
+	if amount := data.USDToMicros(req.Balance); amount > 0 {
+		if _, err := h.firebaseService.UpdateUserBalance(c.Request.Context(), user.ID, amount, data.LedgerEntryAdjustment, ""); err != nil {
+			h.getLogger(c).Error("Failed to fund service account", "error", err, "user_id", user.ID)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Service account created but its starting balance failed",
+				"id":    user.ID,
+			})
+			return
+		}
+		user.Balance = amount
+
+		h.recordAudit(c, &data.AuditEvent{
+			Type:     data.AuditBalanceCredited,
+			TargetID: user.ID,
+			Details:  map[string]interface{}{"amount_micros": amount, "source": "service_account_created"},
+		})
+	}
+
+	c.JSON(http.StatusCreated, newServiceAccountResponse(user))
+}
+
+// CreateServiceAccountAPIKey handles creating an API key for a service account
+func (h *Handler) CreateServiceAccountAPIKey(c *gin.Context) {
+	var req CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	user, err := h.firebaseService.GetUserByID(c.Request.Context(), c.Param("user_id"))
+	if err != nil || !user.IsServiceAccount() {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Service account not found",
+		})
+		return
+	}
+	if !user.IsActive {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Service account is inactive",
+		})
+		return
+	}
+
+	h.issueAPIKey(c, &req, user.ID, "")
+}
@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// CreateSessionRequest represents a request to start a session
+type CreateSessionRequest struct {
+	Model  string `json:"model" binding:"required"`
+	System string `json:"system,omitempty"`
+	// MaxContextTokens bounds the prompt and completion of each request, below the model's context
+	// window; the oldest messages are summarized to stay within it
+	MaxContextTokens int `json:"max_context_tokens,omitempty" binding:"omitempty,min=256"`
+}
+
+// SessionMessageRequest represents a message sent to a session
+type SessionMessageRequest struct {
+	Content     string        `json:"content" binding:"required"`
+	MaxTokens   *int          `json:"max_tokens,omitempty" binding:"omitempty,min=1"`
+	Temperature *float64      `json:"temperature,omitempty" binding:"omitempty,min=0,max=2"`
+	TopP        *float64      `json:"top_p,omitempty" binding:"omitempty,min=0,max=1"`
+	Stop        StopSequences `json:"stop,omitempty" binding:"max=4"`
+}
+
+// SessionMessageResponse is a session's reply to a message, with the session as updated by it
+type SessionMessageResponse struct {
+	*GenerateResponse
+	Session *data.Session `json:"session"`
+}
+
+// CreateSession handles starting a session, whose conversation history the server keeps
+func (h *Handler) CreateSession(c *gin.Context) {
+	requestCtx, exists := h.getRequestContext(c)
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Request context not found",
+		})
+		return
+	}
+
+	var req CreateSessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format: " + err.Error(),
+		})
+		return
+	}
+
+	session, err := h.sessionService.Create(c.Request.Context(), requestCtx.serviceContext(), req.Model, req.System, req.MaxContextTokens)
+	if errors.Is(err, services.ErrUnknownModel) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		requestCtx.Logger.Error("Failed to create session", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create session",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, session)
+}
+
+// GetSession handles getting a session and its messages, including those that have been summarized
+func (h *Handler) GetSession(c *gin.Context) {
+	session, ok := h.userSession(c)
+	if !ok {
+		return
+	}
+
+	messages, err := h.sessionService.Messages(c.Request.Context(), session)
+	if err != nil {
+		h.getLogger(c).Error("Failed to list session messages", "session_id", session.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get session",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"session":  session,
+		"messages": messages,
+	})
+}
+
+// DeleteSession handles deleting a session and its messages
+func (h *Handler) DeleteSession(c *gin.Context) {
+	session, ok := h.userSession(c)
+	if !ok {
+		return
+	}
+
+	if err := h.sessionService.Delete(c.Request.Context(), session.UserID, session.ID); err != nil && !errors.Is(err, data.ErrSessionNotFound) {
+		h.getLogger(c).Error("Failed to delete session", "session_id", session.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to delete session",
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// SendSessionMessage handles sending a message to a session. The message is generated with the
+// session's history, whose oldest messages are summarized by the optimizer model once they no
+// longer fit the session's context, and billed like any generation, the summary included.
+// The message and reply are added to the session once generated.
+func (h *Handler) SendSessionMessage(c *gin.Context) {
+	startTime := time.Now()
+
+	requestCtx, exists := h.getRequestContext(c)
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Request context not found",
+		})
+		return
+	}
+
+	var req SessionMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format: " + err.Error(),
+		})
+		return
+	}
+
+	session, ok := h.userSession(c)
+	if !ok {
+		return
+	}
+
+	serviceReq := &services.GenerationRequest{
+		MaxTokens:   h.getIntValue(req.MaxTokens, 1000),
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+		Stop:        req.Stop,
+	}
+	prepared, err := h.sessionService.Prepare(c.Request.Context(), session, req.Content, serviceReq, requestCtx.serviceContext())
+	if errors.Is(err, services.ErrContextWindowExceeded) || errors.Is(err, services.ErrUnknownModel) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		requestCtx.Logger.Error("Failed to prepare session message", "session_id", session.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to prepare session message",
+		})
+		return
+	}
+
+	resp, genErr := h.runGeneration(c.Request.Context(), requestCtx, serviceReq, startTime)
+	if genErr != nil {
+		c.JSON(genErr.Status, genErr.Body)
+		return
+	}
+
+	updated, err := h.sessionService.Record(c.Request.Context(), prepared, resp.Text, requestCtx.RequestID, resp.Cost.Total())
+	if errors.Is(err, data.ErrSessionConflict) || errors.Is(err, data.ErrSessionNotFound) {
+		// The reply was generated and billed, so it is still returned, though it was not kept
+		requestCtx.Logger.Warn("Session changed while a message was generated", "session_id", session.ID, "error", err)
+		c.JSON(http.StatusConflict, gin.H{
+			"error":    "The session was changed by another request, so this message was not added to it",
+			"response": resp,
+		})
+		return
+	}
+	if err != nil {
+		requestCtx.Logger.Error("Failed to record session message", "session_id", session.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":    "Failed to record session message",
+			"response": resp,
+		})
+		return
+	}
+
+	c.Header("X-Request-ID", requestCtx.RequestID)
+	c.JSON(http.StatusOK, &SessionMessageResponse{GenerateResponse: resp, Session: updated})
+}
+
+// userSession gets the session named in the path, writing an error if the caller has no such session
+func (h *Handler) userSession(c *gin.Context) (*data.Session, bool) {
+	requestCtx, exists := h.getRequestContext(c)
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Request context not found",
+		})
+		return nil, false
+	}
+
+	session, err := h.sessionService.Get(c.Request.Context(), requestCtx.UserID, c.Param("session_id"))
+	if errors.Is(err, data.ErrSessionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Session not found",
+		})
+		return nil, false
+	}
+	if err != nil {
+		requestCtx.Logger.Error("Failed to get session", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get session",
+		})
+		return nil, false
+	}
+	return session, true
+}
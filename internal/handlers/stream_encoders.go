@@ -0,0 +1,347 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// Stream formats clients choose between with the stream_format query parameter or the Accept header
+const (
+	// StreamFormatSSE sends the completion's text as plain server-sent event data, with logprobs,
+	// errors, the finish reason, timing, cost and usage as named events. It is the default.
+	StreamFormatSSE = "sse"
+	// StreamFormatSSEJSON sends every event as JSON, including the completion's text
+	StreamFormatSSEJSON = "sse_json"
+	// StreamFormatOpenAI sends OpenAI chat.completion.chunk objects ending with data: [DONE]
+	StreamFormatOpenAI = "openai"
+	// StreamFormatText sends only the completion's text, as it is generated
+	StreamFormatText = "text"
+)
+
+// streamInfo identifies a stream to encoders whose frames carry its ID and model
+type streamInfo struct {
+	ID      string
+	Model   string
+	Created int64
+}
+
+// streamEnd is what a stream reports once the provider has finished it
+type streamEnd struct {
+	// FinishReason is why the provider or the server ended the stream, or "" when that isn't known
+	FinishReason string
+	Timing       *TimingInfo
+	Cost         *CostInfo
+	// Usage and Savings are what the stream was billed for and what optimization saved it
+	Usage   *UsageInfo
+	Savings *SavingsInfo
+}
+
+// streamUsageEvent is a stream's final accounting, with the usage, cost, savings and finish reason a
+// non-streaming response reports, for clients that can't read trailers
+type streamUsageEvent struct {
+	Usage        *UsageInfo   `json:"usage"`
+	Cost         *CostInfo    `json:"cost,omitempty"`
+	Savings      *SavingsInfo `json:"savings,omitempty"`
+	FinishReason string       `json:"finish_reason,omitempty"`
+}
+
+// streamEncoder frames a generation stream for the client. Frames are written as they are
+// encoded; an error means the client is gone.
+type streamEncoder interface {
+	// ContentType is the stream's Content-Type header
+	ContentType() string
+	Text(w io.Writer, text []byte) error
+	Logprobs(w io.Writer, logprobs []data.TokenLogprob) error
+	// Error reports an error once the stream has started, when the format can carry one
+	Error(w io.Writer, err error) error
+	End(w io.Writer, end *streamEnd) error
+	// Heartbeat keeps an idle connection open, when the format allows it, and reports whether the
+	// client is still there
+	Heartbeat(w io.Writer) bool
+}
+
+// streamEncoders create the encoder of each stream format
+var streamEncoders = map[string]func(info streamInfo) streamEncoder{
+	StreamFormatSSE:     func(streamInfo) streamEncoder { return &sseEncoder{} },
+	StreamFormatSSEJSON: func(streamInfo) streamEncoder { return sseJSONEncoder{} },
+	StreamFormatOpenAI:  func(info streamInfo) streamEncoder { return &openAIEncoder{info: info} },
+	StreamFormatText:    func(streamInfo) streamEncoder { return textEncoder{} },
+}
+
+// streamFormat returns the format a client asked for: the stream_format query parameter, else a
+// text/plain or text/event-stream with a format parameter in the Accept header, else SSE. An
+// unknown stream_format is an error; Accept values that name no format are ignored.
+func streamFormat(c *gin.Context) (string, error) {
+	if format := c.Query("stream_format"); format != "" {
+		if _, ok := streamEncoders[format]; !ok {
+			return "", fmt.Errorf("unknown stream_format %q: expected sse, sse_json, openai or text", format)
+		}
+		return format, nil
+	}
+
+	for _, accepted := range strings.Split(c.GetHeader("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "text/plain":
+			return StreamFormatText, nil
+		case "text/event-stream":
+			switch params["format"] {
+			case "json":
+				return StreamFormatSSEJSON, nil
+			case StreamFormatOpenAI:
+				return StreamFormatOpenAI, nil
+			}
+			return StreamFormatSSE, nil
+		}
+	}
+	return StreamFormatSSE, nil
+}
+
+// writeSSE writes a server-sent event, with no event line when event is ""
+func writeSSE(w io.Writer, event string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if event != "" {
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, body)
+	} else {
+		_, err = fmt.Fprintf(w, "data: %s\n\n", body)
+	}
+	return err
+}
+
+// sseEncoder writes the completion's text as plain event data and everything else as named JSON events
+type sseEncoder struct {
+	// frame is reused across chunks
+	frame []byte
+}
+
+func (e *sseEncoder) ContentType() string { return "text/event-stream" }
+
+// Text writes one data line per line of text, since a newline inside a data line would end the
+// field and clients rejoin an event's data lines with newlines
+func (e *sseEncoder) Text(w io.Writer, text []byte) error {
+	e.frame = e.frame[:0]
+	for {
+		line, rest, more := bytes.Cut(text, []byte("\n"))
+		e.frame = append(append(append(e.frame, "data: "...), line...), '\n')
+		if !more {
+			break
+		}
+		text = rest
+	}
+	e.frame = append(e.frame, '\n')
+	_, err := w.Write(e.frame)
+	return err
+}
+
+func (e *sseEncoder) Logprobs(w io.Writer, logprobs []data.TokenLogprob) error {
+	// Logprobs follow the text they describe as their own event, so text chunks stay plain
+	return writeSSE(w, "logprobs", gin.H{"logprobs": logprobs})
+}
+
+func (e *sseEncoder) Error(w io.Writer, err error) error {
+	return writeSSE(w, "error", gin.H{"error": err.Error()})
+}
+
+func (e *sseEncoder) End(w io.Writer, end *streamEnd) error {
+	return writeSSEEnd(w, end)
+}
+
+func (e *sseEncoder) Heartbeat(w io.Writer) bool {
+	return writeSSEHeartbeat(w)
+}
+
+// writeSSEEnd writes the events both SSE formats end a stream with: its finish reason, timing and
+// cost, then its usage, which repeats the cost and finish reason so one event holds all its accounting
+func writeSSEEnd(w io.Writer, end *streamEnd) error {
+	if end.FinishReason != "" {
+		if err := writeSSE(w, "finish", gin.H{"finish_reason": end.FinishReason}); err != nil {
+			return err
+		}
+	}
+	if end.Timing != nil {
+		if err := writeSSE(w, "timing", gin.H{"timing": end.Timing}); err != nil {
+			return err
+		}
+	}
+	if end.Cost != nil {
+		// The stream is charged once it ends, so its cost can be sent with the final events
+		if err := writeSSE(w, "cost", gin.H{"cost": end.Cost}); err != nil {
+			return err
+		}
+	}
+	if end.Usage != nil {
+		return writeSSE(w, "usage", streamUsageEvent{Usage: end.Usage, Cost: end.Cost, Savings: end.Savings, FinishReason: end.FinishReason})
+	}
+	return nil
+}
+
+// sseJSONEncoder writes the completion's text as {"text": ...} events, so it survives newlines
+type sseJSONEncoder struct{}
+
+func (sseJSONEncoder) ContentType() string { return "text/event-stream" }
+
+func (sseJSONEncoder) Text(w io.Writer, text []byte) error {
+	return writeSSE(w, "", gin.H{"text": string(text)})
+}
+
+func (sseJSONEncoder) Logprobs(w io.Writer, logprobs []data.TokenLogprob) error {
+	return writeSSE(w, "logprobs", gin.H{"logprobs": logprobs})
+}
+
+func (sseJSONEncoder) Error(w io.Writer, err error) error {
+	return writeSSE(w, "error", gin.H{"error": err.Error()})
+}
+
+func (sseJSONEncoder) End(w io.Writer, end *streamEnd) error {
+	return writeSSEEnd(w, end)
+}
+
+func (sseJSONEncoder) Heartbeat(w io.Writer) bool {
+	return writeSSEHeartbeat(w)
+}
+
+// openAIChunk is an OpenAI chat.completion.chunk object
+type openAIChunk struct {
+	ID      string              `json:"id"`
+	Object  string              `json:"object"`
+	Created int64               `json:"created"`
+	Model   string              `json:"model"`
+	Choices []openAIChunkChoice `json:"choices"`
+	// Usage is on the final chunk, as OpenAI sends it when asked to include usage
+	Usage *openAIUsage `json:"usage,omitempty"`
+	// Cost, Timing and Savings are AptRouter's own, on the final chunk
+	Cost    *CostInfo    `json:"cost,omitempty"`
+	Timing  *TimingInfo  `json:"timing,omitempty"`
+	Savings *SavingsInfo `json:"savings,omitempty"`
+}
+
+// openAIUsage is a completion's usage as OpenAI reports it
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// openAIChunkChoice is a chunk's only choice
+type openAIChunkChoice struct {
+	Index        int              `json:"index"`
+	Delta        openAIChunkDelta `json:"delta"`
+	Logprobs     *openAILogprobs  `json:"logprobs"`
+	FinishReason *string          `json:"finish_reason"`
+}
+
+// openAIChunkDelta is the text a chunk adds
+type openAIChunkDelta struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+// openAILogprobs carries the logprobs of a chunk's tokens
+type openAILogprobs struct {
+	Content []data.TokenLogprob `json:"content"`
+}
+
+// openAIEncoder writes OpenAI chat completion chunks, so OpenAI SDKs can read the stream
+type openAIEncoder struct {
+	info streamInfo
+	// started is set once the first chunk, which carries the assistant role, was sent
+	started bool
+}
+
+func (e *openAIEncoder) ContentType() string { return "text/event-stream" }
+
+func (e *openAIEncoder) chunk(choice openAIChunkChoice) openAIChunk {
+	if !e.started {
+		choice.Delta.Role = "assistant"
+		e.started = true
+	}
+	return openAIChunk{
+		ID:      "chatcmpl-" + e.info.ID,
+		Object:  "chat.completion.chunk",
+		Created: e.info.Created,
+		Model:   e.info.Model,
+		Choices: []openAIChunkChoice{choice},
+	}
+}
+
+func (e *openAIEncoder) Text(w io.Writer, text []byte) error {
+	return writeSSE(w, "", e.chunk(openAIChunkChoice{Delta: openAIChunkDelta{Content: string(text)}}))
+}
+
+func (e *openAIEncoder) Logprobs(w io.Writer, logprobs []data.TokenLogprob) error {
+	return writeSSE(w, "", e.chunk(openAIChunkChoice{Logprobs: &openAILogprobs{Content: logprobs}}))
+}
+
+func (e *openAIEncoder) Error(w io.Writer, err error) error {
+	return writeSSE(w, "", gin.H{"error": gin.H{"message": err.Error(), "type": "server_error"}})
+}
+
+func (e *openAIEncoder) End(w io.Writer, end *streamEnd) error {
+	finishReason := openAIFinishReason(end.FinishReason)
+	final := e.chunk(openAIChunkChoice{FinishReason: &finishReason})
+	final.Cost, final.Timing, final.Savings = end.Cost, end.Timing, end.Savings
+	if end.Usage != nil {
+		final.Usage = &openAIUsage{PromptTokens: end.Usage.InputTokens, CompletionTokens: end.Usage.OutputTokens, TotalTokens: end.Usage.TotalTokens}
+	}
+	if err := writeSSE(w, "", final); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "data: [DONE]\n\n")
+	return err
+}
+
+func (e *openAIEncoder) Heartbeat(w io.Writer) bool {
+	return writeSSEHeartbeat(w)
+}
+
+// openAIFinishReason maps a stream's finish reason to OpenAI's, whose reasons the normalized ones
+// share; streams that ended for any other reason stopped
+func openAIFinishReason(reason string) string {
+	switch reason {
+	case services.FinishReasonLengthCapped:
+		return data.FinishReasonLength
+	case data.FinishReasonLength, data.FinishReasonContentFilter, data.FinishReasonToolCalls:
+		return reason
+	default:
+		return data.FinishReasonStop
+	}
+}
+
+// textEncoder writes only the completion's text. Nothing else can be told apart from it, so the
+// stream's end, errors and heartbeats are not sent.
+type textEncoder struct{}
+
+func (textEncoder) ContentType() string { return "text/plain; charset=utf-8" }
+
+func (textEncoder) Text(w io.Writer, text []byte) error {
+	_, err := w.Write(text)
+	return err
+}
+
+func (textEncoder) Logprobs(io.Writer, []data.TokenLogprob) error { return nil }
+
+func (textEncoder) Error(io.Writer, error) error { return nil }
+
+func (textEncoder) End(io.Writer, *streamEnd) error { return nil }
+
+func (textEncoder) Heartbeat(io.Writer) bool { return true }
+
+// newStreamInfo identifies a stream for its encoder
+func newStreamInfo(requestID, model string) streamInfo {
+	return streamInfo{ID: requestID, Model: model, Created: time.Now().Unix()}
+}
@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// SetSystemPromptRequest represents a request to set a managed system prompt
+type SetSystemPromptRequest struct {
+	Content string `json:"content" binding:"required"`
+}
+
+// GetOrgSystemPrompt handles getting the system prompt applied to an organization's requests
+func (h *Handler) GetOrgSystemPrompt(c *gin.Context) {
+	if _, ok := h.requireOrgRole(c, false); !ok {
+		return
+	}
+	h.getSystemPrompt(c, data.SystemPromptScopeOrg, c.Param("org_id"))
+}
+
+// SetOrgSystemPrompt handles setting the system prompt applied to an organization's requests
+func (h *Handler) SetOrgSystemPrompt(c *gin.Context) {
+	caller, ok := h.requireOrgRole(c, true)
+	if !ok {
+		return
+	}
+	h.setSystemPrompt(c, data.SystemPromptScopeOrg, caller.OrgID, caller.OrgID, caller.UserID)
+}
+
+// DeleteOrgSystemPrompt handles removing an organization's system prompt
+func (h *Handler) DeleteOrgSystemPrompt(c *gin.Context) {
+	caller, ok := h.requireOrgRole(c, true)
+	if !ok {
+		return
+	}
+	h.deleteSystemPrompt(c, data.SystemPromptScopeOrg, caller.OrgID, caller.OrgID)
+}
+
+// ListOrgSystemPromptVersions handles listing every version of an organization's system prompt
+func (h *Handler) ListOrgSystemPromptVersions(c *gin.Context) {
+	if _, ok := h.requireOrgRole(c, false); !ok {
+		return
+	}
+	h.listSystemPromptVersions(c, data.SystemPromptScopeOrg, c.Param("org_id"))
+}
+
+// GetKeySystemPrompt handles getting the system prompt applied to an API key's requests
+func (h *Handler) GetKeySystemPrompt(c *gin.Context) {
+	key, ok := h.requireAPIKeyOwner(c)
+	if !ok {
+		return
+	}
+	h.getSystemPrompt(c, data.SystemPromptScopeAPIKey, key.ID)
+}
+
+// SetKeySystemPrompt handles setting the system prompt applied to an API key's requests
+func (h *Handler) SetKeySystemPrompt(c *gin.Context) {
+	key, ok := h.requireAPIKeyOwner(c)
+	if !ok {
+		return
+	}
+	userID, _ := h.getAuthenticatedUserID(c)
+	h.setSystemPrompt(c, data.SystemPromptScopeAPIKey, key.ID, key.OrgID, userID)
+}
+
+// DeleteKeySystemPrompt handles removing an API key's system prompt
+func (h *Handler) DeleteKeySystemPrompt(c *gin.Context) {
+	key, ok := h.requireAPIKeyOwner(c)
+	if !ok {
+		return
+	}
+	h.deleteSystemPrompt(c, data.SystemPromptScopeAPIKey, key.ID, key.OrgID)
+}
+
+// ListKeySystemPromptVersions handles listing every version of an API key's system prompt
+func (h *Handler) ListKeySystemPromptVersions(c *gin.Context) {
+	key, ok := h.requireAPIKeyOwner(c)
+	if !ok {
+		return
+	}
+	h.listSystemPromptVersions(c, data.SystemPromptScopeAPIKey, key.ID)
+}
+
+// getSystemPrompt writes the current system prompt for an organization or API key
+func (h *Handler) getSystemPrompt(c *gin.Context, scope, ownerID string) {
+	prompt, err := h.systemPromptService.Get(c.Request.Context(), scope, ownerID)
+	if err != nil {
+		h.getLogger(c).Error("Failed to get system prompt", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get system prompt",
+		})
+		return
+	}
+	if prompt == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "No system prompt set",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, prompt)
+}
+
+// setSystemPrompt stores a new system prompt version from the request body
+func (h *Handler) setSystemPrompt(c *gin.Context, scope, ownerID, orgID, userID string) {
+	var req SetSystemPromptRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	before, _ := h.systemPromptService.Get(c.Request.Context(), scope, ownerID)
+
+	prompt, err := h.systemPromptService.Set(c.Request.Context(), scope, ownerID, req.Content, userID)
+	if errors.Is(err, services.ErrSystemPromptTooLong) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		h.getLogger(c).Error("Failed to set system prompt", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to set system prompt",
+		})
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditSystemPromptUpdated,
+		OrgID:    orgID,
+		TargetID: scope + ":" + ownerID,
+		Before:   before,
+		After:    prompt,
+	})
+
+	c.JSON(http.StatusOK, prompt)
+}
+
+// deleteSystemPrompt removes the system prompt for an organization or API key
+func (h *Handler) deleteSystemPrompt(c *gin.Context, scope, ownerID, orgID string) {
+	if err := h.systemPromptService.Delete(c.Request.Context(), scope, ownerID); err != nil {
+		h.getLogger(c).Error("Failed to delete system prompt", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to delete system prompt",
+		})
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditSystemPromptDeleted,
+		OrgID:    orgID,
+		TargetID: scope + ":" + ownerID,
+	})
+
+	c.Status(http.StatusNoContent)
+}
+
+// listSystemPromptVersions writes the version history of a system prompt
+func (h *Handler) listSystemPromptVersions(c *gin.Context, scope, ownerID string) {
+	versions, err := h.systemPromptService.Versions(c.Request.Context(), scope, ownerID)
+	if err != nil {
+		h.getLogger(c).Error("Failed to list system prompt versions", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to list system prompt versions",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"versions": versions,
+	})
+}
+
+// requireAPIKeyOwner loads the API key in the path and checks that the caller owns it, or manages
+// the organization it bills. It writes the error response on failure.
+func (h *Handler) requireAPIKeyOwner(c *gin.Context) (*data.APIKey, bool) {
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return nil, false
+	}
+
+	key, err := h.firebaseService.GetAPIKey(c.Request.Context(), c.Param("key_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "API key not found",
+		})
+		return nil, false
+	}
+
+	if key.UserID == userID {
+		return key, true
+	}
+
+	if key.OrgID != "" {
+		member, err := h.firebaseService.GetOrgMember(c.Request.Context(), key.OrgID, userID)
+		if err == nil && member.Role.CanManageMembers() {
+			return key, true
+		}
+	}
+
+	// Don't reveal whether the key exists
+	c.JSON(http.StatusNotFound, gin.H{
+		"error": "API key not found",
+	})
+	return nil, false
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// CreateTemplateRequest represents a request to create a prompt template
+type CreateTemplateRequest struct {
+	Name        string `json:"name" binding:"required,max=100"`
+	Description string `json:"description,omitempty" binding:"max=500"`
+	Content     string `json:"content" binding:"required"`
+	// OrgID shares the template with an organization the caller owns or administers
+	OrgID string `json:"org_id,omitempty"`
+}
+
+// UpdateTemplateRequest represents a request to store a new version of a prompt template
+type UpdateTemplateRequest struct {
+	Description string `json:"description,omitempty" binding:"max=500"`
+	Content     string `json:"content" binding:"required"`
+}
+
+// CreateTemplate handles creating a prompt template
+func (h *Handler) CreateTemplate(c *gin.Context) {
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	var req CreateTemplateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	template, err := h.templateService.Create(c.Request.Context(), userID, req.OrgID, req.Name, req.Description, req.Content)
+	if h.writeTemplateError(c, err, "Failed to create template") {
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditTemplateUpdated,
+		OrgID:    template.OrgID,
+		TargetID: template.ID,
+		After:    template,
+	})
+
+	c.JSON(http.StatusCreated, template)
+}
+
+// ListTemplates handles listing the caller's templates, or an organization's with ?org_id=
+func (h *Handler) ListTemplates(c *gin.Context) {
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	templates, err := h.templateService.List(c.Request.Context(), userID, c.Query("org_id"))
+	if h.writeTemplateError(c, err, "Failed to list templates") {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"templates": templates,
+	})
+}
+
+// GetTemplate handles getting a template's current version, or a pinned one with ?version=
+func (h *Handler) GetTemplate(c *gin.Context) {
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	version := 0
+	if raw := c.Query("version"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "version must be a positive integer",
+			})
+			return
+		}
+		version = parsed
+	}
+
+	template, err := h.templateService.Get(c.Request.Context(), userID, c.Param("template_id"), version)
+	if h.writeTemplateError(c, err, "Failed to get template") {
+		return
+	}
+
+	c.JSON(http.StatusOK, template)
+}
+
+// UpdateTemplate handles storing a new version of a template
+func (h *Handler) UpdateTemplate(c *gin.Context) {
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	var req UpdateTemplateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	template, err := h.templateService.Update(c.Request.Context(), userID, c.Param("template_id"), req.Description, req.Content)
+	if h.writeTemplateError(c, err, "Failed to update template") {
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditTemplateUpdated,
+		OrgID:    template.OrgID,
+		TargetID: template.ID,
+		After:    template,
+	})
+
+	c.JSON(http.StatusOK, template)
+}
+
+// DeleteTemplate handles deleting a template
+func (h *Handler) DeleteTemplate(c *gin.Context) {
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	template, err := h.templateService.Delete(c.Request.Context(), userID, c.Param("template_id"))
+	if h.writeTemplateError(c, err, "Failed to delete template") {
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditTemplateDeleted,
+		OrgID:    template.OrgID,
+		TargetID: template.ID,
+		Before:   template,
+	})
+
+	c.Status(http.StatusNoContent)
+}
+
+// ListTemplateVersions handles listing every version of a template
+func (h *Handler) ListTemplateVersions(c *gin.Context) {
+	userID, ok := h.getAuthenticatedUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	versions, err := h.templateService.Versions(c.Request.Context(), userID, c.Param("template_id"))
+	if h.writeTemplateError(c, err, "Failed to list template versions") {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"versions": versions,
+	})
+}
+
+// writeTemplateError writes the response for a template service error, reporting whether there was one
+func (h *Handler) writeTemplateError(c *gin.Context, err error, message string) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, services.ErrTemplateNotFound):
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Template not found",
+		})
+	case errors.Is(err, services.ErrTemplateForbidden):
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": err.Error(),
+		})
+	case errors.Is(err, services.ErrInvalidTemplate):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+	default:
+		h.getLogger(c).Error(message, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": message,
+		})
+	}
+	return true
+}
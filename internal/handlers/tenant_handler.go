@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// tenantHeader lets clients assert which tenant a request belongs to
+const tenantHeader = "X-Tenant-ID"
+
+// tenantIDPattern restricts tenant IDs to values that are safe in headers and document IDs
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// TenantRequest represents a request to create or replace a tenant
+type TenantRequest struct {
+	// ID is required when creating a tenant and ignored when updating one
+	ID            string   `json:"id,omitempty"`
+	Name          string   `json:"name" binding:"required,max=100"`
+	IsActive      *bool    `json:"is_active,omitempty"`
+	AllowedModels []string `json:"allowed_models,omitempty"`
+	TierID        string   `json:"tier_id,omitempty"`
+}
+
+// BindKeyTenantRequest represents a request to bind an API key to a tenant
+type BindKeyTenantRequest struct {
+	// TenantID is the tenant to bind the key to; empty unbinds it
+	TenantID string `json:"tenant_id"`
+}
+
+// resolveTenant loads the tenant an API key is bound to and checks the tenant the caller asserted,
+// from the X-Tenant-ID header, against it
+func (h *Handler) resolveTenant(ctx context.Context, logger *slog.Logger, requested string, apiKey *data.APIKey) (*data.Tenant, *authError) {
+	if requested != "" && requested != apiKey.TenantID {
+		logger.Warn("API key used for another tenant", "requested_tenant", requested, "key_tenant", apiKey.TenantID)
+		return nil, &authError{
+			Status:  http.StatusForbidden,
+			Message: fmt.Sprintf("API key does not belong to tenant %s", requested),
+			Reason:  "tenant_mismatch",
+			Details: map[string]interface{}{"api_key_id": apiKey.ID, "user_id": apiKey.UserID, "tenant_id": requested},
+		}
+	}
+
+	if apiKey.TenantID == "" {
+		return nil, nil
+	}
+
+	tenant, err := h.getTenantFromCache(ctx, apiKey.TenantID)
+	if err != nil {
+		logger.Error("Failed to get tenant", "error", err, "tenant_id", apiKey.TenantID)
+		return nil, &authError{Status: http.StatusInternalServerError, Message: "Failed to load tenant data"}
+	}
+	if tenant == nil || !tenant.IsActive {
+		return nil, &authError{Status: http.StatusForbidden, Message: "Tenant is inactive"}
+	}
+
+	return tenant, nil
+}
+
+// ListTenants handles listing every tenant
+func (h *Handler) ListTenants(c *gin.Context) {
+	tenants, err := h.firebaseService.ListTenants(c.Request.Context())
+	if err != nil {
+		h.getLogger(c).Error("Failed to list tenants", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to list tenants",
+		})
+		return
+	}
+	if tenants == nil {
+		tenants = []*data.Tenant{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"tenants": tenants,
+	})
+}
+
+// CreateTenant handles creating a tenant
+func (h *Handler) CreateTenant(c *gin.Context) {
+	var req TenantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+	if !tenantIDPattern.MatchString(req.ID) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "id must be 1-63 lowercase letters, digits or dashes",
+		})
+		return
+	}
+
+	tenant, ok := h.tenantFromRequest(c, req.ID, &req)
+	if !ok {
+		return
+	}
+
+	err := h.firebaseService.CreateTenant(c.Request.Context(), tenant)
+	if errors.Is(err, data.ErrTenantExists) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		h.getLogger(c).Error("Failed to create tenant", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create tenant",
+		})
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditTenantUpdated,
+		TargetID: tenant.ID,
+		After:    tenant,
+	})
+
+	c.JSON(http.StatusCreated, tenant)
+}
+
+// UpdateTenant handles replacing a tenant's settings, e.g. to deactivate it or change its catalog
+func (h *Handler) UpdateTenant(c *gin.Context) {
+	var req TenantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	ctx := c.Request.Context()
+	before, err := h.firebaseService.GetTenant(ctx, c.Param("tenant_id"))
+	if err != nil {
+		h.getLogger(c).Error("Failed to get tenant", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to update tenant",
+		})
+		return
+	}
+	if before == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Tenant not found",
+		})
+		return
+	}
+
+	tenant, ok := h.tenantFromRequest(c, before.ID, &req)
+	if !ok {
+		return
+	}
+	if req.IsActive == nil {
+		tenant.IsActive = before.IsActive
+	}
+	tenant.CreatedAt = before.CreatedAt
+
+	if err := h.firebaseService.UpdateTenant(ctx, tenant); err != nil {
+		h.getLogger(c).Error("Failed to update tenant", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to update tenant",
+		})
+		return
+	}
+	if err := h.cache.Invalidate(ctx, services.TenantCacheKey(tenant.ID)); err != nil {
+		h.getLogger(c).Warn("Failed to invalidate cached tenant", "error", err)
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditTenantUpdated,
+		TargetID: tenant.ID,
+		Before:   before,
+		After:    tenant,
+	})
+
+	c.JSON(http.StatusOK, tenant)
+}
+
+// SetAPIKeyTenant handles binding an API key to a tenant, or unbinding it
+func (h *Handler) SetAPIKeyTenant(c *gin.Context) {
+	var req BindKeyTenantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+
+	ctx := c.Request.Context()
+	if req.TenantID != "" {
+		tenant, err := h.firebaseService.GetTenant(ctx, req.TenantID)
+		if err != nil {
+			h.getLogger(c).Error("Failed to get tenant", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to update API key",
+			})
+			return
+		}
+		if tenant == nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Tenant not found",
+			})
+			return
+		}
+	}
+
+	keyID := c.Param("key_id")
+	err := h.firebaseService.SetAPIKeyTenant(ctx, keyID, req.TenantID)
+	if errors.Is(err, data.ErrAPIKeyNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "API key not found",
+		})
+		return
+	}
+	if err != nil {
+		h.getLogger(c).Error("Failed to set API key tenant", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to update API key",
+		})
+		return
+	}
+
+	h.recordAudit(c, &data.AuditEvent{
+		Type:     data.AuditAPIKeyTenantUpdated,
+		TargetID: keyID,
+		After:    req,
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"key_id":    keyID,
+		"tenant_id": req.TenantID,
+	})
+}
+
+// GetTenantUsage handles reporting a tenant's usage. The range defaults to the last 30 days.
+func (h *Handler) GetTenantUsage(c *gin.Context) {
+	startDate, endDate, ok := parseDateRange(c, 30)
+	if !ok {
+		return
+	}
+
+	tenantID := c.Param("tenant_id")
+	usage, err := h.firebaseService.GetTenantUsage(c.Request.Context(), tenantID, startDate, endDate)
+	if err != nil {
+		h.getLogger(c).Error("Failed to get tenant usage", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get tenant usage",
+		})
+		return
+	}
+	usage["tenant_id"] = tenantID
+
+	c.JSON(http.StatusOK, usage)
+}
+
+// tenantFromRequest validates a tenant request's catalog and tier, writing a 400 if either is unknown
+func (h *Handler) tenantFromRequest(c *gin.Context, tenantID string, req *TenantRequest) (*data.Tenant, bool) {
+	for _, model := range req.AllowedModels {
+		if _, err := h.pricingService.GetModelConfig(model); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("Unknown model %s", model),
+			})
+			return nil, false
+		}
+	}
+
+	if req.TierID != "" {
+		if _, err := h.firebaseService.GetPricingTier(c.Request.Context(), req.TierID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("Unknown pricing tier %s", req.TierID),
+			})
+			return nil, false
+		}
+	}
+
+	return &data.Tenant{
+		ID:            tenantID,
+		Name:          req.Name,
+		IsActive:      req.IsActive == nil || *req.IsActive,
+		AllowedModels: req.AllowedModels,
+		TierID:        req.TierID,
+	}, true
+}
@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apt-router/api/internal/services"
+	"github.com/gin-gonic/gin"
+)
+
+// API versions. Each is served under its own path prefix; v2 takes the conversation as chat
+// messages, and is shimmed onto the same generation pipeline as v1.
+const (
+	APIVersionV1 = "v1"
+	APIVersionV2 = "v2"
+)
+
+// apiVersions lists the supported API versions, oldest first
+var apiVersions = []string{APIVersionV1, APIVersionV2}
+
+// apiVersionHeader reports the API version that served a response, and lets clients pin the
+// version they were written against so a request sent to the wrong path fails loudly
+const apiVersionHeader = "X-API-Version"
+
+// flatPromptDeprecatedAt is when the v1 flat prompt field was deprecated in favour of v2 messages
+var flatPromptDeprecatedAt = time.Date(2026, time.October, 16, 0, 0, 0, 0, time.UTC)
+
+// APIVersionMiddleware marks responses with the route group's API version, and rejects requests
+// whose X-API-Version header asks for another version
+func (h *Handler) APIVersionMiddleware(version string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header(apiVersionHeader, version)
+
+		if requested := c.GetHeader(apiVersionHeader); requested != "" && requested != version {
+			message := fmt.Sprintf("API version %s was requested, but this is the %s API: use the /%s path", requested, version, requested)
+			if !slices.Contains(apiVersions, requested) {
+				message = fmt.Sprintf("unsupported API version %q: supported versions are %s", requested, strings.Join(apiVersions, ", "))
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error": message,
+			})
+			return
+		}
+
+		c.Set(string(apiVersionGinKey), version)
+		c.Next()
+	}
+}
+
+// getAPIVersion gets the API version set by APIVersionMiddleware; routes outside a versioned
+// group are served as v1
+func (h *Handler) getAPIVersion(c *gin.Context) string {
+	if version := c.GetString(string(apiVersionGinKey)); version != "" {
+		return version
+	}
+	return APIVersionV1
+}
+
+// ChatMessage is one message of a v2 generate request's conversation
+type ChatMessage struct {
+	Role    string         `json:"role" binding:"required,oneof=system user assistant"`
+	Content MessageContent `json:"content" binding:"required"`
+}
+
+// V2GenerateRequest is the v2 generate request. It takes the conversation as messages in place
+// of the flat prompt, and otherwise accepts the v1 fields.
+type V2GenerateRequest struct {
+	GenerateRequest
+	Messages []ChatMessage `json:"messages,omitempty" binding:"omitempty,dive"`
+}
+
+// toV1 converts the request to the v1 request the generation pipeline takes. System messages
+// become the caller's system instructions and the rest of the conversation the prompt.
+func (r *V2GenerateRequest) toV1() (*GenerateRequest, error) {
+	if r.Prompt != "" {
+		return nil, fmt.Errorf("prompt is not supported in v2: send the conversation as messages")
+	}
+	if len(r.Messages) == 0 && r.TemplateID == "" {
+		return nil, fmt.Errorf("messages or template_id is required")
+	}
+	if len(r.Messages) > 0 && r.TemplateID != "" {
+		return nil, fmt.Errorf("messages and template_id cannot both be set")
+	}
+
+	req := r.GenerateRequest
+	if len(r.Messages) == 0 {
+		return &req, nil
+	}
+
+	var system []string
+	var turns []Message
+	cached := false
+	for i, message := range r.Messages {
+		text, err := message.Content.text()
+		if err != nil {
+			return nil, fmt.Errorf("messages[%d]: %w", i, err)
+		}
+		cached = cached || message.Content.cached()
+
+		if message.Role != "system" {
+			turns = append(turns, Message{Role: message.Role, Content: message.Content})
+			continue
+		}
+		if len(turns) > 0 {
+			return nil, fmt.Errorf("messages[%d]: system messages must come before the conversation", i)
+		}
+		system = append(system, text)
+	}
+	if len(turns) == 0 {
+		return nil, fmt.Errorf("messages must include a user message")
+	}
+	if turns[0].Role != "user" {
+		return nil, fmt.Errorf("the first message after the system messages must use the user role")
+	}
+
+	prompt, err := messagesPrompt(turns)
+	if err != nil {
+		return nil, err
+	}
+	req.Prompt = prompt
+
+	if len(system) > 0 {
+		if _, ok := req.Extra["system"]; ok {
+			return nil, fmt.Errorf("extra.system cannot be set with system messages")
+		}
+		req.Extra = maps.Clone(req.Extra)
+		if req.Extra == nil {
+			req.Extra = make(map[string]interface{})
+		}
+		req.Extra["system"] = strings.Join(system, "\n\n")
+	}
+	if cached && req.CacheControl == nil {
+		req.CacheControl = &CacheControl{Type: "ephemeral"}
+	}
+	return &req, nil
+}
+
+// bindGenerateRequest binds a generate request in the schema of the route's API version and
+// converts it to a service request, responding with 400 if it is invalid. v1 requests that send
+// the deprecated flat prompt are answered with deprecation headers.
+func (h *Handler) bindGenerateRequest(c *gin.Context) (*services.GenerationRequest, bool) {
+	var req *GenerateRequest
+	if h.getAPIVersion(c) == APIVersionV2 {
+		var v2Req V2GenerateRequest
+		if err := c.ShouldBindJSON(&v2Req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid request format: " + err.Error(),
+			})
+			return nil, false
+		}
+
+		converted, err := v2Req.toV1()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return nil, false
+		}
+		req = converted
+	} else {
+		var v1Req GenerateRequest
+		if err := c.ShouldBindJSON(&v1Req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid request format: " + err.Error(),
+			})
+			return nil, false
+		}
+		if v1Req.Prompt != "" {
+			h.deprecateFlatPrompt(c)
+		}
+		req = &v1Req
+	}
+
+	serviceReq, err := h.newGenerationRequest(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return nil, false
+	}
+	return serviceReq, true
+}
+
+// deprecateFlatPrompt sets the Deprecation header (RFC 9745) on a response to a v1 request that
+// sent the flat prompt, with a link to the v2 endpoint and, once a date is configured, the Sunset
+// header (RFC 8594)
+func (h *Handler) deprecateFlatPrompt(c *gin.Context) {
+	c.Header("Deprecation", "@"+strconv.FormatInt(flatPromptDeprecatedAt.Unix(), 10))
+	if path := c.FullPath(); strings.HasPrefix(path, "/"+APIVersionV1+"/") {
+		c.Header("Link", fmt.Sprintf(`</%s%s>; rel="successor-version"`, APIVersionV2, strings.TrimPrefix(path, "/"+APIVersionV1)))
+	}
+	if sunset, err := h.config.PromptSunsetDate(); err == nil && !sunset.IsZero() {
+		c.Header("Sunset", sunset.Format(http.TimeFormat))
+	}
+}
+
+// APIVersionInfo describes a supported API version
+type APIVersionInfo struct {
+	Version string `json:"version"`
+	// Status is "current" for the latest version and "supported" for older ones
+	Status       string             `json:"status"`
+	Deprecations []FieldDeprecation `json:"deprecations,omitempty"`
+}
+
+// FieldDeprecation describes a deprecated request field and what replaces it
+type FieldDeprecation struct {
+	Field        string   `json:"field"`
+	Endpoints    []string `json:"endpoints"`
+	DeprecatedAt string   `json:"deprecated_at"`
+	// Sunset is the date after which the field may stop working, once one is set
+	Sunset    string `json:"sunset,omitempty"`
+	Successor string `json:"successor"`
+}
+
+// ListAPIVersions handles listing the supported API versions and their deprecated fields
+func (h *Handler) ListAPIVersions(c *gin.Context) {
+	promptDeprecation := FieldDeprecation{
+		Field:        "prompt",
+		Endpoints:    []string{"/v1/generate", "/v1/generate/stream"},
+		DeprecatedAt: flatPromptDeprecatedAt.Format(time.DateOnly),
+		Successor:    "messages on /v2/generate and /v2/generate/stream",
+	}
+	if sunset, err := h.config.PromptSunsetDate(); err == nil && !sunset.IsZero() {
+		promptDeprecation.Sunset = sunset.Format(time.DateOnly)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"versions": []APIVersionInfo{
+			{Version: APIVersionV1, Status: "supported", Deprecations: []FieldDeprecation{promptDeprecation}},
+			{Version: APIVersionV2, Status: "current"},
+		},
+	})
+}
@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/apt-router/api/internal/services"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket frame types. Clients send a generate request as the first frame and may send
+// a cancel frame at any time after it; the server answers with delta frames and ends the
+// generation with exactly one done, cancelled or error frame before closing the connection.
+const (
+	wsFrameDelta     = "delta"
+	wsFrameDone      = "done"
+	wsFrameCancel    = "cancel"
+	wsFrameCancelled = "cancelled"
+	wsFrameError     = "error"
+)
+
+// wsWriteTimeout bounds each frame written to the client
+const wsWriteTimeout = 10 * time.Second
+
+// wsUpgrader upgrades generate requests to WebSockets. Requests are authenticated by API key rather
+// than cookies, so connections from any origin are accepted.
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// WebSocketFrame is a frame sent to a WebSocket client
+type WebSocketFrame struct {
+	Type      string                 `json:"type"`
+	RequestID string                 `json:"request_id,omitempty"`
+	Text      string                 `json:"text,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+	Status    int                    `json:"status,omitempty"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	// Timing is sent on done frames, with FinishReason when it is known
+	Timing       *TimingInfo `json:"timing,omitempty"`
+	FinishReason string      `json:"finish_reason,omitempty"`
+}
+
+// WebSocketClientFrame is a control frame sent by a WebSocket client after its generate request
+type WebSocketClientFrame struct {
+	Type string `json:"type"`
+}
+
+// GenerateWebSocket handles streaming generation over a WebSocket. The first frame is a generate
+// request, the same payload as /v1/generate/stream; deltas are sent as JSON frames until the stream
+// ends or the client sends a cancel frame, which aborts the provider stream.
+func (h *Handler) GenerateWebSocket(c *gin.Context) {
+	startTime := time.Now()
+
+	requestCtx, exists := h.getRequestContext(c)
+	if !exists {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Request context not found",
+		})
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, http.Header{"X-Request-ID": []string{requestCtx.RequestID}})
+	if err != nil {
+		// The upgrader has already written an error response
+		requestCtx.Logger.Warn("WebSocket upgrade failed", "error", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(h.config.Server.MaxRequestBodyBytes)
+
+	writeFrame := func(frame *WebSocketFrame) error {
+		frame.RequestID = requestCtx.RequestID
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		return conn.WriteJSON(frame)
+	}
+	finish := func(frame *WebSocketFrame) {
+		if err := writeFrame(frame); err != nil {
+			requestCtx.Logger.Warn("Failed to write WebSocket frame", "type", frame.Type, "error", err)
+			return
+		}
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	}
+
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		requestCtx.Logger.Warn("Failed to read WebSocket generate request", "error", err)
+		return
+	}
+
+	var req GenerateRequest
+	if err := binding.JSON.BindBody(msg, &req); err != nil {
+		finish(&WebSocketFrame{Type: wsFrameError, Status: http.StatusBadRequest, Error: "Invalid request format: " + err.Error()})
+		return
+	}
+	serviceReq, err := h.newGenerationRequest(&req)
+	if err != nil {
+		finish(&WebSocketFrame{Type: wsFrameError, Status: http.StatusBadRequest, Error: err.Error()})
+		return
+	}
+	serviceReq.Stream = true
+
+	// Cancelling ctx aborts the provider stream, on a cancel frame or when the client goes away
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	cancelled := make(chan struct{})
+	go func() {
+		for {
+			var frame WebSocketClientFrame
+			if err := conn.ReadJSON(&frame); err != nil {
+				cancel()
+				return
+			}
+			if frame.Type == wsFrameCancel {
+				close(cancelled)
+				cancel()
+				return
+			}
+		}
+	}()
+
+	streamResp, err := h.generationService.GenerateStream(ctx, serviceReq, requestCtx.serviceContext())
+	if err != nil {
+		h.logGenerationFailure(c.Request.Context(), requestCtx, serviceReq, err, startTime)
+		requestCtx.Logger.Warn("WebSocket generation failed", "error", err, "model", serviceReq.Model)
+		finish(wsErrorFrame(err))
+		return
+	}
+	// Closing the stream releases its timeout and records usage and billing, including for cancelled streams
+	defer streamResp.Stream.Close()
+
+	var pending []byte
+	buf := services.GetStreamBuffer()
+	defer services.PutStreamBuffer(buf)
+	for {
+		n, readErr := streamResp.Stream.Read(*buf)
+		if n > 0 {
+			pending = append(pending, (*buf)[:n]...)
+			// Hold back a rune split across reads so every frame is valid UTF-8
+			complete := completeUTF8Prefix(pending)
+			if complete > 0 {
+				if err := writeFrame(&WebSocketFrame{Type: wsFrameDelta, Text: string(pending[:complete])}); err != nil {
+					requestCtx.Logger.Warn("Failed to write WebSocket delta", "error", err)
+					return
+				}
+				pending = append(pending[:0], pending[complete:]...)
+			}
+		}
+
+		if readErr == nil {
+			continue
+		}
+
+		select {
+		case <-cancelled:
+			requestCtx.Logger.Info("WebSocket stream cancelled by client", "duration_ms", time.Since(startTime).Milliseconds())
+			finish(&WebSocketFrame{Type: wsFrameCancelled})
+			return
+		default:
+		}
+
+		if readErr != io.EOF {
+			requestCtx.Logger.Warn("WebSocket stream read failed", "error", readErr)
+			finish(wsErrorFrame(readErr))
+			return
+		}
+
+		if len(pending) > 0 {
+			if err := writeFrame(&WebSocketFrame{Type: wsFrameDelta, Text: string(pending)}); err != nil {
+				requestCtx.Logger.Warn("Failed to write WebSocket delta", "error", err)
+				return
+			}
+		}
+		metadata := make(map[string]interface{}, len(streamResp.Metadata))
+		for k, v := range streamResp.Metadata {
+			metadata[k] = v
+		}
+		done := &WebSocketFrame{Type: wsFrameDone, Metadata: metadata, FinishReason: streamFinishReason(streamResp.Stream)}
+		if timer, ok := streamResp.Stream.(streamTimer); ok {
+			done.Timing = newTimingInfo(timer.Timing())
+		}
+		finish(done)
+		requestCtx.Logger.Info("WebSocket stream completed", "duration_ms", time.Since(startTime).Milliseconds())
+		return
+	}
+}
+
+// wsErrorFrame converts a generation error to an error frame carrying the status the HTTP endpoints would use
+func wsErrorFrame(err error) *WebSocketFrame {
+	genErr := streamStartError(err)
+	frame := &WebSocketFrame{Type: wsFrameError, Status: genErr.Status, Error: err.Error()}
+	if genErr.Body["code"] != nil {
+		// Content blocked by moderation carries its stage and categories
+		frame.Error, _ = genErr.Body["error"].(string)
+		frame.Metadata = genErr.Body
+	}
+	return frame
+}
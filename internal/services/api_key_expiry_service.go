@@ -0,0 +1,121 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/utils"
+)
+
+// apiKeyExpiringEvent is the webhook event type of API key expiry warnings
+const apiKeyExpiringEvent = "api_key.expiring"
+
+// APIKeyExpiryService deactivates API keys once they expire and warns their owners beforehand, by
+// email and on their spend alert webhook. Authentication rejects expired keys on its own, so the
+// sweep only has to keep key statuses accurate.
+type APIKeyExpiryService struct {
+	config          utils.SecurityConfig
+	firebaseService *data.Service
+	notifications   *NotificationService
+	audit           *AuditService
+}
+
+// NewAPIKeyExpiryService creates a new API key expiry service
+func NewAPIKeyExpiryService(cfg *utils.Config, firebaseService *data.Service, notifications *NotificationService, audit *AuditService) *APIKeyExpiryService {
+	return &APIKeyExpiryService{
+		config:          cfg.Security,
+		firebaseService: firebaseService,
+		notifications:   notifications,
+		audit:           audit,
+	}
+}
+
+// Sweep sets active keys past their expiry to expired and warns the owners of keys expiring within
+// the warning period. Each owner is warned once per key. It runs as a scheduled job.
+func (s *APIKeyExpiryService) Sweep(ctx context.Context) error {
+	now := time.Now()
+	apiKeys, err := s.firebaseService.ListExpiringAPIKeys(ctx, now.Add(s.config.APIKeyExpiryWarning))
+	if err != nil {
+		return err
+	}
+
+	for _, apiKey := range apiKeys {
+		if apiKey.Expired(now) {
+			s.expire(ctx, apiKey, now)
+			continue
+		}
+		if apiKey.ExpiryWarnedAt.IsZero() {
+			s.warn(ctx, apiKey)
+		}
+	}
+	return nil
+}
+
+// expire deactivates an expired key
+func (s *APIKeyExpiryService) expire(ctx context.Context, apiKey *data.APIKey, now time.Time) {
+	expired, err := s.firebaseService.ExpireAPIKey(ctx, apiKey.ID, now)
+	if err != nil {
+		slog.Warn("Failed to expire API key", "api_key_id", apiKey.ID, "error", err)
+		return
+	}
+	if !expired {
+		return
+	}
+
+	s.audit.Record(ctx, &data.AuditEvent{
+		Type:      data.AuditAPIKeyExpired,
+		ActorType: data.AuditActorSystem,
+		ActorID:   "api_key_expiry",
+		OrgID:     apiKey.OrgID,
+		TargetID:  apiKey.ID,
+		Details:   map[string]interface{}{"user_id": apiKey.UserID, "expires_at": apiKey.ExpiresAt},
+	})
+	slog.Info("API key expired", "api_key_id", apiKey.ID, "user_id", apiKey.UserID, "expires_at", apiKey.ExpiresAt)
+}
+
+// warn notifies a key's owner that it is about to expire
+func (s *APIKeyExpiryService) warn(ctx context.Context, apiKey *data.APIKey) {
+	claimed, err := s.firebaseService.ClaimAPIKeyExpiryWarning(ctx, apiKey.ID)
+	if err != nil {
+		slog.Warn("Failed to claim API key expiry warning", "api_key_id", apiKey.ID, "error", err)
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	user, err := s.firebaseService.GetUserByID(ctx, apiKey.UserID)
+	if err != nil {
+		slog.Warn("Failed to get API key owner for expiry warning", "api_key_id", apiKey.ID, "user_id", apiKey.UserID, "error", err)
+		return
+	}
+
+	payload := map[string]interface{}{
+		"type":       apiKeyExpiringEvent,
+		"user_id":    apiKey.UserID,
+		"api_key_id": apiKey.ID,
+		"name":       apiKey.Name,
+		"expires_at": apiKey.ExpiresAt,
+	}
+	if apiKey.OrgID != "" {
+		payload["org_id"] = apiKey.OrgID
+	}
+
+	if user.Email != "" && s.notifications.EmailEnabled() {
+		subject := fmt.Sprintf("AptRouter API key %q expires on %s", apiKey.Name, apiKey.ExpiresAt.UTC().Format(time.DateOnly))
+		body := fmt.Sprintf("Your AptRouter API key %q expires at %s. Requests made with it will be rejected after that; rotate or replace it before then.\n",
+			apiKey.Name, apiKey.ExpiresAt.UTC().Format(time.RFC1123))
+		if err := s.notifications.SendEmail(user.Email, subject, body); err != nil {
+			slog.Warn("Failed to send API key expiry email", "api_key_id", apiKey.ID, "user_id", apiKey.UserID, "error", err)
+		}
+	}
+	if user.SpendAlerts.WebhookURL != "" {
+		if err := s.notifications.SendWebhook(ctx, user.SpendAlerts.WebhookURL, user.SpendAlerts.WebhookSecret, apiKeyExpiringEvent, payload); err != nil {
+			slog.Warn("Failed to deliver API key expiry webhook", "api_key_id", apiKey.ID, "user_id", apiKey.UserID, "error", err)
+		}
+	}
+	slog.Info("API key expiry warning sent", "api_key_id", apiKey.ID, "user_id", apiKey.UserID, "expires_at", apiKey.ExpiresAt)
+}
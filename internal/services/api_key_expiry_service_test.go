@@ -0,0 +1,83 @@
+package services_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apt-router/api/internal/services"
+	apttesting "github.com/apt-router/api/internal/testing"
+	"github.com/apt-router/api/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIKeyExpirySweep(t *testing.T) {
+	var mu sync.Mutex
+	var warnings []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "api_key.expiring", r.Header.Get("X-AptRouter-Event"))
+		assert.NotEmpty(t, r.Header.Get("X-AptRouter-Signature"))
+		var payload map[string]interface{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		mu.Lock()
+		warnings = append(warnings, payload)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	cfg := &utils.Config{
+		Security:      utils.SecurityConfig{APIKeyExpiryWarning: 7 * 24 * time.Hour},
+		Notifications: utils.NotificationsConfig{WebhookTimeout: 5 * time.Second, AllowPrivateWebhooks: true},
+	}
+
+	now := time.Now()
+	store := apttesting.NewDatastore(t)
+	apttesting.ApplySeed(t, store, "", services.Seed{
+		"users": {
+			"user-1": {"email": "user@example.com", "is_active": true, "spend_alerts": map[string]interface{}{"webhook_url": server.URL, "webhook_secret": "whsec_test"}},
+		},
+		"api_keys": {
+			"key-expired":  {"user_id": "user-1", "key_hash": "hash-expired", "name": "Expired", "status": "active", "expires_at": now.Add(-time.Minute)},
+			"key-expiring": {"user_id": "user-1", "key_hash": "hash-expiring", "name": "Expiring", "status": "active", "expires_at": now.Add(24 * time.Hour)},
+			"key-later":    {"user_id": "user-1", "key_hash": "hash-later", "name": "Later", "status": "active", "expires_at": now.Add(30 * 24 * time.Hour)},
+			"key-forever":  {"user_id": "user-1", "key_hash": "hash-forever", "name": "Forever", "status": "active"},
+		},
+	})
+
+	sweeper := services.NewAPIKeyExpiryService(cfg, store, services.NewNotificationService(cfg), services.NewAuditService(store))
+
+	ctx := context.Background()
+	sweeper.Sweep(ctx)
+
+	status := func(keyID string) string {
+		doc, err := store.DB().Collection("api_keys").Doc(keyID).Get(ctx)
+		require.NoError(t, err)
+		value, _ := doc.Data()["status"].(string)
+		return value
+	}
+	assert.Equal(t, "expired", status("key-expired"))
+	assert.Equal(t, "active", status("key-expiring"))
+	assert.Equal(t, "active", status("key-later"))
+	assert.Equal(t, "active", status("key-forever"))
+
+	_, err := store.GetAPIKeyByHash(ctx, "hash-expired")
+	assert.Error(t, err, "expired keys no longer authenticate")
+
+	mu.Lock()
+	require.Len(t, warnings, 1)
+	assert.Equal(t, "key-expiring", warnings[0]["api_key_id"])
+	assert.Equal(t, "Expiring", warnings[0]["name"])
+	mu.Unlock()
+
+	// Owners are warned once per key
+	sweeper.Sweep(ctx)
+	mu.Lock()
+	assert.Len(t, warnings, 1)
+	mu.Unlock()
+}
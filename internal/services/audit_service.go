@@ -0,0 +1,61 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+)
+
+// auditWriteTimeout bounds a background audit event write
+const auditWriteTimeout = 10 * time.Second
+
+// AuditService records administrative and security events
+type AuditService struct {
+	firebaseService *data.Service
+}
+
+// NewAuditService creates a new audit service
+func NewAuditService(firebaseService *data.Service) *AuditService {
+	return &AuditService{
+		firebaseService: firebaseService,
+	}
+}
+
+// Record stores an audit event in the background so auditing never delays or fails the audited action
+func (s *AuditService) Record(ctx context.Context, event *data.AuditEvent) {
+	if s == nil || s.firebaseService == nil || s.firebaseService.DB() == nil {
+		return
+	}
+
+	slog.Info("Audit event",
+		"type", event.Type,
+		"actor_type", event.ActorType,
+		"actor_id", event.ActorID,
+		"org_id", event.OrgID,
+		"target_id", event.TargetID,
+		"ip_address", event.IPAddress,
+	)
+
+	// The write outlives the request that triggered it
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), auditWriteTimeout)
+	go func() {
+		defer cancel()
+		if err := s.firebaseService.RecordAuditEvent(ctx, event); err != nil {
+			slog.Error("Failed to record audit event", "type", event.Type, "error", err)
+		}
+	}()
+}
+
+// List lists audit events matching filter, newest first
+func (s *AuditService) List(ctx context.Context, filter data.AuditEventFilter) ([]*data.AuditEvent, error) {
+	events, err := s.firebaseService.ListAuditEvents(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	if events == nil {
+		events = []*data.AuditEvent{}
+	}
+	return events, nil
+}
@@ -0,0 +1,154 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+)
+
+var (
+	// ErrInsufficientBalance is returned when a request's estimated cost exceeds what its account
+	// has left once its in-flight requests are paid for
+	ErrInsufficientBalance = errors.New("insufficient balance")
+	// ErrAccountInactive is returned for requests billed to an inactive user account
+	ErrAccountInactive = errors.New("user account is inactive")
+)
+
+// balanceHolds tracks the estimated cost of each account's in-flight requests, so concurrent
+// requests, and streams that are only charged when they finish, cannot all spend the same balance.
+// Holds are kept per replica.
+type balanceHolds struct {
+	mu   sync.Mutex
+	held map[string]data.MicroUSD
+}
+
+// BalanceHold is a request's estimated cost held against its account until the request is charged
+type BalanceHold struct {
+	holds   *balanceHolds
+	account string
+	amount  data.MicroUSD
+	once    sync.Once
+}
+
+// reserve holds amount against an account if its available balance, less what is already held,
+// covers it. It returns what the account had left before the hold.
+func (h *balanceHolds) reserve(account string, amount, available data.MicroUSD) (*BalanceHold, data.MicroUSD, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.held == nil {
+		h.held = make(map[string]data.MicroUSD)
+	}
+	remaining := available - h.held[account]
+	if remaining < amount {
+		return nil, remaining, false
+	}
+	h.held[account] += amount
+	return &BalanceHold{holds: h, account: account, amount: amount}, remaining, true
+}
+
+// Release releases the hold once the request has been charged or has failed. It is safe to call
+// on a nil hold and more than once.
+func (h *BalanceHold) Release() {
+	if h == nil {
+		return
+	}
+	h.once.Do(func() {
+		h.holds.mu.Lock()
+		defer h.holds.mu.Unlock()
+
+		h.holds.held[h.account] -= h.amount
+		if h.holds.held[h.account] <= 0 {
+			delete(h.holds.held, h.account)
+		}
+	})
+}
+
+// reserveBalance is the pre-flight balance check for streaming and non-streaming generation. It
+// rejects requests from inactive accounts and requests whose estimated cost, at max_tokens of
+// output, exceeds the billed account's balance less its in-flight requests, then holds the
+// estimated cost until the request is charged. It runs once the provider key is resolved, so BYOK
+// requests are only held for the platform's share. Test mode and shadow requests are never
+// charged and are not held.
+func (s *GenerationService) reserveBalance(ctx context.Context, req *GenerationRequest, modelConfig ModelConfig, requestCtx *RequestContext) (*BalanceHold, error) {
+	if requestCtx.TestMode || req.Shadow {
+		return nil, nil
+	}
+
+	account, available, err := s.accountBalance(ctx, requestCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	estimatedInputTokens := s.tokenizers.Estimate(modelConfig, req.System+req.Prompt)
+	estimatedOutputTokens := req.MaxTokens + req.ThinkingBudget
+	estimatedCost := s.calculateEstimatedCost(estimatedInputTokens, estimatedOutputTokens, modelConfig, req.BYOK, requestCtx)
+
+	hold, remaining, ok := s.holds.reserve(account, estimatedCost, available)
+	if !ok {
+		requestCtx.Logger.Info("Pre-flight balance check failed",
+			"account", account,
+			"available", remaining.String(),
+			"estimated_cost", estimatedCost.String(),
+		)
+		return nil, fmt.Errorf("%w: %s required, %s available", ErrInsufficientBalance, estimatedCost, remaining)
+	}
+
+	requestCtx.Logger.Info("Pre-flight balance check passed",
+		"account", account,
+		"available", remaining.String(),
+		"estimated_cost", estimatedCost.String(),
+		"estimated_input_tokens", estimatedInputTokens,
+		"estimated_output_tokens", estimatedOutputTokens,
+	)
+	return hold, nil
+}
+
+// accountBalance returns the account a request is billed to and its available balance: the
+// organization's shared balance for organization keys, otherwise the user's balance and
+// unexpired promotional credit
+func (s *GenerationService) accountBalance(ctx context.Context, requestCtx *RequestContext) (string, data.MicroUSD, error) {
+	if requestCtx.OrgID != "" {
+		org, err := s.getOrganization(ctx, requestCtx.OrgID)
+		if err != nil {
+			return "", 0, fmt.Errorf("balance check failed: %w", err)
+		}
+		return OrgCacheKey(requestCtx.OrgID), org.Balance, nil
+	}
+
+	user, err := s.getCachedUser(ctx, requestCtx.UserID)
+	if err != nil {
+		return "", 0, fmt.Errorf("balance check failed: %w", err)
+	}
+	if !user.IsActive {
+		return "", 0, ErrAccountInactive
+	}
+	return UserCacheKey(requestCtx.UserID), user.Balance + user.Credits, nil
+}
+
+// getOrganization gets an organization from cache or the store
+func (s *GenerationService) getOrganization(ctx context.Context, orgID string) (*data.Organization, error) {
+	cacheKey := OrgCacheKey(orgID)
+
+	var org data.Organization
+	if found, err := s.cache.Get(ctx, cacheKey, &org); err != nil {
+		slog.Warn("Failed to read organization from cache", "org_id", orgID, "error", err)
+	} else if found {
+		return &org, nil
+	}
+
+	loaded, err := s.usageStore.GetOrganization(ctx, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get organization from Firebase: %w", err)
+	}
+
+	if err := s.cache.Set(ctx, cacheKey, loaded, 5*time.Minute); err != nil {
+		slog.Warn("Failed to store organization in cache", "org_id", orgID, "error", err)
+	}
+	return loaded, nil
+}
@@ -0,0 +1,524 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/utils"
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/webhook"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// ErrBillingDisabled is returned when Stripe billing is not configured
+	ErrBillingDisabled = errors.New("billing is not configured")
+	// ErrInvalidSpendAlerts is returned when spend alert settings fail validation
+	ErrInvalidSpendAlerts = errors.New("invalid spend alerts")
+)
+
+// Payment sources recorded on credited payments and Stripe metadata
+const (
+	paymentSourceCheckout  = "checkout"
+	paymentSourceAutoTopUp = "auto_top_up"
+)
+
+// microsPerCent is the number of micro-USD in one US cent, Stripe's smallest USD unit
+const microsPerCent = 10_000
+
+// BillingService handles Stripe payments, balance top-ups and charging requests to accounts
+type BillingService struct {
+	config          utils.BillingConfig
+	firebaseService *data.Service
+	cache           Cache
+	audit           *AuditService
+	notifications   *NotificationService
+	stripe          *stripe.Client
+}
+
+// NewBillingService creates a new billing service. The cache is used to evict an account's
+// cached balance when it is charged. Billing is disabled when no Stripe secret key is configured.
+func NewBillingService(cfg *utils.Config, firebaseService *data.Service, cache Cache, audit *AuditService, notifications *NotificationService) *BillingService {
+	s := &BillingService{
+		config:          cfg.Billing,
+		firebaseService: firebaseService,
+		cache:           cache,
+		audit:           audit,
+		notifications:   notifications,
+	}
+
+	if cfg.Billing.StripeSecretKey != "" {
+		s.stripe = stripe.NewClient(cfg.Billing.StripeSecretKey)
+	}
+
+	return s
+}
+
+// Enabled reports whether Stripe billing is configured
+func (s *BillingService) Enabled() bool {
+	return s != nil && s.stripe != nil
+}
+
+// ValidateTopUpAmount checks a top-up amount against the configured limits
+func (s *BillingService) ValidateTopUpAmount(amount data.MicroUSD) error {
+	min := data.USDToMicros(s.config.MinTopUpUSD)
+	max := data.USDToMicros(s.config.MaxTopUpUSD)
+	if amount < min || amount > max {
+		return fmt.Errorf("top-up amount must be between %s and %s USD", min, max)
+	}
+	if amount%microsPerCent != 0 {
+		return fmt.Errorf("top-up amount must be a whole number of cents")
+	}
+	return nil
+}
+
+// CreateCheckoutSession creates a Stripe Checkout session for a one-off balance top-up and returns its URL
+func (s *BillingService) CreateCheckoutSession(ctx context.Context, userID string, amount data.MicroUSD) (_ string, err error) {
+	ctx, span := tracer.Start(ctx, "billing.checkout", trace.WithAttributes(
+		attribute.String("user.id", userID),
+		attribute.Int64("billing.amount_micros", int64(amount)),
+	))
+	defer func() {
+		if err != nil {
+			recordSpanError(span, err)
+		}
+		span.End()
+	}()
+
+	if !s.Enabled() {
+		return "", ErrBillingDisabled
+	}
+	if err := s.ValidateTopUpAmount(amount); err != nil {
+		return "", err
+	}
+
+	customerID, err := s.ensureCustomer(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+
+	metadata := map[string]string{
+		"user_id":       userID,
+		"amount_micros": strconv.FormatInt(int64(amount), 10),
+		"source":        paymentSourceCheckout,
+	}
+
+	params := &stripe.CheckoutSessionCreateParams{
+		Mode:              stripe.String(string(stripe.CheckoutSessionModePayment)),
+		Customer:          stripe.String(customerID),
+		ClientReferenceID: stripe.String(userID),
+		SuccessURL:        stripe.String(s.config.CheckoutSuccessURL),
+		CancelURL:         stripe.String(s.config.CheckoutCancelURL),
+		Metadata:          metadata,
+		LineItems: []*stripe.CheckoutSessionCreateLineItemParams{
+			{
+				Quantity: stripe.Int64(1),
+				PriceData: &stripe.CheckoutSessionCreateLineItemPriceDataParams{
+					Currency:   stripe.String(string(stripe.CurrencyUSD)),
+					UnitAmount: stripe.Int64(int64(amount) / microsPerCent),
+					ProductData: &stripe.CheckoutSessionCreateLineItemPriceDataProductDataParams{
+						Name: stripe.String("AptRouter balance top-up"),
+					},
+				},
+			},
+		},
+		// Save the card so it can be used for automatic top-ups
+		PaymentIntentData: &stripe.CheckoutSessionCreatePaymentIntentDataParams{
+			SetupFutureUsage: stripe.String("off_session"),
+		},
+	}
+
+	session, err := s.stripe.V1CheckoutSessions.Create(ctx, params)
+	if err != nil {
+		return "", fmt.Errorf("failed to create checkout session: %w", err)
+	}
+
+	return session.URL, nil
+}
+
+// ensureCustomer returns the user's Stripe customer ID, creating the customer if needed
+func (s *BillingService) ensureCustomer(ctx context.Context, userID string) (string, error) {
+	user, err := s.firebaseService.GetUserByID(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get user: %w", err)
+	}
+	if user.StripeCustomerID != "" {
+		return user.StripeCustomerID, nil
+	}
+
+	params := &stripe.CustomerCreateParams{
+		Email:    stripe.String(user.Email),
+		Metadata: map[string]string{"user_id": userID},
+	}
+	params.SetIdempotencyKey("customer-" + userID)
+
+	customer, err := s.stripe.V1Customers.Create(ctx, params)
+	if err != nil {
+		return "", fmt.Errorf("failed to create stripe customer: %w", err)
+	}
+
+	if err := s.firebaseService.SetStripeCustomerID(ctx, userID, customer.ID); err != nil {
+		return "", err
+	}
+
+	return customer.ID, nil
+}
+
+// HandleWebhook verifies and processes a Stripe webhook event
+func (s *BillingService) HandleWebhook(ctx context.Context, payload []byte, signature string) (err error) {
+	ctx, span := tracer.Start(ctx, "billing.webhook")
+	defer func() {
+		if err != nil {
+			recordSpanError(span, err)
+		}
+		span.End()
+	}()
+
+	if !s.Enabled() {
+		return ErrBillingDisabled
+	}
+
+	event, err := webhook.ConstructEvent(payload, signature, s.config.StripeWebhookSecret)
+	if err != nil {
+		return fmt.Errorf("invalid webhook signature: %w", err)
+	}
+	span.SetAttributes(
+		attribute.String("stripe.event.type", string(event.Type)),
+		attribute.String("stripe.event.id", event.ID),
+	)
+
+	switch event.Type {
+	case stripe.EventTypeCheckoutSessionCompleted, stripe.EventTypeCheckoutSessionAsyncPaymentSucceeded:
+		var session stripe.CheckoutSession
+		if err := json.Unmarshal(event.Data.Raw, &session); err != nil {
+			return fmt.Errorf("failed to parse checkout session: %w", err)
+		}
+		return s.handleCheckoutCompleted(ctx, &session)
+
+	case stripe.EventTypePaymentIntentSucceeded:
+		var intent stripe.PaymentIntent
+		if err := json.Unmarshal(event.Data.Raw, &intent); err != nil {
+			return fmt.Errorf("failed to parse payment intent: %w", err)
+		}
+		// Checkout payments are credited from the session event; only auto top-ups are handled here
+		if intent.Metadata["source"] != paymentSourceAutoTopUp {
+			return nil
+		}
+		return s.creditPayment(ctx, intent.ID, intent.Metadata, paymentSourceAutoTopUp)
+
+	default:
+		slog.Debug("Ignoring Stripe event", "type", event.Type, "event_id", event.ID)
+		return nil
+	}
+}
+
+// handleCheckoutCompleted credits a paid checkout session and remembers its payment method
+func (s *BillingService) handleCheckoutCompleted(ctx context.Context, session *stripe.CheckoutSession) error {
+	if session.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid {
+		slog.Info("Checkout session not yet paid", "session_id", session.ID, "payment_status", session.PaymentStatus)
+		return nil
+	}
+
+	if err := s.creditPayment(ctx, session.ID, session.Metadata, paymentSourceCheckout); err != nil {
+		return err
+	}
+
+	// Store the saved card for automatic top-ups; failure here must not fail the credit
+	if session.PaymentIntent != nil {
+		intent, err := s.stripe.V1PaymentIntents.Retrieve(ctx, session.PaymentIntent.ID, nil)
+		if err != nil {
+			slog.Warn("Failed to retrieve checkout payment intent", "session_id", session.ID, "error", err)
+		} else if intent.PaymentMethod != nil {
+			if err := s.firebaseService.SetAutoTopUpPaymentMethod(ctx, session.Metadata["user_id"], intent.PaymentMethod.ID); err != nil {
+				slog.Warn("Failed to store auto top-up payment method", "session_id", session.ID, "error", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// creditPayment credits a Stripe payment to the user named in its metadata, exactly once
+func (s *BillingService) creditPayment(ctx context.Context, paymentID string, metadata map[string]string, source string) error {
+	userID := metadata["user_id"]
+	if userID == "" {
+		return fmt.Errorf("payment %s has no user_id metadata", paymentID)
+	}
+
+	micros, err := strconv.ParseInt(metadata["amount_micros"], 10, 64)
+	if err != nil || micros <= 0 {
+		return fmt.Errorf("payment %s has invalid amount metadata", paymentID)
+	}
+
+	err = s.firebaseService.CreditPayment(ctx, &data.Payment{
+		ID:        paymentID,
+		UserID:    userID,
+		Amount:    data.MicroUSD(micros),
+		Source:    source,
+		CreatedAt: time.Now(),
+	})
+	if errors.Is(err, data.ErrPaymentAlreadyProcessed) {
+		// Stripe retries webhooks; a duplicate delivery is not an error
+		slog.Info("Ignoring duplicate payment", "payment_id", paymentID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s.audit.Record(ctx, &data.AuditEvent{
+		Type:      data.AuditBalanceCredited,
+		ActorType: data.AuditActorSystem,
+		ActorID:   "stripe",
+		TargetID:  userID,
+		Details: map[string]interface{}{
+			"payment_id":    paymentID,
+			"source":        source,
+			"amount_micros": micros,
+		},
+	})
+	return nil
+}
+
+// Charge charges a request's billable cost to the user, or to their organization's shared balance
+// when orgID is set. Every generation path charges through it, and each request ID is charged
+// at most once: charging a request again changes nothing and returns the original charge's
+// credit use. Charges are for usage already delivered, so one the balance can't cover still
+// settles, leaving the account in debt that its pre-flight holds refuse further requests on until
+// it is repaid. It returns the user's promotional credit the charge consumed; organization
+// charges never use credits. Requests that cost nothing are not charged.
+func (s *BillingService) Charge(ctx context.Context, requestID, userID, orgID string, amount data.MicroUSD) (data.MicroUSD, error) {
+	if amount <= 0 {
+		return 0, nil
+	}
+	if requestID == "" {
+		return 0, errors.New("charging a request requires its request ID")
+	}
+
+	ctx, span := tracer.Start(ctx, "billing.charge", trace.WithAttributes(
+		attribute.String("user.id", userID),
+		attribute.String("org.id", orgID),
+		attribute.Int64("billing.amount_micros", int64(amount)),
+	))
+	defer span.End()
+
+	charge := &data.Charge{
+		RequestID: requestID,
+		UserID:    userID,
+		OrgID:     orgID,
+		Amount:    amount,
+	}
+	err := s.firebaseService.ChargeRequest(ctx, charge)
+	if errors.Is(err, data.ErrRequestAlreadyCharged) {
+		slog.Warn("Ignoring duplicate charge", "request_id", requestID, "amount", amount.String(), "charged", charge.Amount.String())
+		return charge.CreditsUsed, nil
+	}
+	if err != nil {
+		recordSpanError(span, err)
+		return 0, err
+	}
+	if charge.Debt > 0 {
+		slog.Warn("Charge left account in debt", "request_id", requestID, "user_id", userID, "org_id", orgID, "debt", charge.Debt.String())
+	}
+
+	// Invalidate the cached balance on every replica
+	cacheKey := UserCacheKey(userID)
+	if orgID != "" {
+		cacheKey = OrgCacheKey(orgID)
+	}
+	if err := s.cache.Invalidate(ctx, cacheKey); err != nil {
+		slog.Warn("Failed to invalidate cached balance", "request_id", requestID, "error", err)
+	}
+
+	background := context.WithoutCancel(ctx)
+	if orgID == "" {
+		// Top up the balance in the background if the charge left it below the user's threshold
+		go s.MaybeAutoTopUp(background, userID)
+	}
+
+	// Spend alerts count everything the user spends, whichever balance pays for it
+	go s.CheckSpendAlerts(background, userID, amount)
+	return charge.CreditsUsed, nil
+}
+
+// MaybeAutoTopUp charges the user's saved card when their balance has fallen below their auto top-up threshold.
+// The balance is credited when Stripe reports the payment as succeeded.
+func (s *BillingService) MaybeAutoTopUp(ctx context.Context, userID string) {
+	if !s.Enabled() {
+		return
+	}
+
+	ctx, span := tracer.Start(ctx, "billing.auto_top_up", trace.WithAttributes(attribute.String("user.id", userID)))
+	defer span.End()
+
+	user, due, err := s.firebaseService.ClaimAutoTopUp(ctx, userID, s.config.AutoTopUpCooldown)
+	if err != nil {
+		recordSpanError(span, err)
+		slog.Warn("Failed to check auto top-up", "user_id", userID, "error", err)
+		return
+	}
+	if !due {
+		return
+	}
+
+	amount := user.AutoTopUp.Amount
+	params := &stripe.PaymentIntentCreateParams{
+		Amount:        stripe.Int64(int64(amount) / microsPerCent),
+		Currency:      stripe.String(string(stripe.CurrencyUSD)),
+		Customer:      stripe.String(user.StripeCustomerID),
+		PaymentMethod: stripe.String(user.AutoTopUp.PaymentMethodID),
+		OffSession:    stripe.Bool(true),
+		Confirm:       stripe.Bool(true),
+		Metadata: map[string]string{
+			"user_id":       userID,
+			"amount_micros": strconv.FormatInt(int64(amount), 10),
+			"source":        paymentSourceAutoTopUp,
+		},
+	}
+	params.SetIdempotencyKey(fmt.Sprintf("auto-top-up-%s-%d", userID, user.AutoTopUp.LastTriggeredAt.Unix()))
+
+	intent, err := s.stripe.V1PaymentIntents.Create(ctx, params)
+	if err != nil {
+		recordSpanError(span, err)
+		slog.Error("Auto top-up payment failed", "user_id", userID, "amount", amount.String(), "error", err)
+		return
+	}
+
+	slog.Info("Auto top-up payment created",
+		"user_id", userID,
+		"amount", amount.String(),
+		"payment_intent_id", intent.ID,
+		"status", intent.Status,
+	)
+}
+
+// UpdateAutoTopUp updates a user's auto top-up settings
+func (s *BillingService) UpdateAutoTopUp(ctx context.Context, userID string, enabled bool, threshold, amount data.MicroUSD) error {
+	if enabled {
+		if err := s.ValidateTopUpAmount(amount); err != nil {
+			return err
+		}
+		if threshold < 0 {
+			return fmt.Errorf("threshold must not be negative")
+		}
+	}
+
+	return s.firebaseService.UpdateAutoTopUpSettings(ctx, userID, enabled, threshold, amount)
+}
+
+// maxSpendAlertThresholds bounds how many thresholds a user can configure
+const maxSpendAlertThresholds = 10
+
+// spendAlertEvent is the webhook event type of spend alerts
+const spendAlertEvent = "spend_alert.triggered"
+
+// UpdateSpendAlerts validates and stores a user's spend alert settings. The period's spend is
+// recomputed from the user's usage rollups, so alerts configured mid-month count earlier charges;
+// alerts already fired this period stay fired.
+func (s *BillingService) UpdateSpendAlerts(ctx context.Context, userID string, settings *data.SpendAlertSettings) error {
+	if len(settings.Thresholds) > maxSpendAlertThresholds {
+		return fmt.Errorf("%w: at most %d thresholds can be configured", ErrInvalidSpendAlerts, maxSpendAlertThresholds)
+	}
+	if settings.MonthlyBudget < 0 {
+		return fmt.Errorf("%w: monthly budget must not be negative", ErrInvalidSpendAlerts)
+	}
+	for _, threshold := range settings.Thresholds {
+		switch {
+		case threshold.Amount < 0 || threshold.Percent < 0:
+			return fmt.Errorf("%w: thresholds must not be negative", ErrInvalidSpendAlerts)
+		case (threshold.Amount > 0) == (threshold.Percent > 0):
+			return fmt.Errorf("%w: each threshold needs exactly one of amount or percent", ErrInvalidSpendAlerts)
+		case threshold.Percent > 1000:
+			return fmt.Errorf("%w: threshold percent must be at most 1000", ErrInvalidSpendAlerts)
+		case threshold.Percent > 0 && settings.MonthlyBudget == 0:
+			return fmt.Errorf("%w: percent thresholds need a monthly budget", ErrInvalidSpendAlerts)
+		}
+	}
+	if settings.WebhookURL != "" {
+		if err := s.notifications.ValidateWebhookURL(ctx, settings.WebhookURL); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidSpendAlerts, err)
+		}
+	}
+	if settings.Email && !s.notifications.EmailEnabled() {
+		return fmt.Errorf("%w: email notifications are not configured on this server", ErrInvalidSpendAlerts)
+	}
+	if settings.Enabled && !settings.Email && settings.WebhookURL == "" {
+		return fmt.Errorf("%w: enabled alerts need email or a webhook URL", ErrInvalidSpendAlerts)
+	}
+
+	now := time.Now()
+	rollups, err := s.firebaseService.ListUsageRollups(ctx, userID, data.RollupDaily, data.SpendAlertPeriodStart(now), now)
+	if err != nil {
+		return err
+	}
+	settings.PeriodSpend = 0
+	for _, rollup := range rollups {
+		settings.PeriodSpend += rollup.TotalCost
+	}
+	if settings.Period != data.SpendAlertPeriod(now) {
+		settings.Period = data.SpendAlertPeriod(now)
+		settings.Fired = nil
+	}
+
+	return s.firebaseService.UpdateSpendAlertSettings(ctx, userID, settings)
+}
+
+// CheckSpendAlerts adds a charge to the user's spend for the period and notifies them of every
+// threshold it crosses. Each threshold fires at most once per calendar month.
+func (s *BillingService) CheckSpendAlerts(ctx context.Context, userID string, amount data.MicroUSD) {
+	ctx, span := tracer.Start(ctx, "billing.spend_alerts", trace.WithAttributes(attribute.String("user.id", userID)))
+	defer span.End()
+
+	user, crossed, err := s.firebaseService.RecordSpend(ctx, userID, amount)
+	if err != nil {
+		recordSpanError(span, err)
+		slog.Warn("Failed to check spend alerts", "user_id", userID, "error", err)
+		return
+	}
+
+	alerts := user.SpendAlerts
+	for _, threshold := range crossed {
+		limit := threshold.Limit(alerts.MonthlyBudget)
+		payload := map[string]interface{}{
+			"type":         spendAlertEvent,
+			"user_id":      userID,
+			"period":       alerts.Period,
+			"period_spend": alerts.PeriodSpend,
+			"threshold":    threshold,
+			"limit":        limit,
+			"triggered_at": time.Now(),
+		}
+		if alerts.MonthlyBudget > 0 {
+			payload["monthly_budget"] = alerts.MonthlyBudget
+		}
+
+		if alerts.Email && user.Email != "" {
+			subject := fmt.Sprintf("AptRouter spend alert: $%.2f spent in %s", alerts.PeriodSpend.USD(), alerts.Period)
+			body := fmt.Sprintf("Your AptRouter spend for %s has reached $%.2f, crossing your alert threshold of $%.2f.\n", alerts.Period, alerts.PeriodSpend.USD(), limit.USD())
+			if err := s.notifications.SendEmail(user.Email, subject, body); err != nil {
+				slog.Warn("Failed to send spend alert email", "user_id", userID, "error", err)
+			}
+		}
+		if alerts.WebhookURL != "" {
+			if err := s.notifications.SendWebhook(ctx, alerts.WebhookURL, alerts.WebhookSecret, spendAlertEvent, payload); err != nil {
+				slog.Warn("Failed to deliver spend alert webhook", "user_id", userID, "error", err)
+			}
+		}
+
+		s.audit.Record(ctx, &data.AuditEvent{
+			Type:      data.AuditSpendAlertFired,
+			ActorType: data.AuditActorSystem,
+			ActorID:   "billing",
+			TargetID:  userID,
+			Details:   payload,
+		})
+		slog.Info("Spend alert triggered", "user_id", userID, "threshold", threshold.Key(), "period_spend", alerts.PeriodSpend.String())
+	}
+}
@@ -0,0 +1,299 @@
+package services_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	apttesting "github.com/apt-router/api/internal/testing"
+	"github.com/apt-router/api/internal/utils"
+	"github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/webhook"
+)
+
+func TestChargeIsIdempotent(t *testing.T) {
+	cfg := &utils.Config{}
+
+	store := apttesting.NewDatastore(t)
+	apttesting.ApplySeed(t, store, "", services.Seed{
+		"users": {"user-1": {"email": "user@example.com", "balance_micros": int64(1_000_000), "is_active": true}},
+	})
+
+	sharedCache := services.NewSharedCache(cache.New(time.Minute, time.Minute), store, false)
+	billing := services.NewBillingService(cfg, store, sharedCache, services.NewAuditService(store), services.NewNotificationService(cfg))
+
+	ctx := context.Background()
+	_, err := billing.Charge(ctx, "req-1", "user-1", "", 250_000)
+	require.NoError(t, err)
+
+	// A request charged again, e.g. by a retried stream close, is not charged twice
+	_, err = billing.Charge(ctx, "req-1", "user-1", "", 250_000)
+	require.NoError(t, err)
+
+	user, err := store.GetUserByID(ctx, "user-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(750_000), int64(user.Balance))
+
+	entries, err := store.ListLedgerEntries(ctx, "user-1", 10, "")
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// Requests that cost nothing, such as test mode requests, are not charged
+	_, err = billing.Charge(ctx, "req-2", "user-1", "", 0)
+	require.NoError(t, err)
+	entries, err = store.ListLedgerEntries(ctx, "user-1", 10, "")
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestChargeMatchesLedger(t *testing.T) {
+	cfg := &utils.Config{}
+
+	store := apttesting.NewDatastore(t)
+	apttesting.ApplySeed(t, store, "", services.Seed{
+		"users": {"user-1": {"email": "user@example.com", "balance_micros": int64(1_000_000), "is_active": true}},
+	})
+
+	sharedCache := services.NewSharedCache(cache.New(time.Minute, time.Minute), store, false)
+	billing := services.NewBillingService(cfg, store, sharedCache, services.NewAuditService(store), services.NewNotificationService(cfg))
+
+	ctx := context.Background()
+	require.NoError(t, store.GrantCredits(ctx, "user-1", &data.CreditGrant{
+		Amount: 100_000, Source: data.CreditSourceAdmin, ExpiresAt: time.Now().Add(time.Hour),
+	}))
+
+	// chargeEntries returns the user's charge ledger entries, newest first
+	chargeEntries := func(t *testing.T) []*data.LedgerEntry {
+		entries, err := store.ListLedgerEntries(ctx, "user-1", 10, "")
+		require.NoError(t, err)
+		var charges []*data.LedgerEntry
+		for _, entry := range entries {
+			if entry.Type == data.LedgerEntryCharge {
+				charges = append(charges, entry)
+			}
+		}
+		return charges
+	}
+
+	creditsUsed, err := billing.Charge(ctx, "req-1", "user-1", "", 250_000)
+	require.NoError(t, err)
+	assert.Equal(t, data.MicroUSD(100_000), creditsUsed)
+
+	user, err := store.GetUserByID(ctx, "user-1")
+	require.NoError(t, err)
+	assert.Equal(t, data.MicroUSD(850_000), user.Balance)
+
+	// The charge's one ledger entry splits it between credits and the balance it left
+	entries := chargeEntries(t)
+	require.Len(t, entries, 1)
+	entry := entries[0]
+	assert.Equal(t, "req-1", entry.RequestID)
+	assert.Equal(t, data.MicroUSD(-150_000), entry.Amount)
+	assert.Equal(t, data.MicroUSD(-100_000), entry.CreditAmount)
+	assert.Equal(t, data.MicroUSD(-250_000), entry.Amount+entry.CreditAmount)
+	assert.Equal(t, user.Balance, entry.ResultingBalance)
+	assert.Equal(t, data.MicroUSD(0), entry.ResultingCredits)
+	assert.Zero(t, entry.Debt)
+
+	// A retried charge, even one priced differently, reports the original charge and writes nothing
+	creditsUsed, err = billing.Charge(ctx, "req-1", "user-1", "", 400_000)
+	require.NoError(t, err)
+	assert.Equal(t, data.MicroUSD(100_000), creditsUsed)
+
+	user, err = store.GetUserByID(ctx, "user-1")
+	require.NoError(t, err)
+	assert.Equal(t, data.MicroUSD(850_000), user.Balance)
+	assert.Len(t, chargeEntries(t), 1)
+
+	// The next request's entry follows on from the balance the first left
+	_, err = billing.Charge(ctx, "req-2", "user-1", "", 50_000)
+	require.NoError(t, err)
+	entries = chargeEntries(t)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "req-2", entries[0].RequestID)
+	assert.Equal(t, data.MicroUSD(-50_000), entries[0].Amount)
+	assert.Equal(t, entries[1].ResultingBalance+entries[0].Amount, entries[0].ResultingBalance)
+	assert.Equal(t, data.MicroUSD(800_000), entries[0].ResultingBalance)
+}
+
+func TestChargeOverdrawsIntoDebt(t *testing.T) {
+	cfg := &utils.Config{}
+
+	store := apttesting.NewDatastore(t)
+	apttesting.ApplySeed(t, store, "", services.Seed{
+		"users": {"user-1": {"email": "user@example.com", "balance_micros": int64(1_000_000), "is_active": true}},
+	})
+
+	sharedCache := services.NewSharedCache(cache.New(time.Minute, time.Minute), store, false)
+	billing := services.NewBillingService(cfg, store, sharedCache, services.NewAuditService(store), services.NewNotificationService(cfg))
+
+	// Usage that outran its hold is still charged, and what the balance couldn't cover is debt
+	ctx := context.Background()
+	_, err := billing.Charge(ctx, "req-1", "user-1", "", 1_500_000)
+	require.NoError(t, err)
+	_, err = billing.Charge(ctx, "req-2", "user-1", "", 100_000)
+	require.NoError(t, err)
+
+	user, err := store.GetUserByID(ctx, "user-1")
+	require.NoError(t, err)
+	assert.Equal(t, data.MicroUSD(-600_000), user.Balance)
+
+	entries, err := store.ListLedgerEntries(ctx, "user-1", 10, "")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, data.MicroUSD(100_000), entries[0].Debt)
+	assert.Equal(t, data.MicroUSD(500_000), entries[1].Debt)
+
+	// Adjustments may not overdraw the balance, but top-ups may leave debt unpaid
+	_, err = store.UpdateUserBalance(ctx, "user-1", -100_000, data.LedgerEntryAdjustment, "")
+	assert.ErrorContains(t, err, "insufficient balance")
+	_, err = store.UpdateUserBalance(ctx, "user-1", 200_000, data.LedgerEntryTopUp, "")
+	require.NoError(t, err)
+	user, err = store.GetUserByID(ctx, "user-1")
+	require.NoError(t, err)
+	assert.Equal(t, data.MicroUSD(-400_000), user.Balance)
+}
+
+func TestStripeWebhookCreditsOnce(t *testing.T) {
+	cfg := &utils.Config{Billing: utils.BillingConfig{StripeSecretKey: "sk_test_key", StripeWebhookSecret: "whsec_test"}}
+
+	store := apttesting.NewDatastore(t)
+	apttesting.ApplySeed(t, store, "", services.Seed{
+		"users": {"user-1": {"email": "user@example.com", "balance_micros": int64(1_000_000), "is_active": true}},
+	})
+
+	sharedCache := services.NewSharedCache(cache.New(time.Minute, time.Minute), store, false)
+	billing := services.NewBillingService(cfg, store, sharedCache, services.NewAuditService(store), services.NewNotificationService(cfg))
+
+	// deliver signs and delivers a Stripe event, as a webhook delivery does
+	ctx := context.Background()
+	deliver := func(t *testing.T, eventID string, eventType stripe.EventType, object map[string]interface{}) {
+		payload, err := json.Marshal(map[string]interface{}{
+			"id":          eventID,
+			"object":      "event",
+			"api_version": stripe.APIVersion,
+			"type":        eventType,
+			"data":        map[string]interface{}{"object": object},
+		})
+		require.NoError(t, err)
+		signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: cfg.Billing.StripeWebhookSecret})
+		require.NoError(t, billing.HandleWebhook(ctx, signed.Payload, signed.Header))
+	}
+	balance := func(t *testing.T) data.MicroUSD {
+		user, err := store.GetUserByID(ctx, "user-1")
+		require.NoError(t, err)
+		return user.Balance
+	}
+
+	// Stripe redelivers an event until it is acknowledged, and may deliver it again after that
+	session := map[string]interface{}{
+		"id":             "cs_test_1",
+		"object":         "checkout.session",
+		"payment_status": "paid",
+		"metadata":       map[string]string{"user_id": "user-1", "amount_micros": "5000000", "source": "checkout"},
+	}
+	deliver(t, "evt_1", stripe.EventTypeCheckoutSessionCompleted, session)
+	deliver(t, "evt_1", stripe.EventTypeCheckoutSessionCompleted, session)
+	assert.Equal(t, data.MicroUSD(6_000_000), balance(t))
+
+	// An asynchronous payment's success is a second event for the same session
+	deliver(t, "evt_2", stripe.EventTypeCheckoutSessionAsyncPaymentSucceeded, session)
+	assert.Equal(t, data.MicroUSD(6_000_000), balance(t))
+
+	intent := map[string]interface{}{
+		"id":       "pi_test_1",
+		"object":   "payment_intent",
+		"status":   "succeeded",
+		"metadata": map[string]string{"user_id": "user-1", "amount_micros": "2000000", "source": "auto_top_up"},
+	}
+	deliver(t, "evt_3", stripe.EventTypePaymentIntentSucceeded, intent)
+	deliver(t, "evt_3", stripe.EventTypePaymentIntentSucceeded, intent)
+	assert.Equal(t, data.MicroUSD(8_000_000), balance(t))
+
+	entries, err := store.ListLedgerEntries(ctx, "user-1", 10, "")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, data.MicroUSD(2_000_000), entries[0].Amount)
+	assert.Equal(t, data.MicroUSD(5_000_000), entries[1].Amount)
+}
+
+func TestSpendAlertWebhookMustBePublic(t *testing.T) {
+	cfg := &utils.Config{Notifications: utils.NotificationsConfig{WebhookTimeout: 5 * time.Second}}
+
+	store := apttesting.NewDatastore(t)
+	apttesting.ApplySeed(t, store, "", services.Seed{
+		"users": {"user-1": {"email": "user@example.com", "balance_micros": int64(1_000_000), "is_active": true}},
+	})
+
+	sharedCache := services.NewSharedCache(cache.New(time.Minute, time.Minute), store, false)
+	notifications := services.NewNotificationService(cfg)
+	billing := services.NewBillingService(cfg, store, sharedCache, services.NewAuditService(store), notifications)
+
+	ctx := context.Background()
+	update := func(webhookURL string) error {
+		return billing.UpdateSpendAlerts(ctx, "user-1", &data.SpendAlertSettings{
+			Enabled:    true,
+			Thresholds: []data.SpendAlertThreshold{{Amount: 1_000_000}},
+			WebhookURL: webhookURL,
+		})
+	}
+
+	tests := []struct {
+		name       string
+		webhookURL string
+		wantErr    error
+	}{
+		{"Public", "https://93.184.216.34/hooks/aptrouter", nil},
+		{"PublicIPv6", "https://[2606:2800:220:1::1]/hook", nil},
+		{"NotHTTPS", "http://93.184.216.34/hook", services.ErrInvalidSpendAlerts},
+		{"Loopback", "https://127.0.0.1/hook", services.ErrPrivateWebhookAddress},
+		{"LoopbackName", "https://localhost:8443/hook", services.ErrPrivateWebhookAddress},
+		{"LoopbackIPv6", "https://[::1]/hook", services.ErrPrivateWebhookAddress},
+		{"Metadata", "https://169.254.169.254/latest/meta-data/", services.ErrPrivateWebhookAddress},
+		{"Private", "https://10.0.0.5/hook", services.ErrPrivateWebhookAddress},
+		{"Private172", "https://172.16.3.4/hook", services.ErrPrivateWebhookAddress},
+		{"Private192", "https://192.168.1.1/hook", services.ErrPrivateWebhookAddress},
+		{"CarrierGradeNAT", "https://100.64.0.1/hook", services.ErrPrivateWebhookAddress},
+		{"Unspecified", "https://0.0.0.0/hook", services.ErrPrivateWebhookAddress},
+		{"UniqueLocalIPv6", "https://[fd00::1]/hook", services.ErrPrivateWebhookAddress},
+		{"MappedIPv4", "https://[::ffff:127.0.0.1]/hook", services.ErrPrivateWebhookAddress},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := update(tt.webhookURL)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, services.ErrInvalidSpendAlerts)
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+
+	t.Run("DeliveryRefusesPrivateAddresses", func(t *testing.T) {
+		delivered := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			delivered++
+		}))
+		defer server.Close()
+
+		// A webhook saved while its host resolved publicly is still refused once it resolves privately
+		err := notifications.SendWebhook(ctx, server.URL, "whsec_test", "spend_alert.triggered", map[string]string{})
+		assert.ErrorIs(t, err, services.ErrPrivateWebhookAddress)
+		assert.Zero(t, delivered)
+
+		// Private webhooks are for local development
+		local := services.NewNotificationService(&utils.Config{Notifications: utils.NotificationsConfig{WebhookTimeout: 5 * time.Second, AllowPrivateWebhooks: true}})
+		require.NoError(t, local.SendWebhook(ctx, server.URL, "whsec_test", "spend_alert.triggered", map[string]string{}))
+		assert.Equal(t, 1, delivered)
+		require.NoError(t, local.ValidateWebhookURL(ctx, "https://127.0.0.1/hook"))
+	})
+}
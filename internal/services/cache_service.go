@@ -0,0 +1,163 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/google/uuid"
+	"github.com/patrickmn/go-cache"
+)
+
+// Cache is the contract for caches holding user and tier data shared across replicas
+type Cache interface {
+	// Get loads the cached value for key into dest, reporting whether it was found
+	Get(ctx context.Context, key string, dest interface{}) (bool, error)
+
+	// Set stores value under key for the given TTL
+	Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error
+
+	// Invalidate removes key from every cache layer and notifies other replicas
+	Invalidate(ctx context.Context, key string) error
+}
+
+// UserCacheKey returns the cache key for a user's cached data
+func UserCacheKey(userID string) string {
+	return fmt.Sprintf("user:%s", userID)
+}
+
+// TierCacheKey returns the cache key for a pricing tier
+func TierCacheKey(tierID string) string {
+	return fmt.Sprintf("tier:%s", tierID)
+}
+
+// OrgCacheKey returns the cache key for an organization
+func OrgCacheKey(orgID string) string {
+	return fmt.Sprintf("org:%s", orgID)
+}
+
+// TenantCacheKey returns the cache key for a tenant
+func TenantCacheKey(tenantID string) string {
+	return fmt.Sprintf("tenant:%s", tenantID)
+}
+
+// SharedCache is a two-level cache: an in-memory L1 per instance backed by a
+// Firestore L2 shared by all replicas, with invalidations broadcast through Firestore
+type SharedCache struct {
+	local           *cache.Cache
+	firebaseService *data.Service
+	instanceID      string
+	shared          bool
+}
+
+// NewSharedCache creates a new shared cache. When shared is false, or Firestore is
+// unavailable, it behaves as a plain in-memory cache.
+func NewSharedCache(local *cache.Cache, firebaseService *data.Service, shared bool) *SharedCache {
+	return &SharedCache{
+		local:           local,
+		firebaseService: firebaseService,
+		instanceID:      uuid.New().String(),
+		shared:          shared && firebaseService != nil && firebaseService.DB() != nil,
+	}
+}
+
+// Get loads the cached value for key into dest, checking L1 before L2
+func (c *SharedCache) Get(ctx context.Context, key string, dest interface{}) (bool, error) {
+	if cached, found := c.local.Get(key); found {
+		if raw, ok := cached.([]byte); ok {
+			if err := json.Unmarshal(raw, dest); err == nil {
+				return true, nil
+			}
+		}
+		c.local.Delete(key)
+	}
+
+	if !c.shared {
+		return false, nil
+	}
+
+	entry, err := c.firebaseService.GetCacheEntry(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if entry == nil {
+		return false, nil
+	}
+
+	if err := json.Unmarshal(entry.Value, dest); err != nil {
+		return false, fmt.Errorf("failed to decode cache entry %s: %w", key, err)
+	}
+
+	// Populate L1 with the remaining lifetime of the shared entry
+	if ttl := time.Until(entry.ExpiresAt); ttl > 0 {
+		c.local.Set(key, entry.Value, ttl)
+	}
+
+	return true, nil
+}
+
+// Set stores value in both cache layers
+func (c *SharedCache) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode cache entry %s: %w", key, err)
+	}
+
+	c.local.Set(key, raw, ttl)
+
+	if !c.shared {
+		return nil
+	}
+
+	return c.firebaseService.SetCacheEntry(ctx, key, raw, ttl)
+}
+
+// Invalidate removes key from both layers and broadcasts the invalidation to other replicas
+func (c *SharedCache) Invalidate(ctx context.Context, key string) error {
+	c.local.Delete(key)
+
+	if !c.shared {
+		return nil
+	}
+
+	if err := c.firebaseService.DeleteCacheEntry(ctx, key); err != nil {
+		return err
+	}
+
+	return c.firebaseService.PublishCacheInvalidation(ctx, key, c.instanceID)
+}
+
+// ListenForInvalidations evicts L1 entries invalidated by other replicas until ctx is cancelled
+func (c *SharedCache) ListenForInvalidations(ctx context.Context) {
+	if !c.shared {
+		return
+	}
+
+	slog.Info("Starting shared cache invalidation listener", "instance_id", c.instanceID)
+
+	for {
+		err := c.firebaseService.ListenCacheInvalidations(ctx, time.Now(), func(event *data.CacheInvalidation) {
+			if event.SourceID == c.instanceID {
+				return
+			}
+			c.local.Delete(event.Key)
+			slog.Debug("Evicted cache entry after remote invalidation", "key", event.Key, "source_id", event.SourceID)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+
+		// Entries may have been missed while the listener was down, so drop L1 entirely
+		slog.Warn("Shared cache invalidation listener stopped, restarting", "error", err)
+		c.local.Flush()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
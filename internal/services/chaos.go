@@ -0,0 +1,203 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Injected fault kinds
+const (
+	chaosDelay    = "delay"
+	chaosError    = "error"
+	chaosTruncate = "truncate"
+)
+
+// FaultInjector injects the faults CHAOS_* configures into provider calls. Faults are drawn from
+// one seeded source in a fixed order per call, so the same requests meet the same faults.
+type FaultInjector struct {
+	config utils.ChaosConfig
+
+	mu   sync.Mutex
+	rand *rand.Rand
+	// injected counts injected faults by provider and kind
+	injected metric.Int64Counter
+}
+
+// NewFaultInjector creates a fault injector; nil when fault injection is disabled
+func NewFaultInjector(cfg *utils.Config) *FaultInjector {
+	if !cfg.Chaos.Enabled {
+		return nil
+	}
+
+	seed := cfg.Chaos.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	injected, err := meter.Int64Counter("aptrouter.chaos.injected_faults",
+		metric.WithDescription("Faults injected into provider calls"),
+		metric.WithUnit("{fault}"))
+	if err != nil {
+		slog.Warn("Failed to create injected fault counter", "error", err)
+	}
+
+	slog.Warn("Fault injection enabled", "seed", seed, "providers", cfg.Chaos.Providers,
+		"delay_rate", cfg.Chaos.DelayRate, "error_rate", cfg.Chaos.ErrorRate, "truncate_rate", cfg.Chaos.TruncateRate)
+	return &FaultInjector{
+		config:   cfg.Chaos,
+		rand:     rand.New(rand.NewSource(seed)),
+		injected: injected,
+	}
+}
+
+// Wrap returns client with faults injected into its calls, or client itself when its provider is
+// left alone
+func (f *FaultInjector) Wrap(client data.LLMClient, provider, modelID string) data.LLMClient {
+	if f == nil || (len(f.config.Providers) > 0 && !slices.Contains(f.config.Providers, provider)) {
+		return client
+	}
+	return &chaosClient{LLMClient: client, faults: f, provider: provider, modelID: modelID}
+}
+
+// faults are the faults drawn for one provider call
+type faults struct {
+	delay      bool
+	statusCode int
+	truncate   bool
+}
+
+// draw draws the faults of the next provider call
+func (f *FaultInjector) draw() faults {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var drawn faults
+	drawn.delay = f.rand.Float64() < f.config.DelayRate
+	if f.rand.Float64() < f.config.ErrorRate {
+		drawn.statusCode = f.config.ErrorStatusCodes[f.rand.Intn(len(f.config.ErrorStatusCodes))]
+	}
+	drawn.truncate = f.rand.Float64() < f.config.TruncateRate
+	return drawn
+}
+
+// record counts and logs an injected fault
+func (f *FaultInjector) record(ctx context.Context, provider, modelID, kind string, args ...any) {
+	if f.injected != nil {
+		f.injected.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("provider", provider),
+			attribute.String("fault", kind),
+		))
+	}
+	slog.Warn("Injected provider fault", append([]any{"provider", provider, "model_id", modelID, "fault", kind}, args...)...)
+}
+
+// chaosClient is a provider client with faults injected into its calls
+type chaosClient struct {
+	data.LLMClient
+	faults   *FaultInjector
+	provider string
+	modelID  string
+}
+
+func (c *chaosClient) GenerateWithParams(ctx context.Context, params map[string]interface{}) (*data.GenerateResponse, error) {
+	drawn := c.faults.draw()
+	if err := c.inject(ctx, drawn); err != nil {
+		return nil, err
+	}
+	return c.LLMClient.GenerateWithParams(ctx, params)
+}
+
+func (c *chaosClient) GenerateStream(ctx context.Context, params map[string]interface{}) (*data.StreamResponse, error) {
+	drawn := c.faults.draw()
+	if err := c.inject(ctx, drawn); err != nil {
+		return nil, err
+	}
+
+	stream, err := c.LLMClient.GenerateStream(ctx, params)
+	if err != nil || !drawn.truncate {
+		return stream, err
+	}
+	c.faults.record(ctx, c.provider, c.modelID, chaosTruncate, "after_bytes", c.faults.config.TruncateAfterBytes)
+	stream.Stream = &truncatedStream{ReadCloser: stream.Stream, remaining: c.faults.config.TruncateAfterBytes}
+	return stream, nil
+}
+
+// inject holds the call back and fails it as drawn
+func (c *chaosClient) inject(ctx context.Context, drawn faults) error {
+	if drawn.delay && c.faults.config.Delay > 0 {
+		c.faults.record(ctx, c.provider, c.modelID, chaosDelay, "delay", c.faults.config.Delay)
+		timer := time.NewTimer(c.faults.config.Delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	if drawn.statusCode != 0 {
+		c.faults.record(ctx, c.provider, c.modelID, chaosError, "status_code", drawn.statusCode)
+		return &data.ProviderError{
+			Provider:   c.provider,
+			ModelID:    c.modelID,
+			StatusCode: drawn.statusCode,
+			ErrorCode:  "injected_fault",
+			Message:    fmt.Sprintf("injected fault: provider responded with status %d", drawn.statusCode),
+			Retryable:  drawn.statusCode >= 500 || drawn.statusCode == 408,
+		}
+	}
+	return nil
+}
+
+// truncatedStream fails a provider stream, as a dropped connection would, once remaining bytes
+// have been read
+type truncatedStream struct {
+	io.ReadCloser
+	remaining int
+}
+
+func (s *truncatedStream) Read(p []byte) (int, error) {
+	if s.remaining <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if len(p) > s.remaining {
+		p = p[:s.remaining]
+	}
+	n, err := s.ReadCloser.Read(p)
+	s.remaining -= n
+	return n, err
+}
+
+// GetUsage passes through the usage the provider reported before the stream was cut
+func (s *truncatedStream) GetUsage() (int, int) {
+	if reader, ok := s.ReadCloser.(interface{ GetUsage() (int, int) }); ok {
+		return reader.GetUsage()
+	}
+	return 0, 0
+}
+
+// GetTokenDetails passes through the wrapped stream's prompt cache and reasoning usage
+func (s *truncatedStream) GetTokenDetails() data.TokenDetails {
+	if reader, ok := s.ReadCloser.(data.TokenDetailsReader); ok {
+		return reader.GetTokenDetails()
+	}
+	return data.TokenDetails{}
+}
+
+// TakeLogprobs passes through the wrapped stream's token logprobs
+func (s *truncatedStream) TakeLogprobs() []data.TokenLogprob {
+	if reader, ok := s.ReadCloser.(data.LogprobsReader); ok {
+		return reader.TakeLogprobs()
+	}
+	return nil
+}
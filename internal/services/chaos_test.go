@@ -0,0 +1,86 @@
+package services_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	"github.com/apt-router/api/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultInjector(t *testing.T) {
+	ctx := context.Background()
+	params := map[string]interface{}{"prompt": "the quick brown fox jumps over the lazy dog"}
+	injector := func(chaos utils.ChaosConfig) *services.FaultInjector {
+		chaos.Enabled = true
+		return services.NewFaultInjector(&utils.Config{Chaos: chaos})
+	}
+
+	assert.Nil(t, services.NewFaultInjector(&utils.Config{}), "fault injection is off by default")
+
+	t.Run("Errors", func(t *testing.T) {
+		faults := injector(utils.ChaosConfig{Seed: 1, Providers: []string{"openai"}, ErrorRate: 1, ErrorStatusCodes: []int{503}})
+
+		client := faults.Wrap(data.NewFakeClient("gpt-4o", "openai", ""), "openai", "gpt-4o")
+		_, err := client.GenerateWithParams(ctx, params)
+		var providerErr *data.ProviderError
+		require.ErrorAs(t, err, &providerErr)
+		assert.Equal(t, 503, providerErr.StatusCode)
+		assert.True(t, providerErr.Retryable)
+		_, err = client.GenerateStream(ctx, params)
+		assert.ErrorAs(t, err, &providerErr)
+
+		other := faults.Wrap(data.NewFakeClient("gemini-2.0-flash", "google", ""), "google", "gemini-2.0-flash")
+		_, err = other.GenerateWithParams(ctx, params)
+		assert.NoError(t, err, "providers not listed are left alone")
+	})
+
+	t.Run("TruncatesStreams", func(t *testing.T) {
+		faults := injector(utils.ChaosConfig{Seed: 1, TruncateRate: 1, TruncateAfterBytes: 10})
+		client := faults.Wrap(data.NewFakeClient("gpt-4o", "openai", ""), "openai", "gpt-4o")
+
+		stream, err := client.GenerateStream(ctx, params)
+		require.NoError(t, err)
+		read, err := io.ReadAll(stream.Stream)
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		assert.Len(t, read, 10)
+
+		resp, err := client.GenerateWithParams(ctx, params)
+		require.NoError(t, err, "only streams are truncated")
+		assert.Contains(t, resp.Text, "lazy dog")
+	})
+
+	t.Run("Delays", func(t *testing.T) {
+		faults := injector(utils.ChaosConfig{Seed: 1, DelayRate: 1, Delay: time.Hour})
+		client := faults.Wrap(data.NewFakeClient("gpt-4o", "openai", ""), "openai", "gpt-4o")
+
+		timeoutCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		_, err := client.GenerateWithParams(timeoutCtx, params)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("Deterministic", func(t *testing.T) {
+		outcomes := func() []bool {
+			faults := injector(utils.ChaosConfig{Seed: 42, ErrorRate: 0.5, ErrorStatusCodes: []int{500, 503}})
+			client := faults.Wrap(data.NewFakeClient("gpt-4o", "openai", ""), "openai", "gpt-4o")
+			var failed []bool
+			for range 50 {
+				_, err := client.GenerateWithParams(ctx, params)
+				var providerErr *data.ProviderError
+				failed = append(failed, errors.As(err, &providerErr))
+			}
+			return failed
+		}
+		first := outcomes()
+		assert.Equal(t, first, outcomes(), "the same seed injects the same faults")
+		assert.Contains(t, first, true)
+		assert.Contains(t, first, false)
+	})
+}
@@ -0,0 +1,275 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/apt-router/api/internal/data"
+)
+
+// defaultOptimizerModel optimizes prompts and summarizes conversations
+const defaultOptimizerModel = "gemma-3-27b-it"
+
+// How a conversation was compressed to fit its context
+const (
+	// ContextCompressionSummarize folded the oldest turns into a summary written by the optimizer model
+	ContextCompressionSummarize = "summarize"
+	// ContextCompressionTrim dropped the oldest turns, when they could not be summarized
+	ContextCompressionTrim = "trim"
+)
+
+// ConversationTurn is one turn of a conversation: "user" or "assistant" and what was said
+type ConversationTurn struct {
+	Role string
+	Text string
+}
+
+// Conversation is a multi-turn conversation sent as a single prompt: the caller's system
+// instructions, a summary standing for earlier turns that are no longer sent, and the turns that are
+type Conversation struct {
+	System  string
+	Summary string
+	Turns   []ConversationTurn
+}
+
+// Prompt flattens the conversation's turns into the single prompt the generation pipeline sends.
+// A lone user turn is sent as is; longer conversations are rendered as a transcript ending with
+// the assistant turn to complete.
+func (c Conversation) Prompt() string {
+	if len(c.Turns) == 1 && c.Turns[0].Role == "user" {
+		return c.Turns[0].Text
+	}
+	return transcript(c.Turns, true)
+}
+
+// SystemPrompt returns the system instructions, followed by the summary of the earlier turns
+func (c Conversation) SystemPrompt() string {
+	if c.Summary == "" {
+		return c.System
+	}
+	summary := "Summary of the conversation so far:\n" + c.Summary
+	if c.System == "" {
+		return summary
+	}
+	return c.System + "\n\n" + summary
+}
+
+// transcript renders turns as a Human/Assistant transcript, ending with an open assistant turn
+// when complete is set and the last turn is the user's
+func transcript(turns []ConversationTurn, complete bool) string {
+	var prompt strings.Builder
+	for i, turn := range turns {
+		if i > 0 {
+			prompt.WriteString("\n\n")
+		}
+		if turn.Role == "user" {
+			prompt.WriteString("Human: ")
+		} else {
+			prompt.WriteString("Assistant: ")
+		}
+		prompt.WriteString(turn.Text)
+	}
+	if complete && len(turns) > 0 && turns[len(turns)-1].Role == "user" {
+		prompt.WriteString("\n\nAssistant:")
+	}
+	return prompt.String()
+}
+
+// ContextCompression reports how a conversation was compressed to fit its context. It is reported
+// in the response metadata, and the summary's cost is charged with the request as optimizer cost.
+type ContextCompression struct {
+	Strategy string `json:"strategy"`
+	// TurnsCompressed is how many of the oldest turns were summarized or dropped
+	TurnsCompressed int `json:"turns_compressed"`
+	// InputTokensBefore and InputTokensAfter are the conversation's estimated prompt tokens
+	InputTokensBefore int `json:"input_tokens_before"`
+	InputTokensAfter  int `json:"input_tokens_after"`
+	// SummaryModel, SummaryInputTokens and SummaryOutputTokens are the summarization call's usage
+	SummaryModel        string        `json:"summary_model,omitempty"`
+	SummaryInputTokens  int           `json:"summary_input_tokens,omitempty"`
+	SummaryOutputTokens int           `json:"summary_output_tokens,omitempty"`
+	Cost                data.MicroUSD `json:"cost"`
+	// FallbackReason is why turns were dropped rather than summarized
+	FallbackReason string `json:"fallback_reason,omitempty"`
+}
+
+// CompressConversation fits a conversation for req's model into limit tokens of prompt and
+// max_tokens, or into the model's context window when that is smaller, by folding its oldest turns
+// into the summary with the optimizer model. The turns are dropped instead when they cannot be
+// summarized. The last turn is always kept, and ErrContextWindowExceeded is returned when it does
+// not fit on its own. A conversation that fits is returned as is, with no compression. Tokens are
+// estimated with the model's local tokenizer; the request's context window is checked exactly when
+// it is generated.
+func (s *GenerationService) CompressConversation(ctx context.Context, req *GenerationRequest, requestCtx *RequestContext, conversation Conversation, limit int) (Conversation, *ContextCompression, error) {
+	resolved := *req
+	if err := s.resolveModelAlias(ctx, &resolved, requestCtx); err != nil {
+		return conversation, nil, err
+	}
+	modelConfig, err := s.modelCatalog.GetModelConfig(resolved.Model)
+	if err != nil {
+		return conversation, nil, fmt.Errorf("%w: %s", ErrUnknownModel, resolved.Model)
+	}
+	if window := modelConfig.ContextWindowSize; window > 0 && (limit <= 0 || window < limit) {
+		limit = window
+	}
+	if limit <= 0 || len(conversation.Turns) == 0 {
+		return conversation, nil, nil
+	}
+
+	maxTokens := req.MaxTokens
+	if maxTokens == 0 {
+		maxTokens = 1000
+	}
+	inputTokens := func(c Conversation) int {
+		return s.tokenizers.Estimate(modelConfig, c.SystemPrompt()) + s.tokenizers.Estimate(modelConfig, c.Prompt())
+	}
+	before := inputTokens(conversation)
+	if before+maxTokens <= limit {
+		return conversation, nil, nil
+	}
+
+	// Keep as many of the latest turns as fit beside a summary of the longest it may be, starting
+	// on a user turn
+	summaryTokens := s.config.Optimization.SummaryMaxTokens
+	kept := -1
+	for i := 1; i < len(conversation.Turns); i++ {
+		if conversation.Turns[i].Role != "user" && i < len(conversation.Turns)-1 {
+			continue
+		}
+		candidate := Conversation{System: conversation.System, Summary: "-", Turns: conversation.Turns[i:]}
+		if inputTokens(candidate)+summaryTokens+maxTokens <= limit {
+			kept = i
+			break
+		}
+	}
+	if kept < 0 {
+		return conversation, nil, fmt.Errorf("%w: the latest message and %d max_tokens do not fit in %d tokens",
+			ErrContextWindowExceeded, maxTokens, limit)
+	}
+
+	compression := &ContextCompression{
+		Strategy:          ContextCompressionSummarize,
+		TurnsCompressed:   kept,
+		InputTokensBefore: before,
+	}
+	compressed := Conversation{System: conversation.System, Summary: conversation.Summary, Turns: conversation.Turns[kept:]}
+	summary, err := s.summarizeTurns(ctx, requestCtx, conversation.Summary, conversation.Turns[:kept], compression)
+	if err != nil {
+		requestCtx.Logger.Warn("Failed to summarize conversation, dropping its oldest turns", "turns", kept, "error", err)
+		compression.Strategy = ContextCompressionTrim
+		compression.FallbackReason = "summarization_failed"
+	} else {
+		compressed.Summary = summary
+	}
+	compression.InputTokensAfter = inputTokens(compressed)
+
+	requestCtx.Logger.Info("Compressed conversation to fit its context",
+		"model", modelConfig.ModelID,
+		"strategy", compression.Strategy,
+		"turns_compressed", compression.TurnsCompressed,
+		"input_tokens_before", compression.InputTokensBefore,
+		"input_tokens_after", compression.InputTokensAfter,
+		"limit", limit)
+	return compressed, compression, nil
+}
+
+// fitConversation compresses req.Conversation, when the caller asked for it to be compressed, to
+// fit the model's context window beside the managed system prompts, and rebuilds the prompt and the
+// caller's system instructions from it. The compressed request's tokens are still counted exactly
+// before it is sent.
+func (s *GenerationService) fitConversation(ctx context.Context, req *GenerationRequest, modelConfig ModelConfig, requestCtx *RequestContext) error {
+	if req.Conversation == nil || req.ContextCompression != nil || modelConfig.ContextWindowSize <= 0 {
+		return nil
+	}
+
+	limit := modelConfig.ContextWindowSize - s.tokenizers.Estimate(modelConfig, req.System)
+	compressed, compression, err := s.CompressConversation(ctx, req, requestCtx, *req.Conversation, limit)
+	if err != nil || compression == nil {
+		return err
+	}
+
+	// Extra may be shared with the caller, so the system instructions are set on a copy
+	extra := make(map[string]interface{}, len(req.Extra)+1)
+	for key, value := range req.Extra {
+		extra[key] = value
+	}
+	if system := compressed.SystemPrompt(); system != "" {
+		extra["system"] = system
+	}
+	req.Extra = extra
+	req.Prompt = compressed.Prompt()
+	req.Conversation = &compressed
+	req.ContextCompression = compression
+	return nil
+}
+
+// summarizeTurns asks the optimizer model to summarize turns, carrying on from the summary of the
+// turns before them, and records the call's usage and cost on compression. Development mode and
+// test mode requests are summarized by a fake client.
+func (s *GenerationService) summarizeTurns(ctx context.Context, requestCtx *RequestContext, summary string, turns []ConversationTurn, compression *ContextCompression) (string, error) {
+	model := defaultOptimizerModel
+	if s.optimizer != nil {
+		model = s.optimizer.model
+	}
+	// An optimizer model without a configuration is treated as free
+	modelConfig, err := s.modelCatalog.GetModelConfig(model)
+	if err != nil {
+		modelConfig = ModelConfig{ModelID: model, Provider: "google"}
+	}
+
+	var client data.LLMClient
+	if s.config.Dev.Enabled || requestCtx.TestMode {
+		client = s.faults.Wrap(data.NewFakeClient(modelConfig.ModelID, modelConfig.Provider, ""), modelConfig.Provider, modelConfig.ModelID)
+	} else {
+		apiKey := s.config.ProviderKey(modelConfig.Provider)
+		if apiKey == "" {
+			return "", ErrOptimizerUnavailable
+		}
+		client, err = s.newProviderClient(modelConfig, apiKey, nil)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if timeout := s.config.Timeouts.Optimization; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	maxTokens := s.config.Optimization.SummaryMaxTokens
+	resp, err := client.GenerateWithParams(ctx, map[string]interface{}{
+		"prompt":      summarizationPrompt(summary, turns, maxTokens),
+		"max_tokens":  maxTokens,
+		"temperature": 0.2,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	compression.SummaryModel = modelConfig.ModelID
+	compression.SummaryInputTokens = resp.InputTokens
+	compression.SummaryOutputTokens = resp.OutputTokens
+	compression.Cost = data.ComputeCost(resp.InputTokens, resp.OutputTokens,
+		modelConfig.InputPricePerMillion, modelConfig.OutputPricePerMillion, 0, 0).Base()
+
+	text := strings.TrimSpace(resp.Text)
+	if text == "" {
+		return "", fmt.Errorf("optimizer model returned an empty summary")
+	}
+	return text, nil
+}
+
+// summarizationPrompt builds the prompt asking the optimizer model to summarize turns
+func summarizationPrompt(summary string, turns []ConversationTurn, maxTokens int) string {
+	var prompt strings.Builder
+	fmt.Fprintf(&prompt, "Summarize the conversation below in at most %d words, for an assistant that will carry it on without seeing it. Keep the facts, names, numbers, decisions, open questions and the user's instructions and preferences. Write only the summary.\n\n", maxTokens*3/4)
+	if summary != "" {
+		prompt.WriteString("Summary of the conversation before this part:\n")
+		prompt.WriteString(summary)
+		prompt.WriteString("\n\n")
+	}
+	prompt.WriteString("Conversation:\n")
+	prompt.WriteString(transcript(turns, false))
+	return prompt.String()
+}
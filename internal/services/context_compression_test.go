@@ -0,0 +1,112 @@
+package services_test
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	apttesting "github.com/apt-router/api/internal/testing"
+	"github.com/apt-router/api/internal/utils"
+	"github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressConversation(t *testing.T) {
+	cfg := &utils.Config{
+		LLM:          utils.LLMConfig{GoogleAPIKey: "platform-google-key", OpenAIAPIKey: "platform-openai-key"},
+		Optimization: utils.OptimizationConfig{SummaryMaxTokens: 40},
+	}
+	store := apttesting.NewDatastore(t)
+	catalog := apttesting.NewCatalog(
+		services.ModelConfig{ModelID: "gpt-4o", Provider: "openai", ContextWindowSize: 128_000, IsActive: true},
+		services.ModelConfig{ModelID: "gemma-3-27b-it", Provider: "google", InputPricePerMillion: 0.1, OutputPricePerMillion: 0.4, IsActive: true},
+	)
+	sharedCache := services.NewSharedCache(cache.New(time.Minute, time.Minute), store, false)
+	audit := services.NewAuditService(store)
+	generation := services.NewGenerationService(cfg, store, sharedCache, catalog,
+		services.NewBillingService(cfg, store, sharedCache, audit, services.NewNotificationService(cfg)),
+		services.NewProviderKeyService(cfg, store),
+		services.NewSystemPromptService(store, sharedCache),
+		services.NewTemplateService(store, sharedCache),
+		services.NewExperimentService(store, nil),
+		services.NewRoutingService(store, catalog),
+	)
+	llm := apttesting.NewLLMClient()
+	generation.SetClientFactory(llm.Factory())
+
+	ctx := context.Background()
+	requestCtx := &services.RequestContext{RequestID: "req-1", UserID: "user-1", Logger: slog.Default()}
+	req := &services.GenerationRequest{Model: "gpt-4o", MaxTokens: 50}
+	conversation := services.Conversation{
+		System: "Be brief.",
+		Turns: []services.ConversationTurn{
+			{Role: "user", Text: "Hello"},
+			{Role: "assistant", Text: "Hi! How can I help?"},
+			{Role: "user", Text: strings.Repeat("alpha ", 100)},
+			{Role: "assistant", Text: strings.Repeat("beta ", 100)},
+			{Role: "user", Text: strings.Repeat("gamma ", 100)},
+		},
+	}
+
+	t.Run("Fits", func(t *testing.T) {
+		compressed, compression, err := generation.CompressConversation(ctx, req, requestCtx, conversation, 0)
+		require.NoError(t, err)
+		assert.Nil(t, compression, "the model's window holds the whole conversation")
+		assert.Equal(t, conversation, compressed)
+		assert.Empty(t, llm.Calls())
+	})
+
+	t.Run("Summarizes", func(t *testing.T) {
+		llm.Queue(apttesting.Response{Text: "The user greeted the assistant and listed alphas; it answered with betas.", InputTokens: 1000, OutputTokens: 100})
+		compressed, compression, err := generation.CompressConversation(ctx, req, requestCtx, conversation, 300)
+		require.NoError(t, err)
+		require.NotNil(t, compression)
+
+		// The oldest turns are folded into a summary, leaving the latest user turn
+		assert.Equal(t, services.ContextCompressionSummarize, compression.Strategy)
+		assert.Equal(t, 4, compression.TurnsCompressed)
+		assert.Equal(t, conversation.Turns[4:], compressed.Turns)
+		assert.Equal(t, "The user greeted the assistant and listed alphas; it answered with betas.", compressed.Summary)
+		assert.Equal(t, "Be brief.\n\nSummary of the conversation so far:\n"+compressed.Summary, compressed.SystemPrompt())
+		assert.Less(t, compression.InputTokensAfter, compression.InputTokensBefore)
+
+		// The summary is written by the optimizer model on the platform key, and priced at its
+		// rates: 1000 input tokens at $0.10/M and 100 output tokens at $0.40/M
+		calls := llm.Calls()
+		require.Len(t, calls, 1)
+		assert.Equal(t, "gemma-3-27b-it", calls[0].ModelID)
+		assert.Equal(t, "platform-google-key", calls[0].APIKey)
+		assert.Equal(t, 40, calls[0].Params["max_tokens"])
+		assert.Contains(t, calls[0].Params["prompt"], "Human: Hello\n\nAssistant: Hi! How can I help?")
+		assert.NotContains(t, calls[0].Params["prompt"], "gamma")
+		assert.Equal(t, "gemma-3-27b-it", compression.SummaryModel)
+		assert.Equal(t, data.MicroUSD(140), compression.Cost)
+	})
+
+	t.Run("TrimsWhenSummaryFails", func(t *testing.T) {
+		llm.Queue(apttesting.Response{Err: errors.New("overloaded")})
+		previous := conversation
+		previous.Summary = "Earlier, the user asked for brevity."
+		compressed, compression, err := generation.CompressConversation(ctx, req, requestCtx, previous, 300)
+		require.NoError(t, err)
+		require.NotNil(t, compression)
+
+		assert.Equal(t, services.ContextCompressionTrim, compression.Strategy)
+		assert.Equal(t, "summarization_failed", compression.FallbackReason)
+		assert.Equal(t, 4, compression.TurnsCompressed)
+		assert.Equal(t, previous.Turns[4:], compressed.Turns)
+		assert.Equal(t, previous.Summary, compressed.Summary, "the earlier summary is kept")
+		assert.Zero(t, compression.Cost)
+	})
+
+	t.Run("LatestTurnTooLong", func(t *testing.T) {
+		_, _, err := generation.CompressConversation(ctx, req, requestCtx, conversation, 100)
+		assert.ErrorIs(t, err, services.ErrContextWindowExceeded)
+	})
+}
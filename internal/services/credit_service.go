@@ -0,0 +1,126 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/utils"
+)
+
+var (
+	// ErrReferralsDisabled is returned when no referral credit is configured
+	ErrReferralsDisabled = errors.New("referrals are not enabled")
+	// ErrInvalidCreditGrant is returned when a credit grant fails validation
+	ErrInvalidCreditGrant = errors.New("invalid credit grant")
+)
+
+// CreditService grants promotional credits by admin action and referral codes
+type CreditService struct {
+	config          utils.CreditsConfig
+	firebaseService *data.Service
+	cache           Cache
+	audit           *AuditService
+}
+
+// NewCreditService creates a new credit service
+func NewCreditService(cfg *utils.Config, firebaseService *data.Service, cache Cache, audit *AuditService) *CreditService {
+	return &CreditService{
+		config:          cfg.Credits,
+		firebaseService: firebaseService,
+		cache:           cache,
+		audit:           audit,
+	}
+}
+
+// ReferralsEnabled reports whether redeeming a referral code grants any credit
+func (s *CreditService) ReferralsEnabled() bool {
+	return s.config.ReferralCreditUSD > 0 || s.config.ReferrerCreditUSD > 0
+}
+
+// Grant grants a user promotional credit. A zero expiresAt uses the default expiry.
+func (s *CreditService) Grant(ctx context.Context, userID string, amount data.MicroUSD, expiresAt time.Time, reason string) (*data.CreditGrant, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("%w: amount must be positive", ErrInvalidCreditGrant)
+	}
+	if expiresAt.IsZero() {
+		expiresAt = time.Now().Add(s.config.DefaultExpiry)
+	}
+	if !expiresAt.After(time.Now()) {
+		return nil, fmt.Errorf("%w: expiry must be in the future", ErrInvalidCreditGrant)
+	}
+
+	grant := &data.CreditGrant{
+		Amount:    amount,
+		Source:    data.CreditSourceAdmin,
+		Reason:    reason,
+		ExpiresAt: expiresAt,
+	}
+	if err := s.firebaseService.GrantCredits(ctx, userID, grant); err != nil {
+		return nil, err
+	}
+	s.invalidateUser(ctx, userID)
+
+	return grant, nil
+}
+
+// ReferralCode returns the user's referral code, creating one on first use
+func (s *CreditService) ReferralCode(ctx context.Context, userID string) (*data.ReferralCode, error) {
+	if !s.ReferralsEnabled() {
+		return nil, ErrReferralsDisabled
+	}
+	return s.firebaseService.GetOrCreateReferralCode(ctx, userID)
+}
+
+// Redeem redeems a referral code for a user, granting credits to them and to the code's owner.
+// It returns the credit granted to the redeeming user.
+func (s *CreditService) Redeem(ctx context.Context, userID, code string) (*data.CreditGrant, error) {
+	if !s.ReferralsEnabled() {
+		return nil, ErrReferralsDisabled
+	}
+
+	expiresAt := time.Now().Add(s.config.DefaultExpiry)
+	referee := &data.CreditGrant{
+		Amount:    data.USDToMicros(s.config.ReferralCreditUSD),
+		Source:    data.CreditSourceReferral,
+		Reason:    "Redeemed referral code " + code,
+		ExpiresAt: expiresAt,
+	}
+	referrer := &data.CreditGrant{
+		Amount:    data.USDToMicros(s.config.ReferrerCreditUSD),
+		Source:    data.CreditSourceReferrer,
+		Reason:    "Referral code " + code + " redeemed",
+		ExpiresAt: expiresAt,
+	}
+
+	referrerID, err := s.firebaseService.RedeemReferralCode(ctx, userID, code, referee, referrer, s.config.MaxReferralRedemptions)
+	if err != nil {
+		return nil, err
+	}
+	s.invalidateUser(ctx, userID)
+	s.invalidateUser(ctx, referrerID)
+
+	s.audit.Record(ctx, &data.AuditEvent{
+		Type:      data.AuditReferralRedeemed,
+		ActorType: data.AuditActorUser,
+		ActorID:   userID,
+		TargetID:  code,
+		Details: map[string]interface{}{
+			"referrer_id":            referrerID,
+			"referee_credit_micros":  int64(referee.Amount),
+			"referrer_credit_micros": int64(referrer.Amount),
+		},
+	})
+
+	return referee, nil
+}
+
+// invalidateUser drops the cached user on every replica so balance checks see new credit
+func (s *CreditService) invalidateUser(ctx context.Context, userID string) {
+	if err := s.cache.Invalidate(ctx, UserCacheKey(userID)); err != nil {
+		slog.Warn("Failed to invalidate user cache", "user_id", userID, "error", err)
+	}
+}
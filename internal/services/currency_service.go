@@ -0,0 +1,216 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/utils"
+)
+
+var (
+	// ErrUnsupportedCurrency is returned for currencies amounts can't be displayed in
+	ErrUnsupportedCurrency = errors.New("unsupported currency")
+	// ErrNoExchangeRate is returned when no rate was fetched for a currency on or before a day
+	ErrNoExchangeRate = errors.New("no exchange rate available")
+)
+
+// exchangeRateCacheTTL is how long exchange rates read from Firestore are reused. Rates are
+// published daily, so an hour keeps them fresh on replicas that don't fetch them.
+const exchangeRateCacheTTL = time.Hour
+
+// ExchangeRate converts USD amounts into a display currency at one day's rate
+type ExchangeRate struct {
+	Currency string `json:"code"`
+	// Rate is how many units of Currency one USD buys
+	Rate float64 `json:"rate"`
+	// Day is the day the rate was published for, as YYYY-MM-DD; empty for USD
+	Day    string `json:"rate_date,omitempty"`
+	Source string `json:"source,omitempty"`
+}
+
+// usdExchangeRate displays amounts as they are accounted
+var usdExchangeRate = &ExchangeRate{Currency: "USD", Rate: 1}
+
+// Convert converts a USD amount into the currency
+func (r *ExchangeRate) Convert(amount data.MicroUSD) data.DisplayAmount {
+	return amount.Convert(r.Rate, data.CurrencyDecimals(r.Currency))
+}
+
+// ConvertAll converts named USD amounts into the currency, keeping their names
+func (r *ExchangeRate) ConvertAll(amounts map[string]data.MicroUSD) map[string]data.DisplayAmount {
+	converted := make(map[string]data.DisplayAmount, len(amounts))
+	for name, amount := range amounts {
+		converted[name] = r.Convert(amount)
+	}
+	return converted
+}
+
+// cachedExchangeRates are the rates read for a day
+type cachedExchangeRates struct {
+	rates    *data.ExchangeRates
+	cachedAt time.Time
+}
+
+// CurrencyService fetches daily exchange rates and converts the USD amounts of balances, costs
+// and statements into the currencies users display them in. Nothing is accounted or charged in
+// another currency.
+type CurrencyService struct {
+	config          utils.CurrencyConfig
+	firebaseService *data.Service
+	httpClient      *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedExchangeRates
+}
+
+// NewCurrencyService creates a new currency service
+func NewCurrencyService(cfg *utils.Config, firebaseService *data.Service) *CurrencyService {
+	return &CurrencyService{
+		config:          cfg.Currency,
+		firebaseService: firebaseService,
+		httpClient:      &http.Client{Timeout: 30 * time.Second},
+		cache:           make(map[string]cachedExchangeRates),
+	}
+}
+
+// Supported returns the currencies amounts may be displayed in, USD first
+func (s *CurrencyService) Supported() []string {
+	return append([]string{"USD"}, s.config.Currencies...)
+}
+
+// ValidateCurrency checks amounts may be displayed in a currency
+func (s *CurrencyService) ValidateCurrency(currency string) error {
+	if !slices.Contains(s.Supported(), currency) {
+		return fmt.Errorf("%w: %q, expected one of %s", ErrUnsupportedCurrency, currency, strings.Join(s.Supported(), ", "))
+	}
+	return nil
+}
+
+// ExchangeRate returns the rate amounts are converted into a currency at for at's UTC day: the
+// latest published on or before it
+func (s *CurrencyService) ExchangeRate(ctx context.Context, currency string, at time.Time) (*ExchangeRate, error) {
+	if err := s.ValidateCurrency(currency); err != nil {
+		return nil, err
+	}
+	if currency == "USD" {
+		return usdExchangeRate, nil
+	}
+
+	rates, err := s.exchangeRates(ctx, at)
+	if errors.Is(err, data.ErrExchangeRatesNotFound) {
+		return nil, fmt.Errorf("%w: %s on %s", ErrNoExchangeRate, currency, at.UTC().Format(time.DateOnly))
+	}
+	if err != nil {
+		return nil, err
+	}
+	rate, ok := rates.Rates[currency]
+	if !ok || rate <= 0 {
+		return nil, fmt.Errorf("%w: %s on %s", ErrNoExchangeRate, currency, at.UTC().Format(time.DateOnly))
+	}
+	return &ExchangeRate{
+		Currency: currency,
+		Rate:     rate,
+		Day:      rates.Day.Format(time.DateOnly),
+		Source:   rates.Source,
+	}, nil
+}
+
+// exchangeRates gets the rates for at's UTC day, from the cache when it's fresh
+func (s *CurrencyService) exchangeRates(ctx context.Context, at time.Time) (*data.ExchangeRates, error) {
+	day := at.UTC().Format(time.DateOnly)
+	s.mu.Lock()
+	cached, ok := s.cache[day]
+	s.mu.Unlock()
+	if ok && time.Since(cached.cachedAt) < exchangeRateCacheTTL {
+		return cached.rates, nil
+	}
+
+	rates, err := s.firebaseService.GetExchangeRates(ctx, at)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.cache[day] = cachedExchangeRates{rates: rates, cachedAt: time.Now()}
+	s.mu.Unlock()
+	return rates, nil
+}
+
+// LatestRates returns the latest exchange rates fetched
+func (s *CurrencyService) LatestRates(ctx context.Context) (*data.ExchangeRates, error) {
+	return s.exchangeRates(ctx, time.Now())
+}
+
+// frankfurterRates is the latest rates as served by the Frankfurter API
+type frankfurterRates struct {
+	Base  string             `json:"base"`
+	Date  string             `json:"date"`
+	Rates map[string]float64 `json:"rates"`
+}
+
+// Refresh fetches the latest USD exchange rates of the configured currencies and stores them for
+// the day they were published for
+func (s *CurrencyService) Refresh(ctx context.Context) error {
+	if len(s.config.Currencies) == 0 {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.config.RatesURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create exchange rates request: %w", err)
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to get exchange rates: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("exchange rates source returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var latest frankfurterRates
+	if err := json.NewDecoder(resp.Body).Decode(&latest); err != nil {
+		return fmt.Errorf("failed to parse exchange rates: %w", err)
+	}
+	if latest.Base != "USD" {
+		return fmt.Errorf("exchange rates are against %q, not USD", latest.Base)
+	}
+	day, err := time.Parse(time.DateOnly, latest.Date)
+	if err != nil {
+		return fmt.Errorf("failed to parse exchange rates date: %w", err)
+	}
+
+	rates := &data.ExchangeRates{
+		Day:       day,
+		Rates:     make(map[string]float64, len(s.config.Currencies)),
+		Source:    s.config.RatesURL,
+		FetchedAt: time.Now(),
+	}
+	for _, currency := range s.config.Currencies {
+		rate, ok := latest.Rates[currency]
+		if !ok || rate <= 0 {
+			slog.Warn("Exchange rates source has no rate for currency", "currency", currency, "date", latest.Date)
+			continue
+		}
+		rates.Rates[currency] = rate
+	}
+	if err := s.firebaseService.SetExchangeRates(ctx, rates); err != nil {
+		return err
+	}
+
+	// Today's lookups fell back to an earlier day until now
+	s.mu.Lock()
+	clear(s.cache)
+	s.mu.Unlock()
+	return nil
+}
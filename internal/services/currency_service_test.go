@@ -0,0 +1,105 @@
+package services_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	apttesting "github.com/apt-router/api/internal/testing"
+	"github.com/apt-router/api/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCurrencyService(t *testing.T) {
+	store := apttesting.NewDatastore(t)
+	ctx := context.Background()
+	day := data.RollupBucket(data.RollupDaily, time.Now()).AddDate(0, 0, -1)
+
+	base := "USD"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]interface{}{
+			"amount": 1.0,
+			"base":   base,
+			"date":   day.Format(time.DateOnly),
+			"rates":  map[string]float64{"EUR": 0.92, "JPY": 150.5, "GBP": 0.79},
+		}))
+	}))
+	defer server.Close()
+
+	currency := services.NewCurrencyService(&utils.Config{
+		Currency: utils.CurrencyConfig{Currencies: []string{"EUR", "JPY", "CHF"}, RatesURL: server.URL},
+	}, store)
+	assert.Equal(t, []string{"USD", "EUR", "JPY", "CHF"}, currency.Supported())
+
+	// No rates have been fetched yet
+	_, err := currency.ExchangeRate(ctx, "EUR", time.Now())
+	assert.ErrorIs(t, err, services.ErrNoExchangeRate)
+
+	require.NoError(t, currency.Refresh(ctx))
+	stored, err := store.GetExchangeRates(ctx, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"EUR": 0.92, "JPY": 150.5}, stored.Rates, "only configured currencies are kept")
+
+	t.Run("ExchangeRate", func(t *testing.T) {
+		eur, err := currency.ExchangeRate(ctx, "EUR", time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, 0.92, eur.Rate)
+		assert.Equal(t, day.Format(time.DateOnly), eur.Day)
+		assert.Equal(t, "9.20", eur.Convert(10_000_000).String())
+		assert.Equal(t, "-0.01", eur.Convert(-5_500).String())
+
+		// Currencies without minor units are rounded to whole units
+		jpy, err := currency.ExchangeRate(ctx, "JPY", time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, "186", jpy.Convert(1_234_567).String())
+
+		usd, err := currency.ExchangeRate(ctx, "USD", time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, "12.35", usd.Convert(12_345_678).String())
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		_, err := currency.ExchangeRate(ctx, "GBP", time.Now())
+		assert.ErrorIs(t, err, services.ErrUnsupportedCurrency)
+
+		// The source had no CHF rate
+		_, err = currency.ExchangeRate(ctx, "CHF", time.Now())
+		assert.ErrorIs(t, err, services.ErrNoExchangeRate)
+
+		// Nor were any rates published before the day fetched
+		_, err = currency.ExchangeRate(ctx, "EUR", day.AddDate(0, 0, -1))
+		assert.ErrorIs(t, err, services.ErrNoExchangeRate)
+
+		base = "EUR"
+		assert.ErrorContains(t, currency.Refresh(ctx), "not USD")
+	})
+}
+
+func TestStatementConvert(t *testing.T) {
+	start := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	statement := &services.Statement{
+		Period:      "2025-03",
+		StartDate:   start,
+		EndDate:     start.AddDate(0, 1, 0),
+		LineItems:   []services.StatementLine{{ModelID: "gpt-4o", Spend: 2_000_000, Markup: 200_000}},
+		TotalSpend:  2_000_000,
+		TotalMarkup: 200_000,
+		Final:       true,
+		GeneratedAt: time.Now(),
+	}
+	assert.True(t, statement.RateTime().Equal(time.Date(2025, 3, 31, 0, 0, 0, 0, time.UTC)), "final statements use the period's last rate")
+
+	statement.Convert(&services.ExchangeRate{Currency: "EUR", Rate: 0.5, Day: "2025-03-31"})
+	assert.Equal(t, "1.00", statement.Converted["total_spend"].String())
+	assert.Equal(t, "0.10", statement.LineItems[0].Converted["markup"].String())
+
+	pdf := string(services.RenderStatementPDF(statement))
+	assert.Contains(t, pdf, "shown in EUR at 0.5 per USD, the rate of 2025-03-31")
+	assert.Contains(t, pdf, "EUR 1.00")
+}
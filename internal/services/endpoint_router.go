@@ -0,0 +1,264 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/utils"
+)
+
+// Endpoint health is tracked passively from the requests sent to each endpoint: after
+// endpointFailureThreshold consecutive failures an endpoint is taken out of rotation for
+// endpointCooldown, after which one request tries it again
+const (
+	endpointFailureThreshold = 3
+	endpointCooldown         = 30 * time.Second
+	// endpointLatencyWeight is the weight of each new sample in an endpoint's average latency
+	endpointLatencyWeight = 0.2
+	// maxStickyEndpoints is how many users' endpoints are remembered before expired ones are swept
+	maxStickyEndpoints = 10000
+)
+
+// EndpointRouter routes each provider's requests to the fastest of its healthy endpoints.
+// Providers without configured endpoints always use their default endpoint.
+type EndpointRouter struct {
+	stickiness time.Duration
+
+	mu        sync.Mutex
+	providers map[string][]*endpointState
+	// sticky is the endpoint each provider and user was last routed to, by provider and user ID
+	sticky map[string]stickyEndpoint
+}
+
+// endpointState is an endpoint's health and average latency
+type endpointState struct {
+	endpoint  utils.ProviderEndpoint
+	latency   time.Duration
+	requests  int64
+	errors    int64
+	failures  int
+	downUntil time.Time
+}
+
+// stickyEndpoint is the endpoint a user is kept on until the stickiness expires
+type stickyEndpoint struct {
+	name  string
+	until time.Time
+}
+
+// EndpointStatus reports an endpoint's health and average latency
+type EndpointStatus struct {
+	Provider            string     `json:"provider"`
+	Name                string     `json:"name"`
+	BaseURL             string     `json:"base_url,omitempty"`
+	Healthy             bool       `json:"healthy"`
+	LatencyMs           float64    `json:"latency_ms"`
+	Requests            int64      `json:"requests"`
+	Errors              int64      `json:"errors"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	DownUntil           *time.Time `json:"down_until,omitempty"`
+}
+
+// NewEndpointRouter creates a router over the configured endpoints. Each provider with endpoints
+// also keeps its default endpoint in rotation.
+func NewEndpointRouter(endpoints []utils.ProviderEndpoint, stickiness time.Duration) *EndpointRouter {
+	providers := make(map[string][]*endpointState)
+	for _, endpoint := range endpoints {
+		if len(providers[endpoint.Provider]) == 0 {
+			providers[endpoint.Provider] = []*endpointState{{
+				endpoint: utils.ProviderEndpoint{Name: utils.DefaultEndpointName, Provider: endpoint.Provider},
+			}}
+		}
+		providers[endpoint.Provider] = append(providers[endpoint.Provider], &endpointState{endpoint: endpoint})
+	}
+
+	return &EndpointRouter{
+		stickiness: stickiness,
+		providers:  providers,
+		sticky:     make(map[string]stickyEndpoint),
+	}
+}
+
+// Select returns the endpoint to send a user's request to: the endpoint the user is stuck to while
+// it stays healthy, otherwise an endpoint that has not been measured yet, otherwise the healthy
+// endpoint with the lowest average latency. When every endpoint is down, the one due back soonest
+// is tried. It returns nil for providers without configured endpoints.
+func (r *EndpointRouter) Select(provider, userID string) *utils.ProviderEndpoint {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	states := r.providers[provider]
+	if len(states) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	var healthy []*endpointState
+	for _, state := range states {
+		if !now.Before(state.downUntil) {
+			healthy = append(healthy, state)
+		}
+	}
+
+	var selected *endpointState
+	stickyKey := provider + ":" + userID
+	if len(healthy) == 0 {
+		selected = states[0]
+		for _, state := range states[1:] {
+			if state.downUntil.Before(selected.downUntil) {
+				selected = state
+			}
+		}
+	} else if sticky, ok := r.sticky[stickyKey]; ok && r.stickiness > 0 && now.Before(sticky.until) {
+		for _, state := range healthy {
+			if state.endpoint.Name == sticky.name {
+				selected = state
+				break
+			}
+		}
+	}
+	if selected == nil {
+		for _, state := range healthy {
+			if state.requests == 0 {
+				selected = state
+				break
+			}
+			if selected == nil || state.latency < selected.latency {
+				selected = state
+			}
+		}
+	}
+
+	if r.stickiness > 0 {
+		if len(r.sticky) >= maxStickyEndpoints {
+			for key, sticky := range r.sticky {
+				if !now.Before(sticky.until) {
+					delete(r.sticky, key)
+				}
+			}
+		}
+		r.sticky[stickyKey] = stickyEndpoint{name: selected.endpoint.Name, until: now.Add(r.stickiness)}
+	}
+	endpoint := selected.endpoint
+	return &endpoint
+}
+
+// Report records the outcome of a request sent to an endpoint. Only failures that suggest the
+// endpoint is unavailable count against its health: timeouts, transport errors and retryable
+// provider errors, but not invalid requests or callers going away.
+func (r *EndpointRouter) Report(ctx context.Context, provider, name string, latency time.Duration, err error) {
+	if r == nil || errors.Is(ctx.Err(), context.Canceled) {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, state := range r.providers[provider] {
+		if state.endpoint.Name != name {
+			continue
+		}
+
+		state.requests++
+		if err != nil {
+			var providerErr *data.ProviderError
+			if errors.As(err, &providerErr) && !providerErr.Retryable {
+				return
+			}
+			state.errors++
+			state.failures++
+			if state.failures >= endpointFailureThreshold {
+				state.downUntil = time.Now().Add(endpointCooldown)
+			}
+			return
+		}
+
+		state.failures = 0
+		state.downUntil = time.Time{}
+		if state.latency == 0 {
+			state.latency = latency
+		} else {
+			state.latency += time.Duration(endpointLatencyWeight * float64(latency-state.latency))
+		}
+		return
+	}
+}
+
+// Status reports the health and latency of every configured endpoint
+func (r *EndpointRouter) Status() []EndpointStatus {
+	statuses := []EndpointStatus{}
+	if r == nil {
+		return statuses
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for provider, states := range r.providers {
+		for _, state := range states {
+			status := EndpointStatus{
+				Provider:            provider,
+				Name:                state.endpoint.Name,
+				BaseURL:             state.endpoint.BaseURL,
+				Healthy:             !now.Before(state.downUntil),
+				LatencyMs:           float64(state.latency) / float64(time.Millisecond),
+				Requests:            state.requests,
+				Errors:              state.errors,
+				ConsecutiveFailures: state.failures,
+			}
+			if !status.Healthy {
+				downUntil := state.downUntil
+				status.DownUntil = &downUntil
+			}
+			statuses = append(statuses, status)
+		}
+	}
+	sort.SliceStable(statuses, func(i, j int) bool { return statuses[i].Provider < statuses[j].Provider })
+	return statuses
+}
+
+// endpointClient reports the latency and outcome of each call to the endpoint it was created
+// for, and records the endpoint in the response metadata
+type endpointClient struct {
+	data.LLMClient
+	router   *EndpointRouter
+	provider string
+	endpoint string
+}
+
+func (c *endpointClient) GenerateWithParams(ctx context.Context, params map[string]interface{}) (*data.GenerateResponse, error) {
+	start := time.Now()
+	resp, err := c.LLMClient.GenerateWithParams(ctx, params)
+	c.router.Report(ctx, c.provider, c.endpoint, time.Since(start), err)
+	if resp != nil {
+		if resp.Metadata == nil {
+			resp.Metadata = make(map[string]string)
+		}
+		resp.Metadata["endpoint"] = c.endpoint
+	}
+	return resp, err
+}
+
+// GenerateStream measures the time until the stream opens, since a stream's length depends on
+// the completion rather than the endpoint
+func (c *endpointClient) GenerateStream(ctx context.Context, params map[string]interface{}) (*data.StreamResponse, error) {
+	start := time.Now()
+	stream, err := c.LLMClient.GenerateStream(ctx, params)
+	c.router.Report(ctx, c.provider, c.endpoint, time.Since(start), err)
+	if stream != nil {
+		if stream.Metadata == nil {
+			stream.Metadata = make(map[string]string)
+		}
+		stream.Metadata["endpoint"] = c.endpoint
+	}
+	return stream, err
+}
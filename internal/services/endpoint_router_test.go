@@ -0,0 +1,96 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEndpointRouter(t *testing.T) {
+	ctx := context.Background()
+	router := NewEndpointRouter([]utils.ProviderEndpoint{
+		{Name: "azure-eastus", Provider: "openai", BaseURL: "https://eastus.example.com/openai/v1/", AuthHeader: "api-key"},
+	}, 0)
+
+	assert.Nil(t, router.Select("anthropic", "user-1"), "providers without endpoints use their default")
+
+	// Unmeasured endpoints are tried first, then the fastest is preferred
+	assert.Equal(t, utils.DefaultEndpointName, router.Select("openai", "user-1").Name)
+	router.Report(ctx, "openai", utils.DefaultEndpointName, 300*time.Millisecond, nil)
+	assert.Equal(t, "azure-eastus", router.Select("openai", "user-1").Name)
+	router.Report(ctx, "openai", "azure-eastus", 100*time.Millisecond, nil)
+	assert.Equal(t, "azure-eastus", router.Select("openai", "user-1").Name)
+
+	// Invalid requests say nothing about an endpoint's health
+	router.Report(ctx, "openai", "azure-eastus", time.Millisecond, &data.ProviderError{Provider: "openai", Message: "bad request"})
+	assert.Equal(t, "azure-eastus", router.Select("openai", "user-1").Name)
+
+	// Repeated failures take an endpoint out of rotation
+	for range endpointFailureThreshold {
+		router.Report(ctx, "openai", "azure-eastus", time.Second, errors.New("connection reset"))
+	}
+	assert.Equal(t, utils.DefaultEndpointName, router.Select("openai", "user-1").Name)
+
+	statuses := router.Status()
+	require.Len(t, statuses, 2)
+	for _, status := range statuses {
+		if status.Name == "azure-eastus" {
+			assert.False(t, status.Healthy)
+			assert.Equal(t, int64(3), status.Errors)
+			assert.NotNil(t, status.DownUntil)
+		} else {
+			assert.True(t, status.Healthy)
+			assert.Equal(t, 300.0, status.LatencyMs)
+		}
+	}
+}
+
+func TestEndpointRouterStickiness(t *testing.T) {
+	ctx := context.Background()
+	router := NewEndpointRouter([]utils.ProviderEndpoint{
+		{Name: "eu", Provider: "anthropic", BaseURL: "https://eu.example.com"},
+	}, time.Hour)
+	router.Report(ctx, "anthropic", utils.DefaultEndpointName, 300*time.Millisecond, nil)
+
+	// A user stays on their endpoint even once another becomes faster
+	assert.Equal(t, "eu", router.Select("anthropic", "user-1").Name)
+	router.Report(ctx, "anthropic", "eu", 500*time.Millisecond, nil)
+	assert.Equal(t, "eu", router.Select("anthropic", "user-1").Name)
+	assert.Equal(t, utils.DefaultEndpointName, router.Select("anthropic", "user-2").Name)
+}
+
+func TestProviderNetworkBaseURL(t *testing.T) {
+	var paths []string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"chatcmpl-1","object":"chat.completion","model":"gpt-4o","choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":"hello"}}],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`)
+	}))
+	defer gateway.Close()
+
+	data.SetProviderNetwork("openai", data.ProviderNetwork{BaseURL: gateway.URL + "/openai/v1/"})
+	defer data.SetProviderNetwork("openai", data.ProviderNetwork{})
+
+	require.NoError(t, data.CheckProviderConnectivity(context.Background(), "openai"))
+
+	client, err := data.NewClientForModel("gpt-4o", "openai", "sk-test")
+	require.NoError(t, err)
+	resp, err := client.GenerateWithParams(context.Background(), map[string]interface{}{"prompt": "hi"})
+	require.NoError(t, err)
+	assert.Equal(t, "hello", resp.Text)
+	assert.Equal(t, []string{"/openai/v1/", "/openai/v1/chat/completions"}, paths)
+
+	// A proxy nobody listens on makes the provider unreachable
+	data.SetProviderNetwork("openai", data.ProviderNetwork{Proxy: &url.URL{Scheme: "http", Host: "127.0.0.1:1"}})
+	assert.Error(t, data.CheckProviderConnectivity(context.Background(), "openai"))
+}
@@ -0,0 +1,294 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+)
+
+var (
+	// ErrExperimentNotFound is returned when an experiment does not exist
+	ErrExperimentNotFound = errors.New("experiment not found")
+	// ErrInvalidExperiment is returned when an experiment's settings are invalid
+	ErrInvalidExperiment = errors.New("invalid experiment")
+)
+
+// experimentRefreshInterval bounds how stale the active experiments used for assignment can be
+const experimentRefreshInterval = time.Minute
+
+// ExperimentAssignment is the experiment variant a request was assigned to
+type ExperimentAssignment struct {
+	ExperimentID string
+	Variant      string
+	// Overrides is the treatment configuration; it is empty for the control group
+	Overrides data.ExperimentVariant
+	// Shadow is the experiment's shadow traffic, if any, which applies to both variants
+	Shadow *data.ShadowTraffic
+}
+
+// ExperimentService manages A/B experiments and assigns requests to their variants
+type ExperimentService struct {
+	firebaseService *data.Service
+	pricingService  *PricingService
+
+	mu       sync.RWMutex
+	active   []*data.Experiment
+	loadedAt time.Time
+	// shadowSpend tracks each active experiment's shadow spend between reloads, so mirroring
+	// stops as soon as a budget is spent
+	shadowSpend map[string]data.MicroUSD
+}
+
+// NewExperimentService creates a new experiment service
+func NewExperimentService(firebaseService *data.Service, pricingService *PricingService) *ExperimentService {
+	return &ExperimentService{
+		firebaseService: firebaseService,
+		pricingService:  pricingService,
+	}
+}
+
+// Assign returns the variant of the first active experiment matching the request, or nil.
+// Users are assigned by a hash of the experiment and user IDs, so they stay in the same variant.
+func (s *ExperimentService) Assign(ctx context.Context, requestCtx *RequestContext) *ExperimentAssignment {
+	if s == nil || s.firebaseService == nil || s.firebaseService.DB() == nil {
+		return nil
+	}
+
+	experiments, err := s.activeExperiments(ctx)
+	if err != nil {
+		// Experiments never fail a request; the request simply runs with the defaults
+		requestCtx.Logger.Warn("Failed to load experiments", "error", err)
+		return nil
+	}
+
+	for _, experiment := range experiments {
+		if len(experiment.TierIDs) > 0 && !slices.Contains(experiment.TierIDs, requestCtx.PricingTier.ID) {
+			continue
+		}
+		if len(experiment.UserIDs) > 0 && !slices.Contains(experiment.UserIDs, requestCtx.UserID) {
+			continue
+		}
+
+		if experimentBucket(experiment.ID, requestCtx.UserID) < experiment.TreatmentPercent {
+			return &ExperimentAssignment{
+				ExperimentID: experiment.ID,
+				Variant:      data.ExperimentVariantTreatment,
+				Overrides:    experiment.Treatment,
+				Shadow:       experiment.Shadow,
+			}
+		}
+		return &ExperimentAssignment{
+			ExperimentID: experiment.ID,
+			Variant:      data.ExperimentVariantControl,
+			Shadow:       experiment.Shadow,
+		}
+	}
+
+	return nil
+}
+
+// experimentBucket maps a user to a stable point in [0, 100) for an experiment
+func experimentBucket(experimentID, userID string) float64 {
+	h := fnv.New32a()
+	h.Write([]byte(experimentID + ":" + userID))
+	return float64(h.Sum32()%10000) / 100
+}
+
+// activeExperiments returns the active experiments, reloading them once they are stale
+func (s *ExperimentService) activeExperiments(ctx context.Context) ([]*data.Experiment, error) {
+	s.mu.RLock()
+	experiments, loadedAt := s.active, s.loadedAt
+	s.mu.RUnlock()
+	if time.Since(loadedAt) < experimentRefreshInterval {
+		return experiments, nil
+	}
+
+	experiments, err := s.firebaseService.ListExperiments(ctx, data.ExperimentStatusActive)
+	if err != nil {
+		return nil, err
+	}
+
+	shadowSpend := make(map[string]data.MicroUSD)
+	for _, experiment := range experiments {
+		if experiment.Shadow != nil {
+			shadowSpend[experiment.ID] = experiment.ShadowSpend
+		}
+	}
+
+	s.mu.Lock()
+	s.active = experiments
+	s.loadedAt = time.Now()
+	s.shadowSpend = shadowSpend
+	s.mu.Unlock()
+
+	return experiments, nil
+}
+
+// SampleShadow reports whether a request assigned to an experiment should be mirrored to its
+// shadow model: a random Percent of requests are, until the experiment's shadow budget is spent
+func (s *ExperimentService) SampleShadow(assignment *ExperimentAssignment) bool {
+	if s == nil || assignment == nil || assignment.Shadow == nil {
+		return false
+	}
+
+	s.mu.RLock()
+	spent := s.shadowSpend[assignment.ExperimentID]
+	s.mu.RUnlock()
+	if spent >= assignment.Shadow.Budget {
+		return false
+	}
+
+	return rand.Float64()*100 < assignment.Shadow.Percent
+}
+
+// RecordShadow stores the result of a mirrored request and charges it to the experiment's budget
+func (s *ExperimentService) RecordShadow(ctx context.Context, result *data.ShadowResult) error {
+	if err := s.firebaseService.RecordShadowResult(ctx, result); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.shadowSpend != nil {
+		s.shadowSpend[result.ExperimentID] += result.ShadowCost
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// ShadowResults lists up to limit of an experiment's shadow results over a date range
+func (s *ExperimentService) ShadowResults(ctx context.Context, experimentID string, startDate, endDate time.Time, limit int) ([]*data.ShadowResult, error) {
+	results, err := s.firebaseService.ListShadowResults(ctx, experimentID, startDate, endDate, limit)
+	if err != nil {
+		return nil, err
+	}
+	if results == nil {
+		results = []*data.ShadowResult{}
+	}
+	return results, nil
+}
+
+// reload forces the next assignment to reload the active experiments
+func (s *ExperimentService) reload() {
+	s.mu.Lock()
+	s.loadedAt = time.Time{}
+	s.mu.Unlock()
+}
+
+// List lists experiments, optionally only those with the given status
+func (s *ExperimentService) List(ctx context.Context, status string) ([]*data.Experiment, error) {
+	experiments, err := s.firebaseService.ListExperiments(ctx, status)
+	if err != nil {
+		return nil, err
+	}
+	if experiments == nil {
+		experiments = []*data.Experiment{}
+	}
+	return experiments, nil
+}
+
+// Get gets an experiment
+func (s *ExperimentService) Get(ctx context.Context, experimentID string) (*data.Experiment, error) {
+	experiment, err := s.firebaseService.GetExperiment(ctx, experimentID)
+	if err != nil {
+		return nil, err
+	}
+	if experiment == nil {
+		return nil, ErrExperimentNotFound
+	}
+	return experiment, nil
+}
+
+// Create validates and stores a new experiment
+func (s *ExperimentService) Create(ctx context.Context, experiment *data.Experiment) error {
+	if experiment.Status == "" {
+		experiment.Status = data.ExperimentStatusActive
+	}
+	if err := s.validate(experiment); err != nil {
+		return err
+	}
+
+	if err := s.firebaseService.CreateExperiment(ctx, experiment); err != nil {
+		return err
+	}
+	s.reload()
+	return nil
+}
+
+// Update validates and replaces an existing experiment
+func (s *ExperimentService) Update(ctx context.Context, experiment *data.Experiment) error {
+	current, err := s.Get(ctx, experiment.ID)
+	if err != nil {
+		return err
+	}
+	if err := s.validate(experiment); err != nil {
+		return err
+	}
+
+	experiment.CreatedBy = current.CreatedBy
+	experiment.CreatedAt = current.CreatedAt
+	experiment.ShadowSpend = current.ShadowSpend
+	if err := s.firebaseService.UpdateExperiment(ctx, experiment); err != nil {
+		return err
+	}
+	s.reload()
+	return nil
+}
+
+// Results compares an experiment's variants over a date range
+func (s *ExperimentService) Results(ctx context.Context, experimentID string, startDate, endDate time.Time) ([]data.ExperimentVariantResult, error) {
+	if _, err := s.Get(ctx, experimentID); err != nil {
+		return nil, err
+	}
+	return s.firebaseService.GetExperimentResults(ctx, experimentID, startDate, endDate)
+}
+
+// validate checks an experiment's settings
+func (s *ExperimentService) validate(experiment *data.Experiment) error {
+	switch experiment.Status {
+	case data.ExperimentStatusActive, data.ExperimentStatusPaused, data.ExperimentStatusCompleted:
+	default:
+		return fmt.Errorf("%w: status must be active, paused or completed", ErrInvalidExperiment)
+	}
+
+	if experiment.TreatmentPercent < 0 || experiment.TreatmentPercent > 100 {
+		return fmt.Errorf("%w: treatment_percent must be between 0 and 100", ErrInvalidExperiment)
+	}
+
+	switch experiment.Treatment.OptimizationMode {
+	case "", "context", "efficiency":
+	default:
+		return fmt.Errorf("%w: optimization_mode must be context or efficiency", ErrInvalidExperiment)
+	}
+
+	if model := experiment.Treatment.Model; model != "" {
+		if _, err := s.pricingService.GetModelConfig(model); err != nil {
+			return fmt.Errorf("%w: unknown model %s", ErrInvalidExperiment, model)
+		}
+	}
+
+	// An experiment that only mirrors traffic needs no treatment
+	if experiment.Treatment == (data.ExperimentVariant{}) && experiment.Shadow == nil {
+		return fmt.Errorf("%w: treatment must change at least one setting", ErrInvalidExperiment)
+	}
+
+	if shadow := experiment.Shadow; shadow != nil {
+		if _, err := s.pricingService.GetModelConfig(shadow.Model); err != nil {
+			return fmt.Errorf("%w: unknown shadow model %s", ErrInvalidExperiment, shadow.Model)
+		}
+		if shadow.Percent <= 0 || shadow.Percent > 100 {
+			return fmt.Errorf("%w: shadow percent must be greater than 0 and at most 100", ErrInvalidExperiment)
+		}
+		if shadow.Budget <= 0 {
+			return fmt.Errorf("%w: shadow budget must be positive", ErrInvalidExperiment)
+		}
+	}
+
+	return nil
+}
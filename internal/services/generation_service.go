@@ -2,87 +2,326 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/apt-router/api/internal/data"
 	"github.com/apt-router/api/internal/utils"
 	"github.com/google/uuid"
-	"github.com/patrickmn/go-cache"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// tracer creates spans for the service layer
+var tracer = otel.Tracer("github.com/apt-router/api/internal/services")
+
+// recordSpanError marks a span as failed with the given error
+func recordSpanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// providerSpanAttributes describes the provider call made for a model
+func providerSpanAttributes(modelConfig ModelConfig, req *GenerationRequest) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("gen_ai.system", modelConfig.Provider),
+		attribute.String("gen_ai.request.model", modelConfig.ModelID),
+		attribute.Int("gen_ai.request.max_tokens", req.MaxTokens),
+	}
+}
+
 // RequestContext contains request-scoped data (shared with handlers)
 type RequestContext struct {
 	RequestID   string
 	UserID      string
+	OrgID       string
 	APIKeyID    string
 	PricingTier PricingTier
-	Logger      *slog.Logger
+	// Priority is the request's priority class; empty is normal
+	Priority string
+	// ClientIP and UserAgent identify the caller for request logs
+	ClientIP  string
+	UserAgent string
+	// Restrictions limits the models and token counts the API key may use
+	Restrictions *data.KeyRestrictions
+	// PostProcessing transforms the API key's completions before they are returned
+	PostProcessing *data.PostProcessing
+	// Tenant is the tenant the API key is bound to, or nil
+	Tenant *data.Tenant
+	// TestMode is set for test API keys, whose requests a fake provider answers for free
+	TestMode bool
+	Logger   *slog.Logger
 	// Cached user data for performance
 	CachedUser *CachedUserData
 }
 
 // CachedUserData contains frequently accessed user information
 type CachedUserData struct {
-	ID            string    `json:"id"`
-	Email         string    `json:"email"`
-	Balance       float64   `json:"balance"`
-	TierID        string    `json:"tier_id"`
-	IsActive      bool      `json:"is_active"`
-	CustomPricing bool      `json:"custom_pricing"`
-	LastUpdated   time.Time `json:"last_updated"`
+	ID            string        `json:"id"`
+	Email         string        `json:"email"`
+	Balance       data.MicroUSD `json:"balance"`
+	TierID        string        `json:"tier_id"`
+	IsActive      bool          `json:"is_active"`
+	CustomPricing bool          `json:"custom_pricing"`
+	LastUpdated   time.Time     `json:"last_updated"`
+	// Credits is the user's unexpired promotional credit when the data was cached
+	Credits data.MicroUSD `json:"credits"`
+	// UserType is data.UserTypeServiceAccount for service accounts
+	UserType string `json:"user_type,omitempty"`
+}
+
+// UserType returns the type of the request's user, empty for people
+func (r *RequestContext) UserType() string {
+	if r.CachedUser == nil {
+		return ""
+	}
+	return r.CachedUser.UserType
+}
+
+// ModelPricing returns the prices and markups the request's pricing tier applies to a model
+func (r *RequestContext) ModelPricing(modelConfig ModelConfig) data.AppliedPricing {
+	customPricing := r.CachedUser != nil && r.CachedUser.CustomPricing
+	return r.PricingTier.PricingFor(modelConfig, UsesCustomPricing(r.OrgID, r.Tenant, customPricing))
+}
+
+// ErrKeyRestricted is returned when a request uses a model or provider the API key may not use
+var ErrKeyRestricted = errors.New("request not allowed for this API key")
+
+// ErrProviderTimeout is returned when a provider call does not finish within its timeout
+var ErrProviderTimeout = errors.New("provider request timed out")
+
+// RequestErrorDetail describes why a generation failed, for its request log
+func RequestErrorDetail(err error) *data.ErrorDetail {
+	var providerErr *data.ProviderError
+	switch {
+	case errors.As(err, &providerErr):
+		detail := &data.ErrorDetail{
+			Code:       providerErr.ErrorCode,
+			StatusCode: providerErr.StatusCode,
+			Provider:   providerErr.Provider,
+			Retryable:  providerErr.Retryable,
+		}
+		if detail.Code == "" {
+			detail.Code = "provider_error"
+		}
+		return detail
+	case errors.Is(err, ErrProviderTimeout):
+		return &data.ErrorDetail{Code: "timeout", Retryable: true}
+	default:
+		return &data.ErrorDetail{Code: "internal"}
+	}
+}
+
+// ModelCatalog looks up model configurations and resolves model aliases. PricingService
+// implements it; tests substitute a fixed catalog.
+type ModelCatalog interface {
+	// GetModelConfig returns the configuration of an active model
+	GetModelConfig(modelID string) (ModelConfig, error)
+
+	// ResolveModel returns the model ID a model name or alias refers to for an organization
+	ResolveModel(ctx context.Context, orgID, model string) (string, error)
 }
 
+// UsageStore is the storage generation needs to log requests, check the balances of the accounts
+// they are billed to and record their quality evaluations. data.Service implements it.
+type UsageStore interface {
+	LogRequest(ctx context.Context, log *data.RequestLog) error
+	GetUserByID(ctx context.Context, userID string) (*data.User, error)
+	GetOrganization(ctx context.Context, orgID string) (*data.Organization, error)
+	CreateQualityEvaluation(ctx context.Context, evaluation *data.QualityEvaluation) error
+}
+
+// ClientFactory creates the LLM client for a provider's model using the given provider API key.
+// endpoint is nil for the provider's default endpoint.
+type ClientFactory func(modelID, provider, apiKey string, endpoint *data.Endpoint) (data.LLMClient, error)
+
 // GenerationService handles the business logic for text generation
 type GenerationService struct {
-	config          *utils.Config
-	firebaseService *data.Service
-	cache           *cache.Cache
-	pricingService  *PricingService
-	optimizer       *Optimizer
+	config         *utils.Config
+	usageStore     UsageStore
+	cache          Cache
+	modelCatalog   ModelCatalog
+	clientFactory  ClientFactory
+	billingService *BillingService
+	providerKeys   *ProviderKeyService
+	moderation     *ModerationService
+	systemPrompts  *SystemPromptService
+	templates      *TemplateService
+	experiments    *ExperimentService
+	routing        *RoutingService
+	optimizer      *Optimizer
+	providerLimits *ProviderLimiter
+	tokenizers     *TokenizerRegistry
+	endpoints      *EndpointRouter
+	keyPool        *ProviderKeyPool
+	streamMetrics  *streamMetrics
+	// faults injects configured faults into provider calls; nil when fault injection is disabled
+	faults *FaultInjector
+
+	// optimizers holds the alternate optimizer models experiments use, by model
+	optimizersMu sync.Mutex
+	optimizers   map[string]*Optimizer
+
+	// holds are the estimated costs of in-flight requests, held against their accounts' balances
+	holds balanceHolds
 }
 
 // NewGenerationService creates a new generation service
 func NewGenerationService(
 	cfg *utils.Config,
-	firebaseService *data.Service,
-	cache *cache.Cache,
-	pricingService *PricingService,
+	usageStore UsageStore,
+	cache Cache,
+	modelCatalog ModelCatalog,
+	billingService *BillingService,
+	providerKeys *ProviderKeyService,
+	systemPrompts *SystemPromptService,
+	templates *TemplateService,
+	experiments *ExperimentService,
+	routing *RoutingService,
 ) *GenerationService {
-	// Initialize optimizer with Gemma model
-	optimizer, err := NewOptimizer("gemma-3-27b-it", cfg.LLM.GoogleAPIKey)
-	if err != nil {
-		slog.Error("Failed to initialize optimizer", "error", err)
-		// Continue without optimizer if it fails
-		optimizer = nil
+	// Initialize optimizer with Gemma model; development mode makes no provider calls, so has none
+	var optimizer *Optimizer
+	if !cfg.Dev.Enabled {
+		var err error
+		optimizer, err = NewOptimizer(defaultOptimizerModel, cfg.LLM.GoogleAPIKey)
+		if err != nil {
+			slog.Error("Failed to initialize optimizer", "error", err)
+			// Continue without optimizer if it fails
+			optimizer = nil
+		}
+	}
+
+	s := &GenerationService{
+		config:         cfg,
+		usageStore:     usageStore,
+		cache:          cache,
+		modelCatalog:   modelCatalog,
+		clientFactory:  data.NewClientForEndpoint,
+		billingService: billingService,
+		providerKeys:   providerKeys,
+		moderation:     NewModerationService(cfg),
+		systemPrompts:  systemPrompts,
+		templates:      templates,
+		experiments:    experiments,
+		routing:        routing,
+		optimizer:      optimizer,
+		providerLimits: NewProviderLimiter(cfg.RateLimit),
+		tokenizers:     NewTokenizerRegistry(),
+		streamMetrics:  newStreamMetrics(),
+		optimizers:     make(map[string]*Optimizer),
+		keyPool:        NewProviderKeyPool(cfg),
+		faults:         NewFaultInjector(cfg),
 	}
 
-	return &GenerationService{
-		config:          cfg,
-		firebaseService: firebaseService,
-		cache:           cache,
-		pricingService:  pricingService,
-		optimizer:       optimizer,
+	endpoints, err := cfg.LLM.ProviderEndpoints()
+	if err != nil {
+		slog.Warn("Ignoring invalid provider endpoints", "error", err)
+	}
+	s.endpoints = NewEndpointRouter(endpoints, cfg.LLM.EndpointStickiness)
+
+	// Count Anthropic and Gemini prompts with the providers' own endpoints when configured; OpenAI
+	// has no such endpoint, so its models keep their local estimators
+	if cfg.LLM.TokenCounting == "provider" && !cfg.Dev.Enabled {
+		for _, provider := range []string{"anthropic", "google"} {
+			s.tokenizers.RegisterProvider(provider, &providerTokenizer{
+				provider: provider,
+				newClient: func(modelID string) (data.LLMClient, error) {
+					return s.clientFactory(modelID, provider, cfg.ProviderKey(provider), nil)
+				},
+				timeout: 5 * time.Second,
+			})
+		}
 	}
+	return s
+}
+
+// SetClientFactory replaces the function that creates provider clients, so tests can serve
+// generations from fakes. Development mode uses its own fake client regardless.
+func (s *GenerationService) SetClientFactory(factory ClientFactory) {
+	s.clientFactory = factory
+}
+
+// Tokenizers returns the registry that counts prompt tokens for each model
+func (s *GenerationService) Tokenizers() *TokenizerRegistry {
+	return s.tokenizers
 }
 
 // GenerationRequest represents a text generation request
 type GenerationRequest struct {
-	Model            string                 `json:"model"`
-	Prompt           string                 `json:"prompt"`
-	MaxTokens        int                    `json:"max_tokens"`
-	Temperature      float64                `json:"temperature"`
-	TopP             float64                `json:"top_p"`
+	Model     string `json:"model"`
+	Prompt    string `json:"prompt"`
+	MaxTokens int    `json:"max_tokens"`
+	// Sampling parameters are nil when unset, so explicit zeros reach the provider
+	Temperature      *float64 `json:"temperature,omitempty"`
+	TopP             *float64 `json:"top_p,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	// Seed requests deterministic sampling where the provider supports it
+	Seed             *int64                 `json:"seed,omitempty"`
 	Stream           bool                   `json:"stream"`
 	Extra            map[string]interface{} `json:"extra,omitempty"`
 	OpenAIAPIKey     string                 `json:"openai_api_key,omitempty"`
 	AnthropicAPIKey  string                 `json:"anthropic_api_key,omitempty"`
 	GoogleAPIKey     string                 `json:"google_api_key,omitempty"`
 	OptimizationMode string                 `json:"optimization_mode,omitempty"`
+	// DisableOptimization sends the prompt to the provider as written
+	DisableOptimization bool `json:"disable_optimization,omitempty"`
+	// DisableRuleOptimization skips rule-based prompt rewriting; AI optimization still applies
+	DisableRuleOptimization bool `json:"disable_rule_optimization,omitempty"`
+	// TemplateID renders the prompt from a stored template with Variables instead of using Prompt.
+	// TemplateVersion pins a version; 0 uses the current version and is set to the version rendered.
+	TemplateID      string            `json:"template_id,omitempty"`
+	TemplateVersion int               `json:"template_version,omitempty"`
+	Variables       map[string]string `json:"variables,omitempty"`
+	// Experiment is the experiment variant the request was assigned to, if any
+	Experiment *ExperimentAssignment `json:"-"`
+	// Routing is how the routing rules evaluated the request, if any are enabled
+	Routing *data.RoutingDecision `json:"-"`
+	// Timeout overrides the model's provider timeout; 0 uses the model or global default
+	Timeout time.Duration `json:"-"`
+	// RequestedModel is the model name the caller sent when Model was resolved from an alias
+	RequestedModel string `json:"-"`
+	// BYOK is set when the provider is called with the caller's own key, supplied or stored
+	BYOK bool `json:"-"`
+	// System holds the managed system prompts for the caller's organization and key, sent as
+	// system instructions; SystemPrompts records which versions were applied
+	System        string                 `json:"-"`
+	SystemPrompts []data.SystemPromptRef `json:"-"`
+	// Logprobs requests the log probability of each generated token, and TopLogprobs the number of
+	// most likely alternatives at each position, where the provider supports them
+	Logprobs    bool `json:"logprobs,omitempty"`
+	TopLogprobs *int `json:"top_logprobs,omitempty"`
+	// CacheSystem and CachePrompt write the system instructions, or everything up to the end of
+	// the prompt, to the provider's prompt cache where caching has to be requested (Anthropic)
+	CacheSystem bool `json:"cache_system,omitempty"`
+	CachePrompt bool `json:"cache_prompt,omitempty"`
+	// ReasoningEffort (low, medium or high) and ThinkingBudget, the most tokens to spend thinking,
+	// control reasoning models. OpenAI takes the effort; Anthropic and Google take a budget, which
+	// the effort stands for when none is given.
+	ReasoningEffort string `json:"reasoning_effort,omitempty"`
+	ThinkingBudget  int    `json:"thinking_budget,omitempty"`
+	// Shadow is set when replaying a logged request or mirroring one to an experiment's shadow
+	// model; shadow requests always run on the platform's provider keys, never the caller's stored
+	// keys, and are neither assigned to experiments nor routed by routing rules
+	Shadow bool `json:"-"`
+	// Conversation is the conversation Prompt and the system instructions in Extra were built from,
+	// set when the caller asked for it to be compressed to fit the model's context window rather
+	// than the request being rejected
+	Conversation *Conversation `json:"-"`
+	// ContextCompression is how the conversation in Prompt was compressed to fit its context, if
+	// it had to be; its cost is charged with the request
+	ContextCompression *ContextCompression `json:"-"`
 }
 
 // GenerationResponse represents a text generation response
@@ -95,6 +334,8 @@ type GenerationResponse struct {
 	FinishReason string                 `json:"finish_reason,omitempty"`
 	CreatedAt    int64                  `json:"created_at"`
 	Metadata     map[string]interface{} `json:"metadata,omitempty"`
+	// Logprobs holds the generated tokens' log probabilities when they were requested
+	Logprobs []data.TokenLogprob `json:"logprobs,omitempty"`
 }
 
 // ServiceUsageInfo contains token usage information for the service layer
@@ -102,6 +343,8 @@ type ServiceUsageInfo struct {
 	InputTokens  int `json:"input_tokens"`
 	OutputTokens int `json:"output_tokens"`
 	TotalTokens  int `json:"total_tokens"`
+	// Details are the cached input and reasoning output tokens included in the counts above
+	Details data.TokenDetails `json:"-"`
 }
 
 // GenerationResult contains the result of a generation request
@@ -112,51 +355,264 @@ type GenerationResult struct {
 	FallbackReason             string
 	PromptOptimizationResult   *OptimizationResult
 	ResponseOptimizationResult *OptimizationResult
+	// Moderation is nil unless the pricing tier moderates requests. When it is Blocked, the
+	// completion was generated and billed but must not be returned.
+	Moderation *data.ModerationRecord
+	// Payload is the request as the caller sent it and its completion, when payload logging is enabled
+	Payload *data.RequestPayload
+	// Cost is the billable cost of the generation, priced as streams are; the caller charges it
+	Cost data.CostBreakdown
+	// BalanceHold is the generation's estimated cost, still held against its account so nothing
+	// else can spend it before Cost is charged. The caller releases it once it has charged Cost.
+	BalanceHold *BalanceHold
+}
+
+// CostEstimate holds the token counts a request is expected to use, computed without calling a provider
+type CostEstimate struct {
+	Model           string
+	RequestedModel  string
+	Provider        string
+	InputTokens     int
+	MaxOutputTokens int
+	// BYOK is set when the user has stored their own key for the provider, so generation would
+	// be charged only the platform's share
+	BYOK bool
 }
 
 // EnhancedStreamReader wraps the original stream to track tokens and usage
 type EnhancedStreamReader struct {
-	OriginalStream           io.ReadCloser
-	ModelConfig              ModelConfig
-	RequestCtx               *RequestContext
-	InputTokens              int
-	OutputTokens             int
-	AccumulatedContent       strings.Builder
+	OriginalStream io.ReadCloser
+	ModelConfig    ModelConfig
+	RequestCtx     *RequestContext
+	InputTokens    int
+	OutputTokens   int
+	// OutputBytes and OutputRunes count the completion's bytes and characters as it streams; its
+	// tokens are estimated from the characters when the provider reports no usage
+	OutputBytes int
+	OutputRunes int
+	// MaxOutputTokens and MaxOutputBytes are the tier's caps on the stream's output; 0 is unlimited.
+	// LengthCapped is set once the stream was ended at a cap.
+	MaxOutputTokens int
+	MaxOutputBytes  int
+	LengthCapped    bool
+	// Completion is kept only when RetainCompletion is set, for payload logging, completion
+	// moderation and shadow comparisons; otherwise the completion is scanned as it passes
+	RetainCompletion         bool
+	Completion               strings.Builder
+	savings                  savingsScanner
 	WasOptimized             bool
 	OptimizationStatus       string
 	FallbackReason           string
 	PromptOptimizationResult *OptimizationResult
 	Closed                   bool
 	UsageLogged              bool
-	GenerationService        *GenerationService
-	StartTime                time.Time
+	// ContextCompression is how the stream's conversation was compressed to fit, if it was
+	ContextCompression *ContextCompression
+	// Completed is set once the provider stream ends cleanly, and Err once it fails
+	Completed bool
+	Err       error
+	// FirstChunkAt is when the provider stream produced its first output, and EndedAt when it ended
+	FirstChunkAt time.Time
+	EndedAt      time.Time
+	// EstimatedInputTokens is the prompt's estimated size, billed with an estimate of the output
+	// when the provider reports no usage; UsageEstimated records that it was
+	EstimatedInputTokens int
+	UsageEstimated       bool
+	GenerationService    *GenerationService
+	StartTime            time.Time
 	// Token savings tracking
 	InputTokensSaved  int
 	OutputTokensSaved int
 	TotalTokensSaved  int
+	// RequestedModel is the alias the caller used, if any
+	RequestedModel string
+	// BYOK streams are called with the caller's own provider key
+	BYOK bool
+	// Details are the cached input and reasoning output tokens the provider reported
+	Details data.TokenDetails
+	// Pricing is the prices and markups the stream is billed at
+	Pricing data.AppliedPricing
+	// SystemPrompts records the managed system prompt versions applied to the stream
+	SystemPrompts []data.SystemPromptRef
+	// TemplateID and TemplateVersion identify the template the prompt was rendered from, if any
+	TemplateID      string
+	TemplateVersion int
+	// Experiment is the experiment variant the stream was assigned to, if any
+	Experiment *ExperimentAssignment
+	// Routing is how the routing rules evaluated the stream's request, if any are enabled
+	Routing *data.RoutingDecision
+	// Moderation records prompt moderation; the completion is classified once the stream ends,
+	// when it can only be flagged because it has already been sent
+	Moderation *data.ModerationRecord
+	// Span covers the provider stream until it is closed
+	Span trace.Span
+	// Ctx bounds the provider stream; Cancel releases it when the stream is closed
+	Ctx     context.Context
+	Cancel  context.CancelFunc
+	Timeout time.Duration
+	// ProviderReservation is the stream's share of the provider's rate limit, settled on close
+	ProviderReservation *ProviderReservation
+	// Payload is the request as the caller sent it, when payload logging is enabled; the
+	// completion is added once the stream ends
+	Payload *data.RequestPayload
+	// ShadowRequest is mirrored to the experiment's shadow model once the stream completes
+	ShadowRequest *GenerationRequest
+	// BalanceHold is the stream's estimated cost, held against the account until it is charged on close
+	BalanceHold *BalanceHold
+	// Cost is what the stream was charged and CreditsUsed the promotional credit the charge
+	// consumed, once its usage has been logged
+	Cost        data.CostBreakdown
+	CreditsUsed data.MicroUSD
 }
 
 func (r *EnhancedStreamReader) Read(p []byte) (n int, err error) {
-	if r.Closed {
+	if r.Closed || r.LengthCapped {
 		return 0, io.EOF
 	}
 
 	// Read from original stream
 	n, err = r.OriginalStream.Read(p)
+	if limit := r.outputLimit(p[:n]); limit < n {
+		// The stream ends at the cap, without waiting for the provider to stop
+		n, err = limit, io.EOF
+		r.LengthCapped = true
+		if r.Cancel != nil {
+			r.Cancel()
+		}
+		r.RequestCtx.Logger.Info("Streaming: Output reached the tier's cap, ending stream",
+			"max_output_tokens", r.MaxOutputTokens,
+			"max_output_bytes", r.MaxOutputBytes,
+			"output_bytes", r.OutputBytes+n)
+	}
+	if n > 0 && r.FirstChunkAt.IsZero() {
+		r.FirstChunkAt = time.Now()
+	}
+	if err != nil && r.EndedAt.IsZero() {
+		r.EndedAt = time.Now()
+	}
 	if n > 0 {
-		// Accumulate content for token counting
-		r.AccumulatedContent.Write(p[:n])
+		r.OutputBytes += n
+		r.OutputRunes += countRunes(p[:n])
+		r.savings.Write(p[:n])
+		if r.RetainCompletion {
+			r.Completion.Write(p[:n])
+		}
 	}
 
-	// If stream ended, mark for logging but don't log yet
-	if err == io.EOF && !r.UsageLogged {
-		r.UsageLogged = true
-		// Don't call logUsage() here - defer it to Close()
+	// Report an expired stream deadline as a timeout rather than the provider's transport error
+	if err != nil && err != io.EOF && r.Ctx != nil && errors.Is(r.Ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("%w after %s", ErrProviderTimeout, r.Timeout)
 	}
 
+	// Usage is logged by Close, once the provider has reported it
+	if err == io.EOF {
+		r.Completed = !r.LengthCapped
+	} else if err != nil && r.Err == nil && !r.cancelled() {
+		r.Err = err
+	}
 	return n, err
 }
 
+// outputLimit returns how much of chunk fits within the stream's output caps. A character that
+// would not fit whole is left out, even when it arrives a byte at a time.
+func (r *EnhancedStreamReader) outputLimit(chunk []byte) int {
+	checkBytes := r.MaxOutputBytes > 0 && r.OutputBytes+len(chunk)+utf8.UTFMax-1 > r.MaxOutputBytes
+	checkTokens := r.MaxOutputTokens > 0 && r.estimateOutputTokens(r.OutputRunes+countRunes(chunk)) > r.MaxOutputTokens
+	if !checkBytes && !checkTokens {
+		return len(chunk)
+	}
+
+	runes := r.OutputRunes
+	for i, c := range chunk {
+		if c&0xC0 == 0x80 {
+			continue
+		}
+		runes++
+		if checkBytes && r.OutputBytes+i+runeLen(c) > r.MaxOutputBytes {
+			return i
+		}
+		if checkTokens && r.estimateOutputTokens(runes) > r.MaxOutputTokens {
+			return i
+		}
+	}
+	return len(chunk)
+}
+
+// estimateOutputTokens estimates the tokens in a completion of runes characters
+func (r *EnhancedStreamReader) estimateOutputTokens(runes int) int {
+	return r.GenerationService.tokenizers.EstimateRunes(r.ModelConfig, runes)
+}
+
+// FinishReason returns length_capped for a stream ended at its tier's output cap, else the
+// provider's normalized finish reason, or "" when the provider gave none
+func (r *EnhancedStreamReader) FinishReason() string {
+	if r.LengthCapped {
+		return FinishReasonLengthCapped
+	}
+	if reader, ok := r.OriginalStream.(data.FinishReasonReader); ok {
+		return reader.ProviderFinishReason()
+	}
+	return ""
+}
+
+// Timing returns how long the stream took to produce its first output and to end; streams that
+// have not ended yet are timed until now
+func (r *EnhancedStreamReader) Timing() StreamTiming {
+	var timing StreamTiming
+	if !r.FirstChunkAt.IsZero() {
+		timing.TimeToFirstToken = r.FirstChunkAt.Sub(r.StartTime)
+	}
+	end := r.EndedAt
+	if end.IsZero() {
+		end = time.Now()
+	}
+	timing.Duration = end.Sub(r.StartTime)
+	return timing
+}
+
+// StreamUsage is what a stream was billed for and what prompt optimization saved it, as a
+// non-streaming response reports them
+type StreamUsage struct {
+	InputTokens  int
+	OutputTokens int
+	Details      data.TokenDetails
+	// Estimated is set when the provider reported no usage or the stream was capped, so the tokens
+	// billed were estimated
+	Estimated         bool
+	InputTokensSaved  int
+	OutputTokensSaved int
+	TotalTokensSaved  int
+	// NetSavings is what the saved tokens would have cost, less the optimizer's cost
+	NetSavings data.MicroUSD
+}
+
+// Usage returns the stream's billed usage and savings, once Finish or Close has logged them
+func (r *EnhancedStreamReader) Usage() StreamUsage {
+	return StreamUsage{
+		InputTokens:       r.InputTokens,
+		OutputTokens:      r.OutputTokens,
+		Details:           r.Details,
+		Estimated:         r.UsageEstimated,
+		InputTokensSaved:  r.InputTokensSaved,
+		OutputTokensSaved: r.OutputTokensSaved,
+		TotalTokensSaved:  r.TotalTokensSaved,
+		NetSavings:        r.getSavingsAmount(),
+	}
+}
+
+// cancelled reports whether the caller abandoned the stream, which is not a provider failure
+func (r *EnhancedStreamReader) cancelled() bool {
+	return r.Ctx != nil && errors.Is(r.Ctx.Err(), context.Canceled)
+}
+
+// TakeLogprobs passes through the token logprobs the provider stream reported since the last call
+func (r *EnhancedStreamReader) TakeLogprobs() []data.TokenLogprob {
+	if reader, ok := r.OriginalStream.(data.LogprobsReader); ok {
+		return reader.TakeLogprobs()
+	}
+	return nil
+}
+
 // Flush ensures all buffered data is written
 func (r *EnhancedStreamReader) Flush() error {
 	// If the underlying stream has a Flush method, call it
@@ -166,6 +622,16 @@ func (r *EnhancedStreamReader) Flush() error {
 	return nil
 }
 
+// Finish logs and charges the usage of a stream read to its end, returning its cost and the
+// promotional credit the charge consumed, so callers can report them before the stream is
+// closed. Close logs the usage of streams that are not finished.
+func (r *EnhancedStreamReader) Finish() (data.CostBreakdown, data.MicroUSD) {
+	if !r.UsageLogged {
+		r.logUsage()
+	}
+	return r.Cost, r.CreditsUsed
+}
+
 func (r *EnhancedStreamReader) Close() error {
 	r.Closed = true
 
@@ -178,8 +644,30 @@ func (r *EnhancedStreamReader) Close() error {
 	if !r.UsageLogged {
 		r.logUsage()
 	}
+	r.ProviderReservation.Settle(r.InputTokens + r.OutputTokens)
+	r.BalanceHold.Release()
+
+	if r.Span != nil {
+		r.Span.SetAttributes(
+			attribute.Int("gen_ai.usage.input_tokens", r.InputTokens),
+			attribute.Int("gen_ai.usage.output_tokens", r.OutputTokens),
+		)
+		r.Span.End()
+	}
+
+	err := r.OriginalStream.Close()
+	if r.Cancel != nil {
+		r.Cancel()
+	}
+	return err
+}
 
-	return r.OriginalStream.Close()
+// traceContext returns a context carrying the stream's span, for work done after the request context is gone
+func (r *EnhancedStreamReader) traceContext() context.Context {
+	if r.Span == nil {
+		return context.Background()
+	}
+	return trace.ContextWithSpan(context.Background(), r.Span)
 }
 
 func (r *EnhancedStreamReader) logUsage() {
@@ -193,18 +681,40 @@ func (r *EnhancedStreamReader) logUsage() {
 				"input_tokens", inputTokens, "output_tokens", outputTokens)
 		}
 	}
+	if detailsReader, ok := r.OriginalStream.(data.TokenDetailsReader); ok {
+		r.Details = detailsReader.GetTokenDetails()
+	}
 
-	// If no usage from streaming, count output tokens from accumulated content
-	if r.OutputTokens == 0 {
-		outputTokens := 0 // Token estimation removed; only real API usage data is used
-		r.OutputTokens = outputTokens
+	// A stream that produced a response without a usage report, such as one cut off before its
+	// final chunk, would otherwise be billed nothing, so unless disabled bill an estimate and flag
+	// the request log
+	if r.InputTokens == 0 && r.OutputTokens == 0 && (r.Completed || r.OutputRunes > 0) {
+		if r.GenerationService.config.Cost.MissingUsageMode == "none" {
+			r.RequestCtx.Logger.Warn("Provider stream reported no usage, billing nothing",
+				"model", r.ModelConfig.ModelID,
+				"provider", r.ModelConfig.Provider)
+		} else {
+			r.InputTokens = r.EstimatedInputTokens
+			r.OutputTokens = r.GenerationService.tokenizers.EstimateRunes(r.ModelConfig, r.OutputRunes)
+			r.UsageEstimated = true
+			r.RequestCtx.Logger.Warn("Provider stream reported no usage, billing estimated usage",
+				"model", r.ModelConfig.ModelID,
+				"provider", r.ModelConfig.Provider,
+				"input_tokens", r.InputTokens,
+				"output_tokens", r.OutputTokens)
+		}
 	}
 
-	// If no input tokens from streaming, use tokenizer estimate
-	if r.InputTokens == 0 {
-		// For now, we'll use the tokenizer estimate for input tokens
-		// This could be improved by capturing the original prompt and counting it
-		r.RequestCtx.Logger.Info("EnhancedStreamReader: No input tokens from streaming, using tokenizer estimate")
+	// A capped stream was cut off before the provider finished, so its output is billed for what was
+	// sent rather than anything the provider produced past the cap
+	if r.LengthCapped {
+		if sent := r.estimateOutputTokens(r.OutputRunes); r.OutputTokens == 0 || r.OutputTokens > sent {
+			r.OutputTokens = sent
+			r.UsageEstimated = true
+		}
+		if r.InputTokens == 0 {
+			r.InputTokens = r.EstimatedInputTokens
+		}
 	}
 
 	// Calculate actual input token savings using real usage data from streaming response
@@ -214,62 +724,46 @@ func (r *EnhancedStreamReader) logUsage() {
 
 		// CRITICAL: We can only calculate savings if we have real usage data
 		// If we don't have real usage data, we cannot claim any savings
-		if userModelInputTokens == 0 {
+		if userModelInputTokens == 0 || r.UsageEstimated {
 			r.RequestCtx.Logger.Warn("Cannot calculate input token savings - no real usage data available",
 				"input_tokens", userModelInputTokens,
 				"note", "Using real API usage data only, no estimators allowed")
 			r.InputTokensSaved = 0
 			r.TotalTokensSaved = r.OutputTokensSaved
-			return
-		}
-
-		// Use real Gemma 3 API usage data for original tokens
-		gemma3InputTokens := r.PromptOptimizationResult.Gemma3InputTokens
-		if gemma3InputTokens == 0 {
-			// Fallback to the original token count if no real Gemma 3 usage data
-			gemma3InputTokens = r.PromptOptimizationResult.OriginalTokens
-			r.RequestCtx.Logger.Warn("No real Gemma 3 usage data, using fallback token count",
-				"gemma3_input_tokens", gemma3InputTokens,
-				"note", "This may not be accurate - real API usage data preferred")
-		}
+		} else {
+			// Use real Gemma 3 API usage data for original tokens
+			gemma3InputTokens := r.PromptOptimizationResult.Gemma3InputTokens
+			if gemma3InputTokens == 0 {
+				// Fallback to the original token count if no real Gemma 3 usage data
+				gemma3InputTokens = r.PromptOptimizationResult.OriginalTokens
+				r.RequestCtx.Logger.Warn("No real Gemma 3 usage data, using fallback token count",
+					"gemma3_input_tokens", gemma3InputTokens,
+					"note", "This may not be accurate - real API usage data preferred")
+			}
 
-		actualInputTokensSaved := gemma3InputTokens - userModelInputTokens
-		if actualInputTokensSaved < 0 {
-			actualInputTokensSaved = 0 // Don't show negative savings
-		}
+			actualInputTokensSaved := gemma3InputTokens - userModelInputTokens
+			if actualInputTokensSaved < 0 {
+				actualInputTokensSaved = 0 // Don't show negative savings
+			}
 
-		// Update the input tokens saved with actual usage data
-		r.InputTokensSaved = actualInputTokensSaved
-		r.TotalTokensSaved = actualInputTokensSaved + r.OutputTokensSaved
+			// Update the input tokens saved with actual usage data
+			r.InputTokensSaved = actualInputTokensSaved
+			r.TotalTokensSaved = actualInputTokensSaved + r.OutputTokensSaved
 
-		r.RequestCtx.Logger.Info("Updated input tokens saved with real API usage data",
-			"gemma3_input_tokens", gemma3InputTokens,
-			"user_model_input_tokens", userModelInputTokens,
-			"input_tokens_saved", actualInputTokensSaved,
-			"usage_source", "real_api_responses",
-			"comparison_note", "Real Gemma3 usage vs actual user model usage")
+			r.RequestCtx.Logger.Info("Updated input tokens saved with real API usage data",
+				"gemma3_input_tokens", gemma3InputTokens,
+				"user_model_input_tokens", userModelInputTokens,
+				"input_tokens_saved", actualInputTokensSaved,
+				"usage_source", "real_api_responses",
+				"comparison_note", "Real Gemma3 usage vs actual user model usage")
+		}
 	}
 
 	// For output token savings, we need to use AI estimation since we only generate one response
-	// Extract AI estimation of output tokens saved from the content
-	outputTokensSaved := 0
-	if strings.Contains(r.AccumulatedContent.String(), "tokens_saved=") {
-		// Find the marker and extract the estimate
-		startIdx := strings.Index(r.AccumulatedContent.String(), "tokens_saved=")
-		if startIdx != -1 {
-			startIdx += len("tokens_saved=")
-			endIdx := startIdx
-			// Find the end of the number
-			for endIdx < len(r.AccumulatedContent.String()) && r.AccumulatedContent.String()[endIdx] >= '0' && r.AccumulatedContent.String()[endIdx] <= '9' {
-				endIdx++
-			}
-			if endIdx > startIdx {
-				if estimate, parseErr := strconv.Atoi(r.AccumulatedContent.String()[startIdx:endIdx]); parseErr == nil {
-					outputTokensSaved = estimate
-					r.RequestCtx.Logger.Info("Extracted AI estimation of output tokens saved", "estimate", outputTokensSaved)
-				}
-			}
-		}
+	// Extract AI estimation of output tokens saved from the content, scanned as it streamed
+	outputTokensSaved := r.savings.Estimate()
+	if outputTokensSaved > 0 {
+		r.RequestCtx.Logger.Info("Extracted AI estimation of output tokens saved", "estimate", outputTokensSaved)
 	}
 
 	r.OutputTokensSaved = outputTokensSaved
@@ -291,7 +785,7 @@ func (r *EnhancedStreamReader) logUsage() {
 		"input_tokens", r.InputTokens,
 		"output_tokens", r.OutputTokens,
 		"total_tokens", r.InputTokens+r.OutputTokens,
-		"actual_cost", actualCost,
+		"actual_cost", actualCost.Total().String(),
 		"was_optimized", r.WasOptimized,
 		"optimization_status", r.OptimizationStatus,
 		"fallback_reason", r.FallbackReason,
@@ -299,85 +793,143 @@ func (r *EnhancedStreamReader) logUsage() {
 		"output_tokens_saved", r.OutputTokensSaved,
 		"total_tokens_saved", r.TotalTokensSaved)
 
-	// Log the request to Firebase
-	r.logStreamingRequest(actualCost)
+	if _, err := r.GenerationService.moderation.Classify(r.traceContext(), r.RequestCtx.PricingTier.Moderation, r.Moderation, ModerationStageCompletion, r.Completion.String()); err != nil {
+		r.RequestCtx.Logger.Warn("Streaming: Completion moderation failed", "error", err)
+	}
+
+	// Charge the user before logging, so the log records any promotional credit the charge consumed;
+	// BYOK requests may cost nothing to charge
+	creditsUsed, err := r.GenerationService.billingService.Charge(r.traceContext(), r.RequestCtx.RequestID, r.RequestCtx.UserID, r.RequestCtx.OrgID, actualCost.Total())
+	if err != nil {
+		r.RequestCtx.Logger.Error("Failed to charge streaming request", "error", err)
+	}
+
+	r.Cost, r.CreditsUsed = actualCost, creditsUsed
 
-	// Charge the user
-	r.chargeUser(actualCost)
+	// Log the request to Firebase
+	timing := r.Timing()
+	r.logStreamingRequest(actualCost, creditsUsed, timing)
+	r.GenerationService.streamMetrics.record(r.traceContext(), r.ModelConfig, timing)
 
 	// Mark as logged
 	r.UsageLogged = true
 
+	if r.ShadowRequest != nil && r.Completed {
+		go r.GenerationService.mirrorShadow(r.traceContext(), r.ShadowRequest, r.Experiment, shadowOriginal{
+			ModelConfig:  r.ModelConfig,
+			InputTokens:  r.InputTokens,
+			OutputTokens: r.OutputTokens,
+			Details:      r.Details,
+			Optimization: r.PromptOptimizationResult,
+			Duration:     time.Since(r.StartTime),
+			Completion:   r.Completion.String(),
+		}, r.RequestCtx)
+	}
+
 	// Add debug logs to output tokens saved parsing
-	if strings.Contains(r.AccumulatedContent.String(), "tokens_saved=") {
+	if r.savings.found {
 		r.RequestCtx.Logger.Info("Streaming: Found tokens_saved marker in stream")
 	}
 	r.RequestCtx.Logger.Info("Streaming: Parsed output_tokens_saved", "output_tokens_saved", r.OutputTokensSaved)
 	r.RequestCtx.Logger.Info("Streaming: Final input/output tokens saved", "input_tokens_saved", r.InputTokensSaved, "output_tokens_saved", r.OutputTokensSaved)
 }
 
-func (r *EnhancedStreamReader) calculateActualCost(inputTokens, outputTokens int) float64 {
-	// Calculate base cost
-	inputCost := float64(inputTokens) * r.ModelConfig.InputPricePerMillion / 1000000
-	outputCost := float64(outputTokens) * r.ModelConfig.OutputPricePerMillion / 1000000
-	baseCost := inputCost + outputCost
-
-	// Apply pricing tier markups (percentage-based)
-	inputMarkup := inputCost * (r.RequestCtx.PricingTier.InputMarkupPercent / 100)
-	outputMarkup := outputCost * (r.RequestCtx.PricingTier.OutputMarkupPercent / 100)
-	totalMarkup := inputMarkup + outputMarkup
-
-	finalCost := baseCost + totalMarkup
-
-	return finalCost
+func (r *EnhancedStreamReader) calculateActualCost(inputTokens, outputTokens int) data.CostBreakdown {
+	return r.GenerationService.requestCost(inputTokens, outputTokens, r.Details, r.ModelConfig, r.Pricing, r.PromptOptimizationResult, r.ContextCompression, r.BYOK, r.RequestCtx.TestMode)
 }
 
-func (r *EnhancedStreamReader) logStreamingRequest(cost float64) {
+func (r *EnhancedStreamReader) logStreamingRequest(cost data.CostBreakdown, creditsUsed data.MicroUSD, timing StreamTiming) {
 	// Create request log
 	log := &data.RequestLog{
 		ID:                 r.RequestCtx.RequestID,
 		UserID:             r.RequestCtx.UserID,
+		OrgID:              r.RequestCtx.OrgID,
+		TenantID:           r.RequestCtx.Tenant.GetID(),
+		UserType:           r.RequestCtx.UserType(),
 		APIKeyID:           r.RequestCtx.APIKeyID,
 		RequestID:          r.RequestCtx.RequestID,
 		ModelID:            r.ModelConfig.ModelID,
+		RequestedModel:     r.RequestedModel,
+		BYOK:               r.BYOK,
+		BillingMode:        r.GenerationService.BillingMode(r.BYOK, r.RequestCtx.TestMode),
+		Moderation:         r.Moderation,
+		SystemPrompts:      r.SystemPrompts,
+		TemplateID:         r.TemplateID,
+		TemplateVersion:    r.TemplateVersion,
 		Provider:           r.ModelConfig.Provider,
 		InputTokens:        r.InputTokens,
 		OutputTokens:       r.OutputTokens,
 		TotalTokens:        r.InputTokens + r.OutputTokens,
-		BaseCost:           cost / (1 + (r.RequestCtx.PricingTier.InputMarkupPercent+r.RequestCtx.PricingTier.OutputMarkupPercent)/100),
-		MarkupAmount:       cost - (cost / (1 + (r.RequestCtx.PricingTier.InputMarkupPercent+r.RequestCtx.PricingTier.OutputMarkupPercent)/100)),
-		TotalCost:          cost,
+		BaseCost:           cost.Base(),
+		MarkupAmount:       cost.Markup(),
+		PlatformFee:        cost.PlatformFee,
+		TotalCost:          cost.Total(),
+		CreditsUsed:        creditsUsed,
 		TierID:             r.RequestCtx.PricingTier.ID,
-		MarkupPercent:      (r.RequestCtx.PricingTier.InputMarkupPercent + r.RequestCtx.PricingTier.OutputMarkupPercent) / 2,
+		MarkupPercent:      r.Pricing.MarkupPercent(),
 		WasOptimized:       r.WasOptimized,
 		OptimizationStatus: r.OptimizationStatus,
 		TokensSaved:        r.getTokensSaved(),
 		SavingsAmount:      r.getSavingsAmount(),
+		UsageEstimated:     r.UsageEstimated,
 		Streaming:          true,
 		RequestTimestamp:   r.StartTime,
-		ResponseTimestamp:  time.Now(),
-		DurationMs:         time.Since(r.StartTime).Milliseconds(),
+		ResponseTimestamp:  r.StartTime.Add(timing.Duration),
+		DurationMs:         timing.Duration.Milliseconds(),
+		TimeToFirstTokenMs: timing.TimeToFirstToken.Milliseconds(),
 		Status:             "success",
-		IPAddress:          "127.0.0.1", // Will be set by middleware
-		UserAgent:          "streaming-client",
+		IPAddress:          r.RequestCtx.ClientIP,
+		UserAgent:          r.RequestCtx.UserAgent,
 		Metadata: map[string]interface{}{
 			"fallback_reason":     r.FallbackReason,
 			"input_tokens_saved":  r.InputTokensSaved,
 			"output_tokens_saved": r.OutputTokensSaved,
 			"total_tokens_saved":  r.TotalTokensSaved,
 		},
+
+		CachedInputTokens:     r.Details.CacheReadTokens,
+		CacheWriteInputTokens: r.Details.CacheWriteTokens,
+		ReasoningTokens:       r.Details.ReasoningTokens,
+		PricingOverride:       r.Pricing.Override,
+		TestMode:              r.RequestCtx.TestMode,
+	}
+	if reason := r.FinishReason(); reason != "" {
+		log.Metadata["finish_reason"] = reason
+	}
+	if r.Payload != nil {
+		r.Payload.Completion = r.Completion.String()
+		log.Payload = r.Payload
+	}
+	// A stream that failed part way is still billed for what it produced
+	if r.Err != nil && !r.Completed {
+		log.Status = data.RequestStatusError
+		log.Error = r.Err.Error()
+		log.ErrorDetail = RequestErrorDetail(r.Err)
 	}
 
-	// Log to Firebase
-	if err := r.GenerationService.firebaseService.LogRequest(context.Background(), log); err != nil {
-		r.RequestCtx.Logger.Error("Failed to log streaming request", "error", err)
+	if r.Experiment != nil {
+		log.ExperimentID = r.Experiment.ExperimentID
+		log.ExperimentVariant = r.Experiment.Variant
+	}
+	log.Routing = r.Routing
+	if r.PromptOptimizationResult != nil {
+		log.OptimizerInputTokens = r.PromptOptimizationResult.OptimizerInputTokens
+		log.OptimizerOutputTokens = r.PromptOptimizationResult.OptimizerOutputTokens
+		log.OptimizerCost = r.PromptOptimizationResult.OptimizerCost
+		if r.PromptOptimizationResult.Guard != "" {
+			log.Metadata["optimization_guard"] = r.PromptOptimizationResult.Guard
+		}
+	}
+	if compression := r.ContextCompression; compression != nil {
+		log.OptimizerInputTokens += compression.SummaryInputTokens
+		log.OptimizerOutputTokens += compression.SummaryOutputTokens
+		log.OptimizerCost += compression.Cost
+		log.Metadata["context_compression"] = compression.Strategy
 	}
-}
 
-func (r *EnhancedStreamReader) chargeUser(cost float64) {
-	// Update user balance (allows negative balance)
-	if err := r.GenerationService.firebaseService.UpdateUserBalance(context.Background(), r.RequestCtx.UserID, -cost); err != nil {
-		r.RequestCtx.Logger.Error("Failed to update user balance", "error", err)
+	// Log to Firebase
+	if err := r.GenerationService.usageStore.LogRequest(r.traceContext(), log); err != nil {
+		r.RequestCtx.Logger.Error("Failed to log streaming request", "error", err)
 	}
 }
 
@@ -389,15 +941,12 @@ func (r *EnhancedStreamReader) getTokensSaved() int {
 	return 0
 }
 
-// getSavingsAmount calculates the monetary savings from optimization
-func (r *EnhancedStreamReader) getSavingsAmount() float64 {
-	tokensSaved := r.getTokensSaved()
-	if tokensSaved > 0 {
-		// Calculate savings based on input token cost (since optimization affects input tokens)
-		inputCostPerToken := r.ModelConfig.InputPricePerMillion / 1000000
-		return float64(tokensSaved) * inputCostPerToken
+// getSavingsAmount returns the monetary savings from optimization, net of the optimizer's cost
+func (r *EnhancedStreamReader) getSavingsAmount() data.MicroUSD {
+	if r.PromptOptimizationResult == nil {
+		return 0
 	}
-	return 0
+	return r.PromptOptimizationResult.NetSavings
 }
 
 // Generate handles the main generation logic with optimized billing
@@ -406,9 +955,22 @@ func (s *GenerationService) Generate(ctx context.Context, req *GenerationRequest
 	if req.Model == "" {
 		return nil, fmt.Errorf("model is required")
 	}
+	start := time.Now()
+	sent := *req
+	payload := s.capturePayload(req)
+
+	if err := s.resolveModelAlias(ctx, req, requestCtx); err != nil {
+		return nil, err
+	}
+	if err := s.applyTemplate(ctx, req, requestCtx); err != nil {
+		return nil, err
+	}
+
+	s.applyRouting(ctx, req, requestCtx)
+	s.applyExperiment(ctx, req, requestCtx)
 
 	// Get model configuration
-	modelConfig, err := s.pricingService.GetModelConfig(req.Model)
+	modelConfig, err := s.modelCatalog.GetModelConfig(req.Model)
 	if err != nil {
 		return nil, fmt.Errorf("invalid model %s: %w", req.Model, err)
 	}
@@ -417,88 +979,75 @@ func (s *GenerationService) Generate(ctx context.Context, req *GenerationRequest
 	if req.MaxTokens == 0 {
 		req.MaxTokens = 1000
 	}
-	if req.Temperature == 0 {
-		req.Temperature = 0.7
-	}
-	if req.TopP == 0 {
-		req.TopP = 1.0
-	}
-
-	// Pre-flight balance check (quick cache check before expensive operations)
-	estimatedInputTokens := len(req.Prompt) / 4 // Rough estimate
-	estimatedOutputTokens := req.MaxTokens
-	estimatedCost := s.calculateEstimatedCost(estimatedInputTokens, estimatedOutputTokens, modelConfig, requestCtx.PricingTier)
 
-	canProceed, currentBalance, err := s.checkUserBalance(ctx, requestCtx.UserID)
-	if err != nil {
-		return nil, fmt.Errorf("balance check failed: %w", err)
+	if err := s.applyKeyRestrictions(req, modelConfig, requestCtx); err != nil {
+		return nil, err
 	}
 
-	if !canProceed {
-		return nil, fmt.Errorf("user account is inactive")
+	// Streaming requests produce a stream rather than a result
+	if req.Stream {
+		return nil, fmt.Errorf("streaming requests must use GenerateStream")
 	}
 
-	requestCtx.Logger.Info("Pre-flight balance check passed",
-		"user_id", requestCtx.UserID,
-		"current_balance", currentBalance,
-		"estimated_cost", estimatedCost,
-		"estimated_input_tokens", estimatedInputTokens,
-		"estimated_output_tokens", estimatedOutputTokens,
-	)
+	// Moderate the caller's prompt before it is optimized or sent anywhere
+	moderation := s.moderation.NewRecord(requestCtx.PricingTier.Moderation)
+	if err := s.moderation.Check(ctx, requestCtx.PricingTier.Moderation, moderation, ModerationStagePrompt, req.Prompt); err != nil {
+		return nil, err
+	}
 
-	// Check if streaming is requested
-	if req.Stream {
-		return nil, fmt.Errorf("streaming generation not yet implemented")
+	if err := s.applySystemPrompts(ctx, req, requestCtx); err != nil {
+		return nil, err
+	}
+	if err := s.fitConversation(ctx, req, modelConfig, requestCtx); err != nil {
+		return nil, err
 	}
 
 	// Step 1: Optimize input prompt if optimization is enabled and prompt is long enough
-	var promptOptimizationResult *OptimizationResult
-
-	if s.optimizer != nil && s.config.Optimization.Enabled && s.optimizer.ShouldOptimize(req.Prompt, 50) {
-		// Try to optimize the prompt
-		optimizationResult, err := s.optimizer.OptimizePromptWithMode(ctx, req.Prompt, req.OptimizationMode)
-		if err != nil {
-			if s.config.Optimization.FallbackOnOptimizationFailure {
-				requestCtx.Logger.Warn("Prompt optimization failed, using original prompt", "error", err)
-				promptOptimizationResult = &OptimizationResult{
-					OriginalText:     req.Prompt,
-					OptimizedText:    req.Prompt,
-					OriginalTokens:   0,
-					OptimizedTokens:  0,
-					TokensSaved:      0,
-					SavingsPercent:   0,
-					OptimizationType: "none",
-					WasOptimized:     false,
-					FallbackReason:   "optimization_failed",
-				}
-			} else {
-				return nil, fmt.Errorf("prompt optimization failed: %w", err)
-			}
-		} else {
-			promptOptimizationResult = optimizationResult
-			if optimizationResult.WasOptimized {
-				req.Prompt = optimizationResult.OptimizedText
-				requestCtx.Logger.Info("Prompt optimized successfully",
-					"original_tokens", optimizationResult.OriginalTokens,
-					"optimized_tokens", optimizationResult.OptimizedTokens,
-					"tokens_saved", optimizationResult.TokensSaved,
-					"savings_percent", fmt.Sprintf("%.1f%%", optimizationResult.SavingsPercent))
-			}
-		}
+	promptOptimizationResult, err := s.optimizePrompt(ctx, req, modelConfig, requestCtx, minOptimizedPromptChars)
+	if err != nil {
+		return nil, err
 	}
 
-	// Add response optimization prompt to get AI estimate of output tokens saved
-	if promptOptimizationResult != nil && promptOptimizationResult.WasOptimized {
+	// Add response optimization prompt to get AI estimate of output tokens saved, unless the
+	// request is guarded, since its output must keep the shape the caller asked for
+	if promptOptimizationResult != nil && promptOptimizationResult.WasOptimized && promptOptimizationResult.Guard == "" {
 		responseOptimizationPrompt := "\n\nIMPORTANT: Be concise and efficient. After your response, append exactly: tokens_saved=<number> where <number> is your estimate of how many tokens you saved by being concise compared to a verbose response."
 		req.Prompt += responseOptimizationPrompt
 		requestCtx.Logger.Info("Added response optimization prompt for AI estimation", "prompt_length", len(req.Prompt))
 	}
 
+	if _, err := s.checkContextWindow(ctx, req, modelConfig, requestCtx); err != nil {
+		return nil, err
+	}
+
 	// Handle non-streaming generation
-	result, err := s.handleNonStreamingGeneration(ctx, req, modelConfig, requestCtx)
+	result, err := s.handleNonStreamingGeneration(ctx, req, modelConfig, requestCtx, promptOptimizationResult)
 	if err != nil {
 		return nil, err
 	}
+	result.Response.Text = NewResponsePipeline(requestCtx.PostProcessing, promptOptimizationResult != nil && promptOptimizationResult.WasOptimized).Apply(result.Response.Text)
+
+	// A blocked completion is still billed, so it is reported on the result rather than as an error
+	err = s.moderation.Check(ctx, requestCtx.PricingTier.Moderation, moderation, ModerationStageCompletion, result.Response.Text)
+	var moderationErr *ModerationError
+	if err != nil && !errors.As(err, &moderationErr) {
+		result.BalanceHold.Release()
+		return nil, err
+	}
+	result.Moderation = moderation
+	usage := result.Response.Usage
+	result.Cost = s.requestCost(usage.InputTokens, usage.OutputTokens, usage.Details, modelConfig, requestCtx.ModelPricing(modelConfig), promptOptimizationResult, req.ContextCompression, req.BYOK, requestCtx.TestMode)
+
+	if len(req.SystemPrompts) > 0 {
+		result.Response.Metadata["system_prompts"] = req.SystemPrompts
+	}
+	if req.TemplateID != "" {
+		result.Response.Metadata["template_id"] = req.TemplateID
+		result.Response.Metadata["template_version"] = req.TemplateVersion
+	}
+	if req.ContextCompression != nil {
+		result.Response.Metadata["context_compression"] = req.ContextCompression
+	}
 
 	// Add optimization information to the result
 	if promptOptimizationResult != nil {
@@ -507,58 +1056,166 @@ func (s *GenerationService) Generate(ctx context.Context, req *GenerationRequest
 		result.FallbackReason = promptOptimizationResult.FallbackReason
 		result.PromptOptimizationResult = promptOptimizationResult
 	}
+	if payload != nil {
+		payload.Completion = result.Response.Text
+		result.Payload = payload
+	}
+
+	if s.sampleQuality(req, promptOptimizationResult, requestCtx) {
+		go s.evaluateQuality(ctx, sent, result, modelConfig, requestCtx)
+	}
+	if shadowReq := s.shadowRequest(sent, req, requestCtx); shadowReq != nil {
+		go s.mirrorShadow(ctx, shadowReq, req.Experiment, shadowOriginal{
+			ModelConfig:  modelConfig,
+			InputTokens:  result.Response.Usage.InputTokens,
+			OutputTokens: result.Response.Usage.OutputTokens,
+			Details:      result.Response.Usage.Details,
+			Optimization: promptOptimizationResult,
+			Duration:     time.Since(start),
+			Completion:   result.Response.Text,
+		}, requestCtx)
+	}
 	return result, nil
 }
 
+// Estimate resolves the model and estimates the tokens a request would use, without calling the provider
+func (s *GenerationService) Estimate(ctx context.Context, req *GenerationRequest, requestCtx *RequestContext) (*CostEstimate, error) {
+	if err := s.resolveModelAlias(ctx, req, requestCtx); err != nil {
+		return nil, err
+	}
+	if err := s.applyTemplate(ctx, req, requestCtx); err != nil {
+		return nil, err
+	}
+	s.applyRouting(ctx, req, requestCtx)
+
+	modelConfig, err := s.modelCatalog.GetModelConfig(req.Model)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownModel, req.Model)
+	}
+
+	if req.MaxTokens == 0 {
+		req.MaxTokens = 1000
+	}
+	if err := s.applyKeyRestrictions(req, modelConfig, requestCtx); err != nil {
+		return nil, err
+	}
+	if err := s.applySystemPrompts(ctx, req, requestCtx); err != nil {
+		return nil, err
+	}
+	inputTokens, err := s.checkContextWindow(ctx, req, modelConfig, requestCtx)
+	if err != nil {
+		return nil, err
+	}
+	storedKey, err := s.providerKeys.ResolveKey(ctx, requestCtx.UserID, modelConfig.Provider)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve stored provider key: %w", err)
+	}
+
+	return &CostEstimate{
+		Model:           modelConfig.ModelID,
+		RequestedModel:  req.RequestedModel,
+		Provider:        modelConfig.Provider,
+		InputTokens:     inputTokens,
+		MaxOutputTokens: req.MaxTokens,
+		BYOK:            storedKey != "",
+	}, nil
+}
+
+// Optimization strategies PreviewOptimization can run
+const (
+	// OptimizationStrategyAuto tries rule-based rewriting and then the optimizer model, as generation does
+	OptimizationStrategyAuto = "auto"
+	// OptimizationStrategyRuleBased runs only the rule-based rewriting
+	OptimizationStrategyRuleBased = "rule_based"
+	// OptimizationStrategyAI runs only the optimizer model
+	OptimizationStrategyAI = "ai"
+)
+
+var (
+	// ErrUnknownOptimizationStrategy is returned for a strategy other than auto, rule_based or ai
+	ErrUnknownOptimizationStrategy = errors.New("unknown optimization strategy")
+	// ErrOptimizerUnavailable is returned when AI optimization is disabled or its model failed to initialize
+	ErrOptimizerUnavailable = errors.New("AI prompt optimization is not available")
+)
+
+// PreviewOptimization runs the prompt optimizer without generating, so callers can inspect what
+// it would do to a prompt. mode is the optimization mode, as on a generation request.
+func (s *GenerationService) PreviewOptimization(ctx context.Context, prompt, mode, strategy string) (*OptimizationResult, error) {
+	switch strategy {
+	case "", OptimizationStrategyAuto, OptimizationStrategyAI:
+	case OptimizationStrategyRuleBased:
+		return RuleBasedOptimization(prompt), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownOptimizationStrategy, strategy)
+	}
+	if s.optimizer == nil || !s.config.Optimization.Enabled {
+		return nil, ErrOptimizerUnavailable
+	}
+
+	optCtx, cancel := context.WithTimeout(ctx, s.config.Timeouts.Optimization)
+	defer cancel()
+	return s.optimizer.OptimizePromptWithMode(optCtx, prompt, mode, strategy != OptimizationStrategyAI)
+}
+
+// FinishReasonLengthCapped is the finish reason of streams ended at their tier's output cap
+const FinishReasonLengthCapped = "length_capped"
+
+// EstimateTokens approximates the token count of text at about four characters per token
+func EstimateTokens(text string) int {
+	return EstimateTokensFromRunes(utf8.RuneCountInString(text))
+}
+
+// EstimateTokensFromRunes returns EstimateTokens' count for a text of runes characters
+func EstimateTokensFromRunes(runes int) int {
+	return (runes + 3) / 4
+}
+
 // GenerateStream generates text with streaming response
 func (s *GenerationService) GenerateStream(ctx context.Context, req *GenerationRequest, requestCtx *RequestContext) (*data.StreamResponse, error) {
+	// Streams are timed from the request, so time to first token includes everything the caller waits for
+	start := time.Now()
+	sent := *req
+	payload := s.capturePayload(req)
+	if err := s.resolveModelAlias(ctx, req, requestCtx); err != nil {
+		return nil, err
+	}
+	if err := s.applyTemplate(ctx, req, requestCtx); err != nil {
+		return nil, err
+	}
+
+	s.applyRouting(ctx, req, requestCtx)
+	s.applyExperiment(ctx, req, requestCtx)
+
 	// Get model configuration
-	modelConfig, err := s.pricingService.GetModelConfig(req.Model)
+	modelConfig, err := s.modelCatalog.GetModelConfig(req.Model)
 	if err != nil {
 		return nil, fmt.Errorf("model config not found for model ID: %s", req.Model)
 	}
 
-	// Step 1: Quick optimization check - only optimize if prompt is very long and optimization is enabled
-	var promptOptimizationResult *OptimizationResult
-	originalPrompt := req.Prompt
+	if err := s.applyKeyRestrictions(req, modelConfig, requestCtx); err != nil {
+		return nil, err
+	}
 
-	if s.optimizer != nil && s.config.Optimization.Enabled && s.optimizer.ShouldOptimize(req.Prompt, 100) { // Increased threshold
-		// Create a quick optimization context with shorter timeout
-		optCtx, optCancel := context.WithTimeout(ctx, 30*time.Second)
+	// Moderate the caller's prompt before it is optimized or sent anywhere
+	moderation := s.moderation.NewRecord(requestCtx.PricingTier.Moderation)
+	if err := s.moderation.Check(ctx, requestCtx.PricingTier.Moderation, moderation, ModerationStagePrompt, req.Prompt); err != nil {
+		return nil, err
+	}
 
-		// Try to optimize the prompt with a quick timeout
-		optimizationResult, err := s.optimizer.OptimizePromptWithMode(optCtx, req.Prompt, req.OptimizationMode)
-		optCancel() // Cancel immediately after optimization attempt
+	if err := s.applySystemPrompts(ctx, req, requestCtx); err != nil {
+		return nil, err
+	}
+	if err := s.fitConversation(ctx, req, modelConfig, requestCtx); err != nil {
+		return nil, err
+	}
 
-		if err != nil {
-			if s.config.Optimization.FallbackOnOptimizationFailure {
-				requestCtx.Logger.Warn("Prompt optimization failed, using original prompt", "error", err)
-				promptOptimizationResult = &OptimizationResult{
-					OriginalText:     req.Prompt,
-					OptimizedText:    req.Prompt,
-					OriginalTokens:   0,
-					OptimizedTokens:  0,
-					TokensSaved:      0,
-					SavingsPercent:   0,
-					OptimizationType: "none",
-					WasOptimized:     false,
-					FallbackReason:   "optimization_failed",
-				}
-			} else {
-				return nil, fmt.Errorf("prompt optimization failed: %w", err)
-			}
-		} else {
-			promptOptimizationResult = optimizationResult
-			if optimizationResult.WasOptimized {
-				req.Prompt = optimizationResult.OptimizedText
-				requestCtx.Logger.Info("Prompt optimized successfully",
-					"original_tokens", optimizationResult.OriginalTokens,
-					"optimized_tokens", optimizationResult.OptimizedTokens,
-					"tokens_saved", optimizationResult.TokensSaved,
-					"savings_percent", fmt.Sprintf("%.1f%%", optimizationResult.SavingsPercent))
-			}
-		}
-	} else {
+	// Step 1: Quick optimization check - only optimize if prompt is very long and optimization is enabled
+	originalPrompt := req.Prompt
+	promptOptimizationResult, err := s.optimizePrompt(ctx, req, modelConfig, requestCtx, minOptimizedStreamPromptChars)
+	if err != nil {
+		return nil, err
+	}
+	if promptOptimizationResult == nil {
 		// No optimization needed or disabled
 		promptOptimizationResult = &OptimizationResult{
 			OriginalText:     req.Prompt,
@@ -573,41 +1230,72 @@ func (s *GenerationService) GenerateStream(ctx context.Context, req *GenerationR
 		}
 	}
 
-	// Add response optimization prompt only if optimization was actually used
-	if promptOptimizationResult != nil && promptOptimizationResult.WasOptimized {
+	// Add response optimization prompt only if optimization was actually used and not guarded
+	if promptOptimizationResult != nil && promptOptimizationResult.WasOptimized && promptOptimizationResult.Guard == "" {
 		responseOptimizationPrompt := "\n\nIMPORTANT: Be concise and efficient. After your response, append exactly: tokens_saved=<number> where <number> is your estimate of how many tokens you saved by being concise compared to a verbose response."
 		req.Prompt += responseOptimizationPrompt
 		requestCtx.Logger.Info("Added response optimization prompt for AI estimation", "prompt_length", len(req.Prompt))
 	}
 
+	inputTokens, err := s.checkContextWindow(ctx, req, modelConfig, requestCtx)
+	if err != nil {
+		return nil, err
+	}
+
 	// Step 2: Create LLM client
-	client, err := s.createLLMClient(modelConfig, req)
+	client, err := s.createLLMClient(ctx, modelConfig, req, requestCtx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create LLM client: %w", err)
 	}
 
+	// Streams are only charged when they close, so their estimated cost is held until then
+	hold, err := s.reserveBalance(ctx, req, modelConfig, requestCtx)
+	if err != nil {
+		return nil, err
+	}
+
 	// Step 3: Prepare generation parameters with include_usage for streaming
 	params := map[string]interface{}{
 		"model":         req.Model,
 		"prompt":        req.Prompt,
 		"max_tokens":    req.MaxTokens,
-		"temperature":   req.Temperature,
-		"top_p":         req.TopP,
 		"stream":        true,
 		"include_usage": true, // Add this to get usage information in streaming
 	}
+	addSamplingParams(params, req)
 
 	// Add any extra parameters
 	for key, value := range req.Extra {
 		params[key] = value
 	}
+	addSystemParam(params, req)
 
-	// Step 4: Generate streaming response with timeout
-	streamCtx, streamCancel := context.WithTimeout(ctx, 8*time.Minute)
-	defer streamCancel()
+	// Wait for capacity under the provider's rate limits before the stream's timeout starts
+	reservation, err := s.reserveProviderCapacity(ctx, modelConfig, req, requestCtx)
+	if err != nil {
+		hold.Release()
+		return nil, err
+	}
+
+	// Step 4: Generate streaming response with timeout; the stream's Close releases the context
+	timeout := s.providerTimeout(req, modelConfig, true)
+	streamCtx, streamCancel := context.WithTimeout(ctx, timeout)
+
+	streamCtx, span := tracer.Start(streamCtx, "provider.generate_stream",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(providerSpanAttributes(modelConfig, req)...),
+	)
 
 	streamResp, err := client.GenerateStream(streamCtx, params)
 	if err != nil {
+		if errors.Is(streamCtx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("%w after %s", ErrProviderTimeout, timeout)
+		}
+		recordSpanError(span, err)
+		span.End()
+		streamCancel()
+		reservation.Settle(0)
+		hold.Release()
 		return nil, fmt.Errorf("streaming generation failed: %w", err)
 	}
 
@@ -618,21 +1306,46 @@ func (s *GenerationService) GenerateStream(ctx context.Context, req *GenerationR
 		RequestCtx:               requestCtx,
 		InputTokens:              0, // Will be set from streaming usage data in logUsage()
 		OutputTokens:             0, // Will be calculated from stream content
-		AccumulatedContent:       strings.Builder{},
 		WasOptimized:             promptOptimizationResult != nil && promptOptimizationResult.WasOptimized,
 		OptimizationStatus:       "success",
 		FallbackReason:           "",
 		PromptOptimizationResult: promptOptimizationResult,
+		ContextCompression:       req.ContextCompression,
 		Closed:                   false,
 		UsageLogged:              false,
+		EstimatedInputTokens:     inputTokens,
 		GenerationService:        s,
-		StartTime:                time.Now(),
+		StartTime:                start,
 		// Token savings tracking
 		InputTokensSaved:  0, // Will be set by real-time marker detection
 		OutputTokensSaved: 0, // Will be set by real-time marker detection
 		TotalTokensSaved:  0, // Will be updated when output savings are detected
+		RequestedModel:    req.RequestedModel,
+		BYOK:              req.BYOK,
+		Moderation:        moderation,
+		SystemPrompts:     req.SystemPrompts,
+		TemplateID:        req.TemplateID,
+		TemplateVersion:   req.TemplateVersion,
+		Experiment:        req.Experiment,
+		Routing:           req.Routing,
+		Span:              span,
+		Ctx:               streamCtx,
+		Cancel:            streamCancel,
+		Timeout:           timeout,
+
+		ProviderReservation: reservation,
+		MaxOutputTokens:     requestCtx.PricingTier.MaxStreamOutputTokens,
+		MaxOutputBytes:      requestCtx.PricingTier.MaxStreamOutputBytes,
+		Pricing:             requestCtx.ModelPricing(modelConfig),
+		Payload:             payload,
+		ShadowRequest:       s.shadowRequest(sent, req, requestCtx),
+		BalanceHold:         hold,
 	}
 
+	// The completion is only kept when something reads it once the stream ends
+	enhancedStream.RetainCompletion = payload != nil || enhancedStream.ShadowRequest != nil ||
+		(moderation != nil && requestCtx.PricingTier.Moderation.Completions)
+
 	// If optimization was used, set the fallback reason
 	if promptOptimizationResult != nil && promptOptimizationResult.FallbackReason != "" {
 		enhancedStream.FallbackReason = promptOptimizationResult.FallbackReason
@@ -649,87 +1362,111 @@ func (s *GenerationService) GenerateStream(ctx context.Context, req *GenerationR
 	// Add optimization metadata
 	metadata["was_optimized"] = fmt.Sprintf("%v", promptOptimizationResult.WasOptimized)
 	metadata["optimization_type"] = promptOptimizationResult.OptimizationType
+	if promptOptimizationResult.Guard != "" {
+		metadata["optimization_guard"] = promptOptimizationResult.Guard
+	}
 	metadata["original_prompt_length"] = fmt.Sprintf("%d", len(originalPrompt))
 	metadata["optimized_prompt_length"] = fmt.Sprintf("%d", len(req.Prompt))
+	if enhancedStream.Pricing.Override {
+		metadata["custom_pricing"] = "true"
+	}
+	if requestCtx.TestMode {
+		metadata["test_mode"] = "true"
+	}
+	if promptOptimizationResult.OptimizerCost > 0 || promptOptimizationResult.NetTokensSaved != 0 {
+		metadata["optimizer_cost"] = promptOptimizationResult.OptimizerCost.String()
+		metadata["net_tokens_saved"] = fmt.Sprintf("%d", promptOptimizationResult.NetTokensSaved)
+		metadata["net_savings"] = promptOptimizationResult.NetSavings.String()
+	}
+	if len(req.SystemPrompts) > 0 {
+		versions := make([]string, len(req.SystemPrompts))
+		for i, ref := range req.SystemPrompts {
+			versions[i] = fmt.Sprintf("%s:%d", ref.Scope, ref.Version)
+		}
+		metadata["system_prompts"] = strings.Join(versions, ",")
+	}
+	if req.TemplateID != "" {
+		metadata["template_id"] = req.TemplateID
+		metadata["template_version"] = fmt.Sprintf("%d", req.TemplateVersion)
+	}
+	if compression := req.ContextCompression; compression != nil {
+		metadata["context_compression"] = compression.Strategy
+		metadata["turns_compressed"] = fmt.Sprintf("%d", compression.TurnsCompressed)
+		metadata["context_compression_cost"] = compression.Cost.String()
+	}
 
-	// Return enhanced stream response
+	// Return enhanced stream response, post-processed after the enhanced reader has seen the raw
+	// content so optimization markers are still counted
 	return &data.StreamResponse{
-		Stream:   enhancedStream,
+		Stream:   newPostProcessedStream(enhancedStream, NewResponsePipeline(requestCtx.PostProcessing, enhancedStream.WasOptimized)),
 		Metadata: metadata,
 	}, nil
 }
 
-// handleNonStreamingGeneration handles non-streaming text generation
-func (s *GenerationService) handleNonStreamingGeneration(ctx context.Context, req *GenerationRequest, modelConfig ModelConfig, requestCtx *RequestContext) (*GenerationResult, error) {
-	// Step 1: Optimize input prompt if optimization is enabled and prompt is long enough
-	var promptOptimizationResult *OptimizationResult
-
-	if s.optimizer != nil && s.config.Optimization.Enabled && s.optimizer.ShouldOptimize(req.Prompt, 50) {
-		// Try to optimize the prompt
-		optimizationResult, err := s.optimizer.OptimizePromptWithMode(ctx, req.Prompt, req.OptimizationMode)
-		if err != nil {
-			if s.config.Optimization.FallbackOnOptimizationFailure {
-				requestCtx.Logger.Warn("Prompt optimization failed, using original prompt", "error", err)
-				promptOptimizationResult = &OptimizationResult{
-					OriginalText:     req.Prompt,
-					OptimizedText:    req.Prompt,
-					OriginalTokens:   0,
-					OptimizedTokens:  0,
-					TokensSaved:      0,
-					SavingsPercent:   0,
-					OptimizationType: "none",
-					WasOptimized:     false,
-					FallbackReason:   "optimization_failed",
-				}
-			} else {
-				return nil, fmt.Errorf("prompt optimization failed: %w", err)
-			}
-		} else {
-			promptOptimizationResult = optimizationResult
-			if optimizationResult.WasOptimized {
-				req.Prompt = optimizationResult.OptimizedText
-				requestCtx.Logger.Info("Prompt optimized successfully",
-					"original_tokens", optimizationResult.OriginalTokens,
-					"optimized_tokens", optimizationResult.OptimizedTokens,
-					"tokens_saved", optimizationResult.TokensSaved,
-					"savings_percent", fmt.Sprintf("%.1f%%", optimizationResult.SavingsPercent))
-			}
-		}
-	}
-
-	// Add response optimization prompt to get AI estimate of output tokens saved
-	if promptOptimizationResult != nil && promptOptimizationResult.WasOptimized {
-		responseOptimizationPrompt := "\n\nIMPORTANT: Be concise and efficient. After your response, append exactly: tokens_saved=<number> where <number> is your estimate of how many tokens you saved by being concise compared to a verbose response."
-		req.Prompt += responseOptimizationPrompt
-		requestCtx.Logger.Info("Added response optimization prompt for AI estimation", "prompt_length", len(req.Prompt))
-	}
-
+// handleNonStreamingGeneration handles non-streaming text generation of a prompt the caller has
+// already optimized, with the outcome in promptOptimizationResult
+func (s *GenerationService) handleNonStreamingGeneration(ctx context.Context, req *GenerationRequest, modelConfig ModelConfig, requestCtx *RequestContext, promptOptimizationResult *OptimizationResult) (*GenerationResult, error) {
 	// Step 2: Create LLM client
-	client, err := s.createLLMClient(modelConfig, req)
+	client, err := s.createLLMClient(ctx, modelConfig, req, requestCtx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create LLM client: %w", err)
 	}
 
+	// The hold is returned with the result and kept until the caller has charged it
+	hold, err := s.reserveBalance(ctx, req, modelConfig, requestCtx)
+	if err != nil {
+		return nil, err
+	}
+
 	// Step 3: Prepare generation parameters
 	params := map[string]interface{}{
-		"model":       req.Model,
-		"prompt":      req.Prompt,
-		"max_tokens":  req.MaxTokens,
-		"temperature": req.Temperature,
-		"top_p":       req.TopP,
-		"stream":      false,
+		"model":      req.Model,
+		"prompt":     req.Prompt,
+		"max_tokens": req.MaxTokens,
+		"stream":     false,
 	}
+	addSamplingParams(params, req)
 
 	// Add any extra parameters
 	for key, value := range req.Extra {
 		params[key] = value
 	}
+	addSystemParam(params, req)
 
-	// Step 4: Generate response
-	resp, err := client.GenerateWithParams(ctx, params)
+	// Wait for capacity under the provider's rate limits before the provider timeout starts
+	reservation, err := s.reserveProviderCapacity(ctx, modelConfig, req, requestCtx)
 	if err != nil {
+		hold.Release()
+		return nil, err
+	}
+
+	// Step 4: Generate response with timeout
+	timeout := s.providerTimeout(req, modelConfig, false)
+	providerCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	providerCtx, span := tracer.Start(providerCtx, "provider.generate",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(providerSpanAttributes(modelConfig, req)...),
+	)
+	resp, err := client.GenerateWithParams(providerCtx, params)
+	if err != nil {
+		// Provider errors don't wrap the context error, so check the deadline directly
+		if errors.Is(providerCtx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("%w after %s", ErrProviderTimeout, timeout)
+		}
+		recordSpanError(span, err)
+		span.End()
+		reservation.Settle(0)
+		hold.Release()
 		return nil, fmt.Errorf("generation failed: %w", err)
 	}
+	reservation.Settle(resp.InputTokens + resp.OutputTokens)
+	span.SetAttributes(
+		attribute.Int("gen_ai.usage.input_tokens", resp.InputTokens),
+		attribute.Int("gen_ai.usage.output_tokens", resp.OutputTokens),
+	)
+	span.End()
 
 	// Step 5: Use actual input tokens from response usage
 	inputTokensSaved := 0
@@ -803,11 +1540,13 @@ func (s *GenerationService) handleNonStreamingGeneration(ctx context.Context, re
 			FinishReason: resp.FinishReason,
 			CreatedAt:    time.Now().Unix(),
 			Metadata:     convertMetadata(resp.Metadata),
+			Logprobs:     resp.Logprobs,
 		},
 		WasOptimized:             promptOptimizationResult != nil && promptOptimizationResult.WasOptimized,
 		OptimizationStatus:       "success",
 		FallbackReason:           "",
 		PromptOptimizationResult: promptOptimizationResult,
+		BalanceHold:              hold,
 	}
 
 	// Add usage information
@@ -816,6 +1555,11 @@ func (s *GenerationService) handleNonStreamingGeneration(ctx context.Context, re
 			InputTokens:  resp.Usage.PromptTokens,
 			OutputTokens: resp.Usage.CompletionTokens,
 			TotalTokens:  resp.Usage.TotalTokens,
+			Details: data.TokenDetails{
+				CacheReadTokens:  resp.Usage.CachedInputTokens,
+				CacheWriteTokens: resp.Usage.CacheWriteInputTokens,
+				ReasoningTokens:  resp.Usage.ReasoningTokens,
+			},
 		}
 	}
 
@@ -833,6 +1577,14 @@ func (s *GenerationService) handleNonStreamingGeneration(ctx context.Context, re
 		result.Response.Metadata["fallback_reason"] = promptOptimizationResult.FallbackReason
 		result.FallbackReason = promptOptimizationResult.FallbackReason
 	}
+	if promptOptimizationResult != nil && promptOptimizationResult.Guard != "" {
+		result.Response.Metadata["optimization_guard"] = promptOptimizationResult.Guard
+	}
+	if promptOptimizationResult != nil {
+		result.Response.Metadata["optimizer_cost"] = promptOptimizationResult.OptimizerCost
+		result.Response.Metadata["net_tokens_saved"] = promptOptimizationResult.NetTokensSaved
+		result.Response.Metadata["net_savings"] = promptOptimizationResult.NetSavings
+	}
 
 	// Debug logs for token savings (no re-parsing)
 	requestCtx.Logger.Info("Non-streaming: Final input/output tokens saved", "input_tokens_saved", inputTokensSaved, "output_tokens_saved", outputTokensSaved)
@@ -850,106 +1602,641 @@ func convertMetadata(metadata map[string]string) map[string]interface{} {
 	return result
 }
 
-// createLLMClient creates an LLM client for the specified model
-func (s *GenerationService) createLLMClient(modelConfig ModelConfig, req *GenerationRequest) (data.LLMClient, error) {
-	// Determine which API key to use based on provider and request
-	var apiKey string
+// createLLMClient creates an LLM client for the specified model.
+// Keys are chosen in order: a key supplied with the request, the user's stored key, then the platform key.
+func (s *GenerationService) createLLMClient(ctx context.Context, modelConfig ModelConfig, req *GenerationRequest, requestCtx *RequestContext) (data.LLMClient, error) {
+	// Test API keys never reach a provider
+	if s.config.Dev.Enabled || requestCtx.TestMode {
+		return s.faults.Wrap(data.NewFakeClient(modelConfig.ModelID, modelConfig.Provider, s.config.Dev.FakeResponse), modelConfig.Provider, modelConfig.ModelID), nil
+	}
+
+	var requestKey, platformKey string
 
 	switch modelConfig.Provider {
 	case "openai":
-		if req.OpenAIAPIKey != "" {
-			apiKey = req.OpenAIAPIKey
-		} else {
-			apiKey = s.config.LLM.OpenAIAPIKey
-		}
+		requestKey, platformKey = req.OpenAIAPIKey, s.config.ProviderKey("openai")
 	case "anthropic":
-		if req.AnthropicAPIKey != "" {
-			apiKey = req.AnthropicAPIKey
-		} else {
-			apiKey = s.config.LLM.AnthropicAPIKey
-		}
+		requestKey, platformKey = req.AnthropicAPIKey, s.config.ProviderKey("anthropic")
 	case "google":
-		if req.GoogleAPIKey != "" {
-			apiKey = req.GoogleAPIKey
-		} else {
-			apiKey = s.config.LLM.GoogleAPIKey
-		}
+		requestKey, platformKey = req.GoogleAPIKey, s.config.ProviderKey("google")
 	default:
 		return nil, fmt.Errorf("unsupported provider: %s", modelConfig.Provider)
 	}
 
+	apiKey := requestKey
+	if apiKey == "" && !req.Shadow {
+		storedKey, err := s.providerKeys.ResolveKey(ctx, requestCtx.UserID, modelConfig.Provider)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve stored provider key: %w", err)
+		}
+		apiKey = storedKey
+	}
+	req.BYOK = apiKey != ""
+	if apiKey == "" {
+		apiKey = platformKey
+	}
+
+	// Requests on the platform's keys are spread across the provider's endpoints; callers' own keys
+	// are only valid on the provider's default endpoint
+	var endpoint *utils.ProviderEndpoint
+	if !req.BYOK {
+		endpoint = s.endpoints.Select(modelConfig.Provider, requestCtx.UserID)
+		if endpoint != nil && endpoint.APIKey != "" {
+			apiKey = endpoint.APIKey
+		}
+	}
+
 	if apiKey == "" {
 		return nil, fmt.Errorf("no API key provided for provider: %s", modelConfig.Provider)
 	}
 
-	// Create client using the factory function
-	return data.NewClientForModel(modelConfig.ModelID, modelConfig.Provider, apiKey)
+	if req.BYOK {
+		requestCtx.Logger.Info("Using caller's own provider key", "provider", modelConfig.Provider)
+	}
+
+	var target *data.Endpoint
+	if endpoint != nil && endpoint.Name != utils.DefaultEndpointName {
+		target = &data.Endpoint{Name: endpoint.Name, BaseURL: endpoint.BaseURL, AuthHeader: endpoint.AuthHeader}
+	}
+
+	// Platform keys are spread across the provider's pooled keys, unless the endpoint has its own
+	var client data.LLMClient
+	if !req.BYOK && apiKey == platformKey && s.keyPool.Pooled(modelConfig.Provider) {
+		client = &pooledKeyClient{
+			pool:     s.keyPool,
+			provider: modelConfig.Provider,
+			newClient: func(apiKey string) (data.LLMClient, error) {
+				return s.newProviderClient(modelConfig, apiKey, target)
+			},
+		}
+	} else {
+		var err error
+		client, err = s.newProviderClient(modelConfig, apiKey, target)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if endpoint == nil {
+		return client, nil
+	}
+	requestCtx.Logger.Debug("Routing request to provider endpoint", "provider", modelConfig.Provider, "endpoint", endpoint.Name)
+	return &endpointClient{LLMClient: client, router: s.endpoints, provider: modelConfig.Provider, endpoint: endpoint.Name}, nil
 }
 
-// CalculateCost calculates the cost for a request
-func (s *GenerationService) CalculateCost(inputTokens, outputTokens int, modelConfig ModelConfig, pricingTier PricingTier) float64 {
-	// Calculate base cost
-	inputCost := float64(inputTokens) * modelConfig.InputPricePerMillion / 1000000
-	outputCost := float64(outputTokens) * modelConfig.OutputPricePerMillion / 1000000
-	baseCost := inputCost + outputCost
+// newProviderClient creates the client that calls a model's provider with apiKey at target, with
+// any configured faults injected closest to the provider so key pools, endpoint routing and retries
+// see them as provider failures
+func (s *GenerationService) newProviderClient(modelConfig ModelConfig, apiKey string, target *data.Endpoint) (data.LLMClient, error) {
+	client, err := s.clientFactory(modelConfig.ModelID, modelConfig.Provider, apiKey, target)
+	if err != nil {
+		return nil, err
+	}
+	return s.faults.Wrap(client, modelConfig.Provider, modelConfig.ModelID), nil
+}
 
-	// Apply pricing tier markups (percentage-based)
-	inputMarkup := inputCost * (pricingTier.InputMarkupPercent / 100)
-	outputMarkup := outputCost * (pricingTier.OutputMarkupPercent / 100)
-	totalMarkup := inputMarkup + outputMarkup
+// KeyPool returns the pool that spreads requests across the providers' platform keys
+func (s *GenerationService) KeyPool() *ProviderKeyPool {
+	return s.keyPool
+}
 
-	return baseCost + totalMarkup
+// Endpoints returns the router that spreads requests across the providers' endpoints
+func (s *GenerationService) Endpoints() *EndpointRouter {
+	return s.endpoints
 }
 
-// calculateEstimatedCost calculates an estimated cost for a request
-func (s *GenerationService) calculateEstimatedCost(inputTokens, outputTokens int, modelConfig ModelConfig, pricingTier PricingTier) float64 {
-	// Use the same calculation as actual cost for now
-	// In the future, this could include additional factors like optimization savings
-	return s.CalculateCost(inputTokens, outputTokens, modelConfig, pricingTier)
+// addSamplingParams adds the sampling parameters set on the request to provider params.
+// Unset parameters are left out so each provider applies its own default.
+func addSamplingParams(params map[string]interface{}, req *GenerationRequest) {
+	if req.Temperature != nil {
+		params["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		params["top_p"] = *req.TopP
+	}
+	if len(req.Stop) > 0 {
+		params["stop"] = req.Stop
+	}
+	if req.FrequencyPenalty != nil {
+		params["frequency_penalty"] = *req.FrequencyPenalty
+	}
+	if req.PresencePenalty != nil {
+		params["presence_penalty"] = *req.PresencePenalty
+	}
+	if req.Seed != nil {
+		params["seed"] = *req.Seed
+	}
+	if req.ReasoningEffort != "" {
+		params["reasoning_effort"] = req.ReasoningEffort
+	}
+	if req.ThinkingBudget > 0 {
+		params["thinking_budget"] = req.ThinkingBudget
+	}
+	if req.CacheSystem {
+		params["cache_system"] = true
+	}
+	if req.CachePrompt {
+		params["cache_prompt"] = true
+	}
+	if req.Logprobs {
+		params["logprobs"] = true
+		if req.TopLogprobs != nil {
+			params["top_logprobs"] = *req.TopLogprobs
+		}
+	}
 }
 
-// checkUserBalance checks the user's balance
-func (s *GenerationService) checkUserBalance(ctx context.Context, userID string) (bool, float64, error) {
-	// Get user from cache
-	cacheKey := fmt.Sprintf("user:%s", userID)
+// applyRouting routes the request to the target of the first routing rule it matches and records
+// how every rule evaluated it. Routing runs before experiments, so an experiment's model wins.
+func (s *GenerationService) applyRouting(ctx context.Context, req *GenerationRequest, requestCtx *RequestContext) {
+	// Shadow requests run on the model they were given
+	if req.Shadow || s.routing == nil {
+		return
+	}
+	modelConfig, err := s.modelCatalog.GetModelConfig(req.Model)
+	if err != nil {
+		// Unknown models are rejected once the request is resolved
+		return
+	}
 
-	var cachedUser *CachedUserData
-	if cached, found := s.cache.Get(cacheKey); found {
-		if userData, ok := cached.(*CachedUserData); ok {
-			// Check if cache is still valid (5 minutes)
-			if time.Since(userData.LastUpdated) < 5*time.Minute {
-				cachedUser = userData
-			}
+	decision := s.routing.Route(ctx, RoutingInput{
+		Model:        modelConfig.ModelID,
+		Provider:     modelConfig.Provider,
+		PromptTokens: s.tokenizers.Estimate(modelConfig, req.System) + s.tokenizers.Estimate(modelConfig, req.Prompt),
+		TierID:       requestCtx.PricingTier.ID,
+		Time:         time.Now(),
+	}, requestCtx)
+	if decision == nil {
+		return
+	}
+	req.Routing = decision
+	requestCtx.Logger.Debug("Routing rules evaluated", "evaluations", decision.Evaluations)
+
+	if decision.ToModel == "" || decision.ToModel == req.Model {
+		return
+	}
+	requestCtx.Logger.Info("Routing rule routed request", "rule_id", decision.RuleID, "model", req.Model, "routed_model", decision.ToModel)
+	if req.RequestedModel == "" {
+		req.RequestedModel = req.Model
+	}
+	req.Model = decision.ToModel
+}
+
+// applyExperiment assigns the request to an experiment variant and applies the treatment's overrides.
+// Optimization modes the caller chose explicitly are kept.
+func (s *GenerationService) applyExperiment(ctx context.Context, req *GenerationRequest, requestCtx *RequestContext) {
+	// Shadow requests run as mirrored, outside any experiment
+	if req.Shadow {
+		return
+	}
+	assignment := s.experiments.Assign(ctx, requestCtx)
+	if assignment == nil {
+		return
+	}
+	req.Experiment = assignment
+
+	overrides := assignment.Overrides
+	if overrides.OptimizationMode != "" && req.OptimizationMode == "" {
+		req.OptimizationMode = overrides.OptimizationMode
+	}
+	if overrides.Model != "" && overrides.Model != req.Model {
+		requestCtx.Logger.Info("Experiment routed request", "experiment_id", assignment.ExperimentID, "model", req.Model, "experiment_model", overrides.Model)
+		if req.RequestedModel == "" {
+			req.RequestedModel = req.Model
 		}
+		req.Model = overrides.Model
+	}
+}
+
+// OptimizerAvailable reports whether prompt optimization is enabled and its model initialized
+func (s *GenerationService) OptimizerAvailable() bool {
+	return s.optimizer != nil && s.config.Optimization.Enabled
+}
+
+// optimizerFor returns the optimizer for a request: none when its experiment variant disables
+// optimization, the variant's optimizer model if it sets one, and otherwise the default
+func (s *GenerationService) optimizerFor(req *GenerationRequest) *Optimizer {
+	if req.Experiment == nil {
+		return s.optimizer
 	}
 
-	// Cache miss or expired, load from Firebase
-	if cachedUser == nil {
-		user, err := s.firebaseService.GetUserByID(ctx, userID)
+	overrides := req.Experiment.Overrides
+	if overrides.DisableOptimization || s.config.Dev.Enabled {
+		return nil
+	}
+	if overrides.OptimizerModel == "" || (s.optimizer != nil && overrides.OptimizerModel == s.optimizer.model) {
+		return s.optimizer
+	}
+
+	s.optimizersMu.Lock()
+	defer s.optimizersMu.Unlock()
+
+	if optimizer, ok := s.optimizers[overrides.OptimizerModel]; ok {
+		return optimizer
+	}
+	optimizer, err := NewOptimizer(overrides.OptimizerModel, s.config.ProviderKey("google"))
+	if err != nil {
+		slog.Error("Failed to initialize experiment optimizer, using the default", "model", overrides.OptimizerModel, "error", err)
+		return s.optimizer
+	}
+	s.optimizers[overrides.OptimizerModel] = optimizer
+	return optimizer
+}
+
+// The length a prompt must exceed to be optimized when its tier sets no threshold. Streams wait for
+// the optimizer before their first token, so they only optimize longer prompts.
+const (
+	minOptimizedPromptChars       = 50
+	minOptimizedStreamPromptChars = 100
+)
+
+// optimizePrompt optimizes the request's prompt in place when optimization is enabled for it and the
+// prompt exceeds its tier's threshold for the model, or defaultMinLength when the tier sets none. It
+// returns nil when no optimization was attempted. An optimized prompt is only used when its savings,
+// net of the optimizer's own cost, reach the configured minimum.
+func (s *GenerationService) optimizePrompt(ctx context.Context, req *GenerationRequest, modelConfig ModelConfig, requestCtx *RequestContext, defaultMinLength int) (*OptimizationResult, error) {
+	optimizer := s.optimizerFor(req)
+	if req.DisableOptimization || requestCtx.TestMode || optimizer == nil || !s.config.Optimization.Enabled {
+		return nil, nil
+	}
+	minLength, eligible := requestCtx.PricingTier.Optimization.Threshold(modelConfig.ModelID, defaultMinLength)
+	if !eligible || !optimizer.ShouldOptimize(req.Prompt, minLength) {
+		return nil, nil
+	}
+
+	// Rewording tool, JSON and code requests can break the workflows built on them
+	var result *OptimizationResult
+	guard, restricted := optimizationGuard(req)
+	switch {
+	case guard != "" && !restricted:
+		requestCtx.Logger.Info("Prompt optimization bypassed", "guard", guard)
+		return &OptimizationResult{
+			OriginalText:     req.Prompt,
+			OptimizedText:    req.Prompt,
+			OptimizationType: "none",
+			FallbackReason:   "guarded",
+			Guard:            guard,
+		}, nil
+	case guard != "":
+		requestCtx.Logger.Info("Prompt optimization restricted to whitespace", "guard", guard)
+		result = WhitespaceOptimization(req.Prompt)
+		result.Guard = guard
+	default:
+		// Try to optimize the prompt within the optimization timeout
+		optCtx, optCancel := context.WithTimeout(ctx, s.config.Timeouts.Optimization)
+		optimized, err := optimizer.OptimizePromptWithMode(optCtx, req.Prompt, req.OptimizationMode, !req.DisableRuleOptimization)
+		optCancel()
 		if err != nil {
-			return false, 0, fmt.Errorf("failed to get user from Firebase: %w", err)
+			if !s.config.Optimization.FallbackOnOptimizationFailure {
+				return nil, fmt.Errorf("prompt optimization failed: %w", err)
+			}
+			requestCtx.Logger.Warn("Prompt optimization failed, using original prompt", "error", err)
+			return &OptimizationResult{
+				OriginalText:     req.Prompt,
+				OptimizedText:    req.Prompt,
+				OptimizationType: "none",
+				FallbackReason:   "optimization_failed",
+			}, nil
 		}
+		result = optimized
+	}
+
+	s.recountOptimization(result, modelConfig)
+	overheadTokens := s.priceOptimizer(result, optimizer, modelConfig)
+	if result.WasOptimized && float64(result.TokensSaved-overheadTokens) < float64(result.OriginalTokens)*s.config.Optimization.MinSavingsPercent/100 {
+		requestCtx.Logger.Info("Optimized prompt saves too little, using original prompt",
+			"tokens_saved", result.TokensSaved,
+			"optimizer_overhead_tokens", overheadTokens,
+			"min_savings_percent", s.config.Optimization.MinSavingsPercent)
+		result.OptimizedText = req.Prompt
+		result.OptimizedTokens = result.OriginalTokens
+		result.TokensSaved = 0
+		result.SavingsPercent = 0
+		result.WasOptimized = false
+		result.FallbackReason = "below_savings_threshold"
+	}
+
+	// The optimizer's cost is spent whether or not its prompt is used
+	result.NetTokensSaved = result.TokensSaved - overheadTokens
+	result.NetSavings = data.ComputeCost(result.TokensSaved, 0, modelConfig.InputPricePerMillion, 0,
+		requestCtx.PricingTier.InputMarkupPercent, 0).Total() - result.OptimizerCost
+	if !result.WasOptimized {
+		return result, nil
+	}
+
+	req.Prompt = result.OptimizedText
+	requestCtx.Logger.Info("Prompt optimized successfully",
+		"original_tokens", result.OriginalTokens,
+		"optimized_tokens", result.OptimizedTokens,
+		"tokens_saved", result.TokensSaved,
+		"net_tokens_saved", result.NetTokensSaved,
+		"optimizer_cost", result.OptimizerCost,
+		"savings_percent", fmt.Sprintf("%.1f%%", result.SavingsPercent))
+	return result, nil
+}
+
+// recountOptimization recounts an optimization's token savings with the target model's tokenizer,
+// since the optimizer counts every prompt the same way whichever model it is sent to
+func (s *GenerationService) recountOptimization(result *OptimizationResult, modelConfig ModelConfig) {
+	if !result.WasOptimized {
+		return
+	}
+	result.OriginalTokens = s.tokenizers.Estimate(modelConfig, result.OriginalText)
+	result.OptimizedTokens = s.tokenizers.Estimate(modelConfig, result.OptimizedText)
+	result.TokensSaved = result.OriginalTokens - result.OptimizedTokens
+	result.SavingsPercent = 0
+	if result.OriginalTokens > 0 {
+		result.SavingsPercent = float64(result.TokensSaved) / float64(result.OriginalTokens) * 100
+	}
+}
+
+// priceOptimizer sets the optimizer call's cost from the optimizer model's configuration and returns
+// it in input tokens of the target model. An optimizer model without a configuration is treated as free.
+func (s *GenerationService) priceOptimizer(result *OptimizationResult, optimizer *Optimizer, modelConfig ModelConfig) int {
+	if result.OptimizerInputTokens == 0 && result.OptimizerOutputTokens == 0 {
+		return 0
+	}
+	optimizerConfig, err := s.modelCatalog.GetModelConfig(optimizer.model)
+	if err != nil {
+		return 0
+	}
+
+	result.OptimizerCost = data.ComputeCost(result.OptimizerInputTokens, result.OptimizerOutputTokens,
+		optimizerConfig.InputPricePerMillion, optimizerConfig.OutputPricePerMillion, 0, 0).Base()
+	if modelConfig.InputPricePerMillion <= 0 {
+		return 0
+	}
+	optimizerSpend := float64(result.OptimizerInputTokens)*optimizerConfig.InputPricePerMillion +
+		float64(result.OptimizerOutputTokens)*optimizerConfig.OutputPricePerMillion
+	return int(math.Ceil(optimizerSpend / modelConfig.InputPricePerMillion))
+}
+
+// applyTemplate renders the prompt from the request's template, if it names one
+func (s *GenerationService) applyTemplate(ctx context.Context, req *GenerationRequest, requestCtx *RequestContext) error {
+	if req.TemplateID == "" {
+		return nil
+	}
+
+	template, prompt, err := s.templates.Render(ctx, requestCtx, req.TemplateID, req.TemplateVersion, req.Variables)
+	if err != nil {
+		return err
+	}
+
+	req.Prompt = prompt
+	req.TemplateVersion = template.Version
+	return nil
+}
+
+// checkContextWindow counts the request's input tokens with the model's tokenizer and rejects a
+// request whose input and max_tokens do not fit the model's context window, or whose input is over
+// its tier's prompt limit. Prompts over the server's byte limit are rejected before they are
+// counted. Test mode requests are counted locally, since a provider tokenizer would call the provider.
+func (s *GenerationService) checkContextWindow(ctx context.Context, req *GenerationRequest, modelConfig ModelConfig, requestCtx *RequestContext) (int, error) {
+	if limit := s.config.Server.MaxPromptBytes; limit > 0 && len(req.System)+len(req.Prompt) > limit {
+		requestCtx.Logger.Warn("Prompt too large to tokenize",
+			"model", modelConfig.ModelID,
+			"prompt_bytes", len(req.System)+len(req.Prompt),
+			"limit", limit)
+		return 0, fmt.Errorf("%w: %d bytes is over the %d byte limit", ErrPromptTooLarge, len(req.System)+len(req.Prompt), limit)
+	}
+
+	var inputTokens int
+	if requestCtx.TestMode {
+		inputTokens = s.tokenizers.Estimate(modelConfig, req.System) + s.tokenizers.Estimate(modelConfig, req.Prompt)
+	} else {
+		inputTokens = s.tokenizers.Count(ctx, modelConfig, req.System, req.Prompt)
+	}
+	if err := CheckContextWindow(modelConfig, inputTokens, req.MaxTokens); err != nil {
+		requestCtx.Logger.Warn("Request exceeds context window",
+			"model", modelConfig.ModelID,
+			"input_tokens", inputTokens,
+			"max_tokens", req.MaxTokens,
+			"context_window", modelConfig.ContextWindowSize)
+		return 0, err
+	}
+	if limit := requestCtx.PricingTier.MaxPromptTokens; limit > 0 && inputTokens > limit {
+		requestCtx.Logger.Warn("Prompt over tier limit",
+			"model", modelConfig.ModelID,
+			"input_tokens", inputTokens,
+			"tier", requestCtx.PricingTier.ID,
+			"limit", limit)
+		return 0, fmt.Errorf("%w: %d prompt tokens is over the %d token limit", ErrPromptTooLong, inputTokens, limit)
+	}
+	return inputTokens, nil
+}
+
+// reserveProviderCapacity waits for the provider's rate limits to admit a request, reserving its
+// prompt and max_tokens. BYOK requests run under the caller's own provider limits and test mode requests
+// never reach the provider, so they are not counted.
+func (s *GenerationService) reserveProviderCapacity(ctx context.Context, modelConfig ModelConfig, req *GenerationRequest, requestCtx *RequestContext) (*ProviderReservation, error) {
+	if req.BYOK || requestCtx.TestMode {
+		return nil, nil
+	}
+
+	start := time.Now()
+	reservation, err := s.providerLimits.Acquire(ctx, modelConfig.Provider, s.tokenizers.Estimate(modelConfig, req.System)+s.tokenizers.Estimate(modelConfig, req.Prompt)+req.MaxTokens, requestCtx.Priority)
+	if err != nil {
+		requestCtx.Logger.Warn("Request throttled by provider rate limit", "provider", modelConfig.Provider, "error", err)
+		return nil, err
+	}
+	if waited := time.Since(start); waited > time.Second {
+		requestCtx.Logger.Info("Request queued for provider capacity", "provider", modelConfig.Provider, "wait_ms", waited.Milliseconds())
+	}
+	return reservation, nil
+}
+
+// addSystemParam sets the managed system prompt ahead of any system instructions the caller sent,
+// so callers cannot drop it through extra parameters
+func addSystemParam(params map[string]interface{}, req *GenerationRequest) {
+	if req.System == "" {
+		return
+	}
+	if callerSystem, ok := params["system"].(string); ok && callerSystem != "" {
+		params["system"] = req.System + "\n\n" + callerSystem
+		return
+	}
+	params["system"] = req.System
+}
+
+// applySystemPrompts attaches the managed system prompts for the caller's organization and key to req
+func (s *GenerationService) applySystemPrompts(ctx context.Context, req *GenerationRequest, requestCtx *RequestContext) error {
+	if s.systemPrompts == nil {
+		return nil
+	}
+
+	prompts, err := s.systemPrompts.Resolve(ctx, requestCtx.OrgID, requestCtx.APIKeyID)
+	if err != nil {
+		return fmt.Errorf("failed to load system prompts: %w", err)
+	}
+
+	contents := make([]string, 0, len(prompts))
+	for _, prompt := range prompts {
+		contents = append(contents, prompt.Content)
+		req.SystemPrompts = append(req.SystemPrompts, prompt.Ref())
+	}
+	req.System = strings.Join(contents, "\n\n")
+	return nil
+}
+
+// resolveModelAlias replaces an aliased model name with the concrete model it currently points to
+func (s *GenerationService) resolveModelAlias(ctx context.Context, req *GenerationRequest, requestCtx *RequestContext) error {
+	modelID, err := s.modelCatalog.ResolveModel(ctx, requestCtx.OrgID, req.Model)
+	if err != nil {
+		return fmt.Errorf("failed to resolve model %s: %w", req.Model, err)
+	}
+
+	if modelID != req.Model {
+		requestCtx.Logger.Info("Resolved model alias", "alias", req.Model, "model_id", modelID)
+		req.RequestedModel = req.Model
+		req.Model = modelID
+	}
+	return nil
+}
+
+// providerTimeout returns the timeout for a provider call: the request's override, then the
+// model's configured timeout, then the global default, never exceeding the server maximum
+func (s *GenerationService) providerTimeout(req *GenerationRequest, modelConfig ModelConfig, streaming bool) time.Duration {
+	timeout := s.config.Timeouts.Provider
+	if streaming {
+		timeout = s.config.Timeouts.Streaming
+	}
+
+	switch {
+	case req.Timeout > 0:
+		timeout = req.Timeout
+	case modelConfig.TimeoutSeconds > 0:
+		timeout = time.Duration(modelConfig.TimeoutSeconds) * time.Second
+	}
+
+	if limit := s.config.Timeouts.MaxRequest; limit > 0 && timeout > limit {
+		timeout = limit
+	}
+	return timeout
+}
 
-		cachedUser = &CachedUserData{
-			ID:            user.ID,
-			Email:         user.Email,
-			Balance:       user.Balance,
-			TierID:        user.TierID,
-			IsActive:      user.IsActive,
-			CustomPricing: user.CustomPricing,
-			LastUpdated:   time.Now(),
+// applyKeyRestrictions rejects models the API key or its tenant may not use and caps max_tokens to the key's limit
+func (s *GenerationService) applyKeyRestrictions(req *GenerationRequest, modelConfig ModelConfig, requestCtx *RequestContext) error {
+	if err := requestCtx.Restrictions.CheckModel(modelConfig.ModelID, modelConfig.Provider); err != nil {
+		return fmt.Errorf("%w: %v", ErrKeyRestricted, err)
+	}
+	if err := requestCtx.Tenant.CheckModel(modelConfig.ModelID); err != nil {
+		return fmt.Errorf("%w: %v", ErrKeyRestricted, err)
+	}
+
+	if capped := requestCtx.Restrictions.CapMaxTokens(req.MaxTokens); capped != req.MaxTokens {
+		requestCtx.Logger.Info("Capping max_tokens to API key limit", "requested", req.MaxTokens, "limit", capped)
+		req.MaxTokens = capped
+	}
+
+	return nil
+}
+
+// BillingMode returns how a request is billed, depending on whether it was made with a test API key
+// and whether it used the caller's own provider key
+func (s *GenerationService) BillingMode(byok, testMode bool) string {
+	switch {
+	case testMode:
+		return data.BillingModeTest
+	case !byok:
+		return data.BillingModeStandard
+	case s.config.Cost.BYOKBillingMode == "flat":
+		return data.BillingModeBYOKFlat
+	default:
+		return data.BillingModeBYOKMarkup
+	}
+}
+
+// BillableCost returns the amount to charge for a request priced at cost. The provider bills
+// BYOK requests to the caller's own key, so only the platform's share is charged, and test mode
+// requests are free.
+func (s *GenerationService) BillableCost(byok, testMode bool, cost data.CostBreakdown) data.CostBreakdown {
+	switch {
+	case testMode:
+		return data.CostBreakdown{}
+	case !byok:
+		return cost
+	}
+	return cost.ForBYOK(s.BillingMode(byok, testMode), data.USDToMicros(s.config.Cost.BYOKFlatFeeUSD))
+}
+
+// requestCost prices a generation's usage with the pricing its tier applies to the model, adding
+// the optimizer's cost of optimizing its prompt and compressing its conversation, and returns the
+// billable share. Streaming and non-streaming generations are priced by it alike.
+func (s *GenerationService) requestCost(inputTokens, outputTokens int, details data.TokenDetails, modelConfig ModelConfig, pricing data.AppliedPricing, optimization *OptimizationResult, compression *ContextCompression, byok, testMode bool) data.CostBreakdown {
+	cost := data.ComputeDetailedCost(
+		inputTokens,
+		outputTokens,
+		details,
+		modelConfig.TokenRates(),
+		pricing.InputPricePerMillion,
+		pricing.OutputPricePerMillion,
+		pricing.InputMarkupPercent,
+		pricing.OutputMarkupPercent,
+	)
+	if optimization != nil {
+		cost.Optimizer = optimization.OptimizerCost
+	}
+	if compression != nil {
+		cost.Optimizer += compression.Cost
+	}
+	return s.BillableCost(byok, testMode, cost)
+}
+
+// CalculateCost calculates the cost for a request with the prices and markups a tier applies
+func (s *GenerationService) CalculateCost(inputTokens, outputTokens int, pricing data.AppliedPricing) data.CostBreakdown {
+	return data.ComputeCost(
+		inputTokens,
+		outputTokens,
+		pricing.InputPricePerMillion,
+		pricing.OutputPricePerMillion,
+		pricing.InputMarkupPercent,
+		pricing.OutputMarkupPercent,
+	)
+}
+
+// calculateEstimatedCost calculates the estimated billable cost of a request
+func (s *GenerationService) calculateEstimatedCost(inputTokens, outputTokens int, modelConfig ModelConfig, byok bool, requestCtx *RequestContext) data.MicroUSD {
+	// Use the same calculation as actual cost for now
+	// In the future, this could include additional factors like optimization savings
+	cost := s.CalculateCost(inputTokens, outputTokens, requestCtx.ModelPricing(modelConfig))
+	return s.BillableCost(byok, requestCtx.TestMode, cost).Total()
+}
+
+// getCachedUser gets a user's cached data, loading it from Firebase on a miss
+func (s *GenerationService) getCachedUser(ctx context.Context, userID string) (*CachedUserData, error) {
+	cacheKey := UserCacheKey(userID)
+
+	var userData CachedUserData
+	if found, err := s.cache.Get(ctx, cacheKey, &userData); err != nil {
+		slog.Warn("Failed to read user from cache", "user_id", userID, "error", err)
+	} else if found {
+		// Check if cache is still valid (5 minutes)
+		if time.Since(userData.LastUpdated) < 5*time.Minute {
+			return &userData, nil
 		}
+	}
 
-		// Store in cache for 5 minutes
-		s.cache.Set(cacheKey, cachedUser, 5*time.Minute)
+	// Cache miss or expired, load from Firebase
+	user, err := s.usageStore.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user from Firebase: %w", err)
 	}
 
-	// Check if user is active
-	if !cachedUser.IsActive {
-		return false, cachedUser.Balance, fmt.Errorf("user account is inactive")
+	cachedUser := &CachedUserData{
+		ID:            user.ID,
+		Email:         user.Email,
+		Balance:       user.Balance,
+		TierID:        user.TierID,
+		IsActive:      user.IsActive,
+		CustomPricing: user.CustomPricing,
+		LastUpdated:   time.Now(),
+		Credits:       user.AvailableCredits(time.Now()),
+		UserType:      user.Type,
 	}
 
-	// Allow negative balance (graceful handling)
-	// Users can go into negative balance and it will be deducted from next purchase
-	return true, cachedUser.Balance, nil
+	// Store in cache for 5 minutes
+	if err := s.cache.Set(ctx, cacheKey, cachedUser, 5*time.Minute); err != nil {
+		slog.Warn("Failed to store user in cache", "user_id", userID, "error", err)
+	}
+	return cachedUser, nil
 }
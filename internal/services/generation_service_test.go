@@ -0,0 +1,392 @@
+package services_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+	"unicode/utf8"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	apttesting "github.com/apt-router/api/internal/testing"
+	"github.com/apt-router/api/internal/utils"
+	"github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateRoutesThroughCatalog(t *testing.T) {
+	cfg := &utils.Config{
+		LLM:      utils.LLMConfig{OpenAIAPIKey: "platform-openai-key"},
+		Timeouts: utils.TimeoutConfig{Provider: 10 * time.Second, Streaming: 10 * time.Second, MaxRequest: time.Minute},
+	}
+
+	store := apttesting.NewDatastore(t)
+	apttesting.ApplySeed(t, store, "", services.Seed{
+		"users": {"user-1": {"email": "user@example.com", "balance_micros": int64(1_000_000), "is_active": true}},
+	})
+
+	catalog := apttesting.NewCatalog(services.ModelConfig{
+		ModelID:               "model-v2",
+		Provider:              "openai",
+		InputPricePerMillion:  2,
+		OutputPricePerMillion: 4,
+		IsActive:              true,
+	})
+	catalog.Alias("model", "model-v2")
+
+	sharedCache := services.NewSharedCache(cache.New(time.Minute, time.Minute), store, false)
+	audit := services.NewAuditService(store)
+	generation := services.NewGenerationService(cfg, store, sharedCache, catalog,
+		services.NewBillingService(cfg, store, sharedCache, audit, services.NewNotificationService(cfg)),
+		services.NewProviderKeyService(cfg, store),
+		services.NewSystemPromptService(store, sharedCache),
+		services.NewTemplateService(store, sharedCache),
+		services.NewExperimentService(store, nil),
+		services.NewRoutingService(store, catalog),
+	)
+	llm := apttesting.NewLLMClient(
+		apttesting.Response{Text: "Hello!", InputTokens: 100_000, OutputTokens: 50_000},
+		apttesting.Response{Err: &data.ProviderError{Provider: "openai", ModelID: "model-v2", Message: "overloaded"}},
+	)
+	generation.SetClientFactory(llm.Factory())
+
+	ctx := context.Background()
+	requestCtx := func(requestID string) *services.RequestContext {
+		return &services.RequestContext{RequestID: requestID, UserID: "user-1", Logger: slog.Default()}
+	}
+
+	result, err := generation.Generate(ctx, &services.GenerationRequest{Model: "model", Prompt: "Hi"}, requestCtx("req-1"))
+	require.NoError(t, err)
+	assert.Equal(t, "Hello!", result.Response.Text)
+
+	// The alias is routed to the model it resolves to, using the platform key
+	calls := llm.Calls()
+	require.Len(t, calls, 1)
+	assert.Equal(t, "model-v2", calls[0].ModelID)
+	assert.Equal(t, "platform-openai-key", calls[0].APIKey)
+
+	// The provider's usage is priced at the resolved model's rates: 100k input tokens at $2/M
+	// and 50k output tokens at $4/M cost $0.40
+	require.NotNil(t, result.Response.Usage)
+	assert.Equal(t, "model-v2", result.Response.Model)
+	modelConfig, err := catalog.GetModelConfig(result.Response.Model)
+	require.NoError(t, err)
+	cost := generation.CalculateCost(result.Response.Usage.InputTokens, result.Response.Usage.OutputTokens, services.PricingTier{}.PricingFor(modelConfig, false))
+	assert.Equal(t, data.MicroUSD(400_000), cost.Total())
+
+	t.Run("ProviderErrors", func(t *testing.T) {
+		_, err := generation.Generate(ctx, &services.GenerationRequest{Model: "model", Prompt: "Hi"}, requestCtx("req-2"))
+		var providerErr *data.ProviderError
+		assert.True(t, errors.As(err, &providerErr), "got %v", err)
+	})
+
+	t.Run("UnknownModel", func(t *testing.T) {
+		_, err := generation.Generate(ctx, &services.GenerationRequest{Model: "missing", Prompt: "Hi"}, requestCtx("req-3"))
+		assert.Error(t, err)
+		assert.Len(t, llm.Calls(), 2)
+	})
+	t.Run("PromptLimits", func(t *testing.T) {
+		limited := requestCtx("req-4")
+		limited.PricingTier.MaxPromptTokens = 2
+		_, err := generation.Generate(ctx, &services.GenerationRequest{Model: "model", Prompt: "Hello there, how are you?"}, limited)
+		assert.ErrorIs(t, err, services.ErrPromptTooLong)
+
+		cfg.Server.MaxPromptBytes = 16
+		defer func() { cfg.Server.MaxPromptBytes = 0 }()
+		_, err = generation.Generate(ctx, &services.GenerationRequest{Model: "model", Prompt: "Hello there, how are you?"}, requestCtx("req-5"))
+		assert.ErrorIs(t, err, services.ErrPromptTooLarge)
+		assert.Len(t, llm.Calls(), 2, "oversized prompts never reach the provider")
+	})
+}
+
+func TestGenerateMirrorsShadowTraffic(t *testing.T) {
+	cfg := &utils.Config{
+		LLM:      utils.LLMConfig{OpenAIAPIKey: "platform-openai-key"},
+		Timeouts: utils.TimeoutConfig{Provider: 10 * time.Second, Streaming: 10 * time.Second, MaxRequest: time.Minute},
+	}
+
+	store := apttesting.NewDatastore(t)
+	apttesting.ApplySeed(t, store, "", services.Seed{
+		"users": {"user-1": {"email": "user@example.com", "balance_micros": int64(1_000_000), "is_active": true}},
+	})
+
+	// Every request is mirrored until the $0.01 budget is spent
+	ctx := context.Background()
+	experiment := &data.Experiment{
+		Name:   "Try the mini model",
+		Status: data.ExperimentStatusActive,
+		Shadow: &data.ShadowTraffic{Model: "model-mini", Percent: 100, Budget: 10_000, StoreResults: true},
+	}
+	require.NoError(t, store.CreateExperiment(ctx, experiment))
+
+	catalog := apttesting.NewCatalog(
+		services.ModelConfig{ModelID: "model-v2", Provider: "openai", InputPricePerMillion: 2, OutputPricePerMillion: 4, IsActive: true},
+		services.ModelConfig{ModelID: "model-mini", Provider: "openai", InputPricePerMillion: 1, OutputPricePerMillion: 2, IsActive: true},
+	)
+
+	sharedCache := services.NewSharedCache(cache.New(time.Minute, time.Minute), store, false)
+	audit := services.NewAuditService(store)
+	generation := services.NewGenerationService(cfg, store, sharedCache, catalog,
+		services.NewBillingService(cfg, store, sharedCache, audit, services.NewNotificationService(cfg)),
+		services.NewProviderKeyService(cfg, store),
+		services.NewSystemPromptService(store, sharedCache),
+		services.NewTemplateService(store, sharedCache),
+		services.NewExperimentService(store, nil),
+		services.NewRoutingService(store, catalog),
+	)
+	llm := apttesting.NewLLMClient(
+		apttesting.Response{Text: "Hello!", InputTokens: 100_000, OutputTokens: 50_000},
+		apttesting.Response{Text: "Hi!", InputTokens: 10_000, OutputTokens: 5_000},
+	)
+	generation.SetClientFactory(llm.Factory())
+
+	requestCtx := &services.RequestContext{RequestID: "req-1", UserID: "user-1", Logger: slog.Default()}
+	result, err := generation.Generate(ctx, &services.GenerationRequest{Model: "model-v2", Prompt: "Hi"}, requestCtx)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello!", result.Response.Text, "the caller only sees the original completion")
+
+	var results []*data.ShadowResult
+	require.Eventually(t, func() bool {
+		results, err = store.ListShadowResults(ctx, experiment.ID, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), 10)
+		return err == nil && len(results) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The mirror runs on the shadow model with the platform key, priced without markup
+	calls := llm.Calls()
+	require.Len(t, calls, 2)
+	assert.Equal(t, "model-mini", calls[1].ModelID)
+	assert.Equal(t, "platform-openai-key", calls[1].APIKey)
+
+	shadow := results[0]
+	assert.Equal(t, "req-1", shadow.RequestID)
+	assert.Equal(t, "model-v2", shadow.Model)
+	assert.Equal(t, "model-mini", shadow.ShadowModel)
+	assert.Equal(t, data.MicroUSD(400_000), shadow.Cost)
+	assert.Equal(t, data.MicroUSD(20_000), shadow.ShadowCost)
+	assert.Equal(t, "Hi!", shadow.ShadowCompletion)
+	assert.False(t, shadow.OutputMatches)
+
+	experiment, err = store.GetExperiment(ctx, experiment.ID)
+	require.NoError(t, err)
+	assert.Equal(t, data.MicroUSD(20_000), experiment.ShadowSpend)
+
+	// The budget is spent, so later requests are no longer mirrored
+	llm.Queue(apttesting.Response{Text: "Hello again!", InputTokens: 10, OutputTokens: 10})
+	requestCtx.RequestID = "req-2"
+	_, err = generation.Generate(ctx, &services.GenerationRequest{Model: "model-v2", Prompt: "Hi"}, requestCtx)
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, llm.Calls(), 3)
+}
+
+func TestGenerateStreamChecksBalance(t *testing.T) {
+	cfg := &utils.Config{
+		LLM:      utils.LLMConfig{OpenAIAPIKey: "platform-openai-key"},
+		Timeouts: utils.TimeoutConfig{Provider: 10 * time.Second, Streaming: 10 * time.Second, MaxRequest: time.Minute},
+	}
+
+	store := apttesting.NewDatastore(t)
+	apttesting.ApplySeed(t, store, "", services.Seed{
+		"users": {
+			"user-1": {"email": "user@example.com", "balance_micros": int64(500_000), "is_active": true},
+			"user-2": {"email": "inactive@example.com", "balance_micros": int64(500_000), "is_active": false},
+			"user-3": {"email": "owing@example.com", "balance_micros": int64(-2_000_000), "is_active": true},
+		},
+	})
+
+	catalog := apttesting.NewCatalog(services.ModelConfig{ModelID: "model-v2", Provider: "openai", InputPricePerMillion: 2, OutputPricePerMillion: 4, IsActive: true})
+	sharedCache := services.NewSharedCache(cache.New(time.Minute, time.Minute), store, false)
+	audit := services.NewAuditService(store)
+	generation := services.NewGenerationService(cfg, store, sharedCache, catalog,
+		services.NewBillingService(cfg, store, sharedCache, audit, services.NewNotificationService(cfg)),
+		services.NewProviderKeyService(cfg, store),
+		services.NewSystemPromptService(store, sharedCache),
+		services.NewTemplateService(store, sharedCache),
+		services.NewExperimentService(store, nil),
+		services.NewRoutingService(store, catalog),
+	)
+	llm := apttesting.NewLLMClient()
+	generation.SetClientFactory(llm.Factory())
+
+	ctx := context.Background()
+	stream := func(userID string) (*data.StreamResponse, error) {
+		// 100k output tokens at $4/M are estimated at $0.40
+		req := &services.GenerationRequest{Model: "model-v2", Prompt: "Hi", MaxTokens: 100_000, Stream: true}
+		return generation.GenerateStream(ctx, req, &services.RequestContext{RequestID: "req-" + userID, UserID: userID, Logger: slog.Default()})
+	}
+
+	first, err := stream("user-1")
+	require.NoError(t, err)
+
+	// The open stream's estimated cost is held, so a second stream can't spend the same balance
+	_, err = stream("user-1")
+	assert.ErrorIs(t, err, services.ErrInsufficientBalance)
+
+	// Closing the stream charges it and releases the hold
+	require.NoError(t, first.Stream.Close())
+	second, err := stream("user-1")
+	require.NoError(t, err)
+	require.NoError(t, second.Stream.Close())
+
+	_, err = stream("user-2")
+	assert.ErrorIs(t, err, services.ErrAccountInactive)
+
+	_, err = stream("user-3")
+	assert.ErrorIs(t, err, services.ErrInsufficientBalance)
+
+	// Rejected streams never reach the provider
+	assert.Len(t, llm.Calls(), 2)
+
+	// A generation's hold outlives the call, until its caller has charged it
+	generate := &services.GenerationRequest{Model: "model-v2", Prompt: "Hi", MaxTokens: 100_000}
+	result, err := generation.Generate(ctx, generate, &services.RequestContext{RequestID: "req-generate", UserID: "user-1", Logger: slog.Default()})
+	require.NoError(t, err)
+	require.NotNil(t, result.BalanceHold)
+	_, err = stream("user-1")
+	assert.ErrorIs(t, err, services.ErrInsufficientBalance)
+	result.BalanceHold.Release()
+	third, err := stream("user-1")
+	require.NoError(t, err)
+	require.NoError(t, third.Stream.Close())
+}
+
+func TestEnhancedStreamReaderTiming(t *testing.T) {
+	start := time.Now().Add(-time.Second)
+	stream := &services.EnhancedStreamReader{OriginalStream: io.NopCloser(strings.NewReader("Hello")), StartTime: start}
+
+	// A stream without output has no time to first token yet
+	assert.Zero(t, stream.Timing().TimeToFirstToken)
+
+	_, err := io.ReadAll(stream)
+	require.NoError(t, err)
+	timing := stream.Timing()
+	assert.GreaterOrEqual(t, timing.TimeToFirstToken, time.Second)
+	assert.GreaterOrEqual(t, timing.Duration, timing.TimeToFirstToken)
+
+	// Once ended, the stream's duration stops growing
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, timing, stream.Timing())
+}
+
+// newStreamingGenerationService creates a generation service for stream tests, whose provider
+// answers with responses and whose user-1 is funded
+func newStreamingGenerationService(t *testing.T, responses ...apttesting.Response) *services.GenerationService {
+	cfg := &utils.Config{
+		LLM:      utils.LLMConfig{OpenAIAPIKey: "platform-openai-key"},
+		Timeouts: utils.TimeoutConfig{Provider: 10 * time.Second, Streaming: 10 * time.Second, MaxRequest: time.Minute},
+	}
+
+	store := apttesting.NewDatastore(t)
+	apttesting.ApplySeed(t, store, "", services.Seed{
+		"users": {
+			"user-1": {"email": "user@example.com", "balance_micros": int64(10_000_000), "is_active": true},
+		},
+	})
+
+	catalog := apttesting.NewCatalog(services.ModelConfig{ModelID: "model-v2", Provider: "openai", InputPricePerMillion: 2, OutputPricePerMillion: 4, IsActive: true})
+	sharedCache := services.NewSharedCache(cache.New(time.Minute, time.Minute), store, false)
+	audit := services.NewAuditService(store)
+	generation := services.NewGenerationService(cfg, store, sharedCache, catalog,
+		services.NewBillingService(cfg, store, sharedCache, audit, services.NewNotificationService(cfg)),
+		services.NewProviderKeyService(cfg, store),
+		services.NewSystemPromptService(store, sharedCache),
+		services.NewTemplateService(store, sharedCache),
+		services.NewExperimentService(store, nil),
+		services.NewRoutingService(store, catalog),
+	)
+	generation.SetClientFactory(apttesting.NewLLMClient(responses...).Factory())
+	return generation
+}
+
+func TestEnhancedStreamReaderScansCompletion(t *testing.T) {
+	completion := "Déjà vu, in brief. tokens_saved=1234"
+	generation := newStreamingGenerationService(t,
+		apttesting.Response{Text: completion, InputTokens: 10, OutputTokens: 8},
+		// No usage report, so the output is billed as estimated from what streamed
+		apttesting.Response{Text: completion},
+	)
+
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name           string
+		outputTokens   int
+		usageEstimated bool
+	}{
+		{name: "Usage", outputTokens: 8},
+		{name: "MissingUsage", outputTokens: 9, usageEstimated: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &services.GenerationRequest{Model: "model-v2", Prompt: "Hi", MaxTokens: 100, Stream: true}
+			resp, err := generation.GenerateStream(ctx, req, &services.RequestContext{RequestID: "req-" + tc.name, UserID: "user-1", Logger: slog.Default()})
+			require.NoError(t, err)
+
+			// Reading a byte at a time splits the marker and multi-byte characters across chunks
+			text, err := io.ReadAll(iotest.OneByteReader(resp.Stream))
+			require.NoError(t, err)
+			require.NoError(t, resp.Stream.Close())
+			assert.Equal(t, completion, string(text))
+
+			stream := resp.Stream.(*services.EnhancedStreamReader)
+			assert.Equal(t, 1234, stream.OutputTokensSaved)
+			assert.Equal(t, utf8.RuneCountInString(completion), stream.OutputRunes)
+			assert.Equal(t, tc.outputTokens, stream.OutputTokens)
+			assert.Equal(t, tc.usageEstimated, stream.UsageEstimated)
+
+			// Nothing reads the completion once the stream ends, so it isn't kept
+			assert.False(t, stream.RetainCompletion)
+			assert.Zero(t, stream.Completion.Len())
+		})
+	}
+}
+
+func TestEnhancedStreamReaderOutputCaps(t *testing.T) {
+	completion := "Déjà vu, all over again"
+	for _, tc := range []struct {
+		name         string
+		tier         services.PricingTier
+		text         string
+		outputTokens int
+	}{
+		// The byte cap falls inside "é", which is left out rather than split
+		{name: "Bytes", tier: services.PricingTier{MaxStreamOutputBytes: 5}, text: "Déj", outputTokens: 1},
+		// At four characters per token, 8 characters are the most that estimate to 2 tokens
+		{name: "Tokens", tier: services.PricingTier{MaxStreamOutputTokens: 2}, text: "Déjà vu,", outputTokens: 2},
+		{name: "Both", tier: services.PricingTier{MaxStreamOutputTokens: 2, MaxStreamOutputBytes: 7}, text: "Déjà ", outputTokens: 2},
+		{name: "Uncapped", tier: services.PricingTier{MaxStreamOutputBytes: 100}, text: completion, outputTokens: 50},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// The provider reports usage for its whole completion
+			generation := newStreamingGenerationService(t, apttesting.Response{Text: completion, InputTokens: 10, OutputTokens: 50})
+
+			req := &services.GenerationRequest{Model: "model-v2", Prompt: "Hi", MaxTokens: 100, Stream: true}
+			resp, err := generation.GenerateStream(context.Background(), req, &services.RequestContext{RequestID: "req-1", UserID: "user-1", PricingTier: tc.tier, Logger: slog.Default()})
+			require.NoError(t, err)
+
+			text, err := io.ReadAll(iotest.OneByteReader(resp.Stream))
+			require.NoError(t, err)
+			require.NoError(t, resp.Stream.Close())
+			assert.Equal(t, tc.text, string(text))
+
+			stream := resp.Stream.(*services.EnhancedStreamReader)
+			capped := tc.text != completion
+			assert.Equal(t, capped, stream.LengthCapped)
+			assert.Equal(t, !capped, stream.Completed)
+			assert.NoError(t, stream.Err)
+
+			// A capped stream is billed for the output it sent, not what the provider reported
+			assert.Equal(t, 10, stream.InputTokens)
+			assert.Equal(t, tc.outputTokens, stream.OutputTokens)
+			if capped {
+				assert.Equal(t, services.FinishReasonLengthCapped, stream.FinishReason())
+			} else {
+				assert.Equal(t, data.FinishReasonStop, stream.FinishReason(), "uncapped streams end as the provider ended them")
+			}
+		})
+	}
+}
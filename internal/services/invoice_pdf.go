@@ -0,0 +1,141 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/apt-router/api/internal/data"
+)
+
+// PDF page layout: A4 in points, with monospaced lines so the statement's columns line up
+const (
+	pdfPageWidth    = 595
+	pdfPageHeight   = 842
+	pdfMargin       = 50
+	pdfFontSize     = 8
+	pdfLineHeight   = 11
+	pdfLinesPerPage = (pdfPageHeight - 2*pdfMargin) / pdfLineHeight
+)
+
+// RenderStatementPDF renders a statement as a PDF document
+func RenderStatementPDF(statement *Statement) []byte {
+	return renderTextPDF(statementText(statement))
+}
+
+// statementText lays a statement out as lines of monospaced text
+func statementText(statement *Statement) []string {
+	// Totals are shown converted too when the statement is displayed in another currency
+	converted := statement.Currency != nil && statement.Currency.Currency != "USD"
+	row := func(label, field string, amount data.MicroUSD) string {
+		line := fmt.Sprintf("%-30s %16s", label, "$"+amount.String())
+		if converted {
+			line += fmt.Sprintf(" %20s", statement.Currency.Currency+" "+statement.Converted[field].String())
+		}
+		return line
+	}
+
+	lines := []string{
+		"AptRouter statement",
+		"",
+		fmt.Sprintf("Account:  %s (%s)", statement.Email, statement.UserID),
+		fmt.Sprintf("Period:   %s to %s (UTC)", statement.StartDate.Format("2006-01-02"), statement.EndDate.AddDate(0, 0, -1).Format("2006-01-02")),
+		fmt.Sprintf("Issued:   %s", statement.GeneratedAt.UTC().Format("2006-01-02 15:04 MST")),
+	}
+	if !statement.Final {
+		lines = append(lines, "The period has not ended; this statement is provisional.")
+	}
+	if converted {
+		lines = append(lines, fmt.Sprintf("Amounts are charged in USD and shown in %s at %g per USD, the rate of %s.",
+			statement.Currency.Currency, statement.Currency.Rate, statement.Currency.Day))
+	}
+
+	lines = append(lines, "",
+		fmt.Sprintf("%-30s %9s %12s %12s %16s %16s", "Model", "Requests", "Input", "Output", "Markup", "Spend"),
+		strings.Repeat("-", 100))
+	for _, line := range statement.LineItems {
+		lines = append(lines, fmt.Sprintf("%-30s %9d %12d %12d %16s %16s",
+			line.ModelID, line.Requests, line.InputTokens, line.OutputTokens, "$"+line.Markup.String(), "$"+line.Spend.String()))
+	}
+	if len(statement.LineItems) == 0 {
+		lines = append(lines, "No usage in this period.")
+	}
+
+	return append(lines, "",
+		row("Total spend", "total_spend", statement.TotalSpend),
+		row("  of which markup", "total_markup", statement.TotalMarkup),
+		row("Optimization savings", "total_savings", statement.TotalSavings),
+		row("Promotional credits applied", "credits_applied", statement.CreditsApplied),
+		row("Charged to balance", "balance_charged", statement.BalanceCharged),
+		row("Refunds", "refunds", statement.Refunds),
+		row("Payments received", "payments", statement.Payments),
+	)
+}
+
+// renderTextPDF renders lines of text as a PDF in a standard Courier font, paginating as needed.
+// Characters outside printable ASCII are replaced with "?".
+func renderTextPDF(lines []string) []byte {
+	var pages [][]string
+	for len(lines) > pdfLinesPerPage {
+		pages = append(pages, lines[:pdfLinesPerPage])
+		lines = lines[pdfLinesPerPage:]
+	}
+	pages = append(pages, lines)
+
+	var buf bytes.Buffer
+	var offsets []int
+	writeObject := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	buf.WriteString("%PDF-1.4\n")
+
+	// Objects 1-3 are the catalog, the page tree and the font; each page is followed by its content
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 4+2*i)
+	}
+	writeObject("<< /Type /Catalog /Pages 2 0 R >>")
+	writeObject(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	writeObject("<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>")
+
+	for i, page := range pages {
+		writeObject(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, 5+2*i))
+
+		var content strings.Builder
+		fmt.Fprintf(&content, "BT\n/F1 %d Tf\n%d TL\n%d %d Td\n", pdfFontSize, pdfLineHeight, pdfMargin, pdfPageHeight-pdfMargin)
+		for _, line := range page {
+			fmt.Fprintf(&content, "(%s) Tj T*\n", pdfEscape(line))
+		}
+		content.WriteString("ET")
+		writeObject(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return buf.Bytes()
+}
+
+// pdfEscape escapes text for a PDF string literal
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < ' ' || r > '~':
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,196 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+)
+
+// ErrInvalidStatementPeriod is returned when a statement is requested for a month that has not started
+var ErrInvalidStatementPeriod = errors.New("statement period has not started")
+
+// StatementPeriodLayout is the format of statement periods, a UTC calendar month
+const StatementPeriodLayout = "2006-01"
+
+// Statement is a user's monthly statement: their spend per model from the usage rollups, and the
+// charges, promotional credit and payments recorded in their balance ledger
+type Statement struct {
+	UserID    string          `json:"user_id"`
+	Email     string          `json:"email"`
+	Period    string          `json:"period"`
+	StartDate time.Time       `json:"start_date"`
+	EndDate   time.Time       `json:"end_date"`
+	LineItems []StatementLine `json:"line_items"`
+	// TotalSpend is what the period's requests cost, including TotalMarkup
+	TotalSpend   data.MicroUSD `json:"total_spend"`
+	TotalMarkup  data.MicroUSD `json:"total_markup"`
+	TotalSavings data.MicroUSD `json:"total_savings"`
+	// CreditsApplied is the promotional credit charges consumed and BalanceCharged what they took
+	// from the paid balance
+	CreditsApplied data.MicroUSD `json:"credits_applied"`
+	BalanceCharged data.MicroUSD `json:"balance_charged"`
+	Refunds        data.MicroUSD `json:"refunds"`
+	Payments       data.MicroUSD `json:"payments"`
+	// Final is set once the period has ended, so the statement will not change
+	Final       bool      `json:"final"`
+	GeneratedAt time.Time `json:"generated_at"`
+	// Currency is the currency the statement is displayed in and its rate. Amounts are accounted
+	// in USD; Converted holds the totals in Currency, by the names of their USD fields.
+	Currency  *ExchangeRate                 `json:"currency"`
+	Converted map[string]data.DisplayAmount `json:"converted"`
+}
+
+// StatementLine totals a statement's usage of one model
+type StatementLine struct {
+	ModelID      string        `json:"model_id"`
+	Requests     int           `json:"requests"`
+	InputTokens  int           `json:"input_tokens"`
+	OutputTokens int           `json:"output_tokens"`
+	Spend        data.MicroUSD `json:"spend"`
+	Markup       data.MicroUSD `json:"markup"`
+	Savings      data.MicroUSD `json:"savings"`
+	// Converted holds the line's amounts in the statement's currency
+	Converted map[string]data.DisplayAmount `json:"converted"`
+}
+
+// RateTime returns when the statement's amounts are converted at: the last day of a final period,
+// so its rate never changes, or now for the current one
+func (s *Statement) RateTime() time.Time {
+	if s.Final {
+		return s.EndDate.AddDate(0, 0, -1)
+	}
+	return s.GeneratedAt
+}
+
+// Convert displays the statement's amounts in rate's currency
+func (s *Statement) Convert(rate *ExchangeRate) {
+	s.Currency = rate
+	s.Converted = rate.ConvertAll(map[string]data.MicroUSD{
+		"total_spend":     s.TotalSpend,
+		"total_markup":    s.TotalMarkup,
+		"total_savings":   s.TotalSavings,
+		"credits_applied": s.CreditsApplied,
+		"balance_charged": s.BalanceCharged,
+		"refunds":         s.Refunds,
+		"payments":        s.Payments,
+	})
+	for i := range s.LineItems {
+		line := &s.LineItems[i]
+		line.Converted = rate.ConvertAll(map[string]data.MicroUSD{
+			"spend":   line.Spend,
+			"markup":  line.Markup,
+			"savings": line.Savings,
+		})
+	}
+}
+
+// InvoiceService produces monthly statements from usage rollups and the balance ledger
+type InvoiceService struct {
+	firebaseService *data.Service
+}
+
+// NewInvoiceService creates a new invoice service
+func NewInvoiceService(firebaseService *data.Service) *InvoiceService {
+	return &InvoiceService{
+		firebaseService: firebaseService,
+	}
+}
+
+// ParseStatementPeriod parses a YYYY-MM period into the start of its UTC month. An empty period
+// is the current month.
+func ParseStatementPeriod(period string, now time.Time) (time.Time, error) {
+	if period == "" {
+		now = now.UTC()
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC), nil
+	}
+
+	start, err := time.Parse(StatementPeriodLayout, period)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("period must be a month in YYYY-MM format: %w", err)
+	}
+	if start.After(now) {
+		return time.Time{}, ErrInvalidStatementPeriod
+	}
+	return start, nil
+}
+
+// Statement builds a user's statement for the UTC month starting at start. Convert displays it in
+// another currency.
+func (s *InvoiceService) Statement(ctx context.Context, userID string, start time.Time) (*Statement, error) {
+	user, err := s.firebaseService.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	now := time.Now()
+	end := start.AddDate(0, 1, 0)
+	statement := &Statement{
+		UserID:      userID,
+		Email:       user.Email,
+		Period:      start.Format(StatementPeriodLayout),
+		StartDate:   start,
+		EndDate:     end,
+		LineItems:   []StatementLine{},
+		Final:       !end.After(now),
+		GeneratedAt: now,
+	}
+
+	// Daily buckets never straddle a month, so the month's rollups cover its usage exactly
+	rollups, err := s.firebaseService.ListUsageRollups(ctx, userID, data.RollupDaily, start, end)
+	if err != nil {
+		return nil, err
+	}
+	lines := make(map[string]*StatementLine)
+	for _, rollup := range rollups {
+		if !rollup.BucketStart.Before(end) {
+			continue
+		}
+
+		line, ok := lines[rollup.ModelID]
+		if !ok {
+			line = &StatementLine{ModelID: rollup.ModelID}
+			lines[rollup.ModelID] = line
+		}
+		line.Requests += rollup.Requests
+		line.InputTokens += rollup.InputTokens
+		line.OutputTokens += rollup.OutputTokens
+		line.Spend += rollup.TotalCost
+		line.Markup += rollup.MarkupAmount
+		line.Savings += rollup.Savings
+
+		statement.TotalSpend += rollup.TotalCost
+		statement.TotalMarkup += rollup.MarkupAmount
+		statement.TotalSavings += rollup.Savings
+	}
+	for _, line := range lines {
+		statement.LineItems = append(statement.LineItems, *line)
+	}
+	sort.Slice(statement.LineItems, func(i, j int) bool {
+		if statement.LineItems[i].Spend != statement.LineItems[j].Spend {
+			return statement.LineItems[i].Spend > statement.LineItems[j].Spend
+		}
+		return statement.LineItems[i].ModelID < statement.LineItems[j].ModelID
+	})
+
+	entries, err := s.firebaseService.ListLedgerEntriesBetween(ctx, userID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		switch entry.Type {
+		case data.LedgerEntryCharge:
+			statement.BalanceCharged -= entry.Amount
+			statement.CreditsApplied -= entry.CreditAmount
+		case data.LedgerEntryRefund:
+			statement.Refunds += entry.Amount
+		case data.LedgerEntryTopUp:
+			statement.Payments += entry.Amount
+		}
+	}
+
+	return statement, nil
+}
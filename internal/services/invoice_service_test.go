@@ -0,0 +1,66 @@
+package services_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	apttesting "github.com/apt-router/api/internal/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvoiceStatement(t *testing.T) {
+	store := apttesting.NewDatastore(t)
+	apttesting.ApplySeed(t, store, "", services.Seed{
+		"users": {"user-1": {"email": "user@example.com", "balance_micros": int64(1_000_000), "is_active": true}},
+	})
+	ctx := context.Background()
+	now := time.Now()
+	start, err := services.ParseStatementPeriod("", now)
+	require.NoError(t, err)
+
+	for _, log := range []*data.RequestLog{
+		{ID: "req-1", UserID: "user-1", ModelID: "gpt-4o", TotalCost: 1100, MarkupAmount: 100, InputTokens: 100, OutputTokens: 50, RequestTimestamp: start},
+		{ID: "req-2", UserID: "user-1", ModelID: "gpt-4o", TotalCost: 2200, MarkupAmount: 200, SavingsAmount: 300, InputTokens: 200, OutputTokens: 100, RequestTimestamp: start.Add(time.Minute)},
+		{ID: "req-3", UserID: "user-1", ModelID: "claude-sonnet-4", TotalCost: 5000, MarkupAmount: 500, RequestTimestamp: start.Add(time.Minute)},
+		// Requests in the previous month belong to its statement
+		{ID: "req-0", UserID: "user-1", ModelID: "gpt-4o", TotalCost: 9999, RequestTimestamp: start.Add(-time.Minute)},
+	} {
+		require.NoError(t, store.LogRequest(ctx, log))
+	}
+
+	// The first charge is paid from promotional credit, the rest from the balance
+	require.NoError(t, store.GrantCredits(ctx, "user-1", &data.CreditGrant{Amount: 2000, Source: data.CreditSourceAdmin, ExpiresAt: now.Add(time.Hour)}))
+	_, err = store.UpdateUserBalance(ctx, "user-1", -8300, data.LedgerEntryCharge, "req-1")
+	require.NoError(t, err)
+
+	statement, err := services.NewInvoiceService(store).Statement(ctx, "user-1", start)
+	require.NoError(t, err)
+	assert.Equal(t, "user@example.com", statement.Email)
+	assert.Equal(t, start.Format(services.StatementPeriodLayout), statement.Period)
+	assert.False(t, statement.Final)
+	assert.Equal(t, []services.StatementLine{
+		{ModelID: "claude-sonnet-4", Requests: 1, Spend: 5000, Markup: 500},
+		{ModelID: "gpt-4o", Requests: 2, InputTokens: 300, OutputTokens: 150, Spend: 3300, Markup: 300, Savings: 300},
+	}, statement.LineItems)
+	assert.Equal(t, data.MicroUSD(8300), statement.TotalSpend)
+	assert.Equal(t, data.MicroUSD(800), statement.TotalMarkup)
+	assert.Equal(t, data.MicroUSD(300), statement.TotalSavings)
+	assert.Equal(t, data.MicroUSD(2000), statement.CreditsApplied)
+	assert.Equal(t, data.MicroUSD(6300), statement.BalanceCharged)
+
+	pdf := services.RenderStatementPDF(statement)
+	assert.True(t, bytes.HasPrefix(pdf, []byte("%PDF-1.4")))
+	assert.Contains(t, string(pdf), "claude-sonnet-4")
+	assert.True(t, bytes.HasSuffix(pdf, []byte("%%EOF\n")))
+
+	_, err = services.ParseStatementPeriod(now.AddDate(0, 2, 0).Format(services.StatementPeriodLayout), now)
+	assert.True(t, errors.Is(err, services.ErrInvalidStatementPeriod), "got %v", err)
+	_, err = services.ParseStatementPeriod("September", now)
+	assert.Error(t, err)
+}
@@ -0,0 +1,218 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/utils"
+	"github.com/google/uuid"
+)
+
+// Job is a background job the scheduler runs every Interval
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context) error
+}
+
+// JobStatus is a registered job with its last run, as shown to admins
+type JobStatus struct {
+	*data.JobRun
+	Interval  string    `json:"interval"`
+	NextRunAt time.Time `json:"next_run_at"`
+	// Active is whether the job is running on this replica
+	Active bool `json:"active"`
+}
+
+// JobScheduler runs background jobs on one replica at a time. Replicas elect a leader through a
+// lease in Firestore, and only the leader runs jobs. Each run is also claimed in Firestore, so a job
+// runs at most once per interval even while a lapsed leader and its successor overlap. A run is
+// cancelled when its interval is up, when the next run is due, or when its replica stops leading.
+type JobScheduler struct {
+	config          utils.JobsConfig
+	firebaseService *data.Service
+	instanceID      string
+
+	mu   sync.Mutex
+	jobs []Job
+	// running holds the cancel funcs of the jobs running on this replica, by name
+	running map[string]context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// NewJobScheduler creates a new job scheduler
+func NewJobScheduler(cfg *utils.Config, firebaseService *data.Service) *JobScheduler {
+	return &JobScheduler{
+		config:          cfg.Jobs,
+		firebaseService: firebaseService,
+		instanceID:      uuid.New().String(),
+		running:         make(map[string]context.CancelFunc),
+	}
+}
+
+// InstanceID identifies this replica in elections
+func (s *JobScheduler) InstanceID() string {
+	return s.instanceID
+}
+
+// Register adds a job. Jobs with no interval are disabled and left out.
+func (s *JobScheduler) Register(job Job) {
+	if job.Interval <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = append(s.jobs, job)
+}
+
+// Run stands for election and, while leading, runs jobs as they fall due, until ctx is cancelled.
+// Leadership is renewed every third of the lease.
+func (s *JobScheduler) Run(ctx context.Context) {
+	if !s.config.Enabled || s.config.LeaderLease <= 0 || s.firebaseService == nil || s.firebaseService.DB() == nil {
+		return
+	}
+
+	slog.Info("Starting job scheduler", "instance_id", s.instanceID, "leader_lease", s.config.LeaderLease, "jobs", len(s.jobs))
+
+	ticker := time.NewTicker(s.config.LeaderLease / 3)
+	defer ticker.Stop()
+	s.Tick(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			s.stop()
+			// Hand over at once rather than when the lease runs out
+			releaseCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+			if err := s.firebaseService.ReleaseJobLeadership(releaseCtx, s.instanceID); err != nil {
+				slog.Warn("Failed to release job leadership", "error", err)
+			}
+			cancel()
+			return
+		case <-ticker.C:
+			s.Tick(ctx)
+		}
+	}
+}
+
+// Tick claims or renews leadership and, if this replica leads, starts the jobs that are due.
+// Jobs run in the background; Wait waits for them.
+func (s *JobScheduler) Tick(ctx context.Context) {
+	leader, err := s.firebaseService.ClaimJobLeadership(ctx, s.instanceID, s.config.LeaderLease)
+	if err != nil {
+		slog.Warn("Failed to claim job leadership", "instance_id", s.instanceID, "error", err)
+	}
+	if !leader {
+		// A replica that cannot renew may already have been replaced
+		s.stop()
+		return
+	}
+
+	s.mu.Lock()
+	jobs := append([]Job(nil), s.jobs...)
+	s.mu.Unlock()
+	for _, job := range jobs {
+		s.start(ctx, job)
+	}
+}
+
+// Wait waits for the jobs running on this replica to finish
+func (s *JobScheduler) Wait() {
+	s.wg.Wait()
+}
+
+// start runs a job in the background if it is due and not already running here
+func (s *JobScheduler) start(ctx context.Context, job Job) {
+	s.mu.Lock()
+	_, active := s.running[job.Name]
+	s.mu.Unlock()
+	if active {
+		return
+	}
+
+	startedAt, claimed, err := s.firebaseService.ClaimJobRun(ctx, job.Name, s.instanceID, job.Interval)
+	if err != nil {
+		slog.Warn("Failed to claim scheduled job", "job", job.Name, "error", err)
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	// The next run may start once the interval is up, so this one must not outlast it
+	runCtx, cancel := context.WithDeadline(ctx, startedAt.Add(job.Interval))
+	s.mu.Lock()
+	s.running[job.Name] = cancel
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() {
+			s.mu.Lock()
+			delete(s.running, job.Name)
+			s.mu.Unlock()
+			cancel()
+		}()
+
+		slog.Debug("Scheduled job started", "job", job.Name, "instance_id", s.instanceID)
+		runErr := job.Run(runCtx)
+		if runErr != nil {
+			slog.Warn("Scheduled job failed", "job", job.Name, "duration", time.Since(startedAt), "error", runErr)
+		} else {
+			slog.Debug("Scheduled job finished", "job", job.Name, "duration", time.Since(startedAt))
+		}
+
+		// Record the outcome even when the run was cancelled
+		finishCtx, finishCancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer finishCancel()
+		if err := s.firebaseService.FinishJobRun(finishCtx, job.Name, startedAt, runErr); err != nil {
+			slog.Warn("Failed to record scheduled job run", "job", job.Name, "error", err)
+		}
+	}()
+}
+
+// stop cancels the jobs running on this replica
+func (s *JobScheduler) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, cancel := range s.running {
+		slog.Info("Stopping scheduled job", "job", name, "instance_id", s.instanceID)
+		cancel()
+	}
+}
+
+// Status returns the elected leader and every registered job with its last run
+func (s *JobScheduler) Status(ctx context.Context) (*data.JobLeader, []JobStatus, error) {
+	leader, err := s.firebaseService.GetJobLeader(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if leader != nil && time.Now().After(leader.LeaseUntil) {
+		// The last leader's lease has run out and no replica has been elected since
+		leader = nil
+	}
+	runs, err := s.firebaseService.ListJobRuns(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]JobStatus, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		run := runs[job.Name]
+		if run == nil {
+			run = &data.JobRun{Name: job.Name}
+		}
+		status := JobStatus{JobRun: run, Interval: job.Interval.String(), NextRunAt: time.Now()}
+		if !run.LastStartedAt.IsZero() && run.LastStartedAt.Add(job.Interval).After(status.NextRunAt) {
+			status.NextRunAt = run.LastStartedAt.Add(job.Interval)
+		}
+		_, status.Active = s.running[job.Name]
+		statuses = append(statuses, status)
+	}
+	return leader, statuses, nil
+}
@@ -0,0 +1,104 @@
+package services_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	apttesting "github.com/apt-router/api/internal/testing"
+	"github.com/apt-router/api/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobSchedulerRunsJobsOnce(t *testing.T) {
+	store := apttesting.NewDatastore(t)
+	cfg := &utils.Config{Jobs: utils.JobsConfig{Enabled: true, LeaderLease: time.Minute}}
+	ctx := context.Background()
+
+	var runs, failures atomic.Int32
+	newReplica := func() *services.JobScheduler {
+		scheduler := services.NewJobScheduler(cfg, store)
+		scheduler.Register(services.Job{Name: "sweep", Interval: time.Hour, Run: func(ctx context.Context) error {
+			runs.Add(1)
+			return nil
+		}})
+		scheduler.Register(services.Job{Name: "broken", Interval: time.Hour, Run: func(ctx context.Context) error {
+			failures.Add(1)
+			return errors.New("listing failed")
+		}})
+		scheduler.Register(services.Job{Name: "disabled", Run: func(ctx context.Context) error {
+			t.Error("jobs with no interval do not run")
+			return nil
+		}})
+		return scheduler
+	}
+	first, second := newReplica(), newReplica()
+
+	// Only the elected replica runs jobs, and each job runs once per interval
+	first.Tick(ctx)
+	second.Tick(ctx)
+	first.Wait()
+	second.Wait()
+	first.Tick(ctx)
+	first.Wait()
+	assert.Equal(t, int32(1), runs.Load())
+	assert.Equal(t, int32(1), failures.Load())
+
+	leader, jobs, err := second.Status(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, leader)
+	assert.Equal(t, first.InstanceID(), leader.InstanceID)
+	require.Len(t, jobs, 2)
+	assert.Equal(t, "sweep", jobs[0].Name)
+	assert.Equal(t, data.JobSucceeded, jobs[0].Status)
+	assert.Equal(t, first.InstanceID(), jobs[0].InstanceID)
+	assert.Equal(t, int64(1), jobs[0].Runs)
+	assert.WithinDuration(t, jobs[0].LastStartedAt.Add(time.Hour), jobs[0].NextRunAt, time.Second)
+	assert.Equal(t, data.JobFailed, jobs[1].Status)
+	assert.Equal(t, "listing failed", jobs[1].LastError)
+	assert.Equal(t, int64(1), jobs[1].Failures)
+
+	// Once the leader steps down another replica takes over, but jobs still wait for their interval
+	require.NoError(t, store.ReleaseJobLeadership(ctx, first.InstanceID()))
+	second.Tick(ctx)
+	second.Wait()
+	leader, _, err = first.Status(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, second.InstanceID(), leader.InstanceID)
+	assert.Equal(t, int32(1), runs.Load())
+}
+
+func TestJobSchedulerStopsJobsWhenLeadershipIsLost(t *testing.T) {
+	store := apttesting.NewDatastore(t)
+	cfg := &utils.Config{Jobs: utils.JobsConfig{Enabled: true, LeaderLease: time.Minute}}
+	ctx := context.Background()
+
+	started := make(chan struct{})
+	scheduler := services.NewJobScheduler(cfg, store)
+	scheduler.Register(services.Job{Name: "long", Interval: time.Hour, Run: func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}})
+	scheduler.Tick(ctx)
+	<-started
+
+	// Another replica is elected once this one's lease is gone, and this one stops its jobs
+	require.NoError(t, store.ReleaseJobLeadership(ctx, scheduler.InstanceID()))
+	elected, err := store.ClaimJobLeadership(ctx, "other-replica", time.Minute)
+	require.NoError(t, err)
+	require.True(t, elected)
+	scheduler.Tick(ctx)
+	scheduler.Wait()
+
+	_, jobs, err := scheduler.Status(ctx)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, data.JobFailed, jobs[0].Status)
+	assert.False(t, jobs[0].Active)
+}
@@ -0,0 +1,133 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/utils"
+)
+
+// ErrContentBlocked is returned when moderation blocks a prompt or completion
+var ErrContentBlocked = errors.New("content blocked by moderation")
+
+// Moderation stages
+const (
+	ModerationStagePrompt     = "prompt"
+	ModerationStageCompletion = "completion"
+)
+
+// ModerationError describes blocked content; it wraps ErrContentBlocked
+type ModerationError struct {
+	Stage  string
+	Result *data.ModerationResult
+	// Record holds every moderation result for the request, for its request log
+	Record *data.ModerationRecord
+}
+
+// Error implements the error interface
+func (e *ModerationError) Error() string {
+	if len(e.Result.Categories) == 0 {
+		return fmt.Sprintf("%s %s", e.Stage, ErrContentBlocked)
+	}
+	return fmt.Sprintf("%s %s: %s", e.Stage, ErrContentBlocked, strings.Join(e.Result.Categories, ", "))
+}
+
+// Unwrap returns ErrContentBlocked
+func (e *ModerationError) Unwrap() error {
+	return ErrContentBlocked
+}
+
+// ModerationService checks prompts and completions with a content classifier, per tier settings
+type ModerationService struct {
+	moderator data.Moderator
+	timeout   time.Duration
+	failOpen  bool
+}
+
+// NewModerationService creates a new moderation service.
+// Moderation is disabled when no moderation provider is configured.
+func NewModerationService(cfg *utils.Config) *ModerationService {
+	s := &ModerationService{
+		timeout:  cfg.Moderation.Timeout,
+		failOpen: cfg.Moderation.FailOpen,
+	}
+
+	switch cfg.Moderation.Provider {
+	case "openai":
+		apiKey := cfg.Moderation.APIKey
+		if apiKey == "" {
+			apiKey = cfg.LLM.OpenAIAPIKey
+		}
+		s.moderator = data.NewOpenAIModerator(apiKey, cfg.Moderation.Model)
+	case "http":
+		s.moderator = data.NewHTTPModerator(cfg.Moderation.Endpoint, cfg.Moderation.APIKey)
+	}
+
+	return s
+}
+
+// Enabled reports whether a classifier is configured
+func (s *ModerationService) Enabled() bool {
+	return s != nil && s.moderator != nil
+}
+
+// NewRecord starts the moderation record for a request, or returns nil when the tier has moderation off
+func (s *ModerationService) NewRecord(settings data.ModerationSettings) *data.ModerationRecord {
+	if !s.Enabled() || !settings.Enabled() {
+		return nil
+	}
+
+	action := settings.Action
+	if action == "" {
+		action = data.ModerationActionBlock
+	}
+	return &data.ModerationRecord{Action: action}
+}
+
+// Check classifies text for a stage when the tier moderates it, storing the result in record.
+// It returns a ModerationError when the content is flagged and the tier blocks flagged content.
+func (s *ModerationService) Check(ctx context.Context, settings data.ModerationSettings, record *data.ModerationRecord, stage, text string) error {
+	result, err := s.Classify(ctx, settings, record, stage, text)
+	if err != nil {
+		return err
+	}
+
+	if result != nil && result.Flagged && record.Action == data.ModerationActionBlock {
+		record.Blocked = true
+		return &ModerationError{Stage: stage, Result: result, Record: record}
+	}
+	return nil
+}
+
+// Classify classifies text for a stage when the tier moderates it and stores the result in record,
+// without blocking. It returns nil when the stage is not moderated or the classifier is unavailable
+// and moderation fails open.
+func (s *ModerationService) Classify(ctx context.Context, settings data.ModerationSettings, record *data.ModerationRecord, stage, text string) (*data.ModerationResult, error) {
+	if record == nil || (stage == ModerationStagePrompt && !settings.Prompts) || (stage == ModerationStageCompletion && !settings.Completions) {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	result, err := s.moderator.Moderate(ctx, text)
+	if err != nil {
+		if s.failOpen {
+			slog.Warn("Moderation unavailable, allowing content", "stage", stage, "error", err)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("moderation failed: %w", err)
+	}
+
+	if stage == ModerationStagePrompt {
+		record.Prompt = result
+	} else {
+		record.Completion = result
+	}
+	return result, nil
+}
@@ -0,0 +1,196 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/apt-router/api/internal/utils"
+)
+
+// Headers set on webhook deliveries
+const (
+	webhookEventHeader     = "X-AptRouter-Event"
+	webhookSignatureHeader = "X-AptRouter-Signature"
+)
+
+// ErrPrivateWebhookAddress is returned when a webhook URL's host is, or resolves to, a loopback,
+// link-local or private address
+var ErrPrivateWebhookAddress = errors.New("webhook URL must not resolve to a loopback, link-local or private address")
+
+// reservedWebhookPrefixes are non-public ranges the net.IP predicates don't cover: "this network",
+// carrier-grade NAT and benchmarking
+var reservedWebhookPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+}
+
+// NotificationService delivers user notifications by email and signed webhooks
+type NotificationService struct {
+	config     utils.NotificationsConfig
+	httpClient *http.Client
+}
+
+// NewNotificationService creates a new notification service.
+// Email is disabled when no SMTP host is configured; webhooks are always available.
+func NewNotificationService(cfg *utils.Config) *NotificationService {
+	return &NotificationService{
+		config:     cfg.Notifications,
+		httpClient: newWebhookClient(cfg.Notifications),
+	}
+}
+
+// newWebhookClient returns the client users' webhooks are delivered with. Unless private webhooks
+// are allowed, it refuses to connect to non-public addresses, checked on the address dialed so a
+// host that resolves differently after validation or a redirect can't reach internal services.
+func newWebhookClient(cfg utils.NotificationsConfig) *http.Client {
+	if cfg.AllowPrivateWebhooks {
+		return &http.Client{Timeout: cfg.WebhookTimeout}
+	}
+
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil || !publicWebhookAddr(addrPort.Addr()) {
+				return fmt.Errorf("%w: %s", ErrPrivateWebhookAddress, address)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would dial the webhook's address itself, out of reach of the dialer's check
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: cfg.WebhookTimeout, Transport: transport}
+}
+
+// publicWebhookAddr reports whether a webhook may be delivered to addr
+func publicWebhookAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() {
+		return false
+	}
+	for _, prefix := range reservedWebhookPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateWebhookURL checks that rawURL is an absolute https URL whose host resolves only to public
+// addresses, unless private webhooks are allowed
+func (s *NotificationService) ValidateWebhookURL(ctx context.Context, rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Scheme != "https" || parsed.Hostname() == "" {
+		return fmt.Errorf("webhook URL must be an absolute https URL")
+	}
+	if s.config.AllowPrivateWebhooks {
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", parsed.Hostname())
+	if err != nil {
+		return fmt.Errorf("webhook host %s could not be resolved", parsed.Hostname())
+	}
+	for _, addr := range addrs {
+		if !publicWebhookAddr(addr) {
+			return ErrPrivateWebhookAddress
+		}
+	}
+	return nil
+}
+
+// EmailEnabled reports whether an SMTP server is configured
+func (s *NotificationService) EmailEnabled() bool {
+	return s != nil && s.config.SMTPHost != ""
+}
+
+// SendEmail sends a plain text email
+func (s *NotificationService) SendEmail(to, subject, body string) error {
+	if !s.EmailEnabled() {
+		return fmt.Errorf("email notifications are not configured")
+	}
+
+	var auth smtp.Auth
+	if s.config.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", s.config.SMTPUsername, s.config.SMTPPassword, s.config.SMTPHost)
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", s.config.EmailFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(body)
+
+	addr := net.JoinHostPort(s.config.SMTPHost, strconv.Itoa(s.config.SMTPPort))
+	if err := smtp.SendMail(addr, auth, s.config.EmailFrom, []string{to}, []byte(msg.String())); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	return nil
+}
+
+// SendWebhook posts an event as JSON to a user's webhook URL. Deliveries carry the event type and
+// an X-AptRouter-Signature of "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">" keyed by secret.
+func (s *NotificationService) SendWebhook(ctx context.Context, url, secret, event string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, event)
+	req.Header.Set(webhookSignatureHeader, signWebhook(secret, time.Now(), body))
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to deliver webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook endpoint returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// signWebhook returns the signature header value for a webhook body
+func signWebhook(secret string, timestamp time.Time, body []byte) string {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return fmt.Sprintf("t=%s,v1=%s", ts, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// NewWebhookSecret generates a secret for signing a user's webhook deliveries
+func NewWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate webhook secret: %w", err)
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// Optimization guards: why a prompt was kept from the optimizer, or restricted to whitespace-safe
+// rules, because rewriting it could break a structured-output or function-calling workflow
+const (
+	// OptimizationGuardTools is set for requests that offer the model tools or functions to call
+	OptimizationGuardTools = "tools"
+	// OptimizationGuardJSONOutput is set for requests that ask for JSON output
+	OptimizationGuardJSONOutput = "json_output"
+	// OptimizationGuardJSONPrompt is set for prompts that are a JSON document
+	OptimizationGuardJSONPrompt = "json_prompt"
+	// OptimizationGuardCode is set for prompts that are mostly code
+	OptimizationGuardCode = "code"
+)
+
+// codeHeavyShare is the share of a prompt's non-blank lines that must look like code for the prompt
+// to be treated as code
+const codeHeavyShare = 0.4
+
+// toolParams are the extra parameters providers take tool and function definitions in
+var toolParams = []string{"tools", "tool_choice", "functions", "function_call", "tool_config"}
+
+// codeLinePattern matches lines that look like code outside a code block: statements ending in a
+// semicolon or brace, and lines starting with a common keyword or comment
+var codeLinePattern = regexp.MustCompile(`[;{}]\s*$|^\s*(?:(?:func|def|class|import|package|return|const|let|var|public|private)\b|#include|//|/\*)`)
+
+// optimizationGuard returns why a request's prompt must not be rewritten freely, or "" if it may
+// be. When restricted is set, whitespace-safe rules may still apply; otherwise the prompt must be
+// sent as written.
+func optimizationGuard(req *GenerationRequest) (guard string, restricted bool) {
+	for _, key := range toolParams {
+		if hasParam(req.Extra, key) {
+			return OptimizationGuardTools, false
+		}
+	}
+	if wantsJSONOutput(req.Extra) {
+		return OptimizationGuardJSONOutput, false
+	}
+
+	prompt := strings.TrimSpace(req.Prompt)
+	if (strings.HasPrefix(prompt, "{") || strings.HasPrefix(prompt, "[")) && json.Valid([]byte(prompt)) {
+		return OptimizationGuardJSONPrompt, true
+	}
+	if codeShare(prompt) >= codeHeavyShare {
+		return OptimizationGuardCode, true
+	}
+	return "", false
+}
+
+// hasParam reports whether an extra parameter is set to anything but an empty value
+func hasParam(extra map[string]interface{}, key string) bool {
+	switch value := extra[key].(type) {
+	case nil:
+		return false
+	case string:
+		return value != ""
+	case []interface{}:
+		return len(value) > 0
+	case map[string]interface{}:
+		return len(value) > 0
+	default:
+		return true
+	}
+}
+
+// wantsJSONOutput reports whether extra parameters ask for JSON output, as OpenAI's response_format
+// or Gemini's response_mime_type and response_schema do
+func wantsJSONOutput(extra map[string]interface{}) bool {
+	if hasParam(extra, "response_schema") {
+		return true
+	}
+	if mimeType, _ := extra["response_mime_type"].(string); strings.Contains(mimeType, "json") {
+		return true
+	}
+	switch format := extra["response_format"].(type) {
+	case string:
+		return strings.Contains(format, "json")
+	case map[string]interface{}:
+		formatType, _ := format["type"].(string)
+		return strings.Contains(formatType, "json")
+	}
+	return false
+}
+
+// codeShare returns the share of a prompt's non-blank lines that are in code blocks or look like code
+func codeShare(prompt string) float64 {
+	var lines, code int
+	inBlock := false
+	for _, line := range strings.Split(prompt, "\n") {
+		trimmed := strings.TrimSpace(line)
+		fence := strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~")
+		if fence {
+			inBlock = !inBlock
+			continue
+		}
+		if trimmed == "" {
+			continue
+		}
+		lines++
+		if inBlock || strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t") || codeLinePattern.MatchString(line) {
+			code++
+		}
+	}
+	if lines == 0 {
+		return 0
+	}
+	return float64(code) / float64(lines)
+}
+
+// WhitespaceOptimization removes trailing spaces and extra blank lines from the prose of a prompt,
+// leaving its wording, code and quoted text untouched, so its meaning can't change
+func WhitespaceOptimization(originalPrompt string) *OptimizationResult {
+	result := &OptimizationResult{
+		OriginalText:     originalPrompt,
+		OptimizedText:    originalPrompt,
+		OptimizationType: "none",
+		OriginalTokens:   len(originalPrompt) / 4,
+	}
+	result.OptimizedTokens = result.OriginalTokens
+
+	var optimized strings.Builder
+	for _, segment := range splitProtected(originalPrompt) {
+		if segment.protected {
+			optimized.WriteString(segment.text)
+			continue
+		}
+		optimized.WriteString(blankLines.ReplaceAllString(trailingSpaces.ReplaceAllString(segment.text, "\n"), "\n\n"))
+	}
+	text := strings.TrimLeft(strings.TrimRight(optimized.String(), " \t\n"), "\n")
+	if text == originalPrompt {
+		return result
+	}
+	result.OptimizedText = text
+	result.WasOptimized = true
+	result.OptimizationType = "whitespace"
+	result.OptimizedTokens = len(text) / 4
+	result.TokensSaved = result.OriginalTokens - result.OptimizedTokens
+	if result.OriginalTokens > 0 {
+		result.SavingsPercent = float64(result.TokensSaved) / float64(result.OriginalTokens) * 100
+	}
+	return result
+}
@@ -5,10 +5,15 @@ import (
 	"fmt"
 	"log/slog"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/apt-router/api/internal/data"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // OptimizationResult holds detailed information about optimization
@@ -27,6 +32,18 @@ type OptimizationResult struct {
 	// New fields for actual API token counts
 	Gemma3InputTokens    int `json:"gemma3_input_tokens,omitempty"`     // Actual input tokens from Gemma 3 API response
 	UserModelInputTokens int `json:"user_model_input_tokens,omitempty"` // Actual input tokens from user's model API response
+	// OptimizerInputTokens and OptimizerOutputTokens are what the optimizer model call itself used,
+	// and OptimizerCost its price; all are zero for rule-based optimization
+	OptimizerInputTokens  int           `json:"optimizer_input_tokens,omitempty"`
+	OptimizerOutputTokens int           `json:"optimizer_output_tokens,omitempty"`
+	OptimizerCost         data.MicroUSD `json:"optimizer_cost,omitempty"`
+	// NetTokensSaved is TokensSaved less the optimizer's cost, in tokens of the target model, and
+	// NetSavings the price of the tokens saved less the optimizer's cost; both may be negative
+	NetTokensSaved int           `json:"net_tokens_saved,omitempty"`
+	NetSavings     data.MicroUSD `json:"net_savings,omitempty"`
+	// Guard is why the prompt was kept from the optimizer or restricted to whitespace-safe rules,
+	// one of the OptimizationGuard constants, if it was
+	Guard string `json:"guard,omitempty"`
 }
 
 // Optimizer handles token optimization using a lightweight model
@@ -238,59 +255,233 @@ func (o *Optimizer) OptimizeResponse(ctx context.Context, originalResponse strin
 	return result, nil
 }
 
-// applyRuleBasedOptimizations applies rule-based token optimizations
+// RuleBasedOptimization rewrites a prompt with the rule-based optimizations alone, which need no
+// optimizer model
+func RuleBasedOptimization(originalPrompt string) *OptimizationResult {
+	result := &OptimizationResult{
+		OriginalText:     originalPrompt,
+		OptimizedText:    originalPrompt,
+		OptimizationType: "prompt",
+		// Use rough estimation for rule-based optimization (no API call)
+		OriginalTokens: len(originalPrompt) / 4,
+	}
+	result.OptimizedTokens = result.OriginalTokens
+
+	optimized := (&Optimizer{}).applyRuleBasedOptimizations(originalPrompt)
+	if optimized == originalPrompt {
+		return result
+	}
+	result.OptimizedText = optimized
+	result.WasOptimized = true
+	result.OptimizationType = "rule_based"
+	result.OptimizedTokens = len(optimized) / 4
+	result.TokensSaved = result.OriginalTokens - result.OptimizedTokens
+	if result.OriginalTokens > 0 {
+		result.SavingsPercent = float64(result.TokensSaved) / float64(result.OriginalTokens) * 100
+	}
+	return result
+}
+
+// applyRuleBasedOptimizations applies rule-based token optimizations to prose. Code blocks, inline
+// code, URLs and quoted strings are left untouched, and the English phrase rules only apply to
+// text that looks English.
 func (o *Optimizer) applyRuleBasedOptimizations(text string) string {
-	optimized := text
+	segments := splitProtected(text)
+
+	var prose strings.Builder
+	for _, segment := range segments {
+		if !segment.protected {
+			prose.WriteString(segment.text)
+			prose.WriteByte('\n')
+		}
+	}
+	english := looksEnglish(prose.String())
+
+	var optimized strings.Builder
+	for _, segment := range segments {
+		if segment.protected {
+			optimized.WriteString(segment.text)
+			continue
+		}
+		optimized.WriteString(optimizeProse(segment.text, english))
+	}
+	return strings.TrimLeft(strings.TrimRight(optimized.String(), " \t\n"), "\n")
+}
+
+// protectedPattern matches text the rule-based optimizer must not rewrite: fenced code blocks (to
+// the end of the text if unclosed), indented code lines, inline code, URLs and double-quoted strings
+var protectedPattern = regexp.MustCompile("(?s:```.*?(?:```|\\z))|(?s:~~~.*?(?:~~~|\\z))|(?m:^(?: {4}|\\t).*$)|`[^`\\n]+`|https?://[^\\s<>\"']+|\"[^\"\\n]*\"|“[^”\\n]*”")
 
-	// Remove unnecessary whitespace
-	optimized = regexp.MustCompile(`\s+`).ReplaceAllString(optimized, " ")
-	optimized = strings.TrimSpace(optimized)
+// textSegment is a run of prose or of protected text
+type textSegment struct {
+	text      string
+	protected bool
+}
+
+// splitProtected splits text into prose and the protected spans between it
+func splitProtected(text string) []textSegment {
+	var segments []textSegment
+	last := 0
+	for _, match := range protectedPattern.FindAllStringIndex(text, -1) {
+		if match[0] > last {
+			segments = append(segments, textSegment{text: text[last:match[0]]})
+		}
+		segments = append(segments, textSegment{text: text[match[0]:match[1]], protected: true})
+		last = match[1]
+	}
+	if last < len(text) {
+		segments = append(segments, textSegment{text: text[last:]})
+	}
+	return segments
+}
+
+// englishFunctionWords are common English words; prose where they are rare is not treated as English
+var englishFunctionWords = []string{"a", "an", "the", "and", "or", "is", "are", "be", "to", "of", "in", "on", "this", "that", "it", "for", "with", "you", "what", "how", "please"}
+
+// looksEnglish reports whether prose is written mostly in ASCII letters and at least a fifth of its
+// words are common English words, so English phrase rules are not applied to other languages
+func looksEnglish(text string) bool {
+	letters, ascii := 0, 0
+	for _, r := range text {
+		if unicode.IsLetter(r) {
+			letters++
+			if r <= unicode.MaxASCII {
+				ascii++
+			}
+		}
+	}
+	if letters == 0 || ascii*10 < letters*9 {
+		return false
+	}
 
-	// Remove redundant punctuation
-	optimized = regexp.MustCompile(`[.!?]+`).ReplaceAllString(optimized, ".")
-	optimized = regexp.MustCompile(`[,;]+`).ReplaceAllString(optimized, ",")
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !isWordRune(r) })
+	common := 0
+	for _, word := range words {
+		if slices.Contains(englishFunctionWords, word) {
+			common++
+		}
+	}
+	return common > 0 && common*5 >= len(words)
+}
 
-	// Remove unnecessary words and phrases
-	unnecessaryWords := []string{
-		"please", "kindly", "if you could", "would you mind",
-		"i would like to", "i want to", "i need to",
-		"in order to", "so that", "in such a way that",
-		"very", "really", "quite", "rather",
-		"basically", "essentially", "fundamentally",
-		"as a matter of fact", "in fact", "actually",
-		"you know", "i mean", "like", "sort of", "kind of",
+// ruleReplacements shortens wordy English phrases. Phrases removed outright are filler whose
+// removal never changes meaning; words such as "like" or "so that" are left alone.
+var ruleReplacements = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{phrasePattern("it is important to note that"), ""},
+	{phrasePattern("it should be noted that"), ""},
+	{phrasePattern("it is worth mentioning that"), ""},
+	{phrasePattern("as a matter of fact"), ""},
+	{phrasePattern("in spite of the fact that"), "although"},
+	{phrasePattern("due to the fact that"), "because"},
+	{phrasePattern("at this point in time"), "now"},
+	{phrasePattern("in the event that"), "if"},
+	{phrasePattern("in order to"), "to"},
+	{phrasePattern("with regard to"), "regarding"},
+	{phrasePattern("with respect to"), "regarding"},
+	{phrasePattern("basically"), ""},
+	{phrasePattern("essentially"), ""},
+	{phrasePattern("kindly"), ""},
+	{phrasePattern("please"), ""},
+}
+
+// phrasePattern matches a phrase case-insensitively, allowing any whitespace between its words
+func phrasePattern(phrase string) *regexp.Regexp {
+	words := strings.Fields(phrase)
+	for i, word := range words {
+		words[i] = regexp.QuoteMeta(word)
 	}
+	return regexp.MustCompile(`(?i)` + strings.Join(words, `\s+`))
+}
+
+var (
+	// repeatedPunctuation matches runs of a repeated ! ? , or ;
+	repeatedPunctuation = regexp.MustCompile(`!{2,}|\?{2,}|,{2,}|;{2,}`)
+	// innerSpaces matches runs of spaces after a non-space character, so indentation is kept
+	innerSpaces = regexp.MustCompile(`(\S)[ \t]{2,}`)
+	// spaceBeforePunctuation matches spaces left before punctuation by removed phrases
+	spaceBeforePunctuation = regexp.MustCompile(`[ \t]+([,.;:!?])`)
+	// trailingSpaces matches spaces at the end of a line
+	trailingSpaces = regexp.MustCompile(`[ \t]+\n`)
+	// blankLines matches more than one blank line
+	blankLines = regexp.MustCompile(`\n{3,}`)
+)
 
-	for _, word := range unnecessaryWords {
-		pattern := regexp.MustCompile(`(?i)\b` + regexp.QuoteMeta(word) + `\b`)
-		optimized = pattern.ReplaceAllString(optimized, "")
+// optimizeProse applies the rules to a run of prose, keeping its line structure
+func optimizeProse(text string, english bool) string {
+	if english {
+		for _, rule := range ruleReplacements {
+			text = replacePhrase(text, rule.pattern, rule.replacement)
+		}
 	}
 
-	// Remove redundant phrases
-	redundantPhrases := map[string]string{
-		"in the event that":            "if",
-		"at this point in time":        "now",
-		"due to the fact that":         "because",
-		"in spite of the fact that":    "although",
-		"with regard to":               "regarding",
-		"with respect to":              "regarding",
-		"in terms of":                  "regarding",
-		"as far as .* is concerned":    "regarding",
-		"it is important to note that": "",
-		"it should be noted that":      "",
-		"it is worth mentioning that":  "",
+	text = repeatedPunctuation.ReplaceAllStringFunc(text, func(run string) string { return run[:1] })
+	text = innerSpaces.ReplaceAllString(text, "$1 ")
+	if english {
+		text = spaceBeforePunctuation.ReplaceAllString(text, "$1")
 	}
+	text = trailingSpaces.ReplaceAllString(text, "\n")
+	return blankLines.ReplaceAllString(text, "\n\n")
+}
+
+// replacePhrase replaces whole-word matches of pattern with replacement, keeping a leading capital.
+// A removed phrase takes a following comma and spaces with it and passes its capital on to the next word.
+func replacePhrase(text string, pattern *regexp.Regexp, replacement string) string {
+	var out strings.Builder
+	last := 0
+	capitalizeNext := false
+	for _, match := range pattern.FindAllStringIndex(text, -1) {
+		start, end := match[0], match[1]
+		before, _ := utf8.DecodeLastRuneInString(text[:start])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if start < last || (start > 0 && isWordRune(before)) || (end < len(text) && isWordRune(after)) {
+			continue
+		}
 
-	for phrase, replacement := range redundantPhrases {
-		pattern := regexp.MustCompile(`(?i)` + phrase)
-		optimized = pattern.ReplaceAllString(optimized, replacement)
+		out.WriteString(withCapital(text[last:start], capitalizeNext))
+		capitalizeNext = false
+		leadingCapital := unicode.IsUpper([]rune(text[start:end])[0])
+		if replacement == "" {
+			if end < len(text) && text[end] == ',' {
+				end++
+			}
+			for end < len(text) && (text[end] == ' ' || text[end] == '\t') {
+				end++
+			}
+			capitalizeNext = leadingCapital
+		} else {
+			out.WriteString(withCapital(replacement, leadingCapital))
+		}
+		last = end
+	}
+	if last == 0 {
+		return text
 	}
+	out.WriteString(withCapital(text[last:], capitalizeNext))
+	return out.String()
+}
 
-	// Clean up multiple spaces again
-	optimized = regexp.MustCompile(`\s+`).ReplaceAllString(optimized, " ")
-	optimized = strings.TrimSpace(optimized)
+// withCapital upper-cases the first letter of text when capitalize is set
+func withCapital(text string, capitalize bool) string {
+	if !capitalize {
+		return text
+	}
+	for i, r := range text {
+		if unicode.IsLetter(r) {
+			return text[:i] + string(unicode.ToUpper(r)) + text[i+utf8.RuneLen(r):]
+		}
+		if !unicode.IsSpace(r) {
+			return text
+		}
+	}
+	return text
+}
 
-	return optimized
+// isWordRune reports whether r can be part of a word, so phrases only match whole words in any script
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '\'' || r == '’' || r == '-'
 }
 
 // buildPromptOptimizationPrompt creates an optimized prompt for prompt optimization
@@ -347,15 +538,34 @@ func (o *Optimizer) CalculateOptimizationSavings(originalTokens, optimizedTokens
 	return savings, savingsPercent
 }
 
-// OptimizePromptWithMode optimizes a user prompt for token efficiency with a given mode
-func (o *Optimizer) OptimizePromptWithMode(ctx context.Context, originalPrompt string, mode string) (*OptimizationResult, error) {
+// OptimizePromptWithMode optimizes a user prompt for token efficiency with a given mode.
+// Rule-based rewriting is tried first unless ruleBased is false.
+func (o *Optimizer) OptimizePromptWithMode(ctx context.Context, originalPrompt string, mode string, ruleBased bool) (*OptimizationResult, error) {
 	if mode != "efficiency" {
 		mode = "context"
 	}
-	return o.optimizePromptWithMode(ctx, originalPrompt, mode)
+
+	ctx, span := tracer.Start(ctx, "optimizer.optimize_prompt", trace.WithAttributes(
+		attribute.String("optimization.mode", mode),
+		attribute.Int("optimization.prompt_length", len(originalPrompt)),
+		attribute.Bool("optimization.rule_based", ruleBased),
+	))
+	defer span.End()
+
+	result, err := o.optimizePromptWithMode(ctx, originalPrompt, mode, ruleBased)
+	if err != nil {
+		recordSpanError(span, err)
+		return nil, err
+	}
+
+	span.SetAttributes(
+		attribute.Bool("optimization.applied", result.WasOptimized),
+		attribute.Int("optimization.tokens_saved", result.TokensSaved),
+	)
+	return result, nil
 }
 
-func (o *Optimizer) optimizePromptWithMode(ctx context.Context, originalPrompt string, mode string) (*OptimizationResult, error) {
+func (o *Optimizer) optimizePromptWithMode(ctx context.Context, originalPrompt string, mode string, ruleBased bool) (*OptimizationResult, error) {
 	result := &OptimizationResult{
 		OriginalText:     originalPrompt,
 		OptimizationType: "prompt",
@@ -363,19 +573,10 @@ func (o *Optimizer) optimizePromptWithMode(ctx context.Context, originalPrompt s
 	}
 
 	// Apply rule-based optimizations first (no API call)
-	ruleOptimized := o.applyRuleBasedOptimizations(originalPrompt)
-	if ruleOptimized != originalPrompt {
-		result.OptimizedText = ruleOptimized
-		result.WasOptimized = true
-		result.OptimizationType = "rule_based"
-		// Use rough estimation for rule-based optimization (no API call)
-		result.OriginalTokens = len(originalPrompt) / 4
-		result.OptimizedTokens = len(ruleOptimized) / 4
-		result.TokensSaved = result.OriginalTokens - result.OptimizedTokens
-		if result.OriginalTokens > 0 {
-			result.SavingsPercent = float64(result.TokensSaved) / float64(result.OriginalTokens) * 100
+	if ruleBased {
+		if ruleResult := RuleBasedOptimization(originalPrompt); ruleResult.WasOptimized {
+			return ruleResult, nil
 		}
-		return result, nil
 	}
 
 	// Use AI-based optimization - ONLY ONE API CALL to Gemma 3
@@ -405,6 +606,16 @@ func (o *Optimizer) optimizePromptWithMode(ctx context.Context, originalPrompt s
 		return result, nil
 	}
 
+	// Record what the optimizer call cost, estimating it when the provider reports no usage
+	result.OptimizerInputTokens, result.OptimizerOutputTokens = resp.InputTokens, resp.OutputTokens
+	if resp.Usage != nil && result.OptimizerInputTokens == 0 {
+		result.OptimizerInputTokens, result.OptimizerOutputTokens = resp.Usage.PromptTokens, resp.Usage.CompletionTokens
+	}
+	if result.OptimizerInputTokens == 0 {
+		result.OptimizerInputTokens = len(optimizationPrompt) / 4
+		result.OptimizerOutputTokens = len(resp.Text) / 4
+	}
+
 	optimizedPrompt := strings.TrimSpace(resp.Text)
 	// Clean up the response - remove quotes and extra formatting
 	optimizedPrompt = o.cleanOptimizedResponse(optimizedPrompt)
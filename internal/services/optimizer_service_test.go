@@ -0,0 +1,225 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyRuleBasedOptimizations(t *testing.T) {
+	optimizer := &Optimizer{}
+
+	testCases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "RemovesFiller",
+			input:    "Please summarize this article, it is basically about   climate change.",
+			expected: "Summarize this article, it is about climate change.",
+		},
+		{
+			name:     "ShortensWordyPhrases",
+			input:    "In order to help, explain why this fails due to the fact that the cache is cold.",
+			expected: "To help, explain why this fails because the cache is cold.",
+		},
+		{
+			name:     "KeepsMeaningfulWords",
+			input:    "I would like a list of the things that are really unlike each other.",
+			expected: "I would like a list of the things that are really unlike each other.",
+		},
+		{
+			name:     "RespectsWordBoundaries",
+			input:    "Explain the pleased customers and the kindlyness test for this service.",
+			expected: "Explain the pleased customers and the kindlyness test for this service.",
+		},
+		{
+			name:     "KeepsQuestionsAndExclamations",
+			input:    "What is the answer to this?? Tell me now!!!",
+			expected: "What is the answer to this? Tell me now!",
+		},
+		{
+			name:     "SkipsFencedCodeBlocks",
+			input:    "Please fix this code:\n\n```python\ndef f(x):\n    # please   keep\n    return x  like  y\n```\n\nThanks.",
+			expected: "Fix this code:\n\n```python\ndef f(x):\n    # please   keep\n    return x  like  y\n```\n\nThanks.",
+		},
+		{
+			name:     "SkipsInlineCode",
+			input:    "Please explain what `grep -E 'a  b'` does and why it is basically fast.",
+			expected: "Explain what `grep -E 'a  b'` does and why it is fast.",
+		},
+		{
+			name:     "SkipsIndentedCode",
+			input:    "Please review this snippet:\n\n    please   do   not   touch\n\nIt is for the parser.",
+			expected: "Review this snippet:\n\n    please   do   not   touch\n\nIt is for the parser.",
+		},
+		{
+			name:     "SkipsURLs",
+			input:    "Please fetch https://example.com/please/basically?q=in%20order%20to and summarize the page.",
+			expected: "Fetch https://example.com/please/basically?q=in%20order%20to and summarize the page.",
+		},
+		{
+			name:     "SkipsQuotedStrings",
+			input:    `Please translate "please, basically  do it" to French for the app.`,
+			expected: `Translate "please, basically  do it" to French for the app.`,
+		},
+		{
+			name:     "KeepsLineStructure",
+			input:    "Please do the following:\n- Step one\n- Step two\n\n\n\nThat is all.",
+			expected: "Do the following:\n- Step one\n- Step two\n\nThat is all.",
+		},
+		{
+			name:     "SkipsEnglishRulesForOtherLanguages",
+			input:    "Bitte erkläre mir, wie   dieser Algorithmus funktioniert, please.",
+			expected: "Bitte erkläre mir, wie dieser Algorithmus funktioniert, please.",
+		},
+		{
+			name:     "UnclosedFenceIsProtected",
+			input:    "Please check:\n```\nplease   keep",
+			expected: "Check:\n```\nplease   keep",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, optimizer.applyRuleBasedOptimizations(tc.input))
+		})
+	}
+}
+
+func TestLooksEnglish(t *testing.T) {
+	assert.True(t, looksEnglish("Summarize the following text"))
+	assert.False(t, looksEnglish("Résume le texte suivant s'il vous plaît"))
+	assert.False(t, looksEnglish("これを要約してください"))
+	assert.False(t, looksEnglish(""))
+}
+
+func TestOptimizePromptSavingsThreshold(t *testing.T) {
+	service := &GenerationService{
+		config: &utils.Config{
+			Optimization: utils.OptimizationConfig{Enabled: true, MinSavingsPercent: 10},
+			Timeouts:     utils.TimeoutConfig{Optimization: time.Second},
+		},
+		optimizer:  &Optimizer{},
+		tokenizers: NewTokenizerRegistry(),
+	}
+	requestCtx := &RequestContext{Logger: slog.Default()}
+	wordy := "Please summarize this article in order to explain, basically, why the results matter."
+	terse := "Please summarize the following quarterly report for the board and list its three largest risks."
+
+	modelConfig := ModelConfig{InputPricePerMillion: 10}
+
+	t.Run("KeepsLargeSavings", func(t *testing.T) {
+		req := &GenerationRequest{Prompt: wordy}
+		result, err := service.optimizePrompt(context.Background(), req, modelConfig, requestCtx, 50)
+		require.NoError(t, err)
+		assert.True(t, result.WasOptimized)
+		assert.Equal(t, result.OptimizedText, req.Prompt)
+		assert.Equal(t, result.TokensSaved, result.NetTokensSaved)
+		assert.Equal(t, data.CostForTokens(result.TokensSaved, 10), result.NetSavings)
+	})
+
+	t.Run("RejectsSmallSavings", func(t *testing.T) {
+		req := &GenerationRequest{Prompt: terse}
+		result, err := service.optimizePrompt(context.Background(), req, modelConfig, requestCtx, 50)
+		require.NoError(t, err)
+		assert.False(t, result.WasOptimized)
+		assert.Equal(t, "below_savings_threshold", result.FallbackReason)
+		assert.Equal(t, terse, req.Prompt)
+		assert.Zero(t, result.TokensSaved)
+		assert.Zero(t, result.NetSavings)
+	})
+
+	t.Run("OptOut", func(t *testing.T) {
+		req := &GenerationRequest{Prompt: wordy, DisableOptimization: true}
+		result, err := service.optimizePrompt(context.Background(), req, modelConfig, requestCtx, 50)
+		require.NoError(t, err)
+		assert.Nil(t, result)
+		assert.Equal(t, wordy, req.Prompt)
+	})
+}
+
+func TestOptimizePromptTierThreshold(t *testing.T) {
+	service := &GenerationService{
+		config: &utils.Config{
+			Optimization: utils.OptimizationConfig{Enabled: true},
+			Timeouts:     utils.TimeoutConfig{Optimization: time.Second},
+		},
+		optimizer:  &Optimizer{},
+		tokenizers: NewTokenizerRegistry(),
+	}
+	wordy := "Please summarize this article in order to explain, basically, why the results matter."
+	requestCtx := &RequestContext{Logger: slog.Default(), PricingTier: PricingTier{
+		Optimization: data.OptimizationSettings{
+			MinPromptChars: 200,
+			Models: []data.ModelOptimization{
+				{Pattern: "gpt-4o*", MinPromptChars: 60},
+				{Pattern: "claude-*", Disabled: true},
+			},
+		},
+	}}
+
+	testCases := []struct {
+		name      string
+		model     string
+		optimized bool
+	}{
+		{"TierThreshold", "gemini-2.5-flash", false},
+		{"FamilyThreshold", "gpt-4o-mini", true},
+		{"FamilyDisabled", "claude-sonnet-4-20250514", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &GenerationRequest{Prompt: wordy}
+			result, err := service.optimizePrompt(context.Background(), req, ModelConfig{ModelID: tc.model}, requestCtx, 50)
+			require.NoError(t, err)
+			assert.Equal(t, tc.optimized, result != nil)
+		})
+	}
+
+	assert.Error(t, data.OptimizationSettings{Models: []data.ModelOptimization{{Pattern: "gpt-["}}}.Validate())
+	assert.Error(t, data.OptimizationSettings{MinPromptChars: -1}.Validate())
+	assert.NoError(t, requestCtx.PricingTier.Optimization.Validate())
+}
+
+func TestOptimizationGuard(t *testing.T) {
+	service := &GenerationService{
+		config: &utils.Config{
+			Optimization: utils.OptimizationConfig{Enabled: true},
+			Timeouts:     utils.TimeoutConfig{Optimization: time.Second},
+		},
+		optimizer:  &Optimizer{},
+		tokenizers: NewTokenizerRegistry(),
+	}
+	requestCtx := &RequestContext{Logger: slog.Default()}
+	wordy := "Please summarize this article in order to explain, basically, why the results matter."
+	code := "Fix this function, basically:   \n\n\n\nfunc add(a, b int) int {\n\treturn a - b\n}"
+
+	testCases := []struct {
+		name      string
+		req       *GenerationRequest
+		guard     string
+		optimized string
+	}{
+		{"Tools", &GenerationRequest{Prompt: wordy, Extra: map[string]interface{}{"tools": []interface{}{map[string]interface{}{"name": "search"}}}}, OptimizationGuardTools, wordy},
+		{"JSONOutput", &GenerationRequest{Prompt: wordy, Extra: map[string]interface{}{"response_format": map[string]interface{}{"type": "json_object"}}}, OptimizationGuardJSONOutput, wordy},
+		{"JSONPrompt", &GenerationRequest{Prompt: `{"task": "summarize",   "text": "in order to explain, basically"}`}, OptimizationGuardJSONPrompt, `{"task": "summarize",   "text": "in order to explain, basically"}`},
+		{"Code", &GenerationRequest{Prompt: code}, OptimizationGuardCode, "Fix this function, basically:\n\nfunc add(a, b int) int {\n\treturn a - b\n}"},
+		{"EmptyTools", &GenerationRequest{Prompt: wordy, Extra: map[string]interface{}{"tools": []interface{}{}}}, "", "Summarize this article to explain, why the results matter."},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := service.optimizePrompt(context.Background(), tc.req, ModelConfig{}, requestCtx, 50)
+			require.NoError(t, err)
+			assert.Equal(t, tc.guard, result.Guard)
+			assert.Equal(t, tc.optimized, tc.req.Prompt)
+		})
+	}
+}
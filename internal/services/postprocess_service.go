@@ -0,0 +1,399 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/apt-router/api/internal/data"
+)
+
+// Transforms API keys can enable by name
+const (
+	// TransformTrimWhitespace removes leading and trailing whitespace from the completion
+	TransformTrimWhitespace = "trim_whitespace"
+	// TransformRedactSecrets replaces API keys, access tokens and similar credentials with a placeholder
+	TransformRedactSecrets = "redact_secrets"
+)
+
+// ErrUnknownTransform is returned for a post-processing transform name that does not exist
+var ErrUnknownTransform = errors.New("unknown post-processing transform")
+
+// ResponseTransform rewrites completion text on its way to the client. A streamed completion is
+// passed through in order, in pieces cut only at whitespace, with last set on the final piece; a
+// non-streamed completion is one last piece. Transforms may keep state for a single completion.
+type ResponseTransform interface {
+	Transform(piece string, last bool) string
+}
+
+// responseTransforms creates the transforms API keys can enable, by name
+var responseTransforms = map[string]func() ResponseTransform{
+	TransformTrimWhitespace: func() ResponseTransform { return &trimWhitespace{} },
+	TransformRedactSecrets:  func() ResponseTransform { return redactSecrets{} },
+}
+
+// ValidatePostProcessing checks that cfg only names known transforms
+func ValidatePostProcessing(cfg data.PostProcessing) error {
+	for _, name := range cfg.Transforms {
+		if _, ok := responseTransforms[name]; !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownTransform, name)
+		}
+	}
+	if cfg.MaxLength < 0 {
+		return fmt.Errorf("post-processing max_length must not be negative")
+	}
+	return nil
+}
+
+// ResponsePipeline strips optimization markers from a completion, then applies its transforms in
+// order
+type ResponsePipeline struct {
+	markers    *markerFilter
+	transforms []ResponseTransform
+	pending    strings.Builder
+}
+
+// maxPendingBytes bounds how much of a stream is held back waiting for whitespace
+const maxPendingBytes = 4096
+
+// NewResponsePipeline builds the pipeline for one completion: optimization markers are stripped
+// when stripMarkers is set, then the transforms cfg names run in order and max_length truncates the
+// result. It returns nil when there is nothing to do.
+func NewResponsePipeline(cfg *data.PostProcessing, stripMarkers bool) *ResponsePipeline {
+	var markers *markerFilter
+	if stripMarkers {
+		markers = &markerFilter{}
+	}
+	var transforms []ResponseTransform
+	if cfg != nil {
+		for _, name := range cfg.Transforms {
+			if newTransform, ok := responseTransforms[name]; ok {
+				transforms = append(transforms, newTransform())
+			}
+		}
+		if cfg.MaxLength > 0 {
+			transforms = append(transforms, &maxLength{remaining: cfg.MaxLength})
+		}
+	}
+	if markers == nil && len(transforms) == 0 {
+		return nil
+	}
+	return &ResponsePipeline{markers: markers, transforms: transforms}
+}
+
+// Apply transforms a complete, non-streamed completion
+func (p *ResponsePipeline) Apply(text string) string {
+	if p == nil {
+		return text
+	}
+	if p.markers != nil {
+		text = stripMarkers(text, 0)
+	}
+	return p.transform(text, true)
+}
+
+// Write adds a streamed chunk and returns the transformed text that is safe to send. Marker stripping
+// only holds back a tail that could begin a marker; transforms then get everything before the last
+// run of whitespace, so a match is never split between two pieces.
+func (p *ResponsePipeline) Write(chunk string) string {
+	if p.markers != nil {
+		chunk = p.markers.Write(chunk)
+	}
+	if len(p.transforms) == 0 {
+		return chunk
+	}
+
+	p.pending.WriteString(chunk)
+	buffered := p.pending.String()
+
+	cut := 0
+	if last := strings.LastIndexFunc(buffered, unicode.IsSpace); last > 0 {
+		cut = len(strings.TrimRightFunc(buffered[:last], unicode.IsSpace))
+	}
+	if cut == 0 && len(buffered) >= maxPendingBytes {
+		// A very long run without whitespace is sent anyway rather than held indefinitely,
+		// keeping back only a rune split across chunks
+		cut = len(buffered)
+		start := cut - 1
+		for start > 0 && !utf8.RuneStart(buffered[start]) {
+			start--
+		}
+		if !utf8.FullRuneInString(buffered[start:]) {
+			cut = start
+		}
+	}
+	if cut == 0 {
+		return ""
+	}
+
+	p.pending.Reset()
+	p.pending.WriteString(buffered[cut:])
+	return p.transform(buffered[:cut], false)
+}
+
+// Flush returns the transformed remainder at the end of a stream
+func (p *ResponsePipeline) Flush() string {
+	rest := ""
+	if p.markers != nil {
+		rest = p.markers.Flush()
+	}
+	rest = p.pending.String() + rest
+	p.pending.Reset()
+	return p.transform(rest, true)
+}
+
+func (p *ResponsePipeline) transform(piece string, last bool) string {
+	for _, t := range p.transforms {
+		piece = t.Transform(piece, last)
+	}
+	return piece
+}
+
+// optimizationMarkerPattern matches the savings estimate the optimizer asks models to append, with
+// the whitespace before it. The marker must not follow a word, so identifiers such as
+// my_tokens_saved=3 are left alone; the character before it is captured so it can be kept.
+var optimizationMarkerPattern = regexp.MustCompile(`(^|[^\w\[])\s*\[?(?:tokens_saved|saved_tokens)\]?=\d+`)
+
+// optimizationMarkerNames are the spellings of the marker models use
+var optimizationMarkerNames = []string{"tokens_saved", "saved_tokens"}
+
+// maxMarkerPrefix is the longest marker text before its digits that can be split across chunks
+const maxMarkerPrefix = len("[saved_tokens]=")
+
+// markerFilter removes optimization markers from a stream, holding back only a short tail that could
+// be the start of a marker and the whitespace before it
+type markerFilter struct {
+	pending string
+	// before is the last character of the stream before pending, which decides whether a marker
+	// at the start of pending follows a word
+	before string
+}
+
+// Write adds a chunk and returns the text before any possible marker
+func (f *markerFilter) Write(chunk string) string {
+	text := f.before + f.pending + chunk
+	offset := len(f.before)
+
+	var out strings.Builder
+	start, hold := offset, len(text)
+	for _, match := range optimizationMarkerPattern.FindAllStringSubmatchIndex(text, -1) {
+		if match[1] == len(text) {
+			// More digits may follow in the next chunk
+			hold = max(start, markerStart(text, match))
+			break
+		}
+		out.WriteString(text[start:max(start, markerStart(text, match))])
+		start = match[1]
+	}
+	if hold == len(text) {
+		hold = start + markerPrefixStart(text[start:])
+	}
+
+	out.WriteString(text[start:hold])
+	f.pending = text[hold:]
+	if _, size := utf8.DecodeLastRuneInString(text[:hold]); size > 0 {
+		f.before = text[hold-size : hold]
+	}
+	return out.String()
+}
+
+// Flush returns the held back tail at the end of the stream, without a marker
+func (f *markerFilter) Flush() string {
+	rest := stripMarkers(f.before+f.pending, len(f.before))
+	f.pending = ""
+	return rest
+}
+
+// stripMarkers returns text[offset:] without its optimization markers; text[:offset] is the text
+// before it, which only decides whether a marker at offset follows a word
+func stripMarkers(text string, offset int) string {
+	var out strings.Builder
+	start := offset
+	for _, match := range optimizationMarkerPattern.FindAllStringSubmatchIndex(text, -1) {
+		out.WriteString(text[start:max(start, markerStart(text, match))])
+		start = match[1]
+	}
+	out.WriteString(text[start:])
+	return out.String()
+}
+
+// markerStart returns where the text a marker match removes begins: after the character captured
+// before the marker, unless that is whitespace, which is removed with the marker
+func markerStart(text string, match []int) int {
+	if match[2] < match[3] && !isMarkerSpace(text[match[2]]) {
+		return match[3]
+	}
+	return match[0]
+}
+
+// markerPrefixStart returns where the tail of s that could begin a marker starts, including the
+// whitespace before it, or len(s) when no marker can follow
+func markerPrefixStart(s string) int {
+	start := len(s)
+	for i := max(0, len(s)-maxMarkerPrefix); i < len(s); i++ {
+		if couldBeginMarker(s[i:]) {
+			start = i
+			break
+		}
+	}
+	for start > 0 && len(s)-start < maxPendingBytes && isMarkerSpace(s[start-1]) {
+		start--
+	}
+	return start
+}
+
+// couldBeginMarker reports whether s is an incomplete marker
+func couldBeginMarker(s string) bool {
+	s = strings.TrimPrefix(s, "[")
+	for _, name := range optimizationMarkerNames {
+		if len(s) <= len(name) {
+			if strings.HasPrefix(name, s) {
+				return true
+			}
+			continue
+		}
+		if rest, ok := strings.CutPrefix(s, name); ok && (rest == "]" || rest == "=" || rest == "]=") {
+			return true
+		}
+	}
+	return false
+}
+
+// isMarkerSpace reports whether b is whitespace optimizationMarkerPattern strips before a marker
+func isMarkerSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\f'
+}
+
+// trimWhitespace removes whitespace before the first and after the last text of the completion
+type trimWhitespace struct {
+	started bool
+}
+
+func (t *trimWhitespace) Transform(piece string, last bool) string {
+	if !t.started {
+		piece = strings.TrimLeftFunc(piece, unicode.IsSpace)
+		t.started = piece != ""
+	}
+	if last {
+		piece = strings.TrimRightFunc(piece, unicode.IsSpace)
+	}
+	return piece
+}
+
+// secretPatterns match common credential formats. None contain whitespace, so streamed pieces
+// never split a match.
+var secretPatterns = regexp.MustCompile(strings.Join([]string{
+	`sk-[A-Za-z0-9_-]{20,}`,         // OpenAI and Anthropic API keys
+	`AKIA[0-9A-Z]{16}`,              // AWS access key IDs
+	`AIza[0-9A-Za-z_-]{35}`,         // Google API keys
+	`gh[pousr]_[A-Za-z0-9]{36,}`,    // GitHub tokens
+	`xox[abposr]-[A-Za-z0-9-]{10,}`, // Slack tokens
+	`sk_live_[0-9A-Za-z]{24,}`,      // Stripe secret keys
+	`eyJ[\w-]+\.eyJ[\w-]+\.[\w-]+`,  // JSON web tokens
+	`apt-[0-9a-f]{64}`,              // AptRouter API keys
+}, "|"))
+
+// redactedSecret replaces each redacted credential
+const redactedSecret = "[REDACTED]"
+
+// redactSecrets replaces credentials in the completion
+type redactSecrets struct{}
+
+func (redactSecrets) Transform(piece string, last bool) string {
+	return secretPatterns.ReplaceAllString(piece, redactedSecret)
+}
+
+// maxLength truncates the completion to a number of characters
+type maxLength struct {
+	remaining int
+}
+
+func (m *maxLength) Transform(piece string, last bool) string {
+	if m.remaining <= 0 {
+		return ""
+	}
+	if n := utf8.RuneCountInString(piece); n <= m.remaining {
+		m.remaining -= n
+		return piece
+	}
+	runes := []rune(piece)[:m.remaining]
+	m.remaining = 0
+	return string(runes)
+}
+
+// postProcessedStream applies a response pipeline to a completion stream
+type postProcessedStream struct {
+	io.ReadCloser
+	pipeline *ResponsePipeline
+	// buf is pooled and returned on Close; out[pos:] is the processed text not yet read
+	buf *[]byte
+	out []byte
+	pos int
+	err error
+}
+
+// newPostProcessedStream wraps stream so reads return its text after pipeline, or returns stream
+// unchanged when pipeline is nil. Closing it closes stream.
+func newPostProcessedStream(stream io.ReadCloser, pipeline *ResponsePipeline) io.ReadCloser {
+	if pipeline == nil {
+		return stream
+	}
+	return &postProcessedStream{ReadCloser: stream, pipeline: pipeline, buf: GetStreamBuffer()}
+}
+
+func (s *postProcessedStream) Read(p []byte) (int, error) {
+	if s.pos == len(s.out) {
+		s.out, s.pos = s.out[:0], 0
+	}
+	for len(s.out) == 0 && s.err == nil {
+		if s.buf == nil {
+			s.err = io.EOF
+			break
+		}
+		buf := *s.buf
+		n, err := s.ReadCloser.Read(buf)
+		if n > 0 {
+			s.out = append(s.out, s.pipeline.Write(string(buf[:n]))...)
+		}
+		if err != nil {
+			// The stream has ended, so what was held back can be sent
+			s.out = append(s.out, s.pipeline.Flush()...)
+			s.err = err
+		}
+	}
+
+	n := copy(p, s.out[s.pos:])
+	s.pos += n
+	if s.pos < len(s.out) {
+		return n, nil
+	}
+	return n, s.err
+}
+
+// Close closes the wrapped stream and returns the read buffer to the pool
+func (s *postProcessedStream) Close() error {
+	PutStreamBuffer(s.buf)
+	s.buf = nil
+	return s.ReadCloser.Close()
+}
+
+// FinishReason passes through why the wrapped stream ended
+func (s *postProcessedStream) FinishReason() string {
+	if reasoner, ok := s.ReadCloser.(interface{ FinishReason() string }); ok {
+		return reasoner.FinishReason()
+	}
+	return ""
+}
+
+// TakeLogprobs passes through the wrapped stream's token logprobs, which describe the provider's
+// tokens before post-processing
+func (s *postProcessedStream) TakeLogprobs() []data.TokenLogprob {
+	if reader, ok := s.ReadCloser.(data.LogprobsReader); ok {
+		return reader.TakeLogprobs()
+	}
+	return nil
+}
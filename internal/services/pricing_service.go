@@ -2,21 +2,53 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"reflect"
+	"sort"
 	"sync"
 	"time"
 
+	"cloud.google.com/go/firestore"
 	"github.com/apt-router/api/internal/data"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// ErrUnknownModel is returned when an alias points at a model with no active configuration
+var ErrUnknownModel = errors.New("unknown model")
+
 // PricingService handles pricing calculations and model configurations
 type PricingService struct {
 	firebaseService *data.Service
+	cache           Cache
+	audit           *AuditService
 	modelConfigs    map[string]ModelConfig
-	mu              sync.RWMutex
-	lastRefresh     time.Time
-	cacheTTL        time.Duration
+	// modelAliases maps global alias names to concrete model IDs
+	modelAliases map[string]string
+	// orgAliases caches each organization's alias overrides
+	orgAliases map[string]orgAliasEntry
+	// listeners reports the health of the snapshot listeners, keyed by collection
+	listeners   map[string]*ListenerStats
+	mu          sync.RWMutex
+	lastRefresh time.Time
+	cacheTTL    time.Duration
+}
+
+// ListenerStats reports the health of a Firestore snapshot listener
+type ListenerStats struct {
+	Connected  bool      `json:"connected"`
+	LastUpdate time.Time `json:"last_update"`
+	Updates    int       `json:"updates"`
+	Restarts   int       `json:"restarts"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+// orgAliasEntry is an organization's cached aliases
+type orgAliasEntry struct {
+	aliases  map[string]string
+	loadedAt time.Time
 }
 
 // ModelConfig represents pricing configuration for a model
@@ -28,6 +60,63 @@ type ModelConfig struct {
 	OutputPricePerMillion float64 `firestore:"output_price_per_million"`
 	ContextWindowSize     int     `firestore:"context_window_size"`
 	IsActive              bool    `firestore:"is_active"`
+	// TimeoutSeconds overrides the global provider timeout for this model; 0 uses the default
+	TimeoutSeconds int               `firestore:"timeout_seconds,omitempty"`
+	Capabilities   ModelCapabilities `firestore:"capabilities"`
+	// CachedInputPricePerMillion and CacheWritePricePerMillion price input tokens read from and
+	// written to the provider's prompt cache; 0 uses the provider's published discount
+	CachedInputPricePerMillion float64 `firestore:"cached_input_price_per_million,omitempty"`
+	CacheWritePricePerMillion  float64 `firestore:"cache_write_price_per_million,omitempty"`
+	// ReasoningPricePerMillion prices the output tokens a reasoning model spends thinking; 0 prices
+	// them as other output
+	ReasoningPricePerMillion float64 `firestore:"reasoning_price_per_million,omitempty"`
+}
+
+// providerTokenRates are the providers' published prompt cache prices as fractions of the input
+// price: OpenAI halves the price of cached tokens, and Anthropic charges a tenth for cache reads
+// and a quarter more for five-minute cache writes. All of them bill reasoning as output.
+var providerTokenRates = map[string]data.TokenRates{
+	"openai":    {CacheRead: 0.5, CacheWrite: 1, Reasoning: 1},
+	"anthropic": {CacheRead: 0.1, CacheWrite: 1.25, Reasoning: 1},
+	"google":    {CacheRead: 0.25, CacheWrite: 1, Reasoning: 1},
+}
+
+// TokenRates returns the model's prompt cache prices as fractions of its input price and its
+// reasoning price as a fraction of its output price
+func (m ModelConfig) TokenRates() data.TokenRates {
+	rates, ok := providerTokenRates[m.Provider]
+	if !ok {
+		rates = data.TokenRates{CacheRead: 1, CacheWrite: 1, Reasoning: 1}
+	}
+	if m.OutputPricePerMillion > 0 && m.ReasoningPricePerMillion > 0 {
+		rates.Reasoning = m.ReasoningPricePerMillion / m.OutputPricePerMillion
+	}
+	if m.InputPricePerMillion > 0 {
+		if m.CachedInputPricePerMillion > 0 {
+			rates.CacheRead = m.CachedInputPricePerMillion / m.InputPricePerMillion
+		}
+		if m.CacheWritePricePerMillion > 0 {
+			rates.CacheWrite = m.CacheWritePricePerMillion / m.InputPricePerMillion
+		}
+	}
+	return rates
+}
+
+// ModelCapabilities flags the features a model supports
+type ModelCapabilities = data.ModelCapabilities
+
+// ModelListing describes an active model with its prices after the caller's tier markup
+type ModelListing struct {
+	ID                    string            `json:"id"`
+	Provider              string            `json:"provider"`
+	ContextWindowSize     int               `json:"context_window"`
+	InputPricePerMillion  data.MicroUSD     `json:"input_price_per_million"`
+	OutputPricePerMillion data.MicroUSD     `json:"output_price_per_million"`
+	Capabilities          ModelCapabilities `json:"capabilities"`
+	// CachedInputPricePerMillion is the price of input tokens served from the provider's prompt cache
+	CachedInputPricePerMillion data.MicroUSD `json:"cached_input_price_per_million"`
+	// ReasoningPricePerMillion is the price of output tokens spent thinking
+	ReasoningPricePerMillion data.MicroUSD `json:"reasoning_price_per_million"`
 }
 
 // PricingTier represents a pricing tier (for backward compatibility)
@@ -40,21 +129,51 @@ type PricingTier struct {
 	IsActive            bool                    `firestore:"is_active"`
 	IsCustom            bool                    `firestore:"is_custom"`
 	CustomModelPricing  map[string]ModelPricing `firestore:"custom_model_pricing,omitempty"`
+	Moderation          data.ModerationSettings `firestore:"moderation,omitempty"`
+	// Priority is the priority class of the tier's requests
+	Priority string `firestore:"priority,omitempty"`
+	// MaxPromptTokens bounds the prompt of the tier's requests; 0 is unlimited
+	MaxPromptTokens int `firestore:"max_prompt_tokens,omitempty"`
+	// MaxStreamOutputTokens and MaxStreamOutputBytes cap the output of the tier's streams; 0 is unlimited
+	MaxStreamOutputTokens int `firestore:"max_stream_output_tokens,omitempty"`
+	MaxStreamOutputBytes  int `firestore:"max_stream_output_bytes,omitempty"`
+	// Optimization chooses which of the tier's prompts are optimized
+	Optimization data.OptimizationSettings `firestore:"optimization,omitempty"`
 }
 
 // ModelPricing represents custom pricing for specific models
-type ModelPricing struct {
-	ModelID               string  `firestore:"model_id"`
-	Provider              string  `firestore:"provider"`
-	InputPricePerMillion  float64 `firestore:"input_price_per_million"`
-	OutputPricePerMillion float64 `firestore:"output_price_per_million"`
+type ModelPricing = data.ModelPricing
+
+// PricingFor returns the prices and markups the tier applies to a model. Custom model pricing
+// only applies when customPricing is set for the account being billed.
+func (t PricingTier) PricingFor(modelConfig ModelConfig, customPricing bool) data.AppliedPricing {
+	tier := data.PricingTier{
+		InputMarkupPercent:  t.InputMarkupPercent,
+		OutputMarkupPercent: t.OutputMarkupPercent,
+		IsCustom:            t.IsCustom,
+		CustomModelPricing:  t.CustomModelPricing,
+	}
+	return tier.PricingFor(modelConfig.ModelID, customPricing, modelConfig.InputPricePerMillion, modelConfig.OutputPricePerMillion)
+}
+
+// UsesCustomPricing reports whether a request is billed with its tier's custom model pricing.
+// Organizations and tenants with their own tier always are; users only when their account has
+// custom pricing enabled.
+func UsesCustomPricing(orgID string, tenant *data.Tenant, userCustomPricing bool) bool {
+	return orgID != "" || (tenant != nil && tenant.TierID != "") || userCustomPricing
 }
 
-// NewPricingService creates a new pricing service
-func NewPricingService(firebaseService *data.Service) *PricingService {
+// NewPricingService creates a new pricing service. The cache is used to evict pricing tiers
+// when they change in Firestore.
+func NewPricingService(firebaseService *data.Service, cache Cache, audit *AuditService) *PricingService {
 	return &PricingService{
 		firebaseService: firebaseService,
+		cache:           cache,
+		audit:           audit,
+		listeners:       make(map[string]*ListenerStats),
 		modelConfigs:    make(map[string]ModelConfig),
+		modelAliases:    make(map[string]string),
+		orgAliases:      make(map[string]orgAliasEntry),
 		cacheTTL:        5 * time.Minute,
 	}
 }
@@ -70,8 +189,18 @@ func (s *PricingService) PreCacheData(ctx context.Context) error {
 		s.loadDefaultModelConfigs()
 	} else {
 		slog.Info("Successfully loaded model configurations from Firestore")
+		for _, drift := range s.PriceDrift() {
+			slog.Warn("Model configuration differs from the price list",
+				"model_id", drift.ModelID,
+				"field", drift.Field,
+				"listed", drift.Listed,
+				"configured", drift.Actual,
+				"price_list_version", data.ModelPrices().Version)
+		}
 	}
 
+	s.loadModelAliases(ctx)
+
 	// Try to load pricing tiers from Firestore
 	if err := s.loadPricingTiersFromFirestore(); err != nil {
 		slog.Warn("Failed to load pricing tiers from Firestore, using on-demand loading", "error", err)
@@ -87,354 +216,71 @@ func (s *PricingService) PreCacheData(ctx context.Context) error {
 	return nil
 }
 
-// loadDefaultModelConfigs loads the default model configurations
+// loadDefaultModelConfigs loads the models of the canonical price list
 func (s *PricingService) loadDefaultModelConfigs() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// OpenAI Text Models (latest, text-only)
-	s.modelConfigs["gpt-4.1-2025-04-14"] = ModelConfig{
-		ID:                    "101",
-		ModelID:               "gpt-4.1-2025-04-14",
-		Provider:              "openai",
-		InputPricePerMillion:  2.00,
-		OutputPricePerMillion: 8.00,
-		ContextWindowSize:     128000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["gpt-4.1-mini-2025-04-14"] = ModelConfig{
-		ID:                    "102",
-		ModelID:               "gpt-4.1-mini-2025-04-14",
-		Provider:              "openai",
-		InputPricePerMillion:  0.40,
-		OutputPricePerMillion: 1.60,
-		ContextWindowSize:     128000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["gpt-4.1-nano-2025-04-14"] = ModelConfig{
-		ID:                    "103",
-		ModelID:               "gpt-4.1-nano-2025-04-14",
-		Provider:              "openai",
-		InputPricePerMillion:  0.10,
-		OutputPricePerMillion: 0.40,
-		ContextWindowSize:     128000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["gpt-4.5-preview-2025-02-27"] = ModelConfig{
-		ID:                    "104",
-		ModelID:               "gpt-4.5-preview-2025-02-27",
-		Provider:              "openai",
-		InputPricePerMillion:  75.00,
-		OutputPricePerMillion: 150.00,
-		ContextWindowSize:     128000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["gpt-4o-2024-08-06"] = ModelConfig{
-		ID:                    "105",
-		ModelID:               "gpt-4o-2024-08-06",
-		Provider:              "openai",
-		InputPricePerMillion:  2.50,
-		OutputPricePerMillion: 10.00,
-		ContextWindowSize:     128000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["gpt-4o-2024-11-20"] = ModelConfig{
-		ID:                    "106",
-		ModelID:               "gpt-4o-2024-11-20",
-		Provider:              "openai",
-		InputPricePerMillion:  2.50,
-		OutputPricePerMillion: 10.00,
-		ContextWindowSize:     128000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["gpt-4o"] = ModelConfig{
-		ID:                    "107",
-		ModelID:               "gpt-4o",
-		Provider:              "openai",
-		InputPricePerMillion:  5.00,
-		OutputPricePerMillion: 15.00,
-		ContextWindowSize:     128000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["gpt-4o-mini-2024-07-18"] = ModelConfig{
-		ID:                    "108",
-		ModelID:               "gpt-4o-mini-2024-07-18",
-		Provider:              "openai",
-		InputPricePerMillion:  0.15,
-		OutputPricePerMillion: 0.60,
-		ContextWindowSize:     128000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["o1-2024-12-17"] = ModelConfig{
-		ID:                    "109",
-		ModelID:               "o1-2024-12-17",
-		Provider:              "openai",
-		InputPricePerMillion:  15.00,
-		OutputPricePerMillion: 60.00,
-		ContextWindowSize:     128000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["o3-2025-04-16"] = ModelConfig{
-		ID:                    "110",
-		ModelID:               "o3-2025-04-16",
-		Provider:              "openai",
-		InputPricePerMillion:  2.00,
-		OutputPricePerMillion: 8.00,
-		ContextWindowSize:     128000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["o3-mini-2025-01-31"] = ModelConfig{
-		ID:                    "111",
-		ModelID:               "o3-mini-2025-01-31",
-		Provider:              "openai",
-		InputPricePerMillion:  1.10,
-		OutputPricePerMillion: 4.40,
-		ContextWindowSize:     128000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["o1-mini-2024-09-12"] = ModelConfig{
-		ID:                    "112",
-		ModelID:               "o1-mini-2024-09-12",
-		Provider:              "openai",
-		InputPricePerMillion:  1.10,
-		OutputPricePerMillion: 4.40,
-		ContextWindowSize:     128000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["codex-mini-latest"] = ModelConfig{
-		ID:                    "113",
-		ModelID:               "codex-mini-latest",
-		Provider:              "openai",
-		InputPricePerMillion:  1.50,
-		OutputPricePerMillion: 6.00,
-		ContextWindowSize:     128000,
-		IsActive:              true,
-	}
-
-	// Google Gemini Models (Text Only)
-	s.modelConfigs["gemini-2.5-pro"] = ModelConfig{
-		ID:                    "6",
-		ModelID:               "gemini-2.5-pro",
-		Provider:              "google",
-		InputPricePerMillion:  1.25,
-		OutputPricePerMillion: 10.00,
-		ContextWindowSize:     1000000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["gemini-2.5-flash"] = ModelConfig{
-		ID:                    "7",
-		ModelID:               "gemini-2.5-flash",
-		Provider:              "google",
-		InputPricePerMillion:  0.30,
-		OutputPricePerMillion: 2.50,
-		ContextWindowSize:     1000000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["gemini-2.5-flash-lite-preview-06-17"] = ModelConfig{
-		ID:                    "8",
-		ModelID:               "gemini-2.5-flash-lite-preview-06-17",
-		Provider:              "google",
-		InputPricePerMillion:  0.10,
-		OutputPricePerMillion: 0.40,
-		ContextWindowSize:     1000000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["gemini-2.0-flash"] = ModelConfig{
-		ID:                    "9",
-		ModelID:               "gemini-2.0-flash",
-		Provider:              "google",
-		InputPricePerMillion:  0.075,
-		OutputPricePerMillion: 0.30,
-		ContextWindowSize:     1048576,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["gemini-2.0-flash-lite"] = ModelConfig{
-		ID:                    "10",
-		ModelID:               "gemini-2.0-flash-lite",
-		Provider:              "google",
-		InputPricePerMillion:  0.05,
-		OutputPricePerMillion: 0.20,
-		ContextWindowSize:     1048576,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["gemini-1.5-flash"] = ModelConfig{
-		ID:                    "11",
-		ModelID:               "gemini-1.5-flash",
-		Provider:              "google",
-		InputPricePerMillion:  0.075,
-		OutputPricePerMillion: 0.30,
-		ContextWindowSize:     1048576,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["gemini-1.5-flash-8b"] = ModelConfig{
-		ID:                    "12",
-		ModelID:               "gemini-1.5-flash-8b",
-		Provider:              "google",
-		InputPricePerMillion:  0.05,
-		OutputPricePerMillion: 0.20,
-		ContextWindowSize:     1048576,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["gemini-1.5-pro"] = ModelConfig{
-		ID:                    "13",
-		ModelID:               "gemini-1.5-pro",
-		Provider:              "google",
-		InputPricePerMillion:  3.50,
-		OutputPricePerMillion: 10.50,
-		ContextWindowSize:     1048576,
-		IsActive:              true,
-	}
-
-	// Anthropic Claude Models
-	s.modelConfigs["claude-opus-4-20250514"] = ModelConfig{
-		ID:                    "14",
-		ModelID:               "claude-opus-4-20250514",
-		Provider:              "anthropic",
-		InputPricePerMillion:  15.00,
-		OutputPricePerMillion: 75.00,
-		ContextWindowSize:     200000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["claude-sonnet-4-20250514"] = ModelConfig{
-		ID:                    "15",
-		ModelID:               "claude-sonnet-4-20250514",
-		Provider:              "anthropic",
-		InputPricePerMillion:  3.00,
-		OutputPricePerMillion: 15.00,
-		ContextWindowSize:     200000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["claude-3-7-sonnet-20250219"] = ModelConfig{
-		ID:                    "16",
-		ModelID:               "claude-3-7-sonnet-20250219",
-		Provider:              "anthropic",
-		InputPricePerMillion:  3.00,
-		OutputPricePerMillion: 15.00,
-		ContextWindowSize:     200000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["claude-3-5-sonnet-20241022"] = ModelConfig{
-		ID:                    "17",
-		ModelID:               "claude-3-5-sonnet-20241022",
-		Provider:              "anthropic",
-		InputPricePerMillion:  3.00,
-		OutputPricePerMillion: 15.00,
-		ContextWindowSize:     200000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["claude-3-5-sonnet-20240620"] = ModelConfig{
-		ID:                    "18",
-		ModelID:               "claude-3-5-sonnet-20240620",
-		Provider:              "anthropic",
-		InputPricePerMillion:  3.00,
-		OutputPricePerMillion: 15.00,
-		ContextWindowSize:     200000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["claude-3-5-haiku-20241022"] = ModelConfig{
-		ID:                    "19",
-		ModelID:               "claude-3-5-haiku-20241022",
-		Provider:              "anthropic",
-		InputPricePerMillion:  0.80,
-		OutputPricePerMillion: 4.00,
-		ContextWindowSize:     200000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["claude-3-opus-20240229"] = ModelConfig{
-		ID:                    "20",
-		ModelID:               "claude-3-opus-20240229",
-		Provider:              "anthropic",
-		InputPricePerMillion:  15.00,
-		OutputPricePerMillion: 75.00,
-		ContextWindowSize:     200000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["claude-3-haiku-20240307"] = ModelConfig{
-		ID:                    "21",
-		ModelID:               "claude-3-haiku-20240307",
-		Provider:              "anthropic",
-		InputPricePerMillion:  0.25,
-		OutputPricePerMillion: 1.25,
-		ContextWindowSize:     200000,
-		IsActive:              true,
-	}
-
-	// Anthropic Model Aliases (for convenience)
-	s.modelConfigs["claude-opus-4-0"] = ModelConfig{
-		ID:                    "22",
-		ModelID:               "claude-opus-4-0", // Alias for claude-opus-4-20250514
-		Provider:              "anthropic",
-		InputPricePerMillion:  15.00,
-		OutputPricePerMillion: 75.00,
-		ContextWindowSize:     200000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["claude-sonnet-4-0"] = ModelConfig{
-		ID:                    "23",
-		ModelID:               "claude-sonnet-4-0", // Alias for claude-sonnet-4-20250514
-		Provider:              "anthropic",
-		InputPricePerMillion:  3.00,
-		OutputPricePerMillion: 15.00,
-		ContextWindowSize:     200000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["claude-3-7-sonnet-latest"] = ModelConfig{
-		ID:                    "24",
-		ModelID:               "claude-3-7-sonnet-latest", // Alias for claude-3-7-sonnet-20250219
-		Provider:              "anthropic",
-		InputPricePerMillion:  3.00,
-		OutputPricePerMillion: 15.00,
-		ContextWindowSize:     200000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["claude-3-5-sonnet-latest"] = ModelConfig{
-		ID:                    "25",
-		ModelID:               "claude-3-5-sonnet-latest", // Alias for claude-3-5-sonnet-20241022
-		Provider:              "anthropic",
-		InputPricePerMillion:  3.00,
-		OutputPricePerMillion: 15.00,
-		ContextWindowSize:     200000,
-		IsActive:              true,
-	}
-
-	s.modelConfigs["claude-3-5-haiku-latest"] = ModelConfig{
-		ID:                    "26",
-		ModelID:               "claude-3-5-haiku-latest", // Alias for claude-3-5-haiku-20241022
-		Provider:              "anthropic",
-		InputPricePerMillion:  0.80,
-		OutputPricePerMillion: 4.00,
-		ContextWindowSize:     200000,
-		IsActive:              true,
+	for _, price := range data.ModelPrices().Models {
+		s.modelConfigs[price.ModelID] = ModelConfigFromPrice(price)
+	}
+}
+
+// ModelConfigFromPrice returns the configuration of a model in the price list
+func ModelConfigFromPrice(price data.ModelPrice) ModelConfig {
+	return ModelConfig{
+		ID:                         price.ModelID,
+		ModelID:                    price.ModelID,
+		Provider:                   price.Provider,
+		InputPricePerMillion:       price.InputPricePerMillion,
+		OutputPricePerMillion:      price.OutputPricePerMillion,
+		CachedInputPricePerMillion: price.CachedInputPricePerMillion,
+		CacheWritePricePerMillion:  price.CacheWritePricePerMillion,
+		ReasoningPricePerMillion:   price.ReasoningPricePerMillion,
+		ContextWindowSize:          price.ContextWindowSize,
+		TimeoutSeconds:             price.TimeoutSeconds,
+		Capabilities:               price.Capabilities,
+		IsActive:                   true,
+	}
+}
+
+// Price returns the model's prices as a price list entry, to compare with the list
+func (m ModelConfig) Price() data.ModelPrice {
+	return data.ModelPrice{
+		ModelID:                    m.ModelID,
+		Provider:                   m.Provider,
+		InputPricePerMillion:       m.InputPricePerMillion,
+		OutputPricePerMillion:      m.OutputPricePerMillion,
+		CachedInputPricePerMillion: m.CachedInputPricePerMillion,
+		CacheWritePricePerMillion:  m.CacheWritePricePerMillion,
+		ReasoningPricePerMillion:   m.ReasoningPricePerMillion,
+		ContextWindowSize:          m.ContextWindowSize,
+		TimeoutSeconds:             m.TimeoutSeconds,
+		Capabilities:               m.Capabilities,
+	}
+}
+
+// PriceDrift lists where the active models' configurations differ from the canonical price list
+func (s *PricingService) PriceDrift() []data.PriceDrift {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var drift []data.PriceDrift
+	for _, listed := range data.ModelPrices().Models {
+		if config, ok := s.modelConfigs[listed.ModelID]; ok && config.IsActive {
+			drift = append(drift, listed.Drift(config.Price())...)
+		}
 	}
+	return drift
+}
+
+// defaultCapabilities returns the capabilities the price list gives a model. Unlisted models are
+// assumed to stream and accept images and tools.
+func defaultCapabilities(modelID string) ModelCapabilities {
+	if price, ok := data.ModelPrices().Lookup(modelID); ok {
+		return price.Capabilities
+	}
+	return ModelCapabilities{Streaming: true, Vision: true, Tools: true}
 }
 
 // GetModelConfig gets the configuration for a specific model
@@ -454,6 +300,135 @@ func (s *PricingService) GetModelConfig(modelID string) (ModelConfig, error) {
 	return config, nil
 }
 
+// defaultModelAliases maps stable model names to the versions they resolve to unless overridden
+var defaultModelAliases = map[string]string{
+	"gpt-4.1":       "gpt-4.1-2025-04-14",
+	"gpt-4.1-mini":  "gpt-4.1-mini-2025-04-14",
+	"gpt-4.1-nano":  "gpt-4.1-nano-2025-04-14",
+	"gpt-4o-mini":   "gpt-4o-mini-2024-07-18",
+	"o1":            "o1-2024-12-17",
+	"o1-mini":       "o1-mini-2024-09-12",
+	"o3":            "o3-2025-04-16",
+	"o3-mini":       "o3-mini-2025-01-31",
+	"claude-opus":   "claude-opus-4-20250514",
+	"claude-sonnet": "claude-sonnet-4-20250514",
+	"claude-haiku":  "claude-3-5-haiku-20241022",
+}
+
+// loadModelAliases loads the default aliases overlaid with the global aliases in Firestore
+func (s *PricingService) loadModelAliases(ctx context.Context) {
+	aliases := make(map[string]string, len(defaultModelAliases))
+	for alias, modelID := range defaultModelAliases {
+		aliases[alias] = modelID
+	}
+
+	stored, err := s.firebaseService.ListModelAliases(ctx, "")
+	if err != nil {
+		slog.Warn("Failed to load model aliases from Firestore, using defaults", "error", err)
+	}
+	for _, alias := range stored {
+		aliases[alias.Alias] = alias.ModelID
+	}
+
+	s.mu.Lock()
+	s.modelAliases = aliases
+	s.mu.Unlock()
+
+	slog.Info("Loaded model aliases", "count", len(aliases), "from_firestore", len(stored))
+}
+
+// ResolveModel returns the concrete model ID for a model name. An organization's aliases take
+// precedence over global aliases; names that are not aliases are returned unchanged.
+func (s *PricingService) ResolveModel(ctx context.Context, orgID, model string) (string, error) {
+	if orgID != "" {
+		aliases, err := s.getOrgAliases(ctx, orgID)
+		if err != nil {
+			return "", err
+		}
+		if modelID, ok := aliases[model]; ok {
+			return modelID, nil
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if modelID, ok := s.modelAliases[model]; ok {
+		return modelID, nil
+	}
+	return model, nil
+}
+
+// getOrgAliases returns an organization's aliases, reloading them once the cache entry expires
+func (s *PricingService) getOrgAliases(ctx context.Context, orgID string) (map[string]string, error) {
+	s.mu.RLock()
+	entry, ok := s.orgAliases[orgID]
+	s.mu.RUnlock()
+	if ok && time.Since(entry.loadedAt) < s.cacheTTL {
+		return entry.aliases, nil
+	}
+
+	stored, err := s.firebaseService.ListModelAliases(ctx, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load organization model aliases: %w", err)
+	}
+
+	aliases := make(map[string]string, len(stored))
+	for _, alias := range stored {
+		aliases[alias.Alias] = alias.ModelID
+	}
+
+	s.mu.Lock()
+	s.orgAliases[orgID] = orgAliasEntry{aliases: aliases, loadedAt: time.Now()}
+	s.mu.Unlock()
+
+	return aliases, nil
+}
+
+// ListOrgModelAliases lists an organization's alias overrides
+func (s *PricingService) ListOrgModelAliases(ctx context.Context, orgID string) ([]*data.ModelAlias, error) {
+	return s.firebaseService.ListModelAliases(ctx, orgID)
+}
+
+// SetOrgModelAlias pins an alias to a concrete model version for an organization
+func (s *PricingService) SetOrgModelAlias(ctx context.Context, orgID, alias, modelID, updatedBy string) (*data.ModelAlias, error) {
+	// Aliases must point at a concrete, active model so resolution never chains
+	if _, err := s.GetModelConfig(modelID); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownModel, modelID)
+	}
+
+	modelAlias := &data.ModelAlias{
+		Alias:     alias,
+		ModelID:   modelID,
+		OrgID:     orgID,
+		UpdatedBy: updatedBy,
+	}
+	if err := s.firebaseService.SetModelAlias(ctx, modelAlias); err != nil {
+		return nil, err
+	}
+
+	s.invalidateOrgAliases(orgID)
+	return modelAlias, nil
+}
+
+// DeleteOrgModelAlias removes an organization's alias override
+func (s *PricingService) DeleteOrgModelAlias(ctx context.Context, orgID, alias string) error {
+	if err := s.firebaseService.DeleteModelAlias(ctx, orgID, alias); err != nil {
+		return err
+	}
+
+	s.invalidateOrgAliases(orgID)
+	return nil
+}
+
+// invalidateOrgAliases drops an organization's cached aliases. Other replicas pick up the change
+// when their cache entry expires.
+func (s *PricingService) invalidateOrgAliases(orgID string) {
+	s.mu.Lock()
+	delete(s.orgAliases, orgID)
+	s.mu.Unlock()
+}
+
 // GetPricingTier gets a pricing tier by ID (for backward compatibility)
 func (s *PricingService) GetPricingTier(ctx context.Context, userID string) (PricingTier, error) {
 	// Get user from Firebase
@@ -472,67 +447,152 @@ func (s *PricingService) GetPricingTier(ctx context.Context, userID string) (Pri
 		}
 	}
 
-	// Convert Firebase ModelPricing to pricing ModelPricing
-	customModelPricing := make(map[string]ModelPricing)
-	for modelID, modelPricing := range tier.CustomModelPricing {
-		customModelPricing[modelID] = ModelPricing{
-			ModelID:               modelPricing.ModelID,
-			Provider:              modelPricing.Provider,
-			InputPricePerMillion:  modelPricing.InputPricePerMillion,
-			OutputPricePerMillion: modelPricing.OutputPricePerMillion,
-		}
-	}
-
 	// Convert to PricingTier format
 	return PricingTier{
-		ID:                  tier.ID,
-		TierName:            tier.Name,
-		MinMonthlySpend:     tier.MinMonthlySpend,
-		InputMarkupPercent:  tier.InputMarkupPercent,
-		OutputMarkupPercent: tier.OutputMarkupPercent,
-		IsActive:            tier.IsActive,
-		IsCustom:            tier.IsCustom,
-		CustomModelPricing:  customModelPricing,
+		ID:                    tier.ID,
+		TierName:              tier.Name,
+		MinMonthlySpend:       tier.MinMonthlySpend,
+		InputMarkupPercent:    tier.InputMarkupPercent,
+		OutputMarkupPercent:   tier.OutputMarkupPercent,
+		IsActive:              tier.IsActive,
+		IsCustom:              tier.IsCustom,
+		CustomModelPricing:    tier.CustomModelPricing,
+		Moderation:            tier.Moderation,
+		Priority:              tier.Priority,
+		MaxPromptTokens:       tier.MaxPromptTokens,
+		MaxStreamOutputTokens: tier.MaxStreamOutputTokens,
+		MaxStreamOutputBytes:  tier.MaxStreamOutputBytes,
+		Optimization:          tier.Optimization,
 	}, nil
 }
 
-// CalculateCost calculates the cost for a request with percentage-based markup
-func (s *PricingService) CalculateCost(ctx context.Context, userID, modelID string, inputTokens, outputTokens int) (float64, float64, error) {
+// ListModels returns the active model catalog priced for a user's tier
+func (s *PricingService) ListModels(ctx context.Context, userID string) ([]ModelListing, error) {
+	user, err := s.firebaseService.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	return s.listModelsForTier(ctx, user.TierID, user.CustomPricing)
+}
+
+// ListOrgModels returns the active model catalog priced for an organization's pooled tier
+func (s *PricingService) ListOrgModels(ctx context.Context, orgID string) ([]ModelListing, error) {
+	org, err := s.firebaseService.GetOrganization(ctx, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get organization: %w", err)
+	}
+
+	return s.listModelsForTier(ctx, org.TierID, true)
+}
+
+// ListTierModels returns the active model catalog priced for a fixed tier, such as a tenant's
+func (s *PricingService) ListTierModels(ctx context.Context, tierID string) ([]ModelListing, error) {
+	return s.listModelsForTier(ctx, tierID, true)
+}
+
+// listModelsForTier lists the active models with per-million prices after the tier's markup,
+// priced with the same formula used for billing
+func (s *PricingService) listModelsForTier(ctx context.Context, tierID string, customPricing bool) ([]ModelListing, error) {
+	tier, err := s.firebaseService.GetPricingTierOrDefault(ctx, tierID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	models := make([]ModelListing, 0, len(s.modelConfigs))
+	for _, config := range s.modelConfigs {
+		if !config.IsActive {
+			continue
+		}
+
+		models = append(models, ModelListing{
+			ID:                    config.ModelID,
+			Provider:              config.Provider,
+			ContextWindowSize:     config.ContextWindowSize,
+			InputPricePerMillion:  tier.Cost(config.ModelID, customPricing, 1_000_000, 0, data.TokenDetails{}, data.TokenRates{}, config.InputPricePerMillion, config.OutputPricePerMillion).Total(),
+			OutputPricePerMillion: tier.Cost(config.ModelID, customPricing, 0, 1_000_000, data.TokenDetails{}, data.TokenRates{}, config.InputPricePerMillion, config.OutputPricePerMillion).Total(),
+			Capabilities:          config.Capabilities,
+
+			CachedInputPricePerMillion: tier.Cost(config.ModelID, customPricing, 1_000_000, 0, data.TokenDetails{CacheReadTokens: 1_000_000}, config.TokenRates(), config.InputPricePerMillion, config.OutputPricePerMillion).Total(),
+			ReasoningPricePerMillion:   tier.Cost(config.ModelID, customPricing, 0, 1_000_000, data.TokenDetails{ReasoningTokens: 1_000_000}, config.TokenRates(), config.InputPricePerMillion, config.OutputPricePerMillion).Total(),
+		})
+	}
+
+	sort.Slice(models, func(i, j int) bool {
+		if models[i].Provider != models[j].Provider {
+			return models[i].Provider < models[j].Provider
+		}
+		return models[i].ID < models[j].ID
+	})
+
+	return models, nil
+}
+
+// CalculateCost calculates the cost for a request with percentage-based markup. Cached input
+// tokens and reasoning tokens are charged at the model's rates for them.
+func (s *PricingService) CalculateCost(ctx context.Context, userID, modelID string, inputTokens, outputTokens int, details data.TokenDetails) (data.CostBreakdown, error) {
 	// Get user from Firebase
 	user, err := s.firebaseService.GetUserByID(ctx, userID)
 	if err != nil {
-		return 0, 0, fmt.Errorf("failed to get user: %w", err)
+		return data.CostBreakdown{}, fmt.Errorf("failed to get user: %w", err)
 	}
 
+	return s.calculateCostForTier(ctx, user.TierID, user.CustomPricing, modelID, inputTokens, outputTokens, details)
+}
+
+// CalculateOrgCost calculates the cost for a request billed to an organization's pooled tier
+func (s *PricingService) CalculateOrgCost(ctx context.Context, orgID, modelID string, inputTokens, outputTokens int, details data.TokenDetails) (data.CostBreakdown, error) {
+	org, err := s.firebaseService.GetOrganization(ctx, orgID)
+	if err != nil {
+		return data.CostBreakdown{}, fmt.Errorf("failed to get organization: %w", err)
+	}
+
+	// Organizations always use their tier's custom model pricing when it has any
+	return s.calculateCostForTier(ctx, org.TierID, true, modelID, inputTokens, outputTokens, details)
+}
+
+// CalculateTierCost calculates the cost for a request billed under a fixed tier, such as a tenant's
+func (s *PricingService) CalculateTierCost(ctx context.Context, tierID, modelID string, inputTokens, outputTokens int, details data.TokenDetails) (data.CostBreakdown, error) {
+	return s.calculateCostForTier(ctx, tierID, true, modelID, inputTokens, outputTokens, details)
+}
+
+// calculateCostForTier calculates the cost for a request under the given pricing tier
+func (s *PricingService) calculateCostForTier(ctx context.Context, tierID string, customPricing bool, modelID string, inputTokens, outputTokens int, details data.TokenDetails) (data.CostBreakdown, error) {
 	// Get model configuration
 	modelConfig, err := s.GetModelConfig(modelID)
 	if err != nil {
-		return 0, 0, fmt.Errorf("failed to get model config: %w", err)
+		return data.CostBreakdown{}, fmt.Errorf("failed to get model config: %w", err)
 	}
 
 	// Calculate cost with Firebase service
-	totalCost, markupAmount, err := s.firebaseService.CalculateCost(
+	cost, err := s.firebaseService.CalculateCost(
 		ctx,
-		user,
+		tierID,
+		customPricing,
 		modelID,
 		modelConfig.Provider,
 		inputTokens,
 		outputTokens,
+		details,
+		modelConfig.TokenRates(),
 		modelConfig.InputPricePerMillion,
 		modelConfig.OutputPricePerMillion,
 	)
 	if err != nil {
-		return 0, 0, fmt.Errorf("failed to calculate cost: %w", err)
+		return data.CostBreakdown{}, fmt.Errorf("failed to calculate cost: %w", err)
 	}
 
-	return totalCost, markupAmount, nil
+	return cost, nil
 }
 
 // CalculateSavingsFee calculates the savings fee based on tokens saved
-func (s *PricingService) CalculateSavingsFee(tier PricingTier, inputTokensSaved, outputTokensSaved int) float64 {
+func (s *PricingService) CalculateSavingsFee(tier PricingTier, inputTokensSaved, outputTokensSaved int) data.MicroUSD {
 	// Calculate savings based on the tier's markup percentages
-	inputSavings := float64(inputTokensSaved) * (tier.InputMarkupPercent / 100) / 1000000
-	outputSavings := float64(outputTokensSaved) * (tier.OutputMarkupPercent / 100) / 1000000
+	inputSavings := data.CostForTokens(inputTokensSaved, tier.InputMarkupPercent/100)
+	outputSavings := data.CostForTokens(outputTokensSaved, tier.OutputMarkupPercent/100)
 
 	return inputSavings + outputSavings
 }
@@ -550,24 +610,22 @@ func (s *PricingService) RefreshCache(ctx context.Context) error {
 		slog.Info("Successfully refreshed model configurations from Firestore")
 	}
 
+	s.loadModelAliases(ctx)
+
 	// Update last refresh time
 	s.mu.Lock()
 	s.lastRefresh = time.Now()
+	s.orgAliases = make(map[string]orgAliasEntry)
 	s.mu.Unlock()
 
 	slog.Info("Pricing cache refreshed successfully", "model_count", len(s.modelConfigs))
 	return nil
 }
 
-// shouldRefreshCache checks if the cache should be refreshed
-func (s *PricingService) shouldRefreshCache() bool {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	return time.Since(s.lastRefresh) > s.cacheTTL
-}
-
 // GetCacheStats returns cache statistics
 func (s *PricingService) GetCacheStats() map[string]interface{} {
+	listeners := s.GetListenerStats()
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -575,10 +633,18 @@ func (s *PricingService) GetCacheStats() map[string]interface{} {
 		"model_configs_count": len(s.modelConfigs),
 		"last_refresh":        s.lastRefresh,
 		"cache_ttl":           s.cacheTTL,
-		"should_refresh":      s.shouldRefreshCache(),
+		"should_refresh":      time.Since(s.lastRefresh) > s.cacheTTL,
+		"listeners":           listeners,
 	}
 }
 
+// ModelConfigCount returns the number of loaded model configurations
+func (s *PricingService) ModelConfigCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.modelConfigs)
+}
+
 // LoadDefaultModelConfigs loads the default model configurations (for testing)
 func (s *PricingService) LoadDefaultModelConfigs() {
 	s.loadDefaultModelConfigs()
@@ -601,8 +667,8 @@ func (s *PricingService) loadModelConfigsFromFirestore(ctx context.Context) erro
 
 		slog.Debug("Processing model configuration document", "doc_id", doc.Ref.ID)
 
-		var modelConfig ModelConfig
-		if err := doc.DataTo(&modelConfig); err != nil {
+		modelConfig, err := parseModelConfig(doc)
+		if err != nil {
 			slog.Warn("Failed to parse model configuration", "doc_id", doc.Ref.ID, "error", err)
 			continue
 		}
@@ -618,6 +684,214 @@ func (s *PricingService) loadModelConfigsFromFirestore(ctx context.Context) erro
 	return nil
 }
 
+// parseModelConfig parses a model configuration document
+func parseModelConfig(doc *firestore.DocumentSnapshot) (ModelConfig, error) {
+	var modelConfig ModelConfig
+	if err := doc.DataTo(&modelConfig); err != nil {
+		return ModelConfig{}, err
+	}
+
+	// Documents written before capabilities existed get the built-in defaults
+	if _, ok := doc.Data()["capabilities"]; !ok {
+		modelConfig.Capabilities = defaultCapabilities(modelConfig.ModelID)
+	}
+
+	return modelConfig, nil
+}
+
+// ListenForModelConfigs applies model configuration changes as they are written, until ctx is cancelled
+func (s *PricingService) ListenForModelConfigs(ctx context.Context) {
+	s.listen(ctx, "model_configurations", s.applyModelConfigChanges)
+}
+
+// ListenForPricingTiers evicts cached pricing tiers as they change, until ctx is cancelled
+func (s *PricingService) ListenForPricingTiers(ctx context.Context) {
+	s.listen(ctx, "pricing_tiers", s.applyPricingTierChanges)
+}
+
+// snapshotHandler applies the document changes in a snapshot. stale is false only for the
+// first snapshot at startup, which lists documents that were just loaded.
+type snapshotHandler func(ctx context.Context, changes []firestore.DocumentChange, stale bool)
+
+// listen runs a snapshot listener on a collection, restarting it after failures
+func (s *PricingService) listen(ctx context.Context, collection string, apply snapshotHandler) {
+	if s.firebaseService == nil || s.firebaseService.DB() == nil {
+		return
+	}
+
+	slog.Info("Starting snapshot listener", "collection", collection)
+
+	restarted := false
+	for {
+		err := s.watchCollection(ctx, collection, apply, restarted)
+		s.recordListenerStopped(collection, err)
+		if ctx.Err() != nil {
+			return
+		}
+
+		slog.Warn("Snapshot listener stopped, restarting", "collection", collection, "error", err)
+		restarted = true
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// watchCollection applies snapshots of a collection until the listener fails or ctx is cancelled
+func (s *PricingService) watchCollection(ctx context.Context, collection string, apply snapshotHandler, restarted bool) error {
+	snapshots := s.firebaseService.DB().Collection(collection).Snapshots(ctx)
+	defer snapshots.Stop()
+
+	initial := true
+	for {
+		snap, err := snapshots.Next()
+		if err != nil {
+			if status.Code(err) == codes.Canceled || ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("snapshot listener on %s failed: %w", collection, err)
+		}
+
+		// Changes may have been missed while a restarted listener was down
+		apply(ctx, snap.Changes, !initial || restarted)
+		initial = false
+
+		s.recordListenerUpdate(collection)
+	}
+}
+
+// applyModelConfigChanges updates the in-memory model configurations from a snapshot
+func (s *PricingService) applyModelConfigChanges(ctx context.Context, changes []firestore.DocumentChange, stale bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, change := range changes {
+		modelConfig, err := parseModelConfig(change.Doc)
+		if err != nil {
+			slog.Warn("Failed to parse model configuration", "doc_id", change.Doc.Ref.ID, "error", err)
+			continue
+		}
+
+		before, existed := s.modelConfigs[modelConfig.ModelID]
+
+		if change.Kind == firestore.DocumentRemoved {
+			delete(s.modelConfigs, modelConfig.ModelID)
+			slog.Info("Model configuration removed", "model_id", modelConfig.ModelID)
+			if stale {
+				s.auditConfigChange(ctx, data.AuditModelConfigDeleted, modelConfig.ModelID, before, nil)
+			}
+			continue
+		}
+
+		s.modelConfigs[modelConfig.ModelID] = modelConfig
+		slog.Debug("Model configuration updated", "model_id", modelConfig.ModelID, "provider", modelConfig.Provider)
+
+		// A restarted listener replays every document, so only record real changes
+		if stale && (!existed || !reflect.DeepEqual(before, modelConfig)) {
+			var previous interface{}
+			if existed {
+				previous = before
+			}
+			s.auditConfigChange(ctx, data.AuditModelConfigUpdated, modelConfig.ModelID, previous, modelConfig)
+		}
+	}
+
+	s.lastRefresh = time.Now()
+}
+
+// auditConfigChange records an edit to pricing configuration made directly in Firestore
+func (s *PricingService) auditConfigChange(ctx context.Context, eventType data.AuditEventType, targetID string, before, after interface{}) {
+	s.audit.Record(ctx, &data.AuditEvent{
+		Type:      eventType,
+		ActorType: data.AuditActorSystem,
+		ActorID:   "firestore",
+		TargetID:  targetID,
+		Before:    before,
+		After:     after,
+	})
+}
+
+// applyPricingTierChanges evicts changed pricing tiers from the cache so the next request reloads them.
+// Accounts that fell back to the default tier pick up default tier changes when their entry expires.
+func (s *PricingService) applyPricingTierChanges(ctx context.Context, changes []firestore.DocumentChange, stale bool) {
+	if s.cache == nil || !stale {
+		return
+	}
+
+	for _, change := range changes {
+		keys := []string{TierCacheKey(change.Doc.Ref.ID)}
+
+		var tier data.PricingTier
+		if err := change.Doc.DataTo(&tier); err == nil && tier.ID != "" && tier.ID != change.Doc.Ref.ID {
+			keys = append(keys, TierCacheKey(tier.ID))
+		}
+
+		for _, key := range keys {
+			if err := s.cache.Invalidate(ctx, key); err != nil {
+				slog.Warn("Failed to evict pricing tier from cache", "key", key, "error", err)
+			}
+		}
+		slog.Info("Pricing tier changed, evicted from cache", "tier_id", change.Doc.Ref.ID)
+
+		// Restarted listeners report every tier as added, so only edits and deletions are audited
+		switch change.Kind {
+		case firestore.DocumentModified:
+			s.auditConfigChange(ctx, data.AuditPricingTierUpdated, change.Doc.Ref.ID, nil, change.Doc.Data())
+		case firestore.DocumentRemoved:
+			s.auditConfigChange(ctx, data.AuditPricingTierDeleted, change.Doc.Ref.ID, change.Doc.Data(), nil)
+		}
+	}
+}
+
+// recordListenerUpdate records that a listener received a snapshot
+func (s *PricingService) recordListenerUpdate(collection string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.listenerStats(collection)
+	stats.Connected = true
+	stats.LastUpdate = time.Now()
+	stats.Updates++
+}
+
+// recordListenerStopped records that a listener disconnected, with the error if it failed
+func (s *PricingService) recordListenerStopped(collection string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.listenerStats(collection)
+	stats.Connected = false
+	if err != nil {
+		stats.Restarts++
+		stats.LastError = err.Error()
+	}
+}
+
+// listenerStats returns the stats for a collection's listener; callers must hold mu
+func (s *PricingService) listenerStats(collection string) *ListenerStats {
+	stats, ok := s.listeners[collection]
+	if !ok {
+		stats = &ListenerStats{}
+		s.listeners[collection] = stats
+	}
+	return stats
+}
+
+// GetListenerStats returns a copy of the snapshot listener stats, keyed by collection
+func (s *PricingService) GetListenerStats() map[string]ListenerStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := make(map[string]ListenerStats, len(s.listeners))
+	for collection, listener := range s.listeners {
+		stats[collection] = *listener
+	}
+	return stats
+}
+
 // loadPricingTiersFromFirestore loads pricing tiers from Firestore
 func (s *PricingService) loadPricingTiersFromFirestore() error {
 	// This method is a placeholder for future implementation
@@ -0,0 +1,126 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModelConfigTokenRates(t *testing.T) {
+	anthropic := ModelConfig{Provider: "anthropic", InputPricePerMillion: 3, OutputPricePerMillion: 15}
+	assert.Equal(t, data.TokenRates{CacheRead: 0.1, CacheWrite: 1.25, Reasoning: 1}, anthropic.TokenRates())
+
+	reasoning := ModelConfig{Provider: "openai", InputPricePerMillion: 2, OutputPricePerMillion: 8, CachedInputPricePerMillion: 0.5, ReasoningPricePerMillion: 4}
+	rates := reasoning.TokenRates()
+	assert.Equal(t, data.TokenRates{CacheRead: 0.25, CacheWrite: 1, Reasoning: 0.5}, rates)
+
+	// 1000 uncached and 1000 cached input tokens; 1000 answer and 1000 reasoning output tokens
+	cost := data.ComputeDetailedCost(2000, 2000, data.TokenDetails{CacheReadTokens: 1000, ReasoningTokens: 1000}, rates,
+		reasoning.InputPricePerMillion, reasoning.OutputPricePerMillion, 0, 0)
+	assert.Equal(t, data.MicroUSD(2000+500), cost.BaseInput)
+	assert.Equal(t, data.MicroUSD(8000+4000), cost.BaseOutput)
+
+	// Without details, the cost is the plain formula's
+	assert.Equal(t, data.ComputeCost(2000, 2000, 2, 8, 10, 10), data.ComputeDetailedCost(2000, 2000, data.TokenDetails{}, rates, 2, 8, 10, 10))
+}
+
+func TestPricingTierPricingFor(t *testing.T) {
+	modelConfig := ModelConfig{ModelID: "gpt-4o", Provider: "openai", InputPricePerMillion: 2.5, OutputPricePerMillion: 10}
+	markup := func(percent float64) *float64 { return &percent }
+	tier := PricingTier{
+		InputMarkupPercent:  10,
+		OutputMarkupPercent: 20,
+		IsCustom:            true,
+		CustomModelPricing: map[string]ModelPricing{
+			"gpt-4o":      {InputPricePerMillion: 2, OutputPricePerMillion: 8},
+			"gpt-4o-mini": {OutputMarkupPercent: markup(0)},
+		},
+	}
+
+	// Custom prices replace the base prices and keep the tier's markups
+	assert.Equal(t, data.AppliedPricing{InputPricePerMillion: 2, OutputPricePerMillion: 8, InputMarkupPercent: 10, OutputMarkupPercent: 20, Override: true},
+		tier.PricingFor(modelConfig, true))
+
+	// Custom markups replace the tier's, and unset prices keep the base prices
+	mini := ModelConfig{ModelID: "gpt-4o-mini", Provider: "openai", InputPricePerMillion: 0.15, OutputPricePerMillion: 0.6}
+	assert.Equal(t, data.AppliedPricing{InputPricePerMillion: 0.15, OutputPricePerMillion: 0.6, InputMarkupPercent: 10, OutputMarkupPercent: 0, Override: true},
+		tier.PricingFor(mini, true))
+
+	base := data.AppliedPricing{InputPricePerMillion: 2.5, OutputPricePerMillion: 10, InputMarkupPercent: 10, OutputMarkupPercent: 20}
+	assert.Equal(t, base, tier.PricingFor(modelConfig, false), "accounts without custom pricing pay the base prices")
+
+	tier.IsCustom = false
+	assert.Equal(t, base, tier.PricingFor(modelConfig, true), "only custom tiers apply custom model pricing")
+
+	assert.True(t, UsesCustomPricing("org-1", nil, false))
+	assert.True(t, UsesCustomPricing("", &data.Tenant{TierID: "tier-1"}, false))
+	assert.False(t, UsesCustomPricing("", &data.Tenant{}, false))
+	assert.True(t, UsesCustomPricing("", nil, true))
+}
+
+func TestModelPriceList(t *testing.T) {
+	list := data.ModelPrices()
+	require.NoError(t, list.Validate())
+
+	// Default aliases resolve to listed models
+	for alias, modelID := range defaultModelAliases {
+		_, ok := list.Lookup(modelID)
+		assert.True(t, ok, "alias %s resolves to %s, which is not in the price list", alias, modelID)
+	}
+
+	// Without Firestore, the pricing service serves the list
+	s := NewPricingService(nil, nil, nil)
+	s.LoadDefaultModelConfigs()
+	assert.Equal(t, len(list.Models), s.ModelConfigCount())
+	config, err := s.GetModelConfig("o1-mini-2024-09-12")
+	require.NoError(t, err)
+	assert.Equal(t, 600, config.TimeoutSeconds)
+	assert.Equal(t, ModelCapabilities{Streaming: true}, config.Capabilities)
+	assert.Empty(t, s.PriceDrift())
+
+	// Configurations that differ from the list are reported
+	listed, _ := list.Lookup("gpt-4o")
+	stale := ModelConfigFromPrice(listed)
+	stale.InputPricePerMillion, stale.OutputPricePerMillion = listed.InputPricePerMillion*2, listed.OutputPricePerMillion
+	s.modelConfigs["gpt-4o"] = stale
+	assert.Equal(t, []data.PriceDrift{
+		{ModelID: "gpt-4o", Field: "input_price_per_million", Listed: listed.InputPricePerMillion, Actual: listed.InputPricePerMillion * 2},
+	}, s.PriceDrift())
+
+	t.Run("Published", func(t *testing.T) {
+		list := &data.ModelPriceList{
+			Version: "test",
+			Sources: map[string]string{"openai": "https://example.com", "google": "https://example.com"},
+			Models: []data.ModelPrice{
+				{ModelID: "gpt-4o", Provider: "openai", InputPricePerMillion: 2.5, OutputPricePerMillion: 10, ContextWindowSize: 128000},
+				{ModelID: "gemini-1.5-pro", Provider: "google", InputPricePerMillion: 3.5, OutputPricePerMillion: 10.5, ContextWindowSize: 1048576},
+				{ModelID: "codex-mini-latest", Provider: "openai", InputPricePerMillion: 1.5, OutputPricePerMillion: 6, ContextWindowSize: 128000},
+			},
+		}
+		drift, unpublished, err := list.PublishedDrift([]byte(`{
+			"gpt-4o": {"input_cost_per_token": 2.5e-06, "output_cost_per_token": 1e-05, "cache_read_input_token_cost": 1.25e-06, "max_input_tokens": 128000},
+			"gemini/gemini-1.5-pro": {"input_cost_per_token": 1.25e-06, "output_cost_per_token": 5e-06}
+		}`))
+		require.NoError(t, err)
+		assert.Equal(t, []data.PriceDrift{
+			{ModelID: "gemini-1.5-pro", Field: "input_price_per_million", Listed: 3.5, Actual: 1.25},
+			{ModelID: "gemini-1.5-pro", Field: "output_price_per_million", Listed: 10.5, Actual: 5},
+		}, drift)
+		assert.Equal(t, []string{"codex-mini-latest"}, unpublished)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, raw := range []string{
+			`{"models": []}`,
+			`{"version": "v", "sources": {}, "models": [{"model_id": "m", "provider": "openai", "context_window_size": 1}]}`,
+			`{"version": "v", "sources": {"openai": "x"}, "models": [{"model_id": "m", "provider": "openai", "input_price_per_million": -1, "context_window_size": 1}]}`,
+			`{"version": "v", "sources": {"openai": "x"}, "models": [{"model_id": "m", "provider": "openai", "context_window_size": 1}, {"model_id": "m", "provider": "openai", "context_window_size": 1}]}`,
+			`{"version": "v", "sources": {"openai": "x"}, "models": [{"model_id": "m", "provider": "openai", "context_window_size": 1, "price": 2}]}`,
+		} {
+			_, err := data.ParseModelPriceList([]byte(raw))
+			assert.ErrorIs(t, err, data.ErrInvalidPriceList, raw)
+		}
+	})
+}
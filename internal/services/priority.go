@@ -0,0 +1,49 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidPriority is returned for a priority class other than high, normal or low
+var ErrInvalidPriority = errors.New("invalid priority")
+
+// Request priority classes
+const (
+	// PriorityHigh requests skip the concurrency queue and provider rate shaping
+	PriorityHigh = "high"
+	// PriorityNormal is the priority of requests whose tier sets none
+	PriorityNormal = "normal"
+	// PriorityLow requests never queue and leave part of each provider budget to other traffic
+	PriorityLow = "low"
+)
+
+// priorityRanks orders the priority classes
+var priorityRanks = map[string]int{
+	PriorityLow:    0,
+	PriorityNormal: 1,
+	PriorityHigh:   2,
+}
+
+// ResolvePriority returns the priority of a request on a tier. Requests may ask for a lower
+// priority than their tier's, e.g. for batch traffic, but never a higher one. Empty values
+// default to normal.
+func ResolvePriority(tierPriority, requested string) (string, error) {
+	if tierPriority == "" {
+		tierPriority = PriorityNormal
+	}
+	if _, ok := priorityRanks[tierPriority]; !ok {
+		tierPriority = PriorityNormal
+	}
+	if requested == "" {
+		return tierPriority, nil
+	}
+	rank, ok := priorityRanks[requested]
+	if !ok {
+		return "", fmt.Errorf("%w %q: must be high, normal or low", ErrInvalidPriority, requested)
+	}
+	if rank > priorityRanks[tierPriority] {
+		return tierPriority, nil
+	}
+	return requested, nil
+}
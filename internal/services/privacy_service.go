@@ -0,0 +1,201 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/utils"
+)
+
+// dataExportLease is how long a replica has to build an export before another may retry it
+const dataExportLease = 10 * time.Minute
+
+// DataExportContent is the document a user downloads from a completed data export
+type DataExportContent struct {
+	UserID      string    `json:"user_id"`
+	GeneratedAt time.Time `json:"generated_at"`
+	// Collections holds every stored document about the user by collection: their profile under
+	// users, then their API key metadata, request logs, ledger entries, payments and so on
+	Collections map[string][]map[string]interface{} `json:"collections"`
+}
+
+// PrivacyService handles users' requests for a copy of their data and for their account to be
+// deleted. Exports are built in the background; deleted accounts are deactivated at once and
+// erased once the retention period ends.
+type PrivacyService struct {
+	config          utils.PrivacyConfig
+	salt            string
+	firebaseService *data.Service
+	cache           Cache
+	audit           *AuditService
+}
+
+// NewPrivacyService creates a new privacy service
+func NewPrivacyService(cfg *utils.Config, firebaseService *data.Service, cache Cache, audit *AuditService) *PrivacyService {
+	return &PrivacyService{
+		config:          cfg.Privacy,
+		salt:            cfg.Security.APIKeySalt,
+		firebaseService: firebaseService,
+		cache:           cache,
+		audit:           audit,
+	}
+}
+
+// RequestExport records a data export for a user and starts building it in the background; the
+// sweep retries it if this replica stops first
+func (s *PrivacyService) RequestExport(ctx context.Context, userID string) (*data.DataExport, error) {
+	export, err := s.firebaseService.CreateDataExport(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The export outlives the request that asked for it
+	go s.BuildExport(context.WithoutCancel(ctx), export.ID)
+	return export, nil
+}
+
+// BuildExport builds a pending export, unless another replica is already building it
+func (s *PrivacyService) BuildExport(ctx context.Context, exportID string) {
+	export, err := s.firebaseService.ClaimDataExport(ctx, exportID, dataExportLease)
+	if err != nil {
+		slog.Warn("Failed to claim data export", "export_id", exportID, "error", err)
+		return
+	}
+	if export == nil {
+		return
+	}
+
+	content, err := s.exportContent(ctx, export.UserID)
+	if err != nil {
+		slog.Error("Failed to build data export", "export_id", exportID, "user_id", export.UserID, "error", err)
+		if err := s.firebaseService.FailDataExport(ctx, exportID, "failed to collect the account's data"); err != nil {
+			slog.Warn("Failed to mark data export failed", "export_id", exportID, "error", err)
+		}
+		return
+	}
+
+	if err := s.firebaseService.CompleteDataExport(ctx, exportID, content, time.Now().Add(s.config.DataExportExpiry)); err != nil {
+		slog.Error("Failed to store data export", "export_id", exportID, "user_id", export.UserID, "error", err)
+		return
+	}
+	slog.Info("Data export completed", "export_id", exportID, "user_id", export.UserID, "size_bytes", len(content))
+}
+
+// exportContent collects and encodes everything stored about a user
+func (s *PrivacyService) exportContent(ctx context.Context, userID string) ([]byte, error) {
+	collections, err := s.firebaseService.ExportUserData(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(DataExportContent{
+		UserID:      userID,
+		GeneratedAt: time.Now(),
+		Collections: collections,
+	}, "", "  ")
+}
+
+// GetExport gets one of a user's data exports, reporting exports of other users, and exports that
+// expired but were not yet deleted, as not found
+func (s *PrivacyService) GetExport(ctx context.Context, userID, exportID string) (*data.DataExport, error) {
+	export, err := s.firebaseService.GetDataExport(ctx, exportID)
+	if err != nil {
+		return nil, err
+	}
+	if export.UserID != userID || (!export.ExpiresAt.IsZero() && time.Now().After(export.ExpiresAt)) {
+		return nil, data.ErrDataExportNotFound
+	}
+	return export, nil
+}
+
+// ReadExport reads a completed export's content
+func (s *PrivacyService) ReadExport(ctx context.Context, export *data.DataExport) ([]byte, error) {
+	return s.firebaseService.ReadDataExport(ctx, export)
+}
+
+// DeleteUser deactivates a user's account and revokes their API keys, and returns when their data
+// will be erased. Deleting an account already deleted returns its existing purge time.
+func (s *PrivacyService) DeleteUser(ctx context.Context, userID string) (time.Time, error) {
+	user, err := s.firebaseService.GetUserByID(ctx, userID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !user.DeletedAt.IsZero() {
+		return user.PurgeAfter, nil
+	}
+
+	purgeAfter := time.Now().Add(s.config.DeletionRetention)
+	if err := s.firebaseService.MarkUserDeleted(ctx, userID, purgeAfter); err != nil {
+		return time.Time{}, err
+	}
+
+	// Stop the account being used on every replica
+	if err := s.cache.Invalidate(ctx, UserCacheKey(userID)); err != nil {
+		slog.Warn("Failed to invalidate cached user", "user_id", userID, "error", err)
+	}
+	return purgeAfter, nil
+}
+
+// Pseudonym returns the ID a purged user's request logs are kept under. It is stable, so the logs
+// still aggregate, but cannot be traced back to the user without the API key salt.
+func (s *PrivacyService) Pseudonym(userID string) string {
+	sum := sha256.Sum256([]byte(s.salt + userID))
+	return data.AnonymizedUserIDPrefix + hex.EncodeToString(sum[:8])
+}
+
+// Sweep retries exports whose builder was interrupted, deletes expired exports and purges deleted
+// accounts whose retention period has ended. It runs as a scheduled job.
+func (s *PrivacyService) Sweep(ctx context.Context) error {
+	now := time.Now()
+
+	unfinished, err := s.firebaseService.ListUnfinishedDataExports(ctx)
+	if err != nil {
+		slog.Warn("Failed to list unfinished data exports", "error", err)
+	}
+	for _, export := range unfinished {
+		s.BuildExport(ctx, export.ID)
+	}
+
+	expired, err := s.firebaseService.ListExpiredDataExports(ctx, now)
+	if err != nil {
+		slog.Warn("Failed to list expired data exports", "error", err)
+	}
+	for _, export := range expired {
+		if err := s.firebaseService.DeleteDataExport(ctx, export.ID); err != nil {
+			slog.Warn("Failed to delete expired data export", "export_id", export.ID, "error", err)
+		}
+	}
+
+	users, err := s.firebaseService.ListUsersDueForPurge(ctx, now)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		s.purge(ctx, user)
+	}
+	return nil
+}
+
+// purge erases a deleted user's data
+func (s *PrivacyService) purge(ctx context.Context, user *data.User) {
+	pseudonym := s.Pseudonym(user.ID)
+	if err := s.firebaseService.PurgeUser(ctx, user.ID, pseudonym); err != nil {
+		slog.Error("Failed to purge deleted user", "user_id", user.ID, "error", err)
+		return
+	}
+	if err := s.cache.Invalidate(ctx, UserCacheKey(user.ID)); err != nil {
+		slog.Warn("Failed to invalidate cached user", "user_id", user.ID, "error", err)
+	}
+
+	s.audit.Record(ctx, &data.AuditEvent{
+		Type:      data.AuditUserPurged,
+		ActorType: data.AuditActorSystem,
+		ActorID:   "privacy_sweep",
+		TargetID:  user.ID,
+		Details:   map[string]interface{}{"deleted_at": user.DeletedAt},
+	})
+}
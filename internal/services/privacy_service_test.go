@@ -0,0 +1,128 @@
+package services_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	apttesting "github.com/apt-router/api/internal/testing"
+	"github.com/apt-router/api/internal/utils"
+	"github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrivacyExportAndDeletion(t *testing.T) {
+	cfg := &utils.Config{
+		Security: utils.SecurityConfig{APIKeySalt: "test-salt"},
+		// Deleted accounts are due for purge at once
+		Privacy: utils.PrivacyConfig{DataExportExpiry: time.Hour},
+	}
+
+	now := time.Now()
+	store := apttesting.NewDatastore(t)
+	apttesting.ApplySeed(t, store, "", services.Seed{
+		"users": {
+			"user-1": {"email": "user@example.com", "is_active": true, "balance_micros": int64(5_000_000), "spend_alerts": map[string]interface{}{"webhook_url": "https://example.com/hook", "webhook_secret": "whsec_test"}},
+			"user-2": {"email": "other@example.com", "is_active": true},
+		},
+		"api_keys": {
+			"key-1": {"user_id": "user-1", "key_hash": "hash-1", "name": "Production", "status": "active"},
+		},
+	})
+
+	ctx := context.Background()
+	for collection, docs := range map[string]map[string]map[string]interface{}{
+		"request_logs": {
+			"log-1": {"user_id": "user-1", "model_id": "gpt-4o", "total_cost_micros": int64(1200), "ip_address": "203.0.113.7", "user_agent": "curl/8.0", "request_timestamp": now},
+			"log-2": {"user_id": "user-2", "model_id": "gpt-4o", "ip_address": "198.51.100.1", "request_timestamp": now},
+		},
+		"balance_ledger": {
+			"entry-1": {"user_id": "user-1", "type": "top_up", "amount_micros": int64(5_000_000)},
+		},
+	} {
+		for id, fields := range docs {
+			_, err := store.DB().Collection(collection).Doc(id).Set(ctx, fields)
+			require.NoError(t, err)
+		}
+	}
+
+	sharedCache := services.NewSharedCache(cache.New(time.Minute, time.Minute), store, false)
+	privacy := services.NewPrivacyService(cfg, store, sharedCache, services.NewAuditService(store))
+
+	// The export is built in the background and holds everything stored about the user but secrets
+	export, err := privacy.RequestExport(ctx, "user-1")
+	require.NoError(t, err)
+	assert.Equal(t, data.DataExportPending, export.Status)
+	require.Eventually(t, func() bool {
+		export, err = privacy.GetExport(ctx, "user-1", export.ID)
+		return err == nil && export.Status == data.DataExportCompleted
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err = privacy.GetExport(ctx, "user-2", export.ID)
+	assert.ErrorIs(t, err, data.ErrDataExportNotFound, "exports are only visible to their user")
+
+	content, err := privacy.ReadExport(ctx, export)
+	require.NoError(t, err)
+	var exported services.DataExportContent
+	require.NoError(t, json.Unmarshal(content, &exported))
+	assert.Equal(t, "user-1", exported.UserID)
+	require.Len(t, exported.Collections["users"], 1)
+	assert.Equal(t, "user@example.com", exported.Collections["users"][0]["email"])
+	assert.NotContains(t, string(content), "whsec_test")
+	require.Len(t, exported.Collections["api_keys"], 1)
+	assert.Equal(t, "Production", exported.Collections["api_keys"][0]["name"])
+	assert.NotContains(t, exported.Collections["api_keys"][0], "key_hash")
+	require.Len(t, exported.Collections["request_logs"], 1)
+	assert.Equal(t, "203.0.113.7", exported.Collections["request_logs"][0]["ip_address"])
+	assert.Len(t, exported.Collections["balance_ledger"], 1)
+
+	// Deletion deactivates the account and revokes its keys at once
+	purgeAfter, err := privacy.DeleteUser(ctx, "user-1")
+	require.NoError(t, err)
+	again, err := privacy.DeleteUser(ctx, "user-1")
+	require.NoError(t, err)
+	assert.True(t, again.Equal(purgeAfter), "deleting again keeps the purge time")
+
+	user, err := store.GetUserByID(ctx, "user-1")
+	require.NoError(t, err)
+	assert.False(t, user.IsActive)
+	assert.Equal(t, "user@example.com", user.Email, "data is kept until the retention period ends")
+	key, err := store.DB().Collection("api_keys").Doc("key-1").Get(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "revoked", key.Data()["status"])
+
+	// Once due, the sweep erases the account and anonymizes its request logs
+	privacy.Sweep(ctx)
+
+	user, err = store.GetUserByID(ctx, "user-1")
+	require.NoError(t, err)
+	assert.Empty(t, user.Email)
+	assert.Empty(t, user.SpendAlerts.WebhookURL)
+	assert.Equal(t, data.MicroUSD(5_000_000), user.Balance)
+	assert.False(t, user.PurgedAt.IsZero())
+	assert.True(t, user.PurgeAfter.IsZero(), "purged users are not purged again")
+
+	_, err = store.DB().Collection("api_keys").Doc("key-1").Get(ctx)
+	assert.Error(t, err, "API keys are deleted")
+	_, err = store.GetDataExport(ctx, export.ID)
+	assert.ErrorIs(t, err, data.ErrDataExportNotFound, "data exports are deleted")
+
+	log, err := store.DB().Collection("request_logs").Doc("log-1").Get(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, privacy.Pseudonym("user-1"), log.Data()["user_id"])
+	assert.Empty(t, log.Data()["ip_address"])
+	assert.Equal(t, int64(1200), log.Data()["total_cost_micros"], "usage is kept")
+	ledger, err := store.DB().Collection("balance_ledger").Doc("entry-1").Get(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", ledger.Data()["user_id"], "financial records are kept")
+
+	// Other users are untouched
+	other, err := store.DB().Collection("request_logs").Doc("log-2").Get(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "user-2", other.Data()["user_id"])
+	assert.Equal(t, "198.51.100.1", other.Data()["ip_address"])
+}
@@ -0,0 +1,304 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/utils"
+)
+
+// ProviderKeyPool spreads requests on the platform's keys across each provider's pooled keys,
+// taking keys the provider rate limits out of rotation for a cooldown and keys it rejects as
+// unauthorized out until the configured keys change
+type ProviderKeyPool struct {
+	config *utils.Config
+
+	mu        sync.Mutex
+	providers map[string]*keyPool
+}
+
+// keyPool is a provider's pooled keys in configured order
+type keyPool struct {
+	keys []*pooledKey
+	// next is where round-robin selection resumes
+	next int
+}
+
+// pooledKey is a key's load and health
+type pooledKey struct {
+	key          string
+	inFlight     int
+	requests     int64
+	errors       int64
+	unauthorized bool
+	downUntil    time.Time
+}
+
+// ProviderKeyStatus reports a pooled key's load and health. The key itself is never reported,
+// only its last four characters.
+type ProviderKeyStatus struct {
+	Provider     string     `json:"provider"`
+	KeyHint      string     `json:"key_hint"`
+	Available    bool       `json:"available"`
+	InFlight     int        `json:"in_flight"`
+	Requests     int64      `json:"requests"`
+	Errors       int64      `json:"errors"`
+	Unauthorized bool       `json:"unauthorized,omitempty"`
+	DownUntil    *time.Time `json:"down_until,omitempty"`
+}
+
+// NewProviderKeyPool creates a pool over the platform keys in cfg, which are read on every
+// selection so reloaded keys take effect without a restart
+func NewProviderKeyPool(cfg *utils.Config) *ProviderKeyPool {
+	return &ProviderKeyPool{
+		config:    cfg,
+		providers: make(map[string]*keyPool),
+	}
+}
+
+// Pooled reports whether a provider has more than one platform key to choose from
+func (p *ProviderKeyPool) Pooled(provider string) bool {
+	return p != nil && len(p.config.ProviderKeys(provider)) > 1
+}
+
+// Acquire returns the key to send a provider request with and counts it in flight until Release.
+// It skips keys out of rotation and the keys in exclude, which a request has already been refused
+// on. When every key is out of rotation a new request still tries the one due back soonest, but a
+// retry gets an empty key.
+func (p *ProviderKeyPool) Acquire(provider string, exclude map[string]bool) string {
+	configured := p.config.ProviderKeys(provider)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pool := p.sync(provider, configured)
+	now := time.Now()
+	var selected, fallback *pooledKey
+	for i := range pool.keys {
+		index := i
+		if p.config.LLM.KeySelection == utils.KeySelectionRoundRobin {
+			index = (pool.next + i) % len(pool.keys)
+		}
+		state := pool.keys[index]
+		if exclude[state.key] {
+			continue
+		}
+		if state.unauthorized || now.Before(state.downUntil) {
+			// A rate limited key may have recovered early; a rejected one will be refused again
+			if fallback == nil || (fallback.unauthorized && !state.unauthorized) ||
+				(state.unauthorized == fallback.unauthorized && state.downUntil.Before(fallback.downUntil)) {
+				fallback = state
+			}
+			continue
+		}
+		if selected == nil || state.inFlight < selected.inFlight {
+			selected = state
+			if p.config.LLM.KeySelection == utils.KeySelectionRoundRobin {
+				pool.next = (index + 1) % len(pool.keys)
+				break
+			}
+		}
+	}
+	if selected == nil && len(exclude) == 0 {
+		selected = fallback
+	}
+	if selected == nil {
+		return ""
+	}
+
+	selected.inFlight++
+	selected.requests++
+	return selected.key
+}
+
+// Release ends a request sent with key and records its outcome: a 429 takes the key out of
+// rotation for the configured cooldown and a 401 or 403 until the keys change
+func (p *ProviderKeyPool) Release(provider, key string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pool := p.providers[provider]
+	if pool == nil {
+		return
+	}
+	for _, state := range pool.keys {
+		if state.key != key {
+			continue
+		}
+
+		state.inFlight--
+		if err == nil {
+			state.unauthorized = false
+			state.downUntil = time.Time{}
+			return
+		}
+		state.errors++
+		switch keyRejection(err) {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			state.unauthorized = true
+		case http.StatusTooManyRequests:
+			state.downUntil = time.Now().Add(p.config.LLM.KeyCooldown)
+		}
+		return
+	}
+}
+
+// Status reports the load and health of every pooled key that has been used
+func (p *ProviderKeyPool) Status() []ProviderKeyStatus {
+	statuses := []ProviderKeyStatus{}
+	if p == nil {
+		return statuses
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for provider, pool := range p.providers {
+		for _, state := range pool.keys {
+			status := ProviderKeyStatus{
+				Provider:     provider,
+				KeyHint:      keyHint(state.key),
+				Available:    !state.unauthorized && !now.Before(state.downUntil),
+				InFlight:     state.inFlight,
+				Requests:     state.requests,
+				Errors:       state.errors,
+				Unauthorized: state.unauthorized,
+			}
+			if now.Before(state.downUntil) {
+				downUntil := state.downUntil
+				status.DownUntil = &downUntil
+			}
+			statuses = append(statuses, status)
+		}
+	}
+	sort.SliceStable(statuses, func(i, j int) bool { return statuses[i].Provider < statuses[j].Provider })
+	return statuses
+}
+
+// sync brings a provider's pool in line with its configured keys, keeping the state of keys that
+// are still configured. It is called with the lock held.
+func (p *ProviderKeyPool) sync(provider string, configured []string) *keyPool {
+	pool := p.providers[provider]
+	if pool == nil {
+		pool = &keyPool{}
+		p.providers[provider] = pool
+	}
+
+	unchanged := len(pool.keys) == len(configured)
+	for i := 0; unchanged && i < len(configured); i++ {
+		unchanged = pool.keys[i].key == configured[i]
+	}
+	if unchanged {
+		return pool
+	}
+
+	existing := make(map[string]*pooledKey, len(pool.keys))
+	for _, state := range pool.keys {
+		existing[state.key] = state
+	}
+	keys := make([]*pooledKey, 0, len(configured))
+	for _, key := range configured {
+		state := existing[key]
+		if state == nil {
+			state = &pooledKey{key: key}
+		}
+		// A change of keys is how operators fix a rejected key, so every key gets another chance
+		state.unauthorized = false
+		keys = append(keys, state)
+	}
+	pool.keys = keys
+	pool.next = 0
+	return pool
+}
+
+// keyRejection returns the status a provider refused a key with: 401 or 403 for a key it does not
+// accept, 429 for one it rate limits, or 0 for other errors, which say nothing about the key
+func keyRejection(err error) int {
+	var providerErr *data.ProviderError
+	if !errors.As(err, &providerErr) {
+		return 0
+	}
+	switch providerErr.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+		return providerErr.StatusCode
+	}
+	return 0
+}
+
+// pooledKeyClient sends each call with a key from the provider's pool, moving on to the next key
+// when the provider refuses one before anything was generated
+type pooledKeyClient struct {
+	pool     *ProviderKeyPool
+	provider string
+	// newClient creates the provider client for a key
+	newClient func(apiKey string) (data.LLMClient, error)
+}
+
+func (c *pooledKeyClient) GenerateWithParams(ctx context.Context, params map[string]interface{}) (*data.GenerateResponse, error) {
+	tried := make(map[string]bool)
+	var lastErr error
+	for {
+		key := c.pool.Acquire(c.provider, tried)
+		if key == "" {
+			return nil, c.exhausted(lastErr)
+		}
+		tried[key] = true
+
+		client, err := c.newClient(key)
+		if err != nil {
+			c.pool.Release(c.provider, key, nil)
+			return nil, err
+		}
+		resp, err := client.GenerateWithParams(ctx, params)
+		c.pool.Release(c.provider, key, err)
+		if keyRejection(err) == 0 || ctx.Err() != nil {
+			return resp, err
+		}
+		lastErr = err
+	}
+}
+
+// exhausted returns the error of a call that ran out of keys: the last refusal, if any
+func (c *pooledKeyClient) exhausted(lastErr error) error {
+	if lastErr != nil {
+		return lastErr
+	}
+	return fmt.Errorf("no API key provided for provider: %s", c.provider)
+}
+
+// GenerateStream keeps the key in flight until ctx is done, which happens when the stream is
+// closed
+func (c *pooledKeyClient) GenerateStream(ctx context.Context, params map[string]interface{}) (*data.StreamResponse, error) {
+	tried := make(map[string]bool)
+	var lastErr error
+	for {
+		key := c.pool.Acquire(c.provider, tried)
+		if key == "" {
+			return nil, c.exhausted(lastErr)
+		}
+		tried[key] = true
+
+		client, err := c.newClient(key)
+		if err != nil {
+			c.pool.Release(c.provider, key, nil)
+			return nil, err
+		}
+		stream, err := client.GenerateStream(ctx, params)
+		if err == nil {
+			context.AfterFunc(ctx, func() { c.pool.Release(c.provider, key, nil) })
+			return stream, nil
+		}
+		c.pool.Release(c.provider, key, err)
+		if keyRejection(err) == 0 || ctx.Err() != nil {
+			return nil, err
+		}
+		lastErr = err
+	}
+}
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// keyedClient answers with the status its key is given in statuses, or a response naming the key
+type keyedClient struct {
+	key      string
+	statuses map[string]int
+}
+
+func (c *keyedClient) GenerateWithParams(ctx context.Context, params map[string]interface{}) (*data.GenerateResponse, error) {
+	if status := c.statuses[c.key]; status != 0 {
+		return nil, &data.ProviderError{Provider: "openai", StatusCode: status, Message: http.StatusText(status)}
+	}
+	return &data.GenerateResponse{Text: c.key}, nil
+}
+
+func (c *keyedClient) GenerateStream(ctx context.Context, params map[string]interface{}) (*data.StreamResponse, error) {
+	return nil, nil
+}
+
+func newTestKeyPool(selection string) *ProviderKeyPool {
+	return NewProviderKeyPool(&utils.Config{LLM: utils.LLMConfig{
+		OpenAIAPIKey:  "sk-key-0001",
+		OpenAIAPIKeys: "sk-key-0002, sk-key-0003,sk-key-0001",
+		KeySelection:  selection,
+		KeyCooldown:   time.Minute,
+	}})
+}
+
+func TestProviderKeyPoolSelection(t *testing.T) {
+	pool := newTestKeyPool(utils.KeySelectionRoundRobin)
+	assert.True(t, pool.Pooled("openai"))
+	assert.False(t, pool.Pooled("anthropic"))
+
+	// Round robin takes each key in turn, the duplicate only once
+	var keys []string
+	for range 4 {
+		key := pool.Acquire("openai", nil)
+		pool.Release("openai", key, nil)
+		keys = append(keys, key)
+	}
+	assert.Equal(t, []string{"sk-key-0001", "sk-key-0002", "sk-key-0003", "sk-key-0001"}, keys)
+
+	// Least loaded takes the key with the fewest requests in flight
+	pool = newTestKeyPool(utils.KeySelectionLeastLoaded)
+	first := pool.Acquire("openai", nil)
+	second := pool.Acquire("openai", nil)
+	assert.Equal(t, "sk-key-0001", first)
+	assert.Equal(t, "sk-key-0002", second)
+	pool.Release("openai", first, nil)
+	assert.Equal(t, "sk-key-0001", pool.Acquire("openai", nil))
+}
+
+func TestProviderKeyPoolRemovesRefusedKeys(t *testing.T) {
+	pool := newTestKeyPool(utils.KeySelectionRoundRobin)
+	statuses := map[string]int{"sk-key-0001": http.StatusTooManyRequests, "sk-key-0002": http.StatusUnauthorized}
+	client := &pooledKeyClient{
+		pool:     pool,
+		provider: "openai",
+		newClient: func(apiKey string) (data.LLMClient, error) {
+			return &keyedClient{key: apiKey, statuses: statuses}, nil
+		},
+	}
+
+	// A refused key moves the request on to the next one
+	resp, err := client.GenerateWithParams(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "sk-key-0003", resp.Text)
+
+	// Refused keys stay out of rotation
+	for range 3 {
+		key := pool.Acquire("openai", nil)
+		pool.Release("openai", key, nil)
+		assert.Equal(t, "sk-key-0003", key)
+	}
+
+	reports := make(map[string]ProviderKeyStatus)
+	for _, status := range pool.Status() {
+		reports[status.KeyHint] = status
+	}
+	require.Len(t, reports, 3)
+	assert.False(t, reports["0001"].Available)
+	assert.NotNil(t, reports["0001"].DownUntil)
+	assert.True(t, reports["0002"].Unauthorized)
+	assert.Equal(t, int64(4), reports["0003"].Requests)
+	assert.Zero(t, reports["0003"].InFlight)
+
+	// When every key is refused the request fails with the last refusal
+	statuses["sk-key-0003"] = http.StatusTooManyRequests
+	_, err = client.GenerateWithParams(context.Background(), nil)
+	assert.Equal(t, http.StatusTooManyRequests, keyRejection(err))
+}
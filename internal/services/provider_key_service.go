@@ -0,0 +1,205 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/utils"
+	"github.com/patrickmn/go-cache"
+)
+
+// ErrVaultDisabled is returned when no vault master key is configured
+var ErrVaultDisabled = errors.New("stored provider keys are not configured")
+
+// ErrUnsupportedProvider is returned for provider names the router cannot call
+var ErrUnsupportedProvider = errors.New("unsupported provider")
+
+// supportedProviders lists the providers users may store keys for
+var supportedProviders = map[string]bool{
+	"openai":    true,
+	"anthropic": true,
+	"google":    true,
+}
+
+// providerKeyCacheTTL bounds how long a replica may keep using a replaced or deleted key
+const providerKeyCacheTTL = time.Minute
+
+// ProviderKeyService stores users' own provider API keys with envelope encryption
+// and resolves them for generation requests
+type ProviderKeyService struct {
+	firebaseService *data.Service
+	vault           *vault
+	// decrypted caches plaintext keys in process only, never in the shared cache;
+	// an empty string records that the user has no key for the provider
+	decrypted *cache.Cache
+}
+
+// NewProviderKeyService creates a new provider key service.
+// Stored keys are disabled when no valid vault key is configured.
+func NewProviderKeyService(cfg *utils.Config, firebaseService *data.Service) *ProviderKeyService {
+	s := &ProviderKeyService{
+		firebaseService: firebaseService,
+		decrypted:       cache.New(providerKeyCacheTTL, 2*providerKeyCacheTTL),
+	}
+
+	vault, err := newVault(context.Background(), cfg)
+	if err != nil {
+		slog.Error("Failed to initialize vault, stored provider keys disabled", "error", err)
+		return s
+	}
+	s.vault = vault
+
+	return s
+}
+
+// Enabled reports whether users can store provider keys
+func (s *ProviderKeyService) Enabled() bool {
+	return s != nil && s.vault != nil
+}
+
+// StoreKey encrypts and stores a user's key for a provider, replacing any existing key
+func (s *ProviderKeyService) StoreKey(ctx context.Context, userID, provider, apiKey string) (*data.StoredProviderKey, error) {
+	if !s.Enabled() {
+		return nil, ErrVaultDisabled
+	}
+	if !supportedProviders[provider] {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedProvider, provider)
+	}
+
+	secret, err := s.vault.Seal(ctx, apiKey, providerKeyAAD(userID, provider))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt provider key: %w", err)
+	}
+
+	key := &data.StoredProviderKey{
+		UserID:   userID,
+		Provider: provider,
+		Secret:   *secret,
+		KeyHint:  keyHint(apiKey),
+	}
+	if existing, err := s.firebaseService.GetStoredProviderKey(ctx, userID, provider); err == nil && existing != nil {
+		key.CreatedAt = existing.CreatedAt
+	}
+
+	if err := s.firebaseService.SetStoredProviderKey(ctx, key); err != nil {
+		return nil, err
+	}
+
+	s.decrypted.Set(providerKeyCacheKey(userID, provider), apiKey, cache.DefaultExpiration)
+	return key, nil
+}
+
+// ListKeys lists the providers a user has stored keys for, without the keys themselves
+func (s *ProviderKeyService) ListKeys(ctx context.Context, userID string) ([]*data.StoredProviderKey, error) {
+	keys, err := s.firebaseService.ListStoredProviderKeys(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		keys = []*data.StoredProviderKey{}
+	}
+	return keys, nil
+}
+
+// DeleteKey removes a user's stored key for a provider
+func (s *ProviderKeyService) DeleteKey(ctx context.Context, userID, provider string) error {
+	if !supportedProviders[provider] {
+		return fmt.Errorf("%w: %s", ErrUnsupportedProvider, provider)
+	}
+	if err := s.firebaseService.DeleteStoredProviderKey(ctx, userID, provider); err != nil {
+		return err
+	}
+
+	s.decrypted.Delete(providerKeyCacheKey(userID, provider))
+	return nil
+}
+
+// ResolveKey returns a user's stored key for a provider, or an empty string if none is stored
+func (s *ProviderKeyService) ResolveKey(ctx context.Context, userID, provider string) (string, error) {
+	if !s.Enabled() || userID == "" {
+		return "", nil
+	}
+
+	cacheKey := providerKeyCacheKey(userID, provider)
+	if cached, found := s.decrypted.Get(cacheKey); found {
+		return cached.(string), nil
+	}
+
+	stored, err := s.firebaseService.GetStoredProviderKey(ctx, userID, provider)
+	if err != nil {
+		return "", err
+	}
+
+	apiKey := ""
+	if stored != nil {
+		apiKey, err = s.vault.Open(ctx, &stored.Secret, providerKeyAAD(userID, provider))
+		if err != nil {
+			slog.Error("Failed to decrypt stored provider key", "user_id", userID, "provider", provider, "key_id", stored.Secret.KeyID, "error", err)
+			return "", fmt.Errorf("failed to decrypt stored %s key: %w", provider, err)
+		}
+		if s.vault.Stale(&stored.Secret) {
+			if err := s.rewrapKey(ctx, userID, provider); err != nil {
+				slog.Warn("Failed to rewrap stored provider key", "user_id", userID, "provider", provider, "key_id", stored.Secret.KeyID, "error", err)
+			}
+		}
+	}
+
+	s.decrypted.Set(cacheKey, apiKey, cache.DefaultExpiration)
+	return apiKey, nil
+}
+
+// RewrapKeys moves every stored key sealed with the previous vault key, or not yet bound to its
+// owner, to the current key. It returns how many keys were examined; keys are also rewrapped as
+// they are used, so this only needs running before the previous key is retired.
+func (s *ProviderKeyService) RewrapKeys(ctx context.Context) (int, error) {
+	if !s.Enabled() {
+		return 0, ErrVaultDisabled
+	}
+	keys, err := s.firebaseService.ListAllStoredProviderKeys(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var errs []error
+	for _, key := range keys {
+		if !s.vault.Stale(&key.Secret) {
+			continue
+		}
+		if err := s.rewrapKey(ctx, key.UserID, key.Provider); err != nil {
+			errs = append(errs, fmt.Errorf("%s %s: %w", key.UserID, key.Provider, err))
+		}
+	}
+	return len(keys), errors.Join(errs...)
+}
+
+// rewrapKey moves a user's stored key for a provider to the current vault key if it is stale
+func (s *ProviderKeyService) rewrapKey(ctx context.Context, userID, provider string) error {
+	return s.firebaseService.RewrapStoredProviderKey(ctx, userID, provider, func(secret *data.SealedSecret) (*data.SealedSecret, error) {
+		if !s.vault.Stale(secret) {
+			return nil, nil
+		}
+		return s.vault.Rewrap(ctx, secret, providerKeyAAD(userID, provider))
+	})
+}
+
+// providerKeyAAD binds a stored key's ciphertext to the user and provider it was stored for
+func providerKeyAAD(userID, provider string) string {
+	return "provider_key:" + userID + ":" + provider
+}
+
+// providerKeyCacheKey returns the local cache key for a user's decrypted provider key
+func providerKeyCacheKey(userID, provider string) string {
+	return userID + ":" + provider
+}
+
+// keyHint returns the last four characters of an API key
+func keyHint(apiKey string) string {
+	if len(apiKey) <= 4 {
+		return ""
+	}
+	return apiKey[len(apiKey)-4:]
+}
@@ -0,0 +1,59 @@
+package services_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/apt-router/api/internal/services"
+	apttesting "github.com/apt-router/api/internal/testing"
+	"github.com/apt-router/api/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviderKeyVault(t *testing.T) {
+	oldKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	newKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+
+	store := apttesting.NewDatastore(t)
+	ctx := context.Background()
+
+	before := services.NewProviderKeyService(&utils.Config{Vault: utils.VaultConfig{MasterKey: oldKey, MasterKeyID: "local-v1"}}, store)
+	require.True(t, before.Enabled())
+	_, err := before.StoreKey(ctx, "user-1", "openai", "sk-user-1-key")
+	require.NoError(t, err)
+
+	t.Run("CiphertextIsBoundToOwner", func(t *testing.T) {
+		stored, err := store.GetStoredProviderKey(ctx, "user-1", "openai")
+		require.NoError(t, err)
+		stored.UserID = "user-2"
+		require.NoError(t, store.SetStoredProviderKey(ctx, stored))
+
+		// A fresh service so the key is decrypted rather than read from the in-process cache
+		_, err = services.NewProviderKeyService(&utils.Config{Vault: utils.VaultConfig{MasterKey: oldKey, MasterKeyID: "local-v1"}}, store).ResolveKey(ctx, "user-2", "openai")
+		assert.ErrorContains(t, err, "failed to decrypt")
+	})
+
+	t.Run("RotationRewrapsKeys", func(t *testing.T) {
+		rotated := services.NewProviderKeyService(&utils.Config{Vault: utils.VaultConfig{
+			MasterKey: newKey, MasterKeyID: "local-v2",
+			PreviousMasterKey: oldKey, PreviousMasterKeyID: "local-v1",
+		}}, store)
+
+		examined, err := rotated.RewrapKeys(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 2, examined)
+
+		stored, err := store.GetStoredProviderKey(ctx, "user-1", "openai")
+		require.NoError(t, err)
+		assert.Equal(t, "local-v2", stored.Secret.KeyID)
+
+		// Once rewrapped the previous key can be retired
+		after := services.NewProviderKeyService(&utils.Config{Vault: utils.VaultConfig{MasterKey: newKey, MasterKeyID: "local-v2"}}, store)
+		apiKey, err := after.ResolveKey(ctx, "user-1", "openai")
+		require.NoError(t, err)
+		assert.Equal(t, "sk-user-1-key", apiKey)
+	})
+}
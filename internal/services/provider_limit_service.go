@@ -0,0 +1,234 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/apt-router/api/internal/utils"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// ErrProviderRateLimited is returned when a provider's request or token budget cannot admit a
+// request within the provider queue timeout
+var ErrProviderRateLimited = errors.New("provider rate limit reached")
+
+// lowPriorityReserve is the share of each provider budget low-priority requests leave for other
+// traffic, so batch jobs cannot drain the budget interactive requests need
+const lowPriorityReserve = 0.25
+
+// meter records the throttling metrics of the service layer
+var meter = otel.Meter("github.com/apt-router/api/internal/services")
+
+// ProviderLimiter keeps traffic to each provider account within its configured requests- and
+// tokens-per-minute budgets. Each budget is a token bucket refilled continuously; requests wait
+// for capacity up to the queue timeout, so bursts are shaped rather than sent on to fail with 429s.
+type ProviderLimiter struct {
+	maxWait time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*providerBuckets
+
+	throttled metric.Int64Counter
+	waits     metric.Float64Histogram
+}
+
+// providerBuckets holds a provider's request and token buckets; nil buckets are unlimited
+type providerBuckets struct {
+	requests *tokenBucket
+	tokens   *tokenBucket
+}
+
+// ProviderReservation is the capacity taken from a provider's budget for one request
+type ProviderReservation struct {
+	limiter  *ProviderLimiter
+	provider string
+	tokens   int
+}
+
+// NewProviderLimiter creates a limiter for the provider budgets in cfg
+func NewProviderLimiter(cfg utils.RateLimitConfig) *ProviderLimiter {
+	now := time.Now()
+	buckets := make(map[string]*providerBuckets, len(cfg.Providers))
+	for provider, limit := range cfg.Providers {
+		b := &providerBuckets{
+			requests: newTokenBucket(limit.RequestsPerMinute, now),
+			tokens:   newTokenBucket(limit.TokensPerMinute, now),
+		}
+		if b.requests != nil || b.tokens != nil {
+			buckets[provider] = b
+		}
+	}
+
+	throttled, err := meter.Int64Counter("aptrouter.provider.throttled_requests",
+		metric.WithDescription("Requests delayed or rejected by a provider rate limit"))
+	if err != nil {
+		slog.Warn("Failed to create provider throttling counter", "error", err)
+	}
+	waits, err := meter.Float64Histogram("aptrouter.provider.throttle_wait",
+		metric.WithDescription("Time requests waited for provider capacity"),
+		metric.WithUnit("s"))
+	if err != nil {
+		slog.Warn("Failed to create provider throttle wait histogram", "error", err)
+	}
+
+	return &ProviderLimiter{
+		maxWait:   cfg.ProviderQueueTimeout,
+		buckets:   buckets,
+		throttled: throttled,
+		waits:     waits,
+	}
+}
+
+// Acquire waits until provider has capacity for one request using an estimated number of tokens.
+// Requests that would wait longer than the queue timeout fail with ErrProviderRateLimited at once.
+// High-priority requests are never delayed: they take capacity at once, borrowing against later
+// requests. Low-priority requests wait until the budget would keep lowPriorityReserve of itself
+// after they take their share. The reservation should be settled with the tokens the request
+// actually used.
+func (l *ProviderLimiter) Acquire(ctx context.Context, provider string, estimatedTokens int, priority string) (*ProviderReservation, error) {
+	if l == nil {
+		return nil, nil
+	}
+
+	l.mu.Lock()
+	b, ok := l.buckets[provider]
+	if !ok {
+		l.mu.Unlock()
+		return nil, nil
+	}
+
+	now := time.Now()
+	b.refill(now)
+	var reserve float64
+	if priority == PriorityLow {
+		reserve = lowPriorityReserve
+	}
+	var wait time.Duration
+	if priority != PriorityHigh {
+		wait = max(b.requests.delay(1, reserve), b.tokens.delay(float64(estimatedTokens), reserve))
+	}
+	if wait > l.maxWait {
+		l.mu.Unlock()
+		l.recordThrottled(ctx, provider, "rejected")
+		return nil, fmt.Errorf("%w for %s: capacity is available in %s", ErrProviderRateLimited, provider, wait.Round(time.Second))
+	}
+	b.requests.take(1)
+	b.tokens.take(float64(estimatedTokens))
+	l.mu.Unlock()
+
+	reservation := &ProviderReservation{limiter: l, provider: provider, tokens: estimatedTokens}
+	if wait <= 0 {
+		return reservation, nil
+	}
+
+	l.recordThrottled(ctx, provider, "queued")
+	if l.waits != nil {
+		l.waits.Record(ctx, wait.Seconds(), metric.WithAttributes(attribute.String("gen_ai.system", provider)))
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return reservation, nil
+	case <-ctx.Done():
+		reservation.release()
+		return nil, ctx.Err()
+	}
+}
+
+// recordThrottled counts a request delayed or rejected by a provider's budget
+func (l *ProviderLimiter) recordThrottled(ctx context.Context, provider, outcome string) {
+	if l.throttled != nil {
+		l.throttled.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("gen_ai.system", provider),
+			attribute.String("outcome", outcome),
+		))
+	}
+}
+
+// Settle charges the provider's token budget for the tokens the request actually used, returning
+// any of the estimate it did not use
+func (r *ProviderReservation) Settle(actualTokens int) {
+	if r == nil {
+		return
+	}
+
+	r.limiter.mu.Lock()
+	defer r.limiter.mu.Unlock()
+	b := r.limiter.buckets[r.provider]
+	b.refill(time.Now())
+	b.tokens.take(float64(actualTokens - r.tokens))
+	r.tokens = actualTokens
+}
+
+// release returns a reservation that was never used, including its request
+func (r *ProviderReservation) release() {
+	r.limiter.mu.Lock()
+	defer r.limiter.mu.Unlock()
+	b := r.limiter.buckets[r.provider]
+	b.refill(time.Now())
+	b.requests.take(-1)
+	b.tokens.take(float64(-r.tokens))
+}
+
+// refill tops up both buckets for the time elapsed; callers hold the limiter's lock
+func (b *providerBuckets) refill(now time.Time) {
+	b.requests.refill(now)
+	b.tokens.refill(now)
+}
+
+// tokenBucket is a budget of perMinute units refilled continuously. Its level may go negative
+// when requests use more than estimated, delaying later requests until the debt is repaid.
+type tokenBucket struct {
+	perMinute float64
+	level     float64
+	updated   time.Time
+}
+
+// newTokenBucket creates a full bucket, or nil (unlimited) when perMinute is 0
+func newTokenBucket(perMinute int, now time.Time) *tokenBucket {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &tokenBucket{perMinute: float64(perMinute), level: float64(perMinute), updated: now}
+}
+
+// refill adds the units accrued since the last refill, up to a full minute's budget
+func (b *tokenBucket) refill(now time.Time) {
+	if b == nil {
+		return
+	}
+	elapsed := now.Sub(b.updated)
+	if elapsed > 0 {
+		b.level = min(b.perMinute, b.level+elapsed.Minutes()*b.perMinute)
+		b.updated = now
+	}
+}
+
+// delay returns how long until n units are available while leaving the reserve share of the
+// budget untouched. A request larger than the whole budget waits for a full bucket rather than
+// forever.
+func (b *tokenBucket) delay(n, reserve float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	n = min(n+reserve*b.perMinute, b.perMinute)
+	if b.level >= n {
+		return 0
+	}
+	return time.Duration((n - b.level) / b.perMinute * float64(time.Minute))
+}
+
+// take removes n units, or returns them when n is negative
+func (b *tokenBucket) take(n float64) {
+	if b == nil {
+		return
+	}
+	b.level = min(b.perMinute, b.level-n)
+}
@@ -0,0 +1,179 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/apt-router/api/internal/data"
+)
+
+// Quality scorers
+const (
+	// QualityScorerSimilarity scores the cosine similarity of the two responses' term frequencies
+	QualityScorerSimilarity = "similarity"
+	// QualityScorerJudge asks a judge model to rate the optimized response against the original
+	QualityScorerJudge = "judge"
+)
+
+// qualityJudgePrompt asks the judge for a single 0-10 rating of how well the optimized response
+// preserves the original
+const qualityJudgePrompt = `You are evaluating whether shortening a prompt changed the quality of the answer.
+
+PROMPT:
+%s
+
+REFERENCE ANSWER (to the full prompt):
+%s
+
+CANDIDATE ANSWER (to the shortened prompt):
+%s
+
+Rate from 0 to 10 how well the candidate answer preserves the correctness, completeness and usefulness of the reference answer, where 10 means it is just as good. Reply with the number only.`
+
+// sampleQuality reports whether an optimized request should be evaluated against its original prompt
+func (s *GenerationService) sampleQuality(req *GenerationRequest, optimization *OptimizationResult, requestCtx *RequestContext) bool {
+	rate := s.config.Optimization.QualitySampleRate
+	if rate <= 0 || optimization == nil || !optimization.WasOptimized || req.Shadow || requestCtx.TestMode {
+		return false
+	}
+	return rand.Float64() < rate
+}
+
+// evaluateQuality generates the original, unoptimized prompt in the background and scores how
+// closely the optimized response matched it. sent is the request as the caller sent it. The
+// evaluation runs on the platform's keys and is neither charged to the account nor logged.
+func (s *GenerationService) evaluateQuality(ctx context.Context, sent GenerationRequest, optimized *GenerationResult, modelConfig ModelConfig, requestCtx *RequestContext) {
+	ctx = context.WithoutCancel(ctx)
+	scorer := s.config.Optimization.QualityScorer
+	if scorer == "" {
+		scorer = QualityScorerSimilarity
+	}
+
+	evaluation := &data.QualityEvaluation{
+		RequestID:             requestCtx.RequestID,
+		UserID:                requestCtx.UserID,
+		ModelID:               modelConfig.ModelID,
+		OptimizationType:      optimized.PromptOptimizationResult.OptimizationType,
+		Scorer:                scorer,
+		TokensSaved:           optimized.PromptOptimizationResult.TokensSaved,
+		OptimizedInputTokens:  optimized.Response.Usage.InputTokens,
+		OptimizedOutputTokens: optimized.Response.Usage.OutputTokens,
+	}
+
+	sent.OpenAIAPIKey, sent.AnthropicAPIKey, sent.GoogleAPIKey = "", "", ""
+	sent.Model = modelConfig.ModelID
+	sent.RequestedModel = ""
+	sent.Stream = false
+	sent.Shadow = true
+	sent.DisableOptimization = true
+	sent.Experiment = nil
+
+	// Evaluations yield provider capacity to live traffic
+	evaluationCtx := *requestCtx
+	evaluationCtx.Priority = PriorityLow
+	baseline, err := s.Generate(ctx, &sent, &evaluationCtx)
+	if err != nil {
+		evaluation.Error = err.Error()
+	} else {
+		usage := baseline.Response.Usage
+		evaluation.OriginalInputTokens = usage.InputTokens
+		evaluation.OriginalOutputTokens = usage.OutputTokens
+		evaluation.Cost = providerCost(modelConfig, usage.InputTokens, usage.OutputTokens, usage.Details, nil)
+
+		if scorer == QualityScorerJudge {
+			score, cost, err := s.judgeQuality(ctx, sent.Prompt, baseline.Response.Text, optimized.Response.Text, requestCtx)
+			evaluation.Cost += cost
+			if err != nil {
+				evaluation.Error = err.Error()
+			}
+			evaluation.Score = score
+		} else {
+			evaluation.Score = ResponseSimilarity(baseline.Response.Text, optimized.Response.Text)
+		}
+	}
+
+	if evaluation.Error != "" {
+		requestCtx.Logger.Warn("Quality evaluation failed", "error", evaluation.Error)
+	}
+	if err := s.usageStore.CreateQualityEvaluation(ctx, evaluation); err != nil {
+		requestCtx.Logger.Warn("Failed to store quality evaluation", "error", err)
+		return
+	}
+	requestCtx.Logger.Info("Optimization quality evaluated",
+		"model", evaluation.ModelID,
+		"scorer", evaluation.Scorer,
+		"score", evaluation.Score,
+		"tokens_saved", evaluation.TokensSaved)
+}
+
+// judgeQuality asks the configured judge model to score the candidate response against the
+// reference, returning the score between 0 and 1 and the judge call's provider cost
+func (s *GenerationService) judgeQuality(ctx context.Context, prompt, reference, candidate string, requestCtx *RequestContext) (float64, data.MicroUSD, error) {
+	modelConfig, err := s.modelCatalog.GetModelConfig(s.config.Optimization.QualityJudgeModel)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: judge model %s", ErrUnknownModel, s.config.Optimization.QualityJudgeModel)
+	}
+	client, err := s.createLLMClient(ctx, modelConfig, &GenerationRequest{Model: modelConfig.ModelID, Shadow: true}, requestCtx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create judge client: %w", err)
+	}
+
+	judgeCtx, cancel := context.WithTimeout(ctx, s.config.Timeouts.Provider)
+	defer cancel()
+	resp, err := client.GenerateWithParams(judgeCtx, map[string]interface{}{
+		"model":      modelConfig.ModelID,
+		"prompt":     fmt.Sprintf(qualityJudgePrompt, prompt, reference, candidate),
+		"max_tokens": 10,
+		"stream":     false,
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("judge failed: %w", err)
+	}
+	cost := providerCost(modelConfig, resp.InputTokens, resp.OutputTokens, data.TokenDetails{}, nil)
+
+	rating, err := strconv.ParseFloat(strings.TrimFunc(resp.Text, func(r rune) bool {
+		return !unicode.IsDigit(r) && r != '.'
+	}), 64)
+	if err != nil || rating < 0 || rating > 10 {
+		return 0, cost, fmt.Errorf("judge returned an invalid rating %q", resp.Text)
+	}
+	return rating / 10, cost, nil
+}
+
+// ResponseSimilarity scores how alike two responses are, from 0 to 1, as the cosine similarity of
+// their lowercase word frequencies. Two empty responses are identical.
+func ResponseSimilarity(a, b string) float64 {
+	termsA, termsB := termFrequencies(a), termFrequencies(b)
+	if len(termsA) == 0 || len(termsB) == 0 {
+		if len(termsA) == len(termsB) {
+			return 1
+		}
+		return 0
+	}
+
+	var dot, normA, normB float64
+	for term, countA := range termsA {
+		dot += countA * termsB[term]
+		normA += countA * countA
+	}
+	for _, countB := range termsB {
+		normB += countB * countB
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// termFrequencies counts the lowercase words in text
+func termFrequencies(text string) map[string]float64 {
+	terms := make(map[string]float64)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		terms[word]++
+	}
+	return terms
+}
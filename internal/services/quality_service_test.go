@@ -0,0 +1,35 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponseSimilarity(t *testing.T) {
+	assert.InDelta(t, 1, ResponseSimilarity("The capital of France is Paris.", "the capital of france is paris"), 1e-9)
+	assert.InDelta(t, 0, ResponseSimilarity("Paris", "Berlin"), 1e-9)
+	assert.InDelta(t, 1, ResponseSimilarity("", ""), 1e-9)
+	assert.InDelta(t, 0, ResponseSimilarity("Paris", ""), 1e-9)
+
+	// All four terms of the shorter answer appear among the six of the longer one
+	score := ResponseSimilarity("Paris is the capital of France", "Paris is the capital")
+	assert.InDelta(t, 4/(2*2.449489742783178), score, 1e-9)
+}
+
+func TestSummarizeQualityEvaluations(t *testing.T) {
+	summary := data.SummarizeQualityEvaluations([]*data.QualityEvaluation{
+		{Score: 0.9, TokensSaved: 100, OriginalOutputTokens: 50, OptimizedOutputTokens: 40, Cost: 10},
+		{Score: 0.5, TokensSaved: 50, OriginalOutputTokens: 50, OptimizedOutputTokens: 60, Cost: 20},
+		{Error: "generation failed", Cost: 5},
+	})
+
+	assert.Equal(t, 3, summary.Evaluations)
+	assert.Equal(t, 1, summary.Errors)
+	assert.InDelta(t, 0.7, summary.AvgScore, 1e-9)
+	assert.Equal(t, 0.5, summary.MinScore)
+	assert.Equal(t, 150, summary.TokensSaved)
+	assert.Equal(t, 0, summary.OutputTokensDelta)
+	assert.Equal(t, data.MicroUSD(35), summary.Cost)
+}
@@ -0,0 +1,438 @@
+package services
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/utils"
+)
+
+// ErrInvalidBillingExport is returned for billing exports that can't be parsed
+var ErrInvalidBillingExport = errors.New("invalid billing export")
+
+// openAIAPIBaseURL is where OpenAI's organization costs API is served
+const openAIAPIBaseURL = "https://api.openai.com/v1"
+
+// ProviderBillingSource reads what a provider billed per model and day from its billing API
+type ProviderBillingSource interface {
+	DailyCosts(ctx context.Context, start, end time.Time) ([]*data.ProviderBillingRecord, error)
+}
+
+// ReconciliationService compares the base cost recorded for each provider's models per day with
+// what the provider billed, from uploaded exports or its billing API, so pricing tables that have
+// drifted from the providers' prices are caught
+type ReconciliationService struct {
+	config          utils.ReconciliationConfig
+	firebaseService *data.Service
+	sources         map[string]ProviderBillingSource
+}
+
+// NewReconciliationService creates a new reconciliation service.
+// OpenAI's costs are read from its API when an admin key is configured.
+func NewReconciliationService(cfg *utils.Config, firebaseService *data.Service) *ReconciliationService {
+	s := &ReconciliationService{
+		config:          cfg.Reconciliation,
+		firebaseService: firebaseService,
+		sources:         make(map[string]ProviderBillingSource),
+	}
+	if cfg.Reconciliation.OpenAIAdminKey != "" {
+		s.sources["openai"] = NewOpenAIBillingSource(cfg.Reconciliation.OpenAIAdminKey, "")
+	}
+	return s
+}
+
+// SetBillingSource sets the billing API a provider's costs are read from before each
+// reconciliation, e.g. to test against a fake
+func (s *ReconciliationService) SetBillingSource(provider string, source ProviderBillingSource) {
+	s.sources[provider] = source
+}
+
+// ImportCSV stores a provider's billing export, replacing what was held for the days and models
+// it covers. Rows need a date, a model and a cost in USD; input and output token columns are
+// optional. Rows for the same model and day are summed, as exports often split them by line item.
+func (s *ReconciliationService) ImportCSV(ctx context.Context, provider string, r io.Reader) ([]*data.ProviderBillingRecord, error) {
+	records, err := parseBillingCSV(provider, r)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%w: no rows", ErrInvalidBillingExport)
+	}
+	if err := s.firebaseService.SetProviderBillingRecords(ctx, records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// billingCSVColumns are the header names accepted for each column of a billing export
+var billingCSVColumns = map[string][]string{
+	"date":          {"date", "day", "usage_date", "start_time"},
+	"model":         {"model", "model_id", "line_item"},
+	"cost":          {"cost", "cost_usd", "amount", "amount_usd", "amount_value"},
+	"input_tokens":  {"input_tokens", "prompt_tokens"},
+	"output_tokens": {"output_tokens", "completion_tokens"},
+}
+
+// parseBillingCSV parses a provider's billing export into a record per model and day
+func parseBillingCSV(provider string, r io.Reader) ([]*data.ProviderBillingRecord, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%w: empty file", ErrInvalidBillingExport)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBillingExport, err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		for column, aliases := range billingCSVColumns {
+			for _, alias := range aliases {
+				if _, seen := columns[column]; !seen && name == alias {
+					columns[column] = i
+				}
+			}
+		}
+	}
+	for _, column := range []string{"date", "model", "cost"} {
+		if _, ok := columns[column]; !ok {
+			return nil, fmt.Errorf("%w: no %s column", ErrInvalidBillingExport, column)
+		}
+	}
+
+	now := time.Now()
+	byKey := make(map[string]*data.ProviderBillingRecord)
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidBillingExport, err)
+		}
+		line, _ := reader.FieldPos(0)
+
+		day, err := parseBillingDay(row[columns["date"]])
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrInvalidBillingExport, line, err)
+		}
+		modelID := billingModelID(row[columns["model"]])
+		if modelID == "" {
+			return nil, fmt.Errorf("%w: line %d: no model", ErrInvalidBillingExport, line)
+		}
+		cost, err := data.ParseUSD(strings.TrimPrefix(strings.TrimSpace(row[columns["cost"]]), "$"))
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrInvalidBillingExport, line, err)
+		}
+		var tokens [2]int
+		for i, column := range []string{"input_tokens", "output_tokens"} {
+			index, ok := columns[column]
+			if !ok || strings.TrimSpace(row[index]) == "" {
+				continue
+			}
+			if tokens[i], err = strconv.Atoi(strings.TrimSpace(row[index])); err != nil {
+				return nil, fmt.Errorf("%w: line %d: invalid %s", ErrInvalidBillingExport, line, column)
+			}
+		}
+
+		key := modelID + "|" + day.Format(time.DateOnly)
+		record, ok := byKey[key]
+		if !ok {
+			record = &data.ProviderBillingRecord{
+				Provider:   provider,
+				ModelID:    modelID,
+				Day:        day,
+				Source:     data.BillingSourceCSV,
+				ImportedAt: now,
+			}
+			byKey[key] = record
+		}
+		record.Cost += cost
+		record.InputTokens += tokens[0]
+		record.OutputTokens += tokens[1]
+	}
+
+	return sortedBillingRecords(byKey), nil
+}
+
+// parseBillingDay parses an export's date as a YYYY-MM-DD day, an RFC 3339 timestamp or Unix
+// seconds, returning the UTC day it falls on
+func parseBillingDay(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if day, err := time.Parse(time.DateOnly, value); err == nil {
+		return day, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return data.RollupBucket(data.RollupDaily, t), nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return data.RollupBucket(data.RollupDaily, time.Unix(seconds, 0)), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", value)
+}
+
+// billingModelID returns the model a billing line item is for. Line items such as
+// "gpt-4o, input" are billed per model and token type.
+func billingModelID(lineItem string) string {
+	modelID, _, _ := strings.Cut(lineItem, ",")
+	return strings.TrimSpace(modelID)
+}
+
+// sortedBillingRecords lists records by day and model
+func sortedBillingRecords(byKey map[string]*data.ProviderBillingRecord) []*data.ProviderBillingRecord {
+	records := make([]*data.ProviderBillingRecord, 0, len(byKey))
+	for _, record := range byKey {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].Day.Equal(records[j].Day) {
+			return records[i].Day.Before(records[j].Day)
+		}
+		return records[i].ModelID < records[j].ModelID
+	})
+	return records
+}
+
+// Sweep imports the lookback's costs from the providers' billing APIs and reconciles its days.
+// A provider whose API fails is reconciled with the costs last imported for it.
+func (s *ReconciliationService) Sweep(ctx context.Context) error {
+	end := time.Now()
+	start := data.RollupBucket(data.RollupDaily, end.AddDate(0, 0, -s.config.LookbackDays))
+
+	for provider, source := range s.sources {
+		records, err := source.DailyCosts(ctx, start, end)
+		if err != nil {
+			slog.Warn("Failed to read provider billing API", "provider", provider, "error", err)
+			continue
+		}
+		now := time.Now()
+		for _, record := range records {
+			record.Provider = provider
+			record.Source = data.BillingSourceAPI
+			record.ImportedAt = now
+		}
+		if err := s.firebaseService.SetProviderBillingRecords(ctx, records); err != nil {
+			return err
+		}
+	}
+
+	_, err := s.Reconcile(ctx, start, end)
+	return err
+}
+
+// Reconcile compares the costs recorded for the days from start through end with what was
+// billed for them, storing and returning a reconciliation per provider, model and day. Only days
+// a provider has billing records for are compared, so days not yet billed or imported are not
+// flagged.
+func (s *ReconciliationService) Reconcile(ctx context.Context, start, end time.Time) ([]*data.CostReconciliation, error) {
+	billed, err := s.firebaseService.ListProviderBillingRecords(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+	recorded, err := s.firebaseService.ListProviderCosts(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	billedDays := make(map[string]bool)
+	byKey := make(map[string]*data.CostReconciliation)
+	reconciliation := func(provider, modelID string, day time.Time) *data.CostReconciliation {
+		key := provider + "|" + modelID + "|" + day.Format(time.DateOnly)
+		r, ok := byKey[key]
+		if !ok {
+			r = &data.CostReconciliation{Provider: provider, ModelID: modelID, Day: day, CheckedAt: now}
+			byKey[key] = r
+		}
+		return r
+	}
+	for _, record := range billed {
+		billedDays[record.Provider+"|"+record.Day.Format(time.DateOnly)] = true
+		r := reconciliation(record.Provider, record.ModelID, record.Day)
+		r.BilledCost += record.Cost
+		r.Billed = true
+	}
+	for _, cost := range recorded {
+		if !billedDays[cost.Provider+"|"+cost.Day.Format(time.DateOnly)] {
+			continue
+		}
+		r := reconciliation(cost.Provider, cost.ModelID, cost.Day)
+		r.RecordedCost += cost.BaseCost
+		r.Requests += cost.Requests
+		r.Recorded = true
+	}
+
+	reconciliations := make([]*data.CostReconciliation, 0, len(byKey))
+	minDifference := data.USDToMicros(s.config.MinDifferenceUSD)
+	for _, r := range byKey {
+		r.Difference = r.BilledCost - r.RecordedCost
+		absolute := r.Difference
+		if absolute < 0 {
+			absolute = -absolute
+		}
+		switch {
+		case r.BilledCost != 0:
+			r.DifferencePercent = float64(absolute) / float64(r.BilledCost) * 100
+		case absolute != 0:
+			r.DifferencePercent = 100
+		}
+		r.Flagged = absolute > minDifference && r.DifferencePercent > s.config.ThresholdPercent
+		if r.Flagged {
+			slog.Warn("Recorded provider cost differs from billed cost",
+				"provider", r.Provider,
+				"model_id", r.ModelID,
+				"day", r.Day.Format(time.DateOnly),
+				"recorded_cost", r.RecordedCost.String(),
+				"billed_cost", r.BilledCost.String(),
+				"difference_percent", r.DifferencePercent,
+			)
+		}
+		reconciliations = append(reconciliations, r)
+	}
+	sortReconciliations(reconciliations)
+
+	if err := s.firebaseService.SetCostReconciliations(ctx, reconciliations); err != nil {
+		return nil, err
+	}
+	return reconciliations, nil
+}
+
+// List lists the stored reconciliations of the days from start through end
+func (s *ReconciliationService) List(ctx context.Context, start, end time.Time) ([]*data.CostReconciliation, error) {
+	reconciliations, err := s.firebaseService.ListCostReconciliations(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+	sortReconciliations(reconciliations)
+	return reconciliations, nil
+}
+
+// sortReconciliations orders reconciliations by day, provider and model
+func sortReconciliations(reconciliations []*data.CostReconciliation) {
+	sort.Slice(reconciliations, func(i, j int) bool {
+		a, b := reconciliations[i], reconciliations[j]
+		if !a.Day.Equal(b.Day) {
+			return a.Day.Before(b.Day)
+		}
+		if a.Provider != b.Provider {
+			return a.Provider < b.Provider
+		}
+		return a.ModelID < b.ModelID
+	})
+}
+
+// OpenAIBillingSource reads daily costs per model from OpenAI's organization costs API, which
+// needs an admin API key
+type OpenAIBillingSource struct {
+	apiKey     string
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewOpenAIBillingSource creates a source reading OpenAI's costs API at baseURL, or OpenAI's own
+// API when empty
+func NewOpenAIBillingSource(apiKey, baseURL string) *OpenAIBillingSource {
+	if baseURL == "" {
+		baseURL = openAIAPIBaseURL
+	}
+	return &OpenAIBillingSource{
+		apiKey:     apiKey,
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// openAICostsPage is a page of OpenAI's organization costs, bucketed by day
+type openAICostsPage struct {
+	Data []struct {
+		StartTime int64 `json:"start_time"`
+		Results   []struct {
+			Amount struct {
+				Value float64 `json:"value"`
+			} `json:"amount"`
+			LineItem string `json:"line_item"`
+		} `json:"results"`
+	} `json:"data"`
+	HasMore  bool   `json:"has_more"`
+	NextPage string `json:"next_page"`
+}
+
+// DailyCosts reads the costs billed per model for the days from start through end
+func (o *OpenAIBillingSource) DailyCosts(ctx context.Context, start, end time.Time) ([]*data.ProviderBillingRecord, error) {
+	query := url.Values{
+		"start_time":   {strconv.FormatInt(start.Unix(), 10)},
+		"end_time":     {strconv.FormatInt(end.Unix(), 10)},
+		"bucket_width": {"1d"},
+		"group_by":     {"line_item"},
+		"limit":        {"31"},
+	}
+
+	byKey := make(map[string]*data.ProviderBillingRecord)
+	for {
+		page, err := o.costsPage(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		for _, bucket := range page.Data {
+			day := data.RollupBucket(data.RollupDaily, time.Unix(bucket.StartTime, 0))
+			for _, result := range bucket.Results {
+				modelID := billingModelID(result.LineItem)
+				if modelID == "" {
+					continue
+				}
+				key := modelID + "|" + day.Format(time.DateOnly)
+				record, ok := byKey[key]
+				if !ok {
+					record = &data.ProviderBillingRecord{Provider: "openai", ModelID: modelID, Day: day}
+					byKey[key] = record
+				}
+				record.Cost += data.USDToMicros(result.Amount.Value)
+			}
+		}
+		if !page.HasMore || page.NextPage == "" {
+			break
+		}
+		query.Set("page", page.NextPage)
+	}
+
+	return sortedBillingRecords(byKey), nil
+}
+
+// costsPage gets one page of the organization costs API
+func (o *OpenAIBillingSource) costsPage(ctx context.Context, query url.Values) (*openAICostsPage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.baseURL+"/organization/costs?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OpenAI costs request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+o.apiKey)
+
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get OpenAI costs: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("OpenAI costs API returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var page openAICostsPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("failed to parse OpenAI costs: %w", err)
+	}
+	return &page, nil
+}
@@ -0,0 +1,181 @@
+package services_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	apttesting "github.com/apt-router/api/internal/testing"
+	"github.com/apt-router/api/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBillingSource returns fixed billing records
+type fakeBillingSource []*data.ProviderBillingRecord
+
+func (f fakeBillingSource) DailyCosts(ctx context.Context, start, end time.Time) ([]*data.ProviderBillingRecord, error) {
+	return f, nil
+}
+
+func TestReconciliation(t *testing.T) {
+	store := apttesting.NewDatastore(t)
+	ctx := context.Background()
+	yesterday := data.RollupBucket(data.RollupDaily, time.Now()).AddDate(0, 0, -1)
+	earlier := yesterday.AddDate(0, 0, -1)
+
+	for _, log := range []*data.RequestLog{
+		{ID: "req-1", UserID: "user-1", Provider: "openai", ModelID: "gpt-4o", BaseCost: 6_000_000, RequestTimestamp: yesterday.Add(time.Hour)},
+		{ID: "req-2", UserID: "user-1", Provider: "openai", ModelID: "gpt-4o", BaseCost: 4_000_000, RequestTimestamp: yesterday.Add(2 * time.Hour)},
+		{ID: "req-3", UserID: "user-1", Provider: "openai", ModelID: "gpt-4o-mini", BaseCost: 1_000_000, RequestTimestamp: yesterday.Add(time.Hour)},
+		// The platform pays for neither BYOK nor test mode requests
+		{ID: "req-4", UserID: "user-1", Provider: "openai", ModelID: "gpt-4o", BaseCost: 50_000_000, BYOK: true, RequestTimestamp: yesterday.Add(time.Hour)},
+		{ID: "req-5", UserID: "user-1", Provider: "openai", ModelID: "gpt-4o", BaseCost: 50_000_000, TestMode: true, RequestTimestamp: yesterday.Add(time.Hour)},
+		// Days and providers without billing records are not reconciled
+		{ID: "req-6", UserID: "user-1", Provider: "openai", ModelID: "gpt-4o", BaseCost: 5_000_000, RequestTimestamp: earlier.Add(time.Hour)},
+		{ID: "req-7", UserID: "user-1", Provider: "anthropic", ModelID: "claude-sonnet-4", BaseCost: 5_000_000, RequestTimestamp: yesterday.Add(time.Hour)},
+		{ID: "req-8", UserID: "user-1", Provider: "google", ModelID: "gemini-2.5-flash", BaseCost: 2_000_000, RequestTimestamp: yesterday.Add(time.Hour)},
+	} {
+		require.NoError(t, store.LogRequest(ctx, log))
+	}
+
+	reconciliation := services.NewReconciliationService(&utils.Config{
+		Reconciliation: utils.ReconciliationConfig{LookbackDays: 7, ThresholdPercent: 5, MinDifferenceUSD: 1},
+	}, store)
+
+	t.Run("ImportCSV", func(t *testing.T) {
+		day := yesterday.Format(time.DateOnly)
+		records, err := reconciliation.ImportCSV(ctx, "openai", strings.NewReader(
+			"Date,Line_Item,Amount_USD,Input_Tokens\n"+
+				day+",\"gpt-4o, input\",8.00,1000\n"+
+				day+",\"gpt-4o, output\",$4.00,\n"+
+				day+",gpt-4o-mini,1.02,\n"+
+				day+",o3,3.00,\n"))
+		require.NoError(t, err)
+		require.Len(t, records, 3)
+		assert.Equal(t, "gpt-4o", records[0].ModelID)
+		assert.Equal(t, data.MicroUSD(12_000_000), records[0].Cost)
+		assert.Equal(t, 1000, records[0].InputTokens)
+		assert.Equal(t, data.BillingSourceCSV, records[0].Source)
+		assert.True(t, records[0].Day.Equal(yesterday))
+	})
+
+	t.Run("InvalidCSV", func(t *testing.T) {
+		_, err := reconciliation.ImportCSV(ctx, "openai", strings.NewReader("date,model\n2025-01-01,gpt-4o\n"))
+		assert.ErrorIs(t, err, services.ErrInvalidBillingExport)
+		assert.ErrorContains(t, err, "no cost column")
+
+		_, err = reconciliation.ImportCSV(ctx, "openai", strings.NewReader("date,model,cost\n2025-01-01,gpt-4o,1\nyesterday,gpt-4o,1\n"))
+		assert.ErrorIs(t, err, services.ErrInvalidBillingExport)
+		assert.ErrorContains(t, err, "line 3")
+	})
+
+	t.Run("Reconcile", func(t *testing.T) {
+		results, err := reconciliation.Reconcile(ctx, earlier, time.Now())
+		require.NoError(t, err)
+		require.Len(t, results, 3)
+
+		// $12 was billed for $10 recorded: off by over $1 and 5%
+		gpt4o := results[0]
+		assert.Equal(t, "gpt-4o", gpt4o.ModelID)
+		assert.Equal(t, data.MicroUSD(10_000_000), gpt4o.RecordedCost)
+		assert.Equal(t, data.MicroUSD(12_000_000), gpt4o.BilledCost)
+		assert.Equal(t, data.MicroUSD(2_000_000), gpt4o.Difference)
+		assert.InDelta(t, 16.67, gpt4o.DifferencePercent, 0.01)
+		assert.Equal(t, 2, gpt4o.Requests)
+		assert.True(t, gpt4o.Flagged)
+
+		// Two cents is within the minimum difference
+		mini := results[1]
+		assert.Equal(t, "gpt-4o-mini", mini.ModelID)
+		assert.Equal(t, data.MicroUSD(20_000), mini.Difference)
+		assert.False(t, mini.Flagged)
+
+		// Billed costs with nothing recorded point at requests logged under another model ID
+		o3 := results[2]
+		assert.Equal(t, "o3", o3.ModelID)
+		assert.True(t, o3.Billed)
+		assert.False(t, o3.Recorded)
+		assert.Equal(t, 100.0, o3.DifferencePercent)
+		assert.True(t, o3.Flagged)
+
+		stored, err := reconciliation.List(ctx, earlier, time.Now())
+		require.NoError(t, err)
+		assert.Len(t, stored, 3)
+	})
+
+	t.Run("Sweep", func(t *testing.T) {
+		reconciliation.SetBillingSource("google", fakeBillingSource{
+			{ModelID: "gemini-2.5-flash", Day: yesterday, Cost: 2_000_000},
+		})
+		require.NoError(t, reconciliation.Sweep(ctx))
+
+		billed, err := store.ListProviderBillingRecords(ctx, yesterday, time.Now())
+		require.NoError(t, err)
+		var google *data.ProviderBillingRecord
+		for _, record := range billed {
+			if record.Provider == "google" {
+				google = record
+			}
+		}
+		require.NotNil(t, google)
+		assert.Equal(t, data.BillingSourceAPI, google.Source)
+
+		stored, err := reconciliation.List(ctx, yesterday, time.Now())
+		require.NoError(t, err)
+		require.Len(t, stored, 4)
+		assert.Equal(t, "gemini-2.5-flash", stored[0].ModelID)
+		assert.Zero(t, stored[0].Difference)
+		assert.False(t, stored[0].Flagged)
+	})
+}
+
+func TestOpenAIBillingSource(t *testing.T) {
+	day := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/organization/costs", r.URL.Path)
+		assert.Equal(t, "Bearer admin-key", r.Header.Get("Authorization"))
+		assert.Equal(t, "1d", r.URL.Query().Get("bucket_width"))
+		assert.Equal(t, "line_item", r.URL.Query().Get("group_by"))
+
+		page := map[string]interface{}{
+			"data": []interface{}{map[string]interface{}{
+				"start_time": day.Unix(),
+				"results": []interface{}{
+					map[string]interface{}{"amount": map[string]interface{}{"value": 1.25, "currency": "usd"}, "line_item": "gpt-4o, input"},
+					map[string]interface{}{"amount": map[string]interface{}{"value": 0.75, "currency": "usd"}, "line_item": "gpt-4o, output"},
+				},
+			}},
+			"has_more":  true,
+			"next_page": "page-2",
+		}
+		if r.URL.Query().Get("page") == "page-2" {
+			page = map[string]interface{}{
+				"data": []interface{}{map[string]interface{}{
+					"start_time": day.AddDate(0, 0, 1).Unix(),
+					"results": []interface{}{
+						map[string]interface{}{"amount": map[string]interface{}{"value": 3.5, "currency": "usd"}, "line_item": "gpt-4o, input"},
+					},
+				}},
+				"has_more": false,
+			}
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(page))
+	}))
+	defer server.Close()
+
+	records, err := services.NewOpenAIBillingSource("admin-key", server.URL+"/v1").DailyCosts(context.Background(), day, day.AddDate(0, 0, 2))
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "gpt-4o", records[0].ModelID)
+	assert.True(t, records[0].Day.Equal(day))
+	assert.Equal(t, data.MicroUSD(2_000_000), records[0].Cost)
+	assert.True(t, records[1].Day.Equal(day.AddDate(0, 0, 1)))
+	assert.Equal(t, data.MicroUSD(3_500_000), records[1].Cost)
+}
@@ -0,0 +1,181 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/apt-router/api/internal/data"
+)
+
+// Replay modes
+const (
+	// ReplayDryRun resolves and prices a logged request as it would run now, without calling a provider
+	ReplayDryRun = "dry_run"
+	// ReplayShadow runs a logged request against the provider again, without charging or logging it
+	ReplayShadow = "shadow"
+)
+
+var (
+	// ErrInvalidReplayMode is returned for a replay mode other than dry_run or shadow
+	ErrInvalidReplayMode = errors.New("replay mode must be dry_run or shadow")
+	// ErrPayloadNotLogged is returned when replaying a request whose payload was not logged
+	ErrPayloadNotLogged = errors.New("request payload was not logged; enable LOG_REQUEST_PAYLOADS to replay requests")
+)
+
+// ReplayRun describes one execution of a request: the original one from its log, or a replay
+type ReplayRun struct {
+	Model        string        `json:"model"`
+	Provider     string        `json:"provider"`
+	InputTokens  int           `json:"input_tokens"`
+	OutputTokens int           `json:"output_tokens"`
+	Cost         data.MicroUSD `json:"cost"`
+	WasOptimized bool          `json:"was_optimized"`
+	// Output is the completion; dry runs have none
+	Output string `json:"output,omitempty"`
+}
+
+// ReplayResult compares a replayed request with the original
+type ReplayResult struct {
+	RequestID    string    `json:"request_id"`
+	Mode         string    `json:"mode"`
+	Original     ReplayRun `json:"original"`
+	Replay       ReplayRun `json:"replay"`
+	ModelChanged bool      `json:"model_changed"`
+	// OutputMatches is set when a shadow replay's completion is identical to the original's
+	OutputMatches bool `json:"output_matches"`
+	// CostDelta is the replay's cost less the original's
+	CostDelta data.MicroUSD `json:"cost_delta"`
+}
+
+// capturePayload records a request as the caller sent it, before it is resolved and rewritten,
+// when payload logging is enabled. It returns nil otherwise.
+func (s *GenerationService) capturePayload(req *GenerationRequest) *data.RequestPayload {
+	if !s.config.Logging.RequestPayloads {
+		return nil
+	}
+
+	// Provider keys sent with the request are never stored
+	sent := *req
+	sent.OpenAIAPIKey, sent.AnthropicAPIKey, sent.GoogleAPIKey = "", "", ""
+
+	encoded, err := json.Marshal(&sent)
+	if err != nil {
+		slog.Warn("Failed to capture request payload", "error", err)
+		return nil
+	}
+	var request map[string]interface{}
+	if err := json.Unmarshal(encoded, &request); err != nil {
+		slog.Warn("Failed to capture request payload", "error", err)
+		return nil
+	}
+	return &data.RequestPayload{Request: request}
+}
+
+// Replay re-executes a logged request from its stored payload and compares the result with the
+// original. A dry run resolves and prices the request without calling a provider, assuming the
+// original's output length; a shadow replay calls the provider with the platform's keys. Neither
+// is charged or logged. model, when set, replaces the original request's model.
+func (s *GenerationService) Replay(ctx context.Context, log *data.RequestLog, mode, model string, requestCtx *RequestContext) (*ReplayResult, error) {
+	if mode == "" {
+		mode = ReplayDryRun
+	}
+	if mode != ReplayDryRun && mode != ReplayShadow {
+		return nil, ErrInvalidReplayMode
+	}
+	if log.Payload == nil {
+		return nil, ErrPayloadNotLogged
+	}
+
+	encoded, err := json.Marshal(log.Payload.Request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode request payload: %w", err)
+	}
+	var req GenerationRequest
+	if err := json.Unmarshal(encoded, &req); err != nil {
+		return nil, fmt.Errorf("failed to decode request payload: %w", err)
+	}
+	if model != "" {
+		req.Model = model
+	}
+	req.Stream = false
+	req.Shadow = true
+
+	result := &ReplayResult{
+		RequestID: log.RequestID,
+		Mode:      mode,
+		Original: ReplayRun{
+			Model:        log.ModelID,
+			Provider:     log.Provider,
+			InputTokens:  log.InputTokens,
+			OutputTokens: log.OutputTokens,
+			Cost:         log.TotalCost,
+			WasOptimized: log.WasOptimized,
+			Output:       log.Payload.Completion,
+		},
+	}
+
+	if mode == ReplayDryRun {
+		estimate, err := s.Estimate(ctx, &req, requestCtx)
+		if err != nil {
+			return nil, err
+		}
+		modelConfig, err := s.modelCatalog.GetModelConfig(estimate.Model)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownModel, estimate.Model)
+		}
+
+		result.Replay = ReplayRun{
+			Model:        estimate.Model,
+			Provider:     estimate.Provider,
+			InputTokens:  estimate.InputTokens,
+			OutputTokens: log.OutputTokens,
+			Cost:         s.replayCost(estimate.InputTokens, log.OutputTokens, data.TokenDetails{}, nil, modelConfig, requestCtx).Total(),
+		}
+	} else {
+		generation, err := s.Generate(ctx, &req, requestCtx)
+		if err != nil {
+			return nil, err
+		}
+		modelConfig, err := s.modelCatalog.GetModelConfig(req.Model)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownModel, req.Model)
+		}
+
+		usage := generation.Response.Usage
+		result.Replay = ReplayRun{
+			Model:        modelConfig.ModelID,
+			Provider:     generation.Response.Provider,
+			InputTokens:  usage.InputTokens,
+			OutputTokens: usage.OutputTokens,
+			Cost:         s.replayCost(usage.InputTokens, usage.OutputTokens, usage.Details, generation.PromptOptimizationResult, modelConfig, requestCtx).Total(),
+			WasOptimized: generation.WasOptimized,
+			Output:       generation.Response.Text,
+		}
+		result.OutputMatches = result.Replay.Output == result.Original.Output
+	}
+
+	result.ModelChanged = result.Replay.Model != result.Original.Model
+	result.CostDelta = result.Replay.Cost - result.Original.Cost
+
+	requestCtx.Logger.Info("Request replayed",
+		"replayed_request_id", log.RequestID,
+		"mode", mode,
+		"original_model", result.Original.Model,
+		"replay_model", result.Replay.Model,
+		"cost_delta", result.CostDelta.String())
+	return result, nil
+}
+
+// replayCost prices a replay as the request's account would be billed for it, on the platform's keys
+func (s *GenerationService) replayCost(inputTokens, outputTokens int, details data.TokenDetails, optimization *OptimizationResult, modelConfig ModelConfig, requestCtx *RequestContext) data.CostBreakdown {
+	pricing := requestCtx.ModelPricing(modelConfig)
+	cost := data.ComputeDetailedCost(inputTokens, outputTokens, details, modelConfig.TokenRates(),
+		pricing.InputPricePerMillion, pricing.OutputPricePerMillion, pricing.InputMarkupPercent, pricing.OutputMarkupPercent)
+	if optimization != nil {
+		cost.Optimizer = optimization.OptimizerCost
+	}
+	return s.BillableCost(false, requestCtx.TestMode, cost)
+}
@@ -0,0 +1,135 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// RetentionService purges request logs once they are older than their tier's retention, deleting
+// or anonymizing them, and removes stored payloads once they are older than the payload retention.
+// Each tier is purged from where the last purge got to, so logs are visited once.
+type RetentionService struct {
+	config          utils.PrivacyConfig
+	firebaseService *data.Service
+	privacy         *PrivacyService
+	// purged counts purged documents by tier and action
+	purged metric.Int64Counter
+}
+
+// NewRetentionService creates a new retention service; anonymized logs are kept under the
+// pseudonyms privacy gives their users
+func NewRetentionService(cfg *utils.Config, firebaseService *data.Service, privacy *PrivacyService) *RetentionService {
+	purged, err := meter.Int64Counter("aptrouter.retention.purged_documents",
+		metric.WithDescription("Request logs deleted or anonymized, and payloads removed, by the retention purger"),
+		metric.WithUnit("{document}"))
+	if err != nil {
+		slog.Warn("Failed to create retention purge counter", "error", err)
+	}
+	return &RetentionService{
+		config:          cfg.Privacy,
+		firebaseService: firebaseService,
+		privacy:         privacy,
+		purged:          purged,
+	}
+}
+
+// Sweep purges every tier's request logs and payloads past their retention. It runs as a
+// scheduled job.
+func (s *RetentionService) Sweep(ctx context.Context) error {
+	tiers, err := s.firebaseService.ListPricingTiers(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, tier := range tiers {
+		logRetention, payloadRetention := s.Retention(tier)
+		if logRetention == 0 && payloadRetention == 0 {
+			continue
+		}
+
+		cursor, err := s.firebaseService.GetRetentionCursor(ctx, tier.ID)
+		if err != nil {
+			slog.Warn("Failed to get retention cursor", "tier_id", tier.ID, "error", err)
+			continue
+		}
+		if logRetention > 0 {
+			s.purgeLogs(ctx, tier.ID, cursor, now.Add(-logRetention))
+		}
+		if payloadRetention > 0 {
+			s.purgePayloads(ctx, tier.ID, cursor, now.Add(-payloadRetention))
+		}
+		if err := s.firebaseService.SetRetentionCursor(ctx, cursor); err != nil {
+			slog.Warn("Failed to store retention cursor", "tier_id", tier.ID, "error", err)
+		}
+	}
+	return nil
+}
+
+// Retention returns how long a tier's request logs and stored payloads are kept; 0 keeps them
+// indefinitely. Payload retention is 0 when the logs themselves go first.
+func (s *RetentionService) Retention(tier *data.PricingTier) (logs, payloads time.Duration) {
+	logs = s.config.RequestLogRetention
+	if tier.LogRetentionDays > 0 {
+		logs = time.Duration(tier.LogRetentionDays) * 24 * time.Hour
+	}
+	payloads = s.config.PayloadRetention
+	if tier.PayloadRetentionDays > 0 {
+		payloads = time.Duration(tier.PayloadRetentionDays) * 24 * time.Hour
+	}
+	if logs > 0 && payloads >= logs {
+		payloads = 0
+	}
+	return logs, payloads
+}
+
+// purgeLogs deletes or anonymizes a tier's logs from the cursor up to cutoff, advancing the cursor
+func (s *RetentionService) purgeLogs(ctx context.Context, tierID string, cursor *data.RetentionCursor, cutoff time.Time) {
+	var purged int
+	var through time.Time
+	var err error
+	action := s.config.RetentionAction
+	if action == utils.RetentionAnonymize {
+		purged, through, err = s.firebaseService.AnonymizeRequestLogs(ctx, tierID, cursor.LogsThrough, cutoff, s.privacy.Pseudonym)
+	} else {
+		action = utils.RetentionDelete
+		purged, through, err = s.firebaseService.DeleteRequestLogs(ctx, tierID, cursor.LogsThrough, cutoff)
+	}
+	cursor.LogsThrough = through
+	// Purged logs have no payloads left to remove
+	if cursor.PayloadsThrough.Before(through) {
+		cursor.PayloadsThrough = through
+	}
+	s.record(ctx, tierID, action, purged, cutoff, err)
+}
+
+// purgePayloads removes the payloads of a tier's logs from the cursor up to cutoff, advancing the
+// cursor
+func (s *RetentionService) purgePayloads(ctx context.Context, tierID string, cursor *data.RetentionCursor, cutoff time.Time) {
+	purged, through, err := s.firebaseService.RemoveRequestPayloads(ctx, tierID, cursor.PayloadsThrough, cutoff)
+	cursor.PayloadsThrough = through
+	s.record(ctx, tierID, "remove_payload", purged, cutoff, err)
+}
+
+// record counts and logs a purge
+func (s *RetentionService) record(ctx context.Context, tierID, action string, purged int, cutoff time.Time, err error) {
+	if s.purged != nil && purged > 0 {
+		s.purged.Add(ctx, int64(purged), metric.WithAttributes(
+			attribute.String("tier_id", tierID),
+			attribute.String("action", action),
+		))
+	}
+	if err != nil {
+		slog.Warn("Failed to purge request logs", "tier_id", tierID, "action", action, "purged", purged, "error", err)
+		return
+	}
+	if purged > 0 {
+		slog.Info("Request logs purged", "tier_id", tierID, "action", action, "purged", purged, "cutoff", cutoff)
+	}
+}
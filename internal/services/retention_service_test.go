@@ -0,0 +1,91 @@
+package services_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	apttesting "github.com/apt-router/api/internal/testing"
+	"github.com/apt-router/api/internal/utils"
+	"github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestLogRetention(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	store := apttesting.NewDatastore(t)
+	apttesting.ApplySeed(t, store, "", services.Seed{
+		"pricing_tiers": {
+			"tier-short":   {"name": "Short", "is_active": true, "log_retention_days": int64(30), "payload_retention_days": int64(7)},
+			"tier-default": {"name": "Default", "is_active": true},
+		},
+	})
+
+	ctx := context.Background()
+	logs := map[string]map[string]interface{}{
+		"short-old":      {"tier_id": "tier-short", "user_id": "user-1", "ip_address": "203.0.113.7", "request_timestamp": now.Add(-40 * day)},
+		"short-payload":  {"tier_id": "tier-short", "user_id": "user-1", "payload": map[string]interface{}{"completion": "hi"}, "request_timestamp": now.Add(-10 * day)},
+		"short-recent":   {"tier_id": "tier-short", "user_id": "user-1", "payload": map[string]interface{}{"completion": "hi"}, "request_timestamp": now.Add(-day)},
+		"default-old":    {"tier_id": "tier-default", "user_id": "user-1", "ip_address": "203.0.113.7", "request_timestamp": now.Add(-100 * day)},
+		"default-recent": {"tier_id": "tier-default", "user_id": "user-1", "request_timestamp": now.Add(-10 * day)},
+	}
+	for id, fields := range logs {
+		_, err := store.DB().Collection("request_logs").Doc(id).Set(ctx, fields)
+		require.NoError(t, err)
+	}
+
+	cfg := &utils.Config{
+		Security: utils.SecurityConfig{APIKeySalt: "test-salt"},
+		Privacy: utils.PrivacyConfig{
+			RequestLogRetention: 90 * day,
+			RetentionAction:     utils.RetentionAnonymize,
+		},
+	}
+	privacy := services.NewPrivacyService(cfg, store, services.NewSharedCache(cache.New(time.Minute, time.Minute), store, false), services.NewAuditService(store))
+	retention := services.NewRetentionService(cfg, store, privacy)
+
+	logRetention, payloadRetention := retention.Retention(&data.PricingTier{LogRetentionDays: 30, PayloadRetentionDays: 7})
+	assert.Equal(t, 30*day, logRetention)
+	assert.Equal(t, 7*day, payloadRetention)
+	logRetention, payloadRetention = retention.Retention(&data.PricingTier{})
+	assert.Equal(t, 90*day, logRetention, "tiers without a retention use the platform's")
+	assert.Zero(t, payloadRetention)
+
+	get := func(id string) map[string]interface{} {
+		doc, err := store.DB().Collection("request_logs").Doc(id).Get(ctx)
+		if err != nil {
+			return nil
+		}
+		return doc.Data()
+	}
+
+	retention.Sweep(ctx)
+
+	// Logs past their tier's retention are anonymized; payloads past theirs are removed
+	assert.Equal(t, privacy.Pseudonym("user-1"), get("short-old")["user_id"])
+	assert.Empty(t, get("short-old")["ip_address"])
+	assert.Equal(t, privacy.Pseudonym("user-1"), get("default-old")["user_id"])
+	assert.Equal(t, "user-1", get("short-payload")["user_id"])
+	assert.NotContains(t, get("short-payload"), "payload")
+	assert.Contains(t, get("short-recent"), "payload")
+	assert.Equal(t, "user-1", get("default-recent")["user_id"])
+
+	cursor, err := store.GetRetentionCursor(ctx, "tier-short")
+	require.NoError(t, err)
+	assert.WithinDuration(t, now.Add(-40*day), cursor.LogsThrough, time.Second)
+	assert.WithinDuration(t, now.Add(-10*day), cursor.PayloadsThrough, time.Second)
+
+	// Deleting picks up where the cursor left off, so logs already purged are not visited again
+	cfg.Privacy.RetentionAction = utils.RetentionDelete
+	cfg.Privacy.RequestLogRetention = 5 * day
+	retention = services.NewRetentionService(cfg, store, privacy)
+	retention.Sweep(ctx)
+
+	assert.NotNil(t, get("default-old"))
+	assert.Nil(t, get("default-recent"))
+	assert.NotNil(t, get("short-payload"), "the tier's own retention still applies")
+}
@@ -0,0 +1,301 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+)
+
+var (
+	// ErrRoutingRuleNotFound is returned when a routing rule does not exist
+	ErrRoutingRuleNotFound = errors.New("routing rule not found")
+	// ErrInvalidRoutingRule is returned when a routing rule's settings are invalid
+	ErrInvalidRoutingRule = errors.New("invalid routing rule")
+)
+
+// routingRefreshInterval bounds how stale the enabled routing rules used for routing can be
+const routingRefreshInterval = time.Minute
+
+// routingTimeLayout is the layout of a routing rule's daily window
+const routingTimeLayout = "15:04"
+
+// RoutingInput is what routing rules are evaluated against
+type RoutingInput struct {
+	Model        string
+	Provider     string
+	PromptTokens int
+	TierID       string
+	Time         time.Time
+}
+
+// RoutingService manages routing rules and routes requests by them
+type RoutingService struct {
+	firebaseService *data.Service
+	modelCatalog    ModelCatalog
+
+	mu       sync.RWMutex
+	enabled  []*data.RoutingRule
+	loadedAt time.Time
+}
+
+// NewRoutingService creates a new routing service
+func NewRoutingService(firebaseService *data.Service, modelCatalog ModelCatalog) *RoutingService {
+	return &RoutingService{
+		firebaseService: firebaseService,
+		modelCatalog:    modelCatalog,
+	}
+}
+
+// Route evaluates the enabled routing rules against a request in order and returns the decision,
+// whose ToModel is the first matching rule's target. Rules whose target the caller's API key or
+// tenant may not use are skipped. It returns nil when no rules are enabled.
+func (s *RoutingService) Route(ctx context.Context, input RoutingInput, requestCtx *RequestContext) *data.RoutingDecision {
+	if s == nil || s.firebaseService == nil || s.firebaseService.DB() == nil {
+		return nil
+	}
+
+	rules, err := s.enabledRules(ctx)
+	if err != nil {
+		// Routing rules never fail a request; the request simply keeps its model
+		requestCtx.Logger.Warn("Failed to load routing rules", "error", err)
+		return nil
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	decision := &data.RoutingDecision{FromModel: input.Model}
+	for _, rule := range rules {
+		evaluation := data.RoutingEvaluation{RuleID: rule.ID}
+		if reason := matchRoutingConditions(rule.Conditions, input); reason != "" {
+			evaluation.Reason = reason
+			decision.Evaluations = append(decision.Evaluations, evaluation)
+			continue
+		}
+
+		evaluation.Matched = true
+		if reason := s.checkTarget(rule.TargetModel, requestCtx); reason != "" {
+			evaluation.Reason = reason
+			decision.Evaluations = append(decision.Evaluations, evaluation)
+			continue
+		}
+
+		decision.Evaluations = append(decision.Evaluations, evaluation)
+		decision.RuleID = rule.ID
+		decision.ToModel = rule.TargetModel
+		break
+	}
+	return decision
+}
+
+// checkTarget returns why a rule's target model cannot serve the request, or "" if it can
+func (s *RoutingService) checkTarget(modelID string, requestCtx *RequestContext) string {
+	modelConfig, err := s.modelCatalog.GetModelConfig(modelID)
+	if err != nil {
+		return "target model " + modelID + " is not available"
+	}
+	if err := requestCtx.Restrictions.CheckModel(modelConfig.ModelID, modelConfig.Provider); err != nil {
+		return err.Error()
+	}
+	if err := requestCtx.Tenant.CheckModel(modelConfig.ModelID); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// matchRoutingConditions returns the first condition a request fails, or "" if it meets them all
+func matchRoutingConditions(conditions data.RoutingConditions, input RoutingInput) string {
+	if conditions.MinPromptTokens > 0 && input.PromptTokens < conditions.MinPromptTokens {
+		return fmt.Sprintf("prompt has %d tokens, fewer than %d", input.PromptTokens, conditions.MinPromptTokens)
+	}
+	if conditions.MaxPromptTokens > 0 && input.PromptTokens > conditions.MaxPromptTokens {
+		return fmt.Sprintf("prompt has %d tokens, more than %d", input.PromptTokens, conditions.MaxPromptTokens)
+	}
+	if len(conditions.TierIDs) > 0 && !slices.Contains(conditions.TierIDs, input.TierID) {
+		return fmt.Sprintf("tier %q does not match", input.TierID)
+	}
+	if len(conditions.Models) > 0 && !slices.ContainsFunc(conditions.Models, func(pattern string) bool {
+		matched, _ := path.Match(pattern, input.Model)
+		return matched
+	}) {
+		return fmt.Sprintf("model %q does not match", input.Model)
+	}
+	if len(conditions.Providers) > 0 && !slices.Contains(conditions.Providers, input.Provider) {
+		return fmt.Sprintf("provider %q does not match", input.Provider)
+	}
+	if conditions.StartTime != "" && conditions.EndTime != "" && !inRoutingWindow(conditions, input.Time) {
+		return "outside " + conditions.StartTime + "-" + conditions.EndTime
+	}
+	return ""
+}
+
+// inRoutingWindow reports whether t falls in a rule's daily window. Windows were validated when
+// the rule was saved; a window that no longer parses never matches.
+func inRoutingWindow(conditions data.RoutingConditions, t time.Time) bool {
+	location := time.UTC
+	if conditions.Timezone != "" {
+		loaded, err := time.LoadLocation(conditions.Timezone)
+		if err != nil {
+			return false
+		}
+		location = loaded
+	}
+	start, err := time.Parse(routingTimeLayout, conditions.StartTime)
+	if err != nil {
+		return false
+	}
+	end, err := time.Parse(routingTimeLayout, conditions.EndTime)
+	if err != nil {
+		return false
+	}
+
+	t = t.In(location)
+	minute := t.Hour()*60 + t.Minute()
+	from, to := start.Hour()*60+start.Minute(), end.Hour()*60+end.Minute()
+	if from <= to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+// enabledRules returns the enabled rules in evaluation order, reloading them once they are stale
+func (s *RoutingService) enabledRules(ctx context.Context) ([]*data.RoutingRule, error) {
+	s.mu.RLock()
+	rules, loadedAt := s.enabled, s.loadedAt
+	s.mu.RUnlock()
+	if time.Since(loadedAt) < routingRefreshInterval {
+		return rules, nil
+	}
+
+	rules, err := s.firebaseService.ListRoutingRules(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.enabled = rules
+	s.loadedAt = time.Now()
+	s.mu.Unlock()
+
+	return rules, nil
+}
+
+// reload forces the next request to reload the enabled routing rules
+func (s *RoutingService) reload() {
+	s.mu.Lock()
+	s.loadedAt = time.Time{}
+	s.mu.Unlock()
+}
+
+// List lists routing rules in evaluation order
+func (s *RoutingService) List(ctx context.Context) ([]*data.RoutingRule, error) {
+	rules, err := s.firebaseService.ListRoutingRules(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	if rules == nil {
+		rules = []*data.RoutingRule{}
+	}
+	return rules, nil
+}
+
+// Get gets a routing rule
+func (s *RoutingService) Get(ctx context.Context, ruleID string) (*data.RoutingRule, error) {
+	rule, err := s.firebaseService.GetRoutingRule(ctx, ruleID)
+	if err != nil {
+		return nil, err
+	}
+	if rule == nil {
+		return nil, ErrRoutingRuleNotFound
+	}
+	return rule, nil
+}
+
+// Create validates and stores a new routing rule
+func (s *RoutingService) Create(ctx context.Context, rule *data.RoutingRule) error {
+	if err := s.validate(rule); err != nil {
+		return err
+	}
+
+	if err := s.firebaseService.CreateRoutingRule(ctx, rule); err != nil {
+		return err
+	}
+	s.reload()
+	return nil
+}
+
+// Update validates and replaces an existing routing rule
+func (s *RoutingService) Update(ctx context.Context, rule *data.RoutingRule) error {
+	current, err := s.Get(ctx, rule.ID)
+	if err != nil {
+		return err
+	}
+	if err := s.validate(rule); err != nil {
+		return err
+	}
+
+	rule.CreatedAt = current.CreatedAt
+	if err := s.firebaseService.UpdateRoutingRule(ctx, rule); err != nil {
+		return err
+	}
+	s.reload()
+	return nil
+}
+
+// Delete deletes a routing rule, returning it as it was
+func (s *RoutingService) Delete(ctx context.Context, ruleID string) (*data.RoutingRule, error) {
+	rule, err := s.Get(ctx, ruleID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.firebaseService.DeleteRoutingRule(ctx, ruleID); err != nil {
+		return nil, err
+	}
+	s.reload()
+	return rule, nil
+}
+
+// validate checks a routing rule's settings
+func (s *RoutingService) validate(rule *data.RoutingRule) error {
+	if _, err := s.modelCatalog.GetModelConfig(rule.TargetModel); err != nil {
+		return fmt.Errorf("%w: unknown target model %s", ErrInvalidRoutingRule, rule.TargetModel)
+	}
+
+	conditions := rule.Conditions
+	if conditions.MinPromptTokens < 0 || conditions.MaxPromptTokens < 0 {
+		return fmt.Errorf("%w: prompt token bounds must not be negative", ErrInvalidRoutingRule)
+	}
+	if conditions.MaxPromptTokens > 0 && conditions.MinPromptTokens > conditions.MaxPromptTokens {
+		return fmt.Errorf("%w: min_prompt_tokens must not exceed max_prompt_tokens", ErrInvalidRoutingRule)
+	}
+	for _, pattern := range conditions.Models {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%w: invalid model pattern %q", ErrInvalidRoutingRule, pattern)
+		}
+	}
+
+	if (conditions.StartTime == "") != (conditions.EndTime == "") {
+		return fmt.Errorf("%w: start_time and end_time must be set together", ErrInvalidRoutingRule)
+	}
+	if conditions.StartTime != "" && conditions.StartTime == conditions.EndTime {
+		return fmt.Errorf("%w: start_time and end_time must differ", ErrInvalidRoutingRule)
+	}
+	for _, value := range []string{conditions.StartTime, conditions.EndTime} {
+		if _, err := time.Parse(routingTimeLayout, value); value != "" && err != nil {
+			return fmt.Errorf("%w: times must be HH:MM, got %q", ErrInvalidRoutingRule, value)
+		}
+	}
+	if conditions.Timezone != "" {
+		if _, err := time.LoadLocation(conditions.Timezone); err != nil {
+			return fmt.Errorf("%w: unknown timezone %q", ErrInvalidRoutingRule, conditions.Timezone)
+		}
+	}
+
+	return nil
+}
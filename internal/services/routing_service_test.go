@@ -0,0 +1,117 @@
+package services_test
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+	apttesting "github.com/apt-router/api/internal/testing"
+	"github.com/apt-router/api/internal/utils"
+	"github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateAppliesRoutingRules(t *testing.T) {
+	cfg := &utils.Config{
+		LLM:      utils.LLMConfig{OpenAIAPIKey: "platform-openai-key"},
+		Timeouts: utils.TimeoutConfig{Provider: 10 * time.Second, Streaming: 10 * time.Second, MaxRequest: time.Minute},
+	}
+
+	store := apttesting.NewDatastore(t)
+	apttesting.ApplySeed(t, store, "", services.Seed{
+		"users": {"user-1": {"email": "user@example.com", "balance_micros": int64(1_000_000), "is_active": true}},
+		"routing_rules": {
+			"enterprise-only": {
+				"name":         "Enterprise to the large model",
+				"order":        0,
+				"enabled":      true,
+				"conditions":   map[string]interface{}{"tier_ids": []interface{}{"enterprise"}},
+				"target_model": "model-large",
+			},
+			"short-prompts": {
+				"name":         "Short prompts to the mini model",
+				"order":        1,
+				"enabled":      true,
+				"conditions":   map[string]interface{}{"max_prompt_tokens": 500, "models": []interface{}{"model-*"}},
+				"target_model": "model-mini",
+			},
+		},
+	})
+
+	catalog := apttesting.NewCatalog(
+		services.ModelConfig{ModelID: "model-v2", Provider: "openai", InputPricePerMillion: 2, OutputPricePerMillion: 4, IsActive: true},
+		services.ModelConfig{ModelID: "model-mini", Provider: "openai", InputPricePerMillion: 1, OutputPricePerMillion: 2, IsActive: true},
+		services.ModelConfig{ModelID: "model-large", Provider: "openai", InputPricePerMillion: 10, OutputPricePerMillion: 20, IsActive: true},
+	)
+
+	sharedCache := services.NewSharedCache(cache.New(time.Minute, time.Minute), store, false)
+	audit := services.NewAuditService(store)
+	routing := services.NewRoutingService(store, catalog)
+	generation := services.NewGenerationService(cfg, store, sharedCache, catalog,
+		services.NewBillingService(cfg, store, sharedCache, audit, services.NewNotificationService(cfg)),
+		services.NewProviderKeyService(cfg, store),
+		services.NewSystemPromptService(store, sharedCache),
+		services.NewTemplateService(store, sharedCache),
+		services.NewExperimentService(store, nil),
+		routing,
+	)
+	llm := apttesting.NewLLMClient(apttesting.Response{Text: "Hello!", InputTokens: 10, OutputTokens: 5})
+	generation.SetClientFactory(llm.Factory())
+
+	ctx := context.Background()
+	req := &services.GenerationRequest{Model: "model-v2", Prompt: "Hi"}
+	_, err := generation.Generate(ctx, req, &services.RequestContext{RequestID: "req-1", UserID: "user-1", Logger: slog.Default()})
+	require.NoError(t, err)
+
+	// The first rule is for another tier, so the second routes the short prompt
+	calls := llm.Calls()
+	require.Len(t, calls, 1)
+	assert.Equal(t, "model-mini", calls[0].ModelID)
+	assert.Equal(t, "model-v2", req.RequestedModel)
+	require.NotNil(t, req.Routing)
+	assert.Equal(t, "short-prompts", req.Routing.RuleID)
+	assert.Equal(t, []data.RoutingEvaluation{
+		{RuleID: "enterprise-only", Reason: `tier "" does not match`},
+		{RuleID: "short-prompts", Matched: true},
+	}, req.Routing.Evaluations)
+
+	t.Run("RestrictedTarget", func(t *testing.T) {
+		// Rules whose target the API key may not use are skipped
+		decision := routing.Route(ctx, services.RoutingInput{Model: "model-v2", Provider: "openai", PromptTokens: 10}, &services.RequestContext{
+			Restrictions: &data.KeyRestrictions{AllowedModels: []string{"model-v2"}},
+			Logger:       slog.Default(),
+		})
+		require.NotNil(t, decision)
+		assert.Empty(t, decision.ToModel)
+		assert.True(t, decision.Evaluations[1].Matched)
+		assert.Equal(t, "model model-mini is not allowed for this API key", decision.Evaluations[1].Reason)
+	})
+
+	t.Run("TimeWindow", func(t *testing.T) {
+		// An overnight window wraps past midnight
+		rule := &data.RoutingRule{
+			Name:        "Overnight batch",
+			Enabled:     true,
+			Order:       -1,
+			Conditions:  data.RoutingConditions{StartTime: "22:00", EndTime: "06:00"},
+			TargetModel: "model-large",
+		}
+		require.NoError(t, routing.Create(ctx, rule))
+
+		input := services.RoutingInput{Model: "model-v2", Provider: "openai", PromptTokens: 10, Time: time.Date(2026, 1, 1, 3, 0, 0, 0, time.UTC)}
+		requestCtx := &services.RequestContext{Logger: slog.Default()}
+		assert.Equal(t, "model-large", routing.Route(ctx, input, requestCtx).ToModel)
+
+		input.Time = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+		decision := routing.Route(ctx, input, requestCtx)
+		assert.Equal(t, "model-mini", decision.ToModel)
+		assert.Equal(t, "outside 22:00-06:00", decision.Evaluations[0].Reason)
+
+		rule.Conditions.EndTime = ""
+		assert.ErrorIs(t, routing.Update(ctx, rule), services.ErrInvalidRoutingRule)
+	})
+}
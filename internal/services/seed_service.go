@@ -0,0 +1,354 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrInvalidSeed is returned when a seed file cannot be applied as written
+var ErrInvalidSeed = errors.New("invalid seed")
+
+// seedCollections lists the collections a seed may declare, with the fields that deactivate a
+// managed document once it is removed from the seed. Seeds never delete documents.
+var seedCollections = map[string]map[string]interface{}{
+	"model_configurations": {"is_active": false},
+	"pricing_tiers":        {"is_active": false},
+	"users":                {"is_active": false},
+	"api_keys":             {"status": "revoked"},
+	"routing_rules":        {"enabled": false},
+}
+
+// Seed is the desired state of the seeded collections: collection name to document ID to fields
+type Seed map[string]map[string]map[string]interface{}
+
+// LoadSeed reads seed files, merging them. Directories contribute their .yaml, .yml and .json
+// files in name order. A document may only be declared once across all files.
+func LoadSeed(paths ...string) (Seed, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			switch filepath.Ext(entry.Name()) {
+			case ".yaml", ".yml", ".json":
+				if !entry.IsDir() {
+					files = append(files, filepath.Join(path, entry.Name()))
+				}
+			}
+		}
+	}
+
+	seed := make(Seed)
+	for _, file := range files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		var parsed map[string]map[string]map[string]interface{}
+		if filepath.Ext(file) == ".json" {
+			decoder := json.NewDecoder(bytes.NewReader(raw))
+			decoder.UseNumber()
+			err = decoder.Decode(&parsed)
+		} else {
+			err = yaml.Unmarshal(raw, &parsed)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidSeed, file, err)
+		}
+
+		for collection, docs := range parsed {
+			if _, ok := seedCollections[collection]; !ok {
+				return nil, fmt.Errorf("%w: %s: unsupported collection %q", ErrInvalidSeed, file, collection)
+			}
+			if seed[collection] == nil {
+				seed[collection] = make(map[string]map[string]interface{})
+			}
+			for id, fields := range docs {
+				if _, ok := seed[collection][id]; ok {
+					return nil, fmt.Errorf("%w: %s: %s/%s is declared more than once", ErrInvalidSeed, file, collection, id)
+				}
+				normalized := make(map[string]interface{}, len(fields))
+				for field, value := range fields {
+					normalized[field] = normalizeSeedValue(value)
+				}
+				seed[collection][id] = normalized
+			}
+		}
+	}
+
+	return seed, nil
+}
+
+// AddModelPrices declares the models of a price list in model_configurations, so seeds keep
+// Firestore on its prices. Seed files may not declare the listed models themselves.
+func (s Seed) AddModelPrices(list *data.ModelPriceList) error {
+	if s["model_configurations"] == nil {
+		s["model_configurations"] = make(map[string]map[string]interface{})
+	}
+	for _, model := range list.Models {
+		if _, ok := s["model_configurations"][model.ModelID]; ok {
+			return fmt.Errorf("%w: model_configurations/%s is in the model price list; change its prices there", ErrInvalidSeed, model.ModelID)
+		}
+		s["model_configurations"][model.ModelID] = model.Document()
+	}
+	return nil
+}
+
+// normalizeSeedValue converts decoded YAML and JSON values to the types Firestore returns, so a
+// seeded value compares equal to its stored copy
+func normalizeSeedValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int:
+		return int64(v)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			out[key] = normalizeSeedValue(item)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = normalizeSeedValue(item)
+		}
+		return out
+	default:
+		return value
+	}
+}
+
+// SeedService diffs seed files against Firestore and applies the difference
+type SeedService struct {
+	firebaseService *data.Service
+	apiKeySalt      string
+}
+
+// NewSeedService creates a new seed service. apiKeySalt hashes the plaintext keys of seeded API keys.
+func NewSeedService(firebaseService *data.Service, apiKeySalt string) *SeedService {
+	return &SeedService{firebaseService: firebaseService, apiKeySalt: apiKeySalt}
+}
+
+// Plan returns the changes that bring Firestore in line with the seed, in collection and
+// document ID order. With prune, managed documents missing from the seed are deactivated.
+func (s *SeedService) Plan(ctx context.Context, seed Seed, prune bool) ([]data.SeedChange, error) {
+	collections := make([]string, 0, len(seedCollections))
+	for collection := range seedCollections {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+
+	var changes []data.SeedChange
+	for _, collection := range collections {
+		desired := seed[collection]
+		if len(desired) == 0 && !prune {
+			continue
+		}
+		if err := s.prepare(collection, desired); err != nil {
+			return nil, err
+		}
+
+		existing, err := s.firebaseService.ListSeedDocuments(ctx, collection)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, planSeedCollection(collection, desired, existing, prune)...)
+	}
+	return changes, nil
+}
+
+// Apply writes planned changes
+func (s *SeedService) Apply(ctx context.Context, changes []data.SeedChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	return s.firebaseService.ApplySeedChanges(ctx, changes)
+}
+
+// prepare validates a collection's seeded documents and fills in derived fields: the document ID,
+// the managed marker and, for API keys, the hash of a plaintext "key"
+func (s *SeedService) prepare(collection string, docs map[string]map[string]interface{}) error {
+	for id, fields := range docs {
+		if id == "" || strings.Contains(id, "/") {
+			return fmt.Errorf("%w: %s: invalid document ID %q", ErrInvalidSeed, collection, id)
+		}
+
+		switch collection {
+		case "model_configurations":
+			for _, field := range []string{"model_id", "provider"} {
+				if value, _ := fields[field].(string); value == "" {
+					return fmt.Errorf("%w: %s/%s: %s is required", ErrInvalidSeed, collection, id, field)
+				}
+			}
+		case "users":
+			if _, ok := fields["balance"]; ok {
+				return fmt.Errorf("%w: %s/%s: set balance_micros, not the legacy balance field", ErrInvalidSeed, collection, id)
+			}
+		case "api_keys":
+			if key, ok := fields["key"].(string); ok {
+				if s.apiKeySalt == "" {
+					return fmt.Errorf("%w: %s/%s: API_KEY_SALT is required to seed plaintext keys", ErrInvalidSeed, collection, id)
+				}
+				delete(fields, "key")
+				fields["key_hash"] = data.HashAPIKey(key, s.apiKeySalt)
+			}
+			if hash, _ := fields["key_hash"].(string); hash == "" {
+				return fmt.Errorf("%w: %s/%s: key or key_hash is required", ErrInvalidSeed, collection, id)
+			}
+			if value, _ := fields["user_id"].(string); value == "" {
+				return fmt.Errorf("%w: %s/%s: user_id is required", ErrInvalidSeed, collection, id)
+			}
+		case "routing_rules":
+			if value, _ := fields["target_model"].(string); value == "" {
+				return fmt.Errorf("%w: %s/%s: target_model is required", ErrInvalidSeed, collection, id)
+			}
+		}
+
+		fields["id"] = id
+		fields[data.SeedManagedField] = data.SeedManagedBy
+	}
+	return nil
+}
+
+// planSeedCollection diffs one collection. Fields the seed does not declare are left alone, so
+// runtime state such as balances and usage export cursors survives re-seeding.
+func planSeedCollection(collection string, desired, existing map[string]map[string]interface{}, prune bool) []data.SeedChange {
+	var changes []data.SeedChange
+
+	for _, id := range sortedKeys(desired) {
+		fields := desired[id]
+		current, ok := existing[id]
+		if !ok {
+			create := make(map[string]interface{}, len(fields)+2)
+			for field, value := range fields {
+				create[field] = value
+			}
+			// Match what the API stamps on documents it creates
+			if _, ok := create["created_at"]; !ok && collection != "model_configurations" && collection != "pricing_tiers" {
+				now := time.Now()
+				create["created_at"] = now
+				if collection == "users" {
+					create["updated_at"] = now
+				}
+			}
+			changes = append(changes, data.SeedChange{Action: data.SeedCreate, Collection: collection, ID: id, Fields: create})
+			continue
+		}
+
+		update := make(map[string]interface{})
+		for field, value := range fields {
+			if stored, ok := current[field]; !ok || !seedValuesEqual(value, stored) {
+				update[field] = value
+			}
+		}
+		if len(update) > 0 {
+			changes = append(changes, data.SeedChange{Action: data.SeedUpdate, Collection: collection, ID: id, Fields: update})
+		}
+	}
+
+	if !prune {
+		return changes
+	}
+
+	deactivate := seedCollections[collection]
+	for _, id := range sortedKeys(existing) {
+		current := existing[id]
+		if _, ok := desired[id]; ok || current[data.SeedManagedField] != data.SeedManagedBy {
+			continue
+		}
+
+		update := make(map[string]interface{})
+		for field, value := range deactivate {
+			if !seedValuesEqual(value, current[field]) {
+				update[field] = value
+			}
+		}
+		if len(update) > 0 {
+			changes = append(changes, data.SeedChange{Action: data.SeedDeactivate, Collection: collection, ID: id, Fields: update})
+		}
+	}
+
+	return changes
+}
+
+// seedValuesEqual compares a seeded value with a stored one. Numbers compare by value, because
+// Firestore returns whole-number doubles as float64 and seeds declare them as integers.
+func seedValuesEqual(seeded, stored interface{}) bool {
+	switch s := seeded.(type) {
+	case int64:
+		switch v := stored.(type) {
+		case int64:
+			return s == v
+		case float64:
+			return float64(s) == v
+		}
+		return false
+	case float64:
+		switch v := stored.(type) {
+		case int64:
+			return s == float64(v)
+		case float64:
+			return s == v
+		}
+		return false
+	case time.Time:
+		v, ok := stored.(time.Time)
+		return ok && s.Equal(v)
+	case map[string]interface{}:
+		v, ok := stored.(map[string]interface{})
+		if !ok || len(s) != len(v) {
+			return false
+		}
+		for key, item := range s {
+			if other, ok := v[key]; !ok || !seedValuesEqual(item, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		v, ok := stored.([]interface{})
+		return ok && slices.EqualFunc(s, v, seedValuesEqual)
+	default:
+		return reflect.DeepEqual(seeded, stored)
+	}
+}
+
+// sortedKeys returns a document map's IDs in order, so plans are stable
+func sortedKeys(docs map[string]map[string]interface{}) []string {
+	keys := make([]string, 0, len(docs))
+	for key := range docs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,120 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSeed(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "models.yaml"), []byte(`
+model_configurations:
+  gpt-4o:
+    model_id: gpt-4o
+    provider: openai
+    input_price_per_million: 5
+    capabilities: {streaming: true}
+`), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tiers.json"), []byte(`{"pricing_tiers": {"tier-1": {"input_markup_percent": 10.5}}}`), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README.md"), []byte("ignored"), 0o600))
+
+	seed, err := LoadSeed(dir)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), seed["model_configurations"]["gpt-4o"]["input_price_per_million"])
+	assert.Equal(t, map[string]interface{}{"streaming": true}, seed["model_configurations"]["gpt-4o"]["capabilities"])
+	assert.Equal(t, 10.5, seed["pricing_tiers"]["tier-1"]["input_markup_percent"])
+
+	t.Run("RejectsDuplicates", func(t *testing.T) {
+		_, err := LoadSeed(dir, filepath.Join(dir, "models.yaml"))
+		assert.True(t, errors.Is(err, ErrInvalidSeed), "got %v", err)
+	})
+
+	t.Run("RejectsUnknownCollections", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "logs.yaml")
+		require.NoError(t, os.WriteFile(path, []byte("request_logs:\n  log-1: {user_id: u}\n"), 0o600))
+		_, err := LoadSeed(path)
+		assert.True(t, errors.Is(err, ErrInvalidSeed), "got %v", err)
+	})
+}
+
+func TestPlanSeedCollection(t *testing.T) {
+	desired := map[string]map[string]interface{}{
+		"gpt-4o":      {"provider": "openai", "input_price_per_million": int64(5), "capabilities": map[string]interface{}{"tools": true}},
+		"new-model":   {"provider": "google"},
+		"unchanged-1": {"provider": "anthropic", "is_active": true},
+	}
+	existing := map[string]map[string]interface{}{
+		"gpt-4o":      {"provider": "openai", "input_price_per_million": 2.5, "capabilities": map[string]interface{}{"tools": true}, "context_window_size": int64(128000)},
+		"unchanged-1": {"provider": "anthropic", "is_active": true},
+		"retired":     {"provider": "openai", "is_active": true, data.SeedManagedField: data.SeedManagedBy},
+		"manual":      {"provider": "openai", "is_active": true},
+	}
+
+	changes := planSeedCollection("model_configurations", desired, existing, false)
+	require.Len(t, changes, 2)
+	assert.Equal(t, data.SeedChange{
+		Action:     data.SeedUpdate,
+		Collection: "model_configurations",
+		ID:         "gpt-4o",
+		Fields:     map[string]interface{}{"input_price_per_million": int64(5)},
+	}, changes[0])
+	assert.Equal(t, data.SeedCreate, changes[1].Action)
+	assert.Equal(t, "new-model", changes[1].ID)
+	assert.NotContains(t, changes[1].Fields, "created_at")
+
+	t.Run("PruneDeactivatesOnlyManagedDocuments", func(t *testing.T) {
+		changes := planSeedCollection("model_configurations", desired, existing, true)
+		require.Len(t, changes, 3)
+		assert.Equal(t, data.SeedChange{
+			Action:     data.SeedDeactivate,
+			Collection: "model_configurations",
+			ID:         "retired",
+			Fields:     map[string]interface{}{"is_active": false},
+		}, changes[2])
+	})
+
+	t.Run("NumbersCompareByValue", func(t *testing.T) {
+		changes := planSeedCollection("pricing_tiers",
+			map[string]map[string]interface{}{"tier-1": {"input_markup_percent": int64(10)}},
+			map[string]map[string]interface{}{"tier-1": {"input_markup_percent": 10.0}},
+			false)
+		assert.Empty(t, changes)
+	})
+}
+
+func TestSeedPrepareHashesAPIKeys(t *testing.T) {
+	service := NewSeedService(nil, "salt")
+	docs := map[string]map[string]interface{}{
+		"dev-key": {"user_id": "test-user-1", "key": "apt-dev"},
+	}
+	require.NoError(t, service.prepare("api_keys", docs))
+	assert.NotContains(t, docs["dev-key"], "key")
+	assert.Equal(t, data.HashAPIKey("apt-dev", "salt"), docs["dev-key"]["key_hash"])
+	assert.Equal(t, data.SeedManagedBy, docs["dev-key"][data.SeedManagedField])
+
+	err := NewSeedService(nil, "").prepare("api_keys", map[string]map[string]interface{}{"k": {"user_id": "u", "key": "apt-dev"}})
+	assert.True(t, errors.Is(err, ErrInvalidSeed), "got %v", err)
+}
+
+func TestSeedAddModelPrices(t *testing.T) {
+	list := data.ModelPrices()
+	seed := Seed{"pricing_tiers": {"tier-1": {"name": "Standard"}}}
+	require.NoError(t, seed.AddModelPrices(list))
+	require.Len(t, seed["model_configurations"], len(list.Models))
+
+	o1 := seed["model_configurations"]["o1-2024-12-17"]
+	assert.Equal(t, "openai", o1["provider"])
+	assert.Equal(t, int64(600), o1["timeout_seconds"])
+	assert.Equal(t, true, o1["is_active"])
+	assert.NotContains(t, o1, "reasoning_price_per_million", "unset optional prices are left to the provider's published rates")
+
+	// Seed files may add unlisted models, but not reprice listed ones
+	seed = Seed{"model_configurations": {"gpt-4o": {"input_price_per_million": 5.0}}}
+	assert.ErrorIs(t, seed.AddModelPrices(list), ErrInvalidSeed)
+}
@@ -0,0 +1,181 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/utils"
+)
+
+// sessionSweepBatch is how many expired sessions the sweep deletes per batch
+const sessionSweepBatch = 100
+
+// SessionService keeps conversations on the server for clients that send only each new message.
+// Every request to a session is sent with the session's history, compressed to fit the context
+// the session may use, and billed like any other request.
+type SessionService struct {
+	config          utils.SessionsConfig
+	firebaseService *data.Service
+	generation      *GenerationService
+}
+
+// NewSessionService creates a new session service
+func NewSessionService(cfg *utils.Config, firebaseService *data.Service, generation *GenerationService) *SessionService {
+	return &SessionService{
+		config:          cfg.Sessions,
+		firebaseService: firebaseService,
+		generation:      generation,
+	}
+}
+
+// SessionRequest is a message sent to a session, prepared for generation with the session's history
+type SessionRequest struct {
+	Session *data.Session
+	Content string
+	// Conversation is what is sent: the session's history, compressed to fit, and the new message
+	Conversation Conversation
+	// Summarized is how many of the session's messages are no longer sent once this request is recorded
+	Summarized int
+}
+
+// Create starts a session for the caller on a model, which may be an alias resolved on each request
+func (s *SessionService) Create(ctx context.Context, requestCtx *RequestContext, model, system string, maxContextTokens int) (*data.Session, error) {
+	modelID, err := s.generation.modelCatalog.ResolveModel(ctx, requestCtx.OrgID, model)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve model %s: %w", model, err)
+	}
+	if _, err := s.generation.modelCatalog.GetModelConfig(modelID); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownModel, model)
+	}
+
+	now := time.Now()
+	session := &data.Session{
+		UserID:           requestCtx.UserID,
+		OrgID:            requestCtx.OrgID,
+		APIKeyID:         requestCtx.APIKeyID,
+		Model:            model,
+		System:           system,
+		MaxContextTokens: maxContextTokens,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+		ExpiresAt:        now.Add(s.config.TTL),
+	}
+	if err := s.firebaseService.CreateSession(ctx, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// Get gets one of the user's sessions. Other users' sessions, and expired ones the sweep has yet
+// to delete, are not found.
+func (s *SessionService) Get(ctx context.Context, userID, sessionID string) (*data.Session, error) {
+	session, err := s.firebaseService.GetSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session.UserID != userID || time.Now().After(session.ExpiresAt) {
+		return nil, data.ErrSessionNotFound
+	}
+	return session, nil
+}
+
+// Messages lists a session's messages, including those no longer sent
+func (s *SessionService) Messages(ctx context.Context, session *data.Session) ([]data.SessionMessage, error) {
+	return s.firebaseService.ListSessionMessages(ctx, session.ID, 0)
+}
+
+// Delete deletes one of the user's sessions and its messages
+func (s *SessionService) Delete(ctx context.Context, userID, sessionID string) error {
+	if _, err := s.Get(ctx, userID, sessionID); err != nil {
+		return err
+	}
+	return s.firebaseService.DeleteSession(ctx, sessionID)
+}
+
+// Prepare sets req up to send content to a session: its prompt is the session's history and
+// content, with the oldest messages summarized when they no longer fit the session's context,
+// and its system instructions the session's, followed by the summary.
+func (s *SessionService) Prepare(ctx context.Context, session *data.Session, content string, req *GenerationRequest, requestCtx *RequestContext) (*SessionRequest, error) {
+	history, err := s.firebaseService.ListSessionMessages(ctx, session.ID, session.SummarizedMessages)
+	if err != nil {
+		return nil, err
+	}
+
+	conversation := Conversation{System: session.System, Summary: session.Summary}
+	for _, message := range history {
+		conversation.Turns = append(conversation.Turns, ConversationTurn{Role: message.Role, Text: message.Content})
+	}
+	conversation.Turns = append(conversation.Turns, ConversationTurn{Role: "user", Text: content})
+
+	limit := session.MaxContextTokens
+	if limit == 0 {
+		limit = s.config.MaxContextTokens
+	}
+	req.Model = session.Model
+	compressed, compression, err := s.generation.CompressConversation(ctx, req, requestCtx, conversation, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Prompt = compressed.Prompt()
+	if system := compressed.SystemPrompt(); system != "" {
+		if req.Extra == nil {
+			req.Extra = make(map[string]interface{})
+		}
+		req.Extra["system"] = system
+	}
+	req.ContextCompression = compression
+
+	prepared := &SessionRequest{
+		Session:      session,
+		Content:      content,
+		Conversation: compressed,
+		Summarized:   session.SummarizedMessages,
+	}
+	if compression != nil {
+		prepared.Summarized += compression.TurnsCompressed
+	}
+	return prepared, nil
+}
+
+// Record adds a prepared request's message and the reply to its session, with any summary made
+// for it. It fails with data.ErrSessionConflict if another request to the session was recorded
+// since this one was prepared; the reply has been generated and billed, but is not kept.
+func (s *SessionService) Record(ctx context.Context, prepared *SessionRequest, reply, requestID string, cost data.MicroUSD) (*data.Session, error) {
+	return s.firebaseService.AppendSessionTurn(ctx, prepared.Session.ID, prepared.Session.MessageCount, data.SessionTurn{
+		Messages: []data.SessionMessage{
+			{Role: "user", Content: prepared.Content, RequestID: requestID},
+			{Role: "assistant", Content: reply, RequestID: requestID},
+		},
+		Summary:            prepared.Conversation.Summary,
+		SummarizedMessages: prepared.Summarized,
+		Cost:               cost,
+	}, s.config.TTL)
+}
+
+// Sweep deletes expired sessions
+func (s *SessionService) Sweep(ctx context.Context) error {
+	for {
+		expired, err := s.firebaseService.ListExpiredSessions(ctx, time.Now(), sessionSweepBatch)
+		if err != nil {
+			return err
+		}
+		for _, sessionID := range expired {
+			if err := s.firebaseService.DeleteSession(ctx, sessionID); err != nil {
+				return err
+			}
+		}
+		if len(expired) > 0 {
+			slog.Info("Deleted expired sessions", "sessions", len(expired))
+		}
+		if len(expired) < sessionSweepBatch {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+)
+
+// shadowOriginal is what the request a shadow request mirrors used and returned
+type shadowOriginal struct {
+	ModelConfig  ModelConfig
+	InputTokens  int
+	OutputTokens int
+	Details      data.TokenDetails
+	Optimization *OptimizationResult
+	Duration     time.Duration
+	Completion   string
+}
+
+// shadowRequest returns the request to mirror to an experiment's shadow model, or nil when the
+// request is not sampled. sent is the request as the caller sent it, before it was resolved.
+func (s *GenerationService) shadowRequest(sent GenerationRequest, req *GenerationRequest, requestCtx *RequestContext) *GenerationRequest {
+	// Test requests cost nothing, so they are not worth comparing
+	if requestCtx.TestMode || req.Shadow || !s.experiments.SampleShadow(req.Experiment) {
+		return nil
+	}
+
+	// Provider keys sent with the request are the caller's; mirrors are paid by the platform
+	sent.OpenAIAPIKey, sent.AnthropicAPIKey, sent.GoogleAPIKey = "", "", ""
+	sent.Model = req.Experiment.Shadow.Model
+	sent.RequestedModel = ""
+	sent.Stream = false
+	sent.Shadow = true
+	sent.Experiment = nil
+	return &sent
+}
+
+// mirrorShadow runs a shadow request in the background and records how it compares with the
+// request it mirrors. The mirrored request runs on the platform's keys and is neither charged
+// to the account nor logged; its provider cost is taken from the experiment's shadow budget.
+func (s *GenerationService) mirrorShadow(ctx context.Context, shadowReq *GenerationRequest, experiment *ExperimentAssignment, original shadowOriginal, requestCtx *RequestContext) {
+	ctx = context.WithoutCancel(ctx)
+	shadowCtx := *requestCtx
+	shadowCtx.Logger = requestCtx.Logger.With("experiment_id", experiment.ExperimentID, "shadow_model", shadowReq.Model)
+	// Mirrors yield provider capacity to live traffic
+	shadowCtx.Priority = PriorityLow
+
+	result := &data.ShadowResult{
+		ExperimentID: experiment.ExperimentID,
+		RequestID:    requestCtx.RequestID,
+		UserID:       requestCtx.UserID,
+		Model:        original.ModelConfig.ModelID,
+		ShadowModel:  shadowReq.Model,
+		InputTokens:  original.InputTokens,
+		OutputTokens: original.OutputTokens,
+		Cost:         providerCost(original.ModelConfig, original.InputTokens, original.OutputTokens, original.Details, original.Optimization),
+		DurationMs:   original.Duration.Milliseconds(),
+	}
+	if experiment.Shadow.StoreResults {
+		result.Completion = original.Completion
+	}
+
+	start := time.Now()
+	generation, err := s.Generate(ctx, shadowReq, &shadowCtx)
+	result.ShadowDurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		shadowCtx.Logger.Warn("Shadow request failed", "error", err)
+		result.Error = err.Error()
+	} else {
+		modelConfig, err := s.modelCatalog.GetModelConfig(shadowReq.Model)
+		if err != nil {
+			modelConfig = ModelConfig{ModelID: shadowReq.Model}
+		}
+		usage := generation.Response.Usage
+		result.ShadowModel = modelConfig.ModelID
+		result.ShadowInputTokens = usage.InputTokens
+		result.ShadowOutputTokens = usage.OutputTokens
+		result.ShadowCost = providerCost(modelConfig, usage.InputTokens, usage.OutputTokens, usage.Details, generation.PromptOptimizationResult)
+		result.OutputMatches = generation.Response.Text == original.Completion
+		if experiment.Shadow.StoreResults {
+			result.ShadowCompletion = generation.Response.Text
+		}
+	}
+
+	if err := s.experiments.RecordShadow(ctx, result); err != nil {
+		shadowCtx.Logger.Warn("Failed to record shadow result", "error", err)
+		return
+	}
+	shadowCtx.Logger.Info("Shadow request mirrored",
+		"model", result.Model,
+		"cost", result.Cost.String(),
+		"shadow_cost", result.ShadowCost.String(),
+		"output_matches", result.OutputMatches)
+}
+
+// providerCost is what a request costs the platform at a model's base prices, without markup
+func providerCost(modelConfig ModelConfig, inputTokens, outputTokens int, details data.TokenDetails, optimization *OptimizationResult) data.MicroUSD {
+	cost := data.ComputeDetailedCost(inputTokens, outputTokens, details, modelConfig.TokenRates(),
+		modelConfig.InputPricePerMillion, modelConfig.OutputPricePerMillion, 0, 0)
+	if optimization != nil {
+		cost.Optimizer = optimization.OptimizerCost
+	}
+	return cost.Total()
+}
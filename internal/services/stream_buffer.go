@@ -0,0 +1,116 @@
+package services
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+)
+
+// StreamBufferSize is the size of the buffers completion streams are read into, larger than
+// providers' chunks so each read takes a whole chunk
+const StreamBufferSize = 4096
+
+// streamBuffers reuses stream read buffers across streams, so a stream allocates none per read
+var streamBuffers = sync.Pool{New: func() any {
+	buf := make([]byte, StreamBufferSize)
+	return &buf
+}}
+
+// GetStreamBuffer returns a pooled buffer of StreamBufferSize bytes to read a stream into. Return
+// it with PutStreamBuffer once nothing refers to its contents.
+func GetStreamBuffer() *[]byte {
+	return streamBuffers.Get().(*[]byte)
+}
+
+// PutStreamBuffer returns a buffer from GetStreamBuffer to the pool; nil is ignored
+func PutStreamBuffer(buf *[]byte) {
+	if buf != nil {
+		streamBuffers.Put(buf)
+	}
+}
+
+// savingsMarker precedes the output tokens the optimizer asks models to report saving
+const savingsMarker = "tokens_saved="
+
+// maxSavingsDigits bounds the digits held back waiting for the rest of a savings estimate
+const maxSavingsDigits = 19
+
+// savingsScanner finds the first savings estimate in a completion as it streams, without keeping
+// the completion: it only carries over a tail that could hold a marker split across chunks
+type savingsScanner struct {
+	carry []byte
+	// found is set once a marker has been seen, and done once its estimate has been read
+	found    bool
+	done     bool
+	estimate int
+}
+
+// Write scans the next chunk of the completion
+func (s *savingsScanner) Write(chunk []byte) {
+	if s.done {
+		return
+	}
+	window := append(s.carry, chunk...)
+
+	idx := bytes.Index(window, []byte(savingsMarker))
+	if idx < 0 {
+		keep := min(len(window), len(savingsMarker)-1)
+		s.carry = append(s.carry[:0], window[len(window)-keep:]...)
+		return
+	}
+	s.found = true
+
+	digits := window[idx+len(savingsMarker):]
+	end := 0
+	for end < len(digits) && digits[end] >= '0' && digits[end] <= '9' {
+		end++
+	}
+	if end == len(digits) && end < maxSavingsDigits {
+		// More digits may follow in the next chunk
+		s.carry = append(s.carry[:0], window[idx:]...)
+		return
+	}
+	s.finish(digits[:end])
+}
+
+// Estimate returns the savings estimate the completion reported, or 0 when it reported none. It is
+// called once the completion has ended, so a marker at its very end is complete.
+func (s *savingsScanner) Estimate() int {
+	if !s.done && s.found {
+		s.finish(s.carry[len(savingsMarker):])
+	}
+	return s.estimate
+}
+
+// finish reads the estimate from the marker's digits
+func (s *savingsScanner) finish(digits []byte) {
+	s.estimate, _ = strconv.Atoi(string(digits))
+	s.done = true
+	s.carry = nil
+}
+
+// countRunes counts the UTF-8 characters in b by their leading bytes, so a character split across
+// chunks is counted once
+func countRunes(b []byte) int {
+	n := 0
+	for _, c := range b {
+		if c&0xC0 != 0x80 {
+			n++
+		}
+	}
+	return n
+}
+
+// runeLen returns the length of the UTF-8 character starting with lead
+func runeLen(lead byte) int {
+	switch {
+	case lead >= 0xF0:
+		return 4
+	case lead >= 0xE0:
+		return 3
+	case lead >= 0xC0:
+		return 2
+	default:
+		return 1
+	}
+}
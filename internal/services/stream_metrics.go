@@ -0,0 +1,63 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// StreamTiming is how long a stream took to produce its first output and to end
+type StreamTiming struct {
+	// TimeToFirstToken is zero when the stream produced no output
+	TimeToFirstToken time.Duration
+	Duration         time.Duration
+}
+
+// streamMetrics records streaming latency by provider and model, so providers can be compared on
+// the time callers wait for the first token
+type streamMetrics struct {
+	timeToFirstToken metric.Float64Histogram
+	duration         metric.Float64Histogram
+}
+
+// streamLatencyBuckets span fast first tokens to long generations, well past the default bucket bounds
+var streamLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 0.75, 1, 1.5, 2, 3, 5, 10, 30, 60, 120, 300, 600}
+
+// newStreamMetrics creates the streaming instruments; instruments that fail to register are skipped
+func newStreamMetrics() *streamMetrics {
+	timeToFirstToken, err := meter.Float64Histogram("aptrouter.stream.time_to_first_token",
+		metric.WithDescription("Time from a streaming request to the provider's first output"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(streamLatencyBuckets...))
+	if err != nil {
+		slog.Warn("Failed to create time to first token histogram", "error", err)
+	}
+	duration, err := meter.Float64Histogram("aptrouter.stream.duration",
+		metric.WithDescription("Time from a streaming request to the end of the provider's stream"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(streamLatencyBuckets...))
+	if err != nil {
+		slog.Warn("Failed to create stream duration histogram", "error", err)
+	}
+	return &streamMetrics{timeToFirstToken: timeToFirstToken, duration: duration}
+}
+
+// record adds a finished stream to the histograms; streams without output have no first token
+func (m *streamMetrics) record(ctx context.Context, modelConfig ModelConfig, timing StreamTiming) {
+	if m == nil {
+		return
+	}
+	attrs := metric.WithAttributes(
+		attribute.String("gen_ai.system", modelConfig.Provider),
+		attribute.String("gen_ai.request.model", modelConfig.ModelID),
+	)
+	if m.timeToFirstToken != nil && timing.TimeToFirstToken > 0 {
+		m.timeToFirstToken.Record(ctx, timing.TimeToFirstToken.Seconds(), attrs)
+	}
+	if m.duration != nil {
+		m.duration.Record(ctx, timing.Duration.Seconds(), attrs)
+	}
+}
@@ -0,0 +1,138 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+)
+
+// ErrSystemPromptTooLong is returned when a managed system prompt exceeds maxSystemPromptLength
+var ErrSystemPromptTooLong = errors.New("system prompt is too long")
+
+const (
+	// maxSystemPromptLength bounds a managed system prompt, in characters
+	maxSystemPromptLength = 20000
+	// systemPromptCacheTTL bounds how long a prompt is served from cache; changes invalidate it immediately
+	systemPromptCacheTTL = 5 * time.Minute
+)
+
+// systemPromptCacheKey returns the cache key for the system prompt of an organization or API key
+func systemPromptCacheKey(scope, ownerID string) string {
+	return fmt.Sprintf("system_prompt:%s:%s", scope, ownerID)
+}
+
+// systemPromptCacheEntry caches a lookup, including the absence of a prompt
+type systemPromptCacheEntry struct {
+	Prompt *data.SystemPrompt `json:"prompt"`
+}
+
+// SystemPromptService manages the system prompts attached to organizations and API keys
+type SystemPromptService struct {
+	firebaseService *data.Service
+	cache           Cache
+}
+
+// NewSystemPromptService creates a new system prompt service
+func NewSystemPromptService(firebaseService *data.Service, cache Cache) *SystemPromptService {
+	return &SystemPromptService{
+		firebaseService: firebaseService,
+		cache:           cache,
+	}
+}
+
+// Get returns the current system prompt for an organization or API key, or nil if none is set
+func (s *SystemPromptService) Get(ctx context.Context, scope, ownerID string) (*data.SystemPrompt, error) {
+	cacheKey := systemPromptCacheKey(scope, ownerID)
+
+	var entry systemPromptCacheEntry
+	if found, err := s.cache.Get(ctx, cacheKey, &entry); err == nil && found {
+		return entry.Prompt, nil
+	}
+
+	prompt, err := s.firebaseService.GetSystemPrompt(ctx, scope, ownerID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Best effort: a failed cache write only costs a lookup on the next request
+	_ = s.cache.Set(ctx, cacheKey, systemPromptCacheEntry{Prompt: prompt}, systemPromptCacheTTL)
+	return prompt, nil
+}
+
+// Set stores a new version of the system prompt for an organization or API key
+func (s *SystemPromptService) Set(ctx context.Context, scope, ownerID, content, updatedBy string) (*data.SystemPrompt, error) {
+	content = strings.TrimSpace(content)
+	if len(content) > maxSystemPromptLength {
+		return nil, fmt.Errorf("%w: must be at most %d characters", ErrSystemPromptTooLong, maxSystemPromptLength)
+	}
+
+	prompt := &data.SystemPrompt{
+		Scope:     scope,
+		OwnerID:   ownerID,
+		Content:   content,
+		UpdatedBy: updatedBy,
+	}
+	if err := s.firebaseService.SetSystemPrompt(ctx, prompt); err != nil {
+		return nil, err
+	}
+
+	if err := s.cache.Invalidate(ctx, systemPromptCacheKey(scope, ownerID)); err != nil {
+		return nil, fmt.Errorf("failed to invalidate cached system prompt: %w", err)
+	}
+	return prompt, nil
+}
+
+// Delete removes the system prompt for an organization or API key
+func (s *SystemPromptService) Delete(ctx context.Context, scope, ownerID string) error {
+	if err := s.firebaseService.DeleteSystemPrompt(ctx, scope, ownerID); err != nil {
+		return err
+	}
+
+	if err := s.cache.Invalidate(ctx, systemPromptCacheKey(scope, ownerID)); err != nil {
+		return fmt.Errorf("failed to invalidate cached system prompt: %w", err)
+	}
+	return nil
+}
+
+// Versions lists every version of the system prompt for an organization or API key, newest first
+func (s *SystemPromptService) Versions(ctx context.Context, scope, ownerID string) ([]*data.SystemPrompt, error) {
+	versions, err := s.firebaseService.ListSystemPromptVersions(ctx, scope, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	if versions == nil {
+		versions = []*data.SystemPrompt{}
+	}
+	return versions, nil
+}
+
+// Resolve returns the system prompts that apply to a request: the organization's prompt first, then the key's
+func (s *SystemPromptService) Resolve(ctx context.Context, orgID, apiKeyID string) ([]*data.SystemPrompt, error) {
+	var prompts []*data.SystemPrompt
+
+	if orgID != "" {
+		prompt, err := s.Get(ctx, data.SystemPromptScopeOrg, orgID)
+		if err != nil {
+			return nil, err
+		}
+		if prompt != nil && prompt.Content != "" {
+			prompts = append(prompts, prompt)
+		}
+	}
+
+	if apiKeyID != "" {
+		prompt, err := s.Get(ctx, data.SystemPromptScopeAPIKey, apiKeyID)
+		if err != nil {
+			return nil, err
+		}
+		if prompt != nil && prompt.Content != "" {
+			prompts = append(prompts, prompt)
+		}
+	}
+
+	return prompts, nil
+}
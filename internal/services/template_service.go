@@ -0,0 +1,310 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+)
+
+var (
+	// ErrTemplateNotFound is returned when a template does not exist or the caller cannot use it
+	ErrTemplateNotFound = errors.New("prompt template not found")
+	// ErrTemplateForbidden is returned when the caller can use a template but not change it
+	ErrTemplateForbidden = errors.New("requires the template owner or an organization owner or admin")
+	// ErrInvalidTemplate is returned when a template's content cannot be stored
+	ErrInvalidTemplate = errors.New("invalid prompt template")
+	// ErrTemplateVariables is returned when a template cannot be rendered from the supplied variables
+	ErrTemplateVariables = errors.New("invalid template variables")
+)
+
+const (
+	// maxTemplateLength bounds a template's content, in characters
+	maxTemplateLength = 100000
+	// templateCacheTTL bounds how long a template is served from cache; changes invalidate it immediately
+	templateCacheTTL = 5 * time.Minute
+)
+
+// templateVariablePattern matches {{name}} placeholders, allowing spaces inside the braces
+var templateVariablePattern = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// templateCacheKey returns the cache key for a template version; version 0 is the current version
+func templateCacheKey(templateID string, version int) string {
+	return fmt.Sprintf("prompt_template:%s:%d", templateID, version)
+}
+
+// TemplateVariables returns the distinct placeholders in content, in order of first use
+func TemplateVariables(content string) []string {
+	variables := []string{}
+	seen := make(map[string]bool)
+	for _, match := range templateVariablePattern.FindAllStringSubmatch(content, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			variables = append(variables, match[1])
+		}
+	}
+	return variables
+}
+
+// RenderTemplate substitutes variables into content. Every placeholder must have a value;
+// values are inserted as-is and are not themselves expanded.
+func RenderTemplate(content string, variables map[string]string) (string, error) {
+	var missing []string
+	for _, name := range TemplateVariables(content) {
+		if _, ok := variables[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("%w: missing %s", ErrTemplateVariables, strings.Join(missing, ", "))
+	}
+
+	return templateVariablePattern.ReplaceAllStringFunc(content, func(placeholder string) string {
+		return variables[templateVariablePattern.FindStringSubmatch(placeholder)[1]]
+	}), nil
+}
+
+// TemplateService manages prompt templates and renders them for generation requests
+type TemplateService struct {
+	firebaseService *data.Service
+	cache           Cache
+}
+
+// NewTemplateService creates a new template service
+func NewTemplateService(firebaseService *data.Service, cache Cache) *TemplateService {
+	return &TemplateService{
+		firebaseService: firebaseService,
+		cache:           cache,
+	}
+}
+
+// Create stores a new template owned by userID, shared with orgID when it is non-empty
+func (s *TemplateService) Create(ctx context.Context, userID, orgID, name, description, content string) (*data.PromptTemplate, error) {
+	if err := validateTemplateContent(content); err != nil {
+		return nil, err
+	}
+	if orgID != "" {
+		if err := s.requireOrgManager(ctx, orgID, userID); err != nil {
+			return nil, err
+		}
+	}
+
+	template := &data.PromptTemplate{
+		Name:        name,
+		Description: description,
+		Content:     content,
+		Variables:   TemplateVariables(content),
+		OwnerID:     userID,
+		OrgID:       orgID,
+		UpdatedBy:   userID,
+	}
+	if err := s.firebaseService.CreatePromptTemplate(ctx, template); err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+// Get returns the current version of a template the user can see, or a pinned version when version is non-zero
+func (s *TemplateService) Get(ctx context.Context, userID, templateID string, version int) (*data.PromptTemplate, error) {
+	template, err := s.load(ctx, templateID, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !s.canView(ctx, template, userID) {
+		return nil, ErrTemplateNotFound
+	}
+	if version == 0 || version == template.Version {
+		return template, nil
+	}
+	return s.load(ctx, templateID, version)
+}
+
+// List lists an organization's templates, or the user's own templates when orgID is empty
+func (s *TemplateService) List(ctx context.Context, userID, orgID string) ([]*data.PromptTemplate, error) {
+	if orgID != "" {
+		if _, err := s.firebaseService.GetOrgMember(ctx, orgID, userID); err != nil {
+			return nil, ErrTemplateNotFound
+		}
+	}
+
+	templates, err := s.firebaseService.ListPromptTemplates(ctx, userID, orgID)
+	if err != nil {
+		return nil, err
+	}
+	if templates == nil {
+		templates = []*data.PromptTemplate{}
+	}
+	return templates, nil
+}
+
+// Update stores a new version of a template
+func (s *TemplateService) Update(ctx context.Context, userID, templateID, description, content string) (*data.PromptTemplate, error) {
+	if err := validateTemplateContent(content); err != nil {
+		return nil, err
+	}
+
+	current, err := s.editable(ctx, userID, templateID)
+	if err != nil {
+		return nil, err
+	}
+
+	template := *current
+	template.Content = content
+	template.Variables = TemplateVariables(content)
+	template.UpdatedBy = userID
+	if description != "" {
+		template.Description = description
+	}
+
+	if err := s.firebaseService.UpdatePromptTemplate(ctx, &template); err != nil {
+		return nil, err
+	}
+	if err := s.cache.Invalidate(ctx, templateCacheKey(templateID, 0)); err != nil {
+		return nil, fmt.Errorf("failed to invalidate cached prompt template: %w", err)
+	}
+	return &template, nil
+}
+
+// Delete removes a template, returning the deleted template
+func (s *TemplateService) Delete(ctx context.Context, userID, templateID string) (*data.PromptTemplate, error) {
+	template, err := s.editable(ctx, userID, templateID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.firebaseService.DeletePromptTemplate(ctx, templateID); err != nil {
+		return nil, err
+	}
+	if err := s.cache.Invalidate(ctx, templateCacheKey(templateID, 0)); err != nil {
+		return nil, fmt.Errorf("failed to invalidate cached prompt template: %w", err)
+	}
+	return template, nil
+}
+
+// Versions lists every version of a template the user can see, newest first
+func (s *TemplateService) Versions(ctx context.Context, userID, templateID string) ([]*data.PromptTemplate, error) {
+	if _, err := s.Get(ctx, userID, templateID, 0); err != nil {
+		return nil, err
+	}
+
+	versions, err := s.firebaseService.ListPromptTemplateVersions(ctx, templateID)
+	if err != nil {
+		return nil, err
+	}
+	if versions == nil {
+		versions = []*data.PromptTemplate{}
+	}
+	return versions, nil
+}
+
+// Render renders a template for a generation request. Personal templates can be used with any of
+// the owner's keys, and organization templates with the organization's keys. version pins a
+// specific version; 0 uses the current version.
+func (s *TemplateService) Render(ctx context.Context, requestCtx *RequestContext, templateID string, version int, variables map[string]string) (*data.PromptTemplate, string, error) {
+	template, err := s.load(ctx, templateID, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	if template.OwnerID != requestCtx.UserID && (template.OrgID == "" || template.OrgID != requestCtx.OrgID) {
+		return nil, "", ErrTemplateNotFound
+	}
+
+	if version != 0 && version != template.Version {
+		template, err = s.load(ctx, templateID, version)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	prompt, err := RenderTemplate(template.Content, variables)
+	if err != nil {
+		return nil, "", err
+	}
+	return template, prompt, nil
+}
+
+// load gets a template version through the cache; version 0 loads the current version
+func (s *TemplateService) load(ctx context.Context, templateID string, version int) (*data.PromptTemplate, error) {
+	cacheKey := templateCacheKey(templateID, version)
+
+	var template data.PromptTemplate
+	if found, err := s.cache.Get(ctx, cacheKey, &template); err == nil && found {
+		return &template, nil
+	}
+
+	var stored *data.PromptTemplate
+	var err error
+	if version == 0 {
+		stored, err = s.firebaseService.GetPromptTemplate(ctx, templateID)
+	} else {
+		stored, err = s.firebaseService.GetPromptTemplateVersion(ctx, templateID, version)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil {
+		return nil, ErrTemplateNotFound
+	}
+
+	// Best effort: a failed cache write only costs a lookup on the next request
+	_ = s.cache.Set(ctx, cacheKey, stored, templateCacheTTL)
+	return stored, nil
+}
+
+// canView reports whether the user owns the template or belongs to its organization
+func (s *TemplateService) canView(ctx context.Context, template *data.PromptTemplate, userID string) bool {
+	if template.OwnerID == userID {
+		return true
+	}
+	if template.OrgID == "" {
+		return false
+	}
+	_, err := s.firebaseService.GetOrgMember(ctx, template.OrgID, userID)
+	return err == nil
+}
+
+// editable loads the current version of a template the user may change: their own, or one
+// shared with an organization they own or administer
+func (s *TemplateService) editable(ctx context.Context, userID, templateID string) (*data.PromptTemplate, error) {
+	template, err := s.Get(ctx, userID, templateID, 0)
+	if err != nil {
+		return nil, err
+	}
+	if template.OwnerID == userID {
+		return template, nil
+	}
+	if err := s.requireOrgManager(ctx, template.OrgID, userID); err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+// requireOrgManager checks that the user is an owner or admin of the organization
+func (s *TemplateService) requireOrgManager(ctx context.Context, orgID, userID string) error {
+	member, err := s.firebaseService.GetOrgMember(ctx, orgID, userID)
+	if errors.Is(err, data.ErrNotOrgMember) {
+		return ErrTemplateForbidden
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check organization membership: %w", err)
+	}
+	if !member.Role.CanManageMembers() {
+		return ErrTemplateForbidden
+	}
+	return nil
+}
+
+// validateTemplateContent checks a template's content before it is stored
+func validateTemplateContent(content string) error {
+	if strings.TrimSpace(content) == "" {
+		return fmt.Errorf("%w: content must not be empty", ErrInvalidTemplate)
+	}
+	if len(content) > maxTemplateLength {
+		return fmt.Errorf("%w: content must be at most %d characters", ErrInvalidTemplate, maxTemplateLength)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/apt-router/api/internal/data"
+)
+
+// ErrContextWindowExceeded is returned when a prompt and its max_tokens do not fit the model's context window
+var ErrContextWindowExceeded = errors.New("request exceeds the model's context window")
+
+// ErrPromptTooLarge is returned for prompts over the server's byte limit, before they are tokenized
+var ErrPromptTooLarge = errors.New("prompt exceeds the maximum size")
+
+// ErrPromptTooLong is returned for prompts over the pricing tier's token limit
+var ErrPromptTooLong = errors.New("prompt exceeds the tier's maximum prompt length")
+
+// ErrTokenCountingUnsupported is returned by a provider tokenizer whose client cannot count tokens
+var ErrTokenCountingUnsupported = errors.New("provider does not support token counting")
+
+// Tokenizer counts the tokens a model reads for a prompt
+type Tokenizer interface {
+	// Name identifies the tokenizer, such as an estimator name, in logs
+	Name() string
+	// CountTokens returns the input tokens modelID uses for the system instructions and prompt
+	CountTokens(ctx context.Context, modelID, system, prompt string) (int, error)
+}
+
+// Estimator is a local tokenizer that estimates a tokenizer's counts from its average number of
+// characters per token on English text, so counting never leaves the process. Its counts are
+// approximations, not the exact counts of the tokenizer it stands in for.
+type Estimator struct {
+	name          string
+	charsPerToken float64
+}
+
+// Estimators the registry counts with. OpenAI's approximate the tiktoken encodings their models
+// use; o200k_base's larger vocabulary encodes English in fewer tokens than cl100k_base.
+var (
+	EstimatorCL100K   = &Estimator{name: "cl100k_estimate", charsPerToken: 4}
+	EstimatorO200K    = &Estimator{name: "o200k_estimate", charsPerToken: 4.2}
+	EstimatorClaude   = &Estimator{name: "claude_estimate", charsPerToken: 3.5}
+	EstimatorGemini   = &Estimator{name: "gemini_estimate", charsPerToken: 4}
+	EstimatorFallback = &Estimator{name: "estimate", charsPerToken: 4}
+)
+
+// openAIO200KModels are the OpenAI model prefixes that use o200k_base; older models use cl100k_base
+var openAIO200KModels = []string{"gpt-4o", "chatgpt-4o", "gpt-4.1", "gpt-4.5", "gpt-5", "o1", "o3", "o4"}
+
+// Name returns the estimator's name
+func (e *Estimator) Name() string {
+	return e.name
+}
+
+// Count estimates the tokens in text
+func (e *Estimator) Count(text string) int {
+	return e.countRunes(utf8.RuneCountInString(text))
+}
+
+// countRunes estimates the tokens in a text of runes characters
+func (e *Estimator) countRunes(runes int) int {
+	return int(math.Ceil(float64(runes) / e.charsPerToken))
+}
+
+// CountTokens estimates the tokens in the system instructions and prompt
+func (e *Estimator) CountTokens(ctx context.Context, modelID, system, prompt string) (int, error) {
+	return e.Count(system) + e.Count(prompt), nil
+}
+
+// openAIEstimator returns the estimator for the tiktoken encoding an OpenAI model uses
+func openAIEstimator(modelID string) *Estimator {
+	for _, prefix := range openAIO200KModels {
+		if strings.HasPrefix(modelID, prefix) {
+			return EstimatorO200K
+		}
+	}
+	return EstimatorCL100K
+}
+
+// providerTokenizer counts tokens with a provider's token counting endpoint through the client the
+// generation path would use, with the platform key
+type providerTokenizer struct {
+	provider  string
+	newClient func(modelID string) (data.LLMClient, error)
+	timeout   time.Duration
+}
+
+func (p *providerTokenizer) Name() string {
+	return p.provider + "_count_tokens"
+}
+
+func (p *providerTokenizer) CountTokens(ctx context.Context, modelID, system, prompt string) (int, error) {
+	client, err := p.newClient(modelID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create %s client: %w", p.provider, err)
+	}
+	counter, ok := client.(data.TokenCounter)
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrTokenCountingUnsupported, p.provider)
+	}
+
+	countCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	params := map[string]interface{}{"prompt": prompt}
+	if system != "" {
+		params["system"] = system
+	}
+	return counter.CountTokens(countCtx, params)
+}
+
+// TokenizerRegistry chooses the tokenizer for each model: one registered for the model itself,
+// then one registered for its provider, then the provider's local estimator
+type TokenizerRegistry struct {
+	mu        sync.RWMutex
+	models    map[string]Tokenizer
+	providers map[string]Tokenizer
+}
+
+// NewTokenizerRegistry creates a registry that counts every model with its local estimator
+func NewTokenizerRegistry() *TokenizerRegistry {
+	return &TokenizerRegistry{
+		models:    make(map[string]Tokenizer),
+		providers: make(map[string]Tokenizer),
+	}
+}
+
+// Register sets the tokenizer for a model
+func (r *TokenizerRegistry) Register(modelID string, tokenizer Tokenizer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.models[modelID] = tokenizer
+}
+
+// RegisterProvider sets the tokenizer for a provider's models that have none of their own
+func (r *TokenizerRegistry) RegisterProvider(provider string, tokenizer Tokenizer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.providers[provider] = tokenizer
+}
+
+// For returns the tokenizer for a model
+func (r *TokenizerRegistry) For(modelConfig ModelConfig) Tokenizer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if tokenizer, ok := r.models[modelConfig.ModelID]; ok {
+		return tokenizer
+	}
+	if tokenizer, ok := r.providers[modelConfig.Provider]; ok {
+		return tokenizer
+	}
+	return EstimatorFor(modelConfig)
+}
+
+// EstimatorFor returns the local estimator for a model
+func EstimatorFor(modelConfig ModelConfig) *Estimator {
+	switch modelConfig.Provider {
+	case "openai":
+		return openAIEstimator(modelConfig.ModelID)
+	case "anthropic":
+		return EstimatorClaude
+	case "google":
+		return EstimatorGemini
+	default:
+		return EstimatorFallback
+	}
+}
+
+// Count returns the input tokens a model uses for the system instructions and prompt. A tokenizer
+// that fails, such as a provider endpoint that is down, falls back to the local estimator.
+func (r *TokenizerRegistry) Count(ctx context.Context, modelConfig ModelConfig, system, prompt string) int {
+	tokenizer := r.For(modelConfig)
+	count, err := tokenizer.CountTokens(ctx, modelConfig.ModelID, system, prompt)
+	if err == nil {
+		return count
+	}
+
+	slog.Warn("Token counting failed, using local estimate",
+		"model", modelConfig.ModelID,
+		"tokenizer", tokenizer.Name(),
+		"error", err)
+	estimator := EstimatorFor(modelConfig)
+	return estimator.Count(system) + estimator.Count(prompt)
+}
+
+// Estimate returns a local estimate of the tokens in text for a model, for counts that are not
+// worth a provider call, such as optimizer savings and output estimates
+func (r *TokenizerRegistry) Estimate(modelConfig ModelConfig, text string) int {
+	if estimator, ok := r.For(modelConfig).(*Estimator); ok {
+		return estimator.Count(text)
+	}
+	return EstimatorFor(modelConfig).Count(text)
+}
+
+// EstimateRunes returns Estimate's count for a text of runes characters, for text that was counted
+// as it streamed rather than kept
+func (r *TokenizerRegistry) EstimateRunes(modelConfig ModelConfig, runes int) int {
+	if estimator, ok := r.For(modelConfig).(*Estimator); ok {
+		return estimator.countRunes(runes)
+	}
+	return EstimatorFor(modelConfig).countRunes(runes)
+}
+
+// CheckContextWindow returns ErrContextWindowExceeded when inputTokens and maxTokens do not fit the
+// model's context window. Models without a configured window are not checked.
+func CheckContextWindow(modelConfig ModelConfig, inputTokens, maxTokens int) error {
+	if modelConfig.ContextWindowSize <= 0 || inputTokens+maxTokens <= modelConfig.ContextWindowSize {
+		return nil
+	}
+	return fmt.Errorf("%w: %d prompt tokens and %d max_tokens exceed %s's %d-token window",
+		ErrContextWindowExceeded, inputTokens, maxTokens, modelConfig.ModelID, modelConfig.ContextWindowSize)
+}
@@ -0,0 +1,74 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingClient is a provider client whose token counting endpoint answers with a fixed count
+type countingClient struct {
+	data.LLMClient
+	tokens int
+	err    error
+}
+
+func (c *countingClient) CountTokens(ctx context.Context, params map[string]interface{}) (int, error) {
+	return c.tokens, c.err
+}
+
+func TestTokenizerRegistry(t *testing.T) {
+	registry := NewTokenizerRegistry()
+
+	for modelID, estimator := range map[string]string{
+		"gpt-4o-mini":   "o200k_estimate",
+		"gpt-4.1":       "o200k_estimate",
+		"o3-mini":       "o200k_estimate",
+		"gpt-4-turbo":   "cl100k_estimate",
+		"gpt-3.5-turbo": "cl100k_estimate",
+	} {
+		assert.Equal(t, estimator, registry.For(ModelConfig{ModelID: modelID, Provider: "openai"}).Name(), modelID)
+	}
+	assert.Equal(t, "claude_estimate", registry.For(ModelConfig{ModelID: "claude-sonnet-4", Provider: "anthropic"}).Name())
+	assert.Equal(t, "gemini_estimate", registry.For(ModelConfig{ModelID: "gemini-2.5-pro", Provider: "google"}).Name())
+
+	claude := ModelConfig{ModelID: "claude-sonnet-4", Provider: "anthropic"}
+	assert.Equal(t, 5, registry.Count(context.Background(), claude, "Be brief.", "Hello"), "9 and 5 characters at 3.5 per token")
+
+	t.Run("ProviderTokenizer", func(t *testing.T) {
+		client := &countingClient{tokens: 42}
+		registry := NewTokenizerRegistry()
+		registry.RegisterProvider("anthropic", &providerTokenizer{
+			provider:  "anthropic",
+			newClient: func(string) (data.LLMClient, error) { return client, nil },
+		})
+
+		assert.Equal(t, 42, registry.Count(context.Background(), claude, "", "Hello"))
+		assert.Equal(t, 2, registry.Estimate(claude, "Hello"), "estimates stay local")
+
+		client.err = errors.New("unavailable")
+		assert.Equal(t, 2, registry.Count(context.Background(), claude, "", "Hello"), "failures fall back to the local estimator")
+	})
+
+	t.Run("ModelOverridesProvider", func(t *testing.T) {
+		registry := NewTokenizerRegistry()
+		registry.RegisterProvider("openai", EstimatorCL100K)
+		registry.Register("gpt-4o", EstimatorO200K)
+		assert.Equal(t, EstimatorO200K, registry.For(ModelConfig{ModelID: "gpt-4o", Provider: "openai"}))
+		assert.Equal(t, EstimatorCL100K, registry.For(ModelConfig{ModelID: "gpt-4o-mini", Provider: "openai"}))
+	})
+}
+
+func TestCheckContextWindow(t *testing.T) {
+	modelConfig := ModelConfig{ModelID: "model", ContextWindowSize: 1000}
+	require.NoError(t, CheckContextWindow(modelConfig, 600, 400))
+
+	err := CheckContextWindow(modelConfig, 601, 400)
+	assert.True(t, errors.Is(err, ErrContextWindowExceeded), "got %v", err)
+
+	assert.NoError(t, CheckContextWindow(ModelConfig{ModelID: "model"}, 1_000_000, 1000), "models without a window are not checked")
+}
@@ -0,0 +1,366 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/utils"
+)
+
+// ErrInvalidUsageExport is returned for usage export settings that can't be used
+var ErrInvalidUsageExport = errors.New("invalid usage export settings")
+
+// usageExportEvent is the webhook event type of http sink deliveries
+const usageExportEvent = "usage.batch"
+
+// usageExportLease bounds how long a replica may export one user's usage before another takes over
+const usageExportLease = 5 * time.Minute
+
+// maxUsageExportBatches bounds how many batches of one user's usage are delivered per export run
+const maxUsageExportBatches = 10
+
+// maxUsageExportBackoff caps the wait before retrying a failing sink
+const maxUsageExportBackoff = time.Hour
+
+// stripeMeterEventsURL is the Stripe API endpoint billing meter events are reported to
+const stripeMeterEventsURL = "https://api.stripe.com/v1/billing/meter_events"
+
+// UsageExportService pushes users' per-request usage to their metering systems. Each user's
+// request logs are read in order after a cursor that only advances once a batch is delivered,
+// so delivery is at least once; every event carries its request log ID for deduplication.
+type UsageExportService struct {
+	config          utils.UsageExportConfig
+	firebaseService *data.Service
+	notifications   *NotificationService
+	vault           *vault
+	httpClient      *http.Client
+}
+
+// NewUsageExportService creates a new usage export service.
+// OpenMeter and Stripe sinks need a vault key to store their API keys.
+func NewUsageExportService(cfg *utils.Config, firebaseService *data.Service, notifications *NotificationService) *UsageExportService {
+	s := &UsageExportService{
+		config:          cfg.UsageExport,
+		firebaseService: firebaseService,
+		notifications:   notifications,
+		httpClient:      &http.Client{Timeout: cfg.Notifications.WebhookTimeout},
+	}
+
+	vault, err := newVault(context.Background(), cfg)
+	if err != nil {
+		slog.Error("Failed to initialize vault, OpenMeter and Stripe usage export disabled", "error", err)
+		return s
+	}
+	s.vault = vault
+
+	return s
+}
+
+// UpdateSettings validates and stores a user's usage export settings. token is a new OpenMeter or
+// Stripe API key; when empty the stored key is kept for the same sink. Newly enabled exports start
+// from now rather than replaying earlier usage.
+func (s *UsageExportService) UpdateSettings(ctx context.Context, userID string, before data.UsageExportSettings, settings *data.UsageExportSettings, token string) error {
+	switch settings.Sink {
+	case data.UsageExportSinkHTTP, data.UsageExportSinkOpenMeter:
+		parsed, err := url.Parse(settings.URL)
+		if err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+			return fmt.Errorf("%w: url must be an absolute https URL", ErrInvalidUsageExport)
+		}
+	case data.UsageExportSinkStripe:
+		if settings.StripeEventName == "" {
+			return fmt.Errorf("%w: stripe_event_name is required for the stripe sink", ErrInvalidUsageExport)
+		}
+		settings.URL = ""
+	case "":
+		if settings.Enabled {
+			return fmt.Errorf("%w: enabled exports need a sink", ErrInvalidUsageExport)
+		}
+	default:
+		return fmt.Errorf("%w: unknown sink %q", ErrInvalidUsageExport, settings.Sink)
+	}
+
+	settings.Token, settings.TokenHint = nil, ""
+	if token != "" {
+		if s.vault == nil {
+			return ErrVaultDisabled
+		}
+		sealed, err := s.vault.Seal(ctx, token, usageExportTokenAAD(userID))
+		if err != nil {
+			return fmt.Errorf("failed to encrypt usage export token: %w", err)
+		}
+		settings.Token, settings.TokenHint = sealed, keyHint(token)
+	} else if settings.Sink == before.Sink {
+		settings.Token, settings.TokenHint = before.Token, before.TokenHint
+	}
+	if (settings.Sink == data.UsageExportSinkOpenMeter || settings.Sink == data.UsageExportSinkStripe) && settings.Token == nil {
+		return fmt.Errorf("%w: the %s sink needs an API token", ErrInvalidUsageExport, settings.Sink)
+	}
+
+	settings.ExportedThrough, settings.ExportedThroughID = before.ExportedThrough, before.ExportedThroughID
+	if settings.Enabled && !before.Enabled {
+		settings.ExportedThrough, settings.ExportedThroughID = time.Now(), ""
+	}
+
+	return s.firebaseService.UpdateUsageExportSettings(ctx, userID, settings)
+}
+
+// Run exports usage every configured interval until ctx is cancelled
+func (s *UsageExportService) Run(ctx context.Context) {
+	if s.config.Interval <= 0 || s.firebaseService == nil || s.firebaseService.DB() == nil {
+		return
+	}
+
+	slog.Info("Starting usage export", "interval", s.config.Interval)
+
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.ExportAll(ctx)
+		}
+	}
+}
+
+// ExportAll exports the pending usage of every user with usage export enabled
+func (s *UsageExportService) ExportAll(ctx context.Context) {
+	userIDs, err := s.firebaseService.ListUsageExportUserIDs(ctx)
+	if err != nil {
+		slog.Warn("Failed to list usage exports", "error", err)
+		return
+	}
+
+	for _, userID := range userIDs {
+		if err := s.exportUser(ctx, userID); err != nil {
+			slog.Warn("Failed to export usage", "user_id", userID, "error", err)
+		}
+	}
+}
+
+// exportUser delivers a user's usage since their export cursor, in batches
+func (s *UsageExportService) exportUser(ctx context.Context, userID string) error {
+	user, claimed, err := s.firebaseService.ClaimUsageExport(ctx, userID, usageExportLease)
+	if err != nil || !claimed {
+		return err
+	}
+	defer func() {
+		if err := s.firebaseService.ReleaseUsageExport(context.WithoutCancel(ctx), userID); err != nil {
+			slog.Warn("Failed to release usage export", "user_id", userID, "error", err)
+		}
+	}()
+
+	settings := user.UsageExport
+	if settings.Failures > 0 && time.Since(settings.LastErrorAt) < usageExportBackoff(s.config.Interval, settings.Failures) {
+		return nil
+	}
+
+	until := time.Now().Add(-s.config.SettleDelay)
+	for range maxUsageExportBatches {
+		logs, err := s.firebaseService.ListRequestLogsForExport(ctx, userID, settings.ExportedThrough, settings.ExportedThroughID, until, s.config.BatchSize)
+		if err != nil {
+			return err
+		}
+		if len(logs) == 0 {
+			return nil
+		}
+
+		if err := s.deliver(ctx, userID, &settings, logs); err != nil {
+			if recordErr := s.firebaseService.RecordUsageExportFailure(ctx, userID, err); recordErr != nil {
+				slog.Warn("Failed to record usage export failure", "user_id", userID, "error", recordErr)
+			}
+			return fmt.Errorf("failed to deliver usage to %s sink: %w", settings.Sink, err)
+		}
+
+		last := logs[len(logs)-1]
+		settings.ExportedThrough, settings.ExportedThroughID = last.ResponseTimestamp, last.ID
+		if err := s.firebaseService.AdvanceUsageExport(ctx, userID, settings.ExportedThrough, settings.ExportedThroughID); err != nil {
+			return err
+		}
+		slog.Info("Usage exported", "user_id", userID, "sink", settings.Sink, "events", len(logs))
+
+		if len(logs) < s.config.BatchSize {
+			return nil
+		}
+	}
+	return nil
+}
+
+// usageExportBackoff returns how long to wait before retrying a sink that has failed failures times
+func usageExportBackoff(interval time.Duration, failures int) time.Duration {
+	backoff := interval
+	for range min(failures, 16) {
+		backoff *= 2
+		if backoff >= maxUsageExportBackoff {
+			return maxUsageExportBackoff
+		}
+	}
+	return backoff
+}
+
+// deliver sends one batch of request logs to the user's sink
+func (s *UsageExportService) deliver(ctx context.Context, userID string, settings *data.UsageExportSettings, logs []*data.RequestLog) error {
+	events := make([]data.UsageEvent, len(logs))
+	for i, log := range logs {
+		events[i] = data.NewUsageEvent(log)
+	}
+
+	if settings.Sink == data.UsageExportSinkHTTP {
+		return s.notifications.SendWebhook(ctx, settings.URL, settings.WebhookSecret, usageExportEvent, map[string]interface{}{
+			"type":    usageExportEvent,
+			"user_id": userID,
+			"events":  events,
+		})
+	}
+
+	if s.vault == nil || settings.Token == nil {
+		return ErrVaultDisabled
+	}
+	token, err := s.vault.Open(ctx, settings.Token, usageExportTokenAAD(userID))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt usage export token: %w", err)
+	}
+	if s.vault.Stale(settings.Token) {
+		if err := s.rewrapToken(ctx, userID); err != nil {
+			slog.Warn("Failed to rewrap usage export token", "user_id", userID, "key_id", settings.Token.KeyID, "error", err)
+		}
+	}
+
+	switch settings.Sink {
+	case data.UsageExportSinkOpenMeter:
+		return s.deliverOpenMeter(ctx, settings.URL, token, events)
+	case data.UsageExportSinkStripe:
+		return s.deliverStripe(ctx, token, settings, events)
+	default:
+		return fmt.Errorf("%w: unknown sink %q", ErrInvalidUsageExport, settings.Sink)
+	}
+}
+
+// RewrapTokens moves every usage export token sealed with the previous vault key, or not yet
+// bound to its user, to the current key. It returns how many tokens were examined.
+func (s *UsageExportService) RewrapTokens(ctx context.Context) (int, error) {
+	if s.vault == nil {
+		return 0, ErrVaultDisabled
+	}
+	userIDs, err := s.firebaseService.ListUsageExportTokenUserIDs(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var errs []error
+	for _, userID := range userIDs {
+		if err := s.rewrapToken(ctx, userID); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", userID, err))
+		}
+	}
+	return len(userIDs), errors.Join(errs...)
+}
+
+// rewrapToken moves a user's usage export token to the current vault key if it is stale
+func (s *UsageExportService) rewrapToken(ctx context.Context, userID string) error {
+	return s.firebaseService.RewrapUsageExportToken(ctx, userID, func(secret *data.SealedSecret) (*data.SealedSecret, error) {
+		if !s.vault.Stale(secret) {
+			return nil, nil
+		}
+		return s.vault.Rewrap(ctx, secret, usageExportTokenAAD(userID))
+	})
+}
+
+// usageExportTokenAAD binds a usage export token's ciphertext to the user it was stored for
+func usageExportTokenAAD(userID string) string {
+	return "usage_export_token:" + userID
+}
+
+// usageCloudEvent is a usage event in the CloudEvents format OpenMeter ingests
+type usageCloudEvent struct {
+	SpecVersion string          `json:"specversion"`
+	ID          string          `json:"id"`
+	Source      string          `json:"source"`
+	Type        string          `json:"type"`
+	Subject     string          `json:"subject"`
+	Time        time.Time       `json:"time"`
+	Data        data.UsageEvent `json:"data"`
+}
+
+// deliverOpenMeter ingests events as one CloudEvents batch; OpenMeter deduplicates them by ID
+func (s *UsageExportService) deliverOpenMeter(ctx context.Context, baseURL, token string, events []data.UsageEvent) error {
+	batch := make([]usageCloudEvent, len(events))
+	for i, event := range events {
+		batch[i] = usageCloudEvent{
+			SpecVersion: "1.0",
+			ID:          event.ID,
+			Source:      "aptrouter",
+			Type:        "aptrouter.usage",
+			Subject:     event.Subject,
+			Time:        event.Timestamp,
+			Data:        event,
+		}
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("failed to marshal usage events: %w", err)
+	}
+
+	return s.post(ctx, strings.TrimRight(baseURL, "/")+"/api/v1/events", "application/cloudevents-batch+json", token, "", body)
+}
+
+// deliverStripe reports each event's total tokens as a meter event for the subject's Stripe
+// customer. Events whose subject has no Stripe customer are skipped. Stripe meter events can't be
+// batched; the request log ID is the idempotency key, so a redelivered batch is not counted twice.
+func (s *UsageExportService) deliverStripe(ctx context.Context, token string, settings *data.UsageExportSettings, events []data.UsageEvent) error {
+	for _, event := range events {
+		customerID := settings.StripeCustomers[event.Subject]
+		if customerID == "" {
+			continue
+		}
+
+		form := url.Values{}
+		form.Set("event_name", settings.StripeEventName)
+		form.Set("identifier", event.ID)
+		form.Set("timestamp", strconv.FormatInt(event.Timestamp.Unix(), 10))
+		form.Set("payload[stripe_customer_id]", customerID)
+		form.Set("payload[value]", strconv.Itoa(event.TotalTokens))
+
+		if err := s.post(ctx, stripeMeterEventsURL, "application/x-www-form-urlencoded", token, event.ID, []byte(form.Encode())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// post sends a usage delivery authenticated with a bearer token
+func (s *UsageExportService) post(ctx context.Context, endpoint, contentType, token, idempotencyKey string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create usage export request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to deliver usage: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("usage sink returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsageExportDeliverOpenMeter(t *testing.T) {
+	var received []usageCloudEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/events", r.URL.Path)
+		assert.Equal(t, "Bearer om_test_token", r.Header.Get("Authorization"))
+		assert.Equal(t, "application/cloudevents-batch+json", r.Header.Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	wrapper, err := data.NewLocalKeyWrapper("test", make([]byte, 32))
+	require.NoError(t, err)
+	vault := &vault{current: wrapper}
+	token, err := vault.Seal(context.Background(), "om_test_token", usageExportTokenAAD("user-1"))
+	require.NoError(t, err)
+
+	service := &UsageExportService{vault: vault, httpClient: server.Client()}
+	settings := &data.UsageExportSettings{Sink: data.UsageExportSinkOpenMeter, URL: server.URL + "/", Token: token}
+	logs := []*data.RequestLog{
+		{ID: "log-1", UserID: "user-1", APIKeyID: "key-1", ModelID: "gpt-4o", TotalTokens: 30, TotalCost: 1200, ResponseTimestamp: time.Unix(1700000000, 0)},
+		{ID: "log-2", UserID: "user-1", APIKeyID: "key-1", TenantID: "acme", ModelID: "gpt-4o", TotalTokens: 12},
+	}
+
+	require.NoError(t, service.deliver(context.Background(), "user-1", settings, logs))
+	require.Len(t, received, 2)
+	assert.Equal(t, "log-1", received[0].ID)
+	assert.Equal(t, "key-1", received[0].Subject)
+	assert.Equal(t, data.MicroUSD(1200), received[0].Data.Cost)
+	assert.Equal(t, "acme", received[1].Subject)
+
+	t.Run("FailedDeliveryIsAnError", func(t *testing.T) {
+		failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}))
+		defer failing.Close()
+
+		settings.URL = failing.URL
+		assert.ErrorContains(t, service.deliver(context.Background(), "user-1", settings, logs), "status 503")
+	})
+}
+
+func TestUsageExportValidation(t *testing.T) {
+	service := &UsageExportService{}
+	ctx := context.Background()
+
+	testCases := []struct {
+		name     string
+		settings data.UsageExportSettings
+	}{
+		{name: "MissingSink", settings: data.UsageExportSettings{Enabled: true}},
+		{name: "UnknownSink", settings: data.UsageExportSettings{Enabled: true, Sink: "kafka"}},
+		{name: "InsecureURL", settings: data.UsageExportSettings{Enabled: true, Sink: data.UsageExportSinkHTTP, URL: "http://example.com/usage"}},
+		{name: "StripeWithoutEventName", settings: data.UsageExportSettings{Enabled: true, Sink: data.UsageExportSinkStripe}},
+		{name: "OpenMeterWithoutToken", settings: data.UsageExportSettings{Enabled: true, Sink: data.UsageExportSinkOpenMeter, URL: "https://openmeter.example.com"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := service.UpdateSettings(ctx, "user-1", data.UsageExportSettings{}, &tc.settings, "")
+			assert.True(t, errors.Is(err, ErrInvalidUsageExport), "got %v", err)
+		})
+	}
+
+	settings := data.UsageExportSettings{Enabled: true, Sink: data.UsageExportSinkStripe, StripeEventName: "tokens"}
+	assert.ErrorIs(t, service.UpdateSettings(ctx, "user-1", data.UsageExportSettings{}, &settings, "sk_test"), ErrVaultDisabled)
+}
+
+func TestUsageExportBackoff(t *testing.T) {
+	assert.Equal(t, time.Minute, usageExportBackoff(30*time.Second, 1))
+	assert.Equal(t, 4*time.Minute, usageExportBackoff(30*time.Second, 3))
+	assert.Equal(t, maxUsageExportBackoff, usageExportBackoff(30*time.Second, 40))
+}
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/utils"
+	"google.golang.org/api/option"
+)
+
+// vault seals secrets with the current key-encryption key and opens secrets sealed with it or
+// with the key it replaced, so the key can be rotated without users re-entering their secrets
+type vault struct {
+	current data.KeyWrapper
+	// previous holds the key being rotated away from, by key ID
+	previous map[string]data.KeyWrapper
+}
+
+// newVault returns the configured vault, or nil when no vault key is configured
+func newVault(ctx context.Context, cfg *utils.Config) (*vault, error) {
+	current, err := newKeyWrapper(ctx, cfg, cfg.Vault.KMSKey, cfg.Vault.MasterKey, cfg.Vault.MasterKeyID)
+	if err != nil || current == nil {
+		return nil, err
+	}
+	v := &vault{current: current, previous: make(map[string]data.KeyWrapper)}
+
+	previous, err := newKeyWrapper(ctx, cfg, cfg.Vault.PreviousKMSKey, cfg.Vault.PreviousMasterKey, cfg.Vault.PreviousMasterKeyID)
+	if err != nil {
+		return nil, fmt.Errorf("previous vault key: %w", err)
+	}
+	if previous != nil {
+		v.previous[previous.KeyID()] = previous
+	}
+
+	return v, nil
+}
+
+// newKeyWrapper returns a Cloud KMS key wrapper for kmsKey, or a local one for the base64
+// masterKey, or nil when neither is set
+func newKeyWrapper(ctx context.Context, cfg *utils.Config, kmsKey, masterKey, masterKeyID string) (data.KeyWrapper, error) {
+	if kmsKey != "" {
+		var opts []option.ClientOption
+		if !cfg.Firebase.UseCLIAuth && cfg.Firebase.ServiceAccountPath != "" {
+			opts = append(opts, option.WithCredentialsFile(cfg.Firebase.ServiceAccountPath))
+		}
+		return data.NewKMSKeyWrapper(ctx, kmsKey, opts...)
+	}
+	if masterKey == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode vault master key: %w", err)
+	}
+	wrapper, err := data.NewLocalKeyWrapper(masterKeyID, key)
+	if err != nil {
+		return nil, err
+	}
+	return wrapper, nil
+}
+
+// Seal encrypts plaintext with the current key, bound to aad
+func (v *vault) Seal(ctx context.Context, plaintext, aad string) (*data.SealedSecret, error) {
+	return data.SealSecret(ctx, v.current, plaintext, aad)
+}
+
+// Open decrypts a secret sealed with the current or previous key
+func (v *vault) Open(ctx context.Context, secret *data.SealedSecret, aad string) (string, error) {
+	wrapper, err := v.wrapperFor(secret)
+	if err != nil {
+		return "", err
+	}
+	return data.OpenSecret(ctx, wrapper, secret, aad)
+}
+
+// Stale reports whether a secret should be rewrapped: it was sealed with the previous key or
+// before secrets were bound to their owner
+func (v *vault) Stale(secret *data.SealedSecret) bool {
+	return secret.KeyID != v.current.KeyID() || !secret.Bound
+}
+
+// Rewrap moves a stale secret to the current key, bound to aad
+func (v *vault) Rewrap(ctx context.Context, secret *data.SealedSecret, aad string) (*data.SealedSecret, error) {
+	wrapper, err := v.wrapperFor(secret)
+	if err != nil {
+		return nil, err
+	}
+	return data.RewrapSecret(ctx, wrapper, v.current, secret, aad)
+}
+
+// wrapperFor returns the key wrapper that sealed secret
+func (v *vault) wrapperFor(secret *data.SealedSecret) (data.KeyWrapper, error) {
+	if secret.KeyID == v.current.KeyID() {
+		return v.current, nil
+	}
+	if wrapper, ok := v.previous[secret.KeyID]; ok {
+		return wrapper, nil
+	}
+	return nil, fmt.Errorf("secret was sealed with key %q, which is neither the current nor the previous vault key", secret.KeyID)
+}
@@ -0,0 +1,90 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+)
+
+// fakeKMS answers Cloud KMS encrypt and decrypt calls by reversing the plaintext
+func fakeKMS(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]string
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+
+		field, result := "plaintext", "ciphertext"
+		if strings.HasSuffix(r.URL.Path, ":decrypt") {
+			field, result = "ciphertext", "plaintext"
+		}
+		input, err := base64.StdEncoding.DecodeString(req[field])
+		require.NoError(t, err)
+		slices.Reverse(input)
+		json.NewEncoder(w).Encode(map[string]string{result: base64.StdEncoding.EncodeToString(input)})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestVault(t *testing.T) {
+	ctx := context.Background()
+	local, err := data.NewLocalKeyWrapper("local-v1", make([]byte, 32))
+	require.NoError(t, err)
+
+	server := fakeKMS(t)
+	kms, err := data.NewKMSKeyWrapper(ctx, "projects/p/locations/global/keyRings/r/cryptoKeys/k",
+		option.WithEndpoint(server.URL), option.WithoutAuthentication(), option.WithHTTPClient(server.Client()))
+	require.NoError(t, err)
+
+	// Rotating from the local master key to KMS
+	v := &vault{current: kms, previous: map[string]data.KeyWrapper{local.KeyID(): local}}
+
+	sealed, err := v.Seal(ctx, "sk-test", providerKeyAAD("user-1", "openai"))
+	require.NoError(t, err)
+	assert.Equal(t, kms.KeyID(), sealed.KeyID)
+	assert.False(t, v.Stale(sealed))
+
+	opened, err := v.Open(ctx, sealed, providerKeyAAD("user-1", "openai"))
+	require.NoError(t, err)
+	assert.Equal(t, "sk-test", opened)
+
+	_, err = v.Open(ctx, sealed, providerKeyAAD("user-1", "anthropic"))
+	assert.Error(t, err, "a secret only opens for the owner it was sealed for")
+
+	t.Run("LegacySecretIsBoundWhenRewrapped", func(t *testing.T) {
+		legacy, err := data.SealSecret(ctx, local, "sk-legacy", "")
+		require.NoError(t, err)
+		legacy.Bound = false
+		require.True(t, v.Stale(legacy))
+
+		opened, err := v.Open(ctx, legacy, providerKeyAAD("user-1", "openai"))
+		require.NoError(t, err)
+		assert.Equal(t, "sk-legacy", opened)
+
+		rewrapped, err := v.Rewrap(ctx, legacy, providerKeyAAD("user-1", "openai"))
+		require.NoError(t, err)
+		assert.True(t, rewrapped.Bound)
+		assert.Equal(t, kms.KeyID(), rewrapped.KeyID)
+		assert.False(t, v.Stale(rewrapped))
+
+		_, err = v.Open(ctx, rewrapped, providerKeyAAD("user-2", "openai"))
+		assert.Error(t, err)
+		opened, err = v.Open(ctx, rewrapped, providerKeyAAD("user-1", "openai"))
+		require.NoError(t, err)
+		assert.Equal(t, "sk-legacy", opened)
+	})
+
+	t.Run("UnknownKeyIsAnError", func(t *testing.T) {
+		_, err := (&vault{current: local}).Open(ctx, sealed, providerKeyAAD("user-1", "openai"))
+		assert.ErrorContains(t, err, "neither the current nor the previous")
+	})
+}
@@ -0,0 +1,63 @@
+package testing
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/apt-router/api/internal/services"
+)
+
+// Catalog is a fixed services.ModelCatalog for tests that do not need the pricing service's
+// Firestore-backed configuration
+type Catalog struct {
+	mu      sync.RWMutex
+	models  map[string]services.ModelConfig
+	aliases map[string]string
+}
+
+// NewCatalog creates a catalog of models, keyed by model ID
+func NewCatalog(models ...services.ModelConfig) *Catalog {
+	c := &Catalog{
+		models:  make(map[string]services.ModelConfig, len(models)),
+		aliases: make(map[string]string),
+	}
+	for _, model := range models {
+		c.models[model.ModelID] = model
+	}
+	return c
+}
+
+// Alias makes alias resolve to modelID
+func (c *Catalog) Alias(alias, modelID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.aliases[alias] = modelID
+}
+
+// GetModelConfig returns the configuration of an active model, as PricingService does
+func (c *Catalog) GetModelConfig(modelID string) (services.ModelConfig, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	config, ok := c.models[modelID]
+	if !ok {
+		return services.ModelConfig{}, fmt.Errorf("model config not found for model ID: %s", modelID)
+	}
+	if !config.IsActive {
+		return services.ModelConfig{}, fmt.Errorf("model is not active: %s", modelID)
+	}
+	return config, nil
+}
+
+// ResolveModel returns the model an alias refers to, or model itself. Aliases are global, so
+// orgID is ignored.
+func (c *Catalog) ResolveModel(ctx context.Context, orgID, model string) (string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if modelID, ok := c.aliases[model]; ok {
+		return modelID, nil
+	}
+	return model, nil
+}
@@ -0,0 +1,38 @@
+package testing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+)
+
+// NewDatastore returns a data.Service backed by an empty in-memory Firestore, closed when the
+// test ends
+func NewDatastore(t testing.TB) *data.Service {
+	t.Helper()
+
+	store, err := data.NewService(&data.FirebaseConfig{ProjectID: "test-project", InMemory: true})
+	if err != nil {
+		t.Fatalf("failed to start in-memory datastore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// ApplySeed writes seed to store as aptrouter-seed apply would, hashing plaintext API keys with
+// salt. Seeds may be loaded with services.LoadSeed or written inline.
+func ApplySeed(t testing.TB, store *data.Service, salt string, seed services.Seed) {
+	t.Helper()
+
+	ctx := context.Background()
+	seeder := services.NewSeedService(store, salt)
+	changes, err := seeder.Plan(ctx, seed, false)
+	if err != nil {
+		t.Fatalf("failed to plan seed: %v", err)
+	}
+	if err := seeder.Apply(ctx, changes); err != nil {
+		t.Fatalf("failed to apply seed: %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+// Package testing provides test doubles for the generation path: a scriptable LLM client, a
+// fixed model catalog and an in-memory Firestore datastore. Import it under another name, such
+// as apttesting, alongside the standard testing package.
+package testing
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/apt-router/api/internal/data"
+	"github.com/apt-router/api/internal/services"
+)
+
+// Response is a scripted provider answer. A non-nil Err fails the call instead.
+type Response struct {
+	Text         string
+	InputTokens  int
+	OutputTokens int
+	// FinishReason defaults to "stop"
+	FinishReason string
+	// Logprobs are returned with the response, and streamed with its first chunk
+	Logprobs []data.TokenLogprob
+	// Details are the cached input and reasoning output tokens included in the counts above
+	Details data.TokenDetails
+	Err     error
+	// StreamErr, when streamed, fails the stream with this error after its text instead of ending it
+	StreamErr error
+}
+
+// Call records one provider call the client served
+type Call struct {
+	ModelID  string
+	Provider string
+	APIKey   string
+	// Endpoint names the provider endpoint the call was routed to; empty is the default endpoint
+	Endpoint string
+	Stream   bool
+	Params   map[string]interface{}
+}
+
+// LLMClient is a fake provider. Calls are answered with queued responses in order and, once the
+// queue is empty, the way data.FakeClient answers; every call is recorded.
+type LLMClient struct {
+	mu        sync.Mutex
+	responses []Response
+	calls     []Call
+}
+
+// NewLLMClient creates a fake provider that answers with responses first
+func NewLLMClient(responses ...Response) *LLMClient {
+	return &LLMClient{responses: responses}
+}
+
+// Queue appends responses to those the client answers with
+func (c *LLMClient) Queue(responses ...Response) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.responses = append(c.responses, responses...)
+}
+
+// Calls returns the calls made so far
+func (c *LLMClient) Calls() []Call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Call(nil), c.calls...)
+}
+
+// Factory returns a client factory for GenerationService.SetClientFactory that serves every
+// model from c, recording which model, provider, key and endpoint each call was routed to
+func (c *LLMClient) Factory() services.ClientFactory {
+	return func(modelID, provider, apiKey string, endpoint *data.Endpoint) (data.LLMClient, error) {
+		client := &routedClient{fake: c, modelID: modelID, provider: provider, apiKey: apiKey}
+		if endpoint != nil {
+			client.endpoint = endpoint.Name
+		}
+		return client, nil
+	}
+}
+
+// next records a call and returns the response to give, or nil to answer as data.FakeClient
+func (c *LLMClient) next(call Call) *Response {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, call)
+	if len(c.responses) == 0 {
+		return nil
+	}
+	response := c.responses[0]
+	c.responses = c.responses[1:]
+	return &response
+}
+
+// routedClient is the data.LLMClient a factory returns for one model
+type routedClient struct {
+	fake     *LLMClient
+	modelID  string
+	provider string
+	apiKey   string
+	endpoint string
+}
+
+func (r *routedClient) call(params map[string]interface{}, stream bool) *Response {
+	recorded := make(map[string]interface{}, len(params))
+	for k, v := range params {
+		recorded[k] = v
+	}
+	return r.fake.next(Call{ModelID: r.modelID, Provider: r.provider, APIKey: r.apiKey, Endpoint: r.endpoint, Stream: stream, Params: recorded})
+}
+
+// GenerateWithParams answers with the next queued response
+func (r *routedClient) GenerateWithParams(ctx context.Context, params map[string]interface{}) (*data.GenerateResponse, error) {
+	response := r.call(params, false)
+	if response == nil {
+		return data.NewFakeClient(r.modelID, r.provider, "").GenerateWithParams(ctx, params)
+	}
+	if response.Err != nil {
+		return nil, response.Err
+	}
+
+	return &data.GenerateResponse{
+		Text:         response.Text,
+		InputTokens:  response.InputTokens,
+		OutputTokens: response.OutputTokens,
+		Usage: &data.UsageInfo{
+			PromptTokens:     response.InputTokens,
+			CompletionTokens: response.OutputTokens,
+			TotalTokens:      response.InputTokens + response.OutputTokens,
+
+			CachedInputTokens:     response.Details.CacheReadTokens,
+			CacheWriteInputTokens: response.Details.CacheWriteTokens,
+			ReasoningTokens:       response.Details.ReasoningTokens,
+		},
+		FinishReason: data.NormalizeFinishReason(finishReason(response)),
+		ModelID:      r.modelID,
+		Provider:     r.provider,
+		Metadata:     map[string]string{"fake": "true"},
+		Logprobs:     response.Logprobs,
+	}, nil
+}
+
+// GenerateStream streams the next queued response a word at a time
+func (r *routedClient) GenerateStream(ctx context.Context, params map[string]interface{}) (*data.StreamResponse, error) {
+	response := r.call(params, true)
+	if response == nil {
+		return data.NewFakeClient(r.modelID, r.provider, "").GenerateStream(ctx, params)
+	}
+	if response.Err != nil {
+		return nil, response.Err
+	}
+
+	return &data.StreamResponse{
+		Stream: &streamReader{
+			chunks:       strings.SplitAfter(response.Text, " "),
+			inputTokens:  response.InputTokens,
+			outputTokens: response.OutputTokens,
+			logprobs:     response.Logprobs,
+			details:      response.Details,
+			finishReason: finishReason(response),
+			err:          response.StreamErr,
+		},
+		Metadata: map[string]string{
+			"provider": r.provider,
+			"model_id": r.modelID,
+			"fake":     "true",
+		},
+	}, nil
+}
+
+func finishReason(response *Response) string {
+	if response.FinishReason == "" {
+		return "stop"
+	}
+	return response.FinishReason
+}
+
+// streamReader streams a scripted response in chunks and reports its usage
+type streamReader struct {
+	chunks       []string
+	pending      string
+	inputTokens  int
+	outputTokens int
+	logprobs     []data.TokenLogprob
+	details      data.TokenDetails
+	finishReason string
+	err          error
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for s.pending == "" {
+		if len(s.chunks) == 0 {
+			if s.err != nil {
+				return 0, s.err
+			}
+			return 0, io.EOF
+		}
+		s.pending, s.chunks = s.chunks[0], s.chunks[1:]
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *streamReader) Close() error {
+	s.chunks, s.pending = nil, ""
+	return nil
+}
+
+// GetUsage returns the scripted usage
+func (s *streamReader) GetUsage() (int, int) {
+	return s.inputTokens, s.outputTokens
+}
+
+// TakeLogprobs returns the scripted logprobs the first time it is called
+func (s *streamReader) TakeLogprobs() []data.TokenLogprob {
+	logprobs := s.logprobs
+	s.logprobs = nil
+	return logprobs
+}
+
+// GetTokenDetails returns the scripted cached input and reasoning tokens
+func (s *streamReader) GetTokenDetails() data.TokenDetails {
+	return s.details
+}
+
+// ProviderFinishReason returns the scripted finish reason, normalized
+func (s *streamReader) ProviderFinishReason() string {
+	return data.NormalizeFinishReason(s.finishReason)
+}
@@ -1,8 +1,19 @@
 package utils
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/spf13/viper"
@@ -11,77 +22,515 @@ import (
 
 // Config holds all configuration for the application
 type Config struct {
-	Server       ServerConfig       `mapstructure:"server"`
-	Firebase     FirebaseConfig     `mapstructure:"firebase"`
-	Cache        CacheConfig        `mapstructure:"cache"`
-	LLM          LLMConfig          `mapstructure:"llm"`
-	Security     SecurityConfig     `mapstructure:"security"`
-	Logging      LoggingConfig      `mapstructure:"logging"`
-	RateLimit    RateLimitConfig    `mapstructure:"rate_limit"`
-	Cost         CostConfig         `mapstructure:"cost"`
-	Optimization OptimizationConfig `mapstructure:"optimization"`
+	Server         ServerConfig         `mapstructure:"server"`
+	Firebase       FirebaseConfig       `mapstructure:"firebase"`
+	Cache          CacheConfig          `mapstructure:"cache"`
+	LLM            LLMConfig            `mapstructure:"llm"`
+	Security       SecurityConfig       `mapstructure:"security"`
+	Logging        LoggingConfig        `mapstructure:"logging"`
+	RateLimit      RateLimitConfig      `mapstructure:"rate_limit"`
+	Cost           CostConfig           `mapstructure:"cost"`
+	Optimization   OptimizationConfig   `mapstructure:"optimization"`
+	Billing        BillingConfig        `mapstructure:"billing"`
+	Tracing        TracingConfig        `mapstructure:"tracing"`
+	Timeouts       TimeoutConfig        `mapstructure:"timeouts"`
+	Vault          VaultConfig          `mapstructure:"vault"`
+	Moderation     ModerationConfig     `mapstructure:"moderation"`
+	Secrets        SecretsConfig        `mapstructure:"secrets"`
+	Notifications  NotificationsConfig  `mapstructure:"notifications"`
+	Credits        CreditsConfig        `mapstructure:"credits"`
+	UsageExport    UsageExportConfig    `mapstructure:"usage_export"`
+	Privacy        PrivacyConfig        `mapstructure:"privacy"`
+	Jobs           JobsConfig           `mapstructure:"jobs"`
+	Sessions       SessionsConfig       `mapstructure:"sessions"`
+	Reconciliation ReconciliationConfig `mapstructure:"reconciliation"`
+	Currency       CurrencyConfig       `mapstructure:"currency"`
+	Chaos          ChaosConfig          `mapstructure:"chaos"`
+	Dev            DevConfig            `mapstructure:"dev"`
+
+	// Secret settings may hold sm:// or file:// references; secretRefs keeps them, by setting
+	// path, so rotated provider keys can be reloaded under secretsMu
+	secretsMu  sync.RWMutex
+	secretRefs map[string]string
+	resolver   *secretResolver
 }
 
 // ServerConfig holds server-related configuration
 type ServerConfig struct {
 	Port int    `mapstructure:"port"`
 	Env  string `mapstructure:"env"`
+	// TrustedProxies lists the proxy IPs or CIDR ranges whose X-Forwarded-For headers are honoured
+	// when determining the client IP. Empty means the connection's remote address is used.
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+	// RemoteIPHeaders lists the headers, in order, that trusted proxies set to the client IP
+	RemoteIPHeaders []string `mapstructure:"remote_ip_headers"`
+	// MaxRequestBodyBytes bounds request bodies; larger requests are rejected with 413
+	MaxRequestBodyBytes int64 `mapstructure:"max_request_body_bytes"`
+	// MaxPromptBytes bounds a generation's prompt and system text, so absurdly large prompts are
+	// rejected before they are tokenized; 0 disables the limit
+	MaxPromptBytes int `mapstructure:"max_prompt_bytes"`
+	// CompressResponses gzip or deflate encodes JSON responses for clients that accept it
+	CompressResponses bool `mapstructure:"compress_responses"`
+	// GRPCPort serves the gRPC API alongside HTTP; 0 disables it
+	GRPCPort int `mapstructure:"grpc_port"`
+	// PromptSunset is the date, as YYYY-MM-DD, after which the deprecated flat prompt field of the
+	// v1 generate endpoints may stop working. It is announced in a Sunset header once set.
+	PromptSunset string `mapstructure:"prompt_sunset"`
 }
 
 // FirebaseConfig holds Firebase configuration
 type FirebaseConfig struct {
 	ProjectID          string `mapstructure:"project_id"`
 	ServiceAccountPath string `mapstructure:"service_account_path"`
-	WebAPIKey          string `mapstructure:"web_api_key"`
+	WebAPIKey          string `mapstructure:"web_api_key" secret:"true"`
 	AuthDomain         string `mapstructure:"auth_domain"`
 	StorageBucket      string `mapstructure:"storage_bucket"`
 	MessagingSenderID  string `mapstructure:"messaging_sender_id"`
 	AppID              string `mapstructure:"app_id"`
 	MeasurementID      string `mapstructure:"measurement_id"`
 	UseCLIAuth         bool   `mapstructure:"use_cli_auth"`
+	// IndexCheck is what happens when composite indexes the API needs are missing at startup: off,
+	// warn or require
+	IndexCheck string `mapstructure:"index_check"`
 }
 
 // CacheConfig holds cache-related configuration
 type CacheConfig struct {
 	DefaultExpiration time.Duration `mapstructure:"default_expiration"`
 	CleanupInterval   time.Duration `mapstructure:"cleanup_interval"`
+	// Shared enables the Firestore-backed L2 cache shared across replicas. It is off by default,
+	// since a single replica gains nothing from it but an extra Firestore read per L1 miss.
+	Shared bool `mapstructure:"shared"`
 }
 
 // LLMConfig holds LLM provider API keys
 type LLMConfig struct {
-	GoogleAPIKey    string `mapstructure:"google_api_key"`
-	OpenAIAPIKey    string `mapstructure:"openai_api_key"`
-	AnthropicAPIKey string `mapstructure:"anthropic_api_key"`
+	GoogleAPIKey    string `mapstructure:"google_api_key" secret:"true"`
+	OpenAIAPIKey    string `mapstructure:"openai_api_key" secret:"true"`
+	AnthropicAPIKey string `mapstructure:"anthropic_api_key" secret:"true"`
+	// GoogleAPIKeys, OpenAIAPIKeys and AnthropicAPIKeys are comma-separated further platform keys,
+	// pooled with the provider's single key to spread its requests across several rate limits
+	GoogleAPIKeys    string `mapstructure:"google_api_keys" secret:"true"`
+	OpenAIAPIKeys    string `mapstructure:"openai_api_keys" secret:"true"`
+	AnthropicAPIKeys string `mapstructure:"anthropic_api_keys" secret:"true"`
+	// KeySelection chooses among a provider's pooled keys: round_robin takes each in turn,
+	// least_loaded takes the key with the fewest requests in flight
+	KeySelection string `mapstructure:"key_selection"`
+	// KeyCooldown takes a pooled key the provider rate limited (429) out of rotation for this long.
+	// Keys it rejects as unauthorized (401/403) stay out until the configured keys change.
+	KeyCooldown time.Duration `mapstructure:"key_cooldown"`
+	// GoogleBaseURL, OpenAIBaseURL and AnthropicBaseURL replace the providers' default API URLs, for
+	// gateway appliances in front of them; empty uses the provider's own
+	GoogleBaseURL    string `mapstructure:"google_base_url"`
+	OpenAIBaseURL    string `mapstructure:"openai_base_url"`
+	AnthropicBaseURL string `mapstructure:"anthropic_base_url"`
+	// GoogleProxy, OpenAIProxy and AnthropicProxy send each provider's calls through an HTTP, HTTPS
+	// or SOCKS5 proxy; empty uses HTTPS_PROXY and NO_PROXY. They may hold proxy credentials, so they
+	// can be given as secret references.
+	GoogleProxy    string `mapstructure:"google_proxy" secret:"true"`
+	OpenAIProxy    string `mapstructure:"openai_proxy" secret:"true"`
+	AnthropicProxy string `mapstructure:"anthropic_proxy" secret:"true"`
+	// ConnectivityCheck is what happens when a provider with a key can't be reached at startup: off
+	// skips the check, warn logs it, require stops the server
+	ConnectivityCheck string `mapstructure:"connectivity_check"`
+	// TokenCounting selects how prompts are counted before a request is sent: local estimates
+	// each model's tokenizer without a network call, provider asks Anthropic's and Gemini's token
+	// counting endpoints and falls back to the local estimate
+	TokenCounting string `mapstructure:"token_counting"`
+	// Endpoints is a JSON array of ProviderEndpoint serving the providers' APIs besides their
+	// default endpoints, such as other regions or Azure OpenAI resources. It may hold API keys, so
+	// it can be given as a secret reference.
+	Endpoints string `mapstructure:"endpoints" secret:"true"`
+	// EndpointStickiness keeps routing a user to the endpoint they last used for this long, while it
+	// stays healthy; 0 routes every request to the fastest endpoint
+	EndpointStickiness time.Duration `mapstructure:"endpoint_stickiness"`
+}
+
+// ProviderEndpoint is an endpoint serving a provider's API. Requests on platform keys are routed
+// to the fastest healthy endpoint of their provider, including the provider's default endpoint.
+type ProviderEndpoint struct {
+	Name     string `json:"name"`
+	Provider string `json:"provider"`
+	BaseURL  string `json:"base_url"`
+	// APIKey replaces the provider's platform key on this endpoint; empty uses the platform key
+	APIKey string `json:"api_key,omitempty"`
+	// AuthHeader sends the key in this header rather than the provider's usual one, e.g. api-key
+	// for Azure OpenAI
+	AuthHeader string `json:"auth_header,omitempty"`
 }
 
+// ProviderEndpoints parses the configured provider endpoints
+func (c LLMConfig) ProviderEndpoints() ([]ProviderEndpoint, error) {
+	if strings.TrimSpace(c.Endpoints) == "" {
+		return nil, nil
+	}
+
+	var endpoints []ProviderEndpoint
+	if err := json.Unmarshal([]byte(c.Endpoints), &endpoints); err != nil {
+		return nil, fmt.Errorf("PROVIDER_ENDPOINTS must be a JSON array of endpoints: %w", err)
+	}
+
+	names := make(map[string]bool)
+	for _, endpoint := range endpoints {
+		switch endpoint.Provider {
+		case "openai", "anthropic", "google":
+		default:
+			return nil, fmt.Errorf("provider endpoint %q has unsupported provider %q", endpoint.Name, endpoint.Provider)
+		}
+		if endpoint.Name == "" || endpoint.Name == DefaultEndpointName || names[endpoint.Provider+"/"+endpoint.Name] {
+			return nil, fmt.Errorf("provider endpoint names must be set, unique per provider and not %q", DefaultEndpointName)
+		}
+		names[endpoint.Provider+"/"+endpoint.Name] = true
+		if parsed, err := url.Parse(endpoint.BaseURL); err != nil || parsed.Scheme != "https" && parsed.Scheme != "http" || parsed.Host == "" {
+			return nil, fmt.Errorf("provider endpoint %q needs an http(s) base_url", endpoint.Name)
+		}
+	}
+	return endpoints, nil
+}
+
+// ProviderNetwork returns the base URL and proxy configured for a provider's API
+func (c LLMConfig) ProviderNetwork(provider string) (baseURL, proxy string) {
+	switch provider {
+	case "google":
+		return c.GoogleBaseURL, c.GoogleProxy
+	case "openai":
+		return c.OpenAIBaseURL, c.OpenAIProxy
+	case "anthropic":
+		return c.AnthropicBaseURL, c.AnthropicProxy
+	default:
+		return "", ""
+	}
+}
+
+// Ways of choosing among a provider's pooled API keys
+const (
+	KeySelectionRoundRobin  = "round_robin"
+	KeySelectionLeastLoaded = "least_loaded"
+)
+
+// DefaultEndpointName names a provider's own endpoint among its configured endpoints
+const DefaultEndpointName = "default"
+
 // SecurityConfig holds security-related configuration
 type SecurityConfig struct {
-	JWTSecret  string `mapstructure:"jwt_secret"`
-	APIKeySalt string `mapstructure:"api_key_salt"`
+	JWTSecret  string `mapstructure:"jwt_secret" secret:"true"`
+	APIKeySalt string `mapstructure:"api_key_salt" secret:"true"`
+	// AdminUserIDs lists the Firebase Auth users allowed to use the platform admin endpoints
+	AdminUserIDs []string `mapstructure:"admin_user_ids"`
+	// APIKeyRotationGracePeriod is how long a rotated API key's old secret keeps working, and the
+	// longest grace period a rotation may ask for
+	APIKeyRotationGracePeriod time.Duration `mapstructure:"api_key_rotation_grace_period"`
+	// APIKeyExpiryWarning is how long before an API key expires its owner is warned
+	APIKeyExpiryWarning time.Duration `mapstructure:"api_key_expiry_warning"`
+	// APIKeyExpirySweepInterval is how often expired keys are deactivated and expiry warnings sent;
+	// 0 disables the sweep
+	APIKeyExpirySweepInterval time.Duration `mapstructure:"api_key_expiry_sweep_interval"`
+	// ImpersonationTokenTTL is how long the tokens admins get to view a user's account as that user
+	// stay valid
+	ImpersonationTokenTTL time.Duration `mapstructure:"impersonation_token_ttl"`
 }
 
 // LoggingConfig holds logging configuration
 type LoggingConfig struct {
 	Level  string `mapstructure:"level"`
 	Format string `mapstructure:"format"`
+	// RequestPayloads stores each request's parameters and completion on its request log, so it can
+	// be replayed. It is off by default, since the logs then hold customer prompts.
+	RequestPayloads bool `mapstructure:"request_payloads"`
+	// SlowRequestThreshold logs requests that take longer than this with a snippet of their
+	// payload; 0 disables slow request logs
+	SlowRequestThreshold time.Duration `mapstructure:"slow_request_threshold"`
+	// SlowRequestSnippetBytes bounds the payload snippet in slow request logs
+	SlowRequestSnippetBytes int `mapstructure:"slow_request_snippet_bytes"`
 }
 
 // RateLimitConfig holds rate limiting configuration
 type RateLimitConfig struct {
 	RequestsPerMinute int `mapstructure:"requests_per_minute"`
 	Burst             int `mapstructure:"burst"`
+	// MaxConcurrentPerKey and MaxConcurrentPerUser bound in-flight generations, including streams;
+	// 0 disables the limit
+	MaxConcurrentPerKey  int `mapstructure:"max_concurrent_per_key"`
+	MaxConcurrentPerUser int `mapstructure:"max_concurrent_per_user"`
+	// QueueSize is how many generations per key or user may wait for a slot once the limit is
+	// reached; further requests are rejected with 429
+	QueueSize int `mapstructure:"queue_size"`
+	// QueueTimeout is how long a queued generation waits for a slot before it is rejected
+	QueueTimeout time.Duration `mapstructure:"queue_timeout"`
+	// Providers holds the request and token budgets of each provider account, keyed by provider.
+	// Budgets apply per replica; providers without one are unlimited.
+	Providers map[string]ProviderRateLimit `mapstructure:"providers"`
+	// ProviderQueueTimeout is the longest a request waits for provider capacity; requests that
+	// would wait longer fail with 429 immediately
+	ProviderQueueTimeout time.Duration `mapstructure:"provider_queue_timeout"`
+	// RepeatedFailureLimit is how many identical generation requests from one API key may fail
+	// with a client error within RepeatedFailureWindow before the request is blocked for
+	// RepeatedFailureBlock; 0 disables blocking
+	RepeatedFailureLimit  int           `mapstructure:"repeated_failure_limit"`
+	RepeatedFailureWindow time.Duration `mapstructure:"repeated_failure_window"`
+	RepeatedFailureBlock  time.Duration `mapstructure:"repeated_failure_block"`
+}
+
+// ProviderRateLimit is a provider's requests- and tokens-per-minute budget; 0 leaves either unlimited
+type ProviderRateLimit struct {
+	RequestsPerMinute int `mapstructure:"requests_per_minute"`
+	TokensPerMinute   int `mapstructure:"tokens_per_minute"`
 }
 
 // CostConfig holds cost-related configuration
 type CostConfig struct {
 	MaxCostPerRequestUSD  float64 `mapstructure:"max_cost_per_request_usd"`
 	DefaultUserBalanceUSD float64 `mapstructure:"default_user_balance_usd"`
+	// MigrateMoneyFields rewrites legacy float64 USD fields as micro-USD at startup
+	MigrateMoneyFields bool `mapstructure:"migrate_money_fields"`
+	// BYOKBillingMode prices requests made with the caller's own provider key: "markup" charges
+	// the tier markup only, "flat" charges BYOKFlatFeeUSD per request
+	BYOKBillingMode string  `mapstructure:"byok_billing_mode"`
+	BYOKFlatFeeUSD  float64 `mapstructure:"byok_flat_fee_usd"`
+	// MissingUsageMode decides how a stream the provider reports no usage for is billed:
+	// "estimate" counts the prompt and completion with the provider's tokenizer estimate, "none"
+	// bills nothing
+	MissingUsageMode string `mapstructure:"missing_usage_mode"`
 }
 
 // OptimizationConfig holds optimization configuration
 type OptimizationConfig struct {
 	Enabled                       bool `mapstructure:"enabled"`
 	FallbackOnOptimizationFailure bool `mapstructure:"fallback_on_optimization_failure"`
+	// MinSavingsPercent is the share of prompt tokens an optimization must save, net of the
+	// optimizer's own cost, for the optimized prompt to be used
+	MinSavingsPercent float64 `mapstructure:"min_savings_percent"`
+	// QualitySampleRate is the fraction of optimized requests also generated from the original
+	// prompt to score how much the optimization changed the response; 0 disables evaluation
+	QualitySampleRate float64 `mapstructure:"quality_sample_rate"`
+	// QualityScorer is "similarity", comparing the two responses' term vectors, or "judge", asking
+	// QualityJudgeModel to rate the optimized response against the original
+	QualityScorer     string `mapstructure:"quality_scorer"`
+	QualityJudgeModel string `mapstructure:"quality_judge_model"`
+	// SummaryMaxTokens is the most tokens the optimizer model writes when it summarizes the oldest
+	// turns of a conversation that has outgrown its context
+	SummaryMaxTokens int `mapstructure:"summary_max_tokens"`
+}
+
+// BillingConfig holds Stripe billing configuration
+type BillingConfig struct {
+	StripeSecretKey     string  `mapstructure:"stripe_secret_key" secret:"true"`
+	StripeWebhookSecret string  `mapstructure:"stripe_webhook_secret" secret:"true"`
+	CheckoutSuccessURL  string  `mapstructure:"checkout_success_url"`
+	CheckoutCancelURL   string  `mapstructure:"checkout_cancel_url"`
+	MinTopUpUSD         float64 `mapstructure:"min_top_up_usd"`
+	MaxTopUpUSD         float64 `mapstructure:"max_top_up_usd"`
+	// AutoTopUpCooldown is the minimum time between automatic top-ups for a user
+	AutoTopUpCooldown time.Duration `mapstructure:"auto_top_up_cooldown"`
+}
+
+// TracingConfig holds OpenTelemetry tracing configuration
+type TracingConfig struct {
+	Enabled     bool   `mapstructure:"enabled"`
+	ServiceName string `mapstructure:"service_name"`
+	// Endpoint is the OTLP/HTTP collector URL; empty uses the exporter's default (localhost:4318)
+	Endpoint string `mapstructure:"endpoint"`
+	Insecure bool   `mapstructure:"insecure"`
+	// SampleRatio is the fraction of new traces to sample; propagated sampling decisions are honoured
+	SampleRatio float64 `mapstructure:"sample_ratio"`
+}
+
+// TimeoutConfig holds provider call timeouts
+type TimeoutConfig struct {
+	// Provider is the default timeout for non-streaming provider calls
+	Provider time.Duration `mapstructure:"provider"`
+	// Streaming is the default timeout for a whole provider stream
+	Streaming time.Duration `mapstructure:"streaming"`
+	// Optimization bounds the prompt optimization call made before generation
+	Optimization time.Duration `mapstructure:"optimization"`
+	// MaxRequest is the longest timeout a model config or request may ask for
+	MaxRequest time.Duration `mapstructure:"max_request"`
+	// StreamHeartbeat is how often an SSE comment is sent while a stream waits for the provider,
+	// so intermediaries keep idle connections open; 0 disables heartbeats
+	StreamHeartbeat time.Duration `mapstructure:"stream_heartbeat"`
+}
+
+// VaultConfig holds the key-encryption key for stored provider keys
+type VaultConfig struct {
+	// KMSKey is the resource name of a Cloud KMS CryptoKey that wraps per-secret data keys. It
+	// takes precedence over MasterKey; with neither set, stored keys are disabled.
+	KMSKey string `mapstructure:"kms_key"`
+	// MasterKey is the base64-encoded 32-byte key that wraps per-secret data keys when no KMS key is set
+	MasterKey string `mapstructure:"master_key" secret:"true"`
+	// MasterKeyID identifies the master key in stored secrets so it can be rotated
+	MasterKeyID string `mapstructure:"master_key_id"`
+
+	// PreviousKMSKey, or PreviousMasterKey and PreviousMasterKeyID, name the key being rotated
+	// away from. Secrets it sealed still open and are rewrapped with the current key when used,
+	// or all at once with aptrouter-admin rewrap-secrets.
+	PreviousKMSKey      string `mapstructure:"previous_kms_key"`
+	PreviousMasterKey   string `mapstructure:"previous_master_key" secret:"true"`
+	PreviousMasterKeyID string `mapstructure:"previous_master_key_id"`
+}
+
+// ModerationConfig holds the content classifier used by tiers with moderation enabled
+type ModerationConfig struct {
+	// Provider is "openai" for the OpenAI moderation endpoint, "http" for a self-hosted
+	// classifier at Endpoint, or empty to disable moderation
+	Provider string `mapstructure:"provider"`
+	Model    string `mapstructure:"model"`
+	Endpoint string `mapstructure:"endpoint"`
+	// APIKey authenticates with the classifier; the OpenAI provider defaults to the OpenAI API key
+	APIKey  string        `mapstructure:"api_key" secret:"true"`
+	Timeout time.Duration `mapstructure:"timeout"`
+	// FailOpen lets requests through when the classifier is unavailable
+	FailOpen bool `mapstructure:"fail_open"`
+}
+
+// NotificationsConfig holds how user notifications such as spend alerts are delivered
+type NotificationsConfig struct {
+	// SMTPHost is the mail server used for email notifications; empty disables email
+	SMTPHost     string `mapstructure:"smtp_host"`
+	SMTPPort     int    `mapstructure:"smtp_port"`
+	SMTPUsername string `mapstructure:"smtp_username"`
+	SMTPPassword string `mapstructure:"smtp_password" secret:"true"`
+	EmailFrom    string `mapstructure:"email_from"`
+	// WebhookTimeout bounds each webhook delivery
+	WebhookTimeout time.Duration `mapstructure:"webhook_timeout"`
+	// AllowPrivateWebhooks lets users' webhooks reach loopback, link-local and private addresses,
+	// for local development; otherwise they are refused so webhooks can't probe internal services
+	AllowPrivateWebhooks bool `mapstructure:"allow_private_webhooks"`
+}
+
+// CreditsConfig holds promotional credit settings
+type CreditsConfig struct {
+	// DefaultExpiry is how long granted credits last when no expiry is given
+	DefaultExpiry time.Duration `mapstructure:"default_expiry"`
+	// ReferralCreditUSD is granted to a user who redeems a referral code
+	ReferralCreditUSD float64 `mapstructure:"referral_credit_usd"`
+	// ReferrerCreditUSD is granted to the user whose referral code was redeemed
+	ReferrerCreditUSD float64 `mapstructure:"referrer_credit_usd"`
+	// MaxReferralRedemptions bounds how many users can redeem one referral code; 0 is unlimited
+	MaxReferralRedemptions int `mapstructure:"max_referral_redemptions"`
+}
+
+// UsageExportConfig holds how users' usage is exported to their metering systems
+type UsageExportConfig struct {
+	// Interval is how often pending usage is exported; 0 disables export on this replica
+	Interval time.Duration `mapstructure:"interval"`
+	// BatchSize bounds how many requests are delivered together
+	BatchSize int `mapstructure:"batch_size"`
+	// SettleDelay is how long after a request completes it is exported, so logs written late
+	// are not skipped by the export cursor
+	SettleDelay time.Duration `mapstructure:"settle_delay"`
+}
+
+// PrivacyConfig holds how users' data exports and account deletions are handled
+type PrivacyConfig struct {
+	// DataExportExpiry is how long a completed data export can be downloaded before it is deleted
+	DataExportExpiry time.Duration `mapstructure:"data_export_expiry"`
+	// DeletionRetention is how long a deleted account's data is kept before it is erased and its
+	// request logs anonymized
+	DeletionRetention time.Duration `mapstructure:"deletion_retention"`
+	// SweepInterval is how often due accounts are purged, expired exports deleted and interrupted
+	// exports retried; 0 disables the sweep
+	SweepInterval time.Duration `mapstructure:"sweep_interval"`
+	// RequestLogRetention is how long request logs are kept for tiers that set no retention of
+	// their own; 0 keeps them indefinitely
+	RequestLogRetention time.Duration `mapstructure:"request_log_retention"`
+	// PayloadRetention is how long stored request payloads are kept for tiers that set no payload
+	// retention of their own; 0 keeps them as long as their request log
+	PayloadRetention time.Duration `mapstructure:"payload_retention"`
+	// RetentionAction is what happens to request logs past their retention: RetentionDelete or
+	// RetentionAnonymize
+	RetentionAction string `mapstructure:"retention_action"`
+	// RetentionInterval is how often request logs past their retention are purged; 0 disables the
+	// purger
+	RetentionInterval time.Duration `mapstructure:"retention_interval"`
+}
+
+// JobsConfig holds how scheduled background jobs are run across replicas
+type JobsConfig struct {
+	// Enabled is whether this replica stands for election to run scheduled jobs
+	Enabled bool `mapstructure:"enabled"`
+	// LeaderLease is how long the elected replica leads without renewing; if it dies, another
+	// replica takes over within it
+	LeaderLease time.Duration `mapstructure:"leader_lease"`
+}
+
+// SessionsConfig holds how conversations kept on the server for session clients are stored
+type SessionsConfig struct {
+	// MaxContextTokens bounds the context of sessions that set no bound of their own; 0 bounds
+	// them by the model's context window alone
+	MaxContextTokens int `mapstructure:"max_context_tokens"`
+	// TTL is how long a session is kept after its last message
+	TTL time.Duration `mapstructure:"ttl"`
+	// SweepInterval is how often expired sessions are deleted; 0 disables the sweep
+	SweepInterval time.Duration `mapstructure:"sweep_interval"`
+}
+
+// ReconciliationConfig holds how the base costs recorded per provider are reconciled against
+// what the providers billed
+type ReconciliationConfig struct {
+	// Interval is how often recorded costs are reconciled; 0 disables the reconciliation
+	Interval time.Duration `mapstructure:"interval"`
+	// LookbackDays is how many days back each reconciliation covers, since provider bills settle late
+	LookbackDays int `mapstructure:"lookback_days"`
+	// A provider's model is flagged for a day when its recorded and billed costs differ by more
+	// than ThresholdPercent of the billed cost and more than MinDifferenceUSD
+	ThresholdPercent float64 `mapstructure:"threshold_percent"`
+	MinDifferenceUSD float64 `mapstructure:"min_difference_usd"`
+	// OpenAIAdminKey reads OpenAI's organization costs API, whose daily costs are imported before
+	// each reconciliation; without it, OpenAI's costs come from uploaded exports
+	OpenAIAdminKey string `mapstructure:"openai_admin_key" secret:"true"`
+}
+
+// CurrencyConfig holds the exchange rates balances, costs and statements may be displayed in other
+// currencies at. Accounting is always in USD.
+type CurrencyConfig struct {
+	// Currencies are the ISO 4217 codes amounts may be displayed in besides USD
+	Currencies []string `mapstructure:"currencies"`
+	// RatesURL serves the latest USD exchange rates in the format of the Frankfurter API, which
+	// publishes the European Central Bank's daily reference rates
+	RatesURL string `mapstructure:"rates_url"`
+	// RefreshInterval is how often the rates are fetched; 0 disables fetching
+	RefreshInterval time.Duration `mapstructure:"refresh_interval"`
+}
+
+// ChaosConfig injects faults into provider calls, so retries, circuit breakers, fallback routing and
+// billing settlement can be exercised in staging. It must not be enabled in production.
+type ChaosConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Seed seeds the fault draws, so a run of requests meets the same faults every time; 0 seeds
+	// from the clock
+	Seed int64 `mapstructure:"seed"`
+	// Providers limits faults to these providers; empty injects them into every provider
+	Providers []string `mapstructure:"providers"`
+	// DelayRate is the fraction of provider calls held back by Delay before they are made
+	DelayRate float64       `mapstructure:"delay_rate"`
+	Delay     time.Duration `mapstructure:"delay"`
+	// ErrorRate is the fraction of provider calls that fail with one of ErrorStatusCodes, picked
+	// at random, without reaching the provider
+	ErrorRate        float64 `mapstructure:"error_rate"`
+	ErrorStatusCodes []int   `mapstructure:"error_status_codes"`
+	// TruncateRate is the fraction of provider streams cut off, as by a dropped connection, after
+	// TruncateAfterBytes bytes
+	TruncateRate       float64 `mapstructure:"truncate_rate"`
+	TruncateAfterBytes int     `mapstructure:"truncate_after_bytes"`
+}
+
+// What happens to request logs past their retention
+const (
+	// RetentionDelete deletes them
+	RetentionDelete = "delete"
+	// RetentionAnonymize keeps them for aggregate usage, with their user pseudonymized and the
+	// client details, metadata and payload removed
+	RetentionAnonymize = "anonymize"
+)
+
+// DevConfig runs the API without cloud dependencies, for local development and CI
+type DevConfig struct {
+	// Enabled serves Firestore from memory and answers generations with fake providers
+	Enabled bool `mapstructure:"enabled"`
+	// FakeResponse is the fake providers' response template; see data.NewFakeClient
+	FakeResponse string `mapstructure:"fake_response"`
+	// SeedPaths are seed files or directories applied to the in-memory datastore at startup
+	SeedPaths []string `mapstructure:"seed_paths"`
 }
 
 // LoadConfig loads configuration from environment variables and config files
@@ -105,6 +554,11 @@ func LoadConfig() (*Config, error) {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
 
+	// Load secrets given as references rather than values
+	if err := config.resolveSecrets(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to load secrets: %w", err)
+	}
+
 	// Validate configuration
 	if err := validateConfig(config); err != nil {
 		return nil, fmt.Errorf("invalid configuration: %w", err)
@@ -118,6 +572,13 @@ func bindEnvVars() {
 	// Server
 	viper.BindEnv("server.port", "PORT")
 	viper.BindEnv("server.env", "ENV")
+	viper.BindEnv("server.trusted_proxies", "TRUSTED_PROXIES")
+	viper.BindEnv("server.remote_ip_headers", "REMOTE_IP_HEADERS")
+	viper.BindEnv("server.max_request_body_bytes", "MAX_REQUEST_BODY_BYTES")
+	viper.BindEnv("server.max_prompt_bytes", "MAX_PROMPT_BYTES")
+	viper.BindEnv("server.compress_responses", "COMPRESS_RESPONSES")
+	viper.BindEnv("server.grpc_port", "GRPC_PORT")
+	viper.BindEnv("server.prompt_sunset", "PROMPT_SUNSET")
 
 	// Firebase
 	viper.BindEnv("firebase.project_id", "FIREBASE_PROJECT_ID")
@@ -129,31 +590,188 @@ func bindEnvVars() {
 	viper.BindEnv("firebase.app_id", "FIREBASE_APP_ID")
 	viper.BindEnv("firebase.measurement_id", "FIREBASE_MEASUREMENT_ID")
 	viper.BindEnv("firebase.use_cli_auth", "FIREBASE_USE_CLI_AUTH")
+	viper.BindEnv("firebase.index_check", "FIRESTORE_INDEX_CHECK")
+
+	// Cache
+	viper.BindEnv("cache.shared", "CACHE_SHARED")
 
 	// LLM API Keys
 	viper.BindEnv("llm.google_api_key", "GOOGLE_API_KEY")
 	viper.BindEnv("llm.openai_api_key", "OPENAI_API_KEY")
 	viper.BindEnv("llm.anthropic_api_key", "ANTHROPIC_API_KEY")
+	viper.BindEnv("llm.google_api_keys", "GOOGLE_API_KEYS")
+	viper.BindEnv("llm.openai_api_keys", "OPENAI_API_KEYS")
+	viper.BindEnv("llm.anthropic_api_keys", "ANTHROPIC_API_KEYS")
+	viper.BindEnv("llm.key_selection", "PROVIDER_KEY_SELECTION")
+	viper.BindEnv("llm.key_cooldown", "PROVIDER_KEY_COOLDOWN")
+	viper.BindEnv("llm.google_base_url", "GOOGLE_BASE_URL")
+	viper.BindEnv("llm.openai_base_url", "OPENAI_BASE_URL")
+	viper.BindEnv("llm.anthropic_base_url", "ANTHROPIC_BASE_URL")
+	viper.BindEnv("llm.google_proxy", "GOOGLE_PROXY")
+	viper.BindEnv("llm.openai_proxy", "OPENAI_PROXY")
+	viper.BindEnv("llm.anthropic_proxy", "ANTHROPIC_PROXY")
+	viper.BindEnv("llm.connectivity_check", "PROVIDER_CONNECTIVITY_CHECK")
+	viper.BindEnv("llm.token_counting", "TOKEN_COUNTING")
+	viper.BindEnv("llm.endpoints", "PROVIDER_ENDPOINTS")
+	viper.BindEnv("llm.endpoint_stickiness", "PROVIDER_ENDPOINT_STICKINESS")
 
 	// Security
 	viper.BindEnv("security.jwt_secret", "JWT_SECRET")
 	viper.BindEnv("security.api_key_salt", "API_KEY_SALT")
+	viper.BindEnv("security.admin_user_ids", "ADMIN_USER_IDS")
+	viper.BindEnv("security.api_key_rotation_grace_period", "API_KEY_ROTATION_GRACE_PERIOD")
+	viper.BindEnv("security.api_key_expiry_warning", "API_KEY_EXPIRY_WARNING")
+	viper.BindEnv("security.api_key_expiry_sweep_interval", "API_KEY_EXPIRY_SWEEP_INTERVAL")
+	viper.BindEnv("security.impersonation_token_ttl", "IMPERSONATION_TOKEN_TTL")
 
 	// Logging
 	viper.BindEnv("logging.level", "LOG_LEVEL")
 	viper.BindEnv("logging.format", "LOG_FORMAT")
+	viper.BindEnv("logging.request_payloads", "LOG_REQUEST_PAYLOADS")
+	viper.BindEnv("logging.slow_request_threshold", "SLOW_REQUEST_THRESHOLD")
+	viper.BindEnv("logging.slow_request_snippet_bytes", "SLOW_REQUEST_SNIPPET_BYTES")
 
 	// Rate Limiting
 	viper.BindEnv("rate_limit.requests_per_minute", "RATE_LIMIT_REQUESTS_PER_MINUTE")
 	viper.BindEnv("rate_limit.burst", "RATE_LIMIT_BURST")
+	viper.BindEnv("rate_limit.max_concurrent_per_key", "MAX_CONCURRENT_PER_KEY")
+	viper.BindEnv("rate_limit.max_concurrent_per_user", "MAX_CONCURRENT_PER_USER")
+	viper.BindEnv("rate_limit.queue_size", "CONCURRENCY_QUEUE_SIZE")
+	viper.BindEnv("rate_limit.queue_timeout", "CONCURRENCY_QUEUE_TIMEOUT")
+	for _, provider := range []string{"openai", "anthropic", "google"} {
+		prefix := strings.ToUpper(provider)
+		viper.BindEnv("rate_limit.providers."+provider+".requests_per_minute", prefix+"_RPM")
+		viper.BindEnv("rate_limit.providers."+provider+".tokens_per_minute", prefix+"_TPM")
+	}
+	viper.BindEnv("rate_limit.provider_queue_timeout", "PROVIDER_QUEUE_TIMEOUT")
+	viper.BindEnv("rate_limit.repeated_failure_limit", "REPEATED_FAILURE_LIMIT")
+	viper.BindEnv("rate_limit.repeated_failure_window", "REPEATED_FAILURE_WINDOW")
+	viper.BindEnv("rate_limit.repeated_failure_block", "REPEATED_FAILURE_BLOCK")
 
 	// Cost
 	viper.BindEnv("cost.max_cost_per_request_usd", "MAX_COST_PER_REQUEST_USD")
 	viper.BindEnv("cost.default_user_balance_usd", "DEFAULT_USER_BALANCE_USD")
+	viper.BindEnv("cost.migrate_money_fields", "MIGRATE_MONEY_FIELDS")
+	viper.BindEnv("cost.byok_billing_mode", "BYOK_BILLING_MODE")
+	viper.BindEnv("cost.byok_flat_fee_usd", "BYOK_FLAT_FEE_USD")
+	viper.BindEnv("cost.missing_usage_mode", "MISSING_USAGE_BILLING")
 
 	// Optimization
 	viper.BindEnv("optimization.enabled", "OPTIMIZATION_ENABLED")
 	viper.BindEnv("optimization.fallback_on_optimization_failure", "OPTIMIZATION_FALLBACK_ON_FAILURE")
+	viper.BindEnv("optimization.min_savings_percent", "OPTIMIZATION_MIN_SAVINGS_PERCENT")
+	viper.BindEnv("optimization.quality_sample_rate", "OPTIMIZATION_QUALITY_SAMPLE_RATE")
+	viper.BindEnv("optimization.quality_scorer", "OPTIMIZATION_QUALITY_SCORER")
+	viper.BindEnv("optimization.quality_judge_model", "OPTIMIZATION_QUALITY_JUDGE_MODEL")
+	viper.BindEnv("optimization.summary_max_tokens", "OPTIMIZATION_SUMMARY_MAX_TOKENS")
+
+	// Billing
+	viper.BindEnv("billing.stripe_secret_key", "STRIPE_SECRET_KEY")
+	viper.BindEnv("billing.stripe_webhook_secret", "STRIPE_WEBHOOK_SECRET")
+	viper.BindEnv("billing.checkout_success_url", "BILLING_CHECKOUT_SUCCESS_URL")
+	viper.BindEnv("billing.checkout_cancel_url", "BILLING_CHECKOUT_CANCEL_URL")
+	viper.BindEnv("billing.min_top_up_usd", "BILLING_MIN_TOP_UP_USD")
+	viper.BindEnv("billing.max_top_up_usd", "BILLING_MAX_TOP_UP_USD")
+	viper.BindEnv("billing.auto_top_up_cooldown", "BILLING_AUTO_TOP_UP_COOLDOWN")
+
+	// Tracing
+	viper.BindEnv("tracing.enabled", "TRACING_ENABLED")
+	viper.BindEnv("tracing.service_name", "OTEL_SERVICE_NAME")
+	viper.BindEnv("tracing.endpoint", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "OTEL_EXPORTER_OTLP_ENDPOINT")
+	viper.BindEnv("tracing.insecure", "TRACING_INSECURE")
+	viper.BindEnv("tracing.sample_ratio", "TRACING_SAMPLE_RATIO")
+
+	// Timeouts
+	viper.BindEnv("timeouts.provider", "PROVIDER_TIMEOUT")
+	viper.BindEnv("timeouts.streaming", "STREAMING_TIMEOUT")
+	viper.BindEnv("timeouts.optimization", "OPTIMIZATION_TIMEOUT")
+	viper.BindEnv("timeouts.max_request", "MAX_REQUEST_TIMEOUT")
+	viper.BindEnv("timeouts.stream_heartbeat", "STREAM_HEARTBEAT_INTERVAL")
+
+	// Vault
+	viper.BindEnv("vault.master_key", "BYOK_MASTER_KEY")
+	viper.BindEnv("vault.master_key_id", "BYOK_MASTER_KEY_ID")
+	viper.BindEnv("vault.kms_key", "BYOK_KMS_KEY")
+	viper.BindEnv("vault.previous_kms_key", "BYOK_PREVIOUS_KMS_KEY")
+	viper.BindEnv("vault.previous_master_key", "BYOK_PREVIOUS_MASTER_KEY")
+	viper.BindEnv("vault.previous_master_key_id", "BYOK_PREVIOUS_MASTER_KEY_ID")
+
+	// Moderation
+	viper.BindEnv("moderation.provider", "MODERATION_PROVIDER")
+	viper.BindEnv("moderation.model", "MODERATION_MODEL")
+	viper.BindEnv("moderation.endpoint", "MODERATION_ENDPOINT")
+	viper.BindEnv("moderation.api_key", "MODERATION_API_KEY")
+	viper.BindEnv("moderation.timeout", "MODERATION_TIMEOUT")
+	viper.BindEnv("moderation.fail_open", "MODERATION_FAIL_OPEN")
+
+	// Secrets
+	viper.BindEnv("secrets.refresh_interval", "SECRETS_REFRESH_INTERVAL")
+
+	// Notifications
+	viper.BindEnv("notifications.smtp_host", "SMTP_HOST")
+	viper.BindEnv("notifications.smtp_port", "SMTP_PORT")
+	viper.BindEnv("notifications.smtp_username", "SMTP_USERNAME")
+	viper.BindEnv("notifications.smtp_password", "SMTP_PASSWORD")
+	viper.BindEnv("notifications.email_from", "NOTIFICATION_EMAIL_FROM")
+	viper.BindEnv("notifications.webhook_timeout", "NOTIFICATION_WEBHOOK_TIMEOUT")
+	viper.BindEnv("notifications.allow_private_webhooks", "NOTIFICATION_ALLOW_PRIVATE_WEBHOOKS")
+
+	// Credits
+	viper.BindEnv("credits.default_expiry", "CREDIT_DEFAULT_EXPIRY")
+	viper.BindEnv("credits.referral_credit_usd", "REFERRAL_CREDIT_USD")
+	viper.BindEnv("credits.referrer_credit_usd", "REFERRER_CREDIT_USD")
+	viper.BindEnv("credits.max_referral_redemptions", "MAX_REFERRAL_REDEMPTIONS")
+
+	// Usage export
+	viper.BindEnv("usage_export.interval", "USAGE_EXPORT_INTERVAL")
+	viper.BindEnv("usage_export.batch_size", "USAGE_EXPORT_BATCH_SIZE")
+	viper.BindEnv("usage_export.settle_delay", "USAGE_EXPORT_SETTLE_DELAY")
+
+	// Privacy
+	viper.BindEnv("privacy.data_export_expiry", "DATA_EXPORT_EXPIRY")
+	viper.BindEnv("privacy.deletion_retention", "USER_DELETION_RETENTION")
+	viper.BindEnv("privacy.sweep_interval", "PRIVACY_SWEEP_INTERVAL")
+	viper.BindEnv("privacy.request_log_retention", "REQUEST_LOG_RETENTION")
+	viper.BindEnv("privacy.payload_retention", "REQUEST_PAYLOAD_RETENTION")
+	viper.BindEnv("privacy.retention_action", "REQUEST_LOG_RETENTION_ACTION")
+	viper.BindEnv("privacy.retention_interval", "REQUEST_LOG_RETENTION_INTERVAL")
+
+	// Scheduled jobs
+	viper.BindEnv("jobs.enabled", "JOBS_ENABLED")
+	viper.BindEnv("jobs.leader_lease", "JOB_LEADER_LEASE")
+
+	// Sessions
+	viper.BindEnv("sessions.max_context_tokens", "SESSION_MAX_CONTEXT_TOKENS")
+	viper.BindEnv("sessions.ttl", "SESSION_TTL")
+	viper.BindEnv("sessions.sweep_interval", "SESSION_SWEEP_INTERVAL")
+
+	// Provider cost reconciliation
+	viper.BindEnv("reconciliation.interval", "RECONCILIATION_INTERVAL")
+	viper.BindEnv("reconciliation.lookback_days", "RECONCILIATION_LOOKBACK_DAYS")
+	viper.BindEnv("reconciliation.threshold_percent", "RECONCILIATION_THRESHOLD_PERCENT")
+	viper.BindEnv("reconciliation.min_difference_usd", "RECONCILIATION_MIN_DIFFERENCE_USD")
+	viper.BindEnv("reconciliation.openai_admin_key", "OPENAI_ADMIN_API_KEY")
+
+	// Display currencies
+	viper.BindEnv("currency.currencies", "DISPLAY_CURRENCIES")
+	viper.BindEnv("currency.rates_url", "FX_RATES_URL")
+	viper.BindEnv("currency.refresh_interval", "FX_REFRESH_INTERVAL")
+
+	// Fault injection
+	viper.BindEnv("chaos.enabled", "CHAOS_ENABLED")
+	viper.BindEnv("chaos.seed", "CHAOS_SEED")
+	viper.BindEnv("chaos.providers", "CHAOS_PROVIDERS")
+	viper.BindEnv("chaos.delay_rate", "CHAOS_DELAY_RATE")
+	viper.BindEnv("chaos.delay", "CHAOS_DELAY")
+	viper.BindEnv("chaos.error_rate", "CHAOS_ERROR_RATE")
+	viper.BindEnv("chaos.error_status_codes", "CHAOS_ERROR_STATUS_CODES")
+	viper.BindEnv("chaos.truncate_rate", "CHAOS_TRUNCATE_RATE")
+	viper.BindEnv("chaos.truncate_after_bytes", "CHAOS_TRUNCATE_AFTER_BYTES")
+
+	// Development mode
+	viper.BindEnv("dev.enabled", "DEV_MODE")
+	viper.BindEnv("dev.fake_response", "DEV_FAKE_RESPONSE")
+	viper.BindEnv("dev.seed_paths", "DEV_SEED_PATHS")
 }
 
 // setDefaults sets default values for configuration
@@ -161,71 +779,629 @@ func setDefaults() {
 	// Server defaults
 	viper.SetDefault("server.port", 8080)
 	viper.SetDefault("server.env", "development")
+	viper.SetDefault("server.remote_ip_headers", []string{"X-Forwarded-For", "X-Real-IP"})
+	viper.SetDefault("server.max_request_body_bytes", 10<<20) // 10MB
+	viper.SetDefault("server.max_prompt_bytes", 4<<20)        // 4MB, about a million tokens
+	viper.SetDefault("server.compress_responses", true)
 
 	// Firebase defaults (will be overridden by environment variables)
 	viper.SetDefault("firebase.project_id", "aptrouter-44552")
+	viper.SetDefault("firebase.index_check", "warn")
+
+	// LLM defaults
+	viper.SetDefault("llm.token_counting", "local")
+	viper.SetDefault("llm.endpoint_stickiness", time.Duration(0))
+	viper.SetDefault("llm.key_selection", KeySelectionRoundRobin)
+	viper.SetDefault("llm.key_cooldown", time.Minute)
+	viper.SetDefault("llm.connectivity_check", "warn")
 
 	// Cache defaults
 	viper.SetDefault("cache.default_expiration", 5*time.Minute)
 	viper.SetDefault("cache.cleanup_interval", 10*time.Minute)
+	viper.SetDefault("cache.shared", false)
 
 	// Security defaults
-	viper.SetDefault("security.jwt_secret", "your-jwt-secret-change-in-production")
-	viper.SetDefault("security.api_key_salt", "your-api-key-salt-change-in-production")
+	viper.SetDefault("security.jwt_secret", defaultJWTSecret)
+	viper.SetDefault("security.api_key_salt", defaultAPIKeySalt)
+	viper.SetDefault("security.api_key_rotation_grace_period", 24*time.Hour)
+	viper.SetDefault("security.api_key_expiry_warning", 7*24*time.Hour)
+	viper.SetDefault("security.api_key_expiry_sweep_interval", 15*time.Minute)
+	viper.SetDefault("security.impersonation_token_ttl", 15*time.Minute)
 
 	// Logging defaults
 	viper.SetDefault("logging.level", "info")
 	viper.SetDefault("logging.format", "json")
+	viper.SetDefault("logging.request_payloads", false)
+	viper.SetDefault("logging.slow_request_threshold", 30*time.Second)
+	viper.SetDefault("logging.slow_request_snippet_bytes", 512)
 
 	// Rate limiting defaults
 	viper.SetDefault("rate_limit.requests_per_minute", 60)
 	viper.SetDefault("rate_limit.burst", 10)
+	viper.SetDefault("rate_limit.max_concurrent_per_key", 0)
+	viper.SetDefault("rate_limit.max_concurrent_per_user", 20)
+	viper.SetDefault("rate_limit.queue_size", 10)
+	viper.SetDefault("rate_limit.queue_timeout", 30*time.Second)
+	viper.SetDefault("rate_limit.provider_queue_timeout", 30*time.Second)
+	viper.SetDefault("rate_limit.repeated_failure_limit", 10)
+	viper.SetDefault("rate_limit.repeated_failure_window", time.Minute)
+	viper.SetDefault("rate_limit.repeated_failure_block", 5*time.Minute)
 
 	// Cost defaults
 	viper.SetDefault("cost.max_cost_per_request_usd", 10.0)
 	viper.SetDefault("cost.default_user_balance_usd", 100.0)
+	viper.SetDefault("cost.migrate_money_fields", false)
+	viper.SetDefault("cost.byok_billing_mode", "markup")
+	viper.SetDefault("cost.byok_flat_fee_usd", 0.0)
+	viper.SetDefault("cost.missing_usage_mode", "estimate")
 
 	// Optimization defaults
 	viper.SetDefault("optimization.enabled", true)
 	viper.SetDefault("optimization.fallback_on_optimization_failure", true)
+	viper.SetDefault("optimization.min_savings_percent", 10.0)
+	viper.SetDefault("optimization.quality_sample_rate", 0.0)
+	viper.SetDefault("optimization.quality_scorer", "similarity")
+	viper.SetDefault("optimization.quality_judge_model", "gpt-4o-mini")
+	viper.SetDefault("optimization.summary_max_tokens", 512)
+
+	// Billing defaults
+	viper.SetDefault("billing.min_top_up_usd", 5.0)
+	viper.SetDefault("billing.max_top_up_usd", 10000.0)
+	viper.SetDefault("billing.auto_top_up_cooldown", 10*time.Minute)
+
+	// Tracing defaults
+	viper.SetDefault("tracing.enabled", false)
+	viper.SetDefault("tracing.service_name", "aptrouter-api")
+	viper.SetDefault("tracing.sample_ratio", 1.0)
+
+	// Timeout defaults
+	viper.SetDefault("timeouts.provider", 2*time.Minute)
+	viper.SetDefault("timeouts.streaming", 8*time.Minute)
+	viper.SetDefault("timeouts.optimization", 30*time.Second)
+	viper.SetDefault("timeouts.max_request", 10*time.Minute)
+	viper.SetDefault("timeouts.stream_heartbeat", 15*time.Second)
+
+	// Vault defaults
+	viper.SetDefault("vault.master_key_id", "local-v1")
+
+	// Moderation defaults
+	viper.SetDefault("moderation.model", "omni-moderation-latest")
+	viper.SetDefault("moderation.timeout", 10*time.Second)
+	viper.SetDefault("moderation.fail_open", true)
+
+	// Secrets defaults
+	viper.SetDefault("secrets.refresh_interval", 5*time.Minute)
+
+	// Notification defaults
+	viper.SetDefault("notifications.smtp_port", 587)
+	viper.SetDefault("notifications.webhook_timeout", 10*time.Second)
+
+	// Credit defaults
+	viper.SetDefault("credits.default_expiry", 90*24*time.Hour)
+	viper.SetDefault("credits.referral_credit_usd", 0.0)
+	viper.SetDefault("credits.referrer_credit_usd", 0.0)
+	viper.SetDefault("credits.max_referral_redemptions", 50)
+
+	// Usage export defaults
+	viper.SetDefault("usage_export.interval", 30*time.Second)
+	viper.SetDefault("usage_export.batch_size", 100)
+	viper.SetDefault("usage_export.settle_delay", time.Minute)
+
+	// Privacy defaults
+	viper.SetDefault("privacy.data_export_expiry", 7*24*time.Hour)
+	viper.SetDefault("privacy.deletion_retention", 30*24*time.Hour)
+	viper.SetDefault("privacy.sweep_interval", time.Hour)
+	viper.SetDefault("privacy.request_log_retention", time.Duration(0))
+	viper.SetDefault("privacy.payload_retention", time.Duration(0))
+	viper.SetDefault("privacy.retention_action", RetentionDelete)
+	viper.SetDefault("privacy.retention_interval", time.Hour)
+
+	// Scheduled job defaults
+	viper.SetDefault("jobs.enabled", true)
+	viper.SetDefault("jobs.leader_lease", 30*time.Second)
+
+	// Session defaults
+	viper.SetDefault("sessions.max_context_tokens", 0)
+	viper.SetDefault("sessions.ttl", 30*24*time.Hour)
+	viper.SetDefault("sessions.sweep_interval", time.Hour)
+
+	// Provider cost reconciliation defaults
+	viper.SetDefault("reconciliation.interval", 24*time.Hour)
+	viper.SetDefault("reconciliation.lookback_days", 7)
+	viper.SetDefault("reconciliation.threshold_percent", 5.0)
+	viper.SetDefault("reconciliation.min_difference_usd", 1.0)
+
+	// Display currency defaults
+	viper.SetDefault("currency.currencies", []string{"EUR", "GBP", "JPY", "CAD", "AUD", "CHF", "INR"})
+	viper.SetDefault("currency.rates_url", "https://api.frankfurter.app/latest?from=USD")
+	viper.SetDefault("currency.refresh_interval", 6*time.Hour)
+
+	// Fault injection defaults
+	viper.SetDefault("chaos.enabled", false)
+	viper.SetDefault("chaos.delay", 5*time.Second)
+	viper.SetDefault("chaos.error_status_codes", []int{500, 503})
+	viper.SetDefault("chaos.truncate_after_bytes", 256)
+
+	// Development mode defaults
+	viper.SetDefault("dev.enabled", false)
+	viper.SetDefault("dev.seed_paths", []string{"seeds", "seeds/dev"})
 }
 
-// validateConfig validates the configuration
+// Placeholder secrets used as defaults so development works out of the box; they must be replaced in production
+const (
+	defaultJWTSecret  = "your-jwt-secret-change-in-production"
+	defaultAPIKeySalt = "your-api-key-salt-change-in-production"
+)
+
+// Minimum secret lengths required in production
+const (
+	minJWTSecretLength  = 32
+	minAPIKeySaltLength = 16
+)
+
+// kmsKeyPattern matches a Cloud KMS CryptoKey resource name
+var kmsKeyPattern = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+
+// validateConfig validates the configuration, reporting every problem rather than only the first
 func validateConfig(config *Config) error {
-	// Validate server port
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	// Validate server configuration
 	if config.Server.Port <= 0 || config.Server.Port > 65535 {
-		return fmt.Errorf("invalid server port: %d", config.Server.Port)
+		fail("invalid server port %d: set PORT to a value between 1 and 65535", config.Server.Port)
+	}
+
+	if config.Server.GRPCPort < 0 || config.Server.GRPCPort > 65535 {
+		fail("invalid gRPC port %d: set GRPC_PORT to a value between 1 and 65535, or 0 to disable gRPC", config.Server.GRPCPort)
+	} else if config.Server.GRPCPort != 0 && config.Server.GRPCPort == config.Server.Port {
+		fail("GRPC_PORT must differ from PORT")
+	}
+
+	if config.Server.MaxRequestBodyBytes <= 0 {
+		fail("MAX_REQUEST_BODY_BYTES must be positive")
+	}
+
+	if config.Server.MaxPromptBytes < 0 {
+		fail("MAX_PROMPT_BYTES must not be negative")
+	}
+
+	if _, err := config.PromptSunsetDate(); err != nil {
+		fail("invalid PROMPT_SUNSET %q: use YYYY-MM-DD", config.Server.PromptSunset)
+	}
+
+	// Development mode replaces Firestore and the providers, so needs neither's credentials
+	if config.Dev.Enabled && config.IsProduction() {
+		fail("DEV_MODE must not be enabled in production")
 	}
 
 	// Validate Firebase configuration
-	if config.Firebase.ProjectID == "" {
-		return fmt.Errorf("firebase project ID is required")
+	if config.Firebase.ProjectID == "" && !config.Dev.Enabled {
+		fail("firebase project ID is required: set FIREBASE_PROJECT_ID")
+	}
+
+	if path := config.Firebase.ServiceAccountPath; path != "" && !config.Firebase.UseCLIAuth && !config.Dev.Enabled {
+		if _, err := os.Stat(path); err != nil {
+			fail("firebase service account file %q is not readable: check FIREBASE_SERVICE_ACCOUNT_PATH or set FIREBASE_USE_CLI_AUTH=true", path)
+		}
 	}
 
 	// Validate required API keys (at least one should be present)
-	if config.LLM.GoogleAPIKey == "" && config.LLM.OpenAIAPIKey == "" && config.LLM.AnthropicAPIKey == "" {
-		return fmt.Errorf("at least one LLM API key is required")
+	if len(config.ProviderKeys("google")) == 0 && len(config.ProviderKeys("openai")) == 0 && len(config.ProviderKeys("anthropic")) == 0 && !config.Dev.Enabled {
+		fail("at least one LLM API key is required: set GOOGLE_API_KEY, OPENAI_API_KEY or ANTHROPIC_API_KEY")
+	}
+
+	if config.LLM.TokenCounting != "local" && config.LLM.TokenCounting != "provider" {
+		fail("invalid token counting mode %q: set TOKEN_COUNTING to local or provider", config.LLM.TokenCounting)
+	}
+
+	if _, err := config.LLM.ProviderEndpoints(); err != nil {
+		fail("%v", err)
+	}
+
+	if config.LLM.EndpointStickiness < 0 {
+		fail("PROVIDER_ENDPOINT_STICKINESS must not be negative")
+	}
+
+	if config.LLM.KeySelection != KeySelectionRoundRobin && config.LLM.KeySelection != KeySelectionLeastLoaded {
+		fail("invalid provider key selection %q: set PROVIDER_KEY_SELECTION to %s or %s", config.LLM.KeySelection, KeySelectionRoundRobin, KeySelectionLeastLoaded)
+	}
+
+	if config.LLM.KeyCooldown < 0 {
+		fail("PROVIDER_KEY_COOLDOWN must not be negative")
+	}
+
+	for _, provider := range []string{"openai", "anthropic", "google"} {
+		baseURL, proxy := config.LLM.ProviderNetwork(provider)
+		env := strings.ToUpper(provider)
+		if baseURL != "" {
+			if u, err := url.Parse(baseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				fail("%s_BASE_URL must be an http or https URL", env)
+			}
+		}
+		if proxy != "" {
+			if u, err := url.Parse(proxy); err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") || u.Host == "" {
+				fail("%s_PROXY must be an http, https or socks5 URL", env)
+			}
+		}
+	}
+
+	switch config.Firebase.IndexCheck {
+	case "off", "warn", "require":
+	default:
+		fail("invalid Firestore index check %q: set FIRESTORE_INDEX_CHECK to off, warn or require", config.Firebase.IndexCheck)
+	}
+
+	switch config.LLM.ConnectivityCheck {
+	case "off", "warn", "require":
+	default:
+		fail("invalid provider connectivity check %q: set PROVIDER_CONNECTIVITY_CHECK to off, warn or require", config.LLM.ConnectivityCheck)
 	}
 
 	// Validate security configuration
 	if config.Security.JWTSecret == "" {
-		return fmt.Errorf("JWT secret is required")
+		fail("JWT secret is required: set JWT_SECRET")
+	} else if config.IsProduction() && (config.Security.JWTSecret == defaultJWTSecret || len(config.Security.JWTSecret) < minJWTSecretLength) {
+		fail("JWT_SECRET must be replaced with a random secret of at least %d characters in production", minJWTSecretLength)
 	}
 
 	if config.Security.APIKeySalt == "" {
-		return fmt.Errorf("API key salt is required")
+		fail("API key salt is required: set API_KEY_SALT")
+	} else if config.IsProduction() && (config.Security.APIKeySalt == defaultAPIKeySalt || len(config.Security.APIKeySalt) < minAPIKeySaltLength) {
+		fail("API_KEY_SALT must be replaced with a random value of at least %d characters in production", minAPIKeySaltLength)
+	}
+
+	if config.Security.APIKeyRotationGracePeriod < 0 {
+		fail("API_KEY_ROTATION_GRACE_PERIOD must not be negative")
+	}
+	if config.Security.APIKeyExpiryWarning < 0 {
+		fail("API_KEY_EXPIRY_WARNING must not be negative")
+	}
+	if config.Security.APIKeyExpirySweepInterval < 0 {
+		fail("API_KEY_EXPIRY_SWEEP_INTERVAL must not be negative")
+	}
+
+	if config.Security.ImpersonationTokenTTL <= 0 || config.Security.ImpersonationTokenTTL > time.Hour {
+		fail("IMPERSONATION_TOKEN_TTL must be positive and at most 1h")
+	}
+
+	// Validate logging configuration
+	if !slices.Contains([]string{"debug", "info", "warn", "error"}, config.Logging.Level) {
+		fail("invalid log level %q: set LOG_LEVEL to debug, info, warn or error", config.Logging.Level)
+	}
+
+	if config.Logging.SlowRequestThreshold < 0 || config.Logging.SlowRequestSnippetBytes < 0 {
+		fail("SLOW_REQUEST_THRESHOLD and SLOW_REQUEST_SNIPPET_BYTES must not be negative")
 	}
 
 	// Validate cost configuration
 	if config.Cost.MaxCostPerRequestUSD <= 0 {
-		return fmt.Errorf("max cost per request must be positive")
+		fail("MAX_COST_PER_REQUEST_USD must be positive")
 	}
 
 	if config.Cost.DefaultUserBalanceUSD <= 0 {
-		return fmt.Errorf("default user balance must be positive")
+		fail("DEFAULT_USER_BALANCE_USD must be positive")
+	}
+
+	if config.Cost.BYOKBillingMode != "markup" && config.Cost.BYOKBillingMode != "flat" {
+		fail("invalid BYOK billing mode %q: set BYOK_BILLING_MODE to markup or flat", config.Cost.BYOKBillingMode)
+	}
+
+	if config.Cost.BYOKFlatFeeUSD < 0 {
+		fail("BYOK_FLAT_FEE_USD must not be negative")
+	}
+
+	if config.Cost.MissingUsageMode != "estimate" && config.Cost.MissingUsageMode != "none" {
+		fail("invalid missing usage mode %q: set MISSING_USAGE_BILLING to estimate or none", config.Cost.MissingUsageMode)
+	}
+
+	// Validate billing configuration
+	if config.Billing.StripeSecretKey != "" {
+		if config.Billing.StripeWebhookSecret == "" {
+			fail("stripe webhook secret is required when stripe is enabled: set STRIPE_WEBHOOK_SECRET")
+		}
+		if config.Billing.CheckoutSuccessURL == "" || config.Billing.CheckoutCancelURL == "" {
+			fail("checkout redirect URLs are required when stripe is enabled: set BILLING_CHECKOUT_SUCCESS_URL and BILLING_CHECKOUT_CANCEL_URL")
+		}
+	}
+
+	if config.Billing.MinTopUpUSD <= 0 || config.Billing.MaxTopUpUSD < config.Billing.MinTopUpUSD {
+		fail("invalid top-up limits: min %.2f, max %.2f", config.Billing.MinTopUpUSD, config.Billing.MaxTopUpUSD)
+	}
+
+	if config.Optimization.MinSavingsPercent < 0 || config.Optimization.MinSavingsPercent > 100 {
+		fail("OPTIMIZATION_MIN_SAVINGS_PERCENT must be between 0 and 100")
+	}
+
+	if config.Optimization.QualitySampleRate < 0 || config.Optimization.QualitySampleRate > 1 {
+		fail("OPTIMIZATION_QUALITY_SAMPLE_RATE must be between 0 and 1")
+	}
+
+	if config.Optimization.QualityScorer != "similarity" && config.Optimization.QualityScorer != "judge" {
+		fail("invalid quality scorer %q: set OPTIMIZATION_QUALITY_SCORER to similarity or judge", config.Optimization.QualityScorer)
+	}
+
+	if config.Optimization.SummaryMaxTokens < 1 {
+		fail("OPTIMIZATION_SUMMARY_MAX_TOKENS must be positive")
+	}
+
+	// Validate tracing configuration
+	if config.Tracing.SampleRatio < 0 || config.Tracing.SampleRatio > 1 {
+		fail("TRACING_SAMPLE_RATIO must be between 0 and 1")
+	}
+
+	// Validate timeouts
+	if config.Timeouts.Provider <= 0 || config.Timeouts.Streaming <= 0 || config.Timeouts.Optimization <= 0 {
+		fail("PROVIDER_TIMEOUT, STREAMING_TIMEOUT and OPTIMIZATION_TIMEOUT must be positive")
+	}
+
+	if config.Timeouts.MaxRequest < config.Timeouts.Provider || config.Timeouts.MaxRequest < config.Timeouts.Streaming {
+		fail("MAX_REQUEST_TIMEOUT %s must not be shorter than the default provider and streaming timeouts", config.Timeouts.MaxRequest)
+	}
+
+	if config.Timeouts.StreamHeartbeat < 0 {
+		fail("STREAM_HEARTBEAT_INTERVAL must not be negative")
+	}
+
+	// Validate moderation configuration
+	switch config.Moderation.Provider {
+	case "":
+	case "openai":
+		if config.Moderation.APIKey == "" && config.LLM.OpenAIAPIKey == "" {
+			fail("the openai moderation provider needs MODERATION_API_KEY or OPENAI_API_KEY")
+		}
+	case "http":
+		if config.Moderation.Endpoint == "" {
+			fail("moderation endpoint is required for the http moderation provider: set MODERATION_ENDPOINT")
+		}
+	default:
+		fail("invalid moderation provider %q: set MODERATION_PROVIDER to openai or http", config.Moderation.Provider)
+	}
+
+	if config.Moderation.Provider != "" && config.Moderation.Timeout <= 0 {
+		fail("MODERATION_TIMEOUT must be positive")
+	}
+
+	// Validate concurrency limits
+	if config.RateLimit.MaxConcurrentPerKey < 0 || config.RateLimit.MaxConcurrentPerUser < 0 || config.RateLimit.QueueSize < 0 {
+		fail("MAX_CONCURRENT_PER_KEY, MAX_CONCURRENT_PER_USER and CONCURRENCY_QUEUE_SIZE must not be negative")
+	}
+
+	if config.RateLimit.QueueSize > 0 && config.RateLimit.QueueTimeout <= 0 {
+		fail("CONCURRENCY_QUEUE_TIMEOUT must be positive when CONCURRENCY_QUEUE_SIZE is set")
+	}
+
+	for provider, limit := range config.RateLimit.Providers {
+		if limit.RequestsPerMinute < 0 || limit.TokensPerMinute < 0 {
+			fail("%s request and token rate limits must not be negative", provider)
+		}
+	}
+
+	if config.RateLimit.ProviderQueueTimeout < 0 {
+		fail("PROVIDER_QUEUE_TIMEOUT must not be negative")
+	}
+
+	if config.RateLimit.RepeatedFailureLimit < 0 {
+		fail("REPEATED_FAILURE_LIMIT must not be negative")
+	} else if config.RateLimit.RepeatedFailureLimit > 0 && (config.RateLimit.RepeatedFailureWindow <= 0 || config.RateLimit.RepeatedFailureBlock <= 0) {
+		fail("REPEATED_FAILURE_WINDOW and REPEATED_FAILURE_BLOCK must be positive when REPEATED_FAILURE_LIMIT is set")
+	}
+
+	// Validate notification configuration
+	if config.Notifications.SMTPHost != "" && config.Notifications.EmailFrom == "" {
+		fail("sender address is required for email notifications: set NOTIFICATION_EMAIL_FROM")
+	}
+
+	if config.Notifications.WebhookTimeout <= 0 {
+		fail("NOTIFICATION_WEBHOOK_TIMEOUT must be positive")
+	}
+
+	// Validate credit configuration
+	if config.Credits.DefaultExpiry <= 0 {
+		fail("CREDIT_DEFAULT_EXPIRY must be positive")
 	}
 
-	return nil
+	if config.Credits.ReferralCreditUSD < 0 || config.Credits.ReferrerCreditUSD < 0 || config.Credits.MaxReferralRedemptions < 0 {
+		fail("REFERRAL_CREDIT_USD, REFERRER_CREDIT_USD and MAX_REFERRAL_REDEMPTIONS must not be negative")
+	}
+
+	// Validate usage export configuration
+	if config.UsageExport.Interval < 0 || config.UsageExport.SettleDelay < 0 {
+		fail("USAGE_EXPORT_INTERVAL and USAGE_EXPORT_SETTLE_DELAY must not be negative")
+	}
+
+	if config.UsageExport.BatchSize < 1 || config.UsageExport.BatchSize > 1000 {
+		fail("USAGE_EXPORT_BATCH_SIZE must be between 1 and 1000")
+	}
+
+	// Validate privacy configuration
+	if config.Privacy.DataExportExpiry <= 0 {
+		fail("DATA_EXPORT_EXPIRY must be positive")
+	}
+	if config.Privacy.DeletionRetention < 0 || config.Privacy.SweepInterval < 0 {
+		fail("USER_DELETION_RETENTION and PRIVACY_SWEEP_INTERVAL must not be negative")
+	}
+	if config.Privacy.RequestLogRetention < 0 || config.Privacy.PayloadRetention < 0 || config.Privacy.RetentionInterval < 0 {
+		fail("REQUEST_LOG_RETENTION, REQUEST_PAYLOAD_RETENTION and REQUEST_LOG_RETENTION_INTERVAL must not be negative")
+	}
+	if config.Privacy.RetentionAction != RetentionDelete && config.Privacy.RetentionAction != RetentionAnonymize {
+		fail("REQUEST_LOG_RETENTION_ACTION must be delete or anonymize")
+	}
+
+	// Validate scheduled job configuration
+	if config.Jobs.Enabled && config.Jobs.LeaderLease < 3*time.Second {
+		fail("JOB_LEADER_LEASE must be at least 3s")
+	}
+
+	// Validate session configuration
+	if config.Sessions.MaxContextTokens < 0 || config.Sessions.SweepInterval < 0 {
+		fail("SESSION_MAX_CONTEXT_TOKENS and SESSION_SWEEP_INTERVAL must not be negative")
+	}
+	if config.Sessions.TTL <= 0 {
+		fail("SESSION_TTL must be positive")
+	}
+
+	// Validate provider cost reconciliation configuration
+	if config.Reconciliation.Interval < 0 {
+		fail("RECONCILIATION_INTERVAL must not be negative")
+	}
+	if config.Reconciliation.LookbackDays < 1 {
+		fail("RECONCILIATION_LOOKBACK_DAYS must be at least 1")
+	}
+	if config.Reconciliation.ThresholdPercent < 0 || config.Reconciliation.MinDifferenceUSD < 0 {
+		fail("RECONCILIATION_THRESHOLD_PERCENT and RECONCILIATION_MIN_DIFFERENCE_USD must not be negative")
+	}
+
+	// Validate display currency configuration
+	for _, currency := range config.Currency.Currencies {
+		if len(currency) != 3 || strings.ToUpper(currency) != currency || currency == "USD" {
+			fail("DISPLAY_CURRENCIES must hold upper-case ISO 4217 codes other than USD, got %q", currency)
+		}
+	}
+	if config.Currency.RefreshInterval < 0 {
+		fail("FX_REFRESH_INTERVAL must not be negative")
+	}
+	if config.Currency.RefreshInterval > 0 && len(config.Currency.Currencies) > 0 {
+		if u, err := url.Parse(config.Currency.RatesURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			fail("FX_RATES_URL must be an http or https URL")
+		}
+	}
+
+	// Validate fault injection configuration
+	if config.Chaos.Enabled {
+		if config.IsProduction() {
+			fail("CHAOS_ENABLED must not be enabled in production")
+		}
+		rates := []float64{config.Chaos.DelayRate, config.Chaos.ErrorRate, config.Chaos.TruncateRate}
+		if slices.ContainsFunc(rates, func(rate float64) bool { return rate < 0 || rate > 1 }) {
+			fail("CHAOS_DELAY_RATE, CHAOS_ERROR_RATE and CHAOS_TRUNCATE_RATE must be between 0 and 1")
+		}
+		if config.Chaos.Delay < 0 {
+			fail("CHAOS_DELAY must not be negative")
+		}
+		if config.Chaos.ErrorRate > 0 && len(config.Chaos.ErrorStatusCodes) == 0 {
+			fail("CHAOS_ERROR_STATUS_CODES is required when CHAOS_ERROR_RATE is set")
+		}
+		for _, code := range config.Chaos.ErrorStatusCodes {
+			if code < 400 || code > 599 {
+				fail("invalid CHAOS_ERROR_STATUS_CODES status %d: must be between 400 and 599", code)
+			}
+		}
+		if config.Chaos.TruncateAfterBytes < 0 {
+			fail("CHAOS_TRUNCATE_AFTER_BYTES must not be negative")
+		}
+	}
+
+	// Validate vault configuration
+	if config.Vault.MasterKey != "" {
+		key, err := base64.StdEncoding.DecodeString(config.Vault.MasterKey)
+		if err != nil || len(key) != 32 {
+			fail("BYOK_MASTER_KEY must be 32 bytes, base64 encoded")
+		}
+	}
+	if config.Vault.KMSKey != "" && !kmsKeyPattern.MatchString(config.Vault.KMSKey) {
+		fail("BYOK_KMS_KEY must be a CryptoKey name: projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>")
+	}
+	if config.Vault.PreviousKMSKey != "" && !kmsKeyPattern.MatchString(config.Vault.PreviousKMSKey) {
+		fail("BYOK_PREVIOUS_KMS_KEY must be a CryptoKey name: projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>")
+	}
+	if config.Vault.PreviousMasterKey != "" {
+		key, err := base64.StdEncoding.DecodeString(config.Vault.PreviousMasterKey)
+		if err != nil || len(key) != 32 {
+			fail("BYOK_PREVIOUS_MASTER_KEY must be 32 bytes, base64 encoded")
+		}
+		if config.Vault.PreviousMasterKeyID == "" || config.Vault.PreviousMasterKeyID == config.Vault.MasterKeyID {
+			fail("BYOK_PREVIOUS_MASTER_KEY_ID must be set and differ from BYOK_MASTER_KEY_ID")
+		}
+	}
+	if (config.Vault.PreviousKMSKey != "" || config.Vault.PreviousMasterKey != "") && config.Vault.KMSKey == "" && config.Vault.MasterKey == "" {
+		fail("a previous vault key is set without a current one: set BYOK_KMS_KEY or BYOK_MASTER_KEY")
+	}
+
+	return errors.Join(errs...)
+}
+
+// Warnings lists settings that are valid but leave features disabled or insecure, for startup diagnostics
+func (c *Config) Warnings() []string {
+	var warnings []string
+
+	if c.Security.JWTSecret == defaultJWTSecret || len(c.Security.JWTSecret) < minJWTSecretLength {
+		warnings = append(warnings, fmt.Sprintf("JWT_SECRET is a placeholder or shorter than %d characters; it will be rejected in production", minJWTSecretLength))
+	}
+	if c.Security.APIKeySalt == defaultAPIKeySalt || len(c.Security.APIKeySalt) < minAPIKeySaltLength {
+		warnings = append(warnings, fmt.Sprintf("API_KEY_SALT is a placeholder or shorter than %d characters; it will be rejected in production", minAPIKeySaltLength))
+	}
+	if c.Dev.Enabled {
+		warnings = append(warnings, "DEV_MODE is enabled; data is kept in memory, providers are faked and prompts are not optimized")
+	} else if c.Optimization.Enabled && c.LLM.GoogleAPIKey == "" {
+		warnings = append(warnings, "optimization is enabled but GOOGLE_API_KEY is not set; requests will run unoptimized")
+	}
+	if c.Cost.MissingUsageMode == "none" {
+		warnings = append(warnings, "MISSING_USAGE_BILLING is none; streams whose provider reports no usage are not billed")
+	}
+	if c.Billing.StripeSecretKey == "" {
+		warnings = append(warnings, "STRIPE_SECRET_KEY is not set; balance top-ups are disabled")
+	}
+	if c.Vault.KMSKey == "" && c.Vault.MasterKey == "" {
+		warnings = append(warnings, "neither BYOK_KMS_KEY nor BYOK_MASTER_KEY is set; stored provider keys are disabled")
+	}
+	if c.Notifications.SMTPHost == "" {
+		warnings = append(warnings, "SMTP_HOST is not set; email notifications are disabled")
+	}
+	if len(c.Security.AdminUserIDs) == 0 {
+		warnings = append(warnings, "ADMIN_USER_IDS is not set; admin endpoints are unavailable")
+	}
+	if c.Chaos.Enabled {
+		warnings = append(warnings, "CHAOS_ENABLED is set; faults are injected into provider calls")
+	}
+
+	return warnings
+}
+
+// Redacted returns the configuration keyed by setting name, with secrets masked, for diagnostics
+func (c *Config) Redacted() map[string]interface{} {
+	return redactedSettings(reflect.ValueOf(c).Elem())
+}
+
+// redactedSettings converts a config struct to a map keyed by its mapstructure names, masking
+// fields tagged secret:"true"
+func redactedSettings(v reflect.Value) map[string]interface{} {
+	settings := make(map[string]interface{}, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Tag.Get("mapstructure")
+		value := v.Field(i)
+
+		switch {
+		case field.Tag.Get("secret") == "true":
+			settings[name] = redactSecret(value.String())
+		case value.Kind() == reflect.Struct && field.Type != reflect.TypeOf(time.Time{}):
+			settings[name] = redactedSettings(value)
+		case field.Type == reflect.TypeOf(time.Duration(0)):
+			settings[name] = value.Interface().(time.Duration).String()
+		default:
+			settings[name] = value.Interface()
+		}
+	}
+	return settings
+}
+
+// redactSecret reports whether a secret is set without revealing it
+func redactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "[REDACTED]"
+}
+
+// IsAdmin reports whether a user may use the platform admin endpoints
+func (c *Config) IsAdmin(userID string) bool {
+	return userID != "" && slices.Contains(c.Security.AdminUserIDs, userID)
 }
 
 // GetPort returns the server port as a string
@@ -242,3 +1418,12 @@ func (c *Config) IsDevelopment() bool {
 func (c *Config) IsProduction() bool {
 	return c.Server.Env == "production"
 }
+
+// PromptSunsetDate returns the sunset date of the v1 flat prompt field, or the zero time when
+// none is set
+func (c *Config) PromptSunsetDate() (time.Time, error) {
+	if c.Server.PromptSunset == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.DateOnly, c.Server.PromptSunset)
+}
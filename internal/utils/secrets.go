@@ -0,0 +1,236 @@
+package utils
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/api/option"
+	secretmanager "google.golang.org/api/secretmanager/v1"
+)
+
+// Secret reference prefixes accepted in place of a secret's value
+const (
+	// secretManagerPrefix reads a GCP Secret Manager secret: sm://NAME uses the latest version in the
+	// Firebase project, sm://projects/PROJECT/secrets/NAME/versions/VERSION names one exactly
+	secretManagerPrefix = "sm://"
+	// secretFilePrefix reads a mounted file, e.g. file:///var/run/secrets/jwt_secret
+	secretFilePrefix = "file://"
+)
+
+// secretResolveTimeout bounds loading every referenced secret
+const secretResolveTimeout = 30 * time.Second
+
+// SecretsConfig holds how referenced secrets are reloaded
+type SecretsConfig struct {
+	// RefreshInterval is how often referenced provider API keys are reloaded to pick up rotations; 0 disables reloads
+	RefreshInterval time.Duration `mapstructure:"refresh_interval"`
+}
+
+// isSecretReference reports whether a setting refers to a secret stored elsewhere
+func isSecretReference(value string) bool {
+	return strings.HasPrefix(value, secretManagerPrefix) || strings.HasPrefix(value, secretFilePrefix)
+}
+
+// secretResolver reads referenced secrets, creating the Secret Manager client on first use
+type secretResolver struct {
+	projectID       string
+	credentialsFile string
+	client          *secretmanager.Service
+}
+
+// resolve returns the value a reference points to
+func (r *secretResolver) resolve(ctx context.Context, reference string) (string, error) {
+	if path, ok := strings.CutPrefix(reference, secretFilePrefix); ok {
+		value, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret file: %w", err)
+		}
+		return strings.TrimSpace(string(value)), nil
+	}
+
+	name := strings.TrimPrefix(reference, secretManagerPrefix)
+	if !strings.HasPrefix(name, "projects/") {
+		name = fmt.Sprintf("projects/%s/secrets/%s", r.projectID, name)
+	}
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+
+	if r.client == nil {
+		var opts []option.ClientOption
+		if r.credentialsFile != "" {
+			opts = append(opts, option.WithCredentialsFile(r.credentialsFile))
+		}
+		client, err := secretmanager.NewService(ctx, opts...)
+		if err != nil {
+			return "", fmt.Errorf("failed to create secret manager client: %w", err)
+		}
+		r.client = client
+	}
+
+	resp, err := r.client.Projects.Secrets.Versions.Access(name).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to access secret %s: %w", name, err)
+	}
+	value, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode secret %s: %w", name, err)
+	}
+	return strings.TrimSpace(string(value)), nil
+}
+
+// resolveSecrets replaces every secret setting holding a reference with the secret's value,
+// remembering the references so they can be reloaded
+func (c *Config) resolveSecrets(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, secretResolveTimeout)
+	defer cancel()
+
+	credentialsFile := ""
+	if !c.Firebase.UseCLIAuth {
+		credentialsFile = c.Firebase.ServiceAccountPath
+	}
+	c.resolver = &secretResolver{projectID: c.Firebase.ProjectID, credentialsFile: credentialsFile}
+	c.secretRefs = make(map[string]string)
+
+	return walkSecrets(reflect.ValueOf(c).Elem(), "", func(path string, field reflect.Value) error {
+		reference := field.String()
+		if !isSecretReference(reference) {
+			return nil
+		}
+
+		value, err := c.resolver.resolve(ctx, reference)
+		if err != nil {
+			return fmt.Errorf("failed to load %s: %w", path, err)
+		}
+		c.secretRefs[path] = reference
+		field.SetString(value)
+		return nil
+	})
+}
+
+// walkSecrets calls fn with the mapstructure path of every field tagged secret:"true"
+func walkSecrets(v reflect.Value, prefix string, fn func(path string, field reflect.Value) error) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		path := prefix + field.Tag.Get("mapstructure")
+
+		switch {
+		case field.Tag.Get("secret") == "true":
+			if err := fn(path, v.Field(i)); err != nil {
+				return err
+			}
+		case field.Type.Kind() == reflect.Struct:
+			if err := walkSecrets(v.Field(i), path+".", fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ProviderKey returns the platform API key for an LLM provider: its single key, or the first of
+// its pooled keys. Keys loaded from references can change while the server runs, so they are read
+// under a lock.
+func (c *Config) ProviderKey(provider string) string {
+	if keys := c.ProviderKeys(provider); len(keys) > 0 {
+		return keys[0]
+	}
+	return ""
+}
+
+// ProviderKeys returns every platform API key for an LLM provider, its single key first and
+// without duplicates
+func (c *Config) ProviderKeys(provider string) []string {
+	c.secretsMu.RLock()
+	defer c.secretsMu.RUnlock()
+
+	var key, pooled string
+	switch provider {
+	case "google":
+		key, pooled = c.LLM.GoogleAPIKey, c.LLM.GoogleAPIKeys
+	case "openai":
+		key, pooled = c.LLM.OpenAIAPIKey, c.LLM.OpenAIAPIKeys
+	case "anthropic":
+		key, pooled = c.LLM.AnthropicAPIKey, c.LLM.AnthropicAPIKeys
+	default:
+		return nil
+	}
+
+	var keys []string
+	for _, k := range append([]string{key}, strings.Split(pooled, ",")...) {
+		k = strings.TrimSpace(k)
+		if k != "" && !slices.Contains(keys, k) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// WatchSecrets reloads referenced provider API keys every refresh interval until ctx is done.
+// Other secrets are only loaded at startup: the API key salt in particular must never change
+// under a running server, since stored key hashes depend on it.
+func (c *Config) WatchSecrets(ctx context.Context) {
+	providers := map[string]*string{
+		"llm.google_api_key":     &c.LLM.GoogleAPIKey,
+		"llm.openai_api_key":     &c.LLM.OpenAIAPIKey,
+		"llm.anthropic_api_key":  &c.LLM.AnthropicAPIKey,
+		"llm.google_api_keys":    &c.LLM.GoogleAPIKeys,
+		"llm.openai_api_keys":    &c.LLM.OpenAIAPIKeys,
+		"llm.anthropic_api_keys": &c.LLM.AnthropicAPIKeys,
+	}
+
+	watched := make(map[string]string)
+	for path := range providers {
+		if reference, ok := c.secretRefs[path]; ok {
+			watched[path] = reference
+		}
+	}
+	if len(watched) == 0 || c.Secrets.RefreshInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(c.Secrets.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for path, reference := range watched {
+			resolveCtx, cancel := context.WithTimeout(ctx, secretResolveTimeout)
+			value, err := c.resolver.resolve(resolveCtx, reference)
+			cancel()
+			if err != nil {
+				// Keep serving with the current key; the next tick retries
+				slog.Warn("Failed to reload secret", "setting", path, "error", err)
+				continue
+			}
+			if value == "" {
+				slog.Warn("Ignoring empty reloaded secret", "setting", path)
+				continue
+			}
+
+			c.secretsMu.Lock()
+			changed := *providers[path] != value
+			*providers[path] = value
+			c.secretsMu.Unlock()
+
+			if changed {
+				slog.Info("Secret rotated", "setting", path)
+			}
+		}
+	}
+}